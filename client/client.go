@@ -0,0 +1,721 @@
+// Package client is a Go client for the mailescrow REST API. Applications
+// submit outbound mail for review and receive approved inbound mail through
+// typed calls; requests are retried on transient failures where doing so is
+// safe, and authenticated with an API token.
+//
+//	c := client.New("http://localhost:8081")
+//	c.SetToken(os.Getenv("MAILESCROW_TOKEN"))
+//	sub, err := c.Submit(ctx, client.Message{To: []string{"bob@example.com"}, Subject: "Hi", Body: "Hello"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defaults for SetRetries.
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 500 * time.Millisecond
+)
+
+// Client calls a mailescrow API server. Create one with New; it is safe for
+// concurrent use once configured.
+type Client struct {
+	baseURL string // API, e.g. "http://localhost:8081"
+	token   string // sent as a bearer token if set
+	http    *http.Client
+	retries int
+	backoff time.Duration // first retry delay, doubled for each further one
+
+	webURL      string // web UI, for Approve and Reject
+	webUser     string // HTTP Basic Auth username, recorded as the reviewer
+	webPassword string
+}
+
+// New creates a Client for the API at baseURL, e.g. "http://localhost:8081".
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{},
+		retries: DefaultRetries,
+		backoff: DefaultBackoff,
+	}
+}
+
+// SetToken authenticates API requests with token, created on the web UI's
+// Tokens page or through /api/tokens.
+func (c *Client) SetToken(token string) {
+	c.token = token
+}
+
+// SetHTTPClient replaces the HTTP client, e.g. to set a timeout or TLS
+// configuration.
+func (c *Client) SetHTTPClient(h *http.Client) {
+	c.http = h
+}
+
+// SetRetries sets how many times a failed request is retried and the delay
+// before the first retry, which doubles for each further one. A Retry-After
+// header from the server takes precedence. n = 0 disables retries.
+func (c *Client) SetRetries(n int, backoff time.Duration) {
+	c.retries = n
+	c.backoff = backoff
+}
+
+// SetReviewer enables Approve and Reject, which act through the web UI at
+// webURL (e.g. "http://localhost:8080") as a human reviewer would. username
+// is recorded as the reviewer; password is the web UI password, if any.
+func (c *Client) SetReviewer(webURL, username, password string) {
+	c.webURL = strings.TrimSuffix(webURL, "/")
+	c.webUser = username
+	c.webPassword = password
+}
+
+// Error is a request the server answered with an error status.
+type Error struct {
+	StatusCode int
+	Message    string   // the server's error text
+	Fields     []string // per-field problems, for invalid requests
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("mailescrow: %d %s", e.StatusCode, e.Message)
+	if len(e.Fields) > 0 {
+		msg += " (" + strings.Join(e.Fields, "; ") + ")"
+	}
+	return msg
+}
+
+// ErrUnauthorized is matched, with errors.Is, by errors for requests refused
+// for a missing, invalid or insufficiently scoped token, or wrong reviewer
+// credentials.
+var ErrUnauthorized = errors.New("mailescrow: unauthorized")
+
+// ErrAlreadyHandled is matched, with errors.Is, by errors from Approve and
+// Reject when another reviewer decided on the email first; the error's
+// Message says who.
+var ErrAlreadyHandled = errors.New("mailescrow: email already handled")
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrAlreadyHandled:
+		return e.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+// Message is an outbound email for Submit.
+type Message struct {
+	To       []string
+	Subject  string
+	Body     string
+	HTMLBody string            // sent with Body as multipart/alternative; may be alone
+	Headers  map[string]string // extra headers, e.g. List-Unsubscribe
+	Identity string            // configured identity to send as; empty for the relay account
+
+	// IdempotencyKey identifies the submission across retries. When empty a
+	// random key is used, so Submit's own retries never create duplicates.
+	IdempotencyKey string
+}
+
+// Submission is the server's answer to Submit and SubmitRaw.
+type Submission struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"` // "pending", or "sent" when relayed without review
+	Replayed bool   `json:"-"`      // answered from an earlier request with the same idempotency key
+}
+
+// messageRequest is the JSON of a Message.
+type messageRequest struct {
+	To       []string          `json:"to"`
+	Subject  string            `json:"subject"`
+	Body     string            `json:"body"`
+	HTMLBody string            `json:"html_body,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Identity string            `json:"identity,omitempty"`
+}
+
+func (m Message) request() messageRequest {
+	return messageRequest{m.To, m.Subject, m.Body, m.HTMLBody, m.Headers, m.Identity}
+}
+
+// Submit holds an email for review.
+func (c *Client) Submit(ctx context.Context, m Message) (Submission, error) {
+	body, err := json.Marshal(m.request())
+	if err != nil {
+		return Submission{}, fmt.Errorf("encode message: %w", err)
+	}
+	return c.submit(ctx, "/api/v1/emails", "application/json", body, m.IdempotencyKey)
+}
+
+// MaxBatch is the most messages SubmitBatch takes at once.
+const MaxBatch = 100
+
+// BatchResult is the outcome of one message of SubmitBatch.
+type BatchResult struct {
+	Submission
+	Err error // the *Error submitting the message alone would have returned; nil on success
+}
+
+// SubmitBatch holds up to MaxBatch emails for review in one request and
+// returns a result for each, in order. Each is submitted on its own, so one
+// that is refused does not stop the others. A batch carries no idempotency
+// key, so it is not retried and the messages' IdempotencyKey is ignored.
+func (c *Client) SubmitBatch(ctx context.Context, ms []Message) ([]BatchResult, error) {
+	emails := make([]messageRequest, 0, len(ms))
+	for _, m := range ms {
+		emails = append(emails, m.request())
+	}
+	body, err := json.Marshal(struct {
+		Emails []messageRequest `json:"emails"`
+	}{emails})
+	if err != nil {
+		return nil, fmt.Errorf("encode batch: %w", err)
+	}
+	resp, err := c.do(ctx, false, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/emails/batch", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var batch struct {
+		Results []struct {
+			Submission
+			Error *struct {
+				Status  int    `json:"status"`
+				Message string `json:"message"`
+				Fields  []struct {
+					Field   string `json:"field"`
+					Message string `json:"message"`
+				} `json:"fields"`
+			} `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("decode batch: %w", err)
+	}
+	results := make([]BatchResult, 0, len(batch.Results))
+	for _, r := range batch.Results {
+		res := BatchResult{Submission: r.Submission}
+		if e := r.Error; e != nil {
+			apiErr := &Error{StatusCode: e.Status, Message: e.Message}
+			for _, f := range e.Fields {
+				apiErr.Fields = append(apiErr.Fields, f.Field+": "+f.Message)
+			}
+			res.Err = apiErr
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// SubmitRaw holds a complete RFC 5322 message for review; it is relayed as
+// submitted once approved. idempotencyKey may be empty, as for Submit.
+func (c *Client) SubmitRaw(ctx context.Context, raw []byte, idempotencyKey string) (Submission, error) {
+	return c.submit(ctx, "/api/v1/emails/raw", "message/rfc822", raw, idempotencyKey)
+}
+
+func (c *Client) submit(ctx context.Context, path, contentType string, body []byte, key string) (Submission, error) {
+	if key == "" {
+		key = uuid.New().String()
+	}
+	var sub Submission
+	resp, err := c.do(ctx, true, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Idempotency-Key", key)
+		return req, nil
+	})
+	if err != nil {
+		return Submission{}, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&sub); err != nil {
+		return Submission{}, fmt.Errorf("decode submission: %w", err)
+	}
+	sub.Replayed = resp.Header.Get("Idempotent-Replayed") == "true"
+	return sub, nil
+}
+
+// Email is an approved inbound email.
+type Email struct {
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Subject     string    `json:"subject"`
+	Body        string    `json:"body"`
+	Snippet     string    `json:"snippet"` // one-line summary of Body without quoted replies and signatures
+	ReceivedAt  time.Time `json:"received_at"`
+	Queue       string    `json:"queue,omitempty"`
+	DeliveredTo string    `json:"delivered_to,omitempty"` // envelope recipient, for mail to a catch-all address
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+// FetchOptions narrow FetchApproved and WatchEvents.
+type FetchOptions struct {
+	Queue string        // only mail routed to this queue; empty for every queue
+	Tag   string        // only mail with this tag
+	Wait  time.Duration // long-poll up to this long (the server caps it) when nothing is approved yet
+
+	// AfterCheckpoint returns only mail approved since the client's token
+	// last read the queue this way, for servers that keep fetched mail
+	// (api.consume_mode: keep) for several consumers. Needs a token; not
+	// combined with Tag.
+	AfterCheckpoint bool
+}
+
+// FetchApproved returns approved inbound email, or none. The server deletes
+// what it returns, or with AfterCheckpoint moves the token's checkpoint past
+// it, so the request is not retried after a transport error: the emails may
+// already have been handed over.
+func (c *Client) FetchApproved(ctx context.Context, opts FetchOptions) ([]Email, error) {
+	q := url.Values{}
+	if opts.Queue != "" {
+		q.Set("queue", opts.Queue)
+	}
+	if opts.Tag != "" {
+		q.Set("tag", opts.Tag)
+	}
+	if opts.Wait > 0 {
+		q.Set("wait", opts.Wait.String())
+	}
+	if opts.AfterCheckpoint {
+		q.Set("after_checkpoint", "true")
+	}
+	u := c.baseURL + "/api/v1/emails"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	resp, err := c.do(ctx, false, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var emails []Email
+	if err := json.NewDecoder(resp.Body).Decode(&emails); err != nil {
+		return nil, fmt.Errorf("decode emails: %w", err)
+	}
+	return emails, nil
+}
+
+// PendingCount returns how many emails are waiting for review.
+func (c *Client) PendingCount(ctx context.Context) (int, error) {
+	resp, err := c.do(ctx, true, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/v1/emails/pending/count", nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("decode count: %w", err)
+	}
+	return body.Count, nil
+}
+
+// Statuses ListByStatus accepts. Rejected, sent and bounced mail is no longer
+// held, so only what its decision recorded is known of it.
+const (
+	StatusPending   = "pending"
+	StatusScheduled = "scheduled"
+	StatusApproved  = "approved"
+	StatusRejected  = "rejected"
+	StatusSent      = "sent"
+	StatusBounced   = "bounced"
+)
+
+// StatusEmail is an email listed by ListByStatus.
+type StatusEmail struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	Direction   string    `json:"direction"` // "outbound" or "inbound"
+	From        string    `json:"from"`
+	To          []string  `json:"to,omitempty"` // held mail only
+	Subject     string    `json:"subject"`
+	Snippet     string    `json:"snippet,omitempty"`
+	Queue       string    `json:"queue,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	ReceivedAt  time.Time `json:"received_at,omitzero"`  // held mail only
+	ScheduledAt time.Time `json:"scheduled_at,omitzero"` // scheduled mail only
+	Reviewer    string    `json:"reviewer,omitempty"`
+	DecidedAt   time.Time `json:"decided_at,omitzero"` // mail no longer held only
+
+	DeliveryStatus string `json:"delivery_status,omitempty"` // e.g. "delivered" or "failed", when the relay returns DSNs
+	DeliveryDetail string `json:"delivery_detail,omitempty"`
+}
+
+// ListByStatus returns every email with status, e.g. StatusBounced. Unlike
+// FetchApproved it only reads: approved mail it lists is still there to
+// fetch.
+func (c *Client) ListByStatus(ctx context.Context, status string) ([]StatusEmail, error) {
+	var emails []StatusEmail
+	if err := c.getJSON(ctx, "/api/v1/emails?"+url.Values{"status": {status}}.Encode(), &emails); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// Approve approves a held email as the reviewer set with SetReviewer.
+// Outbound mail is relayed before Approve returns, unless a recipient domain
+// policy needs more reviewers to approve it: it then stays pending.
+func (c *Client) Approve(ctx context.Context, id string) error {
+	return c.review(ctx, id, "approve", nil)
+}
+
+// ApproveWithReason is Approve giving a reason, which the server requires for
+// mail to some recipient domains and keeps with the decision.
+func (c *Client) ApproveWithReason(ctx context.Context, id, reason string) error {
+	return c.review(ctx, id, "approve", url.Values{"reason": {reason}})
+}
+
+// Reject rejects a held email as the reviewer set with SetReviewer. With
+// notify set, the sender of inbound mail is told, with reason, if the
+// server's bounce policy allows it.
+func (c *Client) Reject(ctx context.Context, id string, notify bool, reason string) error {
+	form := url.Values{}
+	if notify {
+		form.Set("notify", "1")
+		form.Set("reason", reason)
+	}
+	return c.review(ctx, id, "reject", form)
+}
+
+func (c *Client) review(ctx context.Context, id, action string, form url.Values) error {
+	if c.webURL == "" {
+		return errors.New("mailescrow: no reviewer set, see SetReviewer")
+	}
+	u := c.webURL + "/email/" + url.PathEscape(id) + "/" + action
+	// The web UI answers with a redirect to the inbox, which is success
+	// here; following it would fetch a whole page for nothing.
+	hc := *c.http
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	// Approving twice must not relay twice, so failures without a response
+	// from the server are not retried.
+	resp, err := c.send(ctx, &hc, false, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(c.webUser, c.webPassword)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// WatchEvents long-polls for approved inbound email matching opts and calls
+// fn with each one, in order, until ctx is done or fn returns an error,
+// which WatchEvents then returns. Emails are removed from the server as they
+// are fetched; if fn fails, the rest of that batch is lost. Failed polls are
+// retried with backoff indefinitely, except for authorization errors.
+func (c *Client) WatchEvents(ctx context.Context, opts FetchOptions, fn func(Email) error) error {
+	if opts.Wait <= 0 {
+		opts.Wait = time.Minute
+	}
+	failures := 0
+	for {
+		emails, err := c.FetchApproved(ctx, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, ErrUnauthorized) {
+				return err
+			}
+			failures++
+			if err := sleep(ctx, c.delay(failures, nil)); err != nil {
+				return err
+			}
+			continue
+		}
+		failures = 0
+		for _, e := range emails {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Annotation is a scanner's finding on a held email, added with Annotate.
+type Annotation struct {
+	ID        string    `json:"id,omitempty"`
+	Source    string    `json:"source"`             // the scanner, e.g. "rspamd"
+	Kind      string    `json:"kind"`               // what was checked, e.g. "phishing", "dlp", "links"
+	Severity  string    `json:"severity,omitempty"` // "info" (the default), "warning" or "critical"
+	Score     float64   `json:"score,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+	Findings  []string  `json:"findings,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+
+	// Rule is the rule that rejected the email because of the annotation;
+	// only set on the result of Annotate.
+	Rule string `json:"rule,omitempty"`
+}
+
+// Annotate attaches a finding to a held email; the client's token needs the
+// annotate scope. It is not retried after a network error, which could
+// attach it twice.
+func (c *Client) Annotate(ctx context.Context, emailID string, a Annotation) (Annotation, error) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return Annotation{}, fmt.Errorf("encode annotation: %w", err)
+	}
+	resp, err := c.do(ctx, false, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/emails/"+url.PathEscape(emailID)+"/annotations", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return Annotation{}, err
+	}
+	defer resp.Body.Close()
+	var created Annotation
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return Annotation{}, fmt.Errorf("decode annotation: %w", err)
+	}
+	return created, nil
+}
+
+// Annotations returns the findings attached to a held email, oldest first.
+func (c *Client) Annotations(ctx context.Context, emailID string) ([]Annotation, error) {
+	var annotations []Annotation
+	if err := c.getJSON(ctx, "/api/v1/emails/"+url.PathEscape(emailID)+"/annotations", &annotations); err != nil {
+		return nil, fmt.Errorf("list annotations: %w", err)
+	}
+	return annotations, nil
+}
+
+// Webhook is an endpoint registered with CreateWebhook to be told about
+// decisions on held emails.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`              // empty means every event
+	Direction string    `json:"direction,omitempty"` // empty means both
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent, or being sent, to a webhook.
+type WebhookDelivery struct {
+	ID           string    `json:"id"`
+	Event        string    `json:"event"`
+	EmailID      string    `json:"email_id,omitempty"`
+	Status       string    `json:"status"` // "pending", "succeeded" or "failed"
+	Attempts     int       `json:"attempts"`
+	ResponseCode int       `json:"response_code,omitempty"` // 0 if no response was received
+	LastError    string    `json:"last_error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// CreateWebhook registers a webhook for the client's token, posting the
+// given event types (all if empty) about emails in direction ("inbound",
+// "outbound", or "" for both) to webhookURL. It is not retried after a network
+// error, which could register it twice.
+func (c *Client) CreateWebhook(ctx context.Context, webhookURL string, events []string, direction string) (Webhook, error) {
+	body, err := json.Marshal(struct {
+		URL       string   `json:"url"`
+		Events    []string `json:"events,omitempty"`
+		Direction string   `json:"direction,omitempty"`
+	}{webhookURL, events, direction})
+	if err != nil {
+		return Webhook{}, fmt.Errorf("encode webhook: %w", err)
+	}
+	resp, err := c.do(ctx, false, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/webhooks", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+	defer resp.Body.Close()
+	var w Webhook
+	if err := json.NewDecoder(resp.Body).Decode(&w); err != nil {
+		return Webhook{}, fmt.Errorf("decode webhook: %w", err)
+	}
+	return w, nil
+}
+
+// ListWebhooks returns the webhooks of the client's token, oldest first.
+func (c *Client) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	var webhooks []Webhook
+	if err := c.getJSON(ctx, "/api/v1/webhooks", &webhooks); err != nil {
+		return nil, fmt.Errorf("list webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook of the client's token and its delivery
+// history.
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, true, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodDelete, c.baseURL+"/api/v1/webhooks/"+url.PathEscape(id), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// WebhookDeliveries returns the most recent deliveries to a webhook of the
+// client's token, newest first.
+func (c *Client) WebhookDeliveries(ctx context.Context, id string) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	if err := c.getJSON(ctx, "/api/v1/webhooks/"+url.PathEscape(id)+"/deliveries", &deliveries); err != nil {
+		return nil, fmt.Errorf("list deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// getJSON fetches path, retrying as needed, and decodes the response into v.
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	resp, err := c.do(ctx, true, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path, nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do sends the request built by newReq, retrying on 429 and 5xx gateway
+// errors, and on transport errors too if retryTransport is set. It returns
+// the response to a successful request; any other status becomes an *Error.
+func (c *Client) do(ctx context.Context, retryTransport bool, newReq func() (*http.Request, error)) (*http.Response, error) {
+	return c.send(ctx, c.http, retryTransport, newReq)
+}
+
+// send is do with a given HTTP client.
+func (c *Client) send(ctx context.Context, hc *http.Client, retryTransport bool, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, fmt.Errorf("build request: %w", err)
+		}
+		if c.token != "" && req.Header.Get("Authorization") == "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			if !retryTransport || attempt >= c.retries || ctx.Err() != nil {
+				return nil, err
+			}
+			if err := sleep(ctx, c.delay(attempt+1, nil)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode < 400 {
+			return resp, nil
+		}
+		apiErr := readError(resp)
+		if !retryable(resp.StatusCode) || attempt >= c.retries {
+			return nil, apiErr
+		}
+		if err := sleep(ctx, c.delay(attempt+1, resp)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether a request answered with status may succeed if
+// sent again: the server was busy or a proxy could not reach it.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// delay returns how long to wait before retry n (1-based): the response's
+// Retry-After in seconds if given, else the backoff doubled n-1 times.
+func (c *Client) delay(n int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	d := c.backoff
+	for i := 1; i < n && d < time.Minute; i++ {
+		d *= 2
+	}
+	return min(d, time.Minute)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// readError turns an error response into an *Error. The server answers
+// with plain text, or JSON with "error" and per-field details.
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	var body struct {
+		Error  string `json:"error"`
+		Fields []struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		} `json:"fields"`
+	}
+	if json.Unmarshal(b, &body) == nil && body.Error != "" {
+		e.Message = body.Error
+		for _, f := range body.Fields {
+			e.Fields = append(e.Fields, f.Field+": "+f.Message)
+		}
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
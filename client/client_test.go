@@ -0,0 +1,299 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSubmitRetriesWithSameIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	keys := make(chan string, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the bearer token", got)
+		}
+		keys <- r.Header.Get("Idempotency-Key")
+		if calls.Add(1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		var req struct {
+			To      []string `json:"to"`
+			Subject string   `json:"subject"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Subject != "Hi" || len(req.To) != 1 {
+			t.Errorf("request = %+v, %v", req, err)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": "abc", "status": "pending"})
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.SetToken("secret")
+	c.SetRetries(3, time.Millisecond)
+	sub, err := c.Submit(context.Background(), Message{To: []string{"bob@example.com"}, Subject: "Hi", Body: "Hello"})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if sub.ID != "abc" || sub.Status != "pending" || !sub.Replayed {
+		t.Errorf("Submit = %+v", sub)
+	}
+	close(keys)
+	first := <-keys
+	if first == "" {
+		t.Fatal("no Idempotency-Key sent")
+	}
+	for k := range keys {
+		if k != first {
+			t.Errorf("retry used key %q, want %q", k, first)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/emails/pending/count":
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid recipients","fields":[{"field":"to[0]","value":"x","message":"no such domain"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.SetRetries(0, 0)
+	_, err := c.PendingCount(context.Background())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("PendingCount error = %v, want ErrUnauthorized", err)
+	}
+
+	_, err = c.Submit(context.Background(), Message{To: []string{"x"}})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Submit error = %v, want an *Error", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Message != "invalid recipients" || len(apiErr.Fields) != 1 || apiErr.Fields[0] != "to[0]: no such domain" {
+		t.Errorf("Submit error = %+v", apiErr)
+	}
+}
+
+func TestFetchApproved(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("queue") != "support" || q.Get("tag") != "vip" || q.Get("wait") != "5s" || q.Has("after_checkpoint") {
+			t.Errorf("query = %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(`[{"id":"1","from":"alice@example.com","to":["support@example.com"],"subject":"Help","body":"hi","received_at":"2026-01-02T03:04:05Z","queue":"support","tags":["vip"]}]`))
+	}))
+	defer srv.Close()
+
+	emails, err := New(srv.URL).FetchApproved(context.Background(), FetchOptions{Queue: "support", Tag: "vip", Wait: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("FetchApproved: %v", err)
+	}
+	if len(emails) != 1 || emails[0].Subject != "Help" || emails[0].Queue != "support" || emails[0].ReceivedAt.Year() != 2026 {
+		t.Errorf("FetchApproved = %+v", emails)
+	}
+
+	checkpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "after_checkpoint=true" {
+			t.Errorf("query = %s, want after_checkpoint=true", r.URL.RawQuery)
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer checkpoint.Close()
+	if _, err := New(checkpoint.URL).FetchApproved(context.Background(), FetchOptions{AfterCheckpoint: true}); err != nil {
+		t.Fatalf("FetchApproved after checkpoint: %v", err)
+	}
+}
+
+func TestReviewUsesBasicAuthAndAcceptsRedirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "carol" || pass != "pw" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/email/1/approve":
+		case "/email/5/approve":
+			if r.FormValue("reason") != "contract signed" {
+				http.Error(w, "a reason is required to approve mail to *.gov", http.StatusBadRequest)
+				return
+			}
+		case "/email/4/approve":
+			http.Error(w, "Email already rejected by dave", http.StatusConflict)
+			return
+		case "/email/2/reject":
+			if r.FormValue("notify") != "1" || r.FormValue("reason") != "spam" {
+				t.Errorf("reject form = %v", r.Form)
+			}
+		default:
+			http.Error(w, "email not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New("http://127.0.0.1:1")
+	if err := c.Approve(ctx, "1"); err == nil {
+		t.Error("Approve without a reviewer succeeded")
+	}
+	c.SetReviewer(srv.URL, "carol", "pw")
+	if err := c.Approve(ctx, "1"); err != nil {
+		t.Errorf("Approve: %v", err)
+	}
+	if err := c.ApproveWithReason(ctx, "5", "contract signed"); err != nil {
+		t.Errorf("ApproveWithReason: %v", err)
+	}
+	if err := c.Reject(ctx, "2", true, "spam"); err != nil {
+		t.Errorf("Reject: %v", err)
+	}
+	if err := c.Approve(ctx, "4"); !errors.Is(err, ErrAlreadyHandled) || !strings.Contains(err.Error(), "dave") {
+		t.Errorf("Approve of a rejected email = %v, want ErrAlreadyHandled naming dave", err)
+	}
+	var apiErr *Error
+	if err := c.Approve(ctx, "3"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Approve of a missing email = %v, want a 404 *Error", err)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			http.Error(w, "upstream down", http.StatusBadGateway)
+		case 2:
+			w.Write([]byte(`[]`))
+		default:
+			w.Write([]byte(`[{"id":"1"},{"id":"2"}]`))
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.SetRetries(0, time.Millisecond)
+	var got []string
+	stop := errors.New("stop")
+	err := c.WatchEvents(context.Background(), FetchOptions{}, func(e Email) error {
+		got = append(got, e.ID)
+		if len(got) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("WatchEvents = %v, want the callback's error", err)
+	}
+	if len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Errorf("got emails %v", got)
+	}
+}
+
+func TestDelayHonoursRetryAfter(t *testing.T) {
+	c := New("")
+	c.SetRetries(3, 100*time.Millisecond)
+	if d := c.delay(3, nil); d != 400*time.Millisecond {
+		t.Errorf("delay(3) = %v, want 400ms", d)
+	}
+	resp := &http.Response{Header: http.Header{"Retry-After": {"7"}}}
+	if d := c.delay(1, resp); d != 7*time.Second {
+		t.Errorf("delay with Retry-After = %v, want 7s", d)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/v1/webhooks":
+			var req struct {
+				URL    string   `json:"url"`
+				Events []string `json:"events"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL != "https://app.example.com/hook" || len(req.Events) != 1 {
+				t.Errorf("create request = %+v (%v)", req, err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":"w1","url":"https://app.example.com/hook","events":["email_approved"],"created_at":"2026-01-02T03:04:05Z"}`))
+		case "GET /api/v1/webhooks":
+			w.Write([]byte(`[{"id":"w1","url":"https://app.example.com/hook","events":["email_approved"],"created_at":"2026-01-02T03:04:05Z"}]`))
+		case "GET /api/v1/webhooks/w1/deliveries":
+			w.Write([]byte(`[{"id":"d1","event":"email_approved","email_id":"e1","status":"failed","attempts":5,"response_code":503}]`))
+		case "DELETE /api/v1/webhooks/w1":
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE /api/v1/webhooks/w2":
+			http.Error(w, "webhook not found", http.StatusNotFound)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.SetToken("tok")
+	ctx := context.Background()
+	wh, err := c.CreateWebhook(ctx, "https://app.example.com/hook", []string{"email_approved"}, "")
+	if err != nil || wh.ID != "w1" {
+		t.Fatalf("CreateWebhook = %+v, %v", wh, err)
+	}
+	if list, err := c.ListWebhooks(ctx); err != nil || len(list) != 1 || list[0].Events[0] != "email_approved" {
+		t.Errorf("ListWebhooks = %+v, %v", list, err)
+	}
+	if d, err := c.WebhookDeliveries(ctx, "w1"); err != nil || len(d) != 1 || d[0].Status != "failed" || d[0].ResponseCode != 503 {
+		t.Errorf("WebhookDeliveries = %+v, %v", d, err)
+	}
+	if err := c.DeleteWebhook(ctx, "w1"); err != nil {
+		t.Errorf("DeleteWebhook: %v", err)
+	}
+	var apiErr *Error
+	if err := c.DeleteWebhook(ctx, "w2"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("DeleteWebhook(w2) = %v, want a 404 *Error", err)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/emails/e1/annotations" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`[{"id":"a1","source":"scanner","kind":"phishing","severity":"critical","score":0.97,"created_by":"token:scanner"}]`))
+			return
+		}
+		var a Annotation
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil || a.Kind != "phishing" || a.Score != 0.97 {
+			t.Errorf("annotation = %+v (%v)", a, err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"a1","source":"scanner","kind":"phishing","severity":"critical","score":0.97,"rule":"phishing"}`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	a, err := c.Annotate(context.Background(), "e1", Annotation{Source: "scanner", Kind: "phishing", Severity: "critical", Score: 0.97})
+	if err != nil || a.ID != "a1" || a.Rule != "phishing" {
+		t.Errorf("Annotate = %+v, %v", a, err)
+	}
+	list, err := c.Annotations(context.Background(), "e1")
+	if err != nil || len(list) != 1 || list[0].CreatedBy != "token:scanner" {
+		t.Errorf("Annotations = %+v, %v", list, err)
+	}
+}
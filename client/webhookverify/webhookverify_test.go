@@ -0,0 +1,56 @@
+package webhookverify
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signed(secret string, t time.Time, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+	r.Header.Set(TimestampHeader, strconv.FormatInt(t.Unix(), 10))
+	r.Header.Set(SignatureHeader, Sign([]byte(secret), t, []byte(body)))
+	return r
+}
+
+func TestRequest(t *testing.T) {
+	const body = `{"event":"sla_exceeded"}`
+	got, err := Request(signed("s3cret", time.Now(), body), []byte("s3cret"), DefaultTolerance)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if string(got) != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+
+	if _, err := Request(signed("other", time.Now(), body), []byte("s3cret"), DefaultTolerance); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("wrong secret: %v, want ErrBadSignature", err)
+	}
+	if _, err := Request(signed("s3cret", time.Now().Add(-time.Hour), body), []byte("s3cret"), DefaultTolerance); !errors.Is(err, ErrExpired) {
+		t.Errorf("old timestamp: %v, want ErrExpired", err)
+	}
+	if _, err := Request(signed("s3cret", time.Now().Add(-time.Hour), body), []byte("s3cret"), 0); err != nil {
+		t.Errorf("old timestamp without tolerance: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+	if _, err := Request(r, []byte("s3cret"), DefaultTolerance); !errors.Is(err, ErrNotSigned) {
+		t.Errorf("unsigned: %v, want ErrNotSigned", err)
+	}
+}
+
+func TestVerifyTamperedBody(t *testing.T) {
+	now := time.Now()
+	h := http.Header{}
+	h.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	h.Set(SignatureHeader, "v0=abc, "+Sign([]byte("k"), now, []byte("a")))
+	if err := Verify([]byte("k"), h, []byte("a"), DefaultTolerance); err != nil {
+		t.Errorf("one of several signatures matching: %v", err)
+	}
+	if err := Verify([]byte("k"), h, []byte("b"), DefaultTolerance); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered body: %v, want ErrBadSignature", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/albert/mailescrow/internal/backfill"
+	"github.com/albert/mailescrow/internal/config"
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// runImportIMAP is the import-imap command: it imports the mail already in an
+// IMAP folder as approved inbound history and prints how much it imported.
+func runImportIMAP(args []string) error {
+	fs := flag.NewFlagSet("import-imap", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import-imap [-config path] [-mailbox name] [-since YYYY-MM-DD] [-queue name]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "config.yaml", "path to configuration file")
+	mailbox := fs.String("mailbox", "INBOX", "IMAP folder to import from; it is left as it is")
+	sinceFlag := fs.String("since", "", "only import mail received on or after this date (YYYY-MM-DD)")
+	queue := fs.String("queue", backfill.DefaultQueue, "consumer queue to file imported mail into")
+	_ = fs.Parse(args) // ExitOnError
+
+	var since time.Time
+	if *sinceFlag != "" {
+		var err error
+		if since, err = time.Parse(time.DateOnly, *sinceFlag); err != nil {
+			return fmt.Errorf("invalid -since %q: want YYYY-MM-DD", *sinceFlag)
+		}
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if cfg.IMAP.Host == "" {
+		return fmt.Errorf("import-imap requires imap to be configured")
+	}
+
+	st, err := store.Open(cfg.DB.Driver, cfg.DB.Path, cfg.DB.QueryTimeout)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer func() {
+		if err := st.Close(); err != nil {
+			log.Printf("close store: %v", err)
+		}
+	}()
+	// Imported mail is redacted like mail fetched by the poller.
+	emails, _, err := newRedaction(cfg.Redaction, st)
+	if err != nil {
+		return fmt.Errorf("configure redaction: %w", err)
+	}
+
+	client := imap.New(cfg.IMAP.Host, cfg.IMAP.Port, cfg.IMAP.Username, cfg.IMAP.Password, cfg.IMAP.TLS)
+	res, err := backfill.New(emails, client, *queue).Import(context.Background(), *mailbox, since)
+	fmt.Printf("Imported %d emails from %s into queue %q (%d already imported).\n", res.Imported, *mailbox, *queue, res.Skipped)
+	return err
+}
@@ -1,24 +1,76 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
+	_ "time/tzdata" // timezones for the web UI, on hosts without a zoneinfo database
 
+	"github.com/albert/mailescrow/internal/archive"
+	"github.com/albert/mailescrow/internal/autoreply"
+	"github.com/albert/mailescrow/internal/bounce"
 	"github.com/albert/mailescrow/internal/config"
+	"github.com/albert/mailescrow/internal/contacts"
+	"github.com/albert/mailescrow/internal/correspondence"
+	"github.com/albert/mailescrow/internal/debug"
+	"github.com/albert/mailescrow/internal/dkim"
 	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/journal"
+	"github.com/albert/mailescrow/internal/maintenance"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/poller"
+	"github.com/albert/mailescrow/internal/projects"
+	"github.com/albert/mailescrow/internal/proxy"
+	"github.com/albert/mailescrow/internal/pubsub"
+	"github.com/albert/mailescrow/internal/quota"
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/reconcile"
+	"github.com/albert/mailescrow/internal/redact"
 	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/reputation"
+	"github.com/albert/mailescrow/internal/retention"
+	"github.com/albert/mailescrow/internal/reviewmail"
+	"github.com/albert/mailescrow/internal/routing"
+	"github.com/albert/mailescrow/internal/signature"
+	"github.com/albert/mailescrow/internal/sla"
+	"github.com/albert/mailescrow/internal/smtp"
+	"github.com/albert/mailescrow/internal/snooze"
 	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/sysmail"
+	"github.com/albert/mailescrow/internal/tlsclient"
+	"github.com/albert/mailescrow/internal/tokens"
+	"github.com/albert/mailescrow/internal/tracing"
+	"github.com/albert/mailescrow/internal/tracking"
+	"github.com/albert/mailescrow/internal/trends"
+	"github.com/albert/mailescrow/internal/unsubscribe"
 	"github.com/albert/mailescrow/internal/web"
+	"github.com/albert/mailescrow/internal/webhooks"
+	"github.com/albert/mailescrow/internal/window"
 )
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "reconcile":
+		err = runReconcile(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "import-imap":
+		err = runImportIMAP(os.Args[2:])
+	default:
+		err = run()
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -32,7 +84,20 @@ func run() error {
 		return fmt.Errorf("load config: %w", err)
 	}
 
-	st, err := store.New(cfg.DB.Path)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Endpoint, cfg.Tracing.SampleRatio)
+	if err != nil {
+		return fmt.Errorf("set up tracing: %w", err)
+	}
+	defer func() {
+		// Don't hang on exit when the collector is unreachable.
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Printf("flush traces: %v", err)
+		}
+	}()
+
+	st, err := store.Open(cfg.DB.Driver, cfg.DB.Path, cfg.DB.QueryTimeout)
 	if err != nil {
 		return fmt.Errorf("open store: %w", err)
 	}
@@ -41,26 +106,445 @@ func run() error {
 			log.Printf("close store: %v", err)
 		}
 	}()
+	// Settings changed at runtime override the config file.
+	if err := applySettings(context.Background(), st, cfg, nil); err != nil {
+		return err
+	}
+	var decided store.EmailStore = st
+	if cfg.Archive.Format != "" {
+		a, err := archive.New(cfg.Archive.Format, cfg.Archive.Path, cfg.Archive.Rotate)
+		if err != nil {
+			return fmt.Errorf("configure archive: %w", err)
+		}
+		// Inside redaction, so raw messages it drops are not archived either.
+		decided = archive.NewStore(st, a)
+		log.Printf("Archiving decided-on mail as %s under %s", cfg.Archive.Format, cfg.Archive.Path)
+	}
+	emails, redactor, err := newRedaction(cfg.Redaction, decided)
+	if err != nil {
+		return fmt.Errorf("configure redaction: %w", err)
+	}
+
+	// The relay and the IMAP server are reached through network.proxy_url.
+	var dialer proxy.Dialer
+	if cfg.Network.ProxyURL != "" {
+		if dialer, err = proxy.New(cfg.Network.ProxyURL); err != nil {
+			return fmt.Errorf("configure network: %w", err)
+		}
+	}
 
 	r := relay.New(cfg.Relay.Host, cfg.Relay.Port, cfg.Relay.Username, cfg.Relay.Password, cfg.Relay.TLS)
+	r.SetTimeout(cfg.Relay.Timeout)
+	r.SetDialer(dialer)
+	relayTLS, err := newClientTLS("relay", cfg.Relay.TLSOptions)
+	if err != nil {
+		return err
+	}
+	r.SetTLSConfig(relayTLS)
+	r.SetHeaderRewrite(cfg.Relay.StampHeaders, cfg.Relay.StripHeaders)
+	if err := r.SetDSN(cfg.Relay.DSNNotify, cfg.Relay.DSNRet); err != nil {
+		return fmt.Errorf("relay DSN: %w", err)
+	}
+	var upstream relay.Sender = r
+	switch cfg.Relay.Provider {
+	case "", "smtp":
+	case "blackhole", "file":
+		var dir string
+		if cfg.Relay.Provider == "file" {
+			if cfg.Relay.SinkDir == "" {
+				return errors.New("relay.provider file requires relay.sink_dir")
+			}
+			dir = cfg.Relay.SinkDir
+		}
+		sink, err := relay.NewSink(dir)
+		if err != nil {
+			return fmt.Errorf("configure relay: %w", err)
+		}
+		sink.SetHeaderRewrite(cfg.Relay.StampHeaders, cfg.Relay.StripHeaders)
+		upstream = sink
+		log.Printf("Relay provider is %s: approved mail is not delivered", cfg.Relay.Provider)
+	default:
+		return fmt.Errorf("relay.provider %q (want smtp, blackhole or file)", cfg.Relay.Provider)
+	}
+	// Everything relayed counts against the rate limits, system mail too.
+	var throttle *relay.Throttle
+	if cfg.Relay.MaxPerMinute != 0 || cfg.Relay.MaxPerHour != 0 {
+		if throttle, err = relay.NewThrottle(upstream, cfg.Relay.MaxPerMinute, cfg.Relay.MaxPerHour); err != nil {
+			return fmt.Errorf("configure relay: %w", err)
+		}
+		upstream = throttle
+	}
+
+	// Bounces and notifications go straight to the relay: never held, tracked
+	// or journaled, and let through should they come back in.
+	system := sysmail.New(upstream)
 
 	ctx := context.Background()
+	// Jobs left running by the last shutdown are queued again before anything
+	// can add new ones.
+	queue := jobs.New(emails)
+	queue.SetWebhookSecret(cfg.Webhooks.Secret)
+	if err := queue.Resume(ctx); err != nil {
+		return fmt.Errorf("resume jobs: %w", err)
+	}
+	// Every decision recorded from here on is published to the webhooks API
+	// tokens registered.
+	hooks := webhooks.New(emails, queue)
+	hooks.SetAllowPrivate(cfg.Webhooks.AllowPrivate)
+	emails = webhooks.NewStore(emails, hooks)
+	book := contacts.New(st, cfg.Contacts.AutoApproveAfter)
+	validator := recipients.New(cfg.Recipients.CheckMX)
+	checker := reputation.New(st, cfg.Reputation.DNSBLs, cfg.Reputation.URIBLs)
+	suppressed, err := suppression.New(st, cfg.Suppression.Action)
+	if err != nil {
+		return fmt.Errorf("configure suppression: %w", err)
+	}
+	autoReplies, err := autoreply.New(cfg.AutoReplies.Action, cfg.AutoReplies.LoopAfter, cfg.AutoReplies.LoopWindow)
+	if err != nil {
+		return fmt.Errorf("configure auto_replies: %w", err)
+	}
+	approvals := pubsub.New() // inbound approvals, waking long-polling API reads
 
 	var imapClient *imap.Client
+	var imapPoller *poller.Poller  // nil unless IMAP is configured
+	var inbound *poller.Poller     // files inbound mail, polled over IMAP or delivered over LMTP
+	var alertDigest *notify.Digest // nil unless IMAP is configured
 	if cfg.IMAP.Host != "" {
 		imapClient = imap.New(cfg.IMAP.Host, cfg.IMAP.Port, cfg.IMAP.Username, cfg.IMAP.Password, cfg.IMAP.TLS)
+		imapClient.SetDialer(dialer)
+		imapClient.SetEnvelopeHeader(cfg.IMAP.EnvelopeHeader)
+		imapTLS, err := newClientTLS("imap", cfg.IMAP.TLSOptions)
+		if err != nil {
+			return err
+		}
+		imapClient.SetTLSConfig(imapTLS)
 
 		if err := imapClient.EnsureFolders(ctx); err != nil {
 			return fmt.Errorf("ensure IMAP folders: %w", err)
 		}
 		log.Printf("IMAP folders verified on %s", cfg.IMAP.Host)
+	}
+
+	if imapClient != nil || cfg.SMTP.LMTPListen != "" {
+		routes := make([]routing.Route, 0, len(cfg.Routes))
+		for _, rc := range cfg.Routes {
+			routes = append(routes, routing.Route{Match: rc.Match, Queue: rc.Queue})
+		}
 
-		go runIMAPPoller(ctx, imapClient, st, cfg.IMAP.PollInterval)
+		// Without IMAP the poller is never run and only files LMTP mail.
+		var fetcher poller.Fetcher
+		var notifier notify.Notifier
+		if imapClient != nil {
+			fetcher = imapClient
+			alertDigest = newDigest(ctx, cfg.IMAP.AlertDigest, cfg.Web.PublicURL)
+			notifier = withDigest(alertDigest, queue.Notifier(cmp.Or(cfg.IMAP.AlertWebhookURL, cfg.SLA.WebhookURL)))
+		}
+		inbound = poller.New(fetcher, emails, routing.New(routes), notifier, cfg.IMAP.PollInterval, poller.Options{
+			MaxBackoff:       cfg.IMAP.MaxBackoff,
+			FailureThreshold: cfg.IMAP.FailureThreshold,
+			AlertAfter:       cfg.IMAP.AlertAfter,
+		})
+		if err := inbound.SetFolders(watchFolders(cfg.IMAP.WatchFolders, cfg.IMAP.SpamFolder)); err != nil {
+			return fmt.Errorf("imap.watch_folders: %w", err)
+		}
+		inbound.SetContacts(book)
+		inbound.SetSuppression(suppressed)
+		inbound.SetAutoReplies(autoReplies)
+		verifier, err := signature.New(cfg.Signatures.SMIMETrustAnchors, cfg.Signatures.PGPKeyring)
+		if err != nil {
+			return fmt.Errorf("load signature trust anchors: %w", err)
+		}
+		inbound.SetVerifier(verifier)
+		inbound.SetApprovals(approvals)
+		inbound.SetSystemMail(system)
+	}
+
+	if imapClient != nil {
+		imapPoller = inbound
+		go imapPoller.Run(ctx)
+
+		if cfg.IMAP.ReconcileInterval > 0 {
+			go reconcile.New(emails, imapClient).Run(ctx, cfg.IMAP.ReconcileInterval, cfg.IMAP.ReconcileFix)
+		}
 	} else {
 		log.Printf("IMAP not configured; inbound polling disabled")
 	}
 
-	webSrv := web.New(st, r, imapClient, cfg.Relay.Username, cfg.Relay.FromName, cfg.Web.Password)
+	// Always running, as a reload may batch the SLA webhook's events.
+	slaDigest := newDigest(ctx, cfg.SLA.Digest, cfg.Web.PublicURL)
+	var slaMonitor *sla.Monitor
+	if cfg.SLA.MaxPendingAge > 0 {
+		slaMonitor = sla.New(st, withDigest(slaDigest, queue.Notifier(cfg.SLA.WebhookURL)), cfg.SLA.MaxPendingAge)
+		go slaMonitor.Run(ctx, cfg.SLA.CheckInterval)
+	}
+	// Always running, as any reviewer may snooze an email. Woken emails are
+	// posted to the SLA webhook, batched with its breaches if those are.
+	snoozer := snooze.New(st, withDigest(slaDigest, queue.Notifier(cfg.SLA.WebhookURL)))
+	go snoozer.Run(ctx, time.Minute)
+	// Always running, as a reload may add reviewers to notify.
+	rm := cfg.ReviewMail
+	reviewMail := reviewmail.New(st, system.Sender(sysmail.KindReview), cfg.Relay.Username, cfg.Relay.FromName, rm.To, rm.Threshold, rm.Interval, cfg.Web.PublicURL)
+	reviewMail.SetCheckInterval(rm.CheckInterval)
+	go reviewMail.Run(ctx)
+
+	// Always running, as the settings page may set a policy.
+	purger := retention.New(st, retentionPolicy(cfg.Retention))
+	go purger.Run(ctx, cfg.Retention.Interval)
+	go trends.New(st).Run(ctx)
+	go maintenance.New(st).Run(ctx, cfg.DB.MaintenanceInterval)
+
+	// Without limits the limiter lets everything through; a reload may set some.
+	limiter, err := quota.New(st, cfg.Quota.PerHour, cfg.Quota.PerDay, cfg.Quota.Action)
+	if err != nil {
+		return fmt.Errorf("configure quota: %w", err)
+	}
+	// Exceeded project limits are posted to the SLA webhook, like woken snoozes.
+	limits, err := projects.New(st, projectLimits(cfg.Projects), withDigest(slaDigest, queue.Notifier(cfg.SLA.WebhookURL)))
+	if err != nil {
+		return fmt.Errorf("configure projects: %w", err)
+	}
+
+	// Links are rewritten and unsubscribe headers added before the journal
+	// takes its copy, so it archives what recipients got.
+	sender := upstream
+	if cfg.Tracking.Enabled {
+		publicURL := cmp.Or(cfg.Tracking.URL, cfg.Web.PublicURL)
+		if publicURL == "" {
+			return fmt.Errorf("tracking requires tracking.url or web.public_url")
+		}
+		sender = tracking.New(upstream, emails, publicURL)
+	}
+	if cfg.Unsubscribe.Enabled {
+		publicURL := cmp.Or(cfg.Unsubscribe.URL, cfg.Web.PublicURL)
+		if publicURL == "" {
+			return fmt.Errorf("unsubscribe requires unsubscribe.url or web.public_url")
+		}
+		tag, err := store.NormalizeTag(cfg.Unsubscribe.Tag)
+		if err != nil {
+			return fmt.Errorf("unsubscribe.tag: %w", err)
+		}
+		sender = unsubscribe.New(sender, emails, publicURL, tag)
+	}
+
+	// With IMAP configured the journal is always in place, so a reload can
+	// start filing relayed mail into folders.
+	var j *journal.Sender
+	if cfg.Journal.Mailbox != "" && imapClient == nil {
+		return fmt.Errorf("journal.mailbox requires imap to be configured")
+	}
+	if cfg.Journal.Address != "" || imapClient != nil {
+		j = journal.New(sender, cfg.Journal.Address)
+		if imapClient != nil {
+			j.SetMailbox(imapClient, cfg.Journal.Mailbox)
+			j.SetSentFolder(imapClient, cfg.IMAP.SentFolder)
+		}
+		sender = j
+	}
+	// Relayed mail is kept so that replies to it can be reviewed in context.
+	sender = correspondence.New(sender, emails)
+
+	// Rules apply to SMTP and API submissions, to inbound mail, and to held
+	// mail once it is annotated.
+	engine, err := newRules(cfg.Rules)
+	if err != nil {
+		return fmt.Errorf("load rules: %w", err)
+	}
+	if inbound != nil {
+		inbound.SetRules(engine)
+	}
+	// Recipient domain policies are layered over the rules for outbound mail.
+	policies, err := newPolicies(cfg.Policies)
+	if err != nil {
+		return fmt.Errorf("load policies: %w", err)
+	}
+	windows, err := newWindows(cfg.SendingWindows)
+	if err != nil {
+		return fmt.Errorf("configure sending windows: %w", err)
+	}
+
+	var smtpSrv *smtp.Server
+	if cfg.SMTP.Listen != "" || cfg.SMTP.Internal.Listen != "" {
+		users, err := newSMTPUsers(cfg.SMTP.Users)
+		if err != nil {
+			return fmt.Errorf("load smtp users: %w", err)
+		}
+		smtpSrv = smtp.New(emails, sender, engine)
+		smtpSrv.SetAuth(cfg.SMTP.Username, cfg.SMTP.Password)
+		smtpSrv.SetUsers(users)
+		smtpSrv.SetPolicies(policies)
+		smtpSrv.SetMaxMessageBytes(cfg.SMTP.MaxMessageBytes)
+		smtpSrv.SetMaxRecipients(cfg.SMTP.MaxRecipients)
+		smtpSrv.SetMaxConnections(cfg.SMTP.MaxConnections)
+		smtpSrv.SetTimeouts(cfg.SMTP.ReadTimeout, cfg.SMTP.WriteTimeout)
+		smtpSrv.SetMaxMessageRate(cfg.SMTP.MaxMessageRate)
+		smtpSrv.SetQuota(limiter)
+		smtpSrv.SetSuppression(suppressed)
+		smtpSrv.SetProjects(limits)
+		smtpSrv.SetContacts(book)
+		smtpSrv.SetRecipients(validator)
+		smtpSrv.SetCheckTimeout(cfg.Relay.Timeout)
+		smtpSrv.SetReputation(checker)
+		smtpSrv.SetSystemMail(system)
+		smtpSrv.SetWindows(windows, queue)
+		if cfg.SMTP.TLSCertFile != "" {
+			tlsCfg, err := smtp.LoadTLS(cfg.SMTP.TLSCertFile, cfg.SMTP.TLSKeyFile, cfg.SMTP.ClientCAFile)
+			if err != nil {
+				return fmt.Errorf("load smtp certificate: %w", err)
+			}
+			smtpSrv.SetTLS(tlsCfg)
+		} else if cfg.SMTP.ClientCAFile != "" {
+			return fmt.Errorf("smtp.client_ca_file requires smtp.tls_cert_file")
+		}
+		if cfg.SMTP.Internal.Listen != "" {
+			if err := smtpSrv.SetInternal(cfg.SMTP.Internal.AllowedNetworks, cfg.SMTP.Internal.Project); err != nil {
+				return fmt.Errorf("smtp.internal: %w", err)
+			}
+		}
+		if cfg.SMTP.Listen != "" {
+			go func() {
+				if err := smtpSrv.Serve(cfg.SMTP.Listen); err != nil {
+					log.Fatalf("SMTP server error: %v", err)
+				}
+			}()
+		}
+		if cfg.SMTP.Internal.Listen != "" {
+			go func() {
+				if err := smtpSrv.ServeInternal(cfg.SMTP.Internal.Listen); err != nil {
+					log.Fatalf("SMTP internal server error: %v", err)
+				}
+			}()
+		}
+	}
+
+	var lmtpSrv *smtp.LMTPServer
+	if cfg.SMTP.LMTPListen != "" {
+		lmtpSrv = smtp.NewLMTP(inbound)
+		lmtpSrv.SetMaxMessageBytes(cfg.SMTP.MaxMessageBytes)
+		lmtpSrv.SetMaxRecipients(cfg.SMTP.MaxRecipients)
+		lmtpSrv.SetMaxConnections(cfg.SMTP.MaxConnections)
+		lmtpSrv.SetTimeouts(cfg.SMTP.ReadTimeout, cfg.SMTP.WriteTimeout)
+		go func() {
+			if err := lmtpSrv.Serve(cfg.SMTP.LMTPListen); err != nil {
+				log.Fatalf("LMTP server error: %v", err)
+			}
+		}()
+	}
+
+	webSrv := web.New(emails, sender, imapClient, cfg.Relay.Username, cfg.Relay.FromName, cfg.Web.Password)
+	webSrv.SetSettings(cfg.Settings())
+	webSrv.SetRedactor(redactor)
+	webSrv.SetQuota(limiter)
+	webSrv.SetProjects(limits)
+	webSrv.SetSuppression(suppressed)
+	webSrv.SetContacts(book)
+	webSrv.SetRecipients(validator)
+	webSrv.SetReputation(checker)
+	webSrv.SetApprovals(approvals)
+	webSrv.SetJobs(queue)
+	webSrv.SetRules(engine)
+	webSrv.SetPolicies(policies)
+	webSrv.SetTokens(tokens.New(st), cfg.Web.RequireAPIToken)
+	webSrv.SetWebhooks(hooks)
+	webSrv.SetBasePath(cfg.Web.BasePath)
+	webSrv.SetPublicURL(cfg.Web.PublicURL)
+	webSrv.SetAPIV2(cfg.Web.APIV2)
+	switch cfg.API.ConsumeMode {
+	case "", "delete":
+	case "keep":
+		webSrv.SetKeepFetched(true)
+	default:
+		return fmt.Errorf("api.consume_mode %q (want delete or keep)", cfg.API.ConsumeMode)
+	}
+	switch cfg.Web.TrackingPixels {
+	case "", "flag":
+	case "strip":
+		webSrv.SetStripTrackers(true)
+	default:
+		return fmt.Errorf("web.tracking_pixels %q (want flag or strip)", cfg.Web.TrackingPixels)
+	}
+	if cfg.Web.SingleListener {
+		webSrv.MountAPI()
+	}
+	if err := webSrv.SetTrustedProxies(cfg.Web.TrustedProxies); err != nil {
+		return fmt.Errorf("configure web: %w", err)
+	}
+	if err := webSrv.SetLocale(cfg.Web.Language, cfg.Web.Timezone); err != nil {
+		return fmt.Errorf("configure web: %w", err)
+	}
+	if f := cfg.Web.SecondFactor; len(f.TOTPSecrets) > 0 {
+		if err := webSrv.SetSecondFactors(f.TOTPSecrets, f.Roles, f.Session); err != nil {
+			return fmt.Errorf("configure web.second_factor: %w", err)
+		}
+		roles := f.Roles
+		if len(roles) == 0 {
+			roles = web.Roles
+		}
+		log.Printf("Web UI second factor: %d reviewers enrolled, required for roles: %s", len(f.TOTPSecrets), strings.Join(roles, ", "))
+	}
+	identities, err := newIdentities(cfg.Identities)
+	if err != nil {
+		return fmt.Errorf("load identities: %w", err)
+	}
+	if err := webSrv.SetIdentities(identities); err != nil {
+		return fmt.Errorf("load identities: %w", err)
+	}
+	webSrv.SetWindows(windows)
+	webSrv.SetSLA(cfg.SLA.MaxPendingAge)
+	webSrv.SetThrottle(throttle)
+	if cfg.Bounce.Enabled {
+		bouncer, err := bounce.New(system.Sender(sysmail.KindBounce), cfg.Relay.Username, cfg.Relay.FromName, cfg.Bounce.Policy, cfg.Bounce.Template)
+		if err != nil {
+			return fmt.Errorf("configure bounces: %w", err)
+		}
+		webSrv.SetBounce(bouncer)
+	}
+	var pollerStatus func() poller.Status
+	if imapPoller != nil {
+		pollerStatus = imapPoller.Status
+		webSrv.SetPollerStatus(pollerStatus)
+	}
+	if cfg.Web.Debug {
+		debug.Publish(st, pollerStatus)
+		webSrv.SetDebug(debug.Handler())
+		log.Printf("Debug endpoints enabled on the API under /debug/ (admin token required)")
+	}
+	if cfg.Web.TemplatesDir != "" {
+		if err := webSrv.UseTemplateDir(cfg.Web.TemplatesDir); err != nil {
+			return fmt.Errorf("load templates: %w", err)
+		}
+		log.Printf("Loading UI templates from %s (hot reload enabled)", cfg.Web.TemplatesDir)
+	}
+
+	rl := &reloader{
+		path:        *configPath,
+		st:          st,
+		smtp:        smtpSrv,
+		poller:      imapPoller,
+		inbound:     inbound,
+		sla:         slaMonitor,
+		snooze:      snoozer,
+		reviewMail:  reviewMail,
+		alertDigest: alertDigest,
+		slaDigest:   slaDigest,
+		limiter:     limiter,
+		projects:    limits,
+		suppressed:  suppressed,
+		autoReplies: autoReplies,
+		journal:     j,
+		imap:        imapClient,
+		jobs:        queue,
+		purger:      purger,
+		web:         webSrv,
+		started:     cfg,
+		cfg:         cfg,
+	}
+	webSrv.SetReload(rl.reload)
+	webSrv.SetSettingsEditor(rl)
+	// Before any job or request can start relaying.
+	if err := webSrv.ResumeRelays(ctx); err != nil {
+		return fmt.Errorf("resume relays: %w", err)
+	}
+	go queue.Run(ctx, jobs.DefaultInterval)
 
 	go func() {
 		if err := webSrv.Serve(cfg.Web.Listen); err != nil {
@@ -68,80 +552,174 @@ func run() error {
 		}
 	}()
 
-	go func() {
-		if err := webSrv.ServeAPI(cfg.Web.APIListen); err != nil {
-			log.Fatalf("API server error: %v", err)
-		}
-	}()
+	if !cfg.Web.SingleListener {
+		go func() {
+			if err := webSrv.ServeAPI(cfg.Web.APIListen); err != nil {
+				log.Fatalf("API server error: %v", err)
+			}
+		}()
+	}
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
+		}
+		if _, _, err := rl.reload(); err != nil {
+			log.Printf("Reload failed, previous configuration kept: %v", err)
+		}
+	}
 
 	log.Println("Shutting down...")
 	if err := webSrv.Shutdown(context.Background()); err != nil {
 		log.Printf("Web server shutdown: %v", err)
 	}
+	if smtpSrv != nil {
+		if err := smtpSrv.Shutdown(context.Background()); err != nil {
+			log.Printf("SMTP server shutdown: %v", err)
+		}
+	}
+	if lmtpSrv != nil {
+		if err := lmtpSrv.Shutdown(context.Background()); err != nil {
+			log.Printf("LMTP server shutdown: %v", err)
+		}
+	}
+	// Queue what is waiting for a digest; the jobs deliver it after a restart.
+	for _, d := range []*notify.Digest{alertDigest, slaDigest} {
+		if d == nil {
+			continue
+		}
+		if err := d.Flush(context.Background()); err != nil {
+			log.Printf("Notification digest: %v", err)
+		}
+	}
 	log.Println("Stopped")
 	return nil
 }
 
-func runIMAPPoller(ctx context.Context, client *imap.Client, st store.EmailStore, interval time.Duration) {
-	log.Printf("IMAP poller started (interval: %s)", interval)
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// newDigest starts batching a channel's events as dc asks; if dc leaves them
+// unbatched they are passed on as they happen until a reload batches them.
+// link points digests at the web UI.
+func newDigest(ctx context.Context, dc config.DigestConfig, link string) *notify.Digest {
+	d := notify.NewDigest(nil, dc.Interval, dc.Max, link)
+	go d.Run(ctx)
+	return d
+}
 
-	poll := func() {
-		emails, err := st.ListPending(ctx)
-		if err != nil {
-			log.Printf("IMAP poll: list pending: %v", err)
-			return
-		}
+// withDigest routes the events for n through d, if the channel is batched.
+func withDigest(d *notify.Digest, n notify.Notifier) notify.Notifier {
+	if d == nil || n == nil {
+		return n
+	}
+	d.SetNotifier(n)
+	return d
+}
 
-		knownIDs := make([]string, 0, len(emails))
-		for _, e := range emails {
-			if e.IMAPMessageID != "" {
-				knownIDs = append(knownIDs, e.IMAPMessageID)
+// newIdentities builds the identities API submissions may send as, loading
+// their DKIM keys.
+func newIdentities(ics []config.IdentityConfig) ([]web.Identity, error) {
+	ids := make([]web.Identity, 0, len(ics))
+	for _, ic := range ics {
+		id := web.Identity{Name: ic.Name, Address: ic.Address, DisplayName: ic.DisplayName, Tokens: ic.Tokens}
+		if ic.DKIMSelector != "" {
+			if ic.DKIMKeyFile == "" {
+				return nil, fmt.Errorf("identity %q: dkim_selector needs dkim_key_file", ic.Name)
 			}
-		}
-
-		// Also collect known IDs from approved (not yet fetched) emails.
-		approved, err := st.ListApproved(ctx)
-		if err != nil {
-			log.Printf("IMAP poll: list approved: %v", err)
-		} else {
-			for _, e := range approved {
-				if e.IMAPMessageID != "" {
-					knownIDs = append(knownIDs, e.IMAPMessageID)
-				}
+			key, err := dkim.LoadKey(ic.DKIMKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("identity %q: %w", ic.Name, err)
+			}
+			_, domain, _ := strings.Cut(ic.Address, "@")
+			if id.DKIM, err = dkim.New(domain, ic.DKIMSelector, key); err != nil {
+				return nil, fmt.Errorf("identity %q: %w", ic.Name, err)
 			}
 		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
 
-		fetched, err := client.Poll(ctx, knownIDs)
-		if err != nil {
-			log.Printf("IMAP poll error: %v", err)
-			return
+// newWindows builds the sending windows schedule, or nil if there are none.
+func newWindows(wcs []config.SendingWindowConfig) (*window.Schedule, error) {
+	if len(wcs) == 0 {
+		return nil, nil
+	}
+	windows := make([]window.Window, 0, len(wcs))
+	for _, wc := range wcs {
+		w := window.Window{Name: wc.Name, Sender: wc.Sender, Recipient: wc.Recipient, Tag: wc.Tag}
+		var err error
+		if w.Start, err = window.ParseClock(wc.Start); err != nil {
+			return nil, fmt.Errorf("window %q: start: %w", wc.Name, err)
 		}
-
-		for _, f := range fetched {
-			id, err := st.SaveInbound(ctx, f.Sender, f.Recipients, f.Subject, f.Body, f.RawMessage, f.MessageID, imap.FolderReceived)
+		if w.End, err = window.ParseClock(wc.End); err != nil {
+			return nil, fmt.Errorf("window %q: end: %w", wc.Name, err)
+		}
+		for _, d := range wc.Days {
+			day, err := window.ParseDay(d)
 			if err != nil {
-				log.Printf("IMAP poll: save inbound: %v", err)
-				continue
+				return nil, fmt.Errorf("window %q: %w", wc.Name, err)
+			}
+			w.Days = append(w.Days, day)
+		}
+		if wc.Timezone != "" {
+			if w.Location, err = time.LoadLocation(wc.Timezone); err != nil {
+				return nil, fmt.Errorf("window %q: %w", wc.Name, err)
 			}
-			log.Printf("Received inbound email %s from %s (subject: %s)", id, f.Sender, f.Subject)
 		}
+		windows = append(windows, w)
 	}
+	return window.New(windows)
+}
 
-	// Poll immediately on startup.
-	poll()
+// newClientTLS builds the TLS configuration for connecting to the relay or
+// the IMAP server, named by section, from its tls_options. Unset options
+// return nil, the defaults.
+func newClientTLS(section string, o config.TLSOptionsConfig) (*tls.Config, error) {
+	if o == (config.TLSOptionsConfig{}) {
+		return nil, nil
+	}
+	cfg, err := tlsclient.Load(o.MinVersion, o.CAFile, o.CertFile, o.KeyFile, o.InsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("%s.tls_options: %w", section, err)
+	}
+	if o.InsecureSkipVerify {
+		log.Printf("Insecure: %s.tls_options.insecure_skip_verify is set, so the %s server's certificate is not verified; trust it with %s.tls_options.ca_file instead", section, section, section)
+	}
+	return cfg, nil
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			poll()
+// newRedaction returns st wrapped to redact held mail as rc asks, and the
+// redactor for the web UI, which is nil without patterns.
+func newRedaction(rc config.RedactionConfig, st store.EmailStore) (store.EmailStore, *redact.Redactor, error) {
+	custom := make([]redact.Pattern, 0, len(rc.Custom))
+	for _, c := range rc.Custom {
+		custom = append(custom, redact.Pattern{Name: c.Name, Expr: c.Pattern})
+	}
+	redactor, err := redact.New(rc.Patterns, custom)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch rc.Raw {
+	case redact.RawKeep, redact.RawEncrypt, redact.RawDrop:
+	default:
+		return nil, nil, fmt.Errorf("raw policy %q (want %s, %s or %s)", rc.Raw, redact.RawKeep, redact.RawEncrypt, redact.RawDrop)
+	}
+	// A key encrypts the raw messages stored whatever the policy, and keeps
+	// those stored under an earlier encrypt policy readable.
+	if rc.Key != "" {
+		key, err := base64.StdEncoding.DecodeString(rc.Key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decode key: %w", err)
 		}
+		if err := st.SetRawKey(key); err != nil {
+			return nil, nil, err
+		}
+	} else if rc.Raw == redact.RawEncrypt {
+		return nil, nil, fmt.Errorf("raw policy %s needs a key", redact.RawEncrypt)
+	}
+	if redactor == nil && rc.Raw != redact.RawDrop {
+		return st, nil, nil
 	}
+	return redact.NewStore(st, redactor, rc.Raw), redactor, nil
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/albert/mailescrow/internal/config"
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/reconcile"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// runReconcile is the reconcile command: it compares held emails with the
+// mailescrow IMAP folders once, prints what differs and, with -fix, repairs
+// it. It fails if anything is left unrepaired.
+func runReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reconcile [-config path] [-fix]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "config.yaml", "path to configuration file")
+	fix := fs.Bool("fix", false, "repair the discrepancies found instead of only reporting them")
+	_ = fs.Parse(args) // ExitOnError
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	if cfg.IMAP.Host == "" {
+		return fmt.Errorf("reconcile requires imap to be configured")
+	}
+
+	st, err := store.Open(cfg.DB.Driver, cfg.DB.Path, cfg.DB.QueryTimeout)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+	defer func() {
+		if err := st.Close(); err != nil {
+			log.Printf("close store: %v", err)
+		}
+	}()
+	// The raw key is needed to restore missing messages from stored copies.
+	emails, _, err := newRedaction(cfg.Redaction, st)
+	if err != nil {
+		return fmt.Errorf("configure redaction: %w", err)
+	}
+
+	client := imap.New(cfg.IMAP.Host, cfg.IMAP.Port, cfg.IMAP.Username, cfg.IMAP.Password, cfg.IMAP.TLS)
+	found, err := reconcile.New(emails, client).Check(context.Background(), *fix)
+	if err != nil {
+		return fmt.Errorf("reconcile: %w", err)
+	}
+	unfixed := 0
+	for _, d := range found {
+		fmt.Println(d)
+		if !d.Fixed {
+			unfixed++
+		}
+	}
+	switch {
+	case len(found) == 0:
+		fmt.Println("The database and IMAP folders agree.")
+	case unfixed > 0:
+		return fmt.Errorf("%d of %d discrepancies not repaired", unfixed, len(found))
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/autoreply"
+	"github.com/albert/mailescrow/internal/config"
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/journal"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/policy"
+	"github.com/albert/mailescrow/internal/poller"
+	"github.com/albert/mailescrow/internal/projects"
+	"github.com/albert/mailescrow/internal/quota"
+	"github.com/albert/mailescrow/internal/retention"
+	"github.com/albert/mailescrow/internal/reviewmail"
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/sla"
+	"github.com/albert/mailescrow/internal/smtp"
+	"github.com/albert/mailescrow/internal/snooze"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/web"
+)
+
+// reloader re-reads the configuration file on SIGHUP or POST
+// /api/config/reload and applies the settings config.Reloadable accepts to
+// the running components. Components that were not started are skipped.
+// The settings changed at runtime (config.Tunable), kept in the store,
+// override the file's; the reloader changes them for the settings page and
+// PUT /api/settings.
+type reloader struct {
+	path string
+	st   store.ReadWriter
+
+	smtp        *smtp.Server   // nil when both SMTP listeners are disabled
+	poller      *poller.Poller // nil when IMAP is not configured
+	inbound     *poller.Poller // files IMAP and LMTP mail; nil when neither is configured
+	sla         *sla.Monitor   // nil when SLA alerts are disabled
+	snooze      *snooze.Waker
+	reviewMail  *reviewmail.Notifier
+	limiter     *quota.Limiter
+	projects    *projects.Limits
+	suppressed  *suppression.List
+	autoReplies *autoreply.Policy
+	journal     *journal.Sender // nil when relayed mail is not archived
+	imap        *imap.Client    // nil when IMAP is not configured
+	jobs        *jobs.Queue     // delivers webhook alerts
+	purger      *retention.Purger
+	web         *web.Server
+
+	// Digests batching the poller's and the SLA webhook's alerts, or passing
+	// them on one by one; alertDigest is nil when IMAP is not configured.
+	alertDigest, slaDigest *notify.Digest
+
+	started *config.Config // as loaded at startup
+
+	mu  sync.Mutex
+	cfg *config.Config // as last loaded
+}
+
+// reload loads the configuration again and applies it. If the new
+// configuration is invalid nothing is applied and the old one stays in
+// effect.
+func (r *reloader) reload() (reloaded, restart []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := r.load(context.Background(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	reloaded, restart, err = r.apply(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Configuration reloaded from %s", r.path)
+	logChanges(reloaded, restart)
+	return reloaded, restart, nil
+}
+
+// TunableSettings returns the settings that can be changed at runtime, as
+// they are in effect.
+func (r *reloader) TunableSettings(ctx context.Context) ([]web.TunableSetting, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, err := r.st.ListSettings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list settings: %w", err)
+	}
+	changed := make(map[string]store.Setting, len(stored))
+	for _, s := range stored {
+		changed[s.Key] = s
+	}
+	var settings []web.TunableSetting
+	for _, key := range config.Tunable() {
+		value, secret := r.cfg.TunableValue(key)
+		s, ok := changed[key]
+		settings = append(settings, web.TunableSetting{
+			Key: key, Value: value, Secret: secret,
+			Changed: ok, UpdatedBy: s.UpdatedBy, UpdatedAt: s.UpdatedAt,
+		})
+	}
+	return settings, nil
+}
+
+// UpdateSettings applies changes, YAML values by key, a nil value resetting
+// the setting to the config file's, and stores them once they are in
+// effect. If any change is invalid, nothing is changed.
+func (r *reloader) UpdateSettings(ctx context.Context, changes map[string]*string, actor string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := r.load(ctx, changes)
+	if err != nil {
+		return err
+	}
+	for key, value := range changes {
+		if value == nil {
+			continue
+		}
+		if err := cfg.Override(key, *value); err != nil {
+			return err
+		}
+	}
+	reloaded, restart, err := r.apply(cfg)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for key, value := range changes {
+		if value == nil {
+			err = r.st.DeleteSetting(ctx, key)
+		} else {
+			err = r.st.SaveSetting(ctx, store.Setting{Key: key, Value: *value, UpdatedBy: actor, UpdatedAt: now})
+		}
+		if err != nil {
+			// In effect, but lost on the next reload or restart.
+			return fmt.Errorf("save setting %s: %w", key, err)
+		}
+	}
+	log.Printf("Settings changed by %s", actor)
+	logChanges(reloaded, restart)
+	return nil
+}
+
+// load reads the configuration file and applies the settings changed at
+// runtime, except those in skip.
+func (r *reloader) load(ctx context.Context, skip map[string]*string) (*config.Config, error) {
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	if err := applySettings(ctx, r.st, cfg, skip); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// apply applies cfg to the running components. If cfg is invalid nothing is
+// applied; errors in tunable settings are *config.SettingError.
+func (r *reloader) apply(cfg *config.Config) (reloaded, restart []string, err error) {
+	engine, err := newRules(cfg.Rules)
+	if err != nil {
+		return nil, nil, &config.SettingError{Key: "rules", Err: err}
+	}
+	policies, err := newPolicies(cfg.Policies)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load policies: %w", err)
+	}
+	users, err := newSMTPUsers(cfg.SMTP.Users)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load smtp users: %w", err)
+	}
+	if cfg.Journal.Mailbox != "" && r.imap == nil {
+		return nil, nil, errors.New("journal.mailbox requires imap to be configured")
+	}
+	folders := watchFolders(cfg.IMAP.WatchFolders, cfg.IMAP.SpamFolder)
+	if err := poller.CheckFolders(folders); err != nil {
+		key := "imap.watch_folders"
+		if poller.CheckFolders(folders[:len(folders)-1]) == nil && cfg.IMAP.SpamFolder != "" {
+			key = "imap.spam_folder" // the spam folder, last, is the problem
+		}
+		return nil, nil, &config.SettingError{Key: key, Err: err}
+	}
+	if err := r.limiter.SetLimits(cfg.Quota.PerHour, cfg.Quota.PerDay, cfg.Quota.Action); err != nil {
+		return nil, nil, &config.SettingError{Key: "quota", Err: err}
+	}
+	if err := r.suppressed.SetAction(cfg.Suppression.Action); err != nil {
+		return nil, nil, fmt.Errorf("suppression: %w", err)
+	}
+	if err := r.autoReplies.SetAction(cfg.AutoReplies.Action); err != nil {
+		return nil, nil, fmt.Errorf("auto_replies: %w", err)
+	}
+	if err := r.projects.SetLimits(projectLimits(cfg.Projects)); err != nil {
+		return nil, nil, fmt.Errorf("projects: %w", err)
+	}
+
+	if r.smtp != nil {
+		r.smtp.SetRules(engine)
+		r.smtp.SetPolicies(policies)
+		r.smtp.SetUsers(users)
+	}
+	if r.inbound != nil {
+		r.inbound.SetRules(engine)
+	}
+	if r.alertDigest != nil {
+		r.alertDigest.SetSchedule(cfg.IMAP.AlertDigest.Interval, cfg.IMAP.AlertDigest.Max)
+	}
+	r.slaDigest.SetSchedule(cfg.SLA.Digest.Interval, cfg.SLA.Digest.Max)
+	if r.poller != nil {
+		r.poller.SetInterval(cfg.IMAP.PollInterval)
+		r.poller.SetNotifier(withDigest(r.alertDigest, r.jobs.Notifier(cmp.Or(cfg.IMAP.AlertWebhookURL, cfg.SLA.WebhookURL))))
+		_ = r.poller.SetFolders(folders) // checked above
+	}
+	r.jobs.SetWebhookSecret(cfg.Webhooks.Secret)
+	if r.sla != nil {
+		r.sla.SetNotifier(withDigest(r.slaDigest, r.jobs.Notifier(cfg.SLA.WebhookURL)))
+	}
+	r.snooze.SetNotifier(withDigest(r.slaDigest, r.jobs.Notifier(cfg.SLA.WebhookURL)))
+	r.projects.SetNotifier(withDigest(r.slaDigest, r.jobs.Notifier(cfg.SLA.WebhookURL)))
+	r.reviewMail.SetReviewers(cfg.ReviewMail.To, cfg.ReviewMail.Threshold, cfg.ReviewMail.Interval)
+	r.reviewMail.SetCheckInterval(cfg.ReviewMail.CheckInterval)
+	if r.journal != nil && r.imap != nil {
+		r.journal.SetMailbox(r.imap, cfg.Journal.Mailbox)
+		r.journal.SetSentFolder(r.imap, cfg.IMAP.SentFolder)
+	}
+	r.purger.SetPolicy(retentionPolicy(cfg.Retention))
+
+	// Applied settings are compared with the previous load; settings that
+	// need a restart with startup, so they stay listed until one happens.
+	reloaded, _ = config.Diff(r.cfg, cfg)
+	_, restart = config.Diff(r.started, cfg)
+	r.cfg = cfg
+	r.web.SetRules(engine)
+	r.web.SetPolicies(policies)
+	r.web.SetSettings(cfg.Settings())
+	return reloaded, restart, nil
+}
+
+func logChanges(reloaded, restart []string) {
+	if len(reloaded) > 0 {
+		log.Printf("Applied changed settings: %s", strings.Join(reloaded, ", "))
+	}
+	if len(restart) > 0 {
+		log.Printf("Changed settings that require a restart: %s", strings.Join(restart, ", "))
+	}
+}
+
+// applySettings overrides cfg with the settings changed at runtime, except
+// those in skip. A stored value that no longer parses, e.g. after an
+// upgrade, is logged and left out.
+func applySettings(ctx context.Context, st store.Reader, cfg *config.Config, skip map[string]*string) error {
+	stored, err := st.ListSettings(ctx)
+	if err != nil {
+		return fmt.Errorf("list settings: %w", err)
+	}
+	for _, s := range stored {
+		if _, ok := skip[s.Key]; ok {
+			continue
+		}
+		if err := cfg.Override(s.Key, s.Value); err != nil {
+			log.Printf("Ignoring setting changed by %s: %v", s.UpdatedBy, err)
+		}
+	}
+	return nil
+}
+
+// watchFolders returns the IMAP folders to poll, INBOX if none are
+// configured, followed by the spam folder if there is one.
+func watchFolders(wfs []config.WatchFolderConfig, spam string) []poller.Folder {
+	folders := make([]poller.Folder, 0, len(wfs)+1)
+	for _, wf := range wfs {
+		folders = append(folders, poller.Folder{Name: wf.Folder, Queue: wf.Queue})
+	}
+	if len(folders) == 0 {
+		folders = append(folders, poller.Folder{Name: imap.FolderInbox})
+	}
+	if spam != "" {
+		folders = append(folders, poller.Folder{Name: spam, Spam: true})
+	}
+	return folders
+}
+
+// projectLimits returns the project limits pcs configure.
+func projectLimits(pcs []config.ProjectConfig) []projects.Limit {
+	limits := make([]projects.Limit, 0, len(pcs))
+	for _, pc := range pcs {
+		limits = append(limits, projects.Limit{
+			Project:         pc.Name,
+			MaxPending:      pc.MaxPending,
+			MaxStorageBytes: int64(pc.MaxStorageMB) << 20,
+			MaxMessageBytes: pc.MaxMessageBytes,
+		})
+	}
+	return limits
+}
+
+// retentionPolicy returns the retention policy rc configures.
+func retentionPolicy(rc config.RetentionConfig) retention.Policy {
+	return retention.Policy{
+		History:  time.Duration(rc.History),
+		Rejected: time.Duration(rc.Rejected),
+		Audit:    time.Duration(rc.Audit),
+	}
+}
+
+// newRules builds the rules engine from the configured rules.
+func newRules(rcs []config.RuleConfig) (*rules.Engine, error) {
+	ruleList := make([]rules.Rule, 0, len(rcs))
+	for _, rc := range rcs {
+		ruleList = append(ruleList, rules.Rule{
+			Name:       rc.Name,
+			Direction:  rc.Direction,
+			Sender:     rc.Sender,
+			Recipient:  rc.Recipient,
+			Reputation: rc.Reputation,
+			When:       rc.When,
+			Action:     rules.Action(rc.Action),
+			Tags:       rc.Tags,
+		})
+	}
+	return rules.New(ruleList)
+}
+
+// newPolicies builds the recipient domain policies from the configured ones.
+func newPolicies(pcs []config.PolicyConfig) (*policy.Set, error) {
+	policies := make([]policy.Policy, 0, len(pcs))
+	for _, pc := range pcs {
+		policies = append(policies, policy.Policy{
+			Domain:        pc.Domain,
+			Action:        rules.Action(pc.Action),
+			Approvals:     pc.Approvals,
+			RequireReason: pc.RequireReason,
+		})
+	}
+	return policy.New(policies)
+}
+
+// newSMTPUsers builds the SMTP accounts from the configured users.
+func newSMTPUsers(ucs []config.SMTPUserConfig) (*smtp.Users, error) {
+	users := make([]smtp.User, 0, len(ucs))
+	for _, uc := range ucs {
+		users = append(users, smtp.User{
+			Username:                uc.Username,
+			PasswordHash:            uc.PasswordHash,
+			ClientCertCN:            uc.ClientCertCN,
+			AllowedFromDomains:      uc.AllowedFromDomains,
+			AllowedRecipientDomains: uc.AllowedRecipientDomains,
+			Project:                 uc.Project,
+		})
+	}
+	return smtp.NewUsers(users)
+}
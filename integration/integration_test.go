@@ -1,48 +1,106 @@
 package integration
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
+	"maps"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
 	"net/url"
+	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/albert/mailescrow/client"
+	"github.com/albert/mailescrow/internal/archive"
+	"github.com/albert/mailescrow/internal/autoreply"
+	"github.com/albert/mailescrow/internal/backfill"
+	"github.com/albert/mailescrow/internal/bounce"
+	"github.com/albert/mailescrow/internal/config"
+	"github.com/albert/mailescrow/internal/contacts"
+	"github.com/albert/mailescrow/internal/correspondence"
+	"github.com/albert/mailescrow/internal/debug"
+	"github.com/albert/mailescrow/internal/dkim"
+	"github.com/albert/mailescrow/internal/fixtures"
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/imaptest"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/journal"
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/policy"
+	"github.com/albert/mailescrow/internal/poller"
+	"github.com/albert/mailescrow/internal/projects"
+	"github.com/albert/mailescrow/internal/quota"
+	"github.com/albert/mailescrow/internal/redact"
 	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/reputation"
+	"github.com/albert/mailescrow/internal/retention"
+	"github.com/albert/mailescrow/internal/reviewmail"
+	"github.com/albert/mailescrow/internal/routing"
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/smtp"
 	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/sysmail"
+	"github.com/albert/mailescrow/internal/tokens"
+	"github.com/albert/mailescrow/internal/totp"
+	"github.com/albert/mailescrow/internal/tracking"
+	"github.com/albert/mailescrow/internal/unsubscribe"
 	"github.com/albert/mailescrow/internal/web"
+	"github.com/albert/mailescrow/internal/webhooks"
+	"github.com/albert/mailescrow/internal/window"
 )
 
 // --- Mock upstream SMTP server ---
 
 type receivedMessage struct {
-	From string
-	To   []string
-	Data string
+	From     string
+	To       []string
+	Data     string
+	Commands []string // MAIL and RCPT lines as sent, with their parameters
 }
 
 type upstreamSMTP struct {
-	addr     string
-	listener net.Listener
+	addr       string
+	listener   net.Listener
+	extensions []string // advertised in the EHLO reply, e.g. "DSN"
 
 	mu       sync.Mutex
 	received []receivedMessage
 }
 
-func startUpstreamSMTP(t *testing.T) *upstreamSMTP {
+func startUpstreamSMTP(t *testing.T, extensions ...string) *upstreamSMTP {
 	t.Helper()
 	lis, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatalf("listen upstream: %v", err)
 	}
-	u := &upstreamSMTP{addr: lis.Addr().String(), listener: lis}
+	u := &upstreamSMTP{addr: lis.Addr().String(), listener: lis, extensions: extensions}
 	go u.serve()
 	t.Cleanup(func() { lis.Close() })
 	return u
@@ -66,7 +124,7 @@ func (u *upstreamSMTP) handleConn(conn net.Conn) {
 	write("220 upstream SMTP ready")
 
 	var from string
-	var to []string
+	var to, commands []string
 	var data strings.Builder
 	inData := false
 
@@ -82,14 +140,15 @@ func (u *upstreamSMTP) handleConn(conn net.Conn) {
 				inData = false
 				u.mu.Lock()
 				u.received = append(u.received, receivedMessage{
-					From: from,
-					To:   to,
-					Data: data.String(),
+					From:     from,
+					To:       to,
+					Data:     data.String(),
+					Commands: commands,
 				})
 				u.mu.Unlock()
 				write("250 OK")
 				from = ""
-				to = nil
+				to, commands = nil, nil
 				data.Reset()
 				continue
 			}
@@ -101,12 +160,21 @@ func (u *upstreamSMTP) handleConn(conn net.Conn) {
 		upper := strings.ToUpper(line)
 		switch {
 		case strings.HasPrefix(upper, "EHLO") || strings.HasPrefix(upper, "HELO"):
-			write("250 Hello")
+			lines := append([]string{"Hello"}, u.extensions...)
+			for i, l := range lines {
+				if i == len(lines)-1 {
+					write("250 " + l)
+				} else {
+					write("250-" + l)
+				}
+			}
 		case strings.HasPrefix(upper, "MAIL FROM:"):
 			from = extractAddr(line)
+			commands = append(commands, line)
 			write("250 OK")
 		case strings.HasPrefix(upper, "RCPT TO:"):
 			to = append(to, extractAddr(line))
+			commands = append(commands, line)
 			write("250 OK")
 		case upper == "DATA":
 			write("354 Start mail input")
@@ -201,13 +269,18 @@ func extractID(body, action string) string {
 }
 
 func postAction(t *testing.T, webAddr, id, action string) {
+	t.Helper()
+	postActionForm(t, webAddr, id, action, url.Values{})
+}
+
+func postActionForm(t *testing.T, webAddr, id, action string, form url.Values) {
 	t.Helper()
 	client := &http.Client{
 		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
-	resp, err := client.PostForm("http://"+webAddr+"/email/"+id+"/"+action, url.Values{})
+	resp, err := client.PostForm("http://"+webAddr+"/email/"+id+"/"+action, form)
 	if err != nil {
 		t.Fatalf("POST /email/%s/%s: %v", id, action, err)
 	}
@@ -244,7 +317,12 @@ func postAPIEmail(t *testing.T, webAddr, to, subject, body string) string {
 
 func getAPIEmails(t *testing.T, webAddr string) []map[string]interface{} {
 	t.Helper()
-	resp, err := http.Get("http://" + webAddr + "/api/emails")
+	return getAPIEmailsQuery(t, webAddr, "")
+}
+
+func getAPIEmailsQuery(t *testing.T, webAddr, query string) []map[string]interface{} {
+	t.Helper()
+	resp, err := http.Get("http://" + webAddr + "/api/emails" + query)
 	if err != nil {
 		t.Fatalf("GET /api/emails: %v", err)
 	}
@@ -264,11 +342,22 @@ type testServer struct {
 	apiAddr string
 }
 
-func startTestServer(t *testing.T, st store.EmailStore, r relay.Sender) testServer {
+// startTestServer starts the web UI and API. opts configure the server before it starts.
+func startTestServer(t *testing.T, st store.EmailStore, r relay.Sender, opts ...func(*web.Server)) testServer {
+	t.Helper()
+	return startIMAPTestServer(t, st, r, nil, opts...) // nil imapClient — IMAP moves are skipped
+}
+
+// startIMAPTestServer starts the web UI and API filing inbound mail through
+// the IMAP client mover, e.g. one connected to an imaptest.Server.
+func startIMAPTestServer(t *testing.T, st store.EmailStore, r relay.Sender, mover web.IMAPMover, opts ...func(*web.Server)) testServer {
 	t.Helper()
 	webAddr := freeAddr(t)
 	apiAddr := freeAddr(t)
-	srv := web.New(st, r, nil, "sender@example.com", "", "") // nil imapClient — no IMAP in integration tests
+	srv := web.New(st, r, mover, "sender@example.com", "", "")
+	for _, opt := range opts {
+		opt(srv)
+	}
 	go srv.Serve(webAddr)
 	go srv.ServeAPI(apiAddr)
 	t.Cleanup(func() { srv.Shutdown(t.Context()) }) //nolint:errcheck
@@ -343,6 +432,71 @@ func TestOutboundApproveFlow(t *testing.T) {
 	}
 }
 
+// TestResumeRelays: after a restart, an approval that reached the relay is
+// finished without relaying it again, and one interrupted while relaying is
+// returned to review, flagged, rather than sent a second time.
+func TestResumeRelays(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	ctx := t.Context()
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	// Left behind by a crash: one accepted by the relay, one mid-relay.
+	sent, _ := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, "Accepted before the crash", "b", []byte("Subject: Accepted\r\n\r\nb"))
+	relaying, _ := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, "Interrupted by the crash", "b", []byte("Subject: Interrupted\r\n\r\nb"))
+	for _, id := range []string{sent, relaying} {
+		if err := st.Approve(ctx, id, "alice", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		if err := st.BeginRelay(ctx, id); err != nil {
+			t.Fatalf("begin relay: %v", err)
+		}
+	}
+	if err := st.MarkSent(ctx, sent); err != nil {
+		t.Fatalf("mark sent: %v", err)
+	}
+
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		if err := s.ResumeRelays(ctx); err != nil {
+			t.Fatalf("resume relays: %v", err)
+		}
+	})
+
+	if _, err := st.Get(ctx, sent); err == nil {
+		t.Error("the sent email was not deleted")
+	}
+	decisions, _ := st.ListDecisions(ctx, 10)
+	if len(decisions) != 1 || decisions[0].EmailID != sent || decisions[0].Reviewer != "alice" {
+		t.Errorf("decisions = %+v, want alice's approval of the sent email", decisions)
+	}
+	email, err := st.Get(ctx, relaying)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if email.Status != store.StatusPending || !email.HasFlag(store.FlagRelayInterrupted) {
+		t.Errorf("interrupted email: status %q, flags %v; want pending and flagged", email.Status, email.Flags)
+	}
+	if body := getBody(t, srv.webAddr); !strings.Contains(body, "may already have been sent") {
+		t.Error("web UI does not warn the interrupted email may have been sent")
+	}
+	if msgs := upstream.getReceived(); len(msgs) != 0 {
+		t.Errorf("relayed %d messages on restart, want none", len(msgs))
+	}
+
+	// Approving it again is the reviewer's call.
+	postAction(t, srv.webAddr, relaying, "approve")
+	if msgs := upstream.getReceived(); len(msgs) != 1 || !strings.Contains(msgs[0].Data, "Subject: Interrupted") {
+		t.Errorf("upstream = %+v, want the interrupted email relayed once approved again", msgs)
+	}
+	if inFlight, _ := st.ListInFlight(ctx); len(inFlight) != 0 {
+		t.Errorf("in flight = %+v, want none", inFlight)
+	}
+}
+
 // TestOutboundRejectFlow: POST /api/emails → reject → upstream gets nothing
 func TestOutboundRejectFlow(t *testing.T) {
 	upstream := startUpstreamSMTP(t)
@@ -389,7 +543,7 @@ func TestInboundApproveFlow(t *testing.T) {
 		"external@example.com", []string{"me@example.com"},
 		"Inbound Test", "Hello from outside!",
 		[]byte(rawMsg),
-		"<abc123@external.example.com>", "mailescrow/received",
+		"<abc123@external.example.com>", "mailescrow/received", "default",
 	)
 	if err != nil {
 		t.Fatalf("save inbound: %v", err)
@@ -439,6 +593,230 @@ func TestInboundApproveFlow(t *testing.T) {
 	}
 }
 
+// TestLMTPInbound: a local MTA delivers over LMTP → routed by envelope
+// recipient → approve → GET /api/emails returns it
+func TestLMTPInbound(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false) // unused for inbound
+	srv := startTestServer(t, st, r)
+
+	p := poller.New(nil, st, routing.New([]routing.Route{{Match: "support@*", Queue: "support"}}), nil, time.Minute, poller.Options{})
+	lmtp := smtp.NewLMTP(p)
+	lmtpAddr := freeAddr(t)
+	go lmtp.Serve(lmtpAddr) //nolint:errcheck
+	waitForPort(t, lmtpAddr)
+	t.Cleanup(func() { lmtp.Shutdown(t.Context()) }) //nolint:errcheck
+
+	conn, err := textproto.Dial("tcp", lmtpAddr)
+	if err != nil {
+		t.Fatalf("dial lmtp: %v", err)
+	}
+	defer conn.Close()
+	expect := func(code int) {
+		t.Helper()
+		if _, msg, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("lmtp: %v (%s)", err, msg)
+		}
+	}
+	expect(220)
+	for _, c := range []string{"LHLO mta.example.com", "MAIL FROM:<external@example.com>", "RCPT TO:<support@example.com>"} {
+		_ = conn.PrintfLine("%s", c)
+		expect(250)
+	}
+	_ = conn.PrintfLine("DATA")
+	expect(354)
+	w := conn.DotWriter()
+	_, _ = w.Write([]byte("From: external@example.com\r\nTo: list@example.com\r\nSubject: LMTP Test\r\n\r\nHello over LMTP"))
+	_ = w.Close()
+	expect(250)
+
+	body := getBody(t, srv.webAddr)
+	id := extractID(body, "approve")
+	if !strings.Contains(body, "LMTP Test") || id == "" {
+		t.Fatalf("web UI missing the delivered email: %q", body)
+	}
+	postAction(t, srv.webAddr, id, "approve")
+
+	resp, err := http.Get("http://" + srv.apiAddr + "/api/emails?queue=support")
+	if err != nil {
+		t.Fatalf("GET /api/emails: %v", err)
+	}
+	defer resp.Body.Close()
+	var emails []map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&emails)
+	if len(emails) != 1 || emails[0]["subject"] != "LMTP Test" || fmt.Sprint(emails[0]["delivered_to"]) != "[support@example.com]" {
+		t.Errorf("support queue = %v, want the email delivered to support@example.com", emails)
+	}
+}
+
+// TestIMAPInboundFlow: mail in a real IMAP mailbox → poller → approve/reject
+// in the web UI → GET /api/emails, with each message filed through the
+// mailescrow/* folders on the way
+func TestIMAPInboundFlow(t *testing.T) {
+	mailbox := imaptest.NewServer(t)
+	client := imap.New(mailbox.Host, mailbox.Port, imaptest.Username, imaptest.Password, false)
+	if err := client.EnsureFolders(t.Context()); err != nil {
+		t.Fatalf("ensure folders: %v", err)
+	}
+	invoice := fixtures.Message{
+		MessageID: "invoice@example.org", From: "Billing <billing@example.org>", Subject: "Rechnung März",
+		Text: "Anbei die Rechnung.", Charset: "iso-8859-1",
+		Attachments: []fixtures.Attachment{{Filename: "rechnung.pdf", ContentType: "application/pdf", Data: fixtures.PDF()}},
+		Header:      textproto.MIMEHeader{"Delivered-To": {"me@example.com"}},
+	}
+	spam := fixtures.Message{
+		MessageID: "spam@example.net", From: "promo@example.net", Subject: "You won", HTML: "<p>Click <a href=\"https://example.net\">here</a></p>",
+	}
+	mailbox.Deliver("INBOX", invoice.Bytes())
+	mailbox.Deliver("INBOX", spam.Bytes())
+
+	st := newTestStore(t)
+	srv := startIMAPTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false), client) // relay unused for inbound
+	p := poller.New(client, st, routing.New(nil), nil, time.Minute, poller.Options{})
+
+	// An outage fails the poll and leaves the mail where it is.
+	mailbox.SetDown(true)
+	if err := p.Poll(t.Context()); err == nil {
+		t.Fatal("poll succeeded while the IMAP server was down")
+	}
+	if got := p.Status(); got.ConsecutiveFailures != 1 || got.LastError == "" {
+		t.Errorf("status after failed poll = %+v, want one failure", got)
+	}
+	mailbox.SetDown(false)
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if got := p.Status(); got.ConsecutiveFailures != 0 || got.State != poller.StateClosed {
+		t.Errorf("status after recovery = %+v, want closed with no failures", got)
+	}
+	if got := mailbox.Messages("INBOX"); len(got) != 0 {
+		t.Errorf("INBOX holds %d messages after polling, want none", len(got))
+	}
+	if got := mailbox.Messages(imap.FolderReceived); len(got) != 2 {
+		t.Fatalf("%s holds %d messages, want 2", imap.FolderReceived, len(got))
+	}
+	// Polling again finds nothing new.
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("second poll: %v", err)
+	}
+	if n, _ := st.CountPending(t.Context()); n != 2 {
+		t.Errorf("pending = %d, want 2", n)
+	}
+
+	body := getBody(t, srv.webAddr)
+	for _, want := range []string{"Rechnung März", "You won", "billing@example.org"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("web UI missing %q", want)
+		}
+	}
+	pending, _ := st.ListPending(t.Context())
+	ids := map[string]string{}
+	for _, e := range pending {
+		ids[e.Subject] = e.ID
+	}
+	postAction(t, srv.webAddr, ids["Rechnung März"], "approve")
+	postAction(t, srv.webAddr, ids["You won"], "reject")
+
+	messageIDs := func(folder string) []string {
+		var got []string
+		for _, raw := range mailbox.Messages(folder) {
+			got = append(got, imap.ParseMessage(raw).MessageID)
+		}
+		return got
+	}
+	if got := messageIDs(imap.FolderApproved); !slices.Equal(got, []string{"<invoice@example.org>"}) {
+		t.Errorf("%s = %v, want the approved invoice", imap.FolderApproved, got)
+	}
+	if got := messageIDs(imap.FolderRejected); !slices.Equal(got, []string{"<spam@example.net>"}) {
+		t.Errorf("%s = %v, want the rejected message", imap.FolderRejected, got)
+	}
+
+	emails := getAPIEmails(t, srv.apiAddr)
+	if len(emails) != 1 || emails[0]["subject"] != "Rechnung März" || !strings.Contains(emails[0]["body"].(string), "Anbei die Rechnung.") {
+		t.Fatalf("GET /api/emails = %v, want the decoded invoice", emails)
+	}
+	if got := messageIDs(imap.FolderRead); !slices.Equal(got, []string{"<invoice@example.org>"}) {
+		t.Errorf("%s = %v, want the fetched invoice", imap.FolderRead, got)
+	}
+	if got := mailbox.Messages(imap.FolderApproved); len(got) != 0 {
+		t.Errorf("%s still holds %d messages after the fetch", imap.FolderApproved, len(got))
+	}
+}
+
+// TestIMAPWatchFolders: several folders are polled, and mail from a folder
+// with a queue goes to that queue whatever its recipients
+func TestIMAPWatchFolders(t *testing.T) {
+	mailbox := imaptest.NewServer(t)
+	client := imap.New(mailbox.Host, mailbox.Port, imaptest.Username, imaptest.Password, false)
+	if err := client.EnsureFolders(t.Context()); err != nil {
+		t.Fatalf("ensure folders: %v", err)
+	}
+	mailbox.Deliver("INBOX", fixtures.Message{MessageID: "hello@example.org", From: "alice@example.org", Subject: "Hello", Text: "hi"}.Bytes())
+	mailbox.Deliver("Support", fixtures.Message{MessageID: "help@example.org", From: "bob@example.org", Subject: "Help", Text: "it broke"}.Bytes())
+
+	st := newTestStore(t)
+	p := poller.New(client, st, routing.New(nil), nil, time.Minute, poller.Options{})
+	if err := p.SetFolders([]poller.Folder{{Name: imap.FolderInbox}, {Name: "Support", Queue: "support"}}); err != nil {
+		t.Fatalf("set folders: %v", err)
+	}
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	queues := make(map[string]string)
+	for _, e := range pending {
+		queues[e.Subject] = e.Queue
+	}
+	if want := map[string]string{"Hello": routing.DefaultQueue, "Help": "support"}; !maps.Equal(queues, want) {
+		t.Errorf("queues = %v, want %v", queues, want)
+	}
+	for _, folder := range []string{"INBOX", "Support"} {
+		if got := mailbox.Messages(folder); len(got) != 0 {
+			t.Errorf("%s holds %d messages after polling, want none", folder, len(got))
+		}
+	}
+	if got := mailbox.Messages(imap.FolderReceived); len(got) != 2 {
+		t.Errorf("%s holds %d messages, want both", imap.FolderReceived, len(got))
+	}
+}
+
+// TestImportIMAP: mail already in an IMAP folder is imported as approved
+// inbound history, left in its folder, and served by GET /api/emails in its
+// own queue; a second import adds nothing.
+func TestImportIMAP(t *testing.T) {
+	mailbox := imaptest.NewServer(t)
+	client := imap.New(mailbox.Host, mailbox.Port, imaptest.Username, imaptest.Password, false)
+	mailbox.Deliver("INBOX", fixtures.Message{MessageID: "old-1@example.org", From: "alice@example.org", Subject: "Kickoff notes"}.Bytes())
+	mailbox.Deliver("INBOX", fixtures.Message{MessageID: "old-2@example.org", From: "bob@example.org", Subject: "Signed contract"}.Bytes())
+
+	st := newTestStore(t)
+	srv := startIMAPTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false), client)
+	im := backfill.New(st, client, "")
+	for range 2 {
+		if _, err := im.Import(t.Context(), "INBOX", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+	}
+	if n, _ := st.CountPending(t.Context()); n != 0 {
+		t.Errorf("pending = %d, want imported mail not held", n)
+	}
+	if got := mailbox.Messages("INBOX"); len(got) != 2 {
+		t.Errorf("INBOX holds %d messages after the import, want both left there", len(got))
+	}
+
+	emails := getAPIEmailsQuery(t, srv.apiAddr, "?queue="+backfill.DefaultQueue)
+	if len(emails) != 2 || emails[0]["subject"] != "Kickoff notes" || emails[1]["from"] != "bob@example.org" {
+		t.Fatalf("imported emails = %v, want both messages once", emails)
+	}
+	if tags, _ := emails[0]["tags"].([]any); len(tags) != 1 || tags[0] != backfill.Tag {
+		t.Errorf("tags = %v, want [%s]", emails[0]["tags"], backfill.Tag)
+	}
+}
+
 // TestInboundRejectFlow: inject via SaveInbound → reject → GET /api/emails returns nothing
 func TestInboundRejectFlow(t *testing.T) {
 	st := newTestStore(t)
@@ -450,7 +828,7 @@ func TestInboundRejectFlow(t *testing.T) {
 		"external@example.com", []string{"me@example.com"},
 		"Spam", "Buy now!",
 		[]byte(rawMsg),
-		"<spam@example.com>", "mailescrow/received",
+		"<spam@example.com>", "mailescrow/received", "default",
 	)
 	if err != nil {
 		t.Fatalf("save inbound: %v", err)
@@ -592,3 +970,4882 @@ func TestMixedApproveAndReject(t *testing.T) {
 		t.Error("emails still visible in web UI after approve/reject")
 	}
 }
+
+// TestInboundQueueRouting: approved inbound mail is fetched per consumer queue
+func TestInboundQueueRouting(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	supportID, _ := st.SaveInbound(t.Context(), "a@example.com", []string{"support@example.com"}, "Need help", "body",
+		[]byte("Subject: Need help\r\n\r\nbody"), "<s1@example.com>", "mailescrow/received", "support")
+	billingID, _ := st.SaveInbound(t.Context(), "b@example.com", []string{"billing@example.com"}, "Invoice", "body",
+		[]byte("Subject: Invoice\r\n\r\nbody"), "<b1@example.com>", "mailescrow/received", "billing")
+	postAction(t, srv.webAddr, supportID, "approve")
+	postAction(t, srv.webAddr, billingID, "approve")
+
+	support := getAPIEmailsQuery(t, srv.apiAddr, "?queue=support")
+	if len(support) != 1 || support[0]["id"] != supportID {
+		t.Fatalf("support queue = %v, want only %s", support, supportID)
+	}
+	if support[0]["queue"] != "support" {
+		t.Errorf("queue = %v, want support", support[0]["queue"])
+	}
+
+	// The billing email was not consumed by the support consumer.
+	billing := getAPIEmailsQuery(t, srv.apiAddr, "?queue=billing")
+	if len(billing) != 1 || billing[0]["id"] != billingID {
+		t.Fatalf("billing queue = %v, want only %s", billing, billingID)
+	}
+}
+
+// TestRejectAndNotify: rejecting inbound mail with "notify" bounces it to an
+// authenticated sender and suppresses the bounce for an unauthenticated one.
+func TestRejectAndNotify(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+	bouncer, err := bounce.New(r, "sender@example.com", "", bounce.PolicyAuthenticated, "")
+	if err != nil {
+		t.Fatalf("new bouncer: %v", err)
+	}
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetBounce(bouncer) })
+
+	genuine, _ := st.SaveInbound(t.Context(), "bob@example.org", []string{"me@example.com"}, "Offer", "Buy now",
+		[]byte("Authentication-Results: mx.example.com; dkim=pass header.d=example.org\r\nFrom: bob@example.org\r\nSubject: Offer\r\n\r\nBuy now"),
+		"<offer@example.org>", "mailescrow/received", "default")
+	forged, _ := st.SaveInbound(t.Context(), "victim@example.net", []string{"me@example.com"}, "Spam", "Buy now",
+		[]byte("From: victim@example.net\r\nSubject: Spam\r\n\r\nBuy now"),
+		"<spam@example.net>", "mailescrow/received", "default")
+
+	if body := getBody(t, srv.webAddr); !strings.Contains(body, "Reject &amp; notify") {
+		t.Error("web UI missing reject and notify action")
+	}
+
+	notify := url.Values{"notify": {"1"}, "reason": {"Not interested"}}
+	postActionForm(t, srv.webAddr, genuine, "reject", notify)
+	postActionForm(t, srv.webAddr, forged, "reject", notify)
+
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 bounce, got %d", len(msgs))
+	}
+	if msgs[0].From != "" || len(msgs[0].To) != 1 || msgs[0].To[0] != "bob@example.org" {
+		t.Errorf("bounce envelope = %q -> %v, want <> -> bob@example.org", msgs[0].From, msgs[0].To)
+	}
+	if !strings.Contains(msgs[0].Data, "Subject: Message not accepted: Offer") || !strings.Contains(msgs[0].Data, "Not interested") {
+		t.Errorf("bounce data = %q", msgs[0].Data)
+	}
+	if pending, _ := st.ListPending(t.Context()); len(pending) != 0 {
+		t.Errorf("pending = %d, want both emails rejected", len(pending))
+	}
+}
+
+// TestLongBodyPreview: the pending list shows a preview of long bodies and the
+// detail page loads the rest on demand.
+func TestLongBodyPreview(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	body := strings.Repeat("a", store.PreviewLength) + "TAIL"
+	id, _ := st.SaveOutbound(t.Context(), "app@example.com", []string{"ops@example.com"}, "Long", body, []byte("Subject: Long\r\n\r\n"+body))
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	for _, path := range []string{"/", "/email/" + id} {
+		page := get(path)
+		if strings.Contains(page, "TAIL") || !strings.Contains(page, "Show full message") {
+			t.Errorf("%s: want truncated preview with a link to the full message", path)
+		}
+	}
+	if page := get("/email/" + id + "/body"); page != body {
+		t.Errorf("full body = %d bytes, want %d", len(page), len(body))
+	}
+}
+
+// TestWebUIPages: detail, history, stats, settings and static assets render
+func TestWebUIPages(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	id, _ := st.SaveInbound(t.Context(), "external@example.com", []string{"me@example.com"}, "Page Test", "Hello pages",
+		[]byte("Subject: Page Test\r\n\r\nHello pages"), "<pages@example.com>", "mailescrow/received", "default")
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, body := get("/email/" + id); code != http.StatusOK || !strings.Contains(body, "Page Test") || !strings.Contains(body, "Raw message") {
+		t.Errorf("detail page: status %d, body %q", code, body)
+	}
+	malformed, _ := st.SaveInbound(t.Context(), "external@example.com", []string{"me@example.com"}, "Broken", "",
+		[]byte("Subject: Broken\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/html\r\n\r\n<p>cut off"), "<broken@example.com>", "mailescrow/received", "default")
+	if _, body := get("/email/" + malformed); !strings.Contains(body, "<code>multipart/mixed</code>") || !strings.Contains(body, "<code>text/html</code>") ||
+		!strings.Contains(body, "cannot read part 2") {
+		t.Errorf("detail page does not show the MIME structure and its problem: %q", body)
+	}
+	_ = st.SetSignature(t.Context(), id, store.Signature{Protocol: store.SignatureSMIME, Status: store.SignatureValid, Signer: "external@example.com"})
+	if _, body := get("/email/" + id); !strings.Contains(body, "S/MIME valid, signed by external@example.com") {
+		t.Errorf("detail page does not show the signature: %q", body)
+	}
+	if code, _ := get("/email/does-not-exist"); code != http.StatusNotFound {
+		t.Errorf("missing detail page: status %d, want 404", code)
+	}
+	if code, body := get("/email/" + id + "/body"); code != http.StatusOK || body != "Hello pages" {
+		t.Errorf("body: status %d, body %q", code, body)
+	}
+	if code, body := get("/email/" + id + "/raw"); code != http.StatusOK || !strings.HasPrefix(body, "Subject: Page Test") {
+		t.Errorf("raw message: status %d, body %q", code, body)
+	}
+	if code, body := get("/static/style.css"); code != http.StatusOK || !strings.Contains(body, ".card") {
+		t.Errorf("static css: status %d", code)
+	}
+	if code, _ := get("/nope"); code != http.StatusNotFound {
+		t.Errorf("unknown page: status %d, want 404", code)
+	}
+
+	postAction(t, srv.webAddr, id, "approve")
+
+	if code, body := get("/history"); code != http.StatusOK || !strings.Contains(body, "Page Test") || !strings.Contains(body, "approved") {
+		t.Errorf("history page: status %d, body %q", code, body)
+	}
+	if code, body := get("/stats"); code != http.StatusOK || !strings.Contains(body, "anonymous") {
+		t.Errorf("stats page: status %d, body %q", code, body)
+	}
+	if code, _ := get("/settings"); code != http.StatusOK {
+		t.Errorf("settings page: status %d", code)
+	}
+}
+
+// TestOutboundPreview: the preview page shows an outbound email as relayed
+func TestOutboundPreview(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	r.SetHeaderRewrite(true, nil)
+	srv := startTestServer(t, st, r)
+
+	raw := "From: app@example.com\r\nTo: ops@example.com\r\nSubject: Invoice\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nPlain invoice\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>HTML invoice</p>\r\n" +
+		"--b--\r\n"
+	id, _ := st.SaveOutbound(t.Context(), "app@example.com", []string{"ops@example.com"}, "Invoice", "Plain invoice", []byte(raw))
+	inboundID, _ := st.SaveInbound(t.Context(), "external@example.com", []string{"me@example.com"}, "Hi", "Hi",
+		[]byte("Subject: Hi\r\n\r\nHi"), "<preview@example.com>", "mailescrow/received", "default")
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if _, body := get("/email/" + id); !strings.Contains(body, "/email/"+id+"/preview") {
+		t.Error("detail page does not link to the preview")
+	}
+	if code, body := get("/email/" + id + "/preview"); code != http.StatusOK || !strings.Contains(body, "Plain invoice") || !strings.Contains(body, "rewrites the headers") {
+		t.Errorf("text preview: status %d, body %q", code, body)
+	}
+	if _, body := get("/email/" + id + "/preview?view=html"); !strings.Contains(body, "HTML invoice") || !strings.Contains(body, `sandbox=""`) {
+		t.Errorf("html preview: %q", body)
+	}
+	if _, body := get("/email/" + id + "/preview?view=raw"); !strings.Contains(body, "X-Mailescrow-Approved-By: anonymous") {
+		t.Errorf("raw preview is missing the stamped headers: %q", body)
+	}
+	if code, _ := get("/email/" + inboundID + "/preview"); code != http.StatusBadRequest {
+		t.Errorf("inbound preview: status %d, want 400", code)
+	}
+}
+
+// TestSenderQuota: over-quota API submissions are held and flagged, or refused
+func TestSenderQuota(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	limiter, err := quota.New(st, 1, 0, quota.ActionHold)
+	if err != nil {
+		t.Fatalf("new limiter: %v", err)
+	}
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetQuota(limiter) })
+
+	postAPIEmail(t, srv.apiAddr, "a@example.com", "Within quota", "one")
+	overID := postAPIEmail(t, srv.apiAddr, "b@example.com", "Over quota", "two")
+
+	email, err := st.Get(t.Context(), overID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !email.HasFlag(store.FlagQuotaExceeded) {
+		t.Errorf("flags = %v, want quota_exceeded", email.Flags)
+	}
+	if body := getBody(t, srv.webAddr); strings.Count(body, "quota exceeded") != 1 {
+		t.Errorf("pending page should show one quota exceeded badge")
+	}
+
+	resp, err := http.Get("http://" + srv.webAddr + "/stats")
+	if err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	stats, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(stats), "sender@example.com") || !strings.Contains(string(stats), "2 / 1") {
+		t.Errorf("stats page missing quota usage: %s", stats)
+	}
+
+	// With the refuse action, over-quota submissions get 429.
+	refuser, _ := quota.New(newTestStore(t), 1, 0, quota.ActionRefuse)
+	srv2 := startTestServer(t, newTestStore(t), r, func(s *web.Server) { s.SetQuota(refuser) })
+	postAPIEmail(t, srv2.apiAddr, "a@example.com", "Within quota", "one")
+	b, _ := json.Marshal(map[string]any{"to": []string{"a@example.com"}, "subject": "Over", "body": "two"})
+	resp, err = http.Post("http://"+srv2.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("over-quota status = %d, want 429", resp.StatusCode)
+	}
+	if usage, _ := refuser.Usage(t.Context()); len(usage) != 1 || usage[0].HourCount != 1 {
+		t.Errorf("usage after a refused submission = %+v, want only the accepted one counted", usage)
+	}
+}
+
+// TestTokenQuota: with API tokens, each token has its own quota, whatever
+// address it sends as
+func TestTokenQuota(t *testing.T) {
+	st := newTestStore(t)
+	tm := tokens.New(st)
+	limiter, _ := quota.New(st, 1, 0, quota.ActionRefuse)
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false), func(s *web.Server) {
+		s.SetTokens(tm, true)
+		s.SetQuota(limiter)
+	})
+	post := func(token string) int {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"a@example.com"}, "subject": "Hi", "body": "hi"})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/emails", bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	billing, billingTok, _ := tm.Create(t.Context(), "billing", []string{tokens.ScopeSend}, 0, "test")
+	alerts, alertsTok, _ := tm.Create(t.Context(), "alerts", []string{tokens.ScopeSend}, 0, "test")
+	// A second token called billing does not share the first one's quota.
+	again, againTok, _ := tm.Create(t.Context(), "billing", []string{tokens.ScopeSend}, 0, "test")
+
+	if code := post(billing); code != http.StatusCreated {
+		t.Fatalf("first billing submission: status %d, want 201", code)
+	}
+	if code := post(billing); code != http.StatusTooManyRequests {
+		t.Errorf("second billing submission: status %d, want 429", code)
+	}
+	if code := post(alerts); code != http.StatusCreated {
+		t.Errorf("alerts submission: status %d, want 201 from its own quota", code)
+	}
+	if code := post(again); code != http.StatusCreated {
+		t.Errorf("second billing token submission: status %d, want 201 from its own quota", code)
+	}
+	usage, _ := limiter.Usage(t.Context())
+	counted := make(map[string]bool)
+	for _, u := range usage {
+		counted[u.Sender] = true
+	}
+	if len(usage) != 3 || !counted[quota.TokenKey(billingTok.ID)] || !counted[quota.TokenKey(alertsTok.ID)] || !counted[quota.TokenKey(againTok.ID)] {
+		t.Errorf("usage = %+v, want one counter per token", usage)
+	}
+}
+
+// eventLog is a notify.Notifier keeping the events it is given.
+type eventLog struct {
+	mu     sync.Mutex
+	events []notify.Event
+}
+
+func (l *eventLog) Notify(_ context.Context, e notify.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+	return nil
+}
+
+// TestTokenProject: mail submitted with an API token that has a project is
+// tagged with it and held to the project's limits, in batches too
+func TestTokenProject(t *testing.T) {
+	st := newTestStore(t)
+	tm := tokens.New(st)
+	events := &eventLog{}
+	limits, err := projects.New(st, []projects.Limit{{Project: "billing", MaxPending: 1, MaxMessageBytes: 2048}}, events)
+	if err != nil {
+		t.Fatalf("new limits: %v", err)
+	}
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false), func(s *web.Server) {
+		s.SetTokens(tm, true)
+		s.SetProjects(limits)
+	})
+	billing, _, err := tm.CreateForProject(t.Context(), "billing-app", "billing", []string{tokens.ScopeSend}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	other, _, _ := tm.Create(t.Context(), "other-app", []string{tokens.ScopeSend}, 0, "test")
+	post := func(token, path string, payload any) (int, []byte) {
+		t.Helper()
+		b, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+path, bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+	email := func(body string) map[string]any {
+		return map[string]any{"to": []string{"a@example.com"}, "subject": "Invoice", "body": body}
+	}
+
+	if code, b := post(billing, "/api/emails", email(strings.Repeat("x", 4096))); code != http.StatusRequestEntityTooLarge || !strings.Contains(string(b), "project billing") {
+		t.Errorf("oversized submission: %d %s, want 413 naming the project", code, b)
+	}
+	if code, b := post(billing, "/api/emails", email("first")); code != http.StatusCreated {
+		t.Fatalf("first submission: %d %s, want 201", code, b)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || !slices.Contains(pending[0].Tags, "billing") {
+		t.Fatalf("pending = %+v, want the submission tagged with its project", pending)
+	}
+	if code, b := post(billing, "/api/emails", email("second")); code != http.StatusTooManyRequests || !strings.Contains(string(b), "too many emails pending") {
+		t.Errorf("submission over max_pending: %d %s, want 429", code, b)
+	}
+	code, b := post(billing, "/api/emails/batch", map[string]any{"emails": []any{email("third")}})
+	if code != http.StatusOK || !strings.Contains(string(b), `"status":429`) {
+		t.Errorf("batch over max_pending: %d %s, want its email refused with 429", code, b)
+	}
+	if code, b := post(other, "/api/emails", email("other")); code != http.StatusCreated {
+		t.Errorf("submission without a project: %d %s, want 201", code, b)
+	}
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	var kinds []string
+	for _, e := range events.events {
+		kinds = append(kinds, e.Type)
+	}
+	if want := []string{notify.EventProjectLimit, notify.EventProjectLimit}; !slices.Equal(kinds, want) {
+		t.Errorf("events = %v, want %v", kinds, want)
+	}
+}
+
+// TestHealthz: /healthz is ok without IMAP and degraded while the poller's breaker is open
+func TestHealthz(t *testing.T) {
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	getHealth := func(apiAddr string) (int, map[string]any) {
+		t.Helper()
+		resp, err := http.Get("http://" + apiAddr + "/healthz")
+		if err != nil {
+			t.Fatalf("GET /healthz: %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return resp.StatusCode, body
+	}
+
+	srv := startTestServer(t, newTestStore(t), r)
+	if code, body := getHealth(srv.apiAddr); code != http.StatusOK || body["status"] != "ok" || body["imap"] != nil {
+		t.Errorf("healthz without IMAP = %d %v, want 200 ok", code, body)
+	}
+
+	status := poller.Status{State: poller.StateOpen, ConsecutiveFailures: 7, LastError: "connection refused"}
+	srv = startTestServer(t, newTestStore(t), r, func(s *web.Server) {
+		s.SetPollerStatus(func() poller.Status { return status })
+	})
+	code, body := getHealth(srv.apiAddr)
+	if code != http.StatusServiceUnavailable || body["status"] != "degraded" {
+		t.Errorf("healthz with open breaker = %d %v, want 503 degraded", code, body)
+	}
+	if imap, _ := body["imap"].(map[string]any); imap["state"] != "open" || imap["consecutive_failures"] != float64(7) {
+		t.Errorf("imap status = %v", body["imap"])
+	}
+}
+
+// TestTrustedContacts: approvals are learned; once trusted, API mail is relayed immediately
+func TestTrustedContacts(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+	book := contacts.New(st, 2)
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetContacts(book) })
+
+	send := func(subject string) map[string]any {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"friend@example.com"}, "subject": subject, "body": "hi"})
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return result
+	}
+
+	for i := range 2 {
+		result := send(fmt.Sprintf("Review %d", i))
+		if result["status"] != "pending" {
+			t.Fatalf("submission %d status = %v, want pending", i, result["status"])
+		}
+		if i == 1 && !strings.Contains(getBody(t, srv.webAddr), "previously approved 1 time") {
+			t.Error("pending page missing previously approved badge")
+		}
+		postAction(t, srv.webAddr, result["id"].(string), "approve")
+	}
+
+	result := send("Trusted")
+	if result["status"] != "sent" {
+		t.Fatalf("status = %v, want sent to a contact approved twice", result["status"])
+	}
+	if msgs := upstream.getReceived(); len(msgs) != 3 || !strings.Contains(msgs[2].Data, "Subject: Trusted") {
+		t.Errorf("upstream received %d messages, want the trusted one relayed immediately", len(msgs))
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 1)
+	if len(decisions) != 1 || decisions[0].Reviewer != contacts.Reviewer {
+		t.Errorf("latest decision = %+v, want approval by contacts", decisions)
+	}
+}
+
+// TestIdempotencyKey: retried submissions with the same key return the original email
+func TestIdempotencyKey(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	submit := func(key, subject string) (*http.Response, map[string]any) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"ops@example.com"}, "subject": subject, "body": "hi"})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/emails", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp, result
+	}
+
+	resp, first := submit("retry-1", "Report")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Fatalf("first submission: status %d, replayed %q", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+	}
+	resp, retry := submit("retry-1", "Report")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Idempotent-Replayed") != "true" || retry["id"] != first["id"] || retry["status"] != "pending" {
+		t.Errorf("retry: status %d, body %v, want the original id %v", resp.StatusCode, retry, first["id"])
+	}
+	if resp, _ := submit("retry-1", "Different report"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with a different request: status %d, want 422", resp.StatusCode)
+	}
+	if _, other := submit("retry-2", "Report"); other["id"] == first["id"] {
+		t.Error("a different key returned the same email")
+	}
+
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 2 {
+		t.Errorf("pending = %d emails, want 2", len(pending))
+	}
+}
+
+// TestIdempotencyKeyPerToken: an Idempotency-Key only replays submissions
+// made with the same API token
+func TestIdempotencyKeyPerToken(t *testing.T) {
+	st := newTestStore(t)
+	tm := tokens.New(st)
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false), func(s *web.Server) { s.SetTokens(tm, true) })
+	billing, _, _ := tm.Create(t.Context(), "billing", []string{tokens.ScopeSend}, 0, "test")
+	alerts, _, _ := tm.Create(t.Context(), "alerts", []string{tokens.ScopeSend}, 0, "test")
+
+	submit := func(token string) (string, string) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"ops@example.com"}, "subject": "Report", "body": "hi"})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/emails", bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Idempotency-Key", "report-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			ID string `json:"id"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return result.ID, resp.Header.Get("Idempotent-Replayed")
+	}
+	first, _ := submit(billing)
+	other, replayed := submit(alerts)
+	if other == first || replayed != "" {
+		t.Errorf("another token's submission with the same key = %s (replayed %q), want a new email", other, replayed)
+	}
+	if again, replayed := submit(billing); again != first || replayed != "true" {
+		t.Errorf("retry with the same token = %s (replayed %q), want %s replayed", again, replayed, first)
+	}
+	if pending, _ := st.ListPending(t.Context()); len(pending) != 2 {
+		t.Errorf("pending = %d emails, want 2", len(pending))
+	}
+}
+
+// TestAPITokens: tokens created in the UI gate the API by scope and can be revoked
+func TestAPITokens(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetTokens(tokens.New(st), true) })
+
+	call := func(method, path, token, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+srv.apiAddr+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	email := `{"to": ["ops@example.com"], "subject": "Tokens", "body": "hi"}`
+
+	if code, _ := call(http.MethodPost, "/api/emails", "", email); code != http.StatusUnauthorized {
+		t.Errorf("submission without a token: status %d, want 401", code)
+	}
+	if code, _ := call(http.MethodGet, "/healthz", "", ""); code != http.StatusOK {
+		t.Errorf("healthz without a token: status %d, want 200", code)
+	}
+
+	// Create an admin token in the web UI; the plaintext is shown once.
+	resp, err := http.PostForm("http://"+srv.webAddr+"/tokens", url.Values{"name": {"ops"}, "scope": {tokens.ScopeAdmin}})
+	if err != nil {
+		t.Fatalf("POST /tokens: %v", err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	_, rest, _ := strings.Cut(string(page), "<pre>")
+	admin, _, _ := strings.Cut(rest, "</pre>")
+	if !strings.HasPrefix(admin, "mesc_") {
+		t.Fatalf("tokens page does not show the new token: %s", page)
+	}
+
+	// Use it to issue a send-only token through the API.
+	code, body := call(http.MethodPost, "/api/tokens", admin, `{"name": "agent", "scopes": ["send"], "expires_in_days": 30}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create token: status %d, body %s", code, body)
+	}
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal([]byte(body), &created)
+
+	if code, _ := call(http.MethodPost, "/api/emails", created.Token, email); code != http.StatusCreated {
+		t.Errorf("submission with a send token: status %d, want 201", code)
+	}
+	if code, _ := call(http.MethodGet, "/api/emails", created.Token, ""); code != http.StatusForbidden {
+		t.Errorf("read with a send token: status %d, want 403", code)
+	}
+	if code, _ := call(http.MethodGet, "/api/tokens", created.Token, ""); code != http.StatusForbidden {
+		t.Errorf("token list with a send token: status %d, want 403", code)
+	}
+
+	code, body = call(http.MethodGet, "/api/tokens", admin, "")
+	if code != http.StatusOK || !strings.Contains(body, `"name":"agent"`) || !strings.Contains(body, `"last_used_at"`) || strings.Contains(body, created.Token) {
+		t.Errorf("token list: status %d, body %s", code, body)
+	}
+
+	if code, _ := call(http.MethodDelete, "/api/tokens/"+created.ID, admin, ""); code != http.StatusNoContent {
+		t.Errorf("revoke: status %d, want 204", code)
+	}
+	if code, _ := call(http.MethodPost, "/api/emails", created.Token, email); code != http.StatusUnauthorized {
+		t.Errorf("submission with a revoked token: status %d, want 401", code)
+	}
+
+	resp, err = http.Get("http://" + srv.webAddr + "/tokens")
+	if err != nil {
+		t.Fatalf("GET /tokens: %v", err)
+	}
+	page, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{"revoked", "token:agent", "POST /api/emails", "token.create", "token.revoke"} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("tokens page missing %q", want)
+		}
+	}
+}
+
+// TestTokenWebhooks: an API token registers its own webhook, which is told
+// about decisions and keeps a delivery history only that token can read
+func TestTokenWebhooks(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+	queue := jobs.New(st)
+	hooks := webhooks.New(st, queue)
+	hooks.SetAllowPrivate(true) // the receiver listens on loopback
+	tm := tokens.New(st)
+	srv := startTestServer(t, webhooks.NewStore(st, hooks), r, func(s *web.Server) {
+		s.SetJobs(queue)
+		s.SetTokens(tm, false)
+		s.SetWebhooks(hooks)
+	})
+
+	reader, _, err := tm.Create(t.Context(), "consumer", []string{tokens.ScopeWebhooks}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	other, _, err := tm.Create(t.Context(), "other", []string{tokens.ScopeWebhooks}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	readOnly, _, err := tm.Create(t.Context(), "read-only", []string{tokens.ScopeRead}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	call := func(method, path, token, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+srv.apiAddr+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	var mu sync.Mutex
+	var events []map[string]any
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e map[string]any
+		_ = json.NewDecoder(req.Body).Decode(&e)
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer receiver.Close()
+
+	if code, _ := call(http.MethodPost, "/api/webhooks", "", `{"url": "`+receiver.URL+`"}`); code != http.StatusUnauthorized {
+		t.Errorf("register without a token: status %d, want 401", code)
+	}
+	if code, _ := call(http.MethodPost, "/api/webhooks", readOnly, `{"url": "`+receiver.URL+`"}`); code != http.StatusForbidden {
+		t.Errorf("register with a read token: status %d, want 403", code)
+	}
+	if code, _ := call(http.MethodPost, "/api/webhooks", reader, `{"url": "`+receiver.URL+`", "events": ["email_sent"]}`); code != http.StatusBadRequest {
+		t.Errorf("register an unknown event: status %d, want 400", code)
+	}
+	code, body := call(http.MethodPost, "/api/webhooks", reader, `{"url": "`+receiver.URL+`", "events": ["email_approved"], "direction": "outbound"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("register: status %d, body %s", code, body)
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal([]byte(body), &created)
+
+	if code, body := call(http.MethodGet, "/api/webhooks", reader, ""); code != http.StatusOK || !strings.Contains(body, created.ID) {
+		t.Errorf("list: status %d, body %s", code, body)
+	}
+	if code, body := call(http.MethodGet, "/api/webhooks", other, ""); code != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("another token's list: status %d, body %s, want []", code, body)
+	}
+
+	postAPIEmail(t, srv.apiAddr, "recipient@example.com", "Unhooked", "Rejections are not subscribed.")
+	postAction(t, srv.webAddr, extractID(getBody(t, srv.webAddr), "reject"), "reject")
+	inID, err := st.SaveInbound(t.Context(), "ann@example.com", []string{"me@example.com"}, "Inbound", "hi", []byte("Subject: Inbound\r\n\r\nhi"), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	postAction(t, srv.webAddr, inID, "approve") // inbound is not subscribed either
+	postAPIEmail(t, srv.apiAddr, "recipient@example.com", "Hooked", "Tell the consumer.")
+	id := extractID(getBody(t, srv.webAddr), "approve")
+	postAction(t, srv.webAddr, id, "approve")
+	if err := queue.RunDue(t.Context()); err != nil {
+		t.Fatalf("run jobs: %v", err)
+	}
+
+	mu.Lock()
+	if len(events) != 1 || events[0]["event"] != "email_approved" || events[0]["email_id"] != id || events[0]["subject"] != "Hooked" {
+		t.Errorf("events = %v, want one email_approved for %s", events, id)
+	}
+	mu.Unlock()
+
+	code, body = call(http.MethodGet, "/api/webhooks/"+created.ID+"/deliveries", reader, "")
+	if code != http.StatusOK || !strings.Contains(body, `"status":"succeeded"`) || !strings.Contains(body, `"response_code":202`) || !strings.Contains(body, `"attempts":1`) {
+		t.Errorf("deliveries: status %d, body %s", code, body)
+	}
+	if code, _ := call(http.MethodGet, "/api/webhooks/"+created.ID+"/deliveries", other, ""); code != http.StatusNotFound {
+		t.Errorf("another token's deliveries: status %d, want 404", code)
+	}
+	if code, _ := call(http.MethodDelete, "/api/webhooks/"+created.ID, other, ""); code != http.StatusNotFound {
+		t.Errorf("another token's delete: status %d, want 404", code)
+	}
+	if code, _ := call(http.MethodDelete, "/api/webhooks/"+created.ID, reader, ""); code != http.StatusNoContent {
+		t.Errorf("delete: status %d, want 204", code)
+	}
+	if code, body := call(http.MethodGet, "/api/webhooks", reader, ""); code != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("list after delete: status %d, body %s, want []", code, body)
+	}
+}
+
+// TestAnnotations: scanners attach findings to held email over the API; they
+// show on the detail page, and rules looking at annotations tag or reject it.
+func TestAnnotations(t *testing.T) {
+	st := newTestStore(t)
+	tm := tokens.New(st)
+	engine, err := rules.New([]rules.Rule{
+		{Name: "phishing", When: `email.annotations.exists(a, a.kind == "phishing" && a.score >= 0.9)`, Action: rules.ActionReject},
+		{Name: "dlp", When: `email.annotations.exists(a, a.kind == "dlp" && size(a.findings) > 0)`, Tags: []string{"dlp"}},
+		{Name: "inbound", Direction: store.DirectionInbound, Action: rules.ActionReject}, // never looks at annotations
+	})
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false), func(s *web.Server) { // relay unused for inbound
+		s.SetTokens(tm, false)
+		s.SetRules(engine)
+	})
+
+	scanner, _, err := tm.Create(t.Context(), "scanner", []string{tokens.ScopeAnnotate}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	reader, _, err := tm.Create(t.Context(), "reader", []string{tokens.ScopeRead}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	annotate := func(id, token, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/emails/"+id+"/annotations", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("annotate: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	save := func(subject string) string {
+		t.Helper()
+		id, err := st.SaveInbound(t.Context(), "ann@example.com", []string{"me@example.com"}, subject, "hi", []byte("Subject: "+subject+"\r\n\r\nhi"), "", "", "default")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+		return id
+	}
+	invoice, login := save("Invoice"), save("Verify your account")
+
+	dlp := `{"source": "dlp-scanner", "kind": "dlp", "severity": "warning", "summary": "Bank details", "findings": ["IBAN DE89 3704"]}`
+	if code, _ := annotate(invoice, reader, dlp); code != http.StatusForbidden {
+		t.Errorf("annotate with a read token: status %d, want 403", code)
+	}
+	if code, _ := annotate(invoice, scanner, `{"source": "x", "kind": "dlp", "severity": "dire"}`); code != http.StatusBadRequest {
+		t.Errorf("annotate with an unknown severity: status %d, want 400", code)
+	}
+	if code, _ := annotate("missing", scanner, dlp); code != http.StatusNotFound {
+		t.Errorf("annotate a missing email: status %d, want 404", code)
+	}
+	if code, body := annotate(invoice, scanner, dlp); code != http.StatusCreated || strings.Contains(body, `"rule"`) {
+		t.Fatalf("annotate: status %d, body %s", code, body)
+	}
+
+	// The DLP rule tagged the email; the inbound rule, which does not look
+	// at annotations, left it pending.
+	email, err := st.GetSummary(t.Context(), invoice)
+	if err != nil || email.Status != store.StatusPending || !slices.Contains(email.Tags, "dlp") {
+		t.Fatalf("annotated email = %+v (%v), want pending and tagged dlp", email, err)
+	}
+	resp, err := http.Get("http://" + srv.webAddr + "/email/" + invoice)
+	if err != nil {
+		t.Fatalf("GET detail: %v", err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{`badge-severity-warning`, "Bank details", "IBAN DE89 3704"} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("detail page lacks %q", want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+srv.apiAddr+"/api/emails/"+invoice+"/annotations", nil)
+	req.Header.Set("Authorization", "Bearer "+scanner)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("list annotations: %v", err)
+	}
+	var list []struct {
+		Source    string `json:"source"`
+		CreatedBy string `json:"created_by"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].Source != "dlp-scanner" || list[0].CreatedBy != "token:scanner" {
+		t.Errorf("annotations = %+v", list)
+	}
+
+	code, body := annotate(login, scanner, `{"source": "phish-scanner", "kind": "phishing", "severity": "critical", "score": 0.97}`)
+	if code != http.StatusCreated || !strings.Contains(body, `"rule":"phishing"`) {
+		t.Fatalf("annotate phishing: status %d, body %s", code, body)
+	}
+	d, err := st.LastDecision(t.Context(), login)
+	if err != nil || d == nil || d.Decision != store.DecisionRejected || d.Reviewer != "rule:phishing" {
+		t.Errorf("decision = %+v (%v), want rejected by rule:phishing", d, err)
+	}
+}
+
+// TestCustomHeaders: API headers are added to the message; blocked ones are refused
+func TestCustomHeaders(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	post := func(headers map[string]string) (int, string) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"ops@example.com"}, "subject": "Newsletter", "body": "hi", "headers": headers})
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			ID string `json:"id"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.ID
+	}
+
+	code, id := post(map[string]string{"List-Unsubscribe": "<https://example.com/unsub>", "X-Campaign-Id": "spring"})
+	if code != http.StatusCreated {
+		t.Fatalf("status %d, want 201", code)
+	}
+	email, err := st.Get(t.Context(), id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	raw := string(email.RawMessage)
+	if !strings.Contains(raw, "\r\nList-Unsubscribe: <https://example.com/unsub>\r\nX-Campaign-Id: spring\r\nMIME-Version: 1.0\r\n") {
+		t.Errorf("raw message missing custom headers:\n%s", raw)
+	}
+
+	for _, headers := range []map[string]string{{"Bcc": "hidden@example.com"}, {"From": "ceo@example.com"}, {"X-Tag": "a\r\nBcc: hidden@example.com"}} {
+		if code, _ := post(headers); code != http.StatusBadRequest {
+			t.Errorf("headers %v: status %d, want 400", headers, code)
+		}
+	}
+}
+
+// TestHTMLBody: html_body is sent alongside body as multipart/alternative and
+// both parts can be previewed
+func TestHTMLBody(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	b, _ := json.Marshal(map[string]any{"to": []string{"ops@example.com"}, "subject": "Menü", "body": "Plain menu", "html_body": "<p>HTML menü</p>"})
+	resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status %d, want 201", resp.StatusCode)
+	}
+
+	email, err := st.Get(t.Context(), result.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if email.Body != "Plain menu" {
+		t.Errorf("body = %q, want the plain text part", email.Body)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(email.RawMessage))
+	if err != nil {
+		t.Fatalf("parse raw message: %v", err)
+	}
+	if ct := msg.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/alternative; boundary=") {
+		t.Errorf("Content-Type = %q, want multipart/alternative", ct)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Menü" {
+		t.Errorf("Subject = %q, want Menü", subject)
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	if body := get("/email/" + result.ID); !strings.Contains(body, "/email/"+result.ID+"/html") {
+		t.Error("detail page does not link to the HTML view")
+	}
+	if body := get("/email/" + result.ID + "/preview"); !strings.Contains(body, "Plain menu") {
+		t.Errorf("text preview: %q", body)
+	}
+	if body := get("/email/" + result.ID + "/preview?view=html"); !strings.Contains(body, "HTML menü") {
+		t.Errorf("html preview: %q", body)
+	}
+}
+
+// TestSendAsIdentity: "identity" picks the From address and envelope sender,
+// signs with the identity's DKIM key and is limited to the listed tokens
+func TestSendAsIdentity(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dkim.New("example.com", "mail", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr := tokens.New(st)
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false), func(s *web.Server) {
+		s.SetTokens(mgr, true)
+		err := s.SetIdentities([]web.Identity{
+			{Name: "support", Address: "support@example.com", DisplayName: "Support Team", DKIM: signer, Tokens: []string{"helpdesk"}},
+			{Name: "sales", Address: "sales@example.com"},
+		})
+		if err != nil {
+			t.Fatalf("set identities: %v", err)
+		}
+	})
+	token := func(name string) string {
+		t.Helper()
+		plain, _, err := mgr.Create(t.Context(), name, []string{tokens.ScopeSend}, 0, "test")
+		if err != nil {
+			t.Fatalf("create token %s: %v", name, err)
+		}
+		return plain
+	}
+	helpdesk, other := token("helpdesk"), token("other")
+
+	post := func(token, identity string) (int, string) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"customer@example.org"}, "subject": "Your ticket", "body": "Fixed.", "identity": identity})
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/emails", bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			ID string `json:"id"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.ID
+	}
+
+	if code, _ := post(other, "nobody"); code != http.StatusBadRequest {
+		t.Errorf("unknown identity: status %d, want 400", code)
+	}
+	if code, _ := post(other, "support"); code != http.StatusForbidden {
+		t.Errorf("restricted identity with an unlisted token: status %d, want 403", code)
+	}
+	code, id := post(other, "sales")
+	if code != http.StatusCreated {
+		t.Fatalf("unrestricted identity: status %d, want 201", code)
+	}
+	email, err := st.Get(t.Context(), id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if email.Sender != "sales@example.com" || strings.Contains(string(email.RawMessage), "DKIM-Signature") {
+		t.Errorf("sales email: sender %q, raw:\n%s", email.Sender, email.RawMessage)
+	}
+
+	code, id = post(helpdesk, "support")
+	if code != http.StatusCreated {
+		t.Fatalf("restricted identity with its token: status %d, want 201", code)
+	}
+	email, err = st.Get(t.Context(), id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(email.RawMessage))
+	if err != nil {
+		t.Fatalf("parse raw message: %v", err)
+	}
+	if from := msg.Header.Get("From"); from != `"Support Team" <support@example.com>` {
+		t.Errorf("From = %q", from)
+	}
+	if sig := msg.Header.Get("DKIM-Signature"); !strings.Contains(sig, "d=example.com") || !strings.Contains(sig, "s=mail") {
+		t.Errorf("DKIM-Signature = %q", sig)
+	}
+
+	postAction(t, srv.webAddr, id, "approve")
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(msgs))
+	}
+	if msgs[0].From != "support@example.com" {
+		t.Errorf("upstream from = %q, want support@example.com", msgs[0].From)
+	}
+	if !strings.HasPrefix(msgs[0].Data, "DKIM-Signature:") {
+		t.Errorf("upstream data does not start with the signature:\n%s", msgs[0].Data)
+	}
+}
+
+// TestLongPollGetEmails: GET /api/emails?wait= returns as soon as mail is approved
+func TestLongPollGetEmails(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	start := time.Now()
+	if emails := getAPIEmailsQuery(t, srv.apiAddr, "?wait=100ms"); len(emails) != 0 {
+		t.Errorf("emails = %v, want none", emails)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("returned after %v, want to wait 100ms", elapsed)
+	}
+
+	resp, err := http.Get("http://" + srv.apiAddr + "/api/emails?wait=soon")
+	if err != nil {
+		t.Fatalf("GET /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid wait: status %d, want 400", resp.StatusCode)
+	}
+
+	id, _ := st.SaveInbound(t.Context(), "external@example.com", []string{"me@example.com"}, "Reply", "Hello",
+		[]byte("Subject: Reply\r\n\r\nHello"), "<reply@example.com>", "mailescrow/received", "default")
+	result := make(chan []map[string]interface{}, 1)
+	start = time.Now()
+	go func() {
+		var emails []map[string]interface{}
+		if resp, err := http.Get("http://" + srv.apiAddr + "/api/emails?wait=10s"); err == nil {
+			_ = json.NewDecoder(resp.Body).Decode(&emails)
+			resp.Body.Close()
+		}
+		result <- emails
+	}()
+	time.Sleep(100 * time.Millisecond)
+	postAction(t, srv.webAddr, id, "approve")
+
+	select {
+	case emails := <-result:
+		if len(emails) != 1 || emails[0]["id"] != id {
+			t.Errorf("emails = %v, want the approved email", emails)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("returned after %v, want promptly after the approval", elapsed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("long poll did not return")
+	}
+}
+
+// TestInvalidRecipients: malformed recipients are refused with field-level errors
+func TestInvalidRecipients(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	b, _ := json.Marshal(map[string]any{"to": []string{"ops@example.com", "Bob <bob@example.com>", "carol@"}, "subject": "Hi", "body": "hi"})
+	resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400", resp.StatusCode)
+	}
+	var result struct {
+		Error  string `json:"error"`
+		Fields []struct {
+			Field   string `json:"field"`
+			Value   string `json:"value"`
+			Message string `json:"message"`
+		} `json:"fields"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(result.Fields) != 2 || result.Fields[0].Field != "to[1]" || result.Fields[1].Field != "to[2]" ||
+		result.Fields[1].Value != "carol@" || !strings.Contains(result.Fields[1].Message, "missing domain") {
+		t.Errorf("fields = %+v", result.Fields)
+	}
+
+	emails, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(emails) != 0 {
+		t.Errorf("stored %d emails, want none", len(emails))
+	}
+}
+
+// TestSubmissionValidation: every invalid field of a submission is reported at
+// once, and oversized requests are refused
+func TestSubmissionValidation(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+	post := func(payload map[string]any) (*http.Response, []byte) {
+		t.Helper()
+		b, _ := json.Marshal(payload)
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, b := post(map[string]any{
+		"to":        []string{"bob@example.com", "carol"},
+		"body":      "hi",
+		"html_body": strings.Repeat("x", web.MaxBodyBytes+1),
+		"headers":   map[string]string{"Bcc": "eve@example.com"},
+	})
+	var result struct {
+		Error  string `json:"error"`
+		Fields []struct {
+			Field   string `json:"field"`
+			Value   string `json:"value"`
+			Message string `json:"message"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("response = %d %.200s: %v", resp.StatusCode, b, err)
+	}
+	var fields []string
+	for _, f := range result.Fields {
+		fields = append(fields, f.Field)
+	}
+	if result.Error != "invalid request" || strings.Join(fields, " ") != "to[1] subject html_body headers" {
+		t.Errorf("error %q, fields %v; want every invalid field", result.Error, fields)
+	}
+	if len(b) > 4096 {
+		t.Errorf("response of %d bytes echoes the oversized body", len(b))
+	}
+
+	to := make([]string, web.MaxRecipients+1)
+	for i := range to {
+		to[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	resp, b = post(map[string]any{"to": to, "subject": "Hi"})
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), `"field":"to"`) {
+		t.Errorf("too many recipients = %d %s, want a to error", resp.StatusCode, b)
+	}
+
+	resp, _ = post(map[string]any{"to": []string{"bob@example.com"}, "subject": "Hi", "body": strings.Repeat("x", web.MaxRawMessageBytes)})
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized request: status %d, want 413", resp.StatusCode)
+	}
+
+	emails, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(emails) != 0 {
+		t.Errorf("stored %d emails, want none", len(emails))
+	}
+}
+
+// TestQueueMetrics: /metrics and /stats report queue counts from store aggregates
+func TestQueueMetrics(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	postAPIEmail(t, srv.apiAddr, "a@example.com", "One", "one")
+	postAPIEmail(t, srv.apiAddr, "b@example.com", "Two", "two")
+
+	resp, err := http.Get("http://" + srv.apiAddr + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`mailescrow_emails{direction="outbound",status="pending"} 2`,
+		`mailescrow_emails{direction="inbound",status="pending"} 0`,
+		"mailescrow_oldest_pending_age_seconds ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+
+	resp, err = http.Get("http://" + srv.apiAddr + "/api/emails/pending/count")
+	if err != nil {
+		t.Fatalf("GET pending count: %v", err)
+	}
+	var count struct {
+		Count int `json:"count"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&count)
+	resp.Body.Close()
+	if count.Count != 2 {
+		t.Errorf("pending count = %d, want 2", count.Count)
+	}
+
+	resp, err = http.Get("http://" + srv.webAddr + "/stats")
+	if err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	stats, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(stats), "<td>outbound</td>") || !strings.Contains(string(stats), "Oldest pending email has waited") {
+		t.Errorf("stats page missing queue counts: %s", stats)
+	}
+}
+
+// TestDailyStatsTrend: /stats shows the daily counters after the decisions they count are purged
+func TestDailyStatsTrend(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+	ctx := t.Context()
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+	for _, d := range []store.Decision{
+		{EmailID: "a", Direction: store.DirectionOutbound, Decision: store.DecisionApproved, DecidedAt: yesterday},
+		{EmailID: "b", Direction: store.DirectionOutbound, Decision: store.DecisionApproved, DecidedAt: yesterday},
+		{EmailID: "c", Direction: store.DirectionInbound, Decision: store.DecisionRejected, DecidedAt: yesterday},
+	} {
+		if err := st.RecordDecision(ctx, d); err != nil {
+			t.Fatalf("record decision: %v", err)
+		}
+	}
+	if err := retention.New(st, retention.Policy{History: time.Hour}).Purge(ctx); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if decisions, _ := st.ListDecisions(ctx, 10); len(decisions) != 0 {
+		t.Fatalf("decisions after purge = %d, want 0", len(decisions))
+	}
+
+	resp, err := http.Get("http://" + srv.webAddr + "/stats")
+	if err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	row := fmt.Sprintf(`<td>%s</td>
+    <td class="num">3</td>
+    <td class="num">2</td>
+    <td class="num">1</td>
+    <td class="num">2</td>
+    <td class="num">0</td>`, yesterday.Format("2006-01-02"))
+	if !strings.Contains(string(body), row) {
+		t.Errorf("stats page missing yesterday's counters:\n%s", body)
+	}
+}
+
+// TestPendingListPagination: the pending list pages, sorts and filters server-side
+func TestPendingListPagination(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	for i := range 55 {
+		postAPIEmail(t, srv.apiAddr, "ops@example.com", fmt.Sprintf("Report %02d", i), "body")
+	}
+	if _, err := st.SaveInbound(t.Context(), "carol@example.com", []string{"me@example.com"}, "Invoice", "see attached", []byte("raw"), "<m1>", "mailescrow/received", "billing"); err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	first := get("/")
+	if n := strings.Count(first, `class="card"`); n != 50 {
+		t.Errorf("first page shows %d emails, want 50", n)
+	}
+	if !strings.Contains(first, "Page 1 of 2 (56 pending)") || !strings.Contains(first, `href="/?page=2"`) {
+		t.Errorf("first page missing pagination")
+	}
+	if second := get("/?page=2"); strings.Count(second, `class="card"`) != 6 || !strings.Contains(second, "Invoice") {
+		t.Errorf("second page should hold the 6 newest emails")
+	}
+
+	newest := get("/?sort=subject&order=desc")
+	if i, j := strings.Index(newest, "Report 54"), strings.Index(newest, "Report 53"); i < 0 || j < i {
+		t.Errorf("subject descending should list Report 54 before Report 53")
+	}
+	if !strings.Contains(newest, `href="/?order=desc&amp;page=2&amp;sort=subject"`) {
+		t.Errorf("next link should keep the sort order")
+	}
+
+	billing := get("/?direction=inbound&queue=billing")
+	if strings.Count(billing, `class="card"`) != 1 || !strings.Contains(billing, "Invoice") {
+		t.Errorf("inbound billing filter should show only the invoice")
+	}
+	if body := get("/?attachments=1"); !strings.Contains(body, "No pending emails match these filters.") {
+		t.Errorf("attachment filter should match nothing")
+	}
+}
+
+// TestPendingListAgeFilters: one-click age filters narrow the pending list,
+// and mail past the SLA is marked stale
+func TestPendingListAgeFilters(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetSLA(time.Nanosecond) })
+
+	postAPIEmail(t, srv.apiAddr, "ops@example.com", "Report", "body")
+	postAPIEmail(t, srv.apiAddr, "ops@example.com", "Summary", "body")
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	index := get("/")
+	if n := strings.Count(index, `class="card card-stale"`); n != 2 {
+		t.Errorf("index marks %d emails stale, want both past the SLA", n)
+	}
+	for _, want := range []string{`href="/?age=today"`, `href="/?age=1h"`, `href="/?age=24h"`, `class="badge badge-stale"`} {
+		if !strings.Contains(index, want) {
+			t.Errorf("index missing %s", want)
+		}
+	}
+
+	today := get("/?age=today&sort=subject&order=desc")
+	if i, j := strings.Index(today, "Summary"), strings.Index(today, "Report"); i < 0 || j < i {
+		t.Errorf("today filter should list both emails, subject descending")
+	}
+	if !strings.Contains(today, `<input type="hidden" name="age" value="today">`) || !strings.Contains(today, `href="/?order=desc&amp;sort=subject"`) {
+		t.Errorf("filter form and quick filters should keep the other filters")
+	}
+	if old := get("/?age=1h"); !strings.Contains(old, "No pending emails match these filters.") {
+		t.Errorf("older-than-1h filter should match nothing")
+	}
+}
+
+// TestJournalArchivesApprovedMail: approve → upstream gets the email and a BCC copy for the journal address
+func TestJournalArchivesApprovedMail(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	srv := startTestServer(t, st, journal.New(r, "archive@example.com"))
+
+	postAPIEmail(t, srv.apiAddr, "recipient@example.com", "Journaled", "Keep a copy of this.")
+	id := extractID(getBody(t, srv.webAddr), "approve")
+	if id == "" {
+		t.Fatal("could not extract email ID from web UI")
+	}
+	postAction(t, srv.webAddr, id, "approve")
+
+	msgs := upstream.getReceived()
+	if len(msgs) != 2 {
+		t.Fatalf("expected delivery and journal copy, got %d upstream messages", len(msgs))
+	}
+	if len(msgs[0].To) != 1 || msgs[0].To[0] != "recipient@example.com" {
+		t.Errorf("delivery to = %v, want [recipient@example.com]", msgs[0].To)
+	}
+	if len(msgs[1].To) != 1 || msgs[1].To[0] != "archive@example.com" {
+		t.Errorf("journal copy to = %v, want [archive@example.com]", msgs[1].To)
+	}
+	if msgs[1].Data != msgs[0].Data {
+		t.Errorf("journal copy differs from the relayed email")
+	}
+	if strings.Contains(msgs[1].Data, "archive@example.com") {
+		t.Errorf("journal address leaked into the message headers")
+	}
+}
+
+// TestClickTracking: links in approved HTML mail are rewritten through the
+// click redirect, which counts clicks shown on the stats page.
+func TestClickTracking(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	srv := startTestServer(t, st, tracking.New(r, st, "https://escrow.example.com"))
+
+	b, _ := json.Marshal(map[string]any{
+		"to": []string{"customer@example.com"}, "subject": "Your order shipped", "body": "Track it at https://shop.example.com/track?id=7",
+		"html_body": `<p><a href="https://shop.example.com/track?id=7&amp;ref=mail">Track your order</a></p>`,
+	})
+	resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	id := extractID(getBody(t, srv.webAddr), "approve")
+	if id == "" {
+		t.Fatal("could not extract email ID from web UI")
+	}
+	postAction(t, srv.webAddr, id, "approve")
+
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(msgs))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatalf("parse relayed message: %v", err)
+	}
+	text, html := mimetext.Parts(textproto.MIMEHeader(msg.Header), msg.Body)
+	if !strings.Contains(text, "https://shop.example.com/track?id=7") {
+		t.Errorf("text part = %q, want its link untouched", text)
+	}
+	_, after, ok := strings.Cut(html, `href="https://escrow.example.com/click/`)
+	if !ok {
+		t.Fatalf("HTML part = %q, want a tracked link", html)
+	}
+	token, _, _ := strings.Cut(after, `"`)
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for range 2 {
+		resp, err := noRedirect.Get("http://" + srv.webAddr + "/click/" + token)
+		if err != nil {
+			t.Fatalf("GET /click: %v", err)
+		}
+		resp.Body.Close()
+		if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || loc != "https://shop.example.com/track?id=7&ref=mail" {
+			t.Errorf("click: status %d, Location %q", resp.StatusCode, loc)
+		}
+	}
+	resp, err = noRedirect.Get("http://" + srv.webAddr + "/click/unknown")
+	if err != nil {
+		t.Fatalf("GET /click: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown link: status %d, want 404", resp.StatusCode)
+	}
+
+	stats, err := st.ListClickStats(t.Context(), 10)
+	if err != nil || len(stats) != 1 || stats[0].EmailID != id || stats[0].Clicks != 2 {
+		t.Errorf("click stats = %+v (%v), want 2 clicks on %s", stats, err, id)
+	}
+	resp, err = http.Get("http://" + srv.webAddr + "/stats")
+	if err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Link clicks") || !strings.Contains(string(body), "Your order shipped") {
+		t.Errorf("stats page does not list the clicks:\n%s", body)
+	}
+}
+
+// TestUnsubscribeLinks: tagged outbound mail → relayed with List-Unsubscribe
+// headers; a one-click unsubscribe → the recipient is listed on the rules
+// page and tagged mail to them is not relayed until they are removed.
+func TestUnsubscribeLinks(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	book := contacts.New(st, 0)
+	srv := startTestServer(t, st, unsubscribe.New(r, st, "https://escrow.example.com", "marketing"), func(s *web.Server) { s.SetContacts(book) })
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	submit := func(subject string) string {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"Customer@example.com"}, "subject": subject, "body": "Our spring sale starts today."})
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		resp.Body.Close()
+		id := extractID(getBody(t, srv.webAddr), "approve")
+		if id == "" {
+			t.Fatal("could not extract email ID from web UI")
+		}
+		postActionForm(t, srv.webAddr, id, "tag", url.Values{"tag": {"marketing"}})
+		return id
+	}
+	postAction(t, srv.webAddr, submit("Spring sale"), "approve")
+
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(msgs))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatalf("parse relayed message: %v", err)
+	}
+	if got := msg.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post = %q", got)
+	}
+	link := strings.Trim(msg.Header.Get("List-Unsubscribe"), "<>")
+	token, ok := strings.CutPrefix(link, "https://escrow.example.com/unsubscribe/")
+	if !ok {
+		t.Fatalf("List-Unsubscribe = %q, want a mailescrow link", link)
+	}
+
+	// Following the link only asks for confirmation.
+	body := get("/unsubscribe/" + token)
+	if !strings.Contains(body, `<form method="post"`) {
+		t.Errorf("unsubscribe page has no confirmation form:\n%s", body)
+	}
+	if out, _ := st.OptedOut(t.Context(), []string{"customer@example.com"}); len(out) != 0 {
+		t.Errorf("opted out = %v after GET, want none", out)
+	}
+
+	resp, err := http.Post("http://"+srv.webAddr+"/unsubscribe/"+token, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		t.Fatalf("POST /unsubscribe: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unsubscribe: status %d, want 200", resp.StatusCode)
+	}
+	resp, err = http.Post("http://"+srv.webAddr+"/unsubscribe/unknown", "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		t.Fatalf("POST /unsubscribe: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown link: status %d, want 404", resp.StatusCode)
+	}
+	if body := get("/rules"); !strings.Contains(body, "customer@example.com") {
+		t.Errorf("rules page does not list the opt-out:\n%s", body)
+	}
+
+	// Tagged mail to the opted-out recipient goes back to review.
+	id := submit("Summer sale")
+	resp, err = http.PostForm("http://"+srv.webAddr+"/email/"+id+"/approve", url.Values{})
+	if err != nil {
+		t.Fatalf("POST approve: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("approve to opted-out recipient: status %d, want 500", resp.StatusCode)
+	}
+	if n := len(upstream.getReceived()); n != 1 {
+		t.Errorf("expected 1 upstream message, got %d", n)
+	}
+	if e, err := st.Get(t.Context(), id); err != nil || e.Status != store.StatusPending {
+		t.Errorf("email after refused relay = %+v (%v), want pending", e, err)
+	}
+
+	resp, err = http.PostForm("http://"+srv.webAddr+"/rules/delete", url.Values{"kind": {"unsubscribe"}, "sender": {"customer@example.com"}})
+	if err != nil {
+		t.Fatalf("POST /rules/delete: %v", err)
+	}
+	resp.Body.Close()
+	postAction(t, srv.webAddr, id, "approve")
+	if n := len(upstream.getReceived()); n != 2 {
+		t.Errorf("expected 2 upstream messages after resubscribing, got %d", n)
+	}
+}
+
+// TestSuppressionList: a suppressed recipient added through the API → mail
+// to them is held and flagged; with action refuse → submission and approval
+// are refused until the address is removed on the rules page.
+func TestSuppressionList(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	list, err := suppression.New(st, suppression.ActionHold)
+	if err != nil {
+		t.Fatalf("new suppression list: %v", err)
+	}
+	manager := tokens.New(st)
+	admin, _, err := manager.Create(t.Context(), "ops", []string{tokens.ScopeAdmin}, 0, "test")
+	if err != nil {
+		t.Fatalf("create admin token: %v", err)
+	}
+	book := contacts.New(st, 0)
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		s.SetTokens(manager, false)
+		s.SetContacts(book)
+		s.SetSuppression(list)
+	})
+	api := "http://" + srv.apiAddr + "/api"
+
+	req, _ := http.NewRequest(http.MethodPut, api+"/suppressions/Bob@example.com", strings.NewReader(`{"reason": "complained", "note": "ticket 42"}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT /api/suppressions: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT /api/suppressions: status %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodGet, api+"/suppressions", nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/suppressions: %v", err)
+	}
+	var entries []map[string]any
+	json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if len(entries) != 1 || entries[0]["address"] != "bob@example.com" || entries[0]["reason"] != "complained" {
+		t.Errorf("suppressions = %v", entries)
+	}
+
+	submit := func() *http.Response {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"bob@example.com"}, "subject": "Invoice", "body": "Attached."})
+		resp, err := http.Post(api+"/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := submit(); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("submit with hold: status %d, want 201", resp.StatusCode)
+	}
+	id := extractID(getBody(t, srv.webAddr), "approve")
+	if e, err := st.Get(t.Context(), id); err != nil || !e.HasFlag(store.FlagSuppressed) {
+		t.Errorf("held email = %+v (%v), want it flagged suppressed", e, err)
+	}
+	resp, err = http.Get("http://" + srv.webAddr + "/email/" + id)
+	if err != nil {
+		t.Fatalf("GET detail: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "bob@example.com is on the suppression list") {
+		t.Errorf("detail page does not warn about the suppressed recipient:\n%s", body)
+	}
+
+	if err := list.SetAction(suppression.ActionRefuse); err != nil {
+		t.Fatalf("set action: %v", err)
+	}
+	if resp := submit(); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("submit with refuse: status %d, want 400", resp.StatusCode)
+	}
+	resp, err = http.PostForm("http://"+srv.webAddr+"/email/"+id+"/approve", url.Values{})
+	if err != nil {
+		t.Fatalf("POST approve: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("approve with refuse: status %d, want 409", resp.StatusCode)
+	}
+	if n := len(upstream.getReceived()); n != 0 {
+		t.Errorf("expected no upstream message, got %d", n)
+	}
+
+	resp, err = http.Get("http://" + srv.webAddr + "/rules")
+	if err != nil {
+		t.Fatalf("GET /rules: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "ticket 42") {
+		t.Errorf("rules page does not list the suppression:\n%s", body)
+	}
+	resp, err = http.PostForm("http://"+srv.webAddr+"/rules/delete", url.Values{"kind": {"suppression"}, "address": {"bob@example.com"}})
+	if err != nil {
+		t.Fatalf("POST /rules/delete: %v", err)
+	}
+	resp.Body.Close()
+	postAction(t, srv.webAddr, id, "approve")
+	if n := len(upstream.getReceived()); n != 1 {
+		t.Errorf("expected 1 upstream message after removing the suppression, got %d", n)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, api+"/suppressions/bob@example.com", nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("DELETE /api/suppressions: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("delete removed suppression: status %d, want 404", resp.StatusCode)
+	}
+}
+
+// TestRepliesShowSentMessage: approve → relayed; a reply to it → its detail
+// page shows the message it answers
+func TestRepliesShowSentMessage(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	srv := startTestServer(t, st, correspondence.New(r, st))
+
+	postAPIEmail(t, srv.apiAddr, "customer@example.com", "Your quote", "The total is 420 EUR.")
+	id := extractID(getBody(t, srv.webAddr), "approve")
+	if id == "" {
+		t.Fatal("could not extract email ID from web UI")
+	}
+	postAction(t, srv.webAddr, id, "approve")
+
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(msgs))
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatalf("parse relayed message: %v", err)
+	}
+	sentID := msg.Header.Get("Message-Id")
+
+	raw := "From: customer@example.com\r\nTo: sender@example.com\r\nSubject: Re: Your quote\r\nIn-Reply-To: " + sentID + "\r\n\r\nToo expensive.\r\n"
+	replyID, err := st.SaveInbound(t.Context(), "customer@example.com", []string{"sender@example.com"}, "Re: Your quote", "Too expensive.", []byte(raw), "", "", "")
+	if err != nil {
+		t.Fatalf("save reply: %v", err)
+	}
+	resp, err := http.Get("http://" + srv.webAddr + "/email/" + replyID)
+	if err != nil {
+		t.Fatalf("GET /email: %v", err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	detail := string(b)
+	for _, want := range []string{"In reply to Your quote", "The total is 420 EUR."} {
+		if !strings.Contains(detail, want) {
+			t.Errorf("reply detail page missing %q", want)
+		}
+	}
+}
+
+// TestEditBeforeApproval: a reviewer edits held outbound mail, the edited
+// version is relayed, and the detail page, the history and the audit log show
+// what was changed.
+func TestEditBeforeApproval(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	srv := startTestServer(t, st, r)
+
+	id := postAPIEmail(t, srv.apiAddr, "customer@example.com", "Your quote", "Hello,\nthe total is 420 EUR.\nRegards")
+	page := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return html.UnescapeString(string(b))
+	}
+	if form := page("/email/" + id + "/edit"); !strings.Contains(form, "the total is 420 EUR.") {
+		t.Error("edit form does not hold the body")
+	}
+	postActionForm(t, srv.webAddr, id, "edit", url.Values{
+		"to":      {"customer@example.com, billing@example.com"},
+		"subject": {"Your revised quote"},
+		"body":    {"Hello,\r\nthe total is 380 EUR.\r\nRegards"},
+	})
+
+	detail := page("/email/" + id)
+	for _, want := range []string{"Changed by reviewers", "Edited by anonymous", "- the total is 420 EUR.", "+ the total is 380 EUR.", "+ billing@example.com", "- Your quote"} {
+		if !strings.Contains(detail, want) {
+			t.Errorf("detail page missing %q", want)
+		}
+	}
+
+	postAction(t, srv.webAddr, id, "approve")
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(msgs))
+	}
+	if len(msgs[0].To) != 2 || msgs[0].To[1] != "billing@example.com" {
+		t.Errorf("relayed to %v, want the edited recipients", msgs[0].To)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatalf("parse relayed message: %v", err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if msg.Header.Get("Subject") != "Your revised quote" || !strings.Contains(string(body), "380 EUR") || strings.Contains(string(body), "420 EUR") {
+		t.Errorf("relayed subject %q, body %q; want the edited version", msg.Header.Get("Subject"), body)
+	}
+	if to := msg.Header.Get("To"); !strings.Contains(to, "billing@example.com") {
+		t.Errorf("relayed To header %q, want the edited recipients", to)
+	}
+
+	history := page("/history")
+	for _, want := range []string{"edited", "+ the total is 380 EUR."} {
+		if !strings.Contains(history, want) {
+			t.Errorf("history missing %q", want)
+		}
+	}
+	entries, err := st.ListAudit(t.Context(), 10)
+	if err != nil || len(entries) != 1 || entries[0].Action != "email.edit" || !strings.Contains(entries[0].Detail, "+billing@example.com") {
+		t.Errorf("audit log = %+v, %v", entries, err)
+	}
+}
+
+// TestReviewerNotification: reviewers are emailed through the relay when an
+// API submission is held for review, and the notification is dropped rather
+// than held again when it comes back into the monitored mailbox.
+func TestReviewerNotification(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	srv := startTestServer(t, st, r)
+	system := sysmail.New(r)
+	n := reviewmail.New(st, system.Sender(sysmail.KindReview), "escrow@example.com", "mailescrow", []string{"reviewers@example.com"}, 0, time.Minute, "https://escrow.example.com/")
+	if err := n.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+
+	postAPIEmail(t, srv.apiAddr, "customer@example.com", "Quarterly report", "Numbers attached.")
+	if err := n.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 notification, got %d upstream messages", len(msgs))
+	}
+	if msgs[0].From != "escrow@example.com" || len(msgs[0].To) != 1 || msgs[0].To[0] != "reviewers@example.com" {
+		t.Errorf("envelope = %s → %v", msgs[0].From, msgs[0].To)
+	}
+	if !strings.Contains(msgs[0].Data, "Quarterly report") || !strings.Contains(msgs[0].Data, reviewmail.Header+": pending") {
+		t.Errorf("notification:\n%s", msgs[0].Data)
+	}
+	if !strings.Contains(msgs[0].Data, sysmail.Header+": review; ") {
+		t.Errorf("notification not stamped as system mail:\n%s", msgs[0].Data)
+	}
+
+	p := poller.New(nil, st, routing.New(nil), nil, time.Minute, poller.Options{})
+	p.SetSystemMail(system)
+	id, err := p.Deliver(t.Context(), imap.FetchedEmail{Sender: msgs[0].From, Recipients: msgs[0].To, Subject: "[mailescrow] 1 new email waiting for review", RawMessage: []byte(msgs[0].Data)})
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if d, _ := st.LastDecision(t.Context(), id); d == nil || d.Decision != store.DecisionRejected || d.Reviewer != sysmail.ReviewerPrefix+sysmail.KindReview {
+		t.Errorf("returned notification decision = %+v, want it dropped as system mail", d)
+	}
+	if pending, _ := st.CountPending(t.Context()); pending != 1 {
+		t.Errorf("pending = %d, want only the submission held", pending)
+	}
+}
+
+// TestRelaySink: with the file provider, approving an email writes it to the
+// sink directory instead of delivering it, and it is marked sent as usual.
+func TestRelaySink(t *testing.T) {
+	st := newTestStore(t)
+	dir := t.TempDir()
+	sink, err := relay.NewSink(dir)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	srv := startTestServer(t, st, sink)
+
+	id := postAPIEmail(t, srv.apiAddr, "recipient@example.com", "Staging", "Never delivered.")
+	postAction(t, srv.webAddr, id, "approve")
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("sink has %d files, want 1", len(files))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if !strings.Contains(string(data), "X-Original-To: recipient@example.com\r\n") || !strings.Contains(string(data), "Subject: Staging") {
+		t.Errorf("sink file:\n%s", data)
+	}
+	if d, _ := st.LastDecision(t.Context(), id); d == nil || d.Decision != store.DecisionApproved {
+		t.Errorf("decision = %+v, want approved", d)
+	}
+}
+
+// TestInboundAutoReplies: an out-of-office reply is tagged and filterable,
+// the person's email next to it is not, and the archive policy rejects the
+// next one without review.
+func TestInboundAutoReplies(t *testing.T) {
+	st := newTestStore(t)
+	srv := startTestServer(t, st, nil)
+	replies, err := autoreply.New(autoreply.ActionHold, 3, time.Hour)
+	if err != nil {
+		t.Fatalf("new policy: %v", err)
+	}
+	p := poller.New(nil, st, routing.New(nil), nil, time.Minute, poller.Options{})
+	p.SetAutoReplies(replies)
+
+	deliver := func(sender, raw string) string {
+		t.Helper()
+		id, err := p.Deliver(t.Context(), imap.FetchedEmail{Sender: sender, Recipients: []string{"agent@example.com"}, Subject: "s", RawMessage: []byte(raw)})
+		if err != nil {
+			t.Fatalf("deliver: %v", err)
+		}
+		return id
+	}
+	ooo := deliver("away@example.com", "From: away@example.com\r\nSubject: Automatic reply: Invoice\r\nX-Autoreply: yes\r\n\r\nI am away.\r\n")
+	person := deliver("alice@example.com", "From: alice@example.com\r\nSubject: Re: Invoice\r\n\r\nPaid.\r\n")
+
+	resp, err := http.Get("http://" + srv.webAddr + "/?tag=" + autoreply.Tag)
+	if err != nil {
+		t.Fatalf("GET /?tag=: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if body := string(b); !strings.Contains(body, "/email/"+ooo) || strings.Contains(body, "/email/"+person) {
+		t.Errorf("auto-reply filter should list only the out-of-office reply: %q", body)
+	}
+
+	if err := replies.SetAction(autoreply.ActionArchive); err != nil {
+		t.Fatalf("set action: %v", err)
+	}
+	archived := deliver("away@example.com", "From: away@example.com\r\nAuto-Submitted: auto-replied\r\nSubject: Away\r\n\r\nStill away.\r\n")
+	if pending, _ := st.CountPending(t.Context()); pending != 2 {
+		t.Errorf("pending = %d, want the second auto-reply no longer held", pending)
+	}
+	if d, _ := st.LastDecision(t.Context(), archived); d == nil || d.Reviewer != autoreply.Reviewer {
+		t.Errorf("decision = %+v, want it recorded by %s", d, autoreply.Reviewer)
+	}
+}
+
+// TestDiskArchive: approved and rejected emails are written to the on-disk
+// archive with headers recording the decision.
+func TestDiskArchive(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+
+	dir := t.TempDir()
+	a, err := archive.New(archive.FormatMbox, dir, archive.RotateNever)
+	if err != nil {
+		t.Fatalf("new archive: %v", err)
+	}
+	srv := startTestServer(t, archive.NewStore(st, a), r)
+
+	postAPIEmail(t, srv.apiAddr, "recipient@example.com", "Archive me", "Approved and archived.")
+	postAction(t, srv.webAddr, extractID(getBody(t, srv.webAddr), "approve"), "approve")
+	postAPIEmail(t, srv.apiAddr, "recipient@example.com", "Archive me too", "Rejected and archived.")
+	postAction(t, srv.webAddr, extractID(getBody(t, srv.webAddr), "reject"), "reject")
+
+	data, err := os.ReadFile(filepath.Join(dir, "archive.mbox"))
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	got := string(data)
+	for _, want := range []string{
+		"X-Mailescrow-Decision: approved\nX-Mailescrow-Reviewer: anonymous\n",
+		"Subject: Archive me\n",
+		"X-Mailescrow-Decision: rejected\n",
+		"Subject: Archive me too\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("archive missing %q:\n%s", want, got)
+		}
+	}
+}
+
+// TestTriageFlow: /triage shows one email at a time; deciding on it returns to the same position
+func TestTriageFlow(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	for _, subject := range []string{"First", "Second", "Third"} {
+		postAPIEmail(t, srv.apiAddr, "ops@example.com", subject, "body")
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	first := get("/triage")
+	if !strings.Contains(first, "1 of 3 pending") || !strings.Contains(first, "First") || strings.Contains(first, "Second") {
+		t.Errorf("first triage page should show only the oldest email")
+	}
+	if !strings.Contains(first, `href="/triage?pos=2" rel="next"`) || strings.Contains(first, `rel="prev"`) {
+		t.Errorf("first triage page should link to the next email only")
+	}
+
+	second := get("/triage?pos=2")
+	id := extractID(second, "reject")
+	if id == "" || !strings.Contains(second, "Second") {
+		t.Fatal("second triage page should show the second email")
+	}
+	if !strings.Contains(second, `name="next" value="/triage?pos=2"`) {
+		t.Errorf("actions should return to the same position")
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	decide := func(next string) string {
+		t.Helper()
+		resp, err := client.PostForm("http://"+srv.webAddr+"/email/"+id+"/reject", url.Values{"next": {next}})
+		if err != nil {
+			t.Fatalf("POST reject: %v", err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Location")
+	}
+	if loc := decide("/triage?pos=2"); loc != "/triage?pos=2" {
+		t.Errorf("redirect after reject = %q, want /triage?pos=2", loc)
+	}
+	if after := get("/triage?pos=2"); !strings.Contains(after, "2 of 2 pending") || !strings.Contains(after, "Third") {
+		t.Errorf("the next email should move into position 2")
+	}
+
+	// Past the end the last email is shown; redirects never leave the site.
+	if last := get("/triage?pos=9"); !strings.Contains(last, "2 of 2 pending") {
+		t.Errorf("position past the end should show the last email")
+	}
+	id = extractID(get("/triage"), "reject")
+	if loc := decide("//evil.example.com/"); loc != "/" {
+		t.Errorf("redirect to another host = %q, want /", loc)
+	}
+}
+
+// TestDebugEndpoints: /debug/ on the API needs an admin token and is 404 until enabled
+func TestDebugEndpoints(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	manager := tokens.New(st)
+	admin, _, err := manager.Create(t.Context(), "ops", []string{tokens.ScopeAdmin}, 0, "test")
+	if err != nil {
+		t.Fatalf("create admin token: %v", err)
+	}
+	read, _, err := manager.Create(t.Context(), "agent", []string{tokens.ScopeRead}, 0, "test")
+	if err != nil {
+		t.Fatalf("create read token: %v", err)
+	}
+
+	get := func(apiAddr, path, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+apiAddr+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	disabled := startTestServer(t, st, r, func(s *web.Server) { s.SetTokens(manager, false) })
+	if code, _ := get(disabled.apiAddr, "/debug/vars", admin); code != http.StatusNotFound {
+		t.Errorf("debug disabled: status %d, want 404", code)
+	}
+
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		s.SetTokens(manager, false)
+		s.SetDebug(debug.Handler())
+	})
+	if code, _ := get(srv.apiAddr, "/debug/vars", ""); code != http.StatusUnauthorized {
+		t.Errorf("debug without a token: status %d, want 401", code)
+	}
+	if code, _ := get(srv.apiAddr, "/debug/vars", read); code != http.StatusForbidden {
+		t.Errorf("debug with a read token: status %d, want 403", code)
+	}
+	if code, body := get(srv.apiAddr, "/debug/vars", admin); code != http.StatusOK || !strings.Contains(body, `"memstats"`) {
+		t.Errorf("debug vars: status %d, body %.100s", code, body)
+	}
+	if code, body := get(srv.apiAddr, "/debug/pprof/", admin); code != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("pprof index: status %d", code)
+	}
+}
+
+// TestApprovalTrace: approving with a traceparent header yields one trace covering the request, its queries and the relay send
+func TestApprovalTrace(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+
+	upstream := startUpstreamSMTP(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	srv := startTestServer(t, newTestStore(t), relay.New(upHost, upPort, "", "", false))
+
+	postAPIEmail(t, srv.apiAddr, "recipient@example.com", "Traced", "Follow me.")
+	id := extractID(getBody(t, srv.webAddr), "approve")
+	if id == "" {
+		t.Fatal("could not extract email ID from web UI")
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodPost, "http://"+srv.webAddr+"/email/"+id+"/approve", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := (&http.Transport{}).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("POST approve: %v", err)
+	}
+	resp.Body.Close()
+	if len(upstream.getReceived()) != 1 {
+		t.Fatal("approved email was not relayed")
+	}
+
+	names := map[string]int{}
+	for _, s := range sr.Ended() {
+		if s.SpanContext().TraceID().String() == traceID {
+			names[s.Name()]++
+		}
+	}
+	for _, want := range []string{"POST /email/{id}/approve", "relay.send"} {
+		if names[want] != 1 {
+			t.Errorf("trace has %d %q spans, want 1 (spans: %v)", names[want], want, names)
+		}
+	}
+	var queries int
+	for name, n := range names {
+		if strings.HasPrefix(name, "sql.") {
+			queries += n
+		}
+	}
+	if queries == 0 {
+		t.Errorf("trace has no store query spans (spans: %v)", names)
+	}
+}
+
+// TestCatchAllEnvelopeRecipient: the envelope recipient is shown in the UI and returned as delivered_to
+func TestCatchAllEnvelopeRecipient(t *testing.T) {
+	st := newTestStore(t)
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false))
+
+	id, err := st.SaveInbound(t.Context(),
+		"external@example.com", []string{"newsletter@lists.example.org"},
+		"Catch-all", "Hello", []byte("Subject: Catch-all\r\n\r\nHello"),
+		"<catchall@external.example.com>", "mailescrow/received", "default",
+	)
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	if err := st.SetEnvelopeRecipients(t.Context(), id, []string{"sales@example.com"}); err != nil {
+		t.Fatalf("set envelope recipients: %v", err)
+	}
+
+	if body := getBody(t, srv.webAddr); !strings.Contains(body, "Delivered to: sales@example.com") {
+		t.Errorf("pending list missing envelope recipient: %q", body)
+	}
+	postAction(t, srv.webAddr, id, "approve")
+
+	emails := getAPIEmails(t, srv.apiAddr)
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 approved email, got %d", len(emails))
+	}
+	if got, _ := emails[0]["delivered_to"].([]interface{}); len(got) != 1 || got[0] != "sales@example.com" {
+		t.Errorf("delivered_to = %v, want [sales@example.com]", emails[0]["delivered_to"])
+	}
+}
+
+// TestBatchSubmission: POST /api/emails/batch submits each email on its own and reports a result for each, in order
+func TestBatchSubmission(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+	post := func(payload any, key string) (*http.Response, []byte) {
+		t.Helper()
+		b, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/emails/batch", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/emails/batch: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, b := post(map[string]any{"emails": []map[string]any{
+		{"to": []string{"bob@example.com"}, "subject": "First", "body": "1"},
+		{"to": []string{"carol@"}, "subject": "Second", "body": "2"},
+		{"to": []string{"dave@example.com"}, "subject": "Third", "body": "3", "identity": "nobody"},
+		{"to": []string{"erin@example.com"}, "subject": "Fourth", "body": "4"},
+	}}, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, b)
+	}
+	var result struct {
+		Results []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Error  *struct {
+				Status  int    `json:"status"`
+				Code    string `json:"code"`
+				Message string `json:"message"`
+				Fields  []struct {
+					Field string `json:"field"`
+				} `json:"fields"`
+			} `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil || len(result.Results) != 4 {
+		t.Fatalf("results = %s: %v; want one per email", b, err)
+	}
+	first, second, third, fourth := result.Results[0], result.Results[1], result.Results[2], result.Results[3]
+	if first.ID == "" || first.Status != store.StatusPending || first.Error != nil || fourth.ID == "" {
+		t.Errorf("valid emails = %+v, %+v; want both pending", first, fourth)
+	}
+	if e := second.Error; second.ID != "" || e == nil || e.Status != http.StatusBadRequest || e.Code != "invalid_request" || len(e.Fields) != 1 || e.Fields[0].Field != "to[0]" {
+		t.Errorf("invalid recipient = %+v, want a to[0] field error", second)
+	}
+	if e := third.Error; e == nil || e.Status != http.StatusBadRequest || !strings.Contains(e.Message, `unknown identity "nobody"`) {
+		t.Errorf("unknown identity = %+v, want its error", third)
+	}
+	emails, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(emails) != 2 {
+		t.Errorf("stored %d emails, want the 2 valid ones", len(emails))
+	}
+
+	tooMany := make([]map[string]any, web.MaxBatchEmails+1)
+	for i := range tooMany {
+		tooMany[i] = map[string]any{"to": []string{"bob@example.com"}, "subject": "Hi", "body": "hi"}
+	}
+	for name, payload := range map[string]any{
+		"empty":    map[string]any{"emails": []any{}},
+		"too many": map[string]any{"emails": tooMany},
+	} {
+		if resp, b := post(payload, ""); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), `"field":"emails"`) {
+			t.Errorf("%s batch = %d %.200s, want an emails error", name, resp.StatusCode, b)
+		}
+	}
+	if resp, _ := post(map[string]any{"emails": tooMany[:1]}, "k1"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("batch with an Idempotency-Key: status %d, want 400", resp.StatusCode)
+	}
+	if emails, _ := st.ListPending(t.Context()); len(emails) != 2 {
+		t.Errorf("stored %d emails after refused batches, want 2", len(emails))
+	}
+}
+
+// TestRawMessageSubmission: POST /api/emails/raw holds a caller-built MIME message and relays it byte-for-byte
+func TestRawMessageSubmission(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	srv := startTestServer(t, newTestStore(t), relay.New(upHost, upPort, "", "", false), func(s *web.Server) {
+		if err := s.SetIdentities([]web.Identity{{Name: "reports", Address: "reports@example.com"}}); err != nil {
+			t.Fatalf("set identities: %v", err)
+		}
+	})
+
+	raw := "From: Reports <reports@example.com>\r\n" +
+		"To: boss@example.com\r\n" +
+		"Cc: team@example.com\r\n" +
+		"Subject: Weekly report\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=\"report.csv\"\r\n" +
+		"\r\n" +
+		"week,total\r\n" +
+		"--b1--\r\n"
+
+	post := func(contentType string, body []byte) *http.Response {
+		t.Helper()
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails/raw", contentType, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST /api/emails/raw: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := post("message/rfc822", []byte(raw)); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("rfc822 submission: status %d, want 201", resp.StatusCode)
+	}
+	b64, _ := json.Marshal(map[string][]byte{"message": []byte(strings.Replace(raw, "Weekly report", "Monthly report", 1))})
+	if resp := post("application/json", b64); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("JSON submission: status %d, want 201", resp.StatusCode)
+	}
+	if resp := post("text/plain", []byte(raw)); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain submission: status %d, want 415", resp.StatusCode)
+	}
+	if resp := post("message/rfc822", []byte("From: a@example.com\r\nTo: b@example.com\r\nBcc: c@example.com\r\n\r\nhi")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Bcc submission: status %d, want 400", resp.StatusCode)
+	}
+	if resp := post("message/rfc822", []byte(strings.Replace(raw, "reports@example.com", "ceo@example.com", 1))); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("submission from an unknown sender: status %d, want 403", resp.StatusCode)
+	}
+
+	body := getBody(t, srv.webAddr)
+	if !strings.Contains(body, "Weekly report") || !strings.Contains(body, "Monthly report") {
+		t.Fatalf("web UI missing raw submissions: %q", body)
+	}
+	if !strings.Contains(body, "reports@example.com") || !strings.Contains(body, "team@example.com") {
+		t.Errorf("web UI missing parsed sender or Cc recipient")
+	}
+
+	postAction(t, srv.webAddr, extractID(body, "approve"), "approve")
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(msgs))
+	}
+	if msgs[0].From != "reports@example.com" {
+		t.Errorf("upstream from = %q, want reports@example.com", msgs[0].From)
+	}
+	if len(msgs[0].To) != 2 {
+		t.Errorf("upstream rcpts = %v, want To and Cc", msgs[0].To)
+	}
+	if msgs[0].Data != raw {
+		t.Errorf("upstream data differs from the submitted message:\n%s", msgs[0].Data)
+	}
+}
+
+// TestTags: reviewers tag emails in the UI, filter the pending list by tag, and consumers fetch by tag
+func TestTags(t *testing.T) {
+	st := newTestStore(t)
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false))
+
+	save := func(subject string) string {
+		t.Helper()
+		id, err := st.SaveInbound(t.Context(), "vendor@example.com", []string{"ap@example.com"},
+			subject, "body", []byte("Subject: "+subject+"\r\n\r\nbody"), "<"+subject+"@example.com>", "mailescrow/received", "default")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+		return id
+	}
+	invoice, other := save("Invoice"), save("Newsletter")
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	postActionForm(t, srv.webAddr, invoice, "tag", url.Values{"tag": {"Invoice"}})
+	postActionForm(t, srv.webAddr, invoice, "tag", url.Values{"tag": {"urgent"}})
+	postActionForm(t, srv.webAddr, invoice, "untag", url.Values{"tag": {"urgent"}})
+
+	if body := get("/email/" + invoice); !strings.Contains(body, `class="badge badge-tag" href="/?tag=invoice"`) {
+		t.Errorf("detail page missing invoice tag: %q", body)
+	}
+	body := get("/?tag=invoice")
+	if !strings.Contains(body, "/email/"+invoice) || strings.Contains(body, "/email/"+other) {
+		t.Errorf("tag filter should list only the invoice: %q", body)
+	}
+	if strings.Contains(body, "urgent") {
+		t.Errorf("removed tag still offered: %q", body)
+	}
+
+	resp, err := http.PostForm("http://"+srv.webAddr+"/email/"+invoice+"/tag", url.Values{"tag": {"two words"}})
+	if err != nil {
+		t.Fatalf("POST tag: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid tag: status %d, want 400", resp.StatusCode)
+	}
+
+	postAction(t, srv.webAddr, invoice, "approve")
+	postAction(t, srv.webAddr, other, "approve")
+	emails := getAPIEmailsQuery(t, srv.apiAddr, "?tag=invoice")
+	if len(emails) != 1 || emails[0]["id"] != invoice {
+		t.Fatalf("GET ?tag=invoice = %v, want only %s", emails, invoice)
+	}
+	if tags, _ := emails[0]["tags"].([]interface{}); len(tags) != 1 || tags[0] != "invoice" {
+		t.Errorf("tags = %v, want [invoice]", emails[0]["tags"])
+	}
+	if emails := getAPIEmails(t, srv.apiAddr); len(emails) != 1 || emails[0]["id"] != other {
+		t.Errorf("remaining emails = %v, want only %s", emails, other)
+	}
+}
+
+func TestSnooze(t *testing.T) {
+	st := newTestStore(t)
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false))
+
+	save := func(subject string) string {
+		t.Helper()
+		id, err := st.SaveInbound(t.Context(), "client@example.com", []string{"support@example.com"},
+			subject, "body", []byte("Subject: "+subject+"\r\n\r\nbody"), "<"+subject+"@example.com>", "mailescrow/received", "default")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+		return id
+	}
+	later, other := save("Question"), save("Order")
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	postActionForm(t, srv.webAddr, later, "snooze", url.Values{"hours": {"4"}})
+	if body := get("/"); strings.Contains(body, "/email/"+later) || !strings.Contains(body, "/email/"+other) {
+		t.Errorf("default list should leave out the snoozed email: %q", body)
+	}
+	if body := get("/?snoozed=1"); !strings.Contains(body, "/email/"+later) || strings.Contains(body, "/email/"+other) || !strings.Contains(body, "snoozed until") {
+		t.Errorf("snoozed filter should list only the snoozed email: %q", body)
+	}
+	if body := get("/email/" + later); !strings.Contains(body, "/email/"+later+"/unsnooze") {
+		t.Errorf("detail page missing the wake button: %q", body)
+	}
+	audit, _ := st.ListAudit(t.Context(), 10)
+	if len(audit) == 0 || audit[0].Action != "email.snooze" || !strings.Contains(audit[0].Detail, later) {
+		t.Errorf("audit = %+v, want email.snooze of %s", audit, later)
+	}
+
+	resp, err := http.PostForm("http://"+srv.webAddr+"/email/"+other+"/snooze", url.Values{"hours": {"0"}})
+	if err != nil {
+		t.Fatalf("POST snooze: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("snooze for 0 hours: status %d, want 400", resp.StatusCode)
+	}
+
+	postActionForm(t, srv.webAddr, later, "unsnooze", nil)
+	if body := get("/"); !strings.Contains(body, "/email/"+later) {
+		t.Errorf("woken email missing from the list: %q", body)
+	}
+
+	postAction(t, srv.webAddr, other, "approve")
+	resp, err = http.PostForm("http://"+srv.webAddr+"/email/"+other+"/snooze", url.Values{"hours": {"1"}})
+	if err != nil {
+		t.Fatalf("POST snooze: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("snooze of an approved email: status %d, want 409", resp.StatusCode)
+	}
+}
+
+// dsnFetcher hands the poller one fetched message, then nothing.
+type dsnFetcher struct {
+	fetched []imap.FetchedEmail
+}
+
+func (f *dsnFetcher) Poll(context.Context, string, []string) ([]imap.FetchedEmail, error) {
+	out := f.fetched
+	f.fetched = nil
+	return out, nil
+}
+
+func (f *dsnFetcher) MoveMessage(context.Context, string, string, string) error { return nil }
+
+// TestDeliveryStatusNotifications: approve → relay requests DSNs → a returned
+// DSN is matched by envelope ID and shown on the history page
+func TestDeliveryStatusNotifications(t *testing.T) {
+	upstream := startUpstreamSMTP(t, "DSN")
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+	if err := r.SetDSN([]string{"failure", "delay"}, "hdrs"); err != nil {
+		t.Fatalf("set DSN: %v", err)
+	}
+	srv := startTestServer(t, st, r)
+
+	id := postAPIEmail(t, srv.apiAddr, "bob@example.com", "DSN Test", "Tracked delivery.")
+	postAction(t, srv.webAddr, id, "approve")
+
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(msgs))
+	}
+	if cmds := msgs[0].Commands; len(cmds) != 2 ||
+		!strings.Contains(cmds[0], "RET=HDRS") || !strings.Contains(cmds[0], "ENVID="+id) ||
+		!strings.Contains(cmds[1], "NOTIFY=FAILURE,DELAY") {
+		t.Errorf("upstream commands = %q, want DSN parameters", cmds)
+	}
+
+	history := func() string {
+		resp, err := http.Get("http://" + srv.webAddr + "/history")
+		if err != nil {
+			t.Fatalf("GET /history: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	if body := history(); !strings.Contains(body, "badge-delivery-requested") {
+		t.Errorf("history missing requested delivery: %q", body)
+	}
+
+	raw := "From: MAILER-DAEMON@relay.example.com\r\n" +
+		"Subject: Undelivered Mail Returned to Sender\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; relay.example.com\r\n" +
+		"Original-Envelope-Id: " + id + "\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; bob@example.com\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"--b--\r\n"
+	f := &dsnFetcher{fetched: []imap.FetchedEmail{{
+		MessageID: "<dsn@relay.example.com>", Sender: "MAILER-DAEMON@relay.example.com", Recipients: []string{"sender@example.com"},
+		Subject: "Undelivered Mail Returned to Sender", RawMessage: []byte(raw),
+	}}}
+	p := poller.New(f, st, routing.New(nil), nil, time.Minute, poller.Options{})
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+
+	body := history()
+	if !strings.Contains(body, "badge-delivery-failed") || !strings.Contains(body, "bob@example.com failed (5.1.1)") {
+		t.Errorf("history missing failed delivery: %q", body)
+	}
+}
+
+// TestConfigReload: POST /api/config/reload applies quota changes from the
+// config file, lists settings that need a restart and keeps the old
+// configuration when the new one is invalid
+func TestConfigReload(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	manager := tokens.New(st)
+	admin, _, err := manager.Create(t.Context(), "ops", []string{tokens.ScopeAdmin}, 0, "test")
+	if err != nil {
+		t.Fatalf("create admin token: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+	write("web:\n  listen: \":8080\"\n")
+	started, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	limiter, _ := quota.New(st, 0, 0, "")
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		s.SetTokens(manager, false)
+		s.SetQuota(limiter)
+		s.SetReload(func() ([]string, []string, error) {
+			cfg, err := config.Load(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := limiter.SetLimits(cfg.Quota.PerHour, cfg.Quota.PerDay, cfg.Quota.Action); err != nil {
+				return nil, nil, err
+			}
+			reloaded, restart := config.Diff(started, cfg)
+			return reloaded, restart, nil
+		})
+	})
+
+	reload := func() (int, map[string][]string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/config/reload", nil)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /api/config/reload: %v", err)
+		}
+		defer resp.Body.Close()
+		var body map[string][]string
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	write("web:\n  listen: \":9090\"\nquota:\n  per_hour: 1\n  action: refuse\n")
+	code, body := reload()
+	if code != http.StatusOK {
+		t.Fatalf("reload: status %d", code)
+	}
+	if got := strings.Join(body["reloaded"], ","); got != "quota.per_hour,quota.action" {
+		t.Errorf("reloaded = %q, want quota.per_hour,quota.action", got)
+	}
+	if got := strings.Join(body["restart_required"], ","); got != "web.listen" {
+		t.Errorf("restart_required = %q, want web.listen", got)
+	}
+
+	postAPIEmail(t, srv.apiAddr, "a@example.com", "Within quota", "one")
+	b, _ := json.Marshal(map[string]any{"to": []string{"a@example.com"}, "subject": "Over", "body": "two"})
+	resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("over reloaded quota: status %d, want 429", resp.StatusCode)
+	}
+
+	write("quota:\n  per_hour: 100\n  action: explode\n")
+	if code, _ := reload(); code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid reload: status %d, want 422", code)
+	}
+	if !limiter.Enabled() {
+		t.Error("failed reload dropped the quota")
+	}
+}
+
+// settingsEditor changes the tunable settings of a config loaded at
+// startup, keeping them in the store, as the reloader in cmd/mailescrow does.
+type settingsEditor struct {
+	st      store.EmailStore
+	limiter *quota.Limiter
+	base    config.Config
+}
+
+func (e *settingsEditor) effective(ctx context.Context, skip map[string]*string) (*config.Config, []store.Setting, error) {
+	stored, err := e.st.ListSettings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := e.base
+	for _, s := range stored {
+		if _, ok := skip[s.Key]; ok {
+			continue
+		}
+		if err := cfg.Override(s.Key, s.Value); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &cfg, stored, nil
+}
+
+func (e *settingsEditor) TunableSettings(ctx context.Context) ([]web.TunableSetting, error) {
+	cfg, stored, err := e.effective(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var settings []web.TunableSetting
+	for _, key := range config.Tunable() {
+		value, secret := cfg.TunableValue(key)
+		ts := web.TunableSetting{Key: key, Value: value, Secret: secret}
+		for _, s := range stored {
+			if s.Key == key {
+				ts.Changed, ts.UpdatedBy, ts.UpdatedAt = true, s.UpdatedBy, s.UpdatedAt
+			}
+		}
+		settings = append(settings, ts)
+	}
+	return settings, nil
+}
+
+func (e *settingsEditor) UpdateSettings(ctx context.Context, changes map[string]*string, actor string) error {
+	cfg, _, err := e.effective(ctx, changes)
+	if err != nil {
+		return err
+	}
+	for key, value := range changes {
+		if value == nil {
+			continue
+		}
+		if err := cfg.Override(key, *value); err != nil {
+			return err
+		}
+	}
+	if err := e.limiter.SetLimits(cfg.Quota.PerHour, cfg.Quota.PerDay, cfg.Quota.Action); err != nil {
+		return &config.SettingError{Key: "quota", Err: err}
+	}
+	for key, value := range changes {
+		if value == nil {
+			err = e.st.DeleteSetting(ctx, key)
+		} else {
+			err = e.st.SaveSetting(ctx, store.Setting{Key: key, Value: *value, UpdatedBy: actor})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestSettingsAPI: PUT /api/settings changes tunable settings at runtime,
+// rejects invalid ones with field errors and resets them with null, and the
+// settings page edits them too
+func TestSettingsAPI(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	manager := tokens.New(st)
+	admin, _, err := manager.Create(t.Context(), "ops", []string{tokens.ScopeAdmin}, 0, "test")
+	if err != nil {
+		t.Fatalf("create admin token: %v", err)
+	}
+	limiter, _ := quota.New(st, 0, 0, "")
+	editor := &settingsEditor{st: st, limiter: limiter}
+	editor.base.SLA.WebhookURL = "https://hooks.example.com/secret"
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		s.SetTokens(manager, false)
+		s.SetQuota(limiter)
+		s.SetSettingsEditor(editor)
+	})
+
+	type setting struct {
+		Key       string `json:"key"`
+		Value     any    `json:"value"`
+		Secret    bool   `json:"secret"`
+		Changed   bool   `json:"changed"`
+		UpdatedBy string `json:"updated_by"`
+	}
+	call := func(method, body string) (int, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+srv.apiAddr+"/api/settings", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s /api/settings: %v", method, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, b
+	}
+	settings := func(b []byte) map[string]setting {
+		t.Helper()
+		var resp struct {
+			Settings []setting `json:"settings"`
+		}
+		if err := json.Unmarshal(b, &resp); err != nil {
+			t.Fatalf("decode settings %q: %v", b, err)
+		}
+		byKey := make(map[string]setting)
+		for _, s := range resp.Settings {
+			byKey[s.Key] = s
+		}
+		return byKey
+	}
+
+	code, b := call(http.MethodGet, "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /api/settings: status %d", code)
+	}
+	if got := settings(b)["sla.webhook_url"]; !got.Secret || got.Value != "(redacted)" || got.Changed {
+		t.Errorf("sla.webhook_url = %+v, want a redacted secret from the config file", got)
+	}
+
+	code, b = call(http.MethodPut, `{"quota": {"per_hour": 1, "action": "refuse"}}`)
+	if code != http.StatusOK {
+		t.Fatalf("PUT /api/settings: status %d, body %s", code, b)
+	}
+	if got := settings(b)["quota"]; !got.Changed || got.UpdatedBy != "token:ops" {
+		t.Errorf("quota = %+v, want changed by token:ops", got)
+	}
+	postAPIEmail(t, srv.apiAddr, "a@example.com", "Within quota", "one")
+	over, _ := json.Marshal(map[string]any{"to": []string{"a@example.com"}, "subject": "Over", "body": "two"})
+	resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(over))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("over the quota set at runtime: status %d, want 429", resp.StatusCode)
+	}
+
+	code, b = call(http.MethodPut, `{"quota": {"per_hour": 5, "action": "explode"}, "web.listen": ":1"}`)
+	if code != http.StatusBadRequest || !strings.Contains(string(b), `"web.listen"`) {
+		t.Errorf("PUT with a setting that is not tunable: status %d, body %s", code, b)
+	}
+	code, b = call(http.MethodPut, `{"quota": {"per_hour": 5, "action": "explode"}}`)
+	if code != http.StatusBadRequest || !strings.Contains(string(b), `"quota"`) {
+		t.Errorf("PUT with an invalid quota: status %d, body %s", code, b)
+	}
+	code, b = call(http.MethodPut, `{"sla.webhook_url": "(redacted)"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("PUT of the redacted secret: status %d, body %s", code, b)
+	}
+	if !limiter.Enabled() {
+		t.Error("rejected change dropped the quota")
+	}
+
+	code, b = call(http.MethodPut, `{"quota": null}`)
+	if code != http.StatusOK || settings(b)["quota"].Changed {
+		t.Errorf("reset quota: status %d, body %s", code, b)
+	}
+	if limiter.Enabled() {
+		t.Error("reset quota is still enforced")
+	}
+
+	resp, err = http.PostForm("http://"+srv.webAddr+"/settings", url.Values{"key": {"retention.audit"}, "value": {"90d"}})
+	if err != nil {
+		t.Fatalf("POST /settings: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /settings: status %d", resp.StatusCode)
+	}
+	if stored, _ := st.ListSettings(t.Context()); len(stored) != 1 || stored[0].Key != "retention.audit" || stored[0].Value != "90d" {
+		t.Errorf("stored settings = %+v, want retention.audit changed on the page", stored)
+	}
+	resp, err = http.PostForm("http://"+srv.webAddr+"/settings", url.Values{"key": {"retention.audit"}, "value": {"soon"}})
+	if err != nil {
+		t.Fatalf("POST /settings: %v", err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(page), "soon") {
+		t.Errorf("invalid value on the page: status %d, body %q", resp.StatusCode, page)
+	}
+
+	audit, _ := st.ListAudit(t.Context(), 10)
+	var actions []string
+	for _, a := range audit {
+		actions = append(actions, a.Action+" "+a.Detail)
+	}
+	for _, want := range []string{"settings.update quota", "settings.reset quota", "settings.update retention.audit"} {
+		if !slices.Contains(actions, want) {
+			t.Errorf("audit = %q, want %q", actions, want)
+		}
+	}
+}
+
+// TestConsumerCheckpoints: with api.consume_mode keep, approved inbound mail
+// stays after GET /api/emails, and each token reading with
+// ?after_checkpoint=true gets every email once
+func TestConsumerCheckpoints(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	manager := tokens.New(st)
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		s.SetTokens(manager, false)
+		s.SetKeepFetched(true)
+		s.SetAPIV2(true)
+	})
+	var consumers []string
+	for _, name := range []string{"crm", "archive"} {
+		token, _, err := manager.Create(t.Context(), name, []string{tokens.ScopeRead}, 0, "test")
+		if err != nil {
+			t.Fatalf("create token: %v", err)
+		}
+		consumers = append(consumers, token)
+	}
+	approve := func(subject string) {
+		t.Helper()
+		id, err := st.SaveInbound(t.Context(), "alice@example.com", []string{"me@example.com"}, subject, "hi",
+			[]byte("Subject: "+subject+"\r\n\r\nhi"), "<"+subject+"@example.com>", "mailescrow/approved", "default")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+		if err := st.Approve(t.Context(), id, "carol", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+	}
+	read := func(token, query string) (int, []string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+srv.apiAddr+"/api/emails"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var emails []map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&emails)
+		var subjects []string
+		for _, e := range emails {
+			subjects = append(subjects, fmt.Sprint(e["subject"]))
+		}
+		return resp.StatusCode, subjects
+	}
+
+	approve("one")
+	approve("two")
+	for _, token := range consumers {
+		if code, got := read(token, "?after_checkpoint=true"); code != http.StatusOK || strings.Join(got, ",") != "one,two" {
+			t.Errorf("first read: status %d, %q; want one,two", code, got)
+		}
+		if _, got := read(token, "?after_checkpoint=true"); len(got) != 0 {
+			t.Errorf("second read = %q, want nothing new", got)
+		}
+	}
+	approve("three")
+	if _, got := read(consumers[0], "?after_checkpoint=true"); strings.Join(got, ",") != "three" {
+		t.Errorf("crm read = %q, want three", got)
+	}
+	if _, got := read(consumers[1], "?after_checkpoint=true&wait=5s"); strings.Join(got, ",") != "three" {
+		t.Errorf("archive read = %q, want three", got)
+	}
+
+	// Without a checkpoint every kept email is returned, and still kept.
+	if _, got := read(consumers[0], ""); len(got) != 3 {
+		t.Errorf("read without a checkpoint = %q, want all three", got)
+	}
+	if approved, _ := st.ListApproved(t.Context(), "", ""); len(approved) != 3 {
+		t.Errorf("%d approved emails left, want all 3 kept", len(approved))
+	}
+
+	// A page of a v2 read moves the checkpoint past that page only.
+	approve("four")
+	approve("five")
+	req, _ := http.NewRequest(http.MethodGet, "http://"+srv.apiAddr+"/api/v2/emails?after_checkpoint=true&limit=1", nil)
+	req.Header.Set("Authorization", "Bearer "+consumers[0])
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/v2/emails: %v", err)
+	}
+	var page struct {
+		Data    []map[string]any `json:"data"`
+		HasMore bool             `json:"has_more"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if len(page.Data) != 1 || page.Data[0]["subject"] != "four" || !page.HasMore {
+		t.Errorf("v2 page = %+v, want four with more to come", page)
+	}
+	if _, got := read(consumers[0], "?after_checkpoint=true"); strings.Join(got, ",") != "five" {
+		t.Errorf("read after the page = %q, want five", got)
+	}
+
+	if code, _ := read("", "?after_checkpoint=true"); code != http.StatusUnauthorized {
+		t.Errorf("checkpoint read without a token: status %d, want 401", code)
+	}
+	if code, _ := read(consumers[0], "?after_checkpoint=true&tag=invoice"); code != http.StatusBadRequest {
+		t.Errorf("checkpoint read with a tag: status %d, want 400", code)
+	}
+}
+
+// TestCheckpointsNeedKeepMode: ?after_checkpoint=true is refused while
+// fetched mail is deleted
+func TestCheckpointsNeedKeepMode(t *testing.T) {
+	st := newTestStore(t)
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false))
+	resp, err := http.Get("http://" + srv.apiAddr + "/api/emails?after_checkpoint=true")
+	if err != nil {
+		t.Fatalf("GET /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("checkpoint read in delete mode: status %d, want 400", resp.StatusCode)
+	}
+}
+
+// TestGoClient: the client package submits, approves and fetches against a real server
+func TestGoClient(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	manager := tokens.New(st)
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false), func(s *web.Server) { s.SetTokens(manager, true) })
+	token, _, err := manager.Create(t.Context(), "app", []string{tokens.ScopeSend, tokens.ScopeRead}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	ctx := t.Context()
+	c := client.New("http://" + srv.apiAddr)
+	if _, err := c.PendingCount(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("PendingCount without a token = %v, want ErrUnauthorized", err)
+	}
+	c.SetToken(token)
+	c.SetReviewer("http://"+srv.webAddr, "carol", "")
+
+	sub, err := c.Submit(ctx, client.Message{To: []string{"bob@example.com"}, Subject: "From the client", Body: "hi"})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if n, err := c.PendingCount(ctx); err != nil || n != 1 {
+		t.Errorf("PendingCount = %d, %v; want 1", n, err)
+	}
+	if err := c.Approve(ctx, sub.ID); err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	if msgs := upstream.getReceived(); len(msgs) != 1 || !strings.Contains(msgs[0].Data, "Subject: From the client") {
+		t.Errorf("upstream got %+v, want the approved email", msgs)
+	}
+
+	batch, err := c.SubmitBatch(ctx, []client.Message{
+		{To: []string{"bob@example.com"}, Subject: "Batched", Body: "hi"},
+		{To: []string{"bob@"}, Subject: "Batched", Body: "hi"},
+	})
+	if err != nil {
+		t.Fatalf("SubmitBatch: %v", err)
+	}
+	var apiErr *client.Error
+	if len(batch) != 2 || batch[0].Err != nil || batch[0].Status != "pending" ||
+		!errors.As(batch[1].Err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || len(apiErr.Fields) != 1 {
+		t.Errorf("SubmitBatch = %+v, want the first pending and the second refused", batch)
+	}
+
+	id, err := st.SaveInbound(ctx, "alice@example.com", []string{"me@example.com"}, "Inbound", "hello",
+		[]byte("Subject: Inbound\r\n\r\nhello"), "<client@example.com>", "mailescrow/received", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	if err := c.Approve(ctx, id); err != nil {
+		t.Fatalf("Approve inbound: %v", err)
+	}
+	listed, err := c.ListByStatus(ctx, client.StatusApproved)
+	if err != nil {
+		t.Fatalf("ListByStatus: %v", err)
+	}
+	if len(listed) != 1 || listed[0].ID != id || listed[0].Direction != "inbound" || listed[0].Reviewer == "" {
+		t.Errorf("ListByStatus(approved) = %+v, want the approved inbound email", listed)
+	}
+	emails, err := c.FetchApproved(ctx, client.FetchOptions{})
+	if err != nil {
+		t.Fatalf("FetchApproved: %v", err)
+	}
+	if len(emails) != 1 || emails[0].Subject != "Inbound" || emails[0].From != "alice@example.com" {
+		t.Errorf("FetchApproved = %+v", emails)
+	}
+}
+
+// TestConcurrentDecisions: simultaneous approvals relay once; later decisions name who decided first
+func TestConcurrentDecisions(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false))
+
+	decide := func(id, action, reviewer string, form url.Values) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.webAddr+"/email/"+id+"/"+action, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(reviewer, "")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("POST /email/%s/%s: %v", id, action, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	id := postAPIEmail(t, srv.apiAddr, "bob@example.com", "Race", "hi")
+	var wg sync.WaitGroup
+	codes := make(chan int, 5)
+	for range 5 {
+		wg.Go(func() {
+			code, _ := decide(id, "approve", "alice", url.Values{"version": {"0"}})
+			codes <- code
+		})
+	}
+	wg.Wait()
+	close(codes)
+	won := 0
+	for code := range codes {
+		switch code {
+		case http.StatusSeeOther:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Errorf("concurrent approve: status %d, want 303 or 409", code)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d approvals succeeded, want 1", won)
+	}
+	if n := len(upstream.getReceived()); n != 1 {
+		t.Errorf("upstream got %d messages, want 1", n)
+	}
+
+	if code, body := decide(id, "reject", "bob", url.Values{}); code != http.StatusConflict || body != "Email already approved by alice" {
+		t.Errorf("reject after approval: %d %q, want 409 naming alice", code, body)
+	}
+
+	// A page showing an older version of the email is refused.
+	id = postAPIEmail(t, srv.apiAddr, "bob@example.com", "Stale", "hi")
+	if code, body := decide(id, "approve", "bob", url.Values{"version": {"3"}}); code != http.StatusConflict || !strings.Contains(body, "reload") {
+		t.Errorf("approve at a stale version: %d %q, want 409", code, body)
+	}
+	if code, _ := decide(id, "reject", "bob", url.Values{"version": {"0"}}); code != http.StatusSeeOther {
+		t.Errorf("reject: status %d, want 303", code)
+	}
+	if code, body := decide(id, "approve", "alice", url.Values{}); code != http.StatusConflict || body != "Email already rejected by bob" {
+		t.Errorf("approve after rejection: %d %q, want 409 naming bob", code, body)
+	}
+	if code, _ := decide("no-such-email", "approve", "alice", url.Values{}); code != http.StatusNotFound {
+		t.Errorf("approve of an unknown email: status %d, want 404", code)
+	}
+}
+
+// TestAPIRules: rules approve, reject and tag REST API submissions as they
+// do SMTP ones
+func TestAPIRules(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	engine, err := rules.New([]rules.Rule{
+		{Name: "inbound-only", Direction: store.DirectionInbound, Action: rules.ActionReject},
+		{Name: "internal", Recipient: "*@internal.example.com", Action: rules.ActionApprove},
+		{Name: "secrets", When: `email.subject.lowerAscii().contains("secret")`, Action: rules.ActionReject},
+		{Name: "reports", When: `email.headers["subject"].startsWith("Report")`, Tags: []string{"report"}},
+	})
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false), func(s *web.Server) { s.SetRules(engine) })
+
+	submit := func(to, subject string) (int, string) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{to}, "subject": subject, "body": "Quarterly figures"})
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Status
+	}
+	if code, status := submit("ops@internal.example.com", "Report"); code != http.StatusCreated || status != "sent" {
+		t.Errorf("submit matching an approve rule: %d %q, want 201 sent", code, status)
+	}
+	if code, _ := submit("ceo@partner.example", "Top secret"); code != http.StatusForbidden {
+		t.Errorf("submit matching a reject rule: %d, want 403", code)
+	}
+	if code, status := submit("ceo@partner.example", "Report Q3"); code != http.StatusCreated || status != store.StatusPending {
+		t.Fatalf("submit matching no action: %d %q, want 201 pending", code, status)
+	}
+	if n := len(upstream.getReceived()); n != 1 {
+		t.Errorf("upstream got %d messages, want the approved one", n)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || !slices.Equal(pending[0].Tags, []string{"report"}) {
+		t.Errorf("pending = %+v, want the report held and tagged", pending)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	reviewers := make([]string, 0, len(decisions))
+	for _, d := range decisions {
+		reviewers = append(reviewers, d.Reviewer)
+	}
+	slices.Sort(reviewers)
+	if !slices.Equal(reviewers, []string{"rule:internal", "rule:secrets"}) {
+		t.Errorf("decided by %v, want rule:internal and rule:secrets", reviewers)
+	}
+}
+
+// TestDomainPolicies: mail to a policy's domain is approved, refused or needs
+// two reviewers giving reasons; the history keeps the reasons
+func TestDomainPolicies(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	policies, err := policy.New([]policy.Policy{
+		{Domain: "*.gov", Action: rules.ActionHold, Approvals: 2, RequireReason: true},
+		{Domain: "internal.example.com", Action: rules.ActionApprove},
+		{Domain: "competitor.example", Action: rules.ActionReject},
+	})
+	if err != nil {
+		t.Fatalf("new policies: %v", err)
+	}
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false), func(s *web.Server) { s.SetPolicies(policies) })
+
+	submit := func(to string) (int, string) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{to}, "subject": "Report", "body": "Quarterly figures"})
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Status
+	}
+	if code, status := submit("ops@internal.example.com"); code != http.StatusCreated || status != "sent" {
+		t.Errorf("submit to an approved domain: %d %q, want 201 sent", code, status)
+	}
+	if code, _ := submit("ceo@competitor.example"); code != http.StatusForbidden {
+		t.Errorf("submit to a refused domain: %d, want 403", code)
+	}
+	if n := len(upstream.getReceived()); n != 1 {
+		t.Fatalf("upstream got %d messages, want the approved one", n)
+	}
+
+	id := postAPIEmail(t, srv.apiAddr, "desk@agency.gov", "Filing", "Attached.")
+	approve := func(reviewer, reason string) int {
+		t.Helper()
+		form := url.Values{"reason": {reason}}
+		req, _ := http.NewRequest(http.MethodPost, "http://"+srv.webAddr+"/email/"+id+"/approve", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(reviewer, "")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("POST /email/%s/approve: %v", id, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := approve("alice", ""); code != http.StatusBadRequest {
+		t.Errorf("approval without a reason: %d, want 400", code)
+	}
+	if code := approve("alice", "filing deadline"); code != http.StatusSeeOther {
+		t.Fatalf("first approval: %d, want 303", code)
+	}
+	if n := len(upstream.getReceived()); n != 1 {
+		t.Fatalf("relayed after one of two approvals")
+	}
+	if !strings.Contains(getBody(t, srv.webAddr), "1 of 2 approvals") {
+		t.Error("pending list should show the approvals so far")
+	}
+	if code := approve("alice", "again"); code != http.StatusConflict {
+		t.Errorf("second approval by the same reviewer: %d, want 409", code)
+	}
+	if code := approve("bob", "checked figures"); code != http.StatusSeeOther {
+		t.Fatalf("second approval: %d, want 303", code)
+	}
+	if n := len(upstream.getReceived()); n != 2 {
+		t.Fatalf("upstream got %d messages, want the filing relayed", n)
+	}
+	d, err := st.LastDecision(t.Context(), id)
+	if err != nil || d == nil {
+		t.Fatalf("last decision: %v", err)
+	}
+	if d.Reviewer != "bob" || d.Reason != "alice: filing deadline; bob: checked figures" {
+		t.Errorf("decision by %q with reason %q", d.Reviewer, d.Reason)
+	}
+}
+
+// TestReputationWarnings: local reputation entries managed over the admin API
+// show as warnings on the detail page of outbound and inbound mail
+func TestReputationWarnings(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	manager := tokens.New(st)
+	admin, _, err := manager.Create(t.Context(), "ops", []string{tokens.ScopeAdmin}, 0, "test")
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		s.SetTokens(manager, false)
+		s.SetReputation(reputation.New(st, nil, nil))
+	})
+
+	call := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+srv.apiAddr+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	detail := func(id string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + "/email/" + id)
+		if err != nil {
+			t.Fatalf("GET detail: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	if code, _ := call(http.MethodPut, "/api/reputation/not a domain", `{"reputation": "blocked"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid subject: status %d, want 400", code)
+	}
+	if code, _ := call(http.MethodPut, "/api/reputation/spam.example", `{"reputation": "shady"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid reputation: status %d, want 400", code)
+	}
+	for subject, note := range map[string]string{"Spam.Example": "sends phishing", "192.0.2.1": ""} {
+		if code, body := call(http.MethodPut, "/api/reputation/"+subject, `{"reputation": "blocked", "note": "`+note+`"}`); code != http.StatusOK {
+			t.Fatalf("block %s: status %d, body %s", subject, code, body)
+		}
+	}
+	code, body := call(http.MethodGet, "/api/reputation", "")
+	if code != http.StatusOK || !strings.Contains(body, `"subject":"spam.example"`) || !strings.Contains(body, `"created_by":"token:ops"`) {
+		t.Errorf("list: status %d, body %s", code, body)
+	}
+
+	outbound := postAPIEmail(t, srv.apiAddr, "ceo@mail.spam.example", "Offer", "Hi")
+	clean := postAPIEmail(t, srv.apiAddr, "ops@example.com", "Report", "Hi")
+	raw := []byte("Received: from mail.sender.example (mail.sender.example [192.0.2.1]) by mx.example.org; Mon, 2 Mar 2026 10:00:00 +0000\r\n" +
+		"From: a@sender.example\r\nTo: me@example.com\r\nSubject: Hello\r\n\r\nHi\r\n")
+	inbound, err := st.SaveInbound(t.Context(), "a@sender.example", []string{"me@example.com"}, "Hello", "Hi", raw, "", "", "")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+
+	if page := detail(outbound); !strings.Contains(page, "mail.spam.example is blocked in the local reputation table: spam.example is blocked; sends phishing") {
+		t.Errorf("outbound detail page lacks the recipient domain warning:\n%s", page)
+	}
+	if page := detail(inbound); !strings.Contains(page, "192.0.2.1 is blocked in the local reputation table") {
+		t.Errorf("inbound detail page lacks the sender IP warning:\n%s", page)
+	}
+	if page := detail(clean); strings.Contains(page, "reputation table") {
+		t.Errorf("clean email shows a reputation warning")
+	}
+
+	if code, _ := call(http.MethodDelete, "/api/reputation/spam.example", ""); code != http.StatusNoContent {
+		t.Errorf("delete: status %d, want 204", code)
+	}
+	if code, _ := call(http.MethodDelete, "/api/reputation/spam.example", ""); code != http.StatusNotFound {
+		t.Errorf("delete again: status %d, want 404", code)
+	}
+	if page := detail(outbound); strings.Contains(page, "reputation table") {
+		t.Errorf("warning still shown after the entry was deleted")
+	}
+}
+
+// TestSnippets: the pending list and GET /api/emails show a one-line snippet
+// without the quoted reply and signature
+func TestSnippets(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	body := "Yes, Thursday works.\n\nOn Mon, 2 Mar 2026, Ann <ann@example.com> wrote:\n> Can we meet on Thursday?\n-- \nAnn"
+	raw := []byte("From: ann@example.com\r\nTo: me@example.com\r\nSubject: Re: Meeting\r\n\r\n" + body)
+	if _, err := st.SaveInbound(t.Context(), "ann@example.com", []string{"me@example.com"}, "Re: Meeting", body, raw, "", "", "default"); err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+
+	page := getBody(t, srv.webAddr)
+	if !strings.Contains(page, `<p class="snippet">Yes, Thursday works.</p>`) {
+		t.Errorf("pending list lacks the snippet:\n%s", page)
+	}
+
+	postAction(t, srv.webAddr, extractID(page, "approve"), "approve")
+	emails := getAPIEmails(t, srv.apiAddr)
+	if len(emails) != 1 || emails[0]["snippet"] != "Yes, Thursday works." {
+		t.Errorf("GET /api/emails = %v, want the snippet", emails)
+	}
+}
+
+// TestBasePathBehindProxy: with a base path the UI and API live under it,
+// links and redirects include it, and a trusted proxy's scheme and host make
+// redirects absolute
+func TestBasePathBehindProxy(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		s.SetBasePath("/mailescrow")
+		if err := s.SetTrustedProxies([]string{"127.0.0.1", "::1"}); err != nil {
+			t.Fatalf("set trusted proxies: %v", err)
+		}
+	})
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := http.Post("http://"+srv.apiAddr+"/mailescrow/api/emails", "application/json",
+		strings.NewReader(`{"to": ["ops@example.com"], "subject": "Proxied", "body": "Hi"}`))
+	if err != nil {
+		t.Fatalf("POST /mailescrow/api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /mailescrow/api/emails: status %d, want 201", resp.StatusCode)
+	}
+	for _, u := range []string{"http://" + srv.webAddr + "/", "http://" + srv.apiAddr + "/api/emails"} {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("GET %s: %v", u, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404 outside the base path", u, resp.StatusCode)
+		}
+	}
+
+	resp, err = http.Get("http://" + srv.webAddr + "/mailescrow/")
+	if err != nil {
+		t.Fatalf("GET /mailescrow/: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	page := string(b)
+	for _, want := range []string{`href="/mailescrow/static/style.css"`, `href="/mailescrow/triage"`, `action="/mailescrow/email/`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("pending list lacks %s", want)
+		}
+	}
+
+	id, err := st.SaveInbound(t.Context(), "a@example.com", []string{"me@example.com"}, "Inbound", "Hi", []byte("Subject: Inbound\r\n\r\nHi\r\n"), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+srv.webAddr+"/mailescrow/email/"+id+"/approve", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "intranet.example.org")
+	resp, err = noRedirect.Do(req)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	resp.Body.Close()
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || loc != "https://intranet.example.org/mailescrow/" {
+		t.Errorf("approve: status %d, Location %q; want 303 to https://intranet.example.org/mailescrow/", resp.StatusCode, loc)
+	}
+}
+
+// TestSingleListener: with the API mounted on the web UI's listener, both
+// answer on one port and keep their own authentication
+func TestSingleListener(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	addr := freeAddr(t)
+	srv := web.New(st, r, nil, "sender@example.com", "", "secret")
+	srv.MountAPI()
+	go srv.Serve(addr)
+	t.Cleanup(func() { srv.Shutdown(t.Context()) }) //nolint:errcheck
+	waitForPort(t, addr)
+
+	postAPIEmail(t, addr, "ops@example.com", "One port", "Hi")
+	for path, want := range map[string]int{"/healthz": http.StatusOK, "/api/emails": http.StatusOK, "/": http.StatusUnauthorized} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "One port") {
+		t.Errorf("pending list lacks the email submitted through the API:\n%s", b)
+	}
+}
+
+// TestSecondFactor: a reviewer with a TOTP secret is sent to the code form
+// after the password, and a verified code lets the browser in for the
+// session; a reviewer without one is refused
+func TestSecondFactor(t *testing.T) {
+	st := newTestStore(t)
+	addr := freeAddr(t)
+	srv := web.New(st, relay.New("127.0.0.1", 1, "", "", false), nil, "sender@example.com", "", "secret")
+	const secret = "JBSWY3DPEHPK3PXP"
+	if err := srv.SetSecondFactors(map[string]string{"alice": secret}, nil, time.Hour); err != nil {
+		t.Fatalf("set second factors: %v", err)
+	}
+	go srv.Serve(addr)
+	t.Cleanup(func() { srv.Shutdown(t.Context()) }) //nolint:errcheck
+	waitForPort(t, addr)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(method, path, user string, form url.Values, cookies ...*http.Cookie) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://"+addr+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(user, "secret")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := do(http.MethodGet, "/history", "alice", nil); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/second-factor?next=%2Fhistory" {
+		t.Fatalf("GET /history without a code: status %d, Location %q; want 303 to the code form", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := do(http.MethodGet, "/", "bob", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET / as a reviewer without a secret: status %d, want 403", resp.StatusCode)
+	}
+	if resp := do(http.MethodPost, "/second-factor", "alice", url.Values{"code": {"000000"}, "next": {"/history"}}); resp.StatusCode != http.StatusOK || len(resp.Cookies()) != 0 {
+		t.Errorf("wrong code: status %d, cookies %v; want the form again", resp.StatusCode, resp.Cookies())
+	}
+
+	key, _ := totp.ParseSecret(secret)
+	code := totp.Code(key, totp.Step(time.Now()))
+	resp := do(http.MethodPost, "/second-factor", "alice", url.Values{"code": {code}, "next": {"/history"}})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/history" || len(resp.Cookies()) != 1 {
+		t.Fatalf("right code: status %d, Location %q, cookies %v; want 303 to /history with a cookie", resp.StatusCode, resp.Header.Get("Location"), resp.Cookies())
+	}
+	session := resp.Cookies()[0]
+	if resp := do(http.MethodGet, "/history", "alice", nil, session); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /history with the session: status %d, want 200", resp.StatusCode)
+	}
+	if resp := do(http.MethodPost, "/second-factor", "alice", url.Values{"code": {code}}); len(resp.Cookies()) != 0 {
+		t.Error("a used code was accepted again")
+	}
+}
+
+// TestShareLinks: a reviewer creates a share link for a held email; anyone
+// with the URL can read the email without logging in until the link is
+// revoked, and every visit is recorded in the audit log
+func TestShareLinks(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	addr := freeAddr(t)
+	srv := web.New(st, r, nil, "sender@example.com", "", "secret")
+	go srv.Serve(addr)
+	t.Cleanup(func() { srv.Shutdown(t.Context()) }) //nolint:errcheck
+	waitForPort(t, addr)
+
+	raw := []byte("From: ann@example.com\r\nTo: me@example.com\r\nSubject: Contract draft\r\n\r\nPlease check clause 4.")
+	id, err := st.SaveInbound(t.Context(), "ann@example.com", []string{"me@example.com"}, "Contract draft", "Please check clause 4.", raw, "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	post := func(path string, form url.Values, auth bool) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if auth {
+			req.SetBasicAuth("alice", "secret")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := post("/email/"+id+"/share", url.Values{}, false); code != http.StatusUnauthorized {
+		t.Fatalf("share without login: status %d, want 401", code)
+	}
+	if code, _ := post("/email/"+id+"/share", url.Values{"expires_in_hours": {"1000"}}, true); code != http.StatusBadRequest {
+		t.Errorf("share for 1000 hours: status %d, want 400", code)
+	}
+	code, page := post("/email/"+id+"/share", url.Values{"expires_in_hours": {"1"}}, true)
+	if code != http.StatusOK {
+		t.Fatalf("share: status %d, want 200", code)
+	}
+	_, rest, ok := strings.Cut(page, "<pre>http://"+addr+"/share/")
+	if !ok {
+		t.Fatalf("detail page lacks the share URL:\n%s", page)
+	}
+	token, _, _ := strings.Cut(rest, "</pre>")
+	shareURL := "http://" + addr + "/share/" + token
+
+	resp, err := http.Get(shareURL)
+	if err != nil {
+		t.Fatalf("GET share URL: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET share URL: status %d, want 200", resp.StatusCode)
+	}
+	for _, want := range []string{"Contract draft", "Please check clause 4.", "ann@example.com"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("shared page lacks %q:\n%s", want, b)
+		}
+	}
+	if strings.Contains(string(b), "/approve") {
+		t.Errorf("shared page offers actions:\n%s", b)
+	}
+	if got := resp.Header.Get("Referrer-Policy"); got != "no-referrer" {
+		t.Errorf("Referrer-Policy = %q, want no-referrer", got)
+	}
+
+	audit, err := st.ListAudit(t.Context(), 10)
+	if err != nil {
+		t.Fatalf("list audit: %v", err)
+	}
+	var actions []string
+	for _, e := range audit {
+		actions = append(actions, e.Action+" by "+e.Actor)
+	}
+	links, _ := st.ListShareLinks(t.Context(), id)
+	if len(links) != 1 {
+		t.Fatalf("share links = %+v, want one", links)
+	}
+	if want := []string{"share.view by share:" + links[0].ID, "share.create by alice"}; !slices.Equal(actions, want) {
+		t.Errorf("audit = %q, want %q", actions, want)
+	}
+
+	if code, _ := post("/email/"+id+"/share/"+links[0].ID+"/revoke", url.Values{}, true); code != http.StatusSeeOther {
+		t.Fatalf("revoke: status %d, want 303", code)
+	}
+	resp, err = http.Get(shareURL)
+	if err != nil {
+		t.Fatalf("GET share URL: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET revoked share URL: status %d, want 404", resp.StatusCode)
+	}
+	resp, err = http.Get("http://" + addr + "/share/unknown")
+	if err != nil {
+		t.Fatalf("GET unknown share URL: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET unknown share URL: status %d, want 404", resp.StatusCode)
+	}
+}
+
+// TestRedaction: card numbers are redacted before held mail is stored, the
+// raw view shows outbound mail decoded and redacted, and inbound raw messages
+// are not stored under the drop policy
+func TestRedaction(t *testing.T) {
+	st := newTestStore(t)
+	redactor, err := redact.New([]string{redact.CreditCard}, nil)
+	if err != nil {
+		t.Fatalf("new redactor: %v", err)
+	}
+	held := redact.NewStore(st, redactor, redact.RawDrop)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, held, r, func(s *web.Server) { s.SetRedactor(redactor) })
+
+	resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json",
+		strings.NewReader(`{"to": ["shop@example.com"], "subject": "Order", "body": "Charge 4111 1111 1111 1111 please"}`))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /api/emails: status %d, want 201", resp.StatusCode)
+	}
+	body := "My card is 5500-0000-0000-0004."
+	raw := []byte("From: ann@example.com\r\nTo: me@example.com\r\nSubject: Card\r\n\r\n" + body)
+	inID, err := held.SaveInbound(t.Context(), "ann@example.com", []string{"me@example.com"}, "Card", body, raw, "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+
+	page := getBody(t, srv.webAddr)
+	if strings.Contains(page, "4111") || strings.Contains(page, "5500") {
+		t.Errorf("pending list shows a card number:\n%s", page)
+	}
+	if !strings.Contains(page, "[redacted:credit_card]") {
+		t.Errorf("pending list lacks the redaction marker:\n%s", page)
+	}
+
+	outID := extractID(page, "approve")
+	if outID == inID {
+		t.Fatal("expected the outbound email first")
+	}
+	for id, want := range map[string]string{
+		outID: "Charge [redacted:credit_card] please",
+		inID:  "was not stored",
+	} {
+		resp, err := http.Get("http://" + srv.webAddr + "/email/" + id + "/raw")
+		if err != nil {
+			t.Fatalf("GET raw: %v", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !strings.Contains(string(b), want) || strings.Contains(string(b), "4111 1111") {
+			t.Errorf("raw view of %s = %q, want it to contain %q", id, b, want)
+		}
+	}
+
+	postAction(t, srv.webAddr, inID, "approve")
+	emails := getAPIEmails(t, srv.apiAddr)
+	if len(emails) != 1 || emails[0]["body"] != "My card is [redacted:credit_card]." {
+		t.Errorf("GET /api/emails = %v, want the redacted body", emails)
+	}
+}
+
+// TestArchive: emails selected on the pending list, or named to
+// POST /api/emails/archive with an admin token, download as a zip of .eml
+// files and a metadata.json manifest with each file's SHA-256
+func TestArchive(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	manager := tokens.New(st)
+	admin, _, err := manager.Create(t.Context(), "legal", []string{tokens.ScopeAdmin}, 0, "test")
+	if err != nil {
+		t.Fatalf("create admin token: %v", err)
+	}
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetTokens(manager, false) })
+
+	raws := map[string]string{}
+	for _, subject := range []string{"Invoice", "Phishing"} {
+		raw := "From: ann@example.com\r\nTo: me@example.com\r\nSubject: " + subject + "\r\n\r\nBody of " + subject
+		id, err := st.SaveInbound(t.Context(), "ann@example.com", []string{"me@example.com"}, subject, "Body of "+subject, []byte(raw), "", "", "default")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+		raws[id] = raw
+	}
+	var ids []string
+	for id := range raws {
+		ids = append(ids, id)
+	}
+
+	readZip := func(resp *http.Response) map[string][]byte {
+		t.Helper()
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+			b, _ := io.ReadAll(resp.Body)
+			t.Fatalf("status %d (%s): %s", resp.StatusCode, resp.Header.Get("Content-Type"), b)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("read zip: %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatalf("open zip: %v", err)
+		}
+		files := map[string][]byte{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("open %s: %v", f.Name, err)
+			}
+			files[f.Name], _ = io.ReadAll(rc)
+			rc.Close()
+		}
+		return files
+	}
+
+	page := getBody(t, srv.webAddr)
+	if !strings.Contains(page, `form="archive"`) {
+		t.Errorf("pending list lacks selection checkboxes:\n%s", page)
+	}
+	resp, err := http.PostForm("http://"+srv.webAddr+"/archive", url.Values{"id": ids})
+	if err != nil {
+		t.Fatalf("POST /archive: %v", err)
+	}
+	files := readZip(resp)
+	if len(files) != 3 {
+		t.Errorf("zip has %d files, want 2 emails and metadata.json", len(files))
+	}
+	var manifest struct {
+		Emails []struct {
+			ID     string `json:"id"`
+			File   string `json:"file"`
+			SHA256 string `json:"sha256"`
+			Status string `json:"status"`
+		} `json:"emails"`
+	}
+	if err := json.Unmarshal(files["metadata.json"], &manifest); err != nil {
+		t.Fatalf("decode metadata.json: %v", err)
+	}
+	if len(manifest.Emails) != 2 {
+		t.Fatalf("manifest lists %d emails, want 2", len(manifest.Emails))
+	}
+	for _, e := range manifest.Emails {
+		if string(files[e.File]) != raws[e.ID] {
+			t.Errorf("%s = %q, want the raw message of %s", e.File, files[e.File], e.ID)
+		}
+		if sum := sha256.Sum256(files[e.File]); e.SHA256 != hex.EncodeToString(sum[:]) || e.Status != "pending" {
+			t.Errorf("manifest entry %+v, want the file's SHA-256 and status pending", e)
+		}
+	}
+
+	resp, err = http.PostForm("http://"+srv.webAddr+"/archive", url.Values{"id": {ids[0], "missing"}})
+	if err != nil {
+		t.Fatalf("POST /archive: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST /archive with an unknown ID: status %d, want 404", resp.StatusCode)
+	}
+
+	body := `{"ids": ["` + ids[1] + `"]}`
+	resp, err = http.Post("http://"+srv.apiAddr+"/api/emails/archive", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /api/emails/archive: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST /api/emails/archive without a token: status %d, want 401", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://"+srv.apiAddr+"/api/emails/archive", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /api/emails/archive: %v", err)
+	}
+	if files := readZip(resp); string(files[ids[1]+".eml"]) != raws[ids[1]] || len(files) != 2 {
+		t.Errorf("API zip = %v, want %s.eml and metadata.json", slices.Collect(maps.Keys(files)), ids[1])
+	}
+}
+
+// TestRawViewStreams: a large raw message is sent in chunks as it is read
+// from the store, and fetching approved mail still returns its body
+func TestRawViewStreams(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	body := strings.Repeat("0123456789abcdef", 3<<20/16)
+	raw := "From: ann@example.com\r\nTo: me@example.com\r\nSubject: Scan\r\n\r\n" + body
+	id, err := st.SaveInbound(t.Context(), "ann@example.com", []string{"me@example.com"}, "Scan", body, []byte(raw), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+
+	resp, err := http.Get("http://" + srv.webAddr + "/email/" + id + "/raw")
+	if err != nil {
+		t.Fatalf("GET raw: %v", err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("read raw: %v", err)
+	}
+	if string(b) != raw {
+		t.Errorf("raw view is %d bytes, want %d", len(b), len(raw))
+	}
+	if !slices.Contains(resp.TransferEncoding, "chunked") {
+		t.Errorf("raw view transfer encoding = %v, want chunked", resp.TransferEncoding)
+	}
+	if got := resp.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+
+	postAction(t, srv.webAddr, id, "approve")
+	emails := getAPIEmails(t, srv.apiAddr)
+	if len(emails) != 1 || emails[0]["body"] != body {
+		t.Errorf("GET /api/emails returned %d emails, want the approved one with its body", len(emails))
+	}
+}
+
+// TestForward: a reviewer forwards inbound mail to a colleague with
+// Resent-* headers, approving it first if it was pending; the forward is
+// recorded in the history and the email stays available to the API
+func TestForward(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+	srv := startTestServer(t, st, r)
+
+	raw := "From: bob@example.org\r\nTo: me@example.com\r\nSubject: Partnership\r\n\r\nLet's talk."
+	id, err := st.SaveInbound(t.Context(), "bob@example.org", []string{"me@example.com"}, "Partnership", "Let's talk.", []byte(raw), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	if page := getBody(t, srv.webAddr); !strings.Contains(page, "Approve &amp; forward") {
+		t.Error("pending list lacks the approve and forward action")
+	}
+
+	postActionForm(t, srv.webAddr, id, "forward", url.Values{"to": {"sales@example.com"}})
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("upstream received %d messages, want 1", len(msgs))
+	}
+	if msgs[0].From != "sender@example.com" || len(msgs[0].To) != 1 || msgs[0].To[0] != "sales@example.com" {
+		t.Errorf("forward envelope = %q -> %v, want sender@example.com -> sales@example.com", msgs[0].From, msgs[0].To)
+	}
+	if !strings.Contains(msgs[0].Data, "Resent-To: sales@example.com") || !strings.Contains(msgs[0].Data, raw) {
+		t.Errorf("forwarded data = %q, want Resent-* headers before the original message", msgs[0].Data)
+	}
+
+	// Already approved mail can be forwarded again from its detail page.
+	resp, err := http.Get("http://" + srv.webAddr + "/email/" + id)
+	if err != nil {
+		t.Fatalf("GET detail: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "/forward") {
+		t.Errorf("detail page of approved inbound mail lacks the forward action:\n%s", b)
+	}
+	postActionForm(t, srv.webAddr, id, "forward", url.Values{"to": {"legal@example.com"}})
+	if n := len(upstream.getReceived()); n != 2 {
+		t.Errorf("upstream received %d messages, want 2", n)
+	}
+
+	resp, err = http.PostForm("http://"+srv.webAddr+"/email/"+id+"/forward", url.Values{"to": {"not an address"}})
+	if err != nil {
+		t.Fatalf("POST forward: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forward to an invalid address: status %d, want 400", resp.StatusCode)
+	}
+
+	decisions, err := st.ListDecisions(t.Context(), 10)
+	if err != nil {
+		t.Fatalf("list decisions: %v", err)
+	}
+	var got []string
+	for _, d := range decisions {
+		got = append(got, d.Decision+" "+d.ForwardedTo)
+	}
+	if want := []string{"forwarded legal@example.com", "forwarded sales@example.com", "approved "}; !slices.Equal(got, want) {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+	if emails := getAPIEmails(t, srv.apiAddr); len(emails) != 1 {
+		t.Errorf("GET /api/emails returned %d emails, want the forwarded one", len(emails))
+	}
+}
+
+// TestJobQueue: a forward made while the relay is down is kept as a job,
+// shown on the jobs page with its error, and can be retried or discarded
+func TestJobQueue(t *testing.T) {
+	st := newTestStore(t)
+	downHost, downPortStr, _ := net.SplitHostPort(freeAddr(t)) // nothing listens here
+	var downPort int
+	fmt.Sscanf(downPortStr, "%d", &downPort)
+	srv := startTestServer(t, st, relay.New(downHost, downPort, "", "", false))
+
+	id, err := st.SaveInbound(t.Context(), "bob@example.org", []string{"me@example.com"}, "Invoice", "Attached.",
+		[]byte("From: bob@example.org\r\nSubject: Invoice\r\n\r\nAttached."), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	postActionForm(t, srv.webAddr, id, "forward", url.Values{"to": {"accounts@example.com"}})
+
+	jobs, err := st.ListJobs(t.Context())
+	if err != nil {
+		t.Fatalf("list jobs: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].Kind != "relay" || jobs[0].EmailID != id || jobs[0].Status != store.JobPending || jobs[0].LastError == "" {
+		t.Fatalf("jobs = %+v, want one pending relay job with the relay error", jobs)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	for _, d := range decisions {
+		if d.Decision == store.DecisionForwarded {
+			t.Errorf("forward recorded in the history before it was relayed: %+v", d)
+		}
+	}
+
+	resp, err := http.Get("http://" + srv.webAddr + "/jobs")
+	if err != nil {
+		t.Fatalf("GET /jobs: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{"relay", id, "pending", jobs[0].LastError, "/jobs/" + jobs[0].ID + "/retry"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("jobs page lacks %q", want)
+		}
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, action := range []string{"retry", "discard"} {
+		resp, err := noRedirect.PostForm("http://"+srv.webAddr+"/jobs/"+jobs[0].ID+"/"+action, nil)
+		if err != nil {
+			t.Fatalf("POST %s: %v", action, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("%s job: status %d, want 303", action, resp.StatusCode)
+		}
+	}
+	if jobs, _ := st.ListJobs(t.Context()); len(jobs) != 0 {
+		t.Errorf("jobs = %+v, want none after discarding", jobs)
+	}
+}
+
+// TestSendingWindows: approved outbound mail matching a closed sending window
+// is scheduled and relayed by a send job; other mail is relayed at once
+func TestSendingWindows(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+
+	// A one-hour window opening two hours from now is closed.
+	now := time.Now().UTC()
+	opens := time.Duration((now.Hour()+2)%24) * time.Hour
+	windows, err := window.New([]window.Window{{
+		Name: "germany", Recipient: "*@example.de", Start: opens, End: opens + time.Hour, Location: time.UTC,
+	}})
+	if err != nil {
+		t.Fatalf("new windows: %v", err)
+	}
+	q := jobs.New(st)
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false), func(s *web.Server) {
+		s.SetJobs(q)
+		s.SetWindows(windows)
+	})
+
+	postAPIEmail(t, srv.apiAddr, "kunde@example.de", "Angebot", "Hallo.")
+	postAPIEmail(t, srv.apiAddr, "client@example.com", "Offer", "Hello.")
+	pending, err := st.ListPending(t.Context())
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("pending = %d emails (%v), want 2", len(pending), err)
+	}
+	var heldID string
+	for _, e := range pending {
+		postAction(t, srv.webAddr, e.ID, "approve")
+		if e.Subject == "Angebot" {
+			heldID = e.ID
+		}
+	}
+
+	msgs := upstream.getReceived()
+	if len(msgs) != 1 || !strings.Contains(msgs[0].Data, "Subject: Offer") {
+		t.Fatalf("upstream got %d messages, want only the mail outside any window", len(msgs))
+	}
+	held, err := st.Get(t.Context(), heldID)
+	if err != nil {
+		t.Fatalf("get scheduled email: %v", err)
+	}
+	if held.Status != store.StatusScheduled || held.ScheduledAt.Hour() != int(opens/time.Hour) || !held.ScheduledAt.After(now) {
+		t.Errorf("held email: status %q, scheduled at %v; want scheduled at the next %s", held.Status, held.ScheduledAt, opens)
+	}
+	body := getBody(t, srv.webAddr)
+	if !strings.Contains(body, "Scheduled") || !strings.Contains(body, "Angebot") {
+		t.Errorf("index does not list the scheduled email")
+	}
+	if decisions, _ := st.ListDecisions(t.Context(), 10); len(decisions) != 1 {
+		t.Errorf("decisions = %+v, want only the relayed email's before the window opens", decisions)
+	}
+
+	list, err := q.List(t.Context())
+	if err != nil || len(list) != 1 || list[0].Kind != jobs.KindSend || list[0].EmailID != heldID {
+		t.Fatalf("jobs = %+v (%v), want one send job for the held email", list, err)
+	}
+	if !list[0].RunAt.Equal(held.ScheduledAt) {
+		t.Errorf("send job runs at %v, want %v", list[0].RunAt, held.ScheduledAt)
+	}
+	// Retrying the job sends the email without waiting for the window.
+	if err := q.Retry(t.Context(), list[0].ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run due: %v", err)
+	}
+	msgs = upstream.getReceived()
+	if len(msgs) != 2 || !strings.Contains(msgs[1].Data, "Subject: Angebot") {
+		t.Fatalf("upstream got %d messages, want the scheduled email relayed", len(msgs))
+	}
+	if _, err := st.Get(t.Context(), heldID); err == nil {
+		t.Error("scheduled email still stored after it was sent")
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	if len(decisions) != 2 || decisions[0].EmailID != heldID || decisions[0].Decision != store.DecisionApproved {
+		t.Errorf("decisions = %+v, want the scheduled email's approval recorded once sent", decisions)
+	}
+}
+
+// TestSendingWindowsAutoApproved: mail an approve rule lets through over the
+// API is scheduled like reviewed mail while its sending window is closed
+func TestSendingWindowsAutoApproved(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+
+	// A one-hour window opening two hours from now is closed.
+	now := time.Now().UTC()
+	opens := time.Duration((now.Hour()+2)%24) * time.Hour
+	windows, err := window.New([]window.Window{{
+		Name: "germany", Recipient: "*@example.de", Start: opens, End: opens + time.Hour, Location: time.UTC,
+	}})
+	if err != nil {
+		t.Fatalf("new windows: %v", err)
+	}
+	engine, err := rules.New([]rules.Rule{{Name: "customers", Action: rules.ActionApprove}})
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	q := jobs.New(st)
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false), func(s *web.Server) {
+		s.SetJobs(q)
+		s.SetWindows(windows)
+		s.SetRules(engine)
+	})
+
+	submit := func(to, subject string) (string, string) {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{to}, "subject": subject, "body": "Hallo."})
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /api/emails: status %d, want 201", resp.StatusCode)
+		}
+		var result struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return result.ID, result.Status
+	}
+	if _, status := submit("client@example.com", "Offer"); status != "sent" {
+		t.Errorf("submit outside any window: status %q, want sent", status)
+	}
+	id, status := submit("kunde@example.de", "Angebot")
+	if status != store.StatusScheduled {
+		t.Fatalf("submit in a closed window: status %q, want scheduled", status)
+	}
+	if msgs := upstream.getReceived(); len(msgs) != 1 || !strings.Contains(msgs[0].Data, "Subject: Offer") {
+		t.Fatalf("upstream got %d messages, want only the mail outside any window", len(msgs))
+	}
+	held, err := st.Get(t.Context(), id)
+	if err != nil {
+		t.Fatalf("get scheduled email: %v", err)
+	}
+	if held.Status != store.StatusScheduled || held.ApprovedBy != "rule:customers" || held.ScheduledAt.Hour() != int(opens/time.Hour) {
+		t.Errorf("held email: status %q by %q at %v; want scheduled by rule:customers at the next %s", held.Status, held.ApprovedBy, held.ScheduledAt, opens)
+	}
+
+	list, err := q.List(t.Context())
+	if err != nil || len(list) != 1 || list[0].Kind != jobs.KindSend || list[0].EmailID != id {
+		t.Fatalf("jobs = %+v (%v), want one send job for the held email", list, err)
+	}
+	if err := q.Retry(t.Context(), list[0].ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run due: %v", err)
+	}
+	if msgs := upstream.getReceived(); len(msgs) != 2 || !strings.Contains(msgs[1].Data, "Subject: Angebot") {
+		t.Fatalf("upstream got %d messages, want the scheduled email relayed", len(msgs))
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	if len(decisions) != 2 || decisions[0].EmailID != id || decisions[0].Reviewer != "rule:customers" {
+		t.Errorf("decisions = %+v, want the rule's approval recorded once sent", decisions)
+	}
+}
+
+// TestRelayThrottle: approvals beyond the relay's rate limit are scheduled
+// for when it allows them instead of being relayed at once
+func TestRelayThrottle(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+
+	throttle, err := relay.NewThrottle(relay.New(upHost, upPort, "", "", false), 1, 0)
+	if err != nil {
+		t.Fatalf("new throttle: %v", err)
+	}
+	q := jobs.New(st)
+	srv := startTestServer(t, st, throttle, func(s *web.Server) {
+		s.SetJobs(q)
+		s.SetThrottle(throttle)
+	})
+
+	postAPIEmail(t, srv.apiAddr, "a@example.com", "First", "Hello.")
+	postAPIEmail(t, srv.apiAddr, "b@example.com", "Second", "Hello.")
+	pending, err := st.ListPending(t.Context())
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("pending = %d emails (%v), want 2", len(pending), err)
+	}
+	for _, e := range pending {
+		postAction(t, srv.webAddr, e.ID, "approve")
+	}
+
+	if msgs := upstream.getReceived(); len(msgs) != 1 {
+		t.Fatalf("upstream got %d messages, want one within the limit", len(msgs))
+	}
+	scheduled, err := st.ListScheduled(t.Context())
+	if err != nil || len(scheduled) != 1 {
+		t.Fatalf("scheduled = %d emails (%v), want the one over the limit", len(scheduled), err)
+	}
+	held := scheduled[0]
+	if wait := time.Until(held.ScheduledAt); wait <= 0 || wait > time.Minute {
+		t.Errorf("scheduled at %v, want within the next minute", held.ScheduledAt)
+	}
+	if body := getBody(t, srv.webAddr); !strings.Contains(body, "Relay rate limit reached") || !strings.Contains(body, "1 of 1 messages sent in the last minute") {
+		t.Errorf("index does not show the throttle")
+	}
+
+	// Run early, the send job finds the relay still throttled and leaves a
+	// new job for later rather than failing.
+	list, err := q.List(t.Context())
+	if err != nil || len(list) != 1 || list[0].EmailID != held.ID {
+		t.Fatalf("jobs = %+v (%v), want one send job for the held email", list, err)
+	}
+	first := list[0].ID
+	if err := q.Retry(t.Context(), first); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run due: %v", err)
+	}
+	if msgs := upstream.getReceived(); len(msgs) != 1 {
+		t.Errorf("upstream got %d messages, want the held email still waiting", len(msgs))
+	}
+	list, _ = q.List(t.Context())
+	if len(list) != 1 || list[0].ID == first || list[0].Attempts != 0 || list[0].Status != store.JobPending {
+		t.Errorf("jobs = %+v, want a fresh pending send job", list)
+	}
+	if email, err := st.Get(t.Context(), held.ID); err != nil || email.Status != store.StatusScheduled {
+		t.Errorf("held email = %+v (%v), want still scheduled", email, err)
+	}
+}
+
+// TestAllowSender: "approve & always allow" approves the email and adds an
+// allow rule that lets later mail from the sender skip review
+func TestAllowSender(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	st := newTestStore(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	r := relay.New(upHost, upPort, "", "", false)
+	book := contacts.New(st, 0)
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetContacts(book) })
+
+	id, err := st.SaveInbound(t.Context(), "Bob@example.org", []string{"me@example.com"}, "Hello", "hi", []byte("Subject: Hello\r\n\r\nhi"), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	resp, err := http.Get("http://" + srv.webAddr + "/email/" + id)
+	if err != nil {
+		t.Fatalf("GET detail: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "always allow this sender") {
+		t.Fatalf("detail page lacks the allow action:\n%s", b)
+	}
+
+	postActionForm(t, srv.webAddr, id, "allow", nil)
+	if e, err := st.GetSummary(t.Context(), id); err != nil || e.Status != store.StatusApproved {
+		t.Errorf("email after allow = %+v, %v; want approved", e, err)
+	}
+	if got, _ := book.Approver(t.Context(), store.DirectionInbound, "bob@example.org", nil); got != contacts.AllowReviewer {
+		t.Errorf("approver of bob's next email = %q, want the allowlist", got)
+	}
+	if got, _ := book.Approver(t.Context(), store.DirectionOutbound, "bob@example.org", []string{"x@example.com"}); got != "" {
+		t.Errorf("outbound approver = %q, want the rule scoped to inbound", got)
+	}
+
+	// Outbound API mail is sent as the relay account, so allowing it lets the
+	// next submission through at once.
+	send := func(subject string) map[string]any {
+		t.Helper()
+		b, _ := json.Marshal(map[string]any{"to": []string{"friend@example.com"}, "subject": subject, "body": "hi"})
+		resp, err := http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("POST /api/emails: %v", err)
+		}
+		defer resp.Body.Close()
+		var result map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return result
+	}
+	first := send("First")
+	if first["status"] != "pending" {
+		t.Fatalf("first status = %v, want pending", first["status"])
+	}
+	postActionForm(t, srv.webAddr, first["id"].(string), "allow", nil)
+	if result := send("Second"); result["status"] != "sent" {
+		t.Errorf("second status = %v, want sent by the allow rule", result["status"])
+	}
+	if n := len(upstream.getReceived()); n != 2 {
+		t.Errorf("upstream received %d messages, want 2", n)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 1)
+	if len(decisions) != 1 || decisions[0].Reviewer != contacts.AllowReviewer {
+		t.Errorf("latest decision = %+v, want approval by the allowlist", decisions)
+	}
+
+	resp, err = http.Get("http://" + srv.webAddr + "/rules")
+	if err != nil {
+		t.Fatalf("GET /rules: %v", err)
+	}
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "bob@example.org") || !strings.Contains(string(b), "sender@example.com") {
+		t.Errorf("rules page lacks the allowed senders:\n%s", b)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.PostForm("http://"+srv.webAddr+"/rules/delete", url.Values{"direction": {"inbound"}, "sender": {"bob@example.org"}})
+	if err != nil {
+		t.Fatalf("POST /rules/delete: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("delete rule: status %d, want 303", resp.StatusCode)
+	}
+	if rules, _ := st.ListAllowRules(t.Context()); len(rules) != 1 || rules[0].Direction != store.DirectionOutbound {
+		t.Errorf("rules = %+v, want only the outbound one left", rules)
+	}
+
+	audit, _ := st.ListAudit(t.Context(), 10)
+	var actions []string
+	for _, e := range audit {
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, " "); got != "allow.delete allow.create allow.create" {
+		t.Errorf("audit actions = %q", got)
+	}
+}
+
+// TestBlockSender: "reject & block" rejects the email and adds a block rule
+// that rejects later mail from the sender, counted on the stats page
+func TestBlockSender(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	book := contacts.New(st, 0)
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetContacts(book) })
+
+	id, err := st.SaveInbound(t.Context(), "eve@spam.example", []string{"me@example.com"}, "Win", "hi", []byte("Subject: Win\r\n\r\nhi"), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	resp, err := http.Get("http://" + srv.webAddr + "/email/" + id)
+	if err != nil {
+		t.Fatalf("GET detail: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "Reject &amp; block") || !strings.Contains(string(b), "anyone at spam.example") {
+		t.Fatalf("detail page lacks the block action:\n%s", b)
+	}
+
+	postActionForm(t, srv.webAddr, id, "block", url.Values{"scope": {"domain"}})
+	if _, err := st.GetSummary(t.Context(), id); err == nil {
+		t.Error("blocked email is still held")
+	}
+	if got, _ := book.Blocked(t.Context(), store.DirectionInbound, "mallory@spam.example"); got != "spam.example" {
+		t.Errorf("rule matching another address at the domain = %q, want spam.example", got)
+	}
+
+	// Block outbound API mail from the relay account on the rules page.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.PostForm("http://"+srv.webAddr+"/rules", url.Values{"kind": {"block"}, "direction": {"outbound"}, "sender": {"sender@example.com"}})
+	if err != nil {
+		t.Fatalf("POST /rules: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("add rule: status %d, want 303", resp.StatusCode)
+	}
+	body, _ := json.Marshal(map[string]any{"to": []string{"friend@example.com"}, "subject": "Hi", "body": "hi"})
+	resp, err = http.Post("http://"+srv.apiAddr+"/api/emails", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /api/emails: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("blocked submission: status %d, want 403", resp.StatusCode)
+	}
+
+	resp, err = http.Get("http://" + srv.webAddr + "/stats")
+	if err != nil {
+		t.Fatalf("GET /stats: %v", err)
+	}
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(b), "2 emails rejected by") {
+		t.Errorf("stats page lacks the suppressed count:\n%s", b)
+	}
+
+	resp, err = client.PostForm("http://"+srv.webAddr+"/rules/delete", url.Values{"kind": {"block"}, "direction": {"inbound"}, "sender": {"spam.example"}})
+	if err != nil {
+		t.Fatalf("POST /rules/delete: %v", err)
+	}
+	resp.Body.Close()
+	if rules, _ := st.ListBlockRules(t.Context()); resp.StatusCode != http.StatusSeeOther || len(rules) != 1 {
+		t.Errorf("delete rule: status %d, rules %+v; want only the outbound rule left", resp.StatusCode, rules)
+	}
+	audit, _ := st.ListAudit(t.Context(), 10)
+	var actions []string
+	for _, e := range audit {
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, " "); got != "block.delete block.create block.create" {
+		t.Errorf("audit actions = %q", got)
+	}
+}
+
+// TestAPIVersions: the API is served under /api/v1/ and the legacy /api/
+// paths, while v2 stays dark until enabled and then uses error objects and
+// pagination envelopes
+func TestAPIVersions(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false)
+	dark := startTestServer(t, st, r)
+
+	get := func(srv testServer, path, version string) (*http.Response, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+srv.apiAddr+path, nil)
+		if version != "" {
+			req.Header.Set(web.VersionHeader, version)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, b
+	}
+
+	for _, path := range []string{"/api/v1/emails/pending/count", "/api/emails/pending/count"} {
+		resp, _ := get(dark, path, "")
+		if resp.StatusCode != http.StatusOK || resp.Header.Get(web.VersionHeader) != "1" {
+			t.Errorf("GET %s: status %d, version %q; want 200 served as v1", path, resp.StatusCode, resp.Header.Get(web.VersionHeader))
+		}
+	}
+	if resp, _ := get(dark, "/api/v2/emails/pending/count", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("v2 while dark: status %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := get(dark, "/api/emails/pending/count", "2"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("asking for v2 while dark: status %d, want 400", resp.StatusCode)
+	}
+
+	srv := startTestServer(t, st, r, func(s *web.Server) { s.SetAPIV2(true) })
+	for i := range 3 {
+		id, err := st.SaveInbound(t.Context(), "bob@example.org", []string{"me@example.com"}, fmt.Sprintf("Mail %d", i), "hi", []byte("Subject: hi\r\n\r\nhi"), "", "", "default")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+		if err := st.Approve(t.Context(), id, "alice", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+	}
+	var page struct {
+		Data    []map[string]any `json:"data"`
+		HasMore bool             `json:"has_more"`
+	}
+	resp, b := get(srv, "/api/v2/emails?limit=2", "")
+	if err := json.Unmarshal(b, &page); err != nil || resp.Header.Get(web.VersionHeader) != "2" {
+		t.Fatalf("v2 emails = %s, version %q: %v", b, resp.Header.Get(web.VersionHeader), err)
+	}
+	if len(page.Data) != 2 || !page.HasMore {
+		t.Errorf("first page = %+v, want two emails and more to come", page)
+	}
+	_, b = get(srv, "/api/emails", "2") // negotiated on the legacy path
+	page.Data, page.HasMore = nil, true
+	if err := json.Unmarshal(b, &page); err != nil || len(page.Data) != 1 || page.HasMore {
+		t.Errorf("second page = %s, want the last email: %v", b, err)
+	}
+
+	resp, b = get(srv, "/api/v2/emails?wait=soon", "")
+	var apiErr struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &apiErr); err != nil || resp.StatusCode != http.StatusBadRequest || apiErr.Error.Code != "invalid_request" || apiErr.Error.Message == "" {
+		t.Errorf("v2 error = %d %s, want an invalid_request error object", resp.StatusCode, b)
+	}
+	if resp, b := get(srv, "/api/v1/emails?wait=soon", ""); resp.StatusCode != http.StatusBadRequest || strings.HasPrefix(string(b), "{") {
+		t.Errorf("v1 error = %d %s, want plain text", resp.StatusCode, b)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	st := newTestStore(t)
+	srv := startTestServer(t, st, relay.New("127.0.0.1", 1, "", "", false)) // unused for inbound
+
+	raw := "From: bob@example.org\r\nTo: me@example.com\r\nSubject: Newsletter\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/related; boundary=rel\r\n\r\n" +
+		"--rel\r\nContent-Type: text/html\r\n\r\n<p>Hi</p><img src=\"cid:logo@example.org\"><img src=\"https://tracker.example/p.gif\">\r\n" +
+		"--rel\r\nContent-Type: image/png\r\nContent-Id: <logo@example.org>\r\nContent-Transfer-Encoding: base64\r\n\r\niVBORw0K\r\n" +
+		"--rel--\r\n" +
+		"--outer\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=invoice.pdf\r\n\r\n%PDF-1.4\r\n" +
+		"--outer--\r\n"
+	id, err := st.SaveInbound(t.Context(), "bob@example.org", []string{"me@example.com"}, "Newsletter", "Hi", []byte(raw), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	fetch := func(path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	_, page := fetch("/email/" + id)
+	for _, want := range []string{"invoice.pdf", "application/pdf", "image/png", "/email/" + id + "/attachments/1", "/email/" + id + "/html"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("detail page lacks %q", want)
+		}
+	}
+
+	resp, html := fetch("/email/" + id + "/html")
+	if !strings.Contains(html, `src="/email/`+id+`/attachments/0"`) {
+		t.Errorf("HTML view = %q, want the cid: image pointed at the attachment", html)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.HasPrefix(csp, "sandbox") || !strings.Contains(csp, "img-src 'self'") {
+		t.Errorf("HTML view policy = %q, want sandboxed with same-origin images only", csp)
+	}
+
+	resp, body := fetch("/email/" + id + "/attachments/0")
+	if resp.Header.Get("Content-Type") != "image/png" || !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "inline") || body != "\x89PNG\r\n" {
+		t.Errorf("inline image = %s %q %q", resp.Header.Get("Content-Type"), resp.Header.Get("Content-Disposition"), body)
+	}
+	resp, body = fetch("/email/" + id + "/attachments/1")
+	if resp.Header.Get("Content-Disposition") != "attachment; filename=invoice.pdf" || body != "%PDF-1.4" {
+		t.Errorf("download = %q %q, want invoice.pdf as an attachment", resp.Header.Get("Content-Disposition"), body)
+	}
+	if resp, _ := fetch("/email/" + id + "/attachments/2"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing attachment: status %d, want 404", resp.StatusCode)
+	}
+}
+
+// TestRemoteContent: remote content in the HTML view is blocked unless a
+// reviewer loads it, and tracking pixels are flagged, or stripped with
+// SetStripTrackers.
+func TestRemoteContent(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false) // unused for inbound
+	srv := startTestServer(t, st, r)
+	stripping := startTestServer(t, st, r, func(s *web.Server) { s.SetStripTrackers(true) })
+
+	raw := "From: news@example.org\r\nTo: me@example.com\r\nSubject: Offers\r\nContent-Type: text/html\r\n\r\n" +
+		`<p style="background: url('https://cdn.example.org/bg.png')">Offers</p>` +
+		`<img src="https://cdn.example.org/banner.png"><img src="https://t.example.net/open.gif" width="1" height="1">` + "\r\n"
+	id, err := st.SaveInbound(t.Context(), "news@example.org", []string{"me@example.com"}, "Offers", "Offers", []byte(raw), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	fetch := func(addr, path string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	_, page := fetch(srv.webAddr, "/email/"+id)
+	for _, want := range []string{"1 tracking pixel", "Remote content is blocked (3).", "/email/" + id + "?remote=1", `src="/email/` + id + `/html"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("detail page lacks %q", want)
+		}
+	}
+	resp, html := fetch(srv.webAddr, "/email/"+id+"/html")
+	if csp := resp.Header.Get("Content-Security-Policy"); strings.Contains(csp, "https:") || !strings.Contains(html, "t.example.net/open.gif") {
+		t.Errorf("HTML view policy = %q, want remote content blocked and the pixel flagged only", csp)
+	}
+
+	_, page = fetch(srv.webAddr, "/email/"+id+"?remote=1")
+	if !strings.Contains(page, `src="/email/`+id+`/html?remote=1"`) || !strings.Contains(page, "Remote content is loaded.") {
+		t.Errorf("detail page with remote content does not load it")
+	}
+	resp, _ = fetch(srv.webAddr, "/email/"+id+"/html?remote=1")
+	if csp := resp.Header.Get("Content-Security-Policy"); !strings.HasPrefix(csp, "sandbox") || !strings.Contains(csp, "img-src 'self' data: https:") || resp.Header.Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("HTML view with remote content: policy %q, referrer policy %q", csp, resp.Header.Get("Referrer-Policy"))
+	}
+
+	_, page = fetch(stripping.webAddr, "/email/"+id)
+	if !strings.Contains(page, "1 tracking pixel") || !strings.Contains(page, "Tracking pixels are removed.") {
+		t.Errorf("detail page when stripping lacks the tracker count or note")
+	}
+	_, html = fetch(stripping.webAddr, "/email/"+id+"/html?remote=1")
+	if strings.Contains(html, "open.gif") || !strings.Contains(html, "banner.png") {
+		t.Errorf("HTML view when stripping = %q, want the pixel removed and the banner kept", html)
+	}
+}
+
+func TestLanguageAndTimezone(t *testing.T) {
+	st := newTestStore(t)
+	r := relay.New("127.0.0.1", 1, "", "", false) // unused for inbound
+	srv := startTestServer(t, st, r, func(s *web.Server) {
+		if err := s.SetLocale("", "America/New_York"); err != nil {
+			t.Fatalf("set locale: %v", err)
+		}
+	})
+	id, err := st.SaveInbound(t.Context(), "bob@example.org", []string{"me@example.com"}, "Hola", "Hi", []byte("Subject: Hola\r\n\r\nHi\r\n"), "", "", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	email, err := st.Get(t.Context(), id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	fetch := func(header http.Header, cookies ...*http.Cookie) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://"+srv.webAddr+"/email/"+id, nil)
+		maps.Copy(req.Header, header)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET detail: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	newYork, _ := time.LoadLocation("America/New_York")
+	page := fetch(http.Header{"Accept-Language": {"de-DE,de;q=0.9"}})
+	for _, want := range []string{`lang="de"`, ">Freigeben<", email.ReceivedAt.In(newYork).Format("2006-01-02 15:04:05 MST")} {
+		if !strings.Contains(page, want) {
+			t.Errorf("German page lacks %q", want)
+		}
+	}
+
+	resp, err := client.PostForm("http://"+srv.webAddr+"/preferences", url.Values{"language": {"fr"}, "timezone": {"Asia/Tokyo"}})
+	if err != nil {
+		t.Fatalf("POST preferences: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 2 {
+		t.Fatalf("save preferences: status %d, cookies %v", resp.StatusCode, resp.Cookies())
+	}
+	page = fetch(http.Header{"Accept-Language": {"de"}}, resp.Cookies()...)
+	for _, want := range []string{`lang="fr"`, ">Approuver<", email.ReceivedAt.UTC().Add(9*time.Hour).Format("2006-01-02 15:04:05") + " JST"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page with preferences lacks %q", want)
+		}
+	}
+
+	resp, err = client.PostForm("http://"+srv.webAddr+"/preferences", url.Values{"timezone": {"Mars/Olympus"}})
+	if err != nil {
+		t.Fatalf("POST preferences: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(resp.Cookies()) != 0 || !strings.Contains(string(b), "Unknown timezone") {
+		t.Errorf("unknown timezone: cookies %v, page %q", resp.Cookies(), b)
+	}
+}
+
+// TestStatusViews: the index page's tabs and GET /api/emails?status= list
+// mail in every status, from pending to sent, rejected and bounced, without
+// consuming any of it
+func TestStatusViews(t *testing.T) {
+	upstream := startUpstreamSMTP(t)
+	upHost, upPortStr, _ := net.SplitHostPort(upstream.addr)
+	var upPort int
+	fmt.Sscanf(upPortStr, "%d", &upPort)
+	st := newTestStore(t)
+	srv := startTestServer(t, st, relay.New(upHost, upPort, "", "", false))
+
+	postAPIEmail(t, srv.apiAddr, "ops@example.com", "Still Pending", "1")
+	postAction(t, srv.webAddr, postAPIEmail(t, srv.apiAddr, "ops@example.com", "Went Out", "2"), "approve")
+	postAction(t, srv.webAddr, postAPIEmail(t, srv.apiAddr, "ops@example.com", "Turned Down", "3"), "reject")
+	inbound, err := st.SaveInbound(t.Context(), "external@example.com", []string{"me@example.com"}, "Awaiting Fetch", "4",
+		[]byte("Subject: Awaiting Fetch\r\n\r\n4"), "<m4@example.com>", "mailescrow/received", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	postAction(t, srv.webAddr, inbound, "approve")
+	if err := st.RecordDecision(t.Context(), store.Decision{
+		EmailID: "gone", Direction: store.DirectionOutbound, Subject: "Came Back", Decision: store.DecisionApproved, Reviewer: "alice", EnvelopeID: "env-1",
+	}); err != nil {
+		t.Fatalf("record decision: %v", err)
+	}
+	if err := st.UpdateDelivery(t.Context(), "env-1", store.DeliveryFailed, "ops@example.com failed (5.1.1)"); err != nil {
+		t.Fatalf("update delivery: %v", err)
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + srv.webAddr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	for status, want := range map[string]string{
+		"":          "Still Pending",
+		"approved":  "Awaiting Fetch",
+		"sent":      "Went Out",
+		"rejected":  "Turned Down",
+		"bounced":   "Came Back",
+		"scheduled": "No emails.",
+	} {
+		page := get("/?status=" + status)
+		if !strings.Contains(page, want) {
+			t.Errorf("status %q tab missing %q", status, want)
+		}
+		for _, other := range []string{"Still Pending", "Awaiting Fetch", "Went Out", "Turned Down", "Came Back"} {
+			if other != want && strings.Contains(page, other) {
+				t.Errorf("status %q tab lists %q", status, other)
+			}
+		}
+	}
+	if page := get("/?status=approved"); strings.Contains(page, "/"+inbound+"/approve") || !strings.Contains(page, `class="active">Approved</a>`) {
+		t.Errorf("approved tab should be active and offer no approval")
+	}
+
+	subjects := func(query string) string {
+		t.Helper()
+		var got []string
+		for _, e := range getAPIEmailsQuery(t, srv.apiAddr, query) {
+			got = append(got, fmt.Sprintf("%s:%s", e["status"], e["subject"]))
+		}
+		return strings.Join(got, ",")
+	}
+	for status, want := range map[string]string{
+		"pending":  "pending:Still Pending",
+		"approved": "approved:Awaiting Fetch",
+		"sent":     "sent:Went Out",
+		"rejected": "rejected:Turned Down",
+		"bounced":  "bounced:Came Back",
+	} {
+		if got := subjects("?status=" + status); got != want {
+			t.Errorf("status=%s = %q, want %q", status, got, want)
+		}
+	}
+	if emails := getAPIEmails(t, srv.apiAddr); len(emails) != 1 || emails[0]["subject"] != "Awaiting Fetch" {
+		t.Errorf("fetch after listing approved mail = %v, want it still there", emails)
+	}
+	for _, query := range []string{"?status=relaying", "?status=pending&wait=1s", "?status=sent&queue=default"} {
+		resp, err := http.Get("http://" + srv.apiAddr + "/api/emails" + query)
+		if err != nil {
+			t.Fatalf("GET /api/emails%s: %v", query, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /api/emails%s: status %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
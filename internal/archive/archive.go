@@ -0,0 +1,203 @@
+// Package archive writes every message mailescrow decides on (approved,
+// rejected or forwarded) to mbox files or Maildir directories on disk, so
+// there is a record that can be searched with grep or opened in a mail
+// client, independent of the database. Archiving never blocks a decision:
+// failures are logged and counted.
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Formats.
+const (
+	FormatMbox    = "mbox"    // one mboxrd file per period, <period>.mbox
+	FormatMaildir = "maildir" // one Maildir per period, <period>/{tmp,new,cur}
+)
+
+// Rotations: how often a new file or Maildir is started, by the UTC date of
+// the decision.
+const (
+	RotateDaily   = "daily"   // 2006-01-02
+	RotateMonthly = "monthly" // 2006-01
+	RotateNever   = "never"   // archive.mbox, or the archive directory itself
+)
+
+// Archive writes decided-on messages under a directory.
+type Archive struct {
+	format string
+	dir    string
+	rotate string
+	host   string
+	now    func() time.Time
+
+	mu sync.Mutex // serializes appends to mbox files
+}
+
+// New creates an Archive writing format files under dir, starting a new one
+// as rotate says. dir is created if it does not exist.
+func New(format, dir, rotate string) (*Archive, error) {
+	if format != FormatMbox && format != FormatMaildir {
+		return nil, fmt.Errorf("format %q (want %s or %s)", format, FormatMbox, FormatMaildir)
+	}
+	if rotate == "" {
+		rotate = RotateMonthly
+	}
+	if rotate != RotateDaily && rotate != RotateMonthly && rotate != RotateNever {
+		return nil, fmt.Errorf("rotate %q (want %s, %s or %s)", rotate, RotateDaily, RotateMonthly, RotateNever)
+	}
+	if dir == "" {
+		return nil, errors.New("path is required")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create %s: %w", dir, err)
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	// Maildir file names use "/" and ":" as separators.
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return &Archive{format: format, dir: dir, rotate: rotate, host: host, now: time.Now}, nil
+}
+
+// Write archives the message d was made on, with headers recording the
+// decision. Decisions without a raw message are skipped.
+func (a *Archive) Write(d store.Decision) error {
+	if len(d.RawMessage) == 0 {
+		return nil
+	}
+	at := d.DecidedAt
+	if at.IsZero() {
+		at = a.now()
+	}
+	at = at.UTC()
+	msg := annotate(d, at)
+	if a.format == FormatMaildir {
+		return a.writeMaildir(at, msg)
+	}
+	return a.writeMbox(d.Sender, at, msg)
+}
+
+func (a *Archive) period(at time.Time) string {
+	switch a.rotate {
+	case RotateDaily:
+		return at.Format("2006-01-02")
+	case RotateMonthly:
+		return at.Format("2006-01")
+	default:
+		return ""
+	}
+}
+
+// annotate prepends X-Mailescrow-* headers recording the decision to the raw
+// message.
+func annotate(d store.Decision, at time.Time) []byte {
+	var buf bytes.Buffer
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, strings.NewReplacer("\r", " ", "\n", " ").Replace(value))
+		}
+	}
+	field("X-Mailescrow-Decision", d.Decision)
+	field("X-Mailescrow-Reviewer", d.Reviewer)
+	field("X-Mailescrow-Direction", d.Direction)
+	field("X-Mailescrow-Email-Id", d.EmailID)
+	field("X-Mailescrow-Forwarded-To", d.ForwardedTo)
+	field("X-Mailescrow-Decided-At", at.Format(time.RFC1123Z))
+	buf.Write(d.RawMessage)
+	return buf.Bytes()
+}
+
+// fromLine matches body lines mboxrd quotes with one more ">".
+var fromLine = regexp.MustCompile(`(?m)^(>*From )`)
+
+// writeMbox appends msg to the period's mboxrd file, with LF line endings.
+func (a *Archive) writeMbox(sender string, at time.Time, msg []byte) error {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", strings.ReplaceAll(sender, " ", ""), at.Format(time.ANSIC))
+	buf.Write(fromLine.ReplaceAll(msg, []byte(">$1")))
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	name := "archive"
+	if p := a.period(at); p != "" {
+		name = p
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(a.dir, name+".mbox"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeMaildir delivers msg to the period's Maildir: written to tmp, then
+// renamed into new, so readers never see a partial message.
+func (a *Archive) writeMaildir(at time.Time, msg []byte) error {
+	dir := filepath.Join(a.dir, a.period(at))
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%d.%s.%s", at.Unix(), uuid.NewString(), a.host)
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Store wraps a store and archives the message of every decision recorded
+// through it.
+type Store struct {
+	store.EmailStore
+	a *Archive
+}
+
+// NewStore wraps st to archive to a.
+func NewStore(st store.EmailStore, a *Archive) *Store {
+	return &Store{EmailStore: st, a: a}
+}
+
+// RecordDecision records d, then archives its message. Archive failures are
+// logged and counted, never returned.
+func (s *Store) RecordDecision(ctx context.Context, d store.Decision) error {
+	err := s.EmailStore.RecordDecision(ctx, d)
+	if aerr := s.a.Write(d); aerr != nil {
+		log.Printf("archive %s email %s from %s: %v", d.Decision, d.EmailID, d.Sender, aerr)
+		metrics.ArchiveFailures.Inc()
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+var decidedAt = time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+
+func decision(raw string) store.Decision {
+	return store.Decision{
+		EmailID:    "e1",
+		Direction:  store.DirectionOutbound,
+		Sender:     "app@example.com",
+		Decision:   store.DecisionApproved,
+		Reviewer:   "alice",
+		DecidedAt:  decidedAt,
+		RawMessage: []byte(raw),
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		format, path, rotate string
+		ok                   bool
+	}{
+		{FormatMbox, dir, "", true},
+		{FormatMaildir, dir, RotateDaily, true},
+		{"pst", dir, "", false},
+		{FormatMbox, dir, "hourly", false},
+		{FormatMbox, "", "", false},
+	} {
+		_, err := New(tc.format, tc.path, tc.rotate)
+		if (err == nil) != tc.ok {
+			t.Errorf("New(%q, %q, %q) error = %v, want ok %t", tc.format, tc.path, tc.rotate, err, tc.ok)
+		}
+	}
+}
+
+func TestMbox(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(FormatMbox, dir, "")
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := a.Write(decision("Subject: Hi\r\n\r\nFrom here on\r\n>From there\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := a.Write(decision("Subject: Again\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "2026-01.mbox"))
+	if err != nil {
+		t.Fatalf("read mbox: %v", err)
+	}
+	got := string(data)
+	if n := strings.Count(got, "From app@example.com Fri Jan  2 10:00:00 2026\n"); n != 2 {
+		t.Errorf("mbox has %d From lines, want 2:\n%s", n, got)
+	}
+	for _, want := range []string{
+		"X-Mailescrow-Decision: approved\n",
+		"X-Mailescrow-Reviewer: alice\n",
+		"X-Mailescrow-Email-Id: e1\n",
+		"\n>From here on\n>>From there\n",
+		"Subject: Again\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("mbox missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "\r") {
+		t.Error("mbox has CR line endings")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "2026-01.mbox")); err == nil && info.Mode().Perm() != 0o600 {
+		t.Errorf("mbox mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestMboxRotation(t *testing.T) {
+	for rotate, name := range map[string]string{
+		RotateDaily:   "2026-01-02.mbox",
+		RotateMonthly: "2026-01.mbox",
+		RotateNever:   "archive.mbox",
+	} {
+		dir := t.TempDir()
+		a, err := New(FormatMbox, dir, rotate)
+		if err != nil {
+			t.Fatalf("new: %v", err)
+		}
+		if err := a.Write(decision("Subject: Hi\r\n\r\nhello\r\n")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("rotate %s: %v", rotate, err)
+		}
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(FormatMaildir, dir, RotateDaily)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := a.Write(decision("Subject: Hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	mdir := filepath.Join(dir, "2026-01-02")
+	for _, sub := range []string{"tmp", "cur"} {
+		if entries, err := os.ReadDir(filepath.Join(mdir, sub)); err != nil || len(entries) != 0 {
+			t.Errorf("%s = %d entries (%v), want empty", sub, len(entries), err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(mdir, "new"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("new = %d entries (%v), want 1", len(entries), err)
+	}
+	data, err := os.ReadFile(filepath.Join(mdir, "new", entries[0].Name()))
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "X-Mailescrow-Decision: approved\r\n") || !strings.HasSuffix(string(data), "Subject: Hi\r\n\r\nhello\r\n") {
+		t.Errorf("message = %q", data)
+	}
+}
+
+func TestSkipsDecisionsWithoutMessage(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(FormatMbox, dir, "")
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := a.Write(decision("")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("archive has %d files, want none", len(entries))
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(FormatMbox, dir, RotateNever)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	mem := store.NewMemory()
+	st := NewStore(mem, a)
+	if err := st.RecordDecision(t.Context(), decision("Subject: Hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("record decision: %v", err)
+	}
+
+	decisions, err := mem.ListDecisions(t.Context(), 10)
+	if err != nil || len(decisions) != 1 {
+		t.Fatalf("decisions = %d (%v), want 1", len(decisions), err)
+	}
+	if len(decisions[0].RawMessage) != 0 {
+		t.Error("store kept the decision's raw message")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "archive.mbox"))
+	if err != nil || !strings.Contains(string(data), "Subject: Hi\n") {
+		t.Errorf("archive = %q (%v), want the message", data, err)
+	}
+
+	// A failing archive does not fail the decision.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before := metrics.ArchiveFailures.Value()
+	if err := st.RecordDecision(t.Context(), decision("Subject: Hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("record decision with broken archive: %v", err)
+	}
+	if got := metrics.ArchiveFailures.Value() - before; got != 1 {
+		t.Errorf("archive failures = %v, want 1", got)
+	}
+}
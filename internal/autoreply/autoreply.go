@@ -0,0 +1,165 @@
+// Package autoreply recognises inbound auto-replies, out-of-office notices
+// and other replies sent by a program rather than a person, so they are
+// tagged and kept out of reviewer notifications, and decides what happens to
+// them (auto_replies.action). It also spots vacation loops: two responders
+// answering each other, which show as one sender's auto-replies arriving
+// over and over.
+package autoreply
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tags applied to inbound auto-replies.
+const (
+	Tag     = "auto-reply"
+	LoopTag = "auto-reply-loop" // also on the auto-replies of a loop
+)
+
+// Reviewer is who auto-replies approved or archived by the policy are
+// decided on by.
+const Reviewer = "auto-reply"
+
+// What happens to an inbound auto-reply.
+const (
+	ActionHold    = "hold"    // tag it and keep it for review
+	ActionApprove = "approve" // approve it without review, unless it is part of a loop
+	ActionArchive = "archive" // reject it without review or notice
+)
+
+// subjectPrefixes start the subjects of auto-replies that carry none of the
+// headers for them, lower-cased.
+var subjectPrefixes = []string{
+	"auto-reply:",
+	"autoreply:",
+	"automatic reply:",
+	"out of office:",
+	"out of the office:",
+	"abwesenheitsnotiz:",
+	"réponse automatique:",
+	"respuesta automática:",
+}
+
+// Detect returns why raw looks like an auto-reply, or "" if it does not or
+// cannot be parsed. Delivery status notifications and read receipts are
+// reports, not auto-replies, whatever their headers say.
+func Detect(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	h := msg.Header
+	if mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mediaType == "multipart/report" {
+		return ""
+	}
+	if v := strings.ToLower(strings.TrimSpace(h.Get("Auto-Submitted"))); v == "auto-replied" || strings.HasPrefix(v, "auto-replied;") {
+		return "Auto-Submitted: auto-replied"
+	}
+	for _, name := range []string{"X-Autoreply", "X-Autorespond"} {
+		if h.Get(name) != "" {
+			return name + " header"
+		}
+	}
+	if strings.EqualFold(strings.TrimSpace(h.Get("Precedence")), "auto_reply") {
+		return "Precedence: auto_reply"
+	}
+	subject, err := (&mime.WordDecoder{}).DecodeHeader(h.Get("Subject"))
+	if err != nil {
+		subject = h.Get("Subject")
+	}
+	subject = strings.ToLower(strings.TrimSpace(subject))
+	for _, prefix := range subjectPrefixes {
+		if strings.HasPrefix(subject, prefix) {
+			return fmt.Sprintf("subject starts with %q", prefix)
+		}
+	}
+	return ""
+}
+
+// Policy decides what happens to inbound auto-replies and counts them per
+// sender to spot loops. A nil Policy holds every auto-reply for review and
+// spots no loops.
+type Policy struct {
+	loopAfter  int
+	loopWindow time.Duration
+	now        func() time.Time
+
+	mu     sync.Mutex
+	action string
+	recent map[string][]time.Time // each sender's auto-replies within loopWindow, oldest first
+}
+
+// New creates a Policy. An empty action defaults to ActionHold. The
+// loopAfter-th auto-reply from one sender within loopWindow, and each after
+// it, is part of a loop; a loopAfter of zero spots none.
+func New(action string, loopAfter int, loopWindow time.Duration) (*Policy, error) {
+	p := &Policy{
+		loopAfter:  loopAfter,
+		loopWindow: loopWindow,
+		now:        time.Now,
+		recent:     make(map[string][]time.Time),
+	}
+	if err := p.SetAction(action); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetAction replaces the action, e.g. on a configuration reload.
+func (p *Policy) SetAction(action string) error {
+	switch action {
+	case "":
+		action = ActionHold
+	case ActionHold, ActionApprove, ActionArchive:
+	default:
+		return fmt.Errorf("unknown auto-reply action %q", action)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.action = action
+	return nil
+}
+
+// Action returns what happens to auto-replies.
+func (p *Policy) Action() string {
+	if p == nil {
+		return ActionHold
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.action
+}
+
+// Loop records an auto-reply from sender and reports whether it is part of
+// a loop. Counts are kept in memory and start again on a restart.
+func (p *Policy) Loop(sender string) bool {
+	if p == nil || p.loopAfter <= 0 {
+		return false
+	}
+	sender = strings.ToLower(sender)
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Forget the auto-replies that left the window, and the senders left
+	// without any.
+	for s, times := range p.recent {
+		i := 0
+		for i < len(times) && now.Sub(times[i]) >= p.loopWindow {
+			i++
+		}
+		if i == len(times) {
+			delete(p.recent, s)
+		} else {
+			p.recent[s] = times[i:]
+		}
+	}
+	p.recent[sender] = append(p.recent[sender], now)
+	return len(p.recent[sender]) >= p.loopAfter
+}
@@ -0,0 +1,87 @@
+package autoreply
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		auto   bool
+	}{
+		{"auto-replied", "Auto-Submitted: auto-replied\r\nSubject: Re: Invoice\r\n", true},
+		{"auto-replied with parameter", "Auto-Submitted: Auto-Replied; owner-email=bob@example.org\r\n", true},
+		{"auto-generated", "Auto-Submitted: auto-generated\r\nSubject: Your receipt\r\n", false},
+		{"x-autoreply", "X-Autoreply: yes\r\nSubject: Re: Invoice\r\n", true},
+		{"x-autorespond", "X-Autorespond: Re: Invoice\r\n", true},
+		{"precedence", "Precedence: auto_reply\r\n", true},
+		{"precedence bulk", "Precedence: bulk\r\n", false},
+		{"outlook subject", "Subject: Automatic reply: Invoice\r\n", true},
+		{"encoded subject", "Subject: =?utf-8?q?R=C3=A9ponse_automatique=3A_Facture?=\r\n", true},
+		{"out of office", "Subject: Out of Office: back on Monday\r\n", true},
+		{"reply about an out of office", "Subject: Re: Out of Office: back on Monday\r\n", false},
+		{"person", "Subject: Re: Invoice\r\n", false},
+		{"delivery report", "Auto-Submitted: auto-replied\r\nContent-Type: multipart/report; report-type=delivery-status; boundary=b\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := Detect([]byte(tt.header + "\r\nbody\r\n"))
+			if (reason != "") != tt.auto {
+				t.Errorf("Detect = %q, want auto-reply %v", reason, tt.auto)
+			}
+		})
+	}
+}
+
+func TestLoop(t *testing.T) {
+	p, err := New("", 3, time.Hour)
+	if err != nil {
+		t.Fatalf("new policy: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	for i, want := range []bool{false, false, true, true} {
+		if got := p.Loop("Bob@example.org"); got != want {
+			t.Errorf("auto-reply %d: loop = %v, want %v", i+1, got, want)
+		}
+		now = now.Add(10 * time.Minute)
+	}
+	if p.Loop("alice@example.org") {
+		t.Error("another sender's first auto-reply is a loop")
+	}
+	now = now.Add(2 * time.Hour)
+	if p.Loop("bob@example.org") {
+		t.Error("an auto-reply after the window is still a loop")
+	}
+	if len(p.recent) != 1 {
+		t.Errorf("recent = %v, want the senders outside the window forgotten", p.recent)
+	}
+}
+
+func TestAction(t *testing.T) {
+	var nilPolicy *Policy
+	if got := nilPolicy.Action(); got != ActionHold || nilPolicy.Loop("bob@example.org") {
+		t.Errorf("nil policy: action %q, want hold and no loops", got)
+	}
+	p, err := New("", 0, time.Hour)
+	if err != nil || p.Action() != ActionHold {
+		t.Fatalf("New with no action = %v, %v; want hold", p, err)
+	}
+	for range 5 {
+		if p.Loop("bob@example.org") {
+			t.Fatal("loop with loop detection off")
+		}
+	}
+	if err := p.SetAction(ActionArchive); err != nil || p.Action() != ActionArchive {
+		t.Errorf("SetAction(archive) = %v, action %q", err, p.Action())
+	}
+	if err := p.SetAction("delete"); err == nil {
+		t.Error("SetAction(delete) succeeded, want an error")
+	}
+	if _, err := New("reject", 3, time.Hour); err == nil {
+		t.Error("New with an unknown action succeeded, want an error")
+	}
+}
@@ -0,0 +1,130 @@
+// Package backfill imports the mail already in an IMAP folder into the store
+// as approved inbound history, so teams adopting mailescrow keep their past
+// correspondence in one place. Imported mail is never held for review: it
+// goes straight into its own consumer queue, tagged Tag.
+package backfill
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"time"
+
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// DefaultQueue is the consumer queue imported mail goes into unless another
+// is given.
+const DefaultQueue = "imported"
+
+// Tag is added to every imported email.
+const Tag = "imported"
+
+// Reviewer is recorded as the approver of imported mail.
+const Reviewer = "import"
+
+// Source reads the messages of an IMAP folder. imap.Client implements it.
+type Source interface {
+	Fetch(ctx context.Context, mailbox string, since time.Time, fn func(imap.FetchedEmail) error) error
+}
+
+// Result counts what an import did.
+type Result struct {
+	Imported int
+	Skipped  int // already in the store, or seen twice in the folder
+}
+
+// Importer imports mail into the store.
+type Importer struct {
+	st    store.ReadWriter
+	src   Source
+	queue string
+}
+
+// New creates an Importer filing mail into queue, or DefaultQueue if empty.
+func New(st store.ReadWriter, src Source, queue string) *Importer {
+	if queue == "" {
+		queue = DefaultQueue
+	}
+	return &Importer{st: st, src: src, queue: queue}
+}
+
+// Import saves every message in mailbox received on or after since (all of
+// them if since is zero) as an approved inbound email. Messages whose
+// Message-Id is already in the queue are skipped, so an interrupted import
+// can simply be run again. The folder is left as it is.
+func (im *Importer) Import(ctx context.Context, mailbox string, since time.Time) (Result, error) {
+	existing, err := im.st.ListApproved(ctx, im.queue, "")
+	if err != nil {
+		return Result{}, fmt.Errorf("list approved: %w", err)
+	}
+	known := make(map[string]bool, len(existing))
+	for _, e := range existing {
+		id, err := im.messageID(ctx, e.ID)
+		if err != nil {
+			return Result{}, fmt.Errorf("read %s: %w", e.ID, err)
+		}
+		if id != "" {
+			known[id] = true
+		}
+	}
+
+	var res Result
+	err = im.src.Fetch(ctx, mailbox, since, func(f imap.FetchedEmail) error {
+		if f.MessageID != "" && known[f.MessageID] {
+			res.Skipped++
+			return nil
+		}
+		if err := im.save(ctx, f); err != nil {
+			return err
+		}
+		if f.MessageID != "" {
+			known[f.MessageID] = true
+		}
+		res.Imported++
+		return nil
+	})
+	if err != nil {
+		return res, fmt.Errorf("import from %s: %w", mailbox, err)
+	}
+	return res, nil
+}
+
+// save stores f as an approved inbound email. It is recorded in no IMAP
+// folder: mailescrow must not move it out of mailbox once it is fetched from
+// the API, nor reconcile it with its own folders.
+func (im *Importer) save(ctx context.Context, f imap.FetchedEmail) error {
+	id, err := im.st.SaveInbound(ctx, f.Sender, f.Recipients, f.Subject, f.Body, f.RawMessage, "", "", im.queue)
+	if err != nil {
+		return fmt.Errorf("save %s: %w", f.MessageID, err)
+	}
+	if f.EnvelopeRecipients != nil {
+		if err := im.st.SetEnvelopeRecipients(ctx, id, f.EnvelopeRecipients); err != nil {
+			log.Printf("Import: record envelope recipients for %s: %v", id, err)
+		}
+	}
+	if err := im.st.AddTag(ctx, id, Tag); err != nil {
+		log.Printf("Import: tag %s: %v", id, err)
+	}
+	if err := im.st.Approve(ctx, id, Reviewer, 0); err != nil { // just saved, so at version 0
+		return fmt.Errorf("approve %s: %w", id, err)
+	}
+	return nil
+}
+
+// messageID returns the Message-Id of email id's raw message, or "". Only
+// the header is read.
+func (im *Importer) messageID(ctx context.Context, id string) (string, error) {
+	raw, err := im.st.OpenRaw(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = raw.Close() }()
+	msg, err := mail.ReadMessage(raw)
+	if err != nil {
+		return "", nil
+	}
+	return msg.Header.Get("Message-Id"), nil
+}
@@ -0,0 +1,90 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/fixtures"
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// fakeSource serves messages from one folder, all received at the same time.
+type fakeSource struct {
+	mailbox  string
+	received time.Time
+	msgs     [][]byte
+	err      error // returned after the messages
+}
+
+func (f *fakeSource) Fetch(_ context.Context, mailbox string, since time.Time, fn func(imap.FetchedEmail) error) error {
+	if mailbox != f.mailbox {
+		return errors.New("no such mailbox")
+	}
+	if f.received.Before(since) {
+		return nil
+	}
+	for _, raw := range f.msgs {
+		if err := fn(imap.ParseMessage(raw)); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+func TestImportsAsApprovedHistory(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	src := &fakeSource{mailbox: "INBOX", received: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), msgs: [][]byte{
+		fixtures.Message{MessageID: "a@example.org", From: "alice@example.org", Subject: "Contract"}.Bytes(),
+		fixtures.Message{MessageID: "b@example.org", From: "bob@example.org", Subject: "Invoice"}.Bytes(),
+		fixtures.Message{MessageID: "a@example.org", From: "alice@example.org", Subject: "Contract"}.Bytes(),
+	}}
+	im := New(st, src, "")
+
+	res, err := im.Import(ctx, "INBOX", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if res != (Result{Imported: 2, Skipped: 1}) {
+		t.Errorf("result = %+v, want 2 imported and the duplicate skipped", res)
+	}
+	if pending, _ := st.CountPending(ctx); pending != 0 {
+		t.Errorf("pending = %d, want imported mail never held", pending)
+	}
+	approved, err := st.ListApproved(ctx, DefaultQueue, Tag)
+	if err != nil {
+		t.Fatalf("list approved: %v", err)
+	}
+	if len(approved) != 2 || approved[0].Subject != "Contract" || approved[0].ApprovedBy != Reviewer || approved[0].Direction != store.DirectionInbound {
+		t.Fatalf("approved = %+v, want both messages approved by import", approved)
+	}
+	if approved[0].IMAPMessageID != "" || approved[0].IMAPMailbox != "" {
+		t.Errorf("imported email recorded in IMAP as %q in %q, want in no folder", approved[0].IMAPMessageID, approved[0].IMAPMailbox)
+	}
+
+	// Running it again imports nothing new.
+	res, err = im.Import(ctx, "INBOX", time.Time{})
+	if err != nil || res != (Result{Skipped: 3}) {
+		t.Errorf("second import = %+v (%v), want everything skipped", res, err)
+	}
+	// Mail older than since is left out.
+	res, err = New(st, src, "archive").Import(ctx, "INBOX", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil || res != (Result{}) {
+		t.Errorf("import since 2025 = %+v (%v), want nothing", res, err)
+	}
+}
+
+func TestStopsOnFetchError(t *testing.T) {
+	st := store.NewMemory()
+	src := &fakeSource{mailbox: "INBOX", msgs: [][]byte{fixtures.Message{MessageID: "a@example.org"}.Bytes()}, err: errors.New("connection reset")}
+	res, err := New(st, src, "").Import(t.Context(), "INBOX", time.Time{})
+	if err == nil {
+		t.Fatal("expected the fetch error")
+	}
+	if res.Imported != 1 {
+		t.Errorf("imported = %d, want the message read before the error kept", res.Imported)
+	}
+}
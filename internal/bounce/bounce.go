@@ -0,0 +1,182 @@
+// Package bounce notifies the external sender of a rejected inbound email.
+//
+// Bounces to forged senders are backscatter, so a notification is only sent
+// when the policy allows it and the message does not look automated.
+package bounce
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Policies controlling which senders may receive a bounce.
+const (
+	// PolicyAuthenticated bounces only mail whose sender was authenticated:
+	// SPF, DKIM or DMARC passed according to the receiving server's
+	// Authentication-Results header, or the message carries a valid signature.
+	PolicyAuthenticated = "authenticated"
+	// PolicyAlways bounces any non-automated mail.
+	PolicyAlways = "always"
+)
+
+// DefaultTemplate is the notification body used when no template file is configured.
+const DefaultTemplate = `Your message to {{join .Recipients ", "}} was not accepted.
+
+  Subject:  {{.Subject}}
+  Received: {{.ReceivedAt.Format "2006-01-02 15:04:05 UTC"}}
+{{if .Reason}}  Reason:   {{.Reason}}
+{{end}}
+This is an automatically generated message. Please do not reply.
+`
+
+// Notifier sends bounce notifications through the relay.
+type Notifier struct {
+	sender   relay.Sender
+	fromAddr string
+	fromName string
+	policy   string
+	tmpl     *template.Template
+	now      func() time.Time
+}
+
+// New creates a Notifier sending from fromAddr. templatePath optionally names
+// a text/template file for the notification body; empty uses DefaultTemplate.
+// An empty policy means PolicyAuthenticated.
+func New(sender relay.Sender, fromAddr, fromName, policy, templatePath string) (*Notifier, error) {
+	if policy == "" {
+		policy = PolicyAuthenticated
+	}
+	if policy != PolicyAuthenticated && policy != PolicyAlways {
+		return nil, fmt.Errorf("unknown bounce policy %q", policy)
+	}
+	text := DefaultTemplate
+	if templatePath != "" {
+		b, err := os.ReadFile(templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("read bounce template: %w", err)
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New("bounce").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse bounce template: %w", err)
+	}
+	return &Notifier{
+		sender:   sender,
+		fromAddr: fromAddr,
+		fromName: fromName,
+		policy:   policy,
+		tmpl:     tmpl,
+		now:      time.Now,
+	}, nil
+}
+
+// Eligible reports whether email may be bounced and, if not, why.
+func (n *Notifier) Eligible(email *store.Email) (bool, string) {
+	if email.Direction != store.DirectionInbound {
+		return false, "not an inbound email"
+	}
+	if email.Sender == "" || strings.EqualFold(email.Sender, n.fromAddr) {
+		return false, "no external sender"
+	}
+	local, _, _ := strings.Cut(strings.ToLower(email.Sender), "@")
+	if local == "mailer-daemon" || local == "postmaster" {
+		return false, "sender is a mail system"
+	}
+	if len(email.RawMessage) == 0 {
+		return false, "raw message not stored"
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(email.RawMessage))
+	if err != nil {
+		return false, "unparseable message"
+	}
+	if reason := automated(msg.Header); reason != "" {
+		return false, reason
+	}
+	if n.policy == PolicyAuthenticated && !authenticated(email, msg.Header) {
+		return false, "sender is not authenticated"
+	}
+	return true, ""
+}
+
+// automated returns why a message looks machine-generated, or "" if it does not.
+func automated(h mail.Header) string {
+	if v := h.Get("Auto-Submitted"); v != "" && !strings.EqualFold(v, "no") {
+		return "auto-submitted message"
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "bulk or list message"
+	}
+	if h.Get("List-Id") != "" || h.Get("List-Unsubscribe") != "" {
+		return "mailing list message"
+	}
+	return ""
+}
+
+// authenticated reports whether the sender passed SPF, DKIM or DMARC at the
+// receiving server, or signed the message with a valid signature.
+func authenticated(email *store.Email, h mail.Header) bool {
+	if email.Signature != nil && email.Signature.Status == store.SignatureValid {
+		return true
+	}
+	for _, v := range h["Authentication-Results"] {
+		v = strings.ToLower(v)
+		for _, method := range []string{"dmarc=pass", "dkim=pass", "spf=pass"} {
+			if strings.Contains(v, method) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// data is passed to the notification template.
+type data struct {
+	*store.Email
+	Reason string
+}
+
+// Send notifies the sender of email that it was rejected. reason is optional
+// and included in the notification. Callers should check Eligible first.
+func (n *Notifier) Send(ctx context.Context, email *store.Email, reason string) error {
+	var body bytes.Buffer
+	if err := n.tmpl.Execute(&body, data{Email: email, Reason: reason}); err != nil {
+		return fmt.Errorf("render bounce template: %w", err)
+	}
+
+	from := (&mail.Address{Name: n.fromName, Address: n.fromAddr}).String()
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "Date: %s\r\n", n.now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&raw, "Message-Id: <%s@mailescrow>\r\n", uuid.New().String())
+	fmt.Fprintf(&raw, "From: %s\r\n", from)
+	fmt.Fprintf(&raw, "To: %s\r\n", email.Sender)
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Message not accepted: "+email.Subject))
+	if id := email.IMAPMessageID; id != "" {
+		fmt.Fprintf(&raw, "In-Reply-To: %s\r\nReferences: %s\r\n", id, id)
+	}
+	raw.WriteString("Auto-Submitted: auto-replied\r\n")
+	raw.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	raw.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+
+	// The null reverse path keeps a failing bounce from bouncing in turn.
+	return n.sender.Send(ctx, &store.Email{
+		Direction:  store.DirectionOutbound,
+		Recipients: []string{email.Sender},
+		Subject:    "Message not accepted: " + email.Subject,
+		Body:       body.String(),
+		RawMessage: raw.Bytes(),
+	})
+}
@@ -0,0 +1,136 @@
+package bounce
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeSender struct {
+	sent []*store.Email
+}
+
+func (f *fakeSender) Send(_ context.Context, email *store.Email) error {
+	f.sent = append(f.sent, email)
+	return nil
+}
+
+func inbound(sender, headers string) *store.Email {
+	return &store.Email{
+		ID:            "e1",
+		Direction:     store.DirectionInbound,
+		Sender:        sender,
+		Recipients:    []string{"me@example.com"},
+		Subject:       "Offer",
+		RawMessage:    []byte("From: " + sender + "\r\n" + headers + "Subject: Offer\r\n\r\nHello\r\n"),
+		ReceivedAt:    time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC),
+		IMAPMessageID: "<offer@example.org>",
+	}
+}
+
+func TestEligible(t *testing.T) {
+	authenticatedPolicy, _ := New(&fakeSender{}, "me@example.com", "", PolicyAuthenticated, "")
+	alwaysPolicy, _ := New(&fakeSender{}, "me@example.com", "", PolicyAlways, "")
+	signed := inbound("bob@example.org", "")
+	signed.Signature = &store.Signature{Protocol: store.SignaturePGP, Status: store.SignatureValid}
+	outbound := inbound("me@example.com", "")
+	outbound.Direction = store.DirectionOutbound
+
+	tests := []struct {
+		name  string
+		n     *Notifier
+		email *store.Email
+		want  bool
+	}{
+		{"spf pass", authenticatedPolicy, inbound("bob@example.org", "Authentication-Results: mx.example.com; spf=pass smtp.mailfrom=example.org\r\n"), true},
+		{"dkim pass", authenticatedPolicy, inbound("bob@example.org", "Authentication-Results: mx.example.com; spf=softfail; DKIM=pass header.d=example.org\r\n"), true},
+		{"valid signature", authenticatedPolicy, signed, true},
+		{"unauthenticated", authenticatedPolicy, inbound("bob@example.org", "Authentication-Results: mx.example.com; spf=fail\r\n"), false},
+		{"always", alwaysPolicy, inbound("bob@example.org", ""), true},
+		{"auto-submitted", alwaysPolicy, inbound("bob@example.org", "Auto-Submitted: auto-replied\r\n"), false},
+		{"mailing list", alwaysPolicy, inbound("bob@example.org", "List-Id: <news.example.org>\r\n"), false},
+		{"bulk", alwaysPolicy, inbound("bob@example.org", "Precedence: bulk\r\n"), false},
+		{"mailer daemon", alwaysPolicy, inbound("MAILER-DAEMON@example.org", ""), false},
+		{"null sender", alwaysPolicy, inbound("", ""), false},
+		{"outbound", alwaysPolicy, outbound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, why := tt.n.Eligible(tt.email)
+			if got != tt.want {
+				t.Errorf("Eligible = %v (%s), want %v", got, why, tt.want)
+			}
+			if !got && why == "" {
+				t.Error("ineligible without a reason")
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	sender := &fakeSender{}
+	n, err := New(sender, "me@example.com", "My Service", PolicyAlways, "")
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := n.Send(t.Context(), inbound("bob@example.org", ""), "We do not accept offers."); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sender.sent))
+	}
+	got := sender.sent[0]
+	if got.Sender != "" {
+		t.Errorf("envelope sender = %q, want null reverse path", got.Sender)
+	}
+	if len(got.Recipients) != 1 || got.Recipients[0] != "bob@example.org" {
+		t.Errorf("recipients = %v, want the original sender", got.Recipients)
+	}
+	raw := string(got.RawMessage)
+	for _, want := range []string{
+		"From: \"My Service\" <me@example.com>\r\n",
+		"To: bob@example.org\r\n",
+		"Subject: Message not accepted: Offer\r\n",
+		"In-Reply-To: <offer@example.org>\r\n",
+		"Auto-Submitted: auto-replied\r\n",
+		"was not accepted.\r\n",
+		"Reason:   We do not accept offers.\r\n",
+	} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("bounce missing %q:\n%s", want, raw)
+		}
+	}
+}
+
+func TestCustomTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bounce.txt")
+	_ = os.WriteFile(path, []byte("Sorry, {{.Sender}}: {{.Subject}} was declined.\n"), 0o600)
+	sender := &fakeSender{}
+	n, err := New(sender, "me@example.com", "", "", path)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	_ = n.Send(t.Context(), inbound("bob@example.org", ""), "")
+	if got := sender.sent[0].Body; got != "Sorry, bob@example.org: Offer was declined.\n" {
+		t.Errorf("body = %q", got)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(&fakeSender{}, "me@example.com", "", "sometimes", ""); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+	if _, err := New(&fakeSender{}, "me@example.com", "", "", filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("expected error for missing template")
+	}
+	path := filepath.Join(t.TempDir(), "bad.txt")
+	_ = os.WriteFile(path, []byte("{{.Subject"), 0o600)
+	if _, err := New(&fakeSender{}, "me@example.com", "", "", path); err == nil {
+		t.Error("expected error for unparseable template")
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -19,6 +20,23 @@ imap:
   password: "testpass"
   tls: true
   poll_interval: "30s"
+  max_backoff: "10m"
+  failure_threshold: 3
+  alert_after: "20m"
+  alert_webhook_url: "https://hooks.example.com/imap"
+  alert_digest:
+    interval: "1h"
+  sent_folder: "Sent"
+  watch_folders:
+    - folder: "INBOX"
+    - folder: "Support"
+      queue: "support"
+  spam_folder: "Junk"
+  envelope_header: "X-Original-To"
+  reconcile_interval: "30m"
+  reconcile_fix: true
+  tls_options:
+    insecure_skip_verify: true
 relay:
   host: "smtp.relay.com"
   port: 587
@@ -26,12 +44,189 @@ relay:
   password: "relaypass"
   tls: true
   from_name: "My Service"
+  timeout: "30s"
+  stamp_headers: true
+  strip_headers: ["Received", "X-Originating-IP"]
+  dsn_notify: ["failure", "delay"]
+  dsn_ret: hdrs
+  max_per_minute: 20
+  max_per_hour: 500
+  provider: file
+  sink_dir: "/var/lib/mailescrow/sink"
+  tls_options:
+    min_version: "1.3"
+    ca_file: "/etc/mailescrow/internal-ca.pem"
+    cert_file: "/etc/mailescrow/client.crt"
+    key_file: "/etc/mailescrow/client.key"
 web:
   listen: ":8080"
   api_listen: ":8081"
   password: "hunter2"
+  templates_dir: "/etc/mailescrow/templates"
+  require_api_token: true
+  debug: true
+  single_listener: true
+  api_v2: true
+  base_path: "/mailescrow"
+  trusted_proxies: ["10.0.0.0/8", "::1"]
+  language: "de"
+  timezone: "Europe/Berlin"
+  public_url: "https://intranet.example.org/mailescrow/"
+  tracking_pixels: "strip"
+  second_factor:
+    totp_secrets:
+      alice: "JBSWY3DPEHPK3PXP"
+    roles: ["review", "admin"]
+    session: "8h"
+api:
+  consume_mode: "keep"
 db:
+  driver: "memory"
   path: "/tmp/test.db"
+  query_timeout: "5s"
+  maintenance_interval: "6h"
+sla:
+  max_pending_age: "4h"
+  check_interval: "5m"
+  webhook_url: "https://hooks.example.com/sla"
+  digest:
+    interval: "15m"
+    max: 20
+review_mail:
+  to: ["reviewers@example.com", "oncall@example.com"]
+  threshold: 25
+  interval: "30m"
+  check_interval: "2m"
+smtp:
+  listen: ":2525"
+  username: "app"
+  password: "smtppass"
+  max_message_bytes: 1048576
+  max_recipients: 20
+  max_connections: 10
+  read_timeout: "2m"
+  write_timeout: "30s"
+  max_message_rate: 60
+  lmtp_listen: "unix:/run/mailescrow/lmtp.sock"
+  tls_cert_file: "/etc/mailescrow/smtp.crt"
+  tls_key_file: "/etc/mailescrow/smtp.key"
+  client_ca_file: "/etc/mailescrow/clients-ca.pem"
+  internal:
+    listen: ":25"
+    allowed_networks: ["10.0.0.0/8", "192.168.1.10"]
+    project: "intranet"
+  users:
+    - username: "billing"
+      password_hash: "$2y$10$abcdefghijklmnopqrstuu5Wl1rTQS8Sm1jAyzkFJKWsBm0y8fh1u"
+      allowed_from_domains: ["billing.example.com"]
+      allowed_recipient_domains: ["customers.example.com"]
+      project: "billing"
+    - username: "ci"
+      client_cert_cn: "ci.apps.example.com"
+contacts:
+  auto_approve_after: 3
+signatures:
+  smime_trust_anchors: "/etc/mailescrow/smime-ca.pem"
+  pgp_keyring: "/etc/mailescrow/keyring.asc"
+bounce:
+  enabled: true
+  policy: "always"
+  template: "/etc/mailescrow/bounce.txt"
+recipients:
+  check_mx: true
+reputation:
+  dnsbls: ["zen.spamhaus.org"]
+  uribls: ["dbl.spamhaus.org", "multi.uribl.com"]
+redaction:
+  patterns: ["credit_card", "api_key"]
+  custom:
+    - name: "employee_id"
+      pattern: "EMP-[0-9]{6}"
+  raw: "encrypt"
+  key: "c2VjcmV0"
+journal:
+  address: "archive@example.com"
+  mailbox: "Archive/Outbound"
+archive:
+  format: "maildir"
+  path: "/var/lib/mailescrow/archive"
+  rotate: "daily"
+retention:
+  history: "90d"
+  rejected: "30d"
+  audit: "1y"
+  interval: "6h"
+tracing:
+  endpoint: "http://otel-collector:4318"
+  sample_ratio: 0.25
+network:
+  proxy_url: "socks5://127.0.0.1:1080"
+webhooks:
+  secret: "hooksecret"
+  allow_private: true
+tracking:
+  enabled: true
+  url: "https://links.example.com"
+unsubscribe:
+  enabled: true
+  url: "https://optout.example.com"
+  tag: "newsletter"
+quota:
+  per_hour: 10
+  per_day: 100
+  action: "refuse"
+suppression:
+  action: "refuse"
+auto_replies:
+  action: "archive"
+  loop_after: 5
+  loop_window: 30m
+rules:
+  - name: "alerts"
+    direction: "outbound"
+    sender: "alerts@example.com"
+    recipient: "*@example.com"
+    action: "approve"
+  - name: "invoices"
+    recipient: "*@billing.example.com"
+    tags: ["invoice", "finance"]
+  - name: "listed"
+    reputation: "listed"
+    action: "hold"
+  - name: "large"
+    when: "email.size > 10 * MB"
+    action: "reject"
+policies:
+  - domain: "*.gov"
+    action: "hold"
+    approvals: 2
+    require_reason: true
+  - domain: "internal.example.com"
+    action: "approve"
+routes:
+  - match: "support@*"
+    queue: "support"
+  - match: "*@billing.example.com"
+    queue: "billing"
+identities:
+  - name: "support"
+    address: "support@example.com"
+    display_name: "Example Support"
+    dkim_selector: "mail"
+    dkim_key_file: "/etc/mailescrow/dkim.pem"
+    tokens: ["helpdesk"]
+sending_windows:
+  - name: "germany"
+    recipient: "*@example.de"
+    days: ["mon", "tue", "wed", "thu", "fri"]
+    start: "09:00"
+    end: "17:00"
+    timezone: "Europe/Berlin"
+projects:
+  - name: "billing"
+    max_pending: 100
+    max_storage_mb: 512
+    max_message_bytes: 5242880
 `
 	if err := os.WriteFile(cfgFile, []byte(content), 0644); err != nil {
 		t.Fatalf("write config: %v", err)
@@ -78,6 +273,30 @@ db:
 	if cfg.Relay.FromName != "My Service" {
 		t.Errorf("relay.from_name = %q, want %q", cfg.Relay.FromName, "My Service")
 	}
+	if cfg.Relay.Timeout != 30*time.Second {
+		t.Errorf("relay.timeout = %v, want 30s", cfg.Relay.Timeout)
+	}
+	if !cfg.Relay.StampHeaders {
+		t.Error("relay.stamp_headers = false, want true")
+	}
+	if len(cfg.Relay.StripHeaders) != 2 || cfg.Relay.StripHeaders[0] != "Received" || cfg.Relay.StripHeaders[1] != "X-Originating-IP" {
+		t.Errorf("relay.strip_headers = %v, want [Received X-Originating-IP]", cfg.Relay.StripHeaders)
+	}
+	if len(cfg.Relay.DSNNotify) != 2 || cfg.Relay.DSNNotify[0] != "failure" || cfg.Relay.DSNNotify[1] != "delay" {
+		t.Errorf("relay.dsn_notify = %v, want [failure delay]", cfg.Relay.DSNNotify)
+	}
+	if cfg.Relay.DSNRet != "hdrs" {
+		t.Errorf("relay.dsn_ret = %q, want hdrs", cfg.Relay.DSNRet)
+	}
+	if cfg.Relay.MaxPerMinute != 20 || cfg.Relay.MaxPerHour != 500 {
+		t.Errorf("relay.max_per_minute/max_per_hour = %d/%d, want 20/500", cfg.Relay.MaxPerMinute, cfg.Relay.MaxPerHour)
+	}
+	if cfg.Relay.Provider != "file" || cfg.Relay.SinkDir != "/var/lib/mailescrow/sink" {
+		t.Errorf("relay.provider/sink_dir = %q/%q, want file to /var/lib/mailescrow/sink", cfg.Relay.Provider, cfg.Relay.SinkDir)
+	}
+	if want := (TLSOptionsConfig{MinVersion: "1.3", CAFile: "/etc/mailescrow/internal-ca.pem", CertFile: "/etc/mailescrow/client.crt", KeyFile: "/etc/mailescrow/client.key"}); cfg.Relay.TLSOptions != want {
+		t.Errorf("relay.tls_options = %+v, want %+v", cfg.Relay.TLSOptions, want)
+	}
 	if cfg.Web.Listen != ":8080" {
 		t.Errorf("web.listen = %q, want %q", cfg.Web.Listen, ":8080")
 	}
@@ -87,9 +306,208 @@ db:
 	if cfg.Web.Password != "hunter2" {
 		t.Errorf("web.password = %q, want %q", cfg.Web.Password, "hunter2")
 	}
+	if cfg.Web.TemplatesDir != "/etc/mailescrow/templates" {
+		t.Errorf("web.templates_dir = %q, want %q", cfg.Web.TemplatesDir, "/etc/mailescrow/templates")
+	}
+	if !cfg.Web.RequireAPIToken {
+		t.Error("web.require_api_token = false, want true")
+	}
+	if !cfg.Web.Debug {
+		t.Error("web.debug = false, want true")
+	}
+	if !cfg.Web.APIV2 {
+		t.Error("web.api_v2 = false, want true")
+	}
+	if cfg.Web.Language != "de" || cfg.Web.Timezone != "Europe/Berlin" {
+		t.Errorf("web.language, web.timezone = %q, %q, want de, Europe/Berlin", cfg.Web.Language, cfg.Web.Timezone)
+	}
+	if cfg.Web.PublicURL != "https://intranet.example.org/mailescrow/" {
+		t.Errorf("web.public_url = %q", cfg.Web.PublicURL)
+	}
+	if cfg.Web.TrackingPixels != "strip" {
+		t.Errorf("web.tracking_pixels = %q, want strip", cfg.Web.TrackingPixels)
+	}
+	if f := cfg.Web.SecondFactor; f.TOTPSecrets["alice"] != "JBSWY3DPEHPK3PXP" || !reflect.DeepEqual(f.Roles, []string{"review", "admin"}) || f.Session != 8*time.Hour {
+		t.Errorf("web.second_factor = %+v, want alice's secret, review and admin, 8h", f)
+	}
+	if !cfg.Web.SingleListener {
+		t.Error("web.single_listener = false, want true")
+	}
+	if cfg.Web.BasePath != "/mailescrow" {
+		t.Errorf("web.base_path = %q, want /mailescrow", cfg.Web.BasePath)
+	}
+	if len(cfg.Web.TrustedProxies) != 2 || cfg.Web.TrustedProxies[1] != "::1" {
+		t.Errorf("web.trusted_proxies = %v, want [10.0.0.0/8 ::1]", cfg.Web.TrustedProxies)
+	}
 	if cfg.DB.Path != "/tmp/test.db" {
 		t.Errorf("db.path = %q, want %q", cfg.DB.Path, "/tmp/test.db")
 	}
+	if cfg.DB.Driver != "memory" {
+		t.Errorf("db.driver = %q, want memory", cfg.DB.Driver)
+	}
+	if cfg.DB.QueryTimeout != 5*time.Second {
+		t.Errorf("db.query_timeout = %v, want 5s", cfg.DB.QueryTimeout)
+	}
+	if cfg.DB.MaintenanceInterval != 6*time.Hour {
+		t.Errorf("db.maintenance_interval = %v, want 6h", cfg.DB.MaintenanceInterval)
+	}
+	if cfg.SLA.MaxPendingAge != 4*time.Hour {
+		t.Errorf("sla.max_pending_age = %v, want 4h", cfg.SLA.MaxPendingAge)
+	}
+	if cfg.SLA.CheckInterval != 5*time.Minute {
+		t.Errorf("sla.check_interval = %v, want 5m", cfg.SLA.CheckInterval)
+	}
+	if cfg.SLA.WebhookURL != "https://hooks.example.com/sla" {
+		t.Errorf("sla.webhook_url = %q, want %q", cfg.SLA.WebhookURL, "https://hooks.example.com/sla")
+	}
+	if cfg.SLA.Digest.Interval != 15*time.Minute || cfg.SLA.Digest.Max != 20 {
+		t.Errorf("sla.digest = %+v, want 15m, max 20", cfg.SLA.Digest)
+	}
+	wantReviewMail := ReviewMailConfig{To: []string{"reviewers@example.com", "oncall@example.com"}, Threshold: 25, Interval: 30 * time.Minute, CheckInterval: 2 * time.Minute}
+	if !reflect.DeepEqual(cfg.ReviewMail, wantReviewMail) {
+		t.Errorf("review_mail = %+v, want %+v", cfg.ReviewMail, wantReviewMail)
+	}
+	if len(cfg.Routes) != 2 || cfg.Routes[0] != (RouteConfig{Match: "support@*", Queue: "support"}) || cfg.Routes[1].Queue != "billing" {
+		t.Errorf("routes = %+v, want support@* → support, *@billing.example.com → billing", cfg.Routes)
+	}
+	wantSMTP := SMTPConfig{Listen: ":2525", Username: "app", Password: "smtppass", MaxMessageBytes: 1 << 20, MaxRecipients: 20, Users: []SMTPUserConfig{{
+		Username:                "billing",
+		PasswordHash:            "$2y$10$abcdefghijklmnopqrstuu5Wl1rTQS8Sm1jAyzkFJKWsBm0y8fh1u",
+		AllowedFromDomains:      []string{"billing.example.com"},
+		AllowedRecipientDomains: []string{"customers.example.com"},
+		Project:                 "billing",
+	}, {Username: "ci", ClientCertCN: "ci.apps.example.com"}}, LMTPListen: "unix:/run/mailescrow/lmtp.sock"}
+	wantSMTP.TLSCertFile, wantSMTP.TLSKeyFile, wantSMTP.ClientCAFile = "/etc/mailescrow/smtp.crt", "/etc/mailescrow/smtp.key", "/etc/mailescrow/clients-ca.pem"
+	wantSMTP.Internal = SMTPInternalConfig{Listen: ":25", AllowedNetworks: []string{"10.0.0.0/8", "192.168.1.10"}, Project: "intranet"}
+	wantSMTP.MaxConnections, wantSMTP.ReadTimeout, wantSMTP.WriteTimeout, wantSMTP.MaxMessageRate = 10, 2*time.Minute, 30*time.Second, 60
+	if !reflect.DeepEqual(cfg.SMTP, wantSMTP) {
+		t.Errorf("smtp = %+v", cfg.SMTP)
+	}
+	if cfg.IMAP.MaxBackoff != 10*time.Minute || cfg.IMAP.FailureThreshold != 3 || cfg.IMAP.AlertAfter != 20*time.Minute {
+		t.Errorf("imap resilience = %s/%d/%s, want 10m/3/20m", cfg.IMAP.MaxBackoff, cfg.IMAP.FailureThreshold, cfg.IMAP.AlertAfter)
+	}
+	if cfg.IMAP.AlertWebhookURL != "https://hooks.example.com/imap" {
+		t.Errorf("imap.alert_webhook_url = %q", cfg.IMAP.AlertWebhookURL)
+	}
+	if cfg.IMAP.AlertDigest.Interval != time.Hour || cfg.IMAP.AlertDigest.Max != 0 {
+		t.Errorf("imap.alert_digest = %+v, want 1h, no max", cfg.IMAP.AlertDigest)
+	}
+	if cfg.IMAP.SentFolder != "Sent" {
+		t.Errorf("imap.sent_folder = %q, want Sent", cfg.IMAP.SentFolder)
+	}
+	if want := []WatchFolderConfig{{Folder: "INBOX"}, {Folder: "Support", Queue: "support"}}; !reflect.DeepEqual(cfg.IMAP.WatchFolders, want) {
+		t.Errorf("imap.watch_folders = %+v, want %+v", cfg.IMAP.WatchFolders, want)
+	}
+	if cfg.IMAP.SpamFolder != "Junk" {
+		t.Errorf("imap.spam_folder = %q, want Junk", cfg.IMAP.SpamFolder)
+	}
+	if cfg.IMAP.EnvelopeHeader != "X-Original-To" {
+		t.Errorf("imap.envelope_header = %q, want X-Original-To", cfg.IMAP.EnvelopeHeader)
+	}
+	if cfg.IMAP.ReconcileInterval != 30*time.Minute || !cfg.IMAP.ReconcileFix {
+		t.Errorf("imap reconcile = %s/%t, want 30m/true", cfg.IMAP.ReconcileInterval, cfg.IMAP.ReconcileFix)
+	}
+	if cfg.IMAP.TLSOptions != (TLSOptionsConfig{InsecureSkipVerify: true}) {
+		t.Errorf("imap.tls_options = %+v, want insecure_skip_verify only", cfg.IMAP.TLSOptions)
+	}
+	if cfg.Contacts.AutoApproveAfter != 3 {
+		t.Errorf("contacts.auto_approve_after = %d, want 3", cfg.Contacts.AutoApproveAfter)
+	}
+	if cfg.Signatures != (SignaturesConfig{SMIMETrustAnchors: "/etc/mailescrow/smime-ca.pem", PGPKeyring: "/etc/mailescrow/keyring.asc"}) {
+		t.Errorf("signatures = %+v", cfg.Signatures)
+	}
+	if cfg.Bounce != (BounceConfig{Enabled: true, Policy: "always", Template: "/etc/mailescrow/bounce.txt"}) {
+		t.Errorf("bounce = %+v", cfg.Bounce)
+	}
+	if !cfg.Recipients.CheckMX {
+		t.Errorf("recipients.check_mx = false, want true")
+	}
+	if want := (ReputationConfig{DNSBLs: []string{"zen.spamhaus.org"}, URIBLs: []string{"dbl.spamhaus.org", "multi.uribl.com"}}); !reflect.DeepEqual(cfg.Reputation, want) {
+		t.Errorf("reputation = %+v, want %+v", cfg.Reputation, want)
+	}
+	wantRedaction := RedactionConfig{
+		Patterns: []string{"credit_card", "api_key"},
+		Custom:   []RedactionPatternConfig{{Name: "employee_id", Pattern: "EMP-[0-9]{6}"}},
+		Raw:      "encrypt",
+		Key:      "c2VjcmV0",
+	}
+	if !reflect.DeepEqual(cfg.Redaction, wantRedaction) {
+		t.Errorf("redaction = %+v, want %+v", cfg.Redaction, wantRedaction)
+	}
+	if cfg.Journal != (JournalConfig{Address: "archive@example.com", Mailbox: "Archive/Outbound"}) {
+		t.Errorf("journal = %+v", cfg.Journal)
+	}
+	if cfg.Archive != (ArchiveConfig{Format: "maildir", Path: "/var/lib/mailescrow/archive", Rotate: "daily"}) {
+		t.Errorf("archive = %+v", cfg.Archive)
+	}
+	wantRetention := RetentionConfig{History: Period(90 * 24 * time.Hour), Rejected: Period(30 * 24 * time.Hour), Audit: Period(365 * 24 * time.Hour), Interval: 6 * time.Hour}
+	if cfg.Retention != wantRetention {
+		t.Errorf("retention = %+v, want %+v", cfg.Retention, wantRetention)
+	}
+	if cfg.Tracing != (TracingConfig{Endpoint: "http://otel-collector:4318", SampleRatio: 0.25}) {
+		t.Errorf("tracing = %+v", cfg.Tracing)
+	}
+	if cfg.Network.ProxyURL != "socks5://127.0.0.1:1080" {
+		t.Errorf("network.proxy_url = %q", cfg.Network.ProxyURL)
+	}
+	if cfg.Webhooks.Secret != "hooksecret" {
+		t.Errorf("webhooks.secret = %q, want hooksecret", cfg.Webhooks.Secret)
+	}
+	if !cfg.Webhooks.AllowPrivate {
+		t.Error("webhooks.allow_private = false, want true")
+	}
+	if cfg.Tracking != (TrackingConfig{Enabled: true, URL: "https://links.example.com"}) {
+		t.Errorf("tracking = %+v", cfg.Tracking)
+	}
+	if cfg.Unsubscribe != (UnsubscribeConfig{Enabled: true, URL: "https://optout.example.com", Tag: "newsletter"}) {
+		t.Errorf("unsubscribe = %+v", cfg.Unsubscribe)
+	}
+	if cfg.API != (APIConfig{ConsumeMode: "keep"}) {
+		t.Errorf("api = %+v", cfg.API)
+	}
+	if cfg.Quota != (QuotaConfig{PerHour: 10, PerDay: 100, Action: "refuse"}) {
+		t.Errorf("quota = %+v", cfg.Quota)
+	}
+	if cfg.Suppression.Action != "refuse" {
+		t.Errorf("suppression action = %q, want refuse", cfg.Suppression.Action)
+	}
+	if cfg.AutoReplies != (AutoRepliesConfig{Action: "archive", LoopAfter: 5, LoopWindow: 30 * time.Minute}) {
+		t.Errorf("auto_replies = %+v", cfg.AutoReplies)
+	}
+	wantRules := []RuleConfig{
+		{Name: "alerts", Direction: "outbound", Sender: "alerts@example.com", Recipient: "*@example.com", Action: "approve"},
+		{Name: "invoices", Recipient: "*@billing.example.com", Tags: []string{"invoice", "finance"}},
+		{Name: "listed", Reputation: "listed", Action: "hold"},
+		{Name: "large", When: "email.size > 10 * MB", Action: "reject"},
+	}
+	if !reflect.DeepEqual(cfg.Rules, wantRules) {
+		t.Errorf("rules = %+v, want %+v", cfg.Rules, wantRules)
+	}
+	wantPolicies := []PolicyConfig{
+		{Domain: "*.gov", Action: "hold", Approvals: 2, RequireReason: true},
+		{Domain: "internal.example.com", Action: "approve"},
+	}
+	if !reflect.DeepEqual(cfg.Policies, wantPolicies) {
+		t.Errorf("policies = %+v, want %+v", cfg.Policies, wantPolicies)
+	}
+	wantIdentities := []IdentityConfig{{
+		Name: "support", Address: "support@example.com", DisplayName: "Example Support",
+		DKIMSelector: "mail", DKIMKeyFile: "/etc/mailescrow/dkim.pem", Tokens: []string{"helpdesk"},
+	}}
+	if !reflect.DeepEqual(cfg.Identities, wantIdentities) {
+		t.Errorf("identities = %+v, want %+v", cfg.Identities, wantIdentities)
+	}
+	wantWindows := []SendingWindowConfig{{
+		Name: "germany", Recipient: "*@example.de", Days: []string{"mon", "tue", "wed", "thu", "fri"},
+		Start: "09:00", End: "17:00", Timezone: "Europe/Berlin",
+	}}
+	if !reflect.DeepEqual(cfg.SendingWindows, wantWindows) {
+		t.Errorf("sending_windows = %+v, want %+v", cfg.SendingWindows, wantWindows)
+	}
+	wantProjects := []ProjectConfig{{Name: "billing", MaxPending: 100, MaxStorageMB: 512, MaxMessageBytes: 5 << 20}}
+	if !reflect.DeepEqual(cfg.Projects, wantProjects) {
+		t.Errorf("projects = %+v, want %+v", cfg.Projects, wantProjects)
+	}
 }
 
 func TestLoadDefaults(t *testing.T) {
@@ -118,18 +536,162 @@ relay:
 	if cfg.IMAP.PollInterval != 60*time.Second {
 		t.Errorf("default imap.poll_interval = %v, want 60s", cfg.IMAP.PollInterval)
 	}
+	if cfg.IMAP.SentFolder != "" {
+		t.Errorf("default imap.sent_folder = %q, want disabled", cfg.IMAP.SentFolder)
+	}
+	if cfg.IMAP.WatchFolders != nil {
+		t.Errorf("default imap.watch_folders = %+v, want none (INBOX)", cfg.IMAP.WatchFolders)
+	}
+	if cfg.IMAP.SpamFolder != "" {
+		t.Errorf("default imap.spam_folder = %q, want disabled", cfg.IMAP.SpamFolder)
+	}
+	if cfg.IMAP.EnvelopeHeader != "Delivered-To" {
+		t.Errorf("default imap.envelope_header = %q, want Delivered-To", cfg.IMAP.EnvelopeHeader)
+	}
+	if cfg.IMAP.ReconcileInterval != time.Hour || cfg.IMAP.ReconcileFix {
+		t.Errorf("default imap reconcile = %s/%t, want 1h/false", cfg.IMAP.ReconcileInterval, cfg.IMAP.ReconcileFix)
+	}
 	if cfg.Relay.Port != 587 {
 		t.Errorf("default relay.port = %d, want 587", cfg.Relay.Port)
 	}
+	if cfg.Relay.Timeout != time.Minute {
+		t.Errorf("default relay.timeout = %v, want 1m", cfg.Relay.Timeout)
+	}
+	if cfg.Relay.Provider != "smtp" {
+		t.Errorf("default relay.provider = %q, want smtp", cfg.Relay.Provider)
+	}
+	if cfg.Relay.TLSOptions != (TLSOptionsConfig{}) || cfg.IMAP.TLSOptions != (TLSOptionsConfig{}) {
+		t.Errorf("default relay.tls_options, imap.tls_options = %+v, %+v, want unset", cfg.Relay.TLSOptions, cfg.IMAP.TLSOptions)
+	}
 	if cfg.Web.Listen != ":8080" {
 		t.Errorf("default web.listen = %q, want %q", cfg.Web.Listen, ":8080")
 	}
 	if cfg.Web.APIListen != ":8081" {
 		t.Errorf("default web.api_listen = %q, want :8081", cfg.Web.APIListen)
 	}
+	if cfg.Web.RequireAPIToken {
+		t.Error("default web.require_api_token = true, want false")
+	}
+	if cfg.Web.Debug {
+		t.Error("default web.debug = true, want false")
+	}
+	if cfg.Web.APIV2 {
+		t.Error("default web.api_v2 = true, want false")
+	}
+	if cfg.Web.Language != "" || cfg.Web.Timezone != "" {
+		t.Errorf("default web.language, web.timezone = %q, %q, want empty", cfg.Web.Language, cfg.Web.Timezone)
+	}
+	if cfg.Web.TrackingPixels != "flag" {
+		t.Errorf("default web.tracking_pixels = %q, want flag", cfg.Web.TrackingPixels)
+	}
+	if f := cfg.Web.SecondFactor; f.TOTPSecrets != nil || f.Roles != nil || f.Session != 12*time.Hour {
+		t.Errorf("default web.second_factor = %+v, want no secrets, all roles, 12h", f)
+	}
+	if cfg.Web.PublicURL != "" || cfg.SLA.Digest != (DigestConfig{}) || cfg.IMAP.AlertDigest != (DigestConfig{}) {
+		t.Errorf("default web.public_url, sla.digest, imap.alert_digest = %q, %+v, %+v, want unset", cfg.Web.PublicURL, cfg.SLA.Digest, cfg.IMAP.AlertDigest)
+	}
 	if cfg.DB.Path != "mailescrow.db" {
 		t.Errorf("default db.path = %q, want %q", cfg.DB.Path, "mailescrow.db")
 	}
+	if cfg.DB.Driver != "sqlite" {
+		t.Errorf("default db.driver = %q, want sqlite", cfg.DB.Driver)
+	}
+	if cfg.DB.QueryTimeout != 30*time.Second {
+		t.Errorf("default db.query_timeout = %v, want 30s", cfg.DB.QueryTimeout)
+	}
+	if cfg.DB.MaintenanceInterval != 24*time.Hour {
+		t.Errorf("default db.maintenance_interval = %v, want 24h", cfg.DB.MaintenanceInterval)
+	}
+	if cfg.SLA.MaxPendingAge != 0 {
+		t.Errorf("default sla.max_pending_age = %v, want 0 (disabled)", cfg.SLA.MaxPendingAge)
+	}
+	if cfg.SLA.CheckInterval != time.Minute {
+		t.Errorf("default sla.check_interval = %v, want 1m", cfg.SLA.CheckInterval)
+	}
+	if !reflect.DeepEqual(cfg.ReviewMail, ReviewMailConfig{Interval: 15 * time.Minute, CheckInterval: time.Minute}) {
+		t.Errorf("default review_mail = %+v, want disabled, at most every 15m, checked every minute", cfg.ReviewMail)
+	}
+	if cfg.SMTP.Listen != "" {
+		t.Errorf("default smtp.listen = %q, want empty (disabled)", cfg.SMTP.Listen)
+	}
+	if cfg.SMTP.MaxMessageBytes != 25<<20 {
+		t.Errorf("default smtp.max_message_bytes = %d, want 25 MiB", cfg.SMTP.MaxMessageBytes)
+	}
+	if cfg.SMTP.MaxRecipients != 100 {
+		t.Errorf("default smtp.max_recipients = %d, want 100", cfg.SMTP.MaxRecipients)
+	}
+	if cfg.SMTP.MaxConnections != 100 || cfg.SMTP.ReadTimeout != 5*time.Minute || cfg.SMTP.WriteTimeout != time.Minute || cfg.SMTP.MaxMessageRate != 0 {
+		t.Errorf("default smtp limits = %d/%s/%s/%d, want 100/5m/1m/0", cfg.SMTP.MaxConnections, cfg.SMTP.ReadTimeout, cfg.SMTP.WriteTimeout, cfg.SMTP.MaxMessageRate)
+	}
+	if cfg.SMTP.TLSCertFile != "" || cfg.SMTP.TLSKeyFile != "" || cfg.SMTP.ClientCAFile != "" {
+		t.Errorf("default smtp tls = %q/%q/%q, want empty (no STARTTLS)", cfg.SMTP.TLSCertFile, cfg.SMTP.TLSKeyFile, cfg.SMTP.ClientCAFile)
+	}
+	if cfg.SMTP.LMTPListen != "" {
+		t.Errorf("default smtp.lmtp_listen = %q, want empty (disabled)", cfg.SMTP.LMTPListen)
+	}
+	if cfg.SMTP.Internal.Listen != "" || cfg.SMTP.Internal.Project != "internal" {
+		t.Errorf("default smtp.internal = %+v, want disabled with project internal", cfg.SMTP.Internal)
+	}
+	if cfg.IMAP.MaxBackoff != 15*time.Minute || cfg.IMAP.FailureThreshold != 5 || cfg.IMAP.AlertAfter != 15*time.Minute {
+		t.Errorf("default imap resilience = %s/%d/%s, want 15m/5/15m", cfg.IMAP.MaxBackoff, cfg.IMAP.FailureThreshold, cfg.IMAP.AlertAfter)
+	}
+	if cfg.Contacts.AutoApproveAfter != 0 {
+		t.Errorf("default contacts.auto_approve_after = %d, want 0 (disabled)", cfg.Contacts.AutoApproveAfter)
+	}
+	if cfg.Signatures != (SignaturesConfig{}) {
+		t.Errorf("default signatures = %+v, want no trust anchors", cfg.Signatures)
+	}
+	if cfg.Bounce != (BounceConfig{Policy: "authenticated"}) {
+		t.Errorf("default bounce = %+v, want disabled with authenticated policy", cfg.Bounce)
+	}
+	if cfg.Recipients.CheckMX {
+		t.Errorf("default recipients.check_mx = true, want false")
+	}
+	if cfg.Reputation.DNSBLs != nil || cfg.Reputation.URIBLs != nil {
+		t.Errorf("default reputation = %+v, want no block lists", cfg.Reputation)
+	}
+	if !reflect.DeepEqual(cfg.Redaction, RedactionConfig{Raw: "keep"}) {
+		t.Errorf("default redaction = %+v, want no patterns, raw messages kept", cfg.Redaction)
+	}
+	if cfg.Journal != (JournalConfig{}) {
+		t.Errorf("default journal = %+v, want disabled", cfg.Journal)
+	}
+	if cfg.Archive != (ArchiveConfig{}) {
+		t.Errorf("default archive = %+v, want disabled", cfg.Archive)
+	}
+	if cfg.Retention != (RetentionConfig{Interval: time.Hour}) {
+		t.Errorf("default retention = %+v, want everything kept, checked hourly", cfg.Retention)
+	}
+	if cfg.Tracing != (TracingConfig{SampleRatio: 1}) {
+		t.Errorf("default tracing = %+v, want disabled, sampling everything", cfg.Tracing)
+	}
+	if cfg.Network != (NetworkConfig{}) {
+		t.Errorf("default network = %+v, want direct connections", cfg.Network)
+	}
+	if cfg.Webhooks.Secret != "" {
+		t.Errorf("default webhooks.secret = %q, want unsigned", cfg.Webhooks.Secret)
+	}
+	if cfg.Webhooks.AllowPrivate {
+		t.Error("default webhooks.allow_private = true, want internal addresses refused")
+	}
+	if cfg.Tracking != (TrackingConfig{}) {
+		t.Errorf("default tracking = %+v, want disabled", cfg.Tracking)
+	}
+	if cfg.Unsubscribe != (UnsubscribeConfig{Tag: "marketing"}) {
+		t.Errorf("default unsubscribe = %+v, want disabled for marketing", cfg.Unsubscribe)
+	}
+	if cfg.API != (APIConfig{ConsumeMode: "delete"}) {
+		t.Errorf("default api = %+v, want fetched mail deleted", cfg.API)
+	}
+	if cfg.Quota != (QuotaConfig{Action: "hold"}) {
+		t.Errorf("default quota = %+v, want unlimited with hold action", cfg.Quota)
+	}
+	if cfg.Suppression.Action != "hold" {
+		t.Errorf("default suppression action = %q, want hold", cfg.Suppression.Action)
+	}
+	if cfg.AutoReplies != (AutoRepliesConfig{Action: "hold", LoopAfter: 3, LoopWindow: time.Hour}) {
+		t.Errorf("default auto_replies = %+v, want held with loops after 3 in an hour", cfg.AutoReplies)
+	}
 }
 
 func TestLoadMissingFileIsOK(t *testing.T) {
@@ -179,10 +741,117 @@ func TestEnvVarsOverrideDefaults(t *testing.T) {
 	t.Setenv("MAILESCROW_RELAY_PASSWORD", "relayenvpass")
 	t.Setenv("MAILESCROW_RELAY_TLS", "true")
 	t.Setenv("MAILESCROW_RELAY_FROM_NAME", "Env Service")
+	t.Setenv("MAILESCROW_RELAY_STAMP_HEADERS", "true")
+	t.Setenv("MAILESCROW_RELAY_STRIP_HEADERS", "Received, X-Internal ,")
+	t.Setenv("MAILESCROW_RELAY_DSN_NOTIFY", "success,failure")
+	t.Setenv("MAILESCROW_RELAY_DSN_RET", "full")
+	t.Setenv("MAILESCROW_RELAY_TIMEOUT", "10s")
+	t.Setenv("MAILESCROW_RELAY_TLS_OPTIONS_MIN_VERSION", "1.2")
+	t.Setenv("MAILESCROW_RELAY_TLS_OPTIONS_CA_FILE", "/run/secrets/ca.pem")
+	t.Setenv("MAILESCROW_RELAY_TLS_OPTIONS_CERT_FILE", "/run/secrets/client.crt")
+	t.Setenv("MAILESCROW_RELAY_TLS_OPTIONS_KEY_FILE", "/run/secrets/client.key")
+	t.Setenv("MAILESCROW_IMAP_TLS_OPTIONS_INSECURE_SKIP_VERIFY", "true")
+	t.Setenv("MAILESCROW_RELAY_MAX_PER_MINUTE", "5")
+	t.Setenv("MAILESCROW_RELAY_MAX_PER_HOUR", "100")
+	t.Setenv("MAILESCROW_RELAY_PROVIDER", "blackhole")
+	t.Setenv("MAILESCROW_RELAY_SINK_DIR", "/tmp/sink")
 	t.Setenv("MAILESCROW_WEB_LISTEN", ":9080")
 	t.Setenv("MAILESCROW_API_LISTEN", ":9081")
 	t.Setenv("MAILESCROW_WEB_PASSWORD", "envpass123")
+	t.Setenv("MAILESCROW_WEB_TEMPLATES_DIR", "/tmp/templates")
+	t.Setenv("MAILESCROW_WEB_REQUIRE_API_TOKEN", "true")
+	t.Setenv("MAILESCROW_WEB_DEBUG", "true")
+	t.Setenv("MAILESCROW_WEB_SINGLE_LISTENER", "true")
+	t.Setenv("MAILESCROW_WEB_API_V2", "true")
+	t.Setenv("MAILESCROW_API_CONSUME_MODE", "keep")
+	t.Setenv("MAILESCROW_WEB_BASE_PATH", "/escrow")
+	t.Setenv("MAILESCROW_WEB_TRUSTED_PROXIES", "127.0.0.1, 172.16.0.0/12")
+	t.Setenv("MAILESCROW_WEB_LANGUAGE", "fr")
+	t.Setenv("MAILESCROW_WEB_TIMEZONE", "America/New_York")
+	t.Setenv("MAILESCROW_DB_DRIVER", "memory")
 	t.Setenv("MAILESCROW_DB_PATH", "/tmp/env.db")
+	t.Setenv("MAILESCROW_DB_QUERY_TIMEOUT", "2s")
+	t.Setenv("MAILESCROW_DB_MAINTENANCE_INTERVAL", "0")
+	t.Setenv("MAILESCROW_SLA_MAX_PENDING_AGE", "2h")
+	t.Setenv("MAILESCROW_SLA_CHECK_INTERVAL", "30s")
+	t.Setenv("MAILESCROW_SLA_WEBHOOK_URL", "https://env.example.com/hook")
+	t.Setenv("MAILESCROW_SLA_DIGEST_INTERVAL", "5m")
+	t.Setenv("MAILESCROW_SLA_DIGEST_MAX", "10")
+	t.Setenv("MAILESCROW_REVIEW_MAIL_TO", "env-reviewers@example.com")
+	t.Setenv("MAILESCROW_REVIEW_MAIL_THRESHOLD", "5")
+	t.Setenv("MAILESCROW_REVIEW_MAIL_INTERVAL", "1h")
+	t.Setenv("MAILESCROW_REVIEW_MAIL_CHECK_INTERVAL", "30s")
+	t.Setenv("MAILESCROW_SMTP_LISTEN", ":2526")
+	t.Setenv("MAILESCROW_SMTP_USERNAME", "envapp")
+	t.Setenv("MAILESCROW_SMTP_PASSWORD", "envsmtp")
+	t.Setenv("MAILESCROW_SMTP_MAX_MESSAGE_BYTES", "2048")
+	t.Setenv("MAILESCROW_SMTP_MAX_RECIPIENTS", "10")
+	t.Setenv("MAILESCROW_SMTP_MAX_CONNECTIONS", "20")
+	t.Setenv("MAILESCROW_SMTP_READ_TIMEOUT", "1m")
+	t.Setenv("MAILESCROW_SMTP_WRITE_TIMEOUT", "0")
+	t.Setenv("MAILESCROW_SMTP_MAX_MESSAGE_RATE", "30")
+	t.Setenv("MAILESCROW_SMTP_LMTP_LISTEN", "127.0.0.1:2424")
+	t.Setenv("MAILESCROW_SMTP_TLS_CERT_FILE", "/env/smtp.crt")
+	t.Setenv("MAILESCROW_SMTP_TLS_KEY_FILE", "/env/smtp.key")
+	t.Setenv("MAILESCROW_SMTP_CLIENT_CA_FILE", "/env/ca.pem")
+	t.Setenv("MAILESCROW_SMTP_INTERNAL_LISTEN", ":2525")
+	t.Setenv("MAILESCROW_SMTP_INTERNAL_ALLOWED_NETWORKS", "10.0.0.0/8, fd00::/8")
+	t.Setenv("MAILESCROW_SMTP_INTERNAL_PROJECT", "apps")
+	t.Setenv("MAILESCROW_IMAP_MAX_BACKOFF", "30m")
+	t.Setenv("MAILESCROW_IMAP_FAILURE_THRESHOLD", "8")
+	t.Setenv("MAILESCROW_IMAP_ALERT_AFTER", "1h")
+	t.Setenv("MAILESCROW_IMAP_ALERT_WEBHOOK_URL", "https://env.example.com/imap")
+	t.Setenv("MAILESCROW_IMAP_ALERT_DIGEST_INTERVAL", "30m")
+	t.Setenv("MAILESCROW_IMAP_ALERT_DIGEST_MAX", "3")
+	t.Setenv("MAILESCROW_WEB_PUBLIC_URL", "https://escrow.example.com/")
+	t.Setenv("MAILESCROW_WEB_TRACKING_PIXELS", "strip")
+	t.Setenv("MAILESCROW_WEB_SECOND_FACTOR_ROLES", "admin")
+	t.Setenv("MAILESCROW_WEB_SECOND_FACTOR_SESSION", "1h")
+	t.Setenv("MAILESCROW_IMAP_SENT_FOLDER", "mailescrow/sent")
+	t.Setenv("MAILESCROW_IMAP_RECONCILE_INTERVAL", "0s")
+	t.Setenv("MAILESCROW_IMAP_RECONCILE_FIX", "true")
+	t.Setenv("MAILESCROW_CONTACTS_AUTO_APPROVE_AFTER", "4")
+	t.Setenv("MAILESCROW_SIGNATURES_SMIME_TRUST_ANCHORS", "/env/ca.pem")
+	t.Setenv("MAILESCROW_SIGNATURES_PGP_KEYRING", "/env/keyring.asc")
+	t.Setenv("MAILESCROW_BOUNCE_ENABLED", "true")
+	t.Setenv("MAILESCROW_BOUNCE_POLICY", "always")
+	t.Setenv("MAILESCROW_BOUNCE_TEMPLATE", "/env/bounce.txt")
+	t.Setenv("MAILESCROW_RECIPIENTS_CHECK_MX", "true")
+	t.Setenv("MAILESCROW_REPUTATION_DNSBLS", "bl.example, ")
+	t.Setenv("MAILESCROW_REPUTATION_URIBLS", "dbl.example,uribl.example")
+	t.Setenv("MAILESCROW_REDACTION_PATTERNS", "ssn")
+	t.Setenv("MAILESCROW_REDACTION_RAW", "drop")
+	t.Setenv("MAILESCROW_REDACTION_KEY", "ZW52a2V5")
+	t.Setenv("MAILESCROW_JOURNAL_ADDRESS", "env-archive@example.com")
+	t.Setenv("MAILESCROW_JOURNAL_MAILBOX", "EnvArchive")
+	t.Setenv("MAILESCROW_ARCHIVE_FORMAT", "mbox")
+	t.Setenv("MAILESCROW_ARCHIVE_PATH", "/env/archive")
+	t.Setenv("MAILESCROW_ARCHIVE_ROTATE", "never")
+	t.Setenv("MAILESCROW_RETENTION_HISTORY", "180d")
+	t.Setenv("MAILESCROW_RETENTION_REJECTED", "7d")
+	t.Setenv("MAILESCROW_RETENTION_AUDIT", "2y")
+	t.Setenv("MAILESCROW_RETENTION_INTERVAL", "30m")
+	t.Setenv("MAILESCROW_TRACING_ENDPOINT", "http://localhost:4318")
+	t.Setenv("MAILESCROW_TRACING_SAMPLE_RATIO", "0.5")
+	t.Setenv("MAILESCROW_NETWORK_PROXY_URL", "http://proxy.example.com:3128")
+	t.Setenv("MAILESCROW_WEBHOOKS_SECRET", "envhooksecret")
+	t.Setenv("MAILESCROW_WEBHOOKS_ALLOW_PRIVATE", "true")
+	t.Setenv("MAILESCROW_TRACKING_ENABLED", "true")
+	t.Setenv("MAILESCROW_TRACKING_URL", "https://env-links.example.com")
+	t.Setenv("MAILESCROW_UNSUBSCRIBE_ENABLED", "true")
+	t.Setenv("MAILESCROW_UNSUBSCRIBE_URL", "https://env-optout.example.com")
+	t.Setenv("MAILESCROW_UNSUBSCRIBE_TAG", "promo")
+	t.Setenv("MAILESCROW_QUOTA_PER_HOUR", "5")
+	t.Setenv("MAILESCROW_QUOTA_PER_DAY", "50")
+	t.Setenv("MAILESCROW_QUOTA_ACTION", "refuse")
+	t.Setenv("MAILESCROW_SUPPRESSION_ACTION", "refuse")
+	t.Setenv("MAILESCROW_AUTO_REPLIES_ACTION", "approve")
+	t.Setenv("MAILESCROW_AUTO_REPLIES_LOOP_AFTER", "0")
+	t.Setenv("MAILESCROW_AUTO_REPLIES_LOOP_WINDOW", "2h")
+	t.Setenv("MAILESCROW_ROUTES", "support@*=support, billing@*=billing")
+	t.Setenv("MAILESCROW_IMAP_WATCH_FOLDERS", "INBOX, Support=support")
+	t.Setenv("MAILESCROW_IMAP_SPAM_FOLDER", "[Gmail]/Spam")
+	t.Setenv("MAILESCROW_IMAP_ENVELOPE_HEADER", "Envelope-To")
 
 	cfg, err := Load("")
 	if err != nil {
@@ -225,6 +894,33 @@ func TestEnvVarsOverrideDefaults(t *testing.T) {
 	if cfg.Relay.FromName != "Env Service" {
 		t.Errorf("relay.from_name = %q, want Env Service", cfg.Relay.FromName)
 	}
+	if !cfg.Relay.StampHeaders {
+		t.Error("relay.stamp_headers = false, want true")
+	}
+	if len(cfg.Relay.StripHeaders) != 2 || cfg.Relay.StripHeaders[1] != "X-Internal" {
+		t.Errorf("relay.strip_headers = %v, want [Received X-Internal]", cfg.Relay.StripHeaders)
+	}
+	if len(cfg.Relay.DSNNotify) != 2 || cfg.Relay.DSNNotify[0] != "success" {
+		t.Errorf("relay.dsn_notify = %v, want [success failure]", cfg.Relay.DSNNotify)
+	}
+	if cfg.Relay.DSNRet != "full" {
+		t.Errorf("relay.dsn_ret = %q, want full", cfg.Relay.DSNRet)
+	}
+	if cfg.Relay.MaxPerMinute != 5 || cfg.Relay.MaxPerHour != 100 {
+		t.Errorf("relay.max_per_minute/max_per_hour = %d/%d, want 5/100 from env", cfg.Relay.MaxPerMinute, cfg.Relay.MaxPerHour)
+	}
+	if cfg.Relay.Provider != "blackhole" || cfg.Relay.SinkDir != "/tmp/sink" {
+		t.Errorf("relay.provider/sink_dir = %q/%q, want blackhole and /tmp/sink from env", cfg.Relay.Provider, cfg.Relay.SinkDir)
+	}
+	if cfg.Relay.Timeout != 10*time.Second {
+		t.Errorf("relay.timeout = %v, want 10s from env", cfg.Relay.Timeout)
+	}
+	if want := (TLSOptionsConfig{MinVersion: "1.2", CAFile: "/run/secrets/ca.pem", CertFile: "/run/secrets/client.crt", KeyFile: "/run/secrets/client.key"}); cfg.Relay.TLSOptions != want {
+		t.Errorf("relay.tls_options = %+v, want %+v from env", cfg.Relay.TLSOptions, want)
+	}
+	if !cfg.IMAP.TLSOptions.InsecureSkipVerify {
+		t.Error("imap.tls_options.insecure_skip_verify not set from env")
+	}
 	if cfg.Web.Listen != ":9080" {
 		t.Errorf("web.listen = %q, want :9080", cfg.Web.Listen)
 	}
@@ -234,9 +930,157 @@ func TestEnvVarsOverrideDefaults(t *testing.T) {
 	if cfg.Web.Password != "envpass123" {
 		t.Errorf("web.password = %q, want envpass123", cfg.Web.Password)
 	}
+	if cfg.Web.TemplatesDir != "/tmp/templates" {
+		t.Errorf("web.templates_dir = %q, want /tmp/templates", cfg.Web.TemplatesDir)
+	}
+	if !cfg.Web.RequireAPIToken {
+		t.Error("web.require_api_token = false, want true from env")
+	}
+	if !cfg.Web.Debug {
+		t.Error("web.debug = false, want true from env")
+	}
+	if !cfg.Web.APIV2 {
+		t.Error("web.api_v2 = false, want true from env")
+	}
+	if cfg.Web.Language != "fr" || cfg.Web.Timezone != "America/New_York" {
+		t.Errorf("web.language, web.timezone = %q, %q, want fr, America/New_York from env", cfg.Web.Language, cfg.Web.Timezone)
+	}
+	if !cfg.Web.SingleListener {
+		t.Error("web.single_listener = false, want true from env")
+	}
+	if cfg.Web.BasePath != "/escrow" {
+		t.Errorf("web.base_path = %q, want /escrow", cfg.Web.BasePath)
+	}
+	if len(cfg.Web.TrustedProxies) != 2 || cfg.Web.TrustedProxies[1] != "172.16.0.0/12" {
+		t.Errorf("web.trusted_proxies = %v, want [127.0.0.1 172.16.0.0/12]", cfg.Web.TrustedProxies)
+	}
 	if cfg.DB.Path != "/tmp/env.db" {
 		t.Errorf("db.path = %q, want /tmp/env.db", cfg.DB.Path)
 	}
+	if cfg.DB.Driver != "memory" {
+		t.Errorf("db.driver = %q, want memory from env", cfg.DB.Driver)
+	}
+	if cfg.DB.QueryTimeout != 2*time.Second {
+		t.Errorf("db.query_timeout = %v, want 2s from env", cfg.DB.QueryTimeout)
+	}
+	if cfg.DB.MaintenanceInterval != 0 {
+		t.Errorf("db.maintenance_interval = %v, want 0 from env", cfg.DB.MaintenanceInterval)
+	}
+	if cfg.SLA.MaxPendingAge != 2*time.Hour {
+		t.Errorf("sla.max_pending_age = %v, want 2h", cfg.SLA.MaxPendingAge)
+	}
+	if cfg.SLA.CheckInterval != 30*time.Second {
+		t.Errorf("sla.check_interval = %v, want 30s", cfg.SLA.CheckInterval)
+	}
+	if cfg.SLA.WebhookURL != "https://env.example.com/hook" {
+		t.Errorf("sla.webhook_url = %q, want https://env.example.com/hook", cfg.SLA.WebhookURL)
+	}
+	if cfg.SLA.Digest.Interval != 5*time.Minute || cfg.SLA.Digest.Max != 10 {
+		t.Errorf("sla.digest = %+v, want 5m, max 10 from env", cfg.SLA.Digest)
+	}
+	if want := (ReviewMailConfig{To: []string{"env-reviewers@example.com"}, Threshold: 5, Interval: time.Hour, CheckInterval: 30 * time.Second}); !reflect.DeepEqual(cfg.ReviewMail, want) {
+		t.Errorf("review_mail = %+v, want %+v from env", cfg.ReviewMail, want)
+	}
+	if len(cfg.Routes) != 2 || cfg.Routes[1] != (RouteConfig{Match: "billing@*", Queue: "billing"}) {
+		t.Errorf("routes = %+v, want support@*=support, billing@*=billing", cfg.Routes)
+	}
+	if want := []WatchFolderConfig{{Folder: "INBOX"}, {Folder: "Support", Queue: "support"}}; !reflect.DeepEqual(cfg.IMAP.WatchFolders, want) {
+		t.Errorf("imap.watch_folders = %+v, want %+v from env", cfg.IMAP.WatchFolders, want)
+	}
+	if cfg.IMAP.SpamFolder != "[Gmail]/Spam" {
+		t.Errorf("imap.spam_folder = %q, want [Gmail]/Spam from env", cfg.IMAP.SpamFolder)
+	}
+	if cfg.IMAP.EnvelopeHeader != "Envelope-To" {
+		t.Errorf("imap.envelope_header = %q, want Envelope-To from env", cfg.IMAP.EnvelopeHeader)
+	}
+	if cfg.IMAP.MaxBackoff != 30*time.Minute || cfg.IMAP.FailureThreshold != 8 || cfg.IMAP.AlertAfter != time.Hour {
+		t.Errorf("imap resilience = %s/%d/%s, want 30m/8/1h", cfg.IMAP.MaxBackoff, cfg.IMAP.FailureThreshold, cfg.IMAP.AlertAfter)
+	}
+	if cfg.IMAP.AlertWebhookURL != "https://env.example.com/imap" {
+		t.Errorf("imap.alert_webhook_url = %q", cfg.IMAP.AlertWebhookURL)
+	}
+	if cfg.IMAP.AlertDigest.Interval != 30*time.Minute || cfg.IMAP.AlertDigest.Max != 3 {
+		t.Errorf("imap.alert_digest = %+v, want 30m, max 3 from env", cfg.IMAP.AlertDigest)
+	}
+	if cfg.Web.PublicURL != "https://escrow.example.com/" {
+		t.Errorf("web.public_url = %q from env", cfg.Web.PublicURL)
+	}
+	if cfg.Web.TrackingPixels != "strip" {
+		t.Errorf("web.tracking_pixels = %q, want strip from env", cfg.Web.TrackingPixels)
+	}
+	if !reflect.DeepEqual(cfg.Web.SecondFactor.Roles, []string{"admin"}) || cfg.Web.SecondFactor.Session != time.Hour {
+		t.Errorf("web.second_factor = %+v, want admin, 1h from env", cfg.Web.SecondFactor)
+	}
+	if cfg.IMAP.SentFolder != "mailescrow/sent" {
+		t.Errorf("imap.sent_folder = %q, want mailescrow/sent", cfg.IMAP.SentFolder)
+	}
+	if cfg.IMAP.ReconcileInterval != 0 || !cfg.IMAP.ReconcileFix {
+		t.Errorf("imap reconcile = %s/%t, want 0s/true", cfg.IMAP.ReconcileInterval, cfg.IMAP.ReconcileFix)
+	}
+	if cfg.Contacts.AutoApproveAfter != 4 {
+		t.Errorf("contacts.auto_approve_after = %d, want 4", cfg.Contacts.AutoApproveAfter)
+	}
+	if cfg.Signatures != (SignaturesConfig{SMIMETrustAnchors: "/env/ca.pem", PGPKeyring: "/env/keyring.asc"}) {
+		t.Errorf("signatures = %+v", cfg.Signatures)
+	}
+	if cfg.Bounce != (BounceConfig{Enabled: true, Policy: "always", Template: "/env/bounce.txt"}) {
+		t.Errorf("bounce = %+v", cfg.Bounce)
+	}
+	if !cfg.Recipients.CheckMX {
+		t.Errorf("recipients.check_mx = false, want true from env")
+	}
+	if want := (ReputationConfig{DNSBLs: []string{"bl.example"}, URIBLs: []string{"dbl.example", "uribl.example"}}); !reflect.DeepEqual(cfg.Reputation, want) {
+		t.Errorf("reputation = %+v, want %+v from env", cfg.Reputation, want)
+	}
+	if want := (RedactionConfig{Patterns: []string{"ssn"}, Raw: "drop", Key: "ZW52a2V5"}); !reflect.DeepEqual(cfg.Redaction, want) {
+		t.Errorf("redaction = %+v, want %+v from env", cfg.Redaction, want)
+	}
+	if cfg.Journal != (JournalConfig{Address: "env-archive@example.com", Mailbox: "EnvArchive"}) {
+		t.Errorf("journal = %+v", cfg.Journal)
+	}
+	if cfg.Archive != (ArchiveConfig{Format: "mbox", Path: "/env/archive", Rotate: "never"}) {
+		t.Errorf("archive = %+v", cfg.Archive)
+	}
+	wantRetention := RetentionConfig{History: Period(180 * 24 * time.Hour), Rejected: Period(7 * 24 * time.Hour), Audit: Period(2 * 365 * 24 * time.Hour), Interval: 30 * time.Minute}
+	if cfg.Retention != wantRetention {
+		t.Errorf("retention = %+v, want %+v", cfg.Retention, wantRetention)
+	}
+	if cfg.Tracing != (TracingConfig{Endpoint: "http://localhost:4318", SampleRatio: 0.5}) {
+		t.Errorf("tracing = %+v", cfg.Tracing)
+	}
+	if cfg.Network.ProxyURL != "http://proxy.example.com:3128" {
+		t.Errorf("network.proxy_url = %q from env", cfg.Network.ProxyURL)
+	}
+	if cfg.Webhooks.Secret != "envhooksecret" {
+		t.Errorf("webhooks.secret = %q, want envhooksecret from env", cfg.Webhooks.Secret)
+	}
+	if !cfg.Webhooks.AllowPrivate {
+		t.Error("webhooks.allow_private = false, want true from env")
+	}
+	if cfg.Tracking != (TrackingConfig{Enabled: true, URL: "https://env-links.example.com"}) {
+		t.Errorf("tracking = %+v", cfg.Tracking)
+	}
+	if cfg.Unsubscribe != (UnsubscribeConfig{Enabled: true, URL: "https://env-optout.example.com", Tag: "promo"}) {
+		t.Errorf("unsubscribe = %+v", cfg.Unsubscribe)
+	}
+	if cfg.API.ConsumeMode != "keep" {
+		t.Errorf("api.consume_mode = %q, want keep from env", cfg.API.ConsumeMode)
+	}
+	if cfg.Quota != (QuotaConfig{PerHour: 5, PerDay: 50, Action: "refuse"}) {
+		t.Errorf("quota = %+v", cfg.Quota)
+	}
+	if cfg.Suppression.Action != "refuse" {
+		t.Errorf("suppression action = %q, want refuse", cfg.Suppression.Action)
+	}
+	if cfg.AutoReplies != (AutoRepliesConfig{Action: "approve", LoopWindow: 2 * time.Hour}) {
+		t.Errorf("auto_replies = %+v", cfg.AutoReplies)
+	}
+	if !reflect.DeepEqual(cfg.SMTP, SMTPConfig{Listen: ":2526", Username: "envapp", Password: "envsmtp", MaxMessageBytes: 2048, MaxRecipients: 10,
+		MaxConnections: 20, ReadTimeout: time.Minute, MaxMessageRate: 30, LMTPListen: "127.0.0.1:2424",
+		TLSCertFile: "/env/smtp.crt", TLSKeyFile: "/env/smtp.key", ClientCAFile: "/env/ca.pem",
+		Internal: SMTPInternalConfig{Listen: ":2525", AllowedNetworks: []string{"10.0.0.0/8", "fd00::/8"}, Project: "apps"}}) {
+		t.Errorf("smtp = %+v", cfg.SMTP)
+	}
 }
 
 func TestEnvVarsOverrideConfigFile(t *testing.T) {
@@ -256,3 +1100,28 @@ func TestEnvVarsOverrideConfigFile(t *testing.T) {
 		t.Errorf("imap.host = %q, want imap.env.com (env should override file)", cfg.IMAP.Host)
 	}
 }
+
+func TestParsePeriod(t *testing.T) {
+	valid := map[string]time.Duration{
+		"90d": 90 * 24 * time.Hour,
+		"1y":  365 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+		"0":   0,
+	}
+	for in, want := range valid {
+		p, err := ParsePeriod(in)
+		if err != nil || time.Duration(p) != want {
+			t.Errorf("ParsePeriod(%q) = %v, %v, want %v", in, p, err, want)
+		}
+	}
+	for _, in := range []string{"", "d", "-3d", "1.5y", "soon"} {
+		if _, err := ParsePeriod(in); err == nil {
+			t.Errorf("ParsePeriod(%q) succeeded, want error", in)
+		}
+	}
+	for p, want := range map[Period]string{Period(2 * 365 * 24 * time.Hour): "2y", Period(30 * 24 * time.Hour): "30d", Period(36 * time.Hour): "36h0m0s", 0: "0"} {
+		if got := p.String(); got != want {
+			t.Errorf("Period(%d).String() = %q, want %q", p, got, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Period is a duration that may also be written in days ("90d") or years
+// ("1y", 365 days), as retention periods usually are. Other values use
+// time.ParseDuration syntax.
+type Period time.Duration
+
+const (
+	day  = 24 * time.Hour
+	year = 365 * day
+)
+
+// ParsePeriod parses "90d", "1y" or any time.ParseDuration string.
+func ParsePeriod(s string) (Period, error) {
+	for suffix, unit := range map[string]time.Duration{"d": day, "y": year} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid period %q", s)
+			}
+			return Period(time.Duration(count) * unit), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid period %q", s)
+	}
+	return Period(d), nil
+}
+
+// UnmarshalYAML parses a Period from a YAML string.
+func (p *Period) UnmarshalYAML(n *yaml.Node) error {
+	parsed, err := ParsePeriod(n.Value)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// MarshalYAML writes a Period as it is parsed, e.g. "90d".
+func (p Period) MarshalYAML() (any, error) {
+	return p.String(), nil
+}
+
+// String formats whole years and days as "1y" and "90d".
+func (p Period) String() string {
+	d := time.Duration(p)
+	switch {
+	case d == 0:
+		return "0"
+	case d%year == 0:
+		return fmt.Sprintf("%dy", d/year)
+	case d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	}
+	return d.String()
+}
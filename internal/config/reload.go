@@ -0,0 +1,73 @@
+package config
+
+import "strings"
+
+// reloadable lists the settings a running server applies on reload (SIGHUP or
+// POST /api/config/reload), as exact keys or prefixes ending in "." or "[".
+// Everything else, notably listen addresses and the database, is only read
+// at startup.
+var reloadable = []string{
+	"rules[",
+	"policies[",
+	"quota.",
+	"suppression.action",
+	"auto_replies.action",
+	"smtp.users[",
+	"projects[",
+	"imap.poll_interval",
+	"imap.alert_webhook_url",
+	"imap.alert_digest.",
+	"imap.sent_folder",
+	"sla.webhook_url",
+	"sla.digest.",
+	"review_mail.",
+	"webhooks.secret",
+	"journal.mailbox",
+	"imap.watch_folders[",
+	"imap.spam_folder",
+	"retention.history",
+	"retention.rejected",
+	"retention.audit",
+}
+
+// Reloadable reports whether the setting with the given dotted key takes
+// effect on reload, without a restart.
+func Reloadable(key string) bool {
+	for _, r := range reloadable {
+		if key == r || (strings.HasSuffix(r, ".") || strings.HasSuffix(r, "[")) && strings.HasPrefix(key, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff compares two configurations and returns the dotted keys that differ,
+// split into those a reload applies and those that need a restart. Secret
+// values are compared but never returned, only their keys.
+func Diff(old, updated *Config) (reloaded, restart []string) {
+	before := make(map[string]string)
+	for _, s := range old.values() {
+		before[s.Key] = s.Value
+	}
+	var changed []string
+	for _, s := range updated.values() {
+		if v, ok := before[s.Key]; !ok || v != s.Value {
+			changed = append(changed, s.Key)
+		}
+		delete(before, s.Key)
+	}
+	for _, s := range old.values() {
+		if _, removed := before[s.Key]; removed {
+			changed = append(changed, s.Key)
+		}
+	}
+
+	for _, key := range changed {
+		if Reloadable(key) {
+			reloaded = append(reloaded, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	return reloaded, restart
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Setting is one flattened configuration value, keyed by its dotted YAML path
+// (e.g. "imap.poll_interval").
+type Setting struct {
+	Key   string
+	Value string
+}
+
+// redacted replaces the value of any field tagged `secret:"true"`.
+const redacted = "(redacted)"
+
+// Settings flattens c into dotted YAML keys for display. Fields tagged
+// `secret:"true"` are redacted when set.
+func (c *Config) Settings() []Setting {
+	var out []Setting
+	flatten(reflect.ValueOf(*c), "", false, false, &out)
+	return out
+}
+
+// values flattens c like Settings, but without redacting secrets.
+func (c *Config) values() []Setting {
+	var out []Setting
+	flatten(reflect.ValueOf(*c), "", false, true, &out)
+	return out
+}
+
+func flatten(v reflect.Value, prefix string, secret, reveal bool, out *[]Setting) {
+	secret = secret && !reveal
+	if d, ok := v.Interface().(time.Duration); ok {
+		*out = append(*out, Setting{Key: prefix, Value: redact(d.String(), d == 0, secret)})
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			key := name
+			if prefix != "" {
+				key = prefix + "." + name
+			}
+			flatten(v.Field(i), key, secret || f.Tag.Get("secret") == "true", reveal, out)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := range v.Len() {
+				flatten(v.Index(i), fmt.Sprintf("%s[%d]", prefix, i), secret, reveal, out)
+			}
+			return
+		}
+		items := make([]string, v.Len())
+		for i := range v.Len() {
+			items[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		*out = append(*out, Setting{Key: prefix, Value: redact(strings.Join(items, ", "), v.Len() == 0, secret)})
+	case reflect.Map:
+		*out = append(*out, Setting{Key: prefix, Value: redact(fmt.Sprint(v.Interface()), v.Len() == 0, secret)})
+	default:
+		*out = append(*out, Setting{Key: prefix, Value: redact(fmt.Sprint(v.Interface()), v.IsZero() && v.Kind() == reflect.String, secret)})
+	}
+}
+
+func redact(value string, empty, secret bool) string {
+	if secret && !empty {
+		return redacted
+	}
+	return value
+}
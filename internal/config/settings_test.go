@@ -0,0 +1,143 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettingsFlattensAndRedacts(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	cfg.IMAP.Password = "imap-secret"
+	cfg.Relay.StripHeaders = []string{"Received", "X-Internal"}
+	cfg.Routes = []RouteConfig{{Match: "support@*", Queue: "support"}}
+	cfg.SMTP.Users = []SMTPUserConfig{{Username: "billing", PasswordHash: "imap-secret"}}
+
+	got := make(map[string]string)
+	for _, s := range cfg.Settings() {
+		got[s.Key] = s.Value
+	}
+
+	want := map[string]string{
+		"imap.port":                   "993",
+		"imap.poll_interval":          "1m0s",
+		"imap.password":               "(redacted)",
+		"relay.password":              "", // empty secrets are shown as empty, not redacted
+		"relay.strip_headers":         "Received, X-Internal",
+		"routes[0].match":             "support@*",
+		"routes[0].queue":             "support",
+		"smtp.users[0].username":      "billing",
+		"smtp.users[0].password_hash": "(redacted)",
+		"db.path":                     "mailescrow.db",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+	for key, value := range got {
+		if value == "imap-secret" {
+			t.Errorf("%s leaks a secret", key)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old, err := Load("")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	updated, _ := Load("")
+	updated.Quota.PerHour = 10
+	updated.IMAP.PollInterval = 0
+	updated.Rules = []RuleConfig{{Name: "ops", Action: "hold"}}
+	updated.Web.Listen = ":9090"
+	updated.DB.Path = "other.db"
+	updated.SMTP.Password = "changed"
+
+	reloaded, restart := Diff(old, updated)
+	if got := strings.Join(reloaded, ","); got != "imap.poll_interval,quota.per_hour,rules[0].name,rules[0].direction,rules[0].sender,rules[0].recipient,rules[0].action,rules[0].tags,rules[0].reputation,rules[0].when" {
+		t.Errorf("reloaded = %s", got)
+	}
+	if got := strings.Join(restart, ","); got != "web.listen,db.path,smtp.password" {
+		t.Errorf("restart = %s, want web.listen,db.path,smtp.password", got)
+	}
+
+	if !Reloadable("smtp.users[0].password_hash") {
+		t.Error("smtp.users is not reloadable")
+	}
+
+	// Removed entries count as changed too.
+	if reloaded, _ := Diff(updated, old); len(reloaded) != 10 {
+		t.Errorf("reloaded after removing the rule = %v", reloaded)
+	}
+}
+
+func TestOverride(t *testing.T) {
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	cfg.Quota.Action = "refuse"
+	cfg.SLA.WebhookURL = "https://hooks.example.com/secret"
+
+	if err := cfg.Override("quota", `{"per_hour": 10}`); err != nil {
+		t.Fatalf("override quota: %v", err)
+	}
+	// The value replaces the whole setting.
+	if cfg.Quota != (QuotaConfig{PerHour: 10}) {
+		t.Errorf("quota = %+v, want only per_hour", cfg.Quota)
+	}
+	if err := cfg.Override("rules", "- name: ops\n  sender: ops@example.com\n  action: approve\n"); err != nil {
+		t.Fatalf("override rules: %v", err)
+	}
+	if len(cfg.Rules) != 1 || cfg.Rules[0].Sender != "ops@example.com" {
+		t.Errorf("rules = %+v", cfg.Rules)
+	}
+	if err := cfg.Override("retention.history", "90d"); err != nil || cfg.Retention.History != Period(90*day) {
+		t.Errorf("retention.history = %v, %v", cfg.Retention.History, err)
+	}
+	if err := cfg.Override("review_mail", `{"to": ["oncall@example.com"], "interval": "30m"}`); err != nil {
+		t.Fatalf("override review_mail: %v", err)
+	}
+	if len(cfg.ReviewMail.To) != 1 || cfg.ReviewMail.Interval != 30*time.Minute || cfg.ReviewMail.Threshold != 0 {
+		t.Errorf("review_mail = %+v", cfg.ReviewMail)
+	}
+	if err := cfg.Override("sla.digest", "interval: 1h\nmax: 50\n"); err != nil || cfg.SLA.Digest != (DigestConfig{Interval: time.Hour, Max: 50}) {
+		t.Errorf("sla.digest = %+v, %v", cfg.SLA.Digest, err)
+	}
+
+	for key, value := range map[string]string{
+		"web.listen":         `":9090"`,            // not tunable
+		"quota":              `{"per_minute": 10}`, // unknown field
+		"retention.audit":    "forever",
+		"imap.watch_folders": "",
+	} {
+		var se *SettingError
+		if err := cfg.Override(key, value); !errors.As(err, &se) || se.Key != key {
+			t.Errorf("override %s = %v, want a SettingError", key, err)
+		}
+	}
+
+	if got, secret := cfg.TunableValue("retention.history"); got != "90d\n" || secret {
+		t.Errorf("retention.history = %q, %v", got, secret)
+	}
+	if got, _ := cfg.TunableValue("sla.digest"); got != "interval: 1h0m0s\nmax: 50\n" {
+		t.Errorf("sla.digest = %q", got)
+	}
+	if got, secret := cfg.TunableValue("sla.webhook_url"); got != "(redacted)\n" || !secret {
+		t.Errorf("sla.webhook_url = %q, %v, want it redacted", got, secret)
+	}
+	if got, _ := cfg.TunableValue("imap.alert_webhook_url"); got != "\"\"\n" {
+		t.Errorf("unset imap.alert_webhook_url = %q", got)
+	}
+	for _, key := range Tunable() {
+		if !Reloadable(key) && !Reloadable(key+".") && !Reloadable(key+"[") {
+			t.Errorf("%s is tunable but not reloadable", key)
+		}
+	}
+}
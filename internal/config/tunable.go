@@ -0,0 +1,123 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tunable lists the settings an admin can change at runtime, on the settings
+// page or with PUT /api/settings. Changes are stored in the database and
+// override the config file and environment, which remain the defaults until
+// a setting is changed and again once it is reset. Every tunable setting is
+// reloadable.
+var tunable = []string{
+	"rules",
+	"quota",
+	"retention.history",
+	"retention.rejected",
+	"retention.audit",
+	"imap.watch_folders",
+	"imap.spam_folder",
+	"imap.alert_webhook_url",
+	"imap.alert_digest",
+	"sla.webhook_url",
+	"sla.digest",
+	"review_mail",
+}
+
+// Tunable returns the keys of the settings that can be changed at runtime.
+func Tunable() []string {
+	return slices.Clone(tunable)
+}
+
+// IsTunable reports whether the setting with the given dotted key can be
+// changed at runtime.
+func IsTunable(key string) bool {
+	return slices.Contains(tunable, key)
+}
+
+// SettingError is an invalid value for a setting.
+type SettingError struct {
+	Key string
+	Err error
+}
+
+func (e *SettingError) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *SettingError) Unwrap() error {
+	return e.Err
+}
+
+// Override replaces the tunable setting key with value, a YAML document
+// written as in the config file (JSON is YAML too). Fields of a mapping or
+// list entry that value leaves out are zero, not the config file's. It
+// returns a *SettingError if key is not tunable or value does not parse.
+func (c *Config) Override(key, value string) error {
+	field, _, err := c.tunableField(key)
+	if err != nil {
+		return &SettingError{Key: key, Err: err}
+	}
+	parsed := reflect.New(field.Type())
+	dec := yaml.NewDecoder(strings.NewReader(value))
+	dec.KnownFields(true)
+	if err := dec.Decode(parsed.Interface()); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("no value")
+		}
+		return &SettingError{Key: key, Err: err}
+	}
+	field.Set(parsed.Elem())
+	return nil
+}
+
+// TunableValue returns the tunable setting key as YAML, and whether it is
+// secret. A secret that is set is returned as "(redacted)". It returns ""
+// for a key that is not tunable.
+func (c *Config) TunableValue(key string) (value string, secret bool) {
+	field, secret, err := c.tunableField(key)
+	if err != nil {
+		return "", false
+	}
+	if secret && !field.IsZero() {
+		return redacted + "\n", true
+	}
+	out, err := yaml.Marshal(field.Interface())
+	if err != nil {
+		return "", secret
+	}
+	return string(out), secret
+}
+
+// tunableField returns the field of c that holds the tunable setting key,
+// and whether it is tagged secret.
+func (c *Config) tunableField(key string) (reflect.Value, bool, error) {
+	if !IsTunable(key) {
+		return reflect.Value{}, false, errors.New("not a setting that can be changed at runtime")
+	}
+	v := reflect.ValueOf(c).Elem()
+	var secret bool
+	for name := range strings.SplitSeq(key, ".") {
+		t := v.Type()
+		found := false
+		for i := range t.NumField() {
+			if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ","); tag == name {
+				secret = secret || t.Field(i).Tag.Get("secret") == "true"
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, false, fmt.Errorf("no setting %s", key)
+		}
+	}
+	return v, secret, nil
+}
@@ -0,0 +1,228 @@
+// Package contacts keeps an address book learned from human approvals, and
+// the senders a reviewer chose to always allow or block, and decides whether
+// mail to or from well-known contacts may skip review.
+package contacts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Reviewer is recorded as the approver of mail auto-approved by the address book.
+const Reviewer = "contacts"
+
+// AllowReviewer is recorded as the approver of mail auto-approved by an allow
+// rule.
+const AllowReviewer = "allowlist"
+
+// BlockReviewer is recorded as the reviewer of mail rejected by a block rule.
+const BlockReviewer = "blocklist"
+
+// Audit log actions for allow and block rules.
+const (
+	ActionAllow    = "allow.create"
+	ActionDisallow = "allow.delete"
+	ActionBlock    = "block.create"
+	ActionUnblock  = "block.delete"
+)
+
+// Book learns contacts from approved mail.
+type Book struct {
+	st        store.ReadWriter
+	threshold int // approvals needed before auto-approval; 0 disables it
+}
+
+// New creates a Book. Mail whose counterparties have each been approved at
+// least threshold times is trusted; threshold 0 disables auto-approval.
+func New(st store.ReadWriter, threshold int) *Book {
+	return &Book{st: st, threshold: threshold}
+}
+
+// counterparties returns the addresses that identify who an email is
+// exchanged with: recipients for outbound mail, the sender for inbound.
+func counterparties(direction, sender string, recipients []string) []string {
+	if direction == store.DirectionInbound {
+		return []string{sender}
+	}
+	return recipients
+}
+
+// Learn records the counterparties of an email a human approved.
+func (b *Book) Learn(ctx context.Context, email *store.Email) error {
+	if b == nil {
+		return nil
+	}
+	return b.st.RecordContacts(ctx, email.Direction, counterparties(email.Direction, email.Sender, email.Recipients))
+}
+
+// Count returns how many times the email's counterparties were previously
+// approved. For outbound mail to several recipients it is the lowest count.
+func (b *Book) Count(ctx context.Context, direction, sender string, recipients []string) (int, error) {
+	if b == nil {
+		return 0, nil
+	}
+	addrs := counterparties(direction, sender, recipients)
+	if len(addrs) == 0 {
+		return 0, nil
+	}
+	counts, err := b.st.ContactCounts(ctx, direction, addrs)
+	if err != nil {
+		return 0, err
+	}
+	lowest := -1
+	for _, addr := range addrs {
+		if n := counts[strings.ToLower(addr)]; lowest < 0 || n < lowest {
+			lowest = n
+		}
+	}
+	return lowest, nil
+}
+
+// Trusted reports whether the email may be approved without review.
+func (b *Book) Trusted(ctx context.Context, direction, sender string, recipients []string) (bool, error) {
+	if b == nil || b.threshold <= 0 {
+		return false, nil
+	}
+	n, err := b.Count(ctx, direction, sender, recipients)
+	if err != nil {
+		return false, err
+	}
+	return n >= b.threshold, nil
+}
+
+// Approver returns who lets the email skip review: AllowReviewer if its
+// sender has an allow rule for the direction, Reviewer if its counterparties
+// are trusted, or "" if it must be reviewed. Allow rules apply even when the
+// threshold is 0.
+func (b *Book) Approver(ctx context.Context, direction, sender string, recipients []string) (string, error) {
+	if b == nil {
+		return "", nil
+	}
+	rule, err := b.st.GetAllowRule(ctx, direction, sender)
+	if err != nil {
+		return "", err
+	}
+	if rule != nil {
+		return AllowReviewer, nil
+	}
+	trusted, err := b.Trusted(ctx, direction, sender, recipients)
+	if err != nil || !trusted {
+		return "", err
+	}
+	return Reviewer, nil
+}
+
+// Allow adds an allow rule for sender in direction, made by actor while
+// approving emailID (which may be empty), and records it in the audit log.
+func (b *Book) Allow(ctx context.Context, direction, sender, actor, emailID string) error {
+	sender = strings.ToLower(strings.TrimSpace(sender))
+	if sender == "" {
+		return errors.New("allow rule needs a sender")
+	}
+	if err := checkDirection(direction); err != nil {
+		return err
+	}
+	if err := b.st.AddAllowRule(ctx, store.AllowRule{Direction: direction, Sender: sender, EmailID: emailID, CreatedBy: actor}); err != nil {
+		return err
+	}
+	b.audit(ctx, actor, ActionAllow, direction+" "+sender)
+	return nil
+}
+
+// Disallow deletes the allow rule for sender in direction and records it in
+// the audit log.
+func (b *Book) Disallow(ctx context.Context, direction, sender, actor string) error {
+	if err := b.st.DeleteAllowRule(ctx, direction, sender); err != nil {
+		return err
+	}
+	b.audit(ctx, actor, ActionDisallow, direction+" "+strings.ToLower(sender))
+	return nil
+}
+
+// AllowRules returns every allow rule.
+func (b *Book) AllowRules(ctx context.Context) ([]store.AllowRule, error) {
+	return b.st.ListAllowRules(ctx)
+}
+
+// Blocked reports the block rule that rejects mail from sender in direction:
+// the sender's own address or, failing that, its domain. It returns "" if no
+// rule matches, and otherwise counts the email as suppressed by the rule.
+func (b *Book) Blocked(ctx context.Context, direction, sender string) (string, error) {
+	if b == nil {
+		return "", nil
+	}
+	sender = strings.ToLower(sender)
+	subjects := []string{sender}
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		subjects = append(subjects, sender[at+1:])
+	}
+	for _, subject := range subjects {
+		rule, err := b.st.GetBlockRule(ctx, direction, subject)
+		if err != nil {
+			return "", err
+		}
+		if rule == nil {
+			continue
+		}
+		metrics.Blocked.Inc(direction)
+		if err := b.st.CountSuppressed(ctx, direction, subject); err != nil {
+			log.Printf("count email suppressed by block rule %s %s: %v", direction, subject, err)
+		}
+		return subject, nil
+	}
+	return "", nil
+}
+
+// Block adds a block rule for subject, an address or a domain (optionally
+// written "@domain"), in direction, made by actor while rejecting emailID
+// (which may be empty), and records it in the audit log.
+func (b *Book) Block(ctx context.Context, direction, subject, actor, emailID string) error {
+	subject = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(subject)), "@")
+	if subject == "" || strings.ContainsAny(subject, " \t<>") {
+		return fmt.Errorf("invalid sender or domain %q", subject)
+	}
+	if err := checkDirection(direction); err != nil {
+		return err
+	}
+	if err := b.st.AddBlockRule(ctx, store.BlockRule{Direction: direction, Subject: subject, EmailID: emailID, CreatedBy: actor}); err != nil {
+		return err
+	}
+	b.audit(ctx, actor, ActionBlock, direction+" "+subject)
+	return nil
+}
+
+// Unblock deletes the block rule for subject in direction and records it in
+// the audit log.
+func (b *Book) Unblock(ctx context.Context, direction, subject, actor string) error {
+	if err := b.st.DeleteBlockRule(ctx, direction, subject); err != nil {
+		return err
+	}
+	b.audit(ctx, actor, ActionUnblock, direction+" "+strings.ToLower(subject))
+	return nil
+}
+
+// BlockRules returns every block rule.
+func (b *Book) BlockRules(ctx context.Context) ([]store.BlockRule, error) {
+	return b.st.ListBlockRules(ctx)
+}
+
+func checkDirection(direction string) error {
+	if direction != store.DirectionInbound && direction != store.DirectionOutbound {
+		return fmt.Errorf("unknown direction %q", direction)
+	}
+	return nil
+}
+
+// audit records an entry, logging rather than failing on error.
+func (b *Book) audit(ctx context.Context, actor, action, detail string) {
+	if err := b.st.RecordAudit(ctx, store.AuditEntry{At: time.Now().UTC(), Actor: actor, Action: action, Detail: detail}); err != nil {
+		log.Printf("record audit entry %s: %v", action, err)
+	}
+}
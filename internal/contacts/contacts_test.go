@@ -0,0 +1,153 @@
+package contacts
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestLearnAndTrust(t *testing.T) {
+	b := New(newTestStore(t), 2)
+	out := &store.Email{Direction: store.DirectionOutbound, Sender: "me@x.com", Recipients: []string{"bob@x.com", "carol@x.com"}}
+	in := &store.Email{Direction: store.DirectionInbound, Sender: "Bob@x.com", Recipients: []string{"me@x.com"}}
+
+	for range 2 {
+		if err := b.Learn(t.Context(), out); err != nil {
+			t.Fatalf("learn: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		direction  string
+		sender     string
+		recipients []string
+		count      int
+		trusted    bool
+	}{
+		{"all recipients known", store.DirectionOutbound, "me@x.com", []string{"bob@x.com", "CAROL@x.com"}, 2, true},
+		{"one new recipient", store.DirectionOutbound, "me@x.com", []string{"bob@x.com", "dave@x.com"}, 0, false},
+		{"inbound tracked separately", store.DirectionInbound, "bob@x.com", []string{"me@x.com"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := b.Count(t.Context(), tt.direction, tt.sender, tt.recipients)
+			if err != nil || n != tt.count {
+				t.Errorf("Count = %d, %v; want %d", n, err, tt.count)
+			}
+			ok, err := b.Trusted(t.Context(), tt.direction, tt.sender, tt.recipients)
+			if err != nil || ok != tt.trusted {
+				t.Errorf("Trusted = %v, %v; want %v", ok, err, tt.trusted)
+			}
+		})
+	}
+
+	_ = b.Learn(t.Context(), in)
+	if n, _ := b.Count(t.Context(), store.DirectionInbound, "bob@x.com", nil); n != 1 {
+		t.Errorf("inbound count = %d, want 1", n)
+	}
+}
+
+func TestThresholdZeroNeverTrusts(t *testing.T) {
+	b := New(newTestStore(t), 0)
+	e := &store.Email{Direction: store.DirectionOutbound, Recipients: []string{"bob@x.com"}}
+	_ = b.Learn(t.Context(), e)
+	if ok, _ := b.Trusted(t.Context(), e.Direction, e.Sender, e.Recipients); ok {
+		t.Error("threshold 0 should disable auto-approval")
+	}
+}
+
+func TestAllowRules(t *testing.T) {
+	st := newTestStore(t)
+	b := New(st, 0)
+	if got, err := b.Approver(t.Context(), store.DirectionInbound, "bob@x.com", nil); err != nil || got != "" {
+		t.Fatalf("Approver = %q, %v; want none before any rule", got, err)
+	}
+	if err := b.Allow(t.Context(), store.DirectionInbound, "Bob@x.com", "alice", "e1"); err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	if got, _ := b.Approver(t.Context(), store.DirectionInbound, "bob@X.com", nil); got != AllowReviewer {
+		t.Errorf("Approver = %q, want %q even with threshold 0", got, AllowReviewer)
+	}
+	if got, _ := b.Approver(t.Context(), store.DirectionOutbound, "bob@x.com", []string{"carol@x.com"}); got != "" {
+		t.Errorf("outbound Approver = %q, want the rule scoped to inbound", got)
+	}
+	if err := b.Allow(t.Context(), "sideways", "bob@x.com", "alice", ""); err == nil {
+		t.Error("allow with an unknown direction succeeded")
+	}
+
+	if err := b.Disallow(t.Context(), store.DirectionInbound, "bob@x.com", "carol"); err != nil {
+		t.Fatalf("disallow: %v", err)
+	}
+	if got, _ := b.Approver(t.Context(), store.DirectionInbound, "bob@x.com", nil); got != "" {
+		t.Errorf("Approver = %q after the rule was deleted", got)
+	}
+
+	entries, err := st.ListAudit(t.Context(), 10)
+	if err != nil {
+		t.Fatalf("list audit: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Actor+" "+e.Action+" "+e.Detail)
+	}
+	want := []string{"carol allow.delete inbound bob@x.com", "alice allow.create inbound bob@x.com"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("audit log = %q, want %q", got, want)
+	}
+}
+
+func TestBlockRules(t *testing.T) {
+	st := newTestStore(t)
+	b := New(st, 0)
+	if err := b.Block(t.Context(), store.DirectionInbound, "@Spam.Example", "alice", ""); err != nil {
+		t.Fatalf("block domain: %v", err)
+	}
+	if err := b.Block(t.Context(), store.DirectionInbound, "bob@example.org", "alice", "e1"); err != nil {
+		t.Fatalf("block address: %v", err)
+	}
+	if err := b.Block(t.Context(), store.DirectionInbound, "", "alice", ""); err == nil {
+		t.Error("blocking an empty sender succeeded")
+	}
+
+	tests := []struct {
+		direction, sender, want string
+	}{
+		{store.DirectionInbound, "Eve@spam.example", "spam.example"},
+		{store.DirectionInbound, "bob@example.org", "bob@example.org"},
+		{store.DirectionInbound, "carol@example.org", ""},
+		{store.DirectionOutbound, "eve@spam.example", ""},
+	}
+	for _, tt := range tests {
+		got, err := b.Blocked(t.Context(), tt.direction, tt.sender)
+		if err != nil || got != tt.want {
+			t.Errorf("Blocked(%s, %s) = %q, %v; want %q", tt.direction, tt.sender, got, err, tt.want)
+		}
+	}
+	if r, _ := st.GetBlockRule(t.Context(), store.DirectionInbound, "spam.example"); r == nil || r.Suppressed != 1 {
+		t.Errorf("domain rule = %+v, want one suppressed email", r)
+	}
+
+	if err := b.Unblock(t.Context(), store.DirectionInbound, "spam.example", "bob"); err != nil {
+		t.Fatalf("unblock: %v", err)
+	}
+	if got, _ := b.Blocked(t.Context(), store.DirectionInbound, "eve@spam.example"); got != "" {
+		t.Errorf("Blocked = %q after the rule was deleted", got)
+	}
+	entries, _ := st.ListAudit(t.Context(), 10)
+	if len(entries) != 3 || entries[0].Action != ActionUnblock || entries[0].Detail != "inbound spam.example" {
+		t.Errorf("audit log = %+v", entries)
+	}
+}
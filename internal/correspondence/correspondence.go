@@ -0,0 +1,84 @@
+// Package correspondence keeps a copy of the outbound mail mailescrow
+// relays, so that an inbound reply to it can be reviewed with the message it
+// answers. Recording never blocks delivery: a message that cannot be
+// recorded has still been relayed.
+package correspondence
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Store records relayed messages. store.EmailStore implements it.
+type Store interface {
+	RecordSent(ctx context.Context, m store.SentMessage) error
+}
+
+// Sender wraps a relay.Sender and records each outbound email it relays
+// successfully, keyed by its Message-Id. Messages without one cannot be
+// replied to by reference and are not recorded; neither are forwarded
+// inbound mail and bounces.
+type Sender struct {
+	next relay.Sender
+	st   Store
+}
+
+// New wraps next, recording relayed outbound mail in st.
+func New(next relay.Sender, st Store) *Sender {
+	return &Sender{next: next, st: st}
+}
+
+// Send relays email and, if it was sent, records it.
+func (s *Sender) Send(ctx context.Context, email *store.Email) error {
+	if err := s.next.Send(ctx, email); err != nil {
+		return err
+	}
+	if email.Direction != store.DirectionOutbound {
+		return nil
+	}
+	id := messageID(email.RawMessage)
+	if id == "" {
+		return nil
+	}
+	m := store.SentMessage{
+		MessageID:  id,
+		EmailID:    email.ID,
+		Sender:     email.Sender,
+		Recipients: email.Recipients,
+		Subject:    email.Subject,
+		Body:       email.Body,
+	}
+	// The message is out: record it even if the caller has given up.
+	if err := s.st.RecordSent(context.WithoutCancel(ctx), m); err != nil {
+		log.Printf("record sent message %s of email %s: %v", id, email.ID, err)
+	}
+	return nil
+}
+
+// Preview returns the raw message as the wrapped sender transmits it.
+func (s *Sender) Preview(email *store.Email) []byte {
+	if p, ok := s.next.(relay.Previewer); ok {
+		return p.Preview(email)
+	}
+	return email.RawMessage
+}
+
+// messageID returns the Message-Id of raw, a MIME message, angle brackets
+// included, or "" if it has none.
+func messageID(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	id := strings.TrimSpace(msg.Header.Get("Message-Id"))
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, ">") {
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,90 @@
+package correspondence
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeSender struct {
+	err error
+}
+
+func (f *fakeSender) Send(context.Context, *store.Email) error { return f.err }
+
+type fakeStore struct {
+	sent []store.SentMessage
+	err  error
+}
+
+func (f *fakeStore) RecordSent(_ context.Context, m store.SentMessage) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func outbound(raw string) *store.Email {
+	return &store.Email{
+		ID:         "e1",
+		Direction:  store.DirectionOutbound,
+		Sender:     "me@example.com",
+		Recipients: []string{"you@example.com"},
+		Subject:    "Quote",
+		Body:       "Here is the quote.",
+		RawMessage: []byte(raw),
+	}
+}
+
+const withID = "Message-Id: <q1@example.com>\r\nSubject: Quote\r\n\r\nHere is the quote.\r\n"
+
+func TestSendRecords(t *testing.T) {
+	st := &fakeStore{}
+	s := New(&fakeSender{}, st)
+	if err := s.Send(t.Context(), outbound(withID)); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.sent) != 1 {
+		t.Fatalf("recorded %d messages, want 1", len(st.sent))
+	}
+	m := st.sent[0]
+	if m.MessageID != "<q1@example.com>" || m.EmailID != "e1" || m.Subject != "Quote" || m.Body != "Here is the quote." {
+		t.Errorf("recorded %+v", m)
+	}
+}
+
+func TestSendSkips(t *testing.T) {
+	inbound := outbound(withID)
+	inbound.Direction = store.DirectionInbound
+	tests := []struct {
+		name  string
+		next  *fakeSender
+		email *store.Email
+	}{
+		{"no message id", &fakeSender{}, outbound("Subject: Quote\r\n\r\nbody\r\n")},
+		{"inbound", &fakeSender{}, inbound},
+		{"relay failed", &fakeSender{err: errors.New("refused")}, outbound(withID)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &fakeStore{}
+			err := New(tt.next, st).Send(t.Context(), tt.email)
+			if !errors.Is(err, tt.next.err) {
+				t.Errorf("err = %v, want %v", err, tt.next.err)
+			}
+			if len(st.sent) != 0 {
+				t.Errorf("recorded %+v", st.sent)
+			}
+		})
+	}
+}
+
+func TestSendRecordFailure(t *testing.T) {
+	s := New(&fakeSender{}, &fakeStore{err: errors.New("disk full")})
+	if err := s.Send(t.Context(), outbound(withID)); err != nil {
+		t.Errorf("relayed message reported as failed: %v", err)
+	}
+}
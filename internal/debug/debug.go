@@ -0,0 +1,62 @@
+// Package debug exposes runtime diagnostics for profiling production issues:
+// net/http/pprof profiles and expvar variables describing goroutines, the
+// database, the queue and the IMAP poller.
+package debug
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/albert/mailescrow/internal/poller"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// queryTimeout bounds the store queries made for one /debug/vars request.
+const queryTimeout = 5 * time.Second
+
+// Publish registers the mailescrow expvar variables, which are computed on
+// each request to /debug/vars. Call it at most once. pollerStatus may be nil
+// when IMAP is not configured.
+func Publish(st store.Reader, pollerStatus func() poller.Status) {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	if db, ok := st.(interface{ DBStats() sql.DBStats }); ok {
+		expvar.Publish("db", expvar.Func(func() any { return db.DBStats() }))
+	}
+	expvar.Publish("queue", expvar.Func(func() any { return queue(st) }))
+	if pollerStatus != nil {
+		expvar.Publish("imap", expvar.Func(func() any { return pollerStatus() }))
+	}
+}
+
+// queue counts held emails by direction and status, e.g. "outbound_pending".
+func queue(st store.Reader) any {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	counts, err := st.CountByStatus(ctx)
+	if err != nil {
+		return map[string]string{"error": err.Error()}
+	}
+	out := make(map[string]int, len(counts))
+	for _, c := range counts {
+		out[c.Direction+"_"+c.Status] = c.Count
+	}
+	return out
+}
+
+// Handler serves the pprof profiles under /debug/pprof/ and the expvar
+// variables at /debug/vars.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
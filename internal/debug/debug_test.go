@@ -0,0 +1,41 @@
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/poller"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestHandler(t *testing.T) {
+	st := store.NewMemory()
+	if _, err := st.SaveOutbound(t.Context(), "a@example.com", []string{"b@example.com"}, "Hi", "body", []byte("raw")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	Publish(st, func() poller.Status { return poller.Status{ConsecutiveFailures: 2} })
+	h := Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		Goroutines int            `json:"goroutines"`
+		Queue      map[string]int `json:"queue"`
+		IMAP       poller.Status  `json:"imap"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatalf("decode /debug/vars: %v", err)
+	}
+	if vars.Goroutines == 0 || vars.Queue["outbound_pending"] != 1 || vars.IMAP.ConsecutiveFailures != 2 {
+		t.Errorf("vars = %+v", vars)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Errorf("goroutine profile: %d %.100s", w.Code, w.Body.String())
+	}
+}
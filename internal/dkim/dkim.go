@@ -0,0 +1,221 @@
+// Package dkim signs outbound messages with DKIM (RFC 6376), using relaxed
+// canonicalization for header and body and rsa-sha256 or ed25519-sha256 (RFC
+// 8463) depending on the key. Only signing is implemented; mailescrow never
+// verifies DKIM itself.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signer signs messages for one domain and selector.
+type Signer struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+	now       func() time.Time
+}
+
+// New creates a Signer for domain with the key published at
+// selector._domainkey.domain. key must be an RSA or Ed25519 private key.
+func New(domain, selector string, key crypto.Signer) (*Signer, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("dkim: domain and selector are required")
+	}
+	s := &Signer{domain: strings.ToLower(domain), selector: selector, key: key, now: time.Now}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		s.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		s.algorithm = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("dkim: unsupported key type %T", key)
+	}
+	return s, nil
+}
+
+// LoadKey reads a PEM-encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8)
+// private key from path.
+func LoadKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read DKIM key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("DKIM key %s is not PEM-encoded", path)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse DKIM key %s: %w", path, err)
+		}
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse DKIM key %s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("DKIM key %s: unsupported key type %T", path, key)
+	}
+	return signer, nil
+}
+
+// Domain returns the signing domain (d=).
+func (s *Signer) Domain() string {
+	return s.domain
+}
+
+// Sign returns raw, with CRLF line endings, with a DKIM-Signature header
+// prepended. Every header field of raw is signed, so the signature breaks if
+// one is later changed or removed; header fields added above it are not
+// covered.
+func (s *Signer) Sign(raw []byte) ([]byte, error) {
+	header, body := split(raw)
+	raw = slices.Concat(header, []byte("\r\n"), body)
+	fields := headerFields(header)
+
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		name, _, _ := strings.Cut(f, ":")
+		names = append(names, strings.ToLower(strings.TrimSpace(name)))
+	}
+	bodyHash := sha256.Sum256(canonicalBody(body))
+	value := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%s; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.algorithm, s.domain, s.selector, strconv.FormatInt(s.now().Unix(), 10),
+		strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	// Fields are hashed bottom-up for repeated names (RFC 6376 section
+	// 5.4.2); taking them in order from the last occurrence up does that.
+	used := make(map[string]int)
+	for _, name := range names {
+		used[name]++
+		n := 0
+		for i := len(fields) - 1; i >= 0; i-- {
+			if names[i] == name {
+				n++
+				if n == used[name] {
+					h.Write([]byte(canonicalHeader(fields[i]) + "\r\n"))
+					break
+				}
+			}
+		}
+	}
+	h.Write([]byte(canonicalHeader("DKIM-Signature: " + value)))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	if s.algorithm == "ed25519-sha256" {
+		sig, err = s.key.Sign(rand.Reader, digest, crypto.Hash(0))
+	} else {
+		sig, err = s.key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim sign: %w", err)
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(raw) + len(value) + 512)
+	out.WriteString("DKIM-Signature: " + value)
+	b := base64.StdEncoding.EncodeToString(sig)
+	for len(b) > 72 {
+		out.WriteString(b[:72] + "\r\n\t ")
+		b = b[72:]
+	}
+	out.WriteString(b + "\r\n")
+	out.Write(raw)
+	return out.Bytes(), nil
+}
+
+// split separates the header block of raw, each line ending in CRLF, from
+// its body. Bare LFs are treated as CRLF.
+func split(raw []byte) (header, body []byte) {
+	raw = bytes.ReplaceAll(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		return raw[:i+2], raw[i+4:]
+	}
+	return raw, nil
+}
+
+// headerFields returns the header fields of header, each with its folded
+// continuation lines but without the final CRLF.
+func headerFields(header []byte) []string {
+	var fields []string
+	for line := range strings.SplitSeq(strings.TrimSuffix(string(header), "\r\n"), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		if line != "" {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+// canonicalHeader applies the relaxed header canonicalization to a field:
+// lower-case name, unfolded value with runs of whitespace reduced to one
+// space and none around the colon or at the end. No CRLF is appended.
+func canonicalHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(collapse(value))
+}
+
+// canonicalBody applies the relaxed body canonicalization: whitespace at line
+// ends removed, other runs of whitespace reduced to one space, and empty
+// lines at the end removed. A non-empty body ends in CRLF.
+func canonicalBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(collapse(line), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapse replaces every run of spaces and tabs in s with one space.
+func collapse(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
@@ -0,0 +1,169 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example of RFC 6376 section 3.4.5.
+func TestCanonicalization(t *testing.T) {
+	header, body := split([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	var got []string
+	for _, f := range headerFields(header) {
+		got = append(got, canonicalHeader(f))
+	}
+	if want := []string{"a:X", "b:Y Z"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("headers = %q, want %q", got, want)
+	}
+	if got := string(canonicalBody(body)); got != " C\r\nD E\r\n" {
+		t.Errorf("body = %q", got)
+	}
+	if got := canonicalBody([]byte("\r\n\r\n")); got != nil {
+		t.Errorf("empty body = %q, want nothing", got)
+	}
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte("From: Support <support@example.com>\nTo: bob@example.org\nSubject: Hello\nReceived: one\nReceived: two\n\nHi Bob,  \n\n")
+	for name, key := range map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": edKey} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New("Example.com", "mail", key)
+			if err != nil {
+				t.Fatalf("new: %v", err)
+			}
+			s.now = func() time.Time { return time.Unix(1700000000, 0) }
+			signed, err := s.Sign(raw)
+			if err != nil {
+				t.Fatalf("sign: %v", err)
+			}
+			verify(t, signed, key.Public())
+			for _, want := range []string{"a=" + name, "d=example.com", "s=mail", "t=1700000000", "h=from:to:subject:received:received"} {
+				if !strings.Contains(string(signed), want) {
+					t.Errorf("signature lacks %s:\n%s", want, signed)
+				}
+			}
+
+			// Changing a signed header breaks the signature.
+			tampered := []byte(strings.Replace(string(signed), "Subject: Hello", "Subject: Hullo", 1))
+			if signatureValid(t, tampered, key.Public()) {
+				t.Error("signature still verifies after the subject changed")
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnsupportedKey(t *testing.T) {
+	if _, err := New("example.com", "mail", nil); err == nil {
+		t.Error("expected error for a nil key")
+	}
+	if _, err := New("", "mail", ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))); err == nil {
+		t.Error("expected error without a domain")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"rsa.pem":     {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"ed25519.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	}
+	for name, block := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKey(path); err != nil {
+			t.Errorf("load %s: %v", name, err)
+		}
+	}
+	bad := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(bad, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKey(bad); err == nil {
+		t.Error("expected error for a file that is not PEM")
+	}
+}
+
+func verify(t *testing.T, signed []byte, pub crypto.PublicKey) {
+	t.Helper()
+	if !signatureValid(t, signed, pub) {
+		t.Errorf("signature does not verify:\n%s", signed)
+	}
+}
+
+// signatureValid verifies the first DKIM-Signature of signed the way a
+// receiver would.
+func signatureValid(t *testing.T, signed []byte, pub crypto.PublicKey) bool {
+	t.Helper()
+	header, body := split(signed)
+	fields := headerFields(header)
+	sigField := fields[0]
+	tags := map[string]string{}
+	for tag := range strings.SplitSeq(canonicalHeader(sigField)[len("dkim-signature:"):], ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(tag), "=")
+		tags[k] = strings.ReplaceAll(v, " ", "")
+	}
+	bh := sha256.Sum256(canonicalBody(body))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+		return false
+	}
+
+	h := sha256.New()
+	used := map[int]bool{0: true}
+	for name := range strings.SplitSeq(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			fieldName, _, _ := strings.Cut(fields[i], ":")
+			if !used[i] && strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				used[i] = true
+				h.Write([]byte(canonicalHeader(fields[i]) + "\r\n"))
+				break
+			}
+		}
+	}
+	unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(canonicalHeader(sigField), "b=")
+	h.Write([]byte(unsigned))
+	digest := h.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatalf("decode b=: %v", err)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, digest, sig)
+	}
+	t.Fatalf("unexpected key type %T", pub)
+	return false
+}
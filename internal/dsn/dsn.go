@@ -0,0 +1,173 @@
+// Package dsn parses delivery status notifications (RFC 3464) returned for
+// relayed mail, so they can be matched to the relay by their envelope ID.
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Report is a parsed delivery status notification.
+type Report struct {
+	EnvelopeID string // Original-Envelope-Id: the ENVID the relay sent
+	Recipients []Recipient
+}
+
+// Recipient is the delivery status of one recipient.
+type Recipient struct {
+	Address    string // Original-Recipient, or Final-Recipient when absent
+	Action     string // "failed", "delayed", "delivered", "relayed" or "expanded"
+	Status     string // e.g. "5.1.1"
+	Diagnostic string // the remote server's reply, if reported
+}
+
+// Parse reads raw as a delivery status notification: a multipart/report with
+// report-type delivery-status. It reports false for any other message.
+func Parse(raw []byte) (*Report, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "delivery-status") {
+		return nil, false
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, false
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType == "message/delivery-status" || partType == "message/global-delivery-status" {
+			report, err := parseStatus(part)
+			if err != nil {
+				return nil, false
+			}
+			return report, true
+		}
+	}
+}
+
+// parseStatus reads the per-message fields and the per-recipient field
+// groups of a delivery-status part.
+func parseStatus(r io.Reader) (*Report, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	perMessage, err := tr.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("per-message fields: %w", err)
+	}
+	report := &Report{EnvelopeID: unxtext(strings.TrimSpace(perMessage.Get("Original-Envelope-Id")))}
+	for {
+		fields, err := tr.ReadMIMEHeader()
+		if len(fields) > 0 {
+			report.Recipients = append(report.Recipients, Recipient{
+				Address:    address(cmp.Or(fields.Get("Original-Recipient"), fields.Get("Final-Recipient"))),
+				Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+				Status:     strings.TrimSpace(fields.Get("Status")),
+				Diagnostic: strings.TrimSpace(fields.Get("Diagnostic-Code")),
+			})
+		}
+		if errors.Is(err, io.EOF) {
+			return report, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("per-recipient fields: %w", err)
+		}
+	}
+}
+
+// address strips the address type from a recipient field such as
+// "rfc822;bob@example.com".
+func address(field string) string {
+	if _, addr, ok := strings.Cut(field, ";"); ok {
+		return strings.TrimSpace(addr)
+	}
+	return strings.TrimSpace(field)
+}
+
+// unxtext decodes the "+XX" hex escapes of an RFC 3461 xtext value. A
+// malformed escape is kept as is.
+func unxtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Status summarizes the report as a store.Delivery* status: the worst
+// outcome across its recipients.
+func (r *Report) Status() string {
+	status := ""
+	rank := map[string]int{"": 0, store.DeliveryDelivered: 1, store.DeliveryRelayed: 2, store.DeliveryDelayed: 3, store.DeliveryFailed: 4}
+	for _, rcpt := range r.Recipients {
+		s := rcpt.deliveryStatus()
+		if rank[s] > rank[status] {
+			status = s
+		}
+	}
+	return status
+}
+
+func (rcpt Recipient) deliveryStatus() string {
+	switch rcpt.Action {
+	case "failed":
+		return store.DeliveryFailed
+	case "delayed":
+		return store.DeliveryDelayed
+	case "relayed":
+		return store.DeliveryRelayed
+	case "delivered", "expanded":
+		return store.DeliveryDelivered
+	}
+	return ""
+}
+
+// Bounced returns the recipients whose delivery failed permanently, with a
+// 5.x.x status.
+func (r *Report) Bounced() []Recipient {
+	var bounced []Recipient
+	for _, rcpt := range r.Recipients {
+		if rcpt.Action == "failed" && strings.HasPrefix(rcpt.Status, "5.") {
+			bounced = append(bounced, rcpt)
+		}
+	}
+	return bounced
+}
+
+// Detail describes each recipient's outcome, e.g.
+// "bob@example.com failed (5.1.1: 550 no such user)".
+func (r *Report) Detail() string {
+	parts := make([]string, 0, len(r.Recipients))
+	for _, rcpt := range r.Recipients {
+		s := rcpt.Address + " " + rcpt.Action
+		switch {
+		case rcpt.Status != "" && rcpt.Diagnostic != "":
+			s += " (" + rcpt.Status + ": " + rcpt.Diagnostic + ")"
+		case rcpt.Status != "":
+			s += " (" + rcpt.Status + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, "; ")
+}
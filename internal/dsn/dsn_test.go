@@ -0,0 +1,73 @@
+package dsn
+
+import (
+	"testing"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+const report = "From: MAILER-DAEMON@relay.example.com\r\n" +
+	"To: agent@example.com\r\n" +
+	"Subject: Delivery Status Notification (Failure)\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; relay.example.com\r\n" +
+	"Original-Envelope-Id: abc+2B123\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; bob@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 no such user\r\n" +
+	"\r\n" +
+	"Original-Recipient: rfc822;carol@example.com\r\n" +
+	"Final-Recipient: rfc822; carol@mx.example.com\r\n" +
+	"Action: delivered\r\n" +
+	"Status: 2.0.0\r\n" +
+	"--b1--\r\n"
+
+func TestParse(t *testing.T) {
+	r, ok := Parse([]byte(report))
+	if !ok {
+		t.Fatal("expected a delivery status notification")
+	}
+	if r.EnvelopeID != "abc+123" {
+		t.Errorf("EnvelopeID = %q, want the decoded abc+123", r.EnvelopeID)
+	}
+	if len(r.Recipients) != 2 {
+		t.Fatalf("got %d recipients, want 2", len(r.Recipients))
+	}
+	if got := r.Recipients[1].Address; got != "carol@example.com" {
+		t.Errorf("second address = %q, want the original recipient carol@example.com", got)
+	}
+	if got := r.Status(); got != store.DeliveryFailed {
+		t.Errorf("Status() = %q, want %q", got, store.DeliveryFailed)
+	}
+	if b := r.Bounced(); len(b) != 1 || b[0].Address != "bob@example.com" {
+		t.Errorf("Bounced() = %+v, want bob only", b)
+	}
+	want := "bob@example.com failed (5.1.1: smtp; 550 no such user); carol@example.com delivered (2.0.0)"
+	if got := r.Detail(); got != want {
+		t.Errorf("Detail() = %q, want %q", got, want)
+	}
+}
+
+func TestParseRejectsOtherMessages(t *testing.T) {
+	for name, msg := range map[string]string{
+		"plain":  "From: a@example.com\r\nSubject: Hi\r\n\r\nbody",
+		"mixed":  "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\nx\r\n--b--\r\n",
+		"mdn":    "Content-Type: multipart/report; report-type=disposition-notification; boundary=b\r\n\r\n--b\r\n\r\nx\r\n--b--\r\n",
+		"no dsn": "Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n\r\n--b\r\n\r\nx\r\n--b--\r\n",
+	} {
+		if _, ok := Parse([]byte(msg)); ok {
+			t.Errorf("%s: parsed as a delivery status notification", name)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Package fixtures builds realistic MIME messages for tests: plain and HTML
+// bodies, attachments and inline images, encoded headers, and bodies in other
+// charsets and transfer encodings, the way mail clients send them.
+package fixtures
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Encoding is the Content-Transfer-Encoding of a message's text parts.
+type Encoding string
+
+const (
+	QuotedPrintable Encoding = "quoted-printable"
+	Base64          Encoding = "base64"
+	EightBit        Encoding = "8bit"
+)
+
+// Date is the Date of messages that do not set one.
+var Date = time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+
+// Message describes a message to build. Zero fields take the defaults noted.
+type Message struct {
+	From      string   // default "sender@example.org"
+	To        []string // default ["me@example.com"]
+	Cc        []string
+	Subject   string    // RFC 2047-encoded when not ASCII
+	Date      time.Time // default Date
+	MessageID string    // without angle brackets; default unique per message built
+	Header    textproto.MIMEHeader
+
+	Text     string   // text/plain body
+	HTML     string   // text/html body; with Text, the two make a multipart/alternative
+	Charset  string   // charset the bodies are encoded in, e.g. "iso-8859-1"; default "utf-8"
+	Encoding Encoding // transfer encoding of the bodies; default QuotedPrintable
+
+	Attachments []Attachment
+}
+
+// Attachment is a file attached to a message, or an image its HTML shows
+// inline when ContentID is set (reference it as "cid:<ContentID>").
+type Attachment struct {
+	Filename    string // RFC 2231-encoded when not ASCII
+	ContentType string // default "application/octet-stream"
+	ContentID   string // without angle brackets
+	Data        []byte
+}
+
+var seq atomic.Int64
+
+// Bytes returns the raw message with CRLF line endings. The parts nest the
+// way mail clients send them: multipart/mixed around the attachments,
+// multipart/related around HTML and its inline images, multipart/alternative
+// around the text and HTML bodies.
+func (m Message) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, field := range m.headerFields() {
+		fmt.Fprintf(&buf, "%s: %s\r\n", field[0], field[1])
+	}
+	header, body := render(m.mixed())
+	writeHeader(&buf, header)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// String returns the raw message.
+func (m Message) String() string {
+	return string(m.Bytes())
+}
+
+func (m Message) headerFields() [][2]string {
+	from := m.From
+	if from == "" {
+		from = "sender@example.org"
+	}
+	to := m.To
+	if len(to) == 0 {
+		to = []string{"me@example.com"}
+	}
+	date := m.Date
+	if date.IsZero() {
+		date = Date
+	}
+	id := m.MessageID
+	if id == "" {
+		id = fmt.Sprintf("fixture-%d@example.org", seq.Add(1))
+	}
+
+	// Extra headers come first, as a server's Delivered-To and Received do.
+	var fields [][2]string
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			fields = append(fields, [2]string{k, v})
+		}
+	}
+	fields = append(fields,
+		[2]string{"From", formatAddrs([]string{from})},
+		[2]string{"To", formatAddrs(to)},
+	)
+	if len(m.Cc) > 0 {
+		fields = append(fields, [2]string{"Cc", formatAddrs(m.Cc)})
+	}
+	return append(fields,
+		[2]string{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		[2]string{"Date", date.Format(time.RFC1123Z)},
+		[2]string{"Message-Id", "<" + id + ">"},
+		[2]string{"MIME-Version", "1.0"},
+	)
+}
+
+// formatAddrs joins addresses into a header value, RFC 2047-encoding display
+// names that are not ASCII.
+func formatAddrs(addrs []string) string {
+	formatted := make([]string, len(addrs))
+	for i, a := range addrs {
+		formatted[i] = a
+		if parsed, err := mail.ParseAddress(a); err == nil && parsed.Name != "" {
+			formatted[i] = parsed.String()
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// entity is one part of the message: a leaf with a body, or a multipart.
+type entity struct {
+	header textproto.MIMEHeader
+	body   []byte
+	parts  []entity
+	kind   string // multipart subtype, e.g. "mixed"; empty for a leaf
+}
+
+func (m Message) mixed() entity {
+	body := m.related()
+	var files []entity
+	for _, a := range m.Attachments {
+		if a.ContentID == "" {
+			files = append(files, a.entity("attachment"))
+		}
+	}
+	if len(files) == 0 {
+		return body
+	}
+	return entity{kind: "mixed", parts: append([]entity{body}, files...)}
+}
+
+func (m Message) related() entity {
+	body := m.alternative()
+	var inline []entity
+	for _, a := range m.Attachments {
+		if a.ContentID != "" {
+			inline = append(inline, a.entity("inline"))
+		}
+	}
+	if len(inline) == 0 {
+		return body
+	}
+	return entity{kind: "related", parts: append([]entity{body}, inline...)}
+}
+
+func (m Message) alternative() entity {
+	switch {
+	case m.Text != "" && m.HTML != "":
+		return entity{kind: "alternative", parts: []entity{m.text("plain", m.Text), m.text("html", m.HTML)}}
+	case m.HTML != "":
+		return m.text("html", m.HTML)
+	default:
+		return m.text("plain", m.Text)
+	}
+}
+
+func (m Message) text(subtype, s string) entity {
+	charset := m.Charset
+	if charset == "" {
+		charset = "utf-8"
+	}
+	data := []byte(strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n"))
+	if enc, err := htmlindex.Get(charset); err == nil && !strings.EqualFold(charset, "utf-8") {
+		if encoded, err := enc.NewEncoder().Bytes(data); err == nil {
+			data = encoded
+		}
+	}
+	encoding := m.Encoding
+	if encoding == "" {
+		encoding = QuotedPrintable
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("text/"+subtype, map[string]string{"charset": charset}))
+	h.Set("Content-Transfer-Encoding", string(encoding))
+	return entity{header: h, body: encode(encoding, data)}
+}
+
+func (a Attachment) entity(disposition string) entity {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := textproto.MIMEHeader{}
+	params := map[string]string{}
+	if a.Filename != "" {
+		params["name"] = a.Filename
+	}
+	h.Set("Content-Type", mime.FormatMediaType(contentType, params))
+	h.Set("Content-Transfer-Encoding", string(Base64))
+	if a.Filename != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	} else {
+		h.Set("Content-Disposition", disposition)
+	}
+	if a.ContentID != "" {
+		h.Set("Content-Id", "<"+a.ContentID+">")
+	}
+	return entity{header: h, body: encode(Base64, a.Data)}
+}
+
+// render returns the header and body of e, with the boundaries of nested
+// multiparts filled in.
+func render(e entity) (textproto.MIMEHeader, []byte) {
+	if e.kind == "" {
+		return e.header, e.body
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range e.parts {
+		header, content := render(part)
+		w, _ := mw.CreatePart(header)
+		_, _ = w.Write(content)
+	}
+	_ = mw.Close()
+	return textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/"+e.kind, map[string]string{"boundary": mw.Boundary()})},
+	}, body.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, h textproto.MIMEHeader) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+		}
+	}
+}
+
+// encode applies a transfer encoding, wrapping base64 at 76 columns.
+func encode(encoding Encoding, data []byte) []byte {
+	var buf bytes.Buffer
+	switch encoding {
+	case Base64:
+		s := base64.StdEncoding.EncodeToString(data)
+		for len(s) > 76 {
+			buf.WriteString(s[:76] + "\r\n")
+			s = s[76:]
+		}
+		buf.WriteString(s + "\r\n")
+	case QuotedPrintable:
+		w := quotedprintable.NewWriter(&buf)
+		_, _ = w.Write(data)
+		_ = w.Close()
+		buf.WriteString("\r\n")
+	default:
+		buf.Write(data)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// PNG returns a valid 1×1 PNG image, for inline images and attachments.
+func PNG() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.RGBA{R: 0xcc, A: 0xff})
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// PDF returns a minimal PDF document, for attachments.
+func PDF() []byte {
+	return []byte("%PDF-1.4\n1 0 obj<</Type/Catalog/Pages 2 0 R>>endobj\n" +
+		"2 0 obj<</Type/Pages/Kids[]/Count 0>>endobj\ntrailer<</Root 1 0 R>>\n%%EOF\n")
+}
+
+// Samples returns one message of each shape inbound mail commonly takes,
+// for tests that should hold for any message.
+func Samples() []Message {
+	return []Message{
+		{Subject: "Plain text", Text: "Hello, this is a plain text message.\n"},
+		{Subject: "HTML only", HTML: "<p>Hello, this is <b>HTML</b> only.</p>"},
+		{
+			Subject: "Newsletter",
+			Text:    "Our news this week.",
+			HTML:    `<h1>Our news</h1><p>This week.</p><img src="cid:logo@example.org">`,
+			Attachments: []Attachment{
+				{Filename: "logo.png", ContentType: "image/png", ContentID: "logo@example.org", Data: PNG()},
+			},
+		},
+		{
+			Subject: "Invoice 2026-001",
+			Text:    "Please find the invoice attached.",
+			Attachments: []Attachment{
+				{Filename: "invoice-2026-001.pdf", ContentType: "application/pdf", Data: PDF()},
+				{Filename: "data.csv", ContentType: "text/csv", Data: []byte("item,amount\r\nwidget,10\r\n")},
+			},
+		},
+		{
+			From:     "Jürgen Müller <juergen@example.de>",
+			Subject:  "Grüße aus Köln",
+			Text:     "Schöne Grüße und bis bald!",
+			Charset:  "iso-8859-1",
+			Encoding: QuotedPrintable,
+		},
+		{
+			Subject:  "日本語のテスト",
+			Text:     "こんにちは、世界。",
+			Encoding: Base64,
+			Attachments: []Attachment{
+				{Filename: "報告書.txt", ContentType: "text/plain", Data: []byte("report")},
+			},
+		},
+		{
+			Subject:  "Café menu",
+			Text:     "Crème brûlée — €5",
+			Charset:  "windows-1252",
+			Encoding: EightBit,
+			Header:   textproto.MIMEHeader{"Delivered-To": {"sales@example.com"}},
+		},
+	}
+}
@@ -0,0 +1,70 @@
+package fixtures
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+)
+
+func TestSamplesDecode(t *testing.T) {
+	for _, m := range Samples() {
+		t.Run(m.Subject, func(t *testing.T) {
+			raw := m.Bytes()
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("read message: %v", err)
+			}
+			if _, err := mail.ParseAddress(msg.Header.Get("From")); err != nil {
+				t.Errorf("From %q: %v", msg.Header.Get("From"), err)
+			}
+			if msg.Header.Get("Message-Id") == "" {
+				t.Error("no Message-Id")
+			}
+
+			subject, body := mimetext.Parse(raw)
+			if subject != m.Subject {
+				t.Errorf("subject = %q, want %q", subject, m.Subject)
+			}
+			want := m.Text
+			if want == "" {
+				want = "HTML"
+			}
+			if !strings.Contains(body, strings.TrimSpace(want)) {
+				t.Errorf("body = %q, want it to contain %q", body, want)
+			}
+
+			got := mimetext.Attachments(raw)
+			if len(got) != len(m.Attachments) {
+				t.Fatalf("attachments = %d, want %d", len(got), len(m.Attachments))
+			}
+			for i, a := range m.Attachments {
+				if got[i].Filename != a.Filename || got[i].ContentID != a.ContentID || !bytes.Equal(got[i].Data, a.Data) {
+					t.Errorf("attachment %d = %q <%s> (%d bytes), want %q <%s> (%d bytes)",
+						i, got[i].Filename, got[i].ContentID, len(got[i].Data), a.Filename, a.ContentID, len(a.Data))
+				}
+			}
+		})
+	}
+}
+
+func TestMessageIDsAreUnique(t *testing.T) {
+	a, b := Message{Subject: "a"}, Message{Subject: "a"}
+	if idOf(t, a) == idOf(t, b) {
+		t.Error("two messages got the same Message-Id")
+	}
+	if got := idOf(t, Message{MessageID: "fixed@example.org"}); got != "<fixed@example.org>" {
+		t.Errorf("Message-Id = %q, want <fixed@example.org>", got)
+	}
+}
+
+func idOf(t *testing.T, m Message) string {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Bytes()))
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	return msg.Header.Get("Message-Id")
+}
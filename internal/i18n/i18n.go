@@ -0,0 +1,119 @@
+// Package i18n translates the web UI. Messages are keyed by their English
+// text, so a message missing from a catalog falls back to English.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Default is the language of the UI's own text, which needs no catalog.
+const Default = "en"
+
+//go:embed locales/*.json
+var locales embed.FS
+
+// catalogs maps a language to its translations, by English message.
+var catalogs = loadCatalogs()
+
+// names are the languages as they call themselves, for choosing one.
+var names = map[string]string{
+	"en": "English",
+	"de": "Deutsch",
+	"es": "Español",
+	"fr": "Français",
+}
+
+var matcher = language.NewMatcher(tags())
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := locales.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]map[string]string, len(files))
+	for _, f := range files {
+		data, err := locales.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("parse catalog %s: %v", f.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(f.Name(), ".json")] = messages
+	}
+	return catalogs
+}
+
+// Languages returns the languages the UI can be shown in, Default first.
+func Languages() []string {
+	langs := []string{Default}
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	slices.Sort(langs[1:])
+	return langs
+}
+
+func tags() []language.Tag {
+	var tags []language.Tag
+	for _, lang := range Languages() {
+		tags = append(tags, language.MustParse(lang))
+	}
+	return tags
+}
+
+// Supported reports whether the UI can be shown in lang.
+func Supported(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok || lang == Default
+}
+
+// Name returns lang as it calls itself, e.g. "Deutsch", or lang itself if
+// unknown.
+func Name(lang string) string {
+	if name, ok := names[lang]; ok {
+		return name
+	}
+	return lang
+}
+
+// Match returns the supported language that best fits an Accept-Language
+// header, or Default if none does.
+func Match(acceptLanguage string) string {
+	prefs, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(prefs) == 0 {
+		return Default
+	}
+	_, i, confidence := matcher.Match(prefs...)
+	if confidence == language.No {
+		return Default
+	}
+	return Languages()[i]
+}
+
+// Has reports whether lang's catalog translates msg. Every message is
+// available in Default.
+func Has(lang, msg string) bool {
+	_, ok := catalogs[lang][msg]
+	return ok || lang == Default
+}
+
+// Translate returns msg in lang, formatted with args as by fmt.Sprintf if any
+// are given.
+func Translate(lang, msg string, args ...any) string {
+	if t, ok := catalogs[lang][msg]; ok {
+		msg = t
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
@@ -0,0 +1,51 @@
+package i18n
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", "en"},
+		{"de-DE,de;q=0.9,en;q=0.8", "de"},
+		{"fr-CA", "fr"},
+		{"ja, es;q=0.5", "es"},
+		{"ja", "en"},
+		{"not a header;;", "en"},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.header); got != tt.want {
+			t.Errorf("Match(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	if got := Translate("de", "Approve"); got != "Freigeben" {
+		t.Errorf("de Approve = %q", got)
+	}
+	if got := Translate("es", "Page %d of %d (%d pending)", 1, 3, 42); got != "Página 1 de 3 (42 pendientes)" {
+		t.Errorf("es page = %q", got)
+	}
+	if got := Translate("fr", "not in any catalog"); got != "not in any catalog" {
+		t.Errorf("missing message = %q, want English", got)
+	}
+	if got := Translate("en", "signed by %s", "alice"); got != "signed by alice" {
+		t.Errorf("en = %q", got)
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	langs := Languages()
+	if langs[0] != Default {
+		t.Errorf("Languages()[0] = %q, want %q", langs[0], Default)
+	}
+	for _, lang := range langs {
+		if !Supported(lang) || Name(lang) == lang {
+			t.Errorf("language %q: supported %v, name %q", lang, Supported(lang), Name(lang))
+		}
+	}
+	if Supported("xx") {
+		t.Error("xx should not be supported")
+	}
+}
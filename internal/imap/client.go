@@ -2,21 +2,32 @@ package imap
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
-	"mime"
 	"net"
 	"net/mail"
+	"net/textproto"
 	"os"
+	"slices"
 	"strconv"
-	"strings"
+	"time"
 
 	goimap "github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/proxy"
+	"github.com/albert/mailescrow/internal/tlsclient"
+	"github.com/albert/mailescrow/internal/tracing"
 )
 
+// FolderInbox is the folder polled for new mail unless others are watched.
+const FolderInbox = "INBOX"
+
 const (
 	FolderReceived = "mailescrow/received"
 	FolderApproved = "mailescrow/approved"
@@ -31,6 +42,10 @@ type Client struct {
 	password string
 	port     int
 	useTLS   bool
+	dialer   proxy.Dialer // connects to the server; nil dials directly. See SetDialer
+	tls      *tls.Config  // nil uses the defaults; see SetTLSConfig
+
+	envelopeHeader string // see SetEnvelopeHeader
 }
 
 // FetchedEmail carries parsed data from a fetched IMAP message.
@@ -41,6 +56,19 @@ type FetchedEmail struct {
 	Subject    string
 	Body       string
 	RawMessage []byte
+
+	// EnvelopeRecipients is where the message was actually delivered (see
+	// SetEnvelopeHeader); nil when the server did not record it.
+	EnvelopeRecipients []string
+}
+
+// DeliveredTo returns the addresses the message was delivered to: the
+// envelope recipients when known, else the To header.
+func (f FetchedEmail) DeliveredTo() []string {
+	if len(f.EnvelopeRecipients) > 0 {
+		return f.EnvelopeRecipients
+	}
+	return f.Recipients
 }
 
 // New creates a new Client.
@@ -51,22 +79,61 @@ func New(host string, port int, username, password string, useTLS bool) *Client
 		password: password,
 		port:     port,
 		useTLS:   useTLS,
+
+		envelopeHeader: DefaultEnvelopeHeader,
 	}
 }
 
+// DefaultEnvelopeHeader is the header envelope recipients are read from
+// unless SetEnvelopeHeader says otherwise. Most delivery agents, Gmail's
+// included, add it.
+const DefaultEnvelopeHeader = "Delivered-To"
+
+// SetEnvelopeHeader reads FetchedEmail.EnvelopeRecipients from the topmost
+// name header of each message, the one the provider's delivery agent added
+// last: e.g. X-Original-To on Postfix, which keeps the address before alias
+// and catch-all expansion, or Envelope-To on Exim. Copies further down may
+// come from the sender and are ignored. Only set a header the provider
+// always adds, since a sender can forge one it does not. An empty name
+// leaves envelope recipients unknown, so mail is routed on To.
+func (c *Client) SetEnvelopeHeader(name string) {
+	c.envelopeHeader = name
+}
+
+// dialTimeout bounds connecting through the dialer of SetDialer, proxy
+// handshake and TLS included, as imapclient bounds connecting directly.
+const dialTimeout = 30 * time.Second
+
+// SetDialer connects to the server with d, e.g. through the proxy of
+// network.proxy_url, instead of directly.
+func (c *Client) SetDialer(d proxy.Dialer) {
+	c.dialer = d
+}
+
+// SetTLSConfig verifies the server, and authenticates to it, with cfg (see
+// tlsclient.Load). Its ServerName is set to the IMAP host.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.tls = cfg
+}
+
 func (c *Client) connect() (*imapclient.Client, error) {
 	addr := net.JoinHostPort(c.host, strconv.Itoa(c.port))
 
-	var opts *imapclient.Options
+	tlsConfig := tlsclient.ForHost(c.tls, c.host)
+	tlsConfig.NextProtos = []string{"imap"}
+	opts := &imapclient.Options{TLSConfig: tlsConfig}
 	if os.Getenv("MAILESCROW_IMAP_DEBUG") != "" {
-		opts = &imapclient.Options{DebugWriter: os.Stderr}
+		opts.DebugWriter = os.Stderr
 	}
 
 	var ic *imapclient.Client
 	var err error
-	if c.useTLS {
+	switch {
+	case c.dialer != nil:
+		ic, err = c.dial(addr, opts)
+	case c.useTLS:
 		ic, err = imapclient.DialTLS(addr, opts)
-	} else {
+	default:
 		ic, err = imapclient.DialInsecure(addr, opts)
 	}
 	if err != nil {
@@ -79,10 +146,33 @@ func (c *Client) connect() (*imapclient.Client, error) {
 	return ic, nil
 }
 
+// dial connects to addr through the dialer of SetDialer, with TLS from the
+// start if configured.
+func (c *Client) dial(addr string, opts *imapclient.Options) (*imapclient.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	conn, err := c.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.useTLS {
+		tc := tls.Client(conn, opts.TLSConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return imapclient.New(conn, opts), nil
+}
+
 // EnsureFolders creates the four mailescrow/* folders if they don't exist.
 // It uses CREATE-or-ignore rather than LIST to avoid Gmail closing the
 // connection when the wildcard pattern matches nothing.
-func (c *Client) EnsureFolders(_ context.Context) error {
+func (c *Client) EnsureFolders(ctx context.Context) (err error) {
+	_, span := tracing.Start(ctx, "imap.ensure_folders", attribute.String("server.address", c.host))
+	defer func() { tracing.End(span, err) }()
+
 	ic, err := c.connect()
 	if err != nil {
 		return err
@@ -102,17 +192,20 @@ func (c *Client) EnsureFolders(_ context.Context) error {
 	return nil
 }
 
-// Poll fetches messages from INBOX, skipping any whose Message-Id is in
-// knownMessageIDs, and moves new ones to mailescrow/received.
-func (c *Client) Poll(_ context.Context, knownMessageIDs []string) ([]FetchedEmail, error) {
+// Poll fetches messages from folder, e.g. FolderInbox, skipping any whose
+// Message-Id is in knownMessageIDs, and moves new ones to mailescrow/received.
+func (c *Client) Poll(ctx context.Context, folder string, knownMessageIDs []string) (_ []FetchedEmail, err error) {
+	_, span := tracing.Start(ctx, "imap.poll", attribute.String("server.address", c.host), attribute.String("mailescrow.mailbox", folder))
+	defer func() { tracing.End(span, err) }()
+
 	ic, err := c.connect()
 	if err != nil {
 		return nil, err
 	}
 	defer func() { _ = ic.Logout().Wait() }()
 
-	if _, err := ic.Select("INBOX", nil).Wait(); err != nil {
-		return nil, fmt.Errorf("select INBOX: %w", err)
+	if _, err := ic.Select(folder, nil).Wait(); err != nil {
+		return nil, fmt.Errorf("select %s: %w", folder, err)
 	}
 
 	// Search all non-deleted messages.
@@ -120,7 +213,7 @@ func (c *Client) Poll(_ context.Context, knownMessageIDs []string) ([]FetchedEma
 		NotFlag: []goimap.Flag{goimap.FlagDeleted},
 	}, nil).Wait()
 	if err != nil {
-		return nil, fmt.Errorf("search INBOX: %w", err)
+		return nil, fmt.Errorf("search %s: %w", folder, err)
 	}
 
 	uids := searchData.AllUIDs()
@@ -154,23 +247,15 @@ func (c *Client) Poll(_ context.Context, knownMessageIDs []string) ([]FetchedEma
 		if len(raw) == 0 {
 			continue
 		}
-		msgID := extractMessageID(raw)
-		if knownIDs[msgID] {
+		f := parseMessage(raw, c.envelopeHeader)
+		if knownIDs[f.MessageID] {
 			continue
 		}
-		subject, body := parseMessage(raw)
-		sender, recipients := parseAddresses(raw)
-		fetched = append(fetched, FetchedEmail{
-			MessageID:  msgID,
-			Sender:     sender,
-			Recipients: recipients,
-			Subject:    subject,
-			Body:       body,
-			RawMessage: raw,
-		})
+		fetched = append(fetched, f)
 		newUIDs = append(newUIDs, msg.UID)
 	}
 
+	span.SetAttributes(attribute.Int("mailescrow.fetched", len(fetched)))
 	if len(newUIDs) > 0 {
 		newSet := goimap.UIDSetNum(newUIDs...)
 		if _, err := ic.Move(newSet, FolderReceived).Wait(); err != nil {
@@ -182,7 +267,13 @@ func (c *Client) Poll(_ context.Context, knownMessageIDs []string) ([]FetchedEma
 }
 
 // MoveMessage finds a message by Message-Id in fromMailbox and moves it to toMailbox.
-func (c *Client) MoveMessage(_ context.Context, messageID, fromMailbox, toMailbox string) error {
+func (c *Client) MoveMessage(ctx context.Context, messageID, fromMailbox, toMailbox string) (err error) {
+	_, span := tracing.Start(ctx, "imap.move",
+		attribute.String("server.address", c.host),
+		attribute.String("mailescrow.from_mailbox", fromMailbox),
+		attribute.String("mailescrow.to_mailbox", toMailbox))
+	defer func() { tracing.End(span, err) }()
+
 	ic, err := c.connect()
 	if err != nil {
 		return err
@@ -214,6 +305,170 @@ func (c *Client) MoveMessage(_ context.Context, messageID, fromMailbox, toMailbo
 	return nil
 }
 
+// ListMessageIDs returns the Message-Id of every message in mailbox, skipping
+// messages without one. The mailbox is opened read-only.
+func (c *Client) ListMessageIDs(ctx context.Context, mailbox string) (_ []string, err error) {
+	_, span := tracing.Start(ctx, "imap.list",
+		attribute.String("server.address", c.host),
+		attribute.String("mailescrow.mailbox", mailbox))
+	defer func() { tracing.End(span, err) }()
+
+	ic, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = ic.Logout().Wait() }()
+
+	if _, err := ic.Select(mailbox, &goimap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return nil, fmt.Errorf("select %s: %w", mailbox, err)
+	}
+	searchData, err := ic.UIDSearch(&goimap.SearchCriteria{
+		NotFlag: []goimap.Flag{goimap.FlagDeleted},
+	}, nil).Wait()
+	if err != nil {
+		return nil, fmt.Errorf("search %s: %w", mailbox, err)
+	}
+	uids := searchData.AllUIDs()
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	headerItem := goimap.FetchItemBodySection{
+		Specifier:    goimap.PartSpecifierHeader,
+		HeaderFields: []string{"Message-Id"},
+		Peek:         true,
+	}
+	messages, err := ic.Fetch(goimap.UIDSetNum(uids...), &goimap.FetchOptions{
+		UID:         true,
+		BodySection: []*goimap.FetchItemBodySection{&headerItem},
+	}).Collect()
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		if id := extractMessageID(msg.FindBodySection(&headerItem)); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	span.SetAttributes(attribute.Int("mailescrow.messages", len(ids)))
+	return ids, nil
+}
+
+// fetchBatch is how many messages Fetch reads at a time.
+const fetchBatch = 100
+
+// Fetch calls fn with every message in mailbox received on or after since,
+// oldest first; a zero since means all of them. The mailbox is opened
+// read-only and nothing is moved or marked \Seen. Messages are read in
+// batches, so a large mailbox is never held in memory at once. Fetch stops
+// at the first error fn returns.
+func (c *Client) Fetch(ctx context.Context, mailbox string, since time.Time, fn func(FetchedEmail) error) (err error) {
+	_, span := tracing.Start(ctx, "imap.fetch",
+		attribute.String("server.address", c.host),
+		attribute.String("mailescrow.mailbox", mailbox))
+	defer func() { tracing.End(span, err) }()
+
+	ic, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ic.Logout().Wait() }()
+
+	if _, err := ic.Select(mailbox, &goimap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return fmt.Errorf("select %s: %w", mailbox, err)
+	}
+	criteria := &goimap.SearchCriteria{NotFlag: []goimap.Flag{goimap.FlagDeleted}}
+	if !since.IsZero() {
+		criteria.Since = since
+	}
+	searchData, err := ic.UIDSearch(criteria, nil).Wait()
+	if err != nil {
+		return fmt.Errorf("search %s: %w", mailbox, err)
+	}
+	uids := searchData.AllUIDs()
+	slices.Sort(uids)
+	span.SetAttributes(attribute.Int("mailescrow.messages", len(uids)))
+
+	bodySectionItem := &goimap.FetchItemBodySection{Peek: true}
+	for batch := range slices.Chunk(uids, fetchBatch) {
+		messages, err := ic.Fetch(goimap.UIDSetNum(batch...), &goimap.FetchOptions{
+			UID:         true,
+			BodySection: []*goimap.FetchItemBodySection{bodySectionItem},
+		}).Collect()
+		if err != nil {
+			return fmt.Errorf("fetch: %w", err)
+		}
+		slices.SortFunc(messages, func(a, b *imapclient.FetchMessageBuffer) int { return cmp.Compare(a.UID, b.UID) })
+		for _, msg := range messages {
+			raw := msg.FindBodySection(bodySectionItem)
+			if len(raw) == 0 {
+				continue
+			}
+			if err := fn(parseMessage(raw, c.envelopeHeader)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Append stores raw in mailbox, marked \Seen, creating the mailbox first if
+// it does not exist.
+func (c *Client) Append(ctx context.Context, mailbox string, raw []byte) (err error) {
+	_, span := tracing.Start(ctx, "imap.append",
+		attribute.String("server.address", c.host),
+		attribute.String("mailescrow.mailbox", mailbox))
+	defer func() { tracing.End(span, err) }()
+
+	ic, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ic.Logout().Wait() }()
+
+	if err := ic.Create(mailbox, nil).Wait(); err != nil {
+		var imapErr *goimap.Error
+		if !errors.As(err, &imapErr) || imapErr.Code != goimap.ResponseCodeAlreadyExists {
+			return fmt.Errorf("create folder %s: %w", mailbox, err)
+		}
+	}
+
+	cmd := ic.Append(mailbox, int64(len(raw)), &goimap.AppendOptions{Flags: []goimap.Flag{goimap.FlagSeen}})
+	if _, err := cmd.Write(raw); err != nil {
+		_ = cmd.Close()
+		return fmt.Errorf("append to %s: %w", mailbox, err)
+	}
+	if err := cmd.Close(); err != nil {
+		return fmt.Errorf("append to %s: %w", mailbox, err)
+	}
+	if _, err := cmd.Wait(); err != nil {
+		return fmt.Errorf("append to %s: %w", mailbox, err)
+	}
+	return nil
+}
+
+// ParseMessage reads the fields of a FetchedEmail from a raw message, its
+// envelope recipients from DefaultEnvelopeHeader.
+func ParseMessage(raw []byte) FetchedEmail {
+	return parseMessage(raw, DefaultEnvelopeHeader)
+}
+
+func parseMessage(raw []byte, envelopeHeader string) FetchedEmail {
+	subject, body := mimetext.Parse(raw)
+	sender, recipients := parseAddresses(raw)
+	return FetchedEmail{
+		MessageID:          extractMessageID(raw),
+		Sender:             sender,
+		Recipients:         recipients,
+		Subject:            subject,
+		Body:               body,
+		RawMessage:         raw,
+		EnvelopeRecipients: parseEnvelopeRecipients(raw, envelopeHeader),
+	}
+}
+
 func extractMessageID(raw []byte) string {
 	msg, err := mail.ReadMessage(bytes.NewReader(raw))
 	if err != nil {
@@ -238,25 +493,30 @@ func parseAddresses(raw []byte) (sender string, recipients []string) {
 	return sender, recipients
 }
 
-func parseMessage(raw []byte) (subject, body string) {
+// parseEnvelopeRecipients returns the addresses in the topmost header
+// called name, without duplicates; nil if there is none or it does not
+// parse. Lower copies are not trusted: see Client.SetEnvelopeHeader.
+func parseEnvelopeRecipients(raw []byte, name string) []string {
+	if name == "" {
+		return nil
+	}
 	msg, err := mail.ReadMessage(bytes.NewReader(raw))
 	if err != nil {
-		return "(unknown)", string(raw)
-	}
-	subject = msg.Header.Get("Subject")
-	if subject != "" {
-		decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
-		if err == nil {
-			subject = decoded
-		}
+		return nil
 	}
-	if subject == "" {
-		subject = "(no subject)"
+	values := msg.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	if len(values) == 0 {
+		return nil
 	}
-	bodyBytes, err := io.ReadAll(msg.Body)
+	addrs, err := mail.ParseAddressList(values[0])
 	if err != nil {
-		return subject, ""
+		return nil
+	}
+	var rcpts []string
+	for _, a := range addrs {
+		if !slices.Contains(rcpts, a.Address) {
+			rcpts = append(rcpts, a.Address)
+		}
 	}
-	body = strings.TrimSpace(string(bodyBytes))
-	return subject, body
+	return rcpts
 }
@@ -0,0 +1,231 @@
+package imap
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/fixtures"
+	"github.com/albert/mailescrow/internal/imaptest"
+)
+
+func TestParseEnvelopeRecipients(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		headers string
+		want    []string
+	}{
+		{"none", DefaultEnvelopeHeader, "To: list@example.com\r\n", nil},
+		{"topmost only", DefaultEnvelopeHeader, "Delivered-To: me@gmail.com\r\nDelivered-To: sales@example.com\r\nTo: list@example.com\r\n", []string{"me@gmail.com"}},
+		{"other headers ignored", DefaultEnvelopeHeader, "X-Original-To: ceo@example.com\r\nDelivered-To: catchall@example.com\r\n", []string{"catchall@example.com"}},
+		{"configured header", "X-Original-To", "Delivered-To: catchall@example.com\r\nX-Original-To: sales@example.com\r\nX-Original-To: forged@example.com\r\n", []string{"sales@example.com"}},
+		{"envelope-to list", "Envelope-To", "Envelope-To: a@example.com, <b@example.com>, a@example.com\r\n", []string{"a@example.com", "b@example.com"}},
+		{"unparsable", "X-Original-To", "X-Original-To: not an address\r\nX-Original-To: a@example.com\r\n", nil},
+		{"disabled", "", "Delivered-To: a@example.com\r\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte(tt.headers + "Subject: Hi\r\n\r\nbody")
+			if got := parseEnvelopeRecipients(raw, tt.header); !slices.Equal(got, tt.want) {
+				t.Errorf("parseEnvelopeRecipients = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliveredTo(t *testing.T) {
+	f := FetchedEmail{Recipients: []string{"list@example.com"}}
+	if got := f.DeliveredTo(); !slices.Equal(got, f.Recipients) {
+		t.Errorf("DeliveredTo = %v, want the To recipients without envelope headers", got)
+	}
+	f.EnvelopeRecipients = []string{"sales@example.com"}
+	if got := f.DeliveredTo(); !slices.Equal(got, f.EnvelopeRecipients) {
+		t.Errorf("DeliveredTo = %v, want the envelope recipients", got)
+	}
+}
+
+func newTestClient(t *testing.T) (*Client, *imaptest.Server) {
+	t.Helper()
+	srv := imaptest.NewServer(t)
+	c := New(srv.Host, srv.Port, imaptest.Username, imaptest.Password, false)
+	if err := c.EnsureFolders(t.Context()); err != nil {
+		t.Fatalf("ensure folders: %v", err)
+	}
+	return c, srv
+}
+
+func messageIDs(raw [][]byte) []string {
+	ids := make([]string, len(raw))
+	for i, r := range raw {
+		ids[i] = extractMessageID(r)
+	}
+	return ids
+}
+
+func TestEnsureFolders(t *testing.T) {
+	c, srv := newTestClient(t)
+	if err := c.EnsureFolders(t.Context()); err != nil {
+		t.Fatalf("ensure folders again: %v", err)
+	}
+	got := srv.Mailboxes()
+	for _, want := range []string{FolderReceived, FolderApproved, FolderRejected, FolderRead} {
+		if !slices.Contains(got, want) {
+			t.Errorf("mailboxes = %v, want %s", got, want)
+		}
+	}
+}
+
+func TestPoll(t *testing.T) {
+	c, srv := newTestClient(t)
+	samples := fixtures.Samples()
+	for _, m := range samples {
+		srv.Deliver("INBOX", m.Bytes())
+	}
+	known := fixtures.Message{MessageID: "known@example.org", Subject: "Already held", Text: "Held."}
+	srv.Deliver("INBOX", known.Bytes())
+
+	fetched, err := c.Poll(t.Context(), FolderInbox, []string{"<known@example.org>"})
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if len(fetched) != len(samples) {
+		t.Fatalf("fetched %d messages, want %d", len(fetched), len(samples))
+	}
+	for i, f := range fetched {
+		if f.Subject != samples[i].Subject {
+			t.Errorf("message %d subject = %q, want %q", i, f.Subject, samples[i].Subject)
+		}
+		if f.MessageID == "" || f.Sender == "" || len(f.Recipients) == 0 || len(f.RawMessage) == 0 {
+			t.Errorf("message %d not parsed: %+v", i, f)
+		}
+	}
+	if got := fetched[len(fetched)-1].EnvelopeRecipients; !slices.Equal(got, []string{"sales@example.com"}) {
+		t.Errorf("envelope recipients = %v, want the Delivered-To address", got)
+	}
+
+	if got := messageIDs(srv.Messages("INBOX")); !slices.Equal(got, []string{"<known@example.org>"}) {
+		t.Errorf("INBOX = %v, want only the known message left", got)
+	}
+	received := srv.Messages(FolderReceived)
+	if len(received) != len(samples) {
+		t.Errorf("%s holds %d messages, want %d", FolderReceived, len(received), len(samples))
+	}
+	for i, flags := range srv.Flags(FolderReceived) {
+		if slices.Contains(flags, "\\Seen") {
+			t.Errorf("message %d marked seen by polling", i)
+		}
+	}
+
+	again, err := c.Poll(t.Context(), FolderInbox, []string{"<known@example.org>"})
+	if err != nil || len(again) != 0 {
+		t.Errorf("second poll = %d messages (%v), want none", len(again), err)
+	}
+}
+
+func TestMoveMessage(t *testing.T) {
+	c, srv := newTestClient(t)
+	m := fixtures.Message{MessageID: "move@example.org", Subject: "Move me", Text: "Hi."}
+	srv.Deliver(FolderReceived, m.Bytes())
+	srv.Deliver(FolderReceived, fixtures.Message{Subject: "Stay", Text: "Hi."}.Bytes())
+
+	if err := c.MoveMessage(t.Context(), "<move@example.org>", FolderReceived, FolderApproved); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if got := messageIDs(srv.Messages(FolderApproved)); !slices.Equal(got, []string{"<move@example.org>"}) {
+		t.Errorf("%s = %v, want the moved message", FolderApproved, got)
+	}
+	if got := srv.Messages(FolderReceived); len(got) != 1 {
+		t.Errorf("%s holds %d messages, want the other one left", FolderReceived, len(got))
+	}
+
+	if err := c.MoveMessage(t.Context(), "<move@example.org>", FolderReceived, FolderApproved); err == nil {
+		t.Error("moving a message that is no longer there succeeded")
+	}
+}
+
+func TestListMessageIDs(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.Deliver(FolderApproved, fixtures.Message{MessageID: "a@example.org"}.Bytes())
+	srv.Deliver(FolderApproved, []byte("Subject: No id\r\n\r\nHi.\r\n"))
+	srv.Deliver(FolderApproved, fixtures.Message{MessageID: "b@example.org"}.Bytes())
+
+	got, err := c.ListMessageIDs(t.Context(), FolderApproved)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if want := []string{"<a@example.org>", "<b@example.org>"}; !slices.Equal(got, want) {
+		t.Errorf("message IDs = %v, want %v", got, want)
+	}
+	if got, err := c.ListMessageIDs(t.Context(), FolderRead); err != nil || len(got) != 0 {
+		t.Errorf("empty mailbox = %v (%v), want none", got, err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	c, srv := newTestClient(t)
+	for _, id := range []string{"a@example.org", "b@example.org", "c@example.org"} {
+		srv.Deliver("Archive", fixtures.Message{MessageID: id, Subject: "Old " + id}.Bytes())
+	}
+
+	var got []string
+	err := c.Fetch(t.Context(), "Archive", time.Time{}, func(f FetchedEmail) error {
+		got = append(got, f.MessageID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if want := []string{"<a@example.org>", "<b@example.org>", "<c@example.org>"}; !slices.Equal(got, want) {
+		t.Errorf("fetched %v, want %v", got, want)
+	}
+	if msgs, flags := srv.Messages("Archive"), srv.Flags("Archive"); len(msgs) != 3 || slices.Contains(flags[0], "\\Seen") {
+		t.Errorf("Archive has %d messages with flags %v, want them left unread", len(msgs), flags)
+	}
+
+	got = nil
+	err = c.Fetch(t.Context(), "Archive", time.Now().Add(48*time.Hour), func(f FetchedEmail) error {
+		got = append(got, f.MessageID)
+		return nil
+	})
+	if err != nil || len(got) != 0 {
+		t.Errorf("fetched %v (%v) since the day after tomorrow, want none", got, err)
+	}
+
+	stop := errors.New("stop")
+	if err := c.Fetch(t.Context(), "Archive", time.Time{}, func(FetchedEmail) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("err = %v, want fn's error", err)
+	}
+	if err := c.Fetch(t.Context(), "Missing", time.Time{}, func(FetchedEmail) error { return nil }); err == nil {
+		t.Error("expected an error for a missing mailbox")
+	}
+}
+
+func TestAppend(t *testing.T) {
+	c, srv := newTestClient(t)
+	raw := fixtures.Message{MessageID: "sent@example.org", Subject: "Sent", Text: "Hi."}.Bytes()
+	if err := c.Append(t.Context(), "Archive/2026", raw); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if got := messageIDs(srv.Messages("Archive/2026")); !slices.Equal(got, []string{"<sent@example.org>"}) {
+		t.Errorf("Archive/2026 = %v, want the appended message", got)
+	}
+	if flags := srv.Flags("Archive/2026"); len(flags) != 1 || !slices.Contains(flags[0], "\\Seen") {
+		t.Errorf("flags = %v, want the appended message seen", flags)
+	}
+}
+
+func TestLoginFailure(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.Deliver("INBOX", fixtures.Message{Subject: "Waiting", Text: "Hi."}.Bytes())
+	srv.SetDown(true)
+	if _, err := c.Poll(t.Context(), FolderInbox, nil); err == nil || !strings.Contains(err.Error(), "login") {
+		t.Errorf("poll while down = %v, want a login error", err)
+	}
+	srv.SetDown(false)
+	if fetched, err := c.Poll(t.Context(), FolderInbox, nil); err != nil || len(fetched) != 1 {
+		t.Errorf("poll after recovery = %d messages (%v), want 1", len(fetched), err)
+	}
+}
@@ -0,0 +1,206 @@
+// Package imaptest runs an in-memory IMAP server for tests, so the IMAP
+// client, the poller and reconciliation can be exercised end to end against
+// real IMAP commands (SELECT, UID SEARCH, FETCH, MOVE, APPEND).
+package imaptest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	goimap "github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-imap/v2/imapserver/imapmemserver"
+)
+
+// Credentials of the server's only account.
+const (
+	Username = "mailescrow@example.com"
+	Password = "secret"
+)
+
+// inspector logs in to the same account while the server is down, so tests
+// can look at the mailboxes.
+const inspector = "imaptest"
+
+// Server is an IMAP server holding one account's mailboxes in memory. It
+// speaks plain IMAP (no TLS) on a loopback port and starts with an empty
+// INBOX.
+type Server struct {
+	Host string
+	Port int
+
+	t    testing.TB
+	user *imapmemserver.User
+
+	mu   sync.Mutex
+	down bool
+}
+
+// NewServer starts a Server that is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("imaptest: listen: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(lis.Addr().String())
+	s := &Server{Host: host, t: t, user: imapmemserver.NewUser(Username, Password)}
+	s.Port, _ = strconv.Atoi(port)
+	if err := s.user.Create("INBOX", nil); err != nil {
+		t.Fatalf("imaptest: create INBOX: %v", err)
+	}
+
+	srv := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return &session{srv: s}, nil, nil
+		},
+		Caps:         goimap.CapSet{goimap.CapIMAP4rev1: {}, goimap.CapIMAP4rev2: {}},
+		InsecureAuth: true,
+		Logger:       discard{},
+	})
+	go srv.Serve(lis) //nolint:errcheck
+	t.Cleanup(func() { _ = srv.Close() })
+	return s
+}
+
+// Addr returns the server's host:port.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// SetDown makes logins fail while down is true, as when the server is
+// unreachable or the password was changed, so tests can drive the poller's
+// backoff and circuit breaker.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *Server) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+// Deliver stores raw in mailbox, creating the mailbox if needed, as if the
+// server had received it.
+func (s *Server) Deliver(mailbox string, raw []byte) {
+	s.t.Helper()
+	if err := s.user.Create(mailbox, nil); err != nil {
+		var imapErr *goimap.Error
+		if !errors.As(err, &imapErr) || imapErr.Code != goimap.ResponseCodeAlreadyExists {
+			s.t.Fatalf("imaptest: create %s: %v", mailbox, err)
+		}
+	}
+	if _, err := s.user.Append(mailbox, bytes.NewReader(raw), &goimap.AppendOptions{}); err != nil {
+		s.t.Fatalf("imaptest: append to %s: %v", mailbox, err)
+	}
+}
+
+// Mailboxes returns the names of the account's mailboxes.
+func (s *Server) Mailboxes() []string {
+	s.t.Helper()
+	c := s.dial()
+	defer func() { _ = c.Logout().Wait() }()
+
+	list, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		s.t.Fatalf("imaptest: list: %v", err)
+	}
+	names := make([]string, len(list))
+	for i, mbox := range list {
+		names[i] = mbox.Mailbox
+	}
+	return names
+}
+
+// Messages returns the raw messages in mailbox, oldest first, or nil if the
+// mailbox does not exist. Messages flagged \Deleted are left out.
+func (s *Server) Messages(mailbox string) [][]byte {
+	s.t.Helper()
+	section := &goimap.FetchItemBodySection{Peek: true}
+	msgs := s.fetch(mailbox, &goimap.FetchOptions{BodySection: []*goimap.FetchItemBodySection{section}})
+	raw := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		raw[i] = msg.FindBodySection(section)
+	}
+	return raw
+}
+
+// Flags returns the flags of the messages Messages returns.
+func (s *Server) Flags(mailbox string) [][]goimap.Flag {
+	s.t.Helper()
+	msgs := s.fetch(mailbox, &goimap.FetchOptions{Flags: true})
+	flags := make([][]goimap.Flag, len(msgs))
+	for i, msg := range msgs {
+		flags[i] = msg.Flags
+	}
+	return flags
+}
+
+func (s *Server) fetch(mailbox string, options *goimap.FetchOptions) []*imapclient.FetchMessageBuffer {
+	s.t.Helper()
+	c := s.dial()
+	defer func() { _ = c.Logout().Wait() }()
+
+	if _, err := c.Select(mailbox, &goimap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		return nil
+	}
+	search, err := c.UIDSearch(&goimap.SearchCriteria{NotFlag: []goimap.Flag{goimap.FlagDeleted}}, nil).Wait()
+	if err != nil {
+		s.t.Fatalf("imaptest: search %s: %v", mailbox, err)
+	}
+	uids := search.AllUIDs()
+	if len(uids) == 0 {
+		return nil
+	}
+	options.UID = true
+	msgs, err := c.Fetch(goimap.UIDSetNum(uids...), options).Collect()
+	if err != nil {
+		s.t.Fatalf("imaptest: fetch %s: %v", mailbox, err)
+	}
+	return msgs
+}
+
+func (s *Server) dial() *imapclient.Client {
+	s.t.Helper()
+	c, err := imapclient.DialInsecure(s.Addr(), nil)
+	if err != nil {
+		s.t.Fatalf("imaptest: dial: %v", err)
+	}
+	if err := c.Login(inspector, Password).Wait(); err != nil {
+		s.t.Fatalf("imaptest: login: %v", err)
+	}
+	return c
+}
+
+// session is imapmemserver's session for the server's one account, with
+// logins refused while the server is down.
+type session struct {
+	*imapmemserver.UserSession // nil until logged in
+
+	srv *Server
+}
+
+func (sess *session) Login(username, password string) error {
+	if username == inspector {
+		username = Username
+	} else if sess.srv.isDown() {
+		return &goimap.Error{Type: goimap.StatusResponseTypeNo, Code: goimap.ResponseCodeUnavailable, Text: "Server unavailable"}
+	}
+	if err := sess.srv.user.Login(username, password); err != nil {
+		return err
+	}
+	sess.UserSession = imapmemserver.NewUserSession(sess.srv.user)
+	return nil
+}
+
+type discard struct{}
+
+func (discard) Printf(string, ...any) {}
@@ -0,0 +1,304 @@
+// Package jobs runs the side effects of reviewer decisions and alerts, such
+// as IMAP moves, rejection notices and webhooks, from a queue kept in the
+// store. A job that fails is retried with backoff, and one that was running
+// when the process stopped is run again on the next start, so neither an
+// outage nor a restart loses it.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Kinds of job.
+const (
+	KindRelay    = "relay"     // send a message through the relay, e.g. a forward
+	KindIMAPMove = "imap_move" // move a message between IMAP folders
+	KindWebhook  = "webhook"   // post an alert to a webhook
+	KindNotify   = "notify"    // send a rejection notice to a sender
+	KindSend     = "send"      // relay an approved email once its sending window opens
+	KindDelivery = "delivery"  // post an event to a webhook an API token registered
+)
+
+const (
+	// MaxAttempts is how many times a job is run before it is marked failed.
+	MaxAttempts = 10
+	// DefaultInterval is how often Run looks for jobs that are due.
+	DefaultInterval = 5 * time.Second
+
+	minBackoff = 30 * time.Second
+	maxBackoff = time.Hour
+)
+
+// Handler runs a job. An error makes the job run again later.
+type Handler func(ctx context.Context, job store.Job) error
+
+// Queue persists jobs and runs them through the handler registered for their
+// kind.
+type Queue struct {
+	st   store.ReadWriter
+	now  func() time.Time
+	wake chan struct{} // signalled when a job was made due
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	secret   string // signs webhook requests; see SetWebhookSecret
+}
+
+// New creates a Queue with a handler for KindWebhook.
+func New(st store.ReadWriter) *Queue {
+	q := &Queue{st: st, now: time.Now, wake: make(chan struct{}, 1), handlers: make(map[string]Handler)}
+	q.Handle(KindWebhook, q.runWebhook)
+	return q
+}
+
+// SetWebhookSecret signs the webhook requests of jobs run from now on with
+// secret, or sends them unsigned if it is empty. The secret is not stored
+// with the jobs, so retries are signed with the current one.
+func (q *Queue) SetWebhookSecret(secret string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.secret = secret
+}
+
+// WebhookSecret returns the secret webhook requests are signed with, for
+// handlers that post to webhooks themselves.
+func (q *Queue) WebhookSecret() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.secret
+}
+
+// Handle registers h to run jobs of kind, replacing any handler it had.
+func (q *Queue) Handle(kind string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = h
+}
+
+// Add persists a job of kind about emailID (which may be empty) with payload
+// marshalled as JSON, then runs it straight away, so in the normal case the
+// side effect has happened when Add returns. If that run fails the job is
+// left for Run to retry; only failing to persist it is returned.
+func (q *Queue) Add(ctx context.Context, kind, emailID string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal %s job: %w", kind, err)
+	}
+	// Added as running, so a worker cannot claim it while it runs here.
+	job := store.Job{Kind: kind, EmailID: emailID, Payload: data, Status: store.JobRunning, Attempts: 1, CreatedAt: q.now().UTC()}
+	id, err := q.st.AddJob(ctx, job)
+	if err != nil {
+		return fmt.Errorf("add %s job: %w", kind, err)
+	}
+	job.ID = id
+	q.run(ctx, job)
+	return nil
+}
+
+// Schedule persists a job like Add, but leaves it for Run to start at at,
+// waking Run if that is already due.
+func (q *Queue) Schedule(ctx context.Context, kind, emailID string, payload any, at time.Time) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal %s job: %w", kind, err)
+	}
+	job := store.Job{Kind: kind, EmailID: emailID, Payload: data, Status: store.JobPending, RunAt: at.UTC(), CreatedAt: q.now().UTC()}
+	if _, err := q.st.AddJob(ctx, job); err != nil {
+		return fmt.Errorf("add %s job: %w", kind, err)
+	}
+	if !at.After(q.now()) {
+		q.signal()
+	}
+	return nil
+}
+
+// Send is the payload of a KindSend job: the approval to record once the
+// scheduled email it is about has been relayed.
+type Send struct {
+	Decision store.Decision `json:"decision"`
+}
+
+// ScheduleSend marks the approved outbound email id scheduled for at, with a
+// KindSend job to relay it then and record d. The handler for KindSend is
+// registered by whoever relays held mail.
+func (q *Queue) ScheduleSend(ctx context.Context, id string, d store.Decision, at time.Time) error {
+	// The job is queued first: one that finds its email unscheduled does
+	// nothing, while a scheduled email without a job would never be sent.
+	if err := q.Schedule(ctx, KindSend, id, Send{Decision: d}, at); err != nil {
+		return err
+	}
+	return q.st.Schedule(ctx, id, at)
+}
+
+// Resume returns jobs that were running when the process last stopped to the
+// queue. Call it once at startup, before anything adds jobs.
+func (q *Queue) Resume(ctx context.Context) error {
+	n, err := q.st.ResetRunningJobs(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Resuming %d jobs interrupted by the last shutdown", n)
+	}
+	return nil
+}
+
+// Run runs due jobs every interval, and as soon as Retry or Schedule makes one
+// due, until ctx is cancelled.
+func (q *Queue) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.RunDue(ctx); err != nil {
+			log.Printf("Run jobs: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// RunDue runs every job that is due, one at a time.
+func (q *Queue) RunDue(ctx context.Context) error {
+	for ctx.Err() == nil {
+		job, err := q.st.ClaimJob(ctx, q.now())
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return nil
+		}
+		q.run(ctx, *job)
+	}
+	return nil
+}
+
+// run runs a claimed job, then deletes it if it succeeded and otherwise
+// schedules its next attempt or, after MaxAttempts, marks it failed.
+func (q *Queue) run(ctx context.Context, job store.Job) {
+	q.mu.Lock()
+	h := q.handlers[job.Kind]
+	q.mu.Unlock()
+
+	err := fmt.Errorf("no handler for %s jobs", job.Kind)
+	if h != nil {
+		err = h(ctx, job)
+	}
+	// Record the outcome even if the request that added the job is gone, or
+	// the job would stay running until the next start.
+	ctx = context.WithoutCancel(ctx)
+	if err == nil {
+		metrics.JobRuns.Inc(job.Kind, "succeeded")
+		if err := q.st.DeleteJob(ctx, job.ID); err != nil {
+			log.Printf("delete %s job %s: %v", job.Kind, job.ID, err)
+		}
+		return
+	}
+
+	if job.Attempts >= MaxAttempts {
+		metrics.JobRuns.Inc(job.Kind, "failed")
+		log.Printf("%s job %s failed after %d attempts, giving up: %v", job.Kind, job.ID, job.Attempts, err)
+		if err := q.st.FailJob(ctx, job.ID, err.Error()); err != nil {
+			log.Printf("mark %s job %s failed: %v", job.Kind, job.ID, err)
+		}
+		return
+	}
+	metrics.JobRuns.Inc(job.Kind, "retrying")
+	delay := backoff(job.Attempts)
+	log.Printf("%s job %s failed (attempt %d of %d), retrying in %s: %v", job.Kind, job.ID, job.Attempts, MaxAttempts, delay, err)
+	if err := q.st.RetryJobAt(ctx, job.ID, err.Error(), q.now().Add(delay)); err != nil {
+		log.Printf("reschedule %s job %s: %v", job.Kind, job.ID, err)
+	}
+}
+
+// backoff is the wait after the given failed attempt: 30s doubling up to an
+// hour.
+func backoff(attempt int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+// List returns every queued or failed job, oldest first.
+func (q *Queue) List(ctx context.Context) ([]store.Job, error) {
+	return q.st.ListJobs(ctx)
+}
+
+// Retry makes a pending or failed job due now, with a fresh set of attempts.
+func (q *Queue) Retry(ctx context.Context, id string) error {
+	if err := q.st.RequeueJob(ctx, id); err != nil {
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// signal wakes Run to look for due jobs.
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Discard deletes a job without running it.
+func (q *Queue) Discard(ctx context.Context, id string) error {
+	return q.st.DeleteJob(ctx, id)
+}
+
+// webhookJob is the payload of a KindWebhook job.
+type webhookJob struct {
+	URL   string       `json:"url"`
+	Event notify.Event `json:"event"`
+}
+
+// Notifier returns a notify.Notifier that delivers events to the webhook at
+// url through q, or nil if url is empty.
+func (q *Queue) Notifier(url string) notify.Notifier {
+	if url == "" {
+		return nil
+	}
+	return &queuedWebhook{q: q, url: url}
+}
+
+type queuedWebhook struct {
+	q   *Queue
+	url string
+}
+
+// Notify queues e for the webhook. Delivery failures are retried by the
+// queue, so only failing to queue e is returned.
+func (n *queuedWebhook) Notify(ctx context.Context, e notify.Event) error {
+	if e.Time.IsZero() {
+		e.Time = n.q.now().UTC()
+	}
+	return n.q.Add(ctx, KindWebhook, e.EmailID, webhookJob{URL: n.url, Event: e})
+}
+
+func (q *Queue) runWebhook(ctx context.Context, job store.Job) error {
+	var p webhookJob
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("unmarshal payload: %w", err)
+	}
+	q.mu.Lock()
+	secret := q.secret
+	q.mu.Unlock()
+	wh := notify.NewWebhook(p.URL)
+	wh.SetSecret(secret)
+	return wh.Notify(ctx, p.Event)
+}
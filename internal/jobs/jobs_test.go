@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestAddRunsJob(t *testing.T) {
+	st := store.NewMemory()
+	q := New(st)
+	var got []string
+	q.Handle(KindIMAPMove, func(_ context.Context, job store.Job) error {
+		var to string
+		if err := json.Unmarshal(job.Payload, &to); err != nil {
+			return err
+		}
+		got = append(got, job.EmailID+" "+to)
+		return nil
+	})
+	if err := q.Add(t.Context(), KindIMAPMove, "e1", "mailescrow/approved"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if len(got) != 1 || got[0] != "e1 mailescrow/approved" {
+		t.Errorf("handler ran with %q, want the job run once on Add", got)
+	}
+	if jobs, _ := q.List(t.Context()); len(jobs) != 0 {
+		t.Errorf("jobs = %+v, want none left after success", jobs)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	st := store.NewMemory()
+	q := New(st)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+	runs := 0
+	q.Handle(KindSend, func(context.Context, store.Job) error {
+		runs++
+		return nil
+	})
+	if err := q.Schedule(t.Context(), KindSend, "e1", struct{}{}, now.Add(time.Hour)); err != nil {
+		t.Fatalf("schedule: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil || runs != 0 {
+		t.Fatalf("run due before the job's time: runs = %d, %v, want 0", runs, err)
+	}
+	now = now.Add(time.Hour)
+	if err := q.RunDue(t.Context()); err != nil || runs != 1 {
+		t.Errorf("run due at the job's time: runs = %d, %v, want 1", runs, err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	st := store.NewMemory()
+	q := New(st)
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	fail := true
+	runs := 0
+	q.Handle(KindNotify, func(context.Context, store.Job) error {
+		runs++
+		if fail {
+			return errors.New("relay down")
+		}
+		return nil
+	})
+	if err := q.Add(t.Context(), KindNotify, "e1", nil); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	jobs, _ := q.List(t.Context())
+	if len(jobs) != 1 || jobs[0].Status != store.JobPending || jobs[0].LastError != "relay down" || !jobs[0].RunAt.Equal(now.Add(minBackoff)) {
+		t.Fatalf("jobs = %+v, want one pending retry due after the minimum backoff", jobs)
+	}
+
+	// Not due yet.
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run due: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("runs = %d, want 1 before the backoff passed", runs)
+	}
+
+	// Every attempt fails until the job is given up on.
+	for i := 2; i <= MaxAttempts; i++ {
+		now = now.Add(maxBackoff)
+		if err := q.RunDue(t.Context()); err != nil {
+			t.Fatalf("run due: %v", err)
+		}
+	}
+	jobs, _ = q.List(t.Context())
+	if runs != MaxAttempts || len(jobs) != 1 || jobs[0].Status != store.JobFailed {
+		t.Fatalf("after %d runs jobs = %+v, want the job failed after %d", runs, jobs, MaxAttempts)
+	}
+	now = now.Add(maxBackoff)
+	if err := q.RunDue(t.Context()); err != nil || runs != MaxAttempts {
+		t.Errorf("a failed job ran again: runs = %d, %v", runs, err)
+	}
+
+	// An operator retries it once the relay is back.
+	fail = false
+	if err := q.Retry(t.Context(), jobs[0].ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run due: %v", err)
+	}
+	if jobs, _ := q.List(t.Context()); len(jobs) != 0 {
+		t.Errorf("jobs = %+v, want none after the retry succeeded", jobs)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 8: time.Hour, 20: time.Hour} {
+		if got := backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	st := store.NewMemory()
+	// A job left running by a process that stopped mid-run.
+	if _, err := st.AddJob(t.Context(), store.Job{Kind: KindRelay, Status: store.JobRunning, Attempts: 1}); err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+	q := New(st)
+	runs := 0
+	q.Handle(KindRelay, func(context.Context, store.Job) error { runs++; return nil })
+	if err := q.Resume(t.Context()); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run due: %v", err)
+	}
+	if runs != 1 {
+		t.Errorf("runs = %d, want the interrupted job run again", runs)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	var got notify.Event
+	var signature string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Mailescrow-Signature")
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	q := New(store.NewMemory())
+	q.SetWebhookSecret("s3cret")
+	if q.Notifier("") != nil {
+		t.Error("Notifier(\"\") is not nil")
+	}
+	if err := q.Notifier(srv.URL).Notify(t.Context(), notify.Event{Type: notify.EventSLAExceeded, EmailID: "e1"}); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if got.Type != notify.EventSLAExceeded || got.EmailID != "e1" || got.Time.IsZero() {
+		t.Errorf("webhook received %+v", got)
+	}
+	if !strings.HasPrefix(signature, "v1=") {
+		t.Errorf("signature = %q, want the request signed", signature)
+	}
+}
@@ -0,0 +1,112 @@
+// Package journal archives a copy of every relayed outbound email for
+// compliance ("journaling") and files it in the IMAP account's Sent folder.
+// Archiving never blocks delivery: failures are logged and counted, and the
+// relay result stands.
+package journal
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Appender stores a raw message in an IMAP mailbox. *imap.Client implements it.
+type Appender interface {
+	Append(ctx context.Context, mailbox string, raw []byte) error
+}
+
+// Sender wraps a relay.Sender and archives each message it relays
+// successfully: as a BCC to an archive address, into IMAP mailboxes, or both.
+type Sender struct {
+	next    relay.Sender
+	address string // empty disables the BCC copy
+
+	mu     sync.Mutex
+	copies []mailboxCopy // at most one per target; replaced on a configuration reload
+}
+
+// mailboxCopy is an IMAP mailbox that receives every relayed message.
+type mailboxCopy struct {
+	appender Appender
+	mailbox  string
+	target   string // metrics label: "mailbox" or "sent"
+}
+
+// New wraps next, BCC'ing every relayed message to address. An empty address
+// sends no copy; use SetMailbox to archive over IMAP instead or as well.
+func New(next relay.Sender, address string) *Sender {
+	return &Sender{next: next, address: address}
+}
+
+// SetMailbox also appends every relayed message to the journal mailbox
+// through a. It replaces any earlier journal mailbox; an empty mailbox stops
+// the copy.
+func (s *Sender) SetMailbox(a Appender, mailbox string) {
+	s.setCopy(mailboxCopy{appender: a, mailbox: mailbox, target: "mailbox"})
+}
+
+// SetSentFolder also appends every relayed message to folder through a, so
+// the account keeps a record of mail sent on its behalf. It replaces any
+// earlier Sent folder; an empty folder stops the copy.
+func (s *Sender) SetSentFolder(a Appender, folder string) {
+	s.setCopy(mailboxCopy{appender: a, mailbox: folder, target: "sent"})
+}
+
+func (s *Sender) setCopy(c mailboxCopy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Build a new slice: archive may still be reading the old one.
+	copies := slices.DeleteFunc(slices.Clone(s.copies), func(old mailboxCopy) bool { return old.target == c.target })
+	if c.mailbox != "" {
+		copies = append(copies, c)
+	}
+	s.copies = copies
+}
+
+// Send relays email, then archives it. Only the relay error is returned.
+func (s *Sender) Send(ctx context.Context, email *store.Email) error {
+	if err := s.next.Send(ctx, email); err != nil {
+		return err
+	}
+	s.archive(ctx, email)
+	return nil
+}
+
+// Preview returns the raw message as the wrapped sender transmits it.
+func (s *Sender) Preview(email *store.Email) []byte {
+	if p, ok := s.next.(relay.Previewer); ok {
+		return p.Preview(email)
+	}
+	return email.RawMessage
+}
+
+func (s *Sender) archive(ctx context.Context, email *store.Email) {
+	if s.address != "" {
+		// Same message and envelope sender, with the archive as the only
+		// recipient, so the copy is byte-for-byte what was relayed.
+		copied := *email
+		copied.Recipients = []string{s.address}
+		if err := s.next.Send(ctx, &copied); err != nil {
+			log.Printf("journal email %s to %s: %v", email.ID, s.address, err)
+			metrics.JournalFailures.Inc("address")
+		}
+	}
+	s.mu.Lock()
+	copies := s.copies
+	s.mu.Unlock()
+	if len(copies) == 0 {
+		return
+	}
+	raw := s.Preview(email)
+	for _, c := range copies {
+		if err := c.appender.Append(ctx, c.mailbox, raw); err != nil {
+			log.Printf("journal email %s to IMAP %s: %v", email.ID, c.mailbox, err)
+			metrics.JournalFailures.Inc(c.target)
+		}
+	}
+}
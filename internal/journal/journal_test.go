@@ -0,0 +1,143 @@
+package journal
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeSender struct {
+	sent []*store.Email
+	fail map[string]bool // recipients whose delivery fails
+}
+
+func (f *fakeSender) Send(_ context.Context, email *store.Email) error {
+	for _, rcpt := range email.Recipients {
+		if f.fail[rcpt] {
+			return errors.New("550 mailbox unavailable")
+		}
+	}
+	f.sent = append(f.sent, email)
+	return nil
+}
+
+func (f *fakeSender) Preview(email *store.Email) []byte {
+	return append([]byte("X-Stamped: yes\r\n"), email.RawMessage...)
+}
+
+type fakeAppender struct {
+	appended map[string][]byte // mailbox → raw message
+	err      error
+}
+
+func (f *fakeAppender) Append(_ context.Context, mailbox string, raw []byte) error {
+	if f.appended == nil {
+		f.appended = make(map[string][]byte)
+	}
+	f.appended[mailbox] = raw
+	return f.err
+}
+
+func outbound() *store.Email {
+	return &store.Email{
+		ID:         "e1",
+		Direction:  store.DirectionOutbound,
+		Sender:     "app@example.com",
+		Recipients: []string{"bob@example.com"},
+		RawMessage: []byte("Subject: Hi\r\n\r\nhello\r\n"),
+	}
+}
+
+func TestArchivesRelayedMail(t *testing.T) {
+	next := &fakeSender{}
+	appender := &fakeAppender{}
+	s := New(next, "archive@example.com")
+	s.SetMailbox(appender, "Archive")
+
+	email := outbound()
+	if err := s.Send(t.Context(), email); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(next.sent) != 2 {
+		t.Fatalf("sent %d messages, want the original and the archive copy", len(next.sent))
+	}
+	if got := next.sent[1].Recipients; !slices.Equal(got, []string{"archive@example.com"}) || next.sent[1].Sender != "app@example.com" {
+		t.Errorf("archive copy = %+v", next.sent[1])
+	}
+	if !slices.Equal(email.Recipients, []string{"bob@example.com"}) {
+		t.Errorf("original recipients changed to %v", email.Recipients)
+	}
+	if got := string(appender.appended["Archive"]); got != "X-Stamped: yes\r\nSubject: Hi\r\n\r\nhello\r\n" {
+		t.Errorf("appended %q to Archive, want the message as relayed", got)
+	}
+}
+
+func TestArchiveFailuresDoNotBlockDelivery(t *testing.T) {
+	next := &fakeSender{fail: map[string]bool{"archive@example.com": true}}
+	s := New(next, "archive@example.com")
+	full := &fakeAppender{err: errors.New("mailbox full")}
+	s.SetMailbox(full, "Archive")
+	s.SetSentFolder(full, "Sent")
+
+	failures := func() float64 {
+		return metrics.JournalFailures.Value("address") + metrics.JournalFailures.Value("mailbox") + metrics.JournalFailures.Value("sent")
+	}
+	before := failures()
+	if err := s.Send(t.Context(), outbound()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if after := failures(); after != before+3 {
+		t.Errorf("journal failures grew by %v, want 3", after-before)
+	}
+}
+
+func TestNoArchiveWhenRelayFails(t *testing.T) {
+	next := &fakeSender{fail: map[string]bool{"bob@example.com": true}}
+	appender := &fakeAppender{}
+	s := New(next, "archive@example.com")
+	s.SetMailbox(appender, "Archive")
+
+	if err := s.Send(t.Context(), outbound()); err == nil {
+		t.Fatal("expected the relay error")
+	}
+	if len(next.sent) != 0 || len(appender.appended) != 0 {
+		t.Errorf("archived mail that was not relayed")
+	}
+}
+
+func TestSentFolderOnly(t *testing.T) {
+	next := &fakeSender{}
+	appender := &fakeAppender{}
+	s := New(next, "")
+	s.SetSentFolder(appender, "mailescrow/sent")
+
+	if err := s.Send(t.Context(), outbound()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(next.sent) != 1 {
+		t.Errorf("sent %d messages, want only the original", len(next.sent))
+	}
+	if _, ok := appender.appended["mailescrow/sent"]; !ok || len(appender.appended) != 1 {
+		t.Errorf("appended to %v, want only mailescrow/sent", appender.appended)
+	}
+}
+
+func TestSetFoldersReplaces(t *testing.T) {
+	appender := &fakeAppender{}
+	s := New(&fakeSender{}, "")
+	s.SetSentFolder(appender, "Sent")
+	s.SetMailbox(appender, "Archive")
+	s.SetSentFolder(appender, "Sent Items")
+	s.SetMailbox(appender, "")
+
+	if err := s.Send(t.Context(), outbound()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, ok := appender.appended["Sent Items"]; !ok || len(appender.appended) != 1 {
+		t.Errorf("appended to %v, want only the replacement Sent Items", appender.appended)
+	}
+}
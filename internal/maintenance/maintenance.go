@@ -0,0 +1,91 @@
+// Package maintenance keeps the database compact and its query plans current,
+// and reports how large it is so operators notice when it needs attention.
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// MeasureInterval is how often the size metrics are refreshed.
+const MeasureInterval = time.Minute
+
+// Maintainer runs maintenance on the store and measures it. Only the store's
+// owner creates one.
+type Maintainer struct {
+	st  store.Lifecycle
+	now func() time.Time
+}
+
+// New creates a Maintainer.
+func New(st store.Lifecycle) *Maintainer {
+	return &Maintainer{st: st, now: time.Now}
+}
+
+// Run maintains the database every interval, starting now, and measures it
+// every MeasureInterval until ctx is cancelled. A zero interval only
+// measures.
+func (m *Maintainer) Run(ctx context.Context, interval time.Duration) {
+	var maintain <-chan time.Time
+	if interval > 0 {
+		log.Printf("Database maintenance started (interval: %s)", interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		maintain = ticker.C
+		m.run(ctx)
+	}
+	measure := time.NewTicker(MeasureInterval)
+	defer measure.Stop()
+
+	for {
+		if err := m.Measure(ctx); err != nil {
+			log.Printf("Measure database: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-maintain:
+			m.run(ctx)
+		case <-measure.C:
+		}
+	}
+}
+
+func (m *Maintainer) run(ctx context.Context) {
+	start := m.now()
+	if err := m.Maintain(ctx); err != nil {
+		log.Printf("Database maintenance: %v", err)
+		return
+	}
+	log.Printf("Database maintenance finished in %s", m.now().Sub(start).Round(time.Millisecond))
+}
+
+// Maintain runs one round of maintenance: it frees the pages of deleted rows
+// and refreshes the query planner's statistics.
+func (m *Maintainer) Maintain(ctx context.Context) error {
+	if err := m.st.Maintain(ctx); err != nil {
+		return err
+	}
+	metrics.DBLastMaintenance.Set(float64(m.now().Unix()))
+	return nil
+}
+
+// Measure refreshes the database size metrics.
+func (m *Maintainer) Measure(ctx context.Context) error {
+	size, err := m.st.Size(ctx)
+	if err != nil {
+		return fmt.Errorf("size: %w", err)
+	}
+	metrics.DBSize.Set(float64(size.Bytes))
+	metrics.DBFree.Set(float64(size.FreeBytes))
+	metrics.DBWALSize.Set(float64(size.WALBytes))
+	for table, n := range size.Rows {
+		metrics.DBRows.Set(float64(n), table)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package maintenance
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestMaintainAndMeasure(t *testing.T) {
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	ctx := t.Context()
+	for range 3 {
+		if err := st.RecordAudit(ctx, store.AuditEntry{At: time.Now(), Actor: "alice", Action: "token.create"}); err != nil {
+			t.Fatalf("record audit: %v", err)
+		}
+	}
+
+	now := time.Date(2026, 6, 1, 3, 0, 0, 0, time.UTC)
+	m := New(st)
+	m.now = func() time.Time { return now }
+	if err := m.Maintain(ctx); err != nil {
+		t.Fatalf("maintain: %v", err)
+	}
+	if got := metrics.DBLastMaintenance.Value(); got != float64(now.Unix()) {
+		t.Errorf("last maintenance = %v, want %d", got, now.Unix())
+	}
+
+	if err := m.Measure(ctx); err != nil {
+		t.Fatalf("measure: %v", err)
+	}
+	if got := metrics.DBRows.Value("audit_log"); got != 3 {
+		t.Errorf("audit_log rows = %v, want 3", got)
+	}
+	if got := metrics.DBRows.Value("emails"); got != 0 {
+		t.Errorf("emails rows = %v, want 0", got)
+	}
+	if metrics.DBSize.Value() == 0 {
+		t.Error("database size not measured")
+	}
+}
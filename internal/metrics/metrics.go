@@ -0,0 +1,363 @@
+// Package metrics implements a small Prometheus-compatible metrics registry.
+//
+// Only the pieces mailescrow needs are provided: counters and histograms with
+// labels, rendered in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram bounds (in seconds) suited to human review
+// latency: one minute up to one week.
+var DefaultBuckets = []float64{60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 3 * 24 * 3600, 7 * 24 * 3600}
+
+// Metrics exported by mailescrow.
+var (
+	ApprovalLatency = NewHistogram(
+		"mailescrow_approval_latency_seconds",
+		"Time from an email being held to a reviewer deciding on it.",
+		DefaultBuckets, "direction", "decision", "reviewer",
+	)
+	SLABreaches = NewCounter(
+		"mailescrow_sla_breaches_total",
+		"Pending emails that exceeded the configured SLA age.",
+		"direction",
+	)
+	QuotaExceeded = NewCounter(
+		"mailescrow_quota_exceeded_total",
+		"Submissions made while the sender was over quota.",
+		"action",
+	)
+	ProjectLimitExceeded = NewCounter(
+		"mailescrow_project_limit_exceeded_total",
+		"Submissions refused because their project was over a limit, by limit (message_size, pending, storage).",
+		"limit",
+	)
+	Bounces = NewCounter(
+		"mailescrow_bounces_total",
+		"Rejection notices requested for inbound mail, by result (sent, suppressed, failed).",
+		"result",
+	)
+	Blocked = NewCounter(
+		"mailescrow_blocked_total",
+		"Emails rejected without review by a block rule, by direction.",
+		"direction",
+	)
+	JournalFailures = NewCounter(
+		"mailescrow_journal_failures_total",
+		"Archive copies of relayed mail that could not be made, by target (address, mailbox).",
+		"target",
+	)
+	ArchiveFailures = NewCounter(
+		"mailescrow_archive_failures_total",
+		"Decided-on messages that could not be written to the on-disk archive.",
+	)
+	LinkClicks = NewCounter(
+		"mailescrow_link_clicks_total",
+		"Clicks on tracked links in relayed mail.",
+	)
+	RetentionPurged = NewCounter(
+		"mailescrow_retention_purged_total",
+		"Records deleted once past their retention period, by record (history, rejected, audit).",
+		"record",
+	)
+	JobRuns = NewCounter(
+		"mailescrow_job_runs_total",
+		"Runs of queued side effects, by kind and result (succeeded, retrying, failed).",
+		"kind", "result",
+	)
+	Emails = NewGauge(
+		"mailescrow_emails",
+		"Emails currently held, by direction and status.",
+		"direction", "status",
+	)
+	OldestPendingAge = NewGauge(
+		"mailescrow_oldest_pending_age_seconds",
+		"Age of the oldest pending email; 0 when nothing is pending.",
+	)
+	IMAPPollFailures = NewCounter(
+		"mailescrow_imap_poll_failures_total",
+		"IMAP poll attempts that failed.",
+	)
+	IMAPConsecutiveFailures = NewGauge(
+		"mailescrow_imap_consecutive_failures",
+		"IMAP poll failures since the last successful poll.",
+	)
+	IMAPCircuitState = NewGauge(
+		"mailescrow_imap_circuit_state",
+		"IMAP poller circuit breaker state; 1 for the current state, 0 otherwise.",
+		"state",
+	)
+	IMAPDiscrepancies = NewGauge(
+		"mailescrow_imap_discrepancies",
+		"Differences between held emails and the IMAP folders found by the last reconciliation, by kind (orphaned, misfiled, missing).",
+		"kind",
+	)
+	DBSize = NewGauge(
+		"mailescrow_db_size_bytes",
+		"Size of the database file.",
+	)
+	DBFree = NewGauge(
+		"mailescrow_db_free_bytes",
+		"Unused space in the database file, reclaimed by the next maintenance run.",
+	)
+	DBWALSize = NewGauge(
+		"mailescrow_db_wal_size_bytes",
+		"Size of the database's write-ahead log.",
+	)
+	DBRows = NewGauge(
+		"mailescrow_db_rows",
+		"Rows in each database table.",
+		"table",
+	)
+	DBLastMaintenance = NewGauge(
+		"mailescrow_db_last_maintenance_timestamp_seconds",
+		"Unix time the last database maintenance run finished; 0 until one has.",
+	)
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// WriteTo renders all registered metrics in the Prometheus text format.
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	cs := make([]collector, len(registry))
+	copy(cs, registry)
+	registryMu.Unlock()
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+// Handler returns an http.Handler serving all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// Counter is a monotonically increasing value partitioned by labels.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter identified by labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter identified by labelValues.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Value returns the current value for labelValues.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelKey(labelValues)]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+// Gauge is a value that can go up and down, partitioned by labels.
+type Gauge struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge identified by labelValues to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+// Value returns the current value for labelValues.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[labelKey(labelValues)]
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, key, ""), formatFloat(g.values[key]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets, partitioned by labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // per bucket, non-cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram with the given upper bounds.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(h)
+	return h
+}
+
+// Observe records v in the series identified by labelValues.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations for labelValues.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[labelKey(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+// labelKey joins label values with a separator that cannot appear in them.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {a="x",b="y"} for the label values encoded in key.
+// If le is non-empty it is appended as the histogram bucket label.
+func formatLabels(names []string, key, le string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, "\xff")
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, strconv.Quote(v)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=%q", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	h := &Histogram{name: "test_latency_seconds", help: "Test.", labels: []string{"kind"}, buckets: []float64{1, 10}, series: make(map[string]*histogramSeries)}
+	h.Observe(0.5, "a")
+	h.Observe(5, "a")
+	h.Observe(50, "a")
+
+	var sb strings.Builder
+	h.write(&sb)
+	out := sb.String()
+
+	for _, want := range []string{
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{kind="a",le="1"} 1`,
+		`test_latency_seconds_bucket{kind="a",le="10"} 2`,
+		`test_latency_seconds_bucket{kind="a",le="+Inf"} 3`,
+		`test_latency_seconds_sum{kind="a"} 55.5`,
+		`test_latency_seconds_count{kind="a"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+	if n := h.Count("a"); n != 3 {
+		t.Errorf("count = %d, want 3", n)
+	}
+}
+
+func TestCounterExposition(t *testing.T) {
+	c := &Counter{name: "test_total", help: "Test.", labels: []string{"direction"}, values: make(map[string]float64)}
+	c.Inc("inbound")
+	c.Add(2, "outbound")
+
+	var sb strings.Builder
+	c.write(&sb)
+	out := sb.String()
+
+	if !strings.Contains(out, `test_total{direction="inbound"} 1`) {
+		t.Errorf("output missing inbound counter:\n%s", out)
+	}
+	if !strings.Contains(out, `test_total{direction="outbound"} 2`) {
+		t.Errorf("output missing outbound counter:\n%s", out)
+	}
+}
+
+func TestHandlerServesRegisteredMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("content-type = %q, want text/plain", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "mailescrow_approval_latency_seconds") {
+		t.Errorf("handler output missing approval latency histogram:\n%s", w.Body.String())
+	}
+}
+
+func TestGaugeExposition(t *testing.T) {
+	g := &Gauge{name: "test_state", help: "Test.", labels: []string{"state"}, values: make(map[string]float64)}
+	g.Set(1, "open")
+	g.Set(1, "closed")
+	g.Set(0, "closed")
+
+	var sb strings.Builder
+	g.write(&sb)
+	out := sb.String()
+
+	for _, want := range []string{"# TYPE test_state gauge", `test_state{state="closed"} 0`, `test_state{state="open"} 1`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
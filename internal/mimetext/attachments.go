@@ -0,0 +1,80 @@
+package mimetext
+
+import (
+	"bytes"
+	"cmp"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxDepth bounds how deeply nested multiparts are searched for attachments.
+const maxDepth = 10
+
+// Attachment is a part of a message other than its text: a file attached to
+// it, or an image its HTML shows inline by Content-ID.
+type Attachment struct {
+	Filename    string // decoded; empty if the part names none
+	ContentType string // media type, e.g. "image/png"
+	ContentID   string // without the angle brackets; empty if none
+	Inline      bool   // Content-Disposition: inline, or inside multipart/related
+	Data        []byte // with the transfer encoding undone
+}
+
+// Size is the decoded size of the attachment in bytes.
+func (a Attachment) Size() int {
+	return len(a.Data)
+}
+
+// Attachments returns the attachments of a raw message in the order they
+// appear: every part that is not a text/plain or text/html body, and text
+// parts sent as attachments. Messages that fail to parse have none.
+func Attachments(raw []byte) []Attachment {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	var found []Attachment
+	collectAttachments(textproto.MIMEHeader(msg.Header), msg.Body, false, 0, &found)
+	return found
+}
+
+func collectAttachments(header textproto.MIMEHeader, body io.Reader, related bool, depth int, found *[]Attachment) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth {
+			return
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return
+			}
+			collectAttachments(part.Header, part, related || mediaType == "multipart/related", depth+1, found)
+		}
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if (mediaType == "text/plain" || mediaType == "text/html") && disposition != "attachment" {
+		return // the message text, see Parts
+	}
+	data, err := io.ReadAll(transferDecoder(header, body))
+	if err != nil {
+		log.Printf("mimetext: decode %s attachment: %v", mediaType, err)
+	}
+	*found = append(*found, Attachment{
+		Filename:    Header(cmp.Or(dparams["filename"], params["name"])),
+		ContentType: mediaType,
+		ContentID:   strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>"),
+		Inline:      disposition == "inline" || (related && disposition != "attachment"),
+		Data:        data,
+	})
+}
@@ -0,0 +1,37 @@
+package mimetext
+
+import "testing"
+
+func TestAttachments(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/related; boundary=rel\r\n\r\n" +
+		"--rel\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:logo@x\">\r\n" +
+		"--rel\r\nContent-Type: image/png; name=logo.png\r\nContent-Id: <logo@x>\r\nContent-Transfer-Encoding: base64\r\n\r\naW1hZ2U=\r\n" +
+		"--rel--\r\n" +
+		"--outer\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=\"=?UTF-8?Q?r=C3=A9sum=C3=A9.txt?=\"\r\n\r\nnotes\r\n" +
+		"--outer\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=report.pdf\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n%PDF=3D1\r\n" +
+		"--outer--\r\n"
+
+	got := Attachments([]byte(raw))
+	want := []Attachment{
+		{Filename: "logo.png", ContentType: "image/png", ContentID: "logo@x", Inline: true, Data: []byte("image")},
+		{Filename: "résumé.txt", ContentType: "text/plain", Data: []byte("notes")},
+		{Filename: "report.pdf", ContentType: "application/pdf", Data: []byte("%PDF=1")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d attachments, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Filename != w.Filename || g.ContentType != w.ContentType || g.ContentID != w.ContentID || g.Inline != w.Inline || string(g.Data) != string(w.Data) {
+			t.Errorf("attachment %d = %+v, want %+v", i, g, w)
+		}
+	}
+	if got[2].Size() != 6 {
+		t.Errorf("size = %d, want 6", got[2].Size())
+	}
+
+	if got := Attachments([]byte("Subject: plain\r\n\r\nHello\r\n")); len(got) != 0 {
+		t.Errorf("plain message has attachments %+v", got)
+	}
+}
@@ -0,0 +1,129 @@
+// Package mimetext decodes the human-readable parts of a message to UTF-8:
+// RFC 2047 encoded words in headers, and text bodies in any transfer
+// encoding and charset.
+package mimetext
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// Header decodes the encoded words in a header value, e.g.
+// "=?ISO-2022-JP?B?...?=". A value that cannot be decoded is returned as is.
+func Header(v string) string {
+	if d, err := wordDecoder.DecodeHeader(v); err == nil {
+		return d
+	}
+	return v
+}
+
+// Parse returns the decoded subject and text body of a raw message, with
+// "(no subject)" for a missing subject. A message that cannot be parsed has
+// subject "(unknown)" and its raw bytes as body.
+func Parse(raw []byte) (subject, body string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "(unknown)", string(raw)
+	}
+	subject = Header(msg.Header.Get("Subject"))
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	return subject, Body(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+// Body returns the text to show for a message body: its plain-text part, or
+// the HTML part if there is none, trimmed.
+func Body(header textproto.MIMEHeader, body io.Reader) string {
+	text, html := Parts(header, body)
+	if text == "" {
+		text = html
+	}
+	return strings.TrimSpace(text)
+}
+
+// Parts returns the first text/plain and text/html parts of a message body,
+// walking nested multiparts, skipping attachments and undoing transfer
+// encodings and charsets.
+func Parts(header textproto.MIMEHeader, body io.Reader) (text, html string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				break
+			}
+			t, h := Parts(part.Header, part)
+			if text == "" {
+				text = t
+			}
+			if html == "" {
+				html = h
+			}
+		}
+		return text, html
+	}
+	if disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")); disposition == "attachment" {
+		return "", ""
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", ""
+	}
+
+	r := transferDecoder(header, body)
+	if cr, err := charsetReader(params["charset"], r); err == nil {
+		r = cr
+	} else {
+		log.Printf("mimetext: unknown charset %q, %s part left undecoded", params["charset"], mediaType)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		log.Printf("mimetext: decode %s part: %v", mediaType, err)
+	}
+	s := strings.ToValidUTF8(string(b), "�")
+	if mediaType == "text/html" {
+		return "", s
+	}
+	return s, ""
+}
+
+// transferDecoder undoes the Content-Transfer-Encoding of a part's body.
+func transferDecoder(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// charsetReader converts input from charset to UTF-8. Labels are matched
+// as browsers do, so "iso-8859-1" decodes as windows-1252, its superset.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
@@ -0,0 +1,90 @@
+package mimetext
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestParts(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nCaf=C3=A9 menu\r\n" +
+		"--inner\r\nContent-Type: text/html\r\nContent-Transfer-Encoding: base64\r\n\r\nPHA+Q2Fmw6kgbWVudTwvcD4=\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=notes.txt\r\n\r\nattached\r\n" +
+		"--outer--\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	text, html := Parts(textproto.MIMEHeader(msg.Header), msg.Body)
+	if text != "Café menu" {
+		t.Errorf("text = %q, want decoded plain-text part", text)
+	}
+	if html != "<p>Café menu</p>" {
+		t.Errorf("html = %q, want decoded HTML part", html)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		wantSubject string
+		wantBody    string
+	}{
+		{
+			"plain",
+			"Subject: Hi\r\n\r\nHello\r\n",
+			"Hi", "Hello",
+		},
+		{
+			"no subject",
+			"From: a@example.com\r\n\r\nHello\r\n",
+			"(no subject)", "Hello",
+		},
+		{
+			"unparseable",
+			"not a message",
+			"(unknown)", "not a message",
+		},
+		{
+			"quoted-printable latin-1",
+			"Subject: =?ISO-8859-1?Q?Caf=E9?=\r\nContent-Type: text/plain; charset=ISO-8859-1\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nCaf=E9 cr=E8me=\r\n br=FBl=E9e\r\n",
+			"Café", "Café crème brûlée",
+		},
+		{
+			"base64 shift-jis",
+			"Subject: =?ISO-2022-JP?B?GyRCRnxLXDhsGyhC?=\r\nContent-Type: text/plain; charset=Shift_JIS\r\nContent-Transfer-Encoding: base64\r\n\r\nk/qWe4zq\r\n",
+			"日本語", "日本語",
+		},
+		{
+			"8bit windows-1252",
+			"Subject: Quote\r\nContent-Type: text/plain; charset=windows-1252\r\nContent-Transfer-Encoding: 8bit\r\n\r\n\x93smart\x94 \x80 5\r\n",
+			"Quote", "“smart” € 5",
+		},
+		{
+			"html only",
+			"Subject: Hi\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<p>Hello</p>\r\n",
+			"Hi", "<p>Hello</p>",
+		},
+		{
+			"unknown charset",
+			"Subject: Hi\r\nContent-Type: text/plain; charset=x-made-up\r\n\r\nHello \xff\r\n",
+			"Hi", "Hello �",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, body := Parse([]byte(tt.raw))
+			if subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", subject, tt.wantSubject)
+			}
+			if body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
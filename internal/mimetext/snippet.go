@@ -0,0 +1,75 @@
+package mimetext
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// SnippetLength is the most characters Snippet returns, ellipsis included.
+const SnippetLength = 140
+
+var (
+	// htmlSkipped matches elements whose content is not text.
+	htmlSkipped = regexp.MustCompile(`(?is)<(style|script|head)\b.*?</(style|script|head)\s*>`)
+	// htmlQuote matches quoted replies: blockquotes and Gmail's quote div.
+	htmlQuote = regexp.MustCompile(`(?is)<blockquote\b.*?</blockquote\s*>|<div[^>]*class="gmail_quote".*`)
+	htmlBreak = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h[1-6])\b[^>]*>`)
+	htmlTag   = regexp.MustCompile(`(?s)<[^>]*>`)
+
+	// replyHeader matches the line introducing a quoted reply, e.g.
+	// "On Mon, 2 Mar 2026 at 10:00, Ann <ann@example.com> wrote:".
+	replyHeader = regexp.MustCompile(`(?i)^(on\s.*wrote:|-+\s*original message\s*-+|_{10,}|from:\s.*)$`)
+)
+
+// Snippet returns a one-line plain-text summary of body, as returned by
+// Body, for list views: at most SnippetLength characters of what the sender
+// wrote, without quoted replies, forwarded headers, signatures or markup.
+func Snippet(body string) string {
+	if looksLikeHTML(body) {
+		body = htmlText(body)
+	}
+	var words []string
+	for line := range strings.Lines(body) {
+		line = strings.TrimRight(line, "\r\n")
+		if line == "-- " || line == "--" || replyHeader.MatchString(strings.TrimSpace(line)) ||
+			strings.HasPrefix(line, "Sent from my ") {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		words = append(words, strings.Fields(line)...)
+	}
+	return truncate(strings.Join(words, " "), SnippetLength)
+}
+
+func looksLikeHTML(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.HasPrefix(s, "<!doctype html") || strings.HasPrefix(s, "<html") ||
+		strings.Contains(s, "<body") || strings.Contains(s, "<p>") || strings.Contains(s, "<div")
+}
+
+// htmlText reduces an HTML document to its text, one line per block.
+func htmlText(s string) string {
+	s = htmlSkipped.ReplaceAllString(s, "")
+	s = htmlQuote.ReplaceAllString(s, "")
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+// truncate cuts s to at most n characters, at a word boundary unless that
+// would lose most of them, ending it with an ellipsis if anything was cut.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)[:n-1]
+	cut := string(runes)
+	if i := strings.LastIndexByte(cut, ' '); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,;:.-") + "…"
+}
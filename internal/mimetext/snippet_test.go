@@ -0,0 +1,46 @@
+package mimetext
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"plain", "Hi Ann,\n\nthe invoice is attached.\n", "Hi Ann, the invoice is attached."},
+		{"quoted reply", "Sounds good.\n\nOn Mon, 2 Mar 2026 at 10:00, Ann <ann@example.com> wrote:\n> Lunch?\n", "Sounds good."},
+		{"inline quotes", "> Lunch?\nYes\n> Where?\nThe usual\n", "Yes The usual"},
+		{"signature", "See you then.\n-- \nBob\nACME Corp\n", "See you then."},
+		{"outlook reply", "Approved.\r\n\r\n-----Original Message-----\r\nFrom: Ann\r\n", "Approved."},
+		{"mobile", "On my way\n\nSent from my iPhone\n", "On my way"},
+		{
+			"html",
+			"<html><head><style>p{color:red}</style></head><body><p>Hello&nbsp;&amp; welcome</p><div>Second</div>" +
+				"<blockquote>old message</blockquote></body></html>",
+			"Hello & welcome Second",
+		},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Snippet(tt.body); got != tt.want {
+				t.Errorf("Snippet = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnippetTruncates(t *testing.T) {
+	got := Snippet(strings.Repeat("lorem ipsum ", 50))
+	if n := utf8.RuneCountInString(got); n > SnippetLength {
+		t.Errorf("snippet has %d characters, want at most %d", n, SnippetLength)
+	}
+	if !strings.HasSuffix(got, "ipsum…") && !strings.HasSuffix(got, "lorem…") {
+		t.Errorf("snippet = %q, want it cut at a word boundary", got)
+	}
+}
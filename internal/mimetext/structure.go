@@ -0,0 +1,114 @@
+package mimetext
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Part is one node of a message's MIME tree, as Structure parses it.
+type Part struct {
+	ContentType string // media type, e.g. "multipart/alternative"; "text/plain" when the part names none
+	Charset     string
+	Encoding    string // Content-Transfer-Encoding, lower-cased; empty if the part names none
+	Disposition string // "attachment", "inline" or empty
+	Filename    string // decoded; empty if the part names none
+	ContentID   string // without the angle brackets
+	Size        int    // bytes of the body as it is in the message, for a multipart including its parts
+	DecodedSize int    // bytes of the body with the transfer encoding undone; zero for a multipart
+	Parts       []Part // of a multipart, in order
+
+	// Problem describes what is wrong with the part, e.g. an undecodable
+	// body or a multipart missing its closing boundary; empty if nothing
+	// is. Whatever could still be read of the part is filled in.
+	Problem string
+}
+
+// Structure parses the MIME tree of a raw message. It never fails: what
+// cannot be parsed is reported in the Problem of the part it is found in,
+// so that malformed messages can be looked into.
+func Structure(raw []byte) Part {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return Part{Size: len(raw), Problem: fmt.Sprintf("cannot read the message header: %v", err)}
+	}
+	return structure(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+}
+
+func structure(header textproto.MIMEHeader, body io.Reader, depth int) (p Part) {
+	mediaType, params := "text/plain", map[string]string(nil)
+	if ct := header.Get("Content-Type"); ct != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(ct)
+		if err != nil {
+			p.Problem = fmt.Sprintf("invalid Content-Type %q: %v", ct, err)
+		}
+		mediaType = cmp.Or(mediaType, "text/plain")
+	}
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	p.ContentType = mediaType
+	p.Charset = params["charset"]
+	p.Encoding = strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	p.Disposition = disposition
+	p.Filename = Header(cmp.Or(dparams["filename"], params["name"]))
+	p.ContentID = strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>")
+
+	counted := &countingReader{r: body}
+	defer func() {
+		_, _ = io.Copy(io.Discard, counted) // whatever is left, e.g. a multipart's epilogue
+		p.Size = counted.n
+	}()
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		switch {
+		case params["boundary"] == "":
+			p.Problem = cmp.Or(p.Problem, "multipart without a boundary")
+		case depth >= maxDepth:
+			p.Problem = "nested too deeply; its parts are not shown"
+		default:
+			mr := multipart.NewReader(counted, params["boundary"])
+			for {
+				part, err := mr.NextRawPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					p.Problem = fmt.Sprintf("cannot read part %d: %v", len(p.Parts)+1, err)
+					break
+				}
+				p.Parts = append(p.Parts, structure(part.Header, part, depth+1))
+			}
+		}
+		return p
+	}
+
+	switch p.Encoding {
+	case "", "7bit", "8bit", "binary", "base64", "quoted-printable":
+	default:
+		p.Problem = cmp.Or(p.Problem, fmt.Sprintf("unknown Content-Transfer-Encoding %q", p.Encoding))
+	}
+	n, err := io.Copy(io.Discard, transferDecoder(header, counted))
+	if err != nil {
+		p.Problem = cmp.Or(p.Problem, fmt.Sprintf("cannot decode the %s body: %v", p.Encoding, err))
+	}
+	p.DecodedSize = int(n)
+	return p
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
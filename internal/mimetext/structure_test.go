@@ -0,0 +1,50 @@
+package mimetext
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStructure(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: multipart/alternative; boundary=alt\r\n\r\n" +
+		"--alt\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nHello\r\n" +
+		"--alt\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<p>Hello=3D</p>\r\n" +
+		"--alt--\r\n" +
+		"--outer\r\nContent-Type: application/pdf; name=report.pdf\r\nContent-Disposition: attachment; filename=\"=?UTF-8?Q?r=C3=A9sum=C3=A9.pdf?=\"\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERg==\r\n" +
+		"--outer\r\nContent-Type: image/png\r\nContent-Id: <logo@x>\r\nContent-Transfer-Encoding: base64\r\n\r\nnot base64!\r\n" +
+		"--outer--\r\n"
+
+	root := Structure([]byte(raw))
+	if root.ContentType != "multipart/mixed" || root.Problem != "" || len(root.Parts) != 3 {
+		t.Fatalf("root = %+v, want multipart/mixed with 3 parts", root)
+	}
+	alt := root.Parts[0]
+	if alt.ContentType != "multipart/alternative" || len(alt.Parts) != 2 {
+		t.Fatalf("first part = %+v, want multipart/alternative with 2 parts", alt)
+	}
+	if html := alt.Parts[1]; html.ContentType != "text/html" || html.Charset != "utf-8" || html.Encoding != "quoted-printable" || html.DecodedSize != len("<p>Hello=</p>") {
+		t.Errorf("html part = %+v", html)
+	}
+	if pdf := root.Parts[1]; pdf.Filename != "résumé.pdf" || pdf.Disposition != "attachment" || pdf.Size != len("JVBERg==") || pdf.DecodedSize != 4 {
+		t.Errorf("pdf part = %+v", pdf)
+	}
+	if img := root.Parts[2]; img.ContentID != "logo@x" || !strings.Contains(img.Problem, "cannot decode the base64 body") {
+		t.Errorf("image part = %+v, want a decoding problem", img)
+	}
+	if root.Size <= alt.Size {
+		t.Errorf("root size %d, want more than its first part's %d", root.Size, alt.Size)
+	}
+
+	for name, tt := range map[string]struct{ raw, problem string }{
+		"no boundary":  {"Content-Type: multipart/mixed\r\n\r\nbody\r\n", "multipart without a boundary"},
+		"unterminated": {"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\ncut off", "cannot read part 2"},
+		"bad type":     {"Content-Type: text/plain; charset\r\n\r\nbody\r\n", "invalid Content-Type"},
+		"bad encoding": {"Content-Transfer-Encoding: x-uuencode\r\n\r\nbody\r\n", `unknown Content-Transfer-Encoding "x-uuencode"`},
+		"no header":    {"not a message", "cannot read the message header"},
+	} {
+		if p := Structure([]byte(tt.raw)); !strings.Contains(p.Problem, tt.problem) {
+			t.Errorf("%s: problem %q, want %q", name, p.Problem, tt.problem)
+		}
+	}
+}
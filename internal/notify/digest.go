@@ -0,0 +1,157 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Digest batches events for a Notifier. Instead of passing each event on, it
+// delivers the events waiting as one EventDigest event every interval, or as
+// soon as max of them are waiting. Events are held in memory only; call Flush
+// on shutdown so none are lost.
+type Digest struct {
+	link string        // the web UI's pending queue; may be empty
+	full chan struct{} // wakes Run early: max events are waiting, or the schedule changed
+
+	mu       sync.Mutex
+	interval time.Duration // 0 passes each event on as it happens
+	max      int           // 0 waits for the interval however many are waiting
+	next     Notifier
+	pending  []Event
+}
+
+// NewDigest creates a Digest delivering to next, which may be nil until set
+// with SetNotifier. An interval of 0 passes events on unbatched until
+// SetSchedule sets one. Start it with Run.
+func NewDigest(next Notifier, interval time.Duration, max int, link string) *Digest {
+	return &Digest{next: next, interval: interval, max: max, link: link, full: make(chan struct{}, 1)}
+}
+
+// SetNotifier replaces where digests are delivered, e.g. on a configuration
+// reload. Events already waiting go to n too.
+func (d *Digest) SetNotifier(n Notifier) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.next = n
+}
+
+// SetSchedule changes how often digests are delivered, e.g. on a
+// configuration reload. The events waiting are delivered at once; with an
+// interval of 0, later ones are passed on as they happen.
+func (d *Digest) SetSchedule(interval time.Duration, max int) {
+	d.mu.Lock()
+	d.interval, d.max = interval, max
+	d.mu.Unlock()
+	d.wake()
+}
+
+// Notify adds e to the next digest. Batched, it never fails: delivery errors
+// surface in Flush. Unbatched, it returns the Notifier's error.
+func (d *Digest) Notify(ctx context.Context, e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	d.mu.Lock()
+	if d.interval <= 0 && d.next != nil && len(d.pending) == 0 {
+		next := d.next
+		d.mu.Unlock()
+		return next.Notify(ctx, e)
+	}
+	d.pending = append(d.pending, e)
+	full := d.interval <= 0 || d.max > 0 && len(d.pending) >= d.max
+	d.mu.Unlock()
+	if full {
+		d.wake()
+	}
+	return nil
+}
+
+// wake makes Run deliver the events waiting now.
+func (d *Digest) wake() {
+	select {
+	case d.full <- struct{}{}:
+	default: // a flush is already due
+	}
+}
+
+// Run delivers a digest every interval, and whenever max events are waiting,
+// until ctx is cancelled.
+func (d *Digest) Run(ctx context.Context) {
+	for {
+		d.mu.Lock()
+		interval := d.interval
+		d.mu.Unlock()
+		var timer *time.Timer
+		var due <-chan time.Time // never, unbatched
+		if interval > 0 {
+			timer = time.NewTimer(interval)
+			due = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-due:
+		case <-d.full:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := d.Flush(ctx); err != nil {
+			log.Printf("notification digest: %v", err)
+		}
+	}
+}
+
+// Flush delivers the events waiting as one digest, if there are any. If
+// delivery fails they are kept for the next one.
+func (d *Digest) Flush(ctx context.Context) error {
+	d.mu.Lock()
+	events, next := d.pending, d.next
+	if next == nil {
+		d.mu.Unlock()
+		return nil // nowhere to deliver yet; keep waiting
+	}
+	d.pending = nil
+	d.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+	if err := next.Notify(ctx, d.digest(events)); err != nil {
+		d.mu.Lock()
+		d.pending = append(events, d.pending...)
+		d.mu.Unlock()
+		return fmt.Errorf("deliver digest of %d events: %w", len(events), err)
+	}
+	return nil
+}
+
+// digest summarizes events in one event: its message is a table of them, one
+// per line, for targets that show text only.
+func (d *Digest) digest(events []Event) Event {
+	var sb strings.Builder
+	if len(events) == 1 {
+		sb.WriteString("1 notification")
+	} else {
+		fmt.Fprintf(&sb, "%d notifications", len(events))
+	}
+	fmt.Fprintf(&sb, " since %s:\n", events[0].Time.Format(time.DateTime+" MST"))
+	tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+	for _, e := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.TimeOnly), e.Type, e.Sender, e.Subject, e.Message)
+	}
+	_ = tw.Flush()
+	if d.link != "" {
+		fmt.Fprintf(&sb, "Review the queue: %s\n", d.link)
+	}
+	return Event{
+		Type:    EventDigest,
+		Message: strings.TrimSuffix(sb.String(), "\n"),
+		URL:     d.link,
+		Events:  events,
+	}
+}
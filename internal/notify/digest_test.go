@@ -0,0 +1,129 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+	err    error
+}
+
+func (r *recorder) Notify(_ context.Context, e Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recorder) received() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestDigestFlush(t *testing.T) {
+	rec := &recorder{}
+	d := NewDigest(rec, time.Hour, 0, "https://escrow.example.com/")
+	d.Notify(t.Context(), Event{Type: EventSLAExceeded, Sender: "alice@example.com", Subject: "Report", Message: "late"})
+	d.Notify(t.Context(), Event{Type: EventSLAExceeded, Sender: "bob@example.com", Subject: "Invoice", Message: "late"})
+	if got := rec.received(); len(got) != 0 {
+		t.Fatalf("delivered before flush: %+v", got)
+	}
+
+	if err := d.Flush(t.Context()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	got := rec.received()
+	if len(got) != 1 {
+		t.Fatalf("delivered %d events, want 1 digest", len(got))
+	}
+	e := got[0]
+	if e.Type != EventDigest || len(e.Events) != 2 || e.URL != "https://escrow.example.com/" {
+		t.Errorf("digest = %+v", e)
+	}
+	for _, want := range []string{"2 notifications", "alice@example.com", "Invoice", "Review the queue: https://escrow.example.com/"} {
+		if !strings.Contains(e.Message, want) {
+			t.Errorf("message lacks %q:\n%s", want, e.Message)
+		}
+	}
+
+	if err := d.Flush(t.Context()); err != nil || len(rec.received()) != 1 {
+		t.Errorf("empty flush delivered something (err %v)", err)
+	}
+}
+
+func TestDigestKeepsEventsOnFailure(t *testing.T) {
+	rec := &recorder{err: errors.New("down")}
+	d := NewDigest(rec, time.Hour, 0, "")
+	d.Notify(t.Context(), Event{Type: EventIMAPPollFailing})
+	if err := d.Flush(t.Context()); err == nil {
+		t.Fatal("flush: want error")
+	}
+	rec.err = nil
+	d.Notify(t.Context(), Event{Type: EventIMAPPollRecovered})
+	if err := d.Flush(t.Context()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	got := rec.received()
+	if len(got) != 1 || len(got[0].Events) != 2 || got[0].Events[0].Type != EventIMAPPollFailing {
+		t.Errorf("delivered %+v, want both events in order", got)
+	}
+}
+
+func TestDigestFlushesWhenFull(t *testing.T) {
+	rec := &recorder{}
+	d := NewDigest(rec, time.Hour, 2, "")
+	go d.Run(t.Context())
+
+	d.Notify(t.Context(), Event{Type: EventSLAExceeded, EmailID: "a"})
+	d.Notify(t.Context(), Event{Type: EventSLAExceeded, EmailID: "b"})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no digest after max events")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := rec.received(); len(got[0].Events) != 2 {
+		t.Errorf("digest has %d events, want 2", len(got[0].Events))
+	}
+}
+
+func TestDigestSetSchedule(t *testing.T) {
+	rec := &recorder{}
+	d := NewDigest(rec, time.Hour, 0, "")
+	go d.Run(t.Context())
+
+	d.Notify(t.Context(), Event{Type: EventSLAExceeded, EmailID: "a"})
+	d.SetSchedule(0, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("waiting events not delivered when batching stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := d.Notify(t.Context(), Event{Type: EventSLAExceeded, EmailID: "b"}); err != nil {
+		t.Fatalf("unbatched notify: %v", err)
+	}
+	got := rec.received()
+	if len(got) != 2 || got[0].Type != EventDigest || got[1].EmailID != "b" {
+		t.Fatalf("delivered %+v, want a digest of the waiting event, then b as it happened", got)
+	}
+
+	d.SetSchedule(time.Hour, 0)
+	d.Notify(t.Context(), Event{Type: EventSLAExceeded, EmailID: "c"})
+	if got := rec.received(); len(got) != 2 {
+		t.Errorf("delivered %d events once batching again, want 2", len(got))
+	}
+}
@@ -0,0 +1,110 @@
+// Package notify delivers operational alerts (for example SLA breaches) to
+// external systems.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/albert/mailescrow/client/webhookverify"
+)
+
+// Event types emitted by mailescrow.
+const (
+	EventSLAExceeded       = "sla_exceeded"
+	EventIMAPPollFailing   = "imap_poll_failing"
+	EventIMAPPollRecovered = "imap_poll_recovered"
+	EventSnoozeExpired     = "snooze_expired"
+	EventProjectLimit      = "project_limit_exceeded"
+	EventDigest            = "digest" // several of the above at once; see Digest
+)
+
+// Event is the JSON payload delivered to notification targets.
+type Event struct {
+	Type       string    `json:"event"`
+	Message    string    `json:"message"`
+	EmailID    string    `json:"email_id,omitempty"`
+	Direction  string    `json:"direction,omitempty"`
+	Sender     string    `json:"sender,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	Reviewer   string    `json:"reviewer,omitempty"`
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+	Tags       []string  `json:"tags,omitempty"`
+	Time       time.Time `json:"time"`
+
+	// On digests only: the events batched, and a link to the web UI's
+	// pending queue if known.
+	Events []Event `json:"events,omitempty"`
+	URL    string  `json:"url,omitempty"`
+}
+
+// Notifier delivers events to an external target.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// Webhook posts events as JSON to a URL.
+type Webhook struct {
+	url    string
+	secret []byte // signs each request when set; see package webhookverify
+	client *http.Client
+}
+
+// NewWebhook creates a Webhook notifier that POSTs to url.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// SetClient replaces the HTTP client requests are sent with.
+func (wh *Webhook) SetClient(c *http.Client) {
+	wh.client = c
+}
+
+// SetSecret signs each request with secret, so the receiver can check with
+// package webhookverify that it came from mailescrow. An empty secret sends
+// requests unsigned.
+func (wh *Webhook) SetSecret(secret string) {
+	wh.secret = []byte(secret)
+}
+
+// Notify POSTs e to the webhook URL. Any non-2xx response is an error.
+func (wh *Webhook) Notify(ctx context.Context, e Event) error {
+	_, err := wh.Deliver(ctx, e)
+	return err
+}
+
+// Deliver is Notify, also returning the HTTP status of the response, or 0 if
+// there was none.
+func (wh *Webhook) Deliver(ctx context.Context, e Event) (int, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, fmt.Errorf("marshal event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		now := time.Now()
+		req.Header.Set(webhookverify.TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set(webhookverify.SignatureHeader, webhookverify.Sign(wh.secret, now, body))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("post webhook: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
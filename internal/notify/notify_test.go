@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/albert/mailescrow/client/webhookverify"
+)
+
+func TestWebhookNotify(t *testing.T) {
+	var got Event
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("content-type = %q, want application/json", r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	wh := NewWebhook(srv.URL)
+	if err := wh.Notify(t.Context(), Event{Type: EventSLAExceeded, EmailID: "abc", Message: "late"}); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if got.Type != EventSLAExceeded || got.EmailID != "abc" {
+		t.Errorf("payload = %+v, want sla_exceeded for abc", got)
+	}
+	if got.Time.IsZero() {
+		t.Error("payload time should be set")
+	}
+}
+
+func TestWebhookNotifySigned(t *testing.T) {
+	var verr error
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, verr = webhookverify.Request(r, []byte("s3cret"), webhookverify.DefaultTolerance)
+	}))
+	defer srv.Close()
+
+	wh := NewWebhook(srv.URL)
+	wh.SetSecret("s3cret")
+	if err := wh.Notify(t.Context(), Event{Type: EventSLAExceeded}); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if verr != nil {
+		t.Errorf("verify signed request: %v", verr)
+	}
+}
+
+func TestWebhookNotifyErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	if err := NewWebhook(srv.URL).Notify(t.Context(), Event{Type: EventSLAExceeded}); err == nil {
+		t.Fatal("expected error for 500 response")
+	}
+}
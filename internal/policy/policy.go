@@ -0,0 +1,165 @@
+// Package policy overrides the review of outbound mail by recipient domain:
+// mail to some domains may skip review or be refused outright, and mail to
+// others may need several reviewers, each giving a reason, to approve it.
+// Policies are layered over the rules engine; see Requirement.Decide.
+package policy
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/rules"
+)
+
+// ReviewerPrefix starts the reviewer recorded for mail a policy approves or
+// rejects, followed by the policy's domain.
+const ReviewerPrefix = "policy:"
+
+// Policy overrides review for outbound mail to one domain.
+type Policy struct {
+	Domain        string       // e.g. "internal.example.com", or a glob such as "*.gov"
+	Action        rules.Action // "" leaves the action to the rules
+	Approvals     int          // distinct reviewers needed to approve; 0 is one
+	RequireReason bool         // each reviewer approving must give a reason
+}
+
+// Requirement is what the policies of a message's recipients require of it.
+type Requirement struct {
+	Action        rules.Action // "" if the policies leave it to the rules
+	Domain        string       // the policy behind Action, or behind Review if it has none
+	Approvals     int          // distinct reviewers needed to approve, at least 1
+	RequireReason bool
+}
+
+// Review reports whether mail under r is always reviewed: a policy holds it,
+// or needs more than one approval or a reason. Such mail is never approved
+// by a rule, an allow rule or the address book.
+func (r Requirement) Review() bool {
+	return r.Action == rules.ActionHold || r.Approvals > 1 || r.RequireReason
+}
+
+// Decide layers r over rule, the first matching rule of the rules engine
+// (ActionHold if none matched), and returns the action to take and who
+// decided it, "rule:<name>" or ReviewerPrefix plus the policy's domain. A
+// reject from either side wins; then a policy requiring review; then a
+// policy approving; otherwise the rule decides.
+func (r Requirement) Decide(rule rules.Rule) (rules.Action, string) {
+	switch {
+	case rule.Action == rules.ActionReject:
+		return rules.ActionReject, "rule:" + rule.Name
+	case r.Action == rules.ActionReject:
+		return rules.ActionReject, ReviewerPrefix + r.Domain
+	case r.Review():
+		return rules.ActionHold, ReviewerPrefix + r.Domain
+	case r.Action == rules.ActionApprove:
+		return rules.ActionApprove, ReviewerPrefix + r.Domain
+	}
+	return rule.Action, "rule:" + rule.Name
+}
+
+// Set holds the configured policies. A nil *Set has none.
+type Set struct {
+	policies []Policy
+}
+
+// New validates policies and returns a Set. Domains are lower-cased.
+func New(policies []Policy) (*Set, error) {
+	policies = slices.Clone(policies)
+	seen := make(map[string]bool)
+	for i, p := range policies {
+		domain := strings.ToLower(strings.TrimSpace(p.Domain))
+		if domain == "" {
+			return nil, fmt.Errorf("policy %d: domain is required", i)
+		}
+		if _, err := path.Match(domain, ""); err != nil {
+			return nil, fmt.Errorf("policy %d (%s): invalid pattern: %w", i, domain, err)
+		}
+		if seen[domain] {
+			return nil, fmt.Errorf("policy %d (%s): domain listed twice", i, domain)
+		}
+		seen[domain] = true
+		switch p.Action {
+		case "", rules.ActionHold, rules.ActionApprove, rules.ActionReject:
+		default:
+			return nil, fmt.Errorf("policy %d (%s): unknown action %q", i, domain, p.Action)
+		}
+		if p.Approvals < 0 {
+			return nil, fmt.Errorf("policy %d (%s): approvals must not be negative", i, domain)
+		}
+		if p.Action == "" && p.Approvals <= 1 && !p.RequireReason {
+			return nil, fmt.Errorf("policy %d (%s): needs an action, approvals or require_reason", i, domain)
+		}
+		if p.Action != "" && p.Action != rules.ActionHold && (p.Approvals > 1 || p.RequireReason) {
+			return nil, fmt.Errorf("policy %d (%s): approvals and require_reason only apply to mail held for review", i, domain)
+		}
+		policies[i].Domain = domain
+	}
+	return &Set{policies: policies}, nil
+}
+
+// For returns the requirement for outbound mail to recipients. Each
+// recipient follows the most specific policy matching its domain: an exact
+// domain before any glob, and a longer glob before a shorter one. Across
+// recipients the strictest action wins: reject, then hold, and approve only
+// if every recipient's policy approves. Approvals is the most any of those
+// policies needs, and a reason is required if any of them requires one.
+func (s *Set) For(recipients []string) Requirement {
+	req := Requirement{Approvals: 1}
+	if s == nil || len(s.policies) == 0 {
+		return req
+	}
+	// approver is the first approving policy and reviewer the first one
+	// needing more than one approval or a reason.
+	var approver, reviewer string
+	approved := 0
+	for _, rcpt := range recipients {
+		p, ok := s.match(rcpt)
+		if !ok {
+			continue
+		}
+		if p.Approvals > 1 || p.RequireReason {
+			req.Approvals = max(req.Approvals, p.Approvals)
+			req.RequireReason = req.RequireReason || p.RequireReason
+			reviewer = cmp.Or(reviewer, p.Domain)
+		}
+		switch {
+		case p.Action == rules.ActionReject && req.Action != rules.ActionReject,
+			p.Action == rules.ActionHold && req.Action == "":
+			req.Action, req.Domain = p.Action, p.Domain
+		case p.Action == rules.ActionApprove:
+			approved++
+			approver = cmp.Or(approver, p.Domain)
+		}
+	}
+	switch {
+	case req.Action != "":
+	case reviewer != "":
+		req.Domain = reviewer
+	case approved > 0 && approved == len(recipients):
+		req.Action, req.Domain = rules.ActionApprove, approver
+	}
+	return req
+}
+
+// match returns the most specific policy for the domain of addr.
+func (s *Set) match(addr string) (Policy, bool) {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return Policy{}, false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(addr[at+1:], ">"))
+	var best Policy
+	found := false
+	for _, p := range s.policies {
+		if p.Domain == domain {
+			return p, true
+		}
+		if ok, _ := path.Match(p.Domain, domain); ok && (!found || len(p.Domain) > len(best.Domain)) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/albert/mailescrow/internal/rules"
+)
+
+func TestFor(t *testing.T) {
+	s, err := New([]Policy{
+		{Domain: "*.gov", Action: rules.ActionHold, Approvals: 2, RequireReason: true},
+		{Domain: "open.example.gov", Action: rules.ActionApprove},
+		{Domain: "Internal.Example.com", Action: rules.ActionApprove},
+		{Domain: "*.example.com", Approvals: 2},
+		{Domain: "spam.example", Action: rules.ActionReject},
+	})
+	if err != nil {
+		t.Fatalf("new policies: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		to     []string
+		want   Requirement
+		review bool
+	}{
+		{"no policy", []string{"a@other.org"}, Requirement{Approvals: 1}, false},
+		{"glob", []string{"a@agency.gov"}, Requirement{Action: rules.ActionHold, Domain: "*.gov", Approvals: 2, RequireReason: true}, true},
+		{"exact beats glob", []string{"a@open.example.gov"}, Requirement{Action: rules.ActionApprove, Domain: "open.example.gov", Approvals: 1}, false},
+		{"exact beats longer glob", []string{"a@INTERNAL.example.com"}, Requirement{Action: rules.ActionApprove, Domain: "internal.example.com", Approvals: 1}, false},
+		{"approvals only", []string{"a@sales.example.com"}, Requirement{Domain: "*.example.com", Approvals: 2}, true},
+		{"approve needs every recipient", []string{"a@internal.example.com", "b@other.org"}, Requirement{Approvals: 1}, false},
+		{"strictest wins", []string{"a@internal.example.com", "b@agency.gov", "c@spam.example"}, Requirement{Action: rules.ActionReject, Domain: "spam.example", Approvals: 2, RequireReason: true}, true},
+		{"review beats approve", []string{"a@internal.example.com", "b@sales.example.com"}, Requirement{Domain: "*.example.com", Approvals: 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.For(tt.to)
+			if got != tt.want {
+				t.Errorf("For(%v) = %+v, want %+v", tt.to, got, tt.want)
+			}
+			if got.Review() != tt.review {
+				t.Errorf("Review() = %v, want %v", got.Review(), tt.review)
+			}
+		})
+	}
+
+	var none *Set
+	if got := none.For([]string{"a@agency.gov"}); got != (Requirement{Approvals: 1}) {
+		t.Errorf("nil set: For = %+v", got)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	approveRule := rules.Rule{Name: "alerts", Action: rules.ActionApprove}
+	rejectRule := rules.Rule{Name: "large", Action: rules.ActionReject}
+	noRule := rules.Rule{Action: rules.ActionHold}
+
+	tests := []struct {
+		name   string
+		req    Requirement
+		rule   rules.Rule
+		action rules.Action
+		by     string
+	}{
+		{"no policy", Requirement{Approvals: 1}, approveRule, rules.ActionApprove, "rule:alerts"},
+		{"rule reject beats policy approve", Requirement{Action: rules.ActionApprove, Domain: "example.com", Approvals: 1}, rejectRule, rules.ActionReject, "rule:large"},
+		{"policy reject beats rule approve", Requirement{Action: rules.ActionReject, Domain: "spam.example", Approvals: 1}, approveRule, rules.ActionReject, "policy:spam.example"},
+		{"policy review beats rule approve", Requirement{Domain: "*.gov", Approvals: 2}, approveRule, rules.ActionHold, "policy:*.gov"},
+		{"policy approve beats default hold", Requirement{Action: rules.ActionApprove, Domain: "example.com", Approvals: 1}, noRule, rules.ActionApprove, "policy:example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, by := tt.req.Decide(tt.rule)
+			if action != tt.action || by != tt.by {
+				t.Errorf("Decide = %s by %q, want %s by %q", action, by, tt.action, tt.by)
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, p := range []Policy{
+		{Action: rules.ActionHold},
+		{Domain: "[", Action: rules.ActionHold},
+		{Domain: "example.com", Action: "relay"},
+		{Domain: "example.com", Approvals: -1, Action: rules.ActionHold},
+		{Domain: "example.com"},
+		{Domain: "example.com", Action: rules.ActionApprove, RequireReason: true},
+	} {
+		if _, err := New([]Policy{p}); err == nil {
+			t.Errorf("New(%+v) accepted", p)
+		}
+	}
+	if _, err := New([]Policy{{Domain: "example.com", Action: rules.ActionHold}, {Domain: "EXAMPLE.com", Approvals: 2}}); err == nil {
+		t.Error("duplicate domain accepted")
+	}
+}
@@ -0,0 +1,705 @@
+// Package poller periodically fetches new inbound mail from IMAP into the
+// store; Deliver files mail that arrives another way the same. Consecutive failures back off exponentially with jitter and trip a
+// circuit breaker, so a flapping server does not produce a tight error loop.
+package poller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/autoreply"
+	"github.com/albert/mailescrow/internal/contacts"
+	"github.com/albert/mailescrow/internal/dsn"
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/pubsub"
+	"github.com/albert/mailescrow/internal/routing"
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/signature"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/sysmail"
+	"github.com/albert/mailescrow/internal/tracing"
+)
+
+// State is the circuit breaker state.
+type State string
+
+const (
+	StateClosed   State = "closed"    // polling normally
+	StateOpen     State = "open"      // too many consecutive failures; waiting to retry
+	StateHalfOpen State = "half_open" // trial poll after the breaker was open
+)
+
+// Fetcher fetches new messages from the mail server and files them into
+// folders. *imap.Client implements it.
+type Fetcher interface {
+	Poll(ctx context.Context, folder string, knownMessageIDs []string) ([]imap.FetchedEmail, error)
+	MoveMessage(ctx context.Context, messageID, fromMailbox, toMailbox string) error
+}
+
+// Status is a snapshot of the poller's health.
+type Status struct {
+	State               State     `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success,omitzero"`
+	LastError           string    `json:"last_error,omitempty"`
+	FailingSince        time.Time `json:"failing_since,omitzero"`
+	NextAttempt         time.Time `json:"next_attempt,omitzero"`
+}
+
+// Options tune the poller's resilience. Zero values take the defaults.
+type Options struct {
+	MaxBackoff       time.Duration // longest delay between failing attempts; default 15m
+	FailureThreshold int           // consecutive failures that open the breaker; default 5
+	AlertAfter       time.Duration // notify once polling has failed this long; 0 disables
+}
+
+// SpamTag tags mail fetched from a spam folder.
+const SpamTag = "spam"
+
+// Folder is a mail folder polled for new mail. Mail fetched from it goes to
+// Queue, or to the queue its recipients are routed to if Queue is empty.
+type Folder struct {
+	Name  string
+	Queue string
+	// Spam marks the provider's spam folder: its mail is tagged SpamTag and
+	// never approved without review.
+	Spam bool
+}
+
+// Poller polls IMAP folders on an interval.
+type Poller struct {
+	client   Fetcher
+	st       store.ReadWriter
+	router   *routing.Router
+	folders  []Folder
+	notifier notify.Notifier     // may be nil
+	contacts *contacts.Book      // may be nil; mail from trusted contacts is then held like any other
+	verifier *signature.Verifier // may be nil; signatures are then not checked
+	approved *pubsub.Topic       // may be nil; published when mail is auto-approved
+	system   *sysmail.Mailer     // may be nil; mailescrow's own mail is then held like any other
+	suppress *suppression.List   // may be nil; bounces are then not added to the suppression list
+	replies  *autoreply.Policy   // may be nil; auto-replies are then tagged and held
+	rules    *rules.Engine       // may be nil; replaced by SetRules on a configuration reload
+	interval time.Duration
+	opts     Options
+	now      func() time.Time
+	jitter   func(d time.Duration) time.Duration
+
+	mu      sync.Mutex // guards the fields below, and notifier, interval, folders and rules, which a reload may replace
+	status  Status
+	alerted bool // a failing notification was sent for the current outage
+}
+
+// New creates a Poller. notifier may be nil.
+func New(client Fetcher, st store.ReadWriter, router *routing.Router, notifier notify.Notifier, interval time.Duration, opts Options) *Poller {
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 15 * time.Minute
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+	p := &Poller{
+		client:   client,
+		st:       st,
+		router:   router,
+		folders:  []Folder{{Name: imap.FolderInbox}},
+		notifier: notifier,
+		interval: interval,
+		opts:     opts,
+		now:      time.Now,
+		jitter:   equalJitter,
+		status:   Status{State: StateClosed},
+	}
+	p.setStateMetric(StateClosed)
+	return p
+}
+
+// SetFolders replaces the folders polled for new mail, by default only
+// INBOX. It returns CheckFolders' error, if any. It applies from the next
+// poll.
+func (p *Poller) SetFolders(folders []Folder) error {
+	if err := CheckFolders(folders); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.folders = folders
+	return nil
+}
+
+// CheckFolders reports whether folders can be polled: there must be some,
+// each named once and none of them one of the mailescrow/* folders mail is
+// filed into.
+func CheckFolders(folders []Folder) error {
+	if len(folders) == 0 {
+		return errors.New("no folders to poll")
+	}
+	seen := make(map[string]bool, len(folders))
+	for _, f := range folders {
+		switch {
+		case f.Name == "":
+			return errors.New("folder name is empty")
+		case strings.HasPrefix(f.Name, "mailescrow/"):
+			return fmt.Errorf("folder %s is where mailescrow files mail", f.Name)
+		case seen[f.Name]:
+			return fmt.Errorf("folder %s is listed twice", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	return nil
+}
+
+// SetContacts approves inbound mail from trusted contacts as it is fetched.
+func (p *Poller) SetContacts(b *contacts.Book) {
+	p.contacts = b
+}
+
+// SetRules applies engine's inbound rules to mail as it is fetched or
+// delivered. engine may be nil.
+func (p *Poller) SetRules(engine *rules.Engine) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = engine
+}
+
+// SetSuppression adds the recipients that delivery status notifications
+// report as bounced permanently to l.
+func (p *Poller) SetSuppression(l *suppression.List) {
+	p.suppress = l
+}
+
+// SetAutoReplies applies pol to inbound auto-replies, which are tagged
+// autoreply.Tag (and autoreply.LoopTag in a loop) either way.
+func (p *Poller) SetAutoReplies(pol *autoreply.Policy) {
+	p.replies = pol
+}
+
+// SetVerifier checks S/MIME and PGP signatures on inbound mail as it is
+// fetched. Mail with an invalid signature is never auto-approved.
+func (p *Poller) SetVerifier(v *signature.Verifier) {
+	p.verifier = v
+}
+
+// SetNotifier replaces the notifier for failing and recovered polling. n may
+// be nil.
+func (p *Poller) SetNotifier(n notify.Notifier) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.notifier = n
+}
+
+// SetInterval replaces the polling interval. It applies from the next wait.
+func (p *Poller) SetInterval(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval = d
+}
+
+// SetApprovals publishes to t whenever inbound mail is auto-approved, waking
+// long-polling API reads.
+func (p *Poller) SetApprovals(t *pubsub.Topic) {
+	p.approved = t
+}
+
+// SetSystemMail drops mail m sent, mailescrow's own bounces and
+// notifications, as it comes back in instead of holding it for review.
+func (p *Poller) SetSystemMail(m *sysmail.Mailer) {
+	p.system = m
+}
+
+// Status returns a snapshot of the poller's health.
+func (p *Poller) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Run polls immediately and then until ctx is cancelled, waiting interval
+// between successful polls and an increasing backoff after failures.
+func (p *Poller) Run(ctx context.Context) {
+	p.mu.Lock()
+	interval, folders := p.interval, p.folders
+	p.mu.Unlock()
+	names := make([]string, len(folders))
+	for i, f := range folders {
+		names[i] = f.Name
+	}
+	log.Printf("IMAP poller started (interval: %s, folders: %s)", interval, strings.Join(names, ", "))
+	for {
+		if err := p.Poll(ctx); err != nil {
+			log.Printf("IMAP poll error: %v", err)
+		}
+		delay := p.nextDelay()
+		p.mu.Lock()
+		p.status.NextAttempt = p.now().Add(delay)
+		p.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Poll performs one polling attempt and updates the breaker state.
+func (p *Poller) Poll(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "poller.poll")
+	defer func() { tracing.End(span, err) }()
+
+	p.mu.Lock()
+	if p.status.State == StateOpen {
+		p.status.State = StateHalfOpen
+		p.setStateMetric(StateHalfOpen)
+	}
+	p.mu.Unlock()
+
+	err = p.poll(ctx)
+	if err != nil {
+		p.recordFailure(ctx, err)
+	} else {
+		p.recordSuccess(ctx)
+	}
+	return err
+}
+
+func (p *Poller) poll(ctx context.Context) error {
+	emails, err := p.st.ListPendingSummaries(ctx)
+	if err != nil {
+		return fmt.Errorf("list pending: %w", err)
+	}
+
+	knownIDs := make([]string, 0, len(emails))
+	for _, e := range emails {
+		if e.IMAPMessageID != "" {
+			knownIDs = append(knownIDs, e.IMAPMessageID)
+		}
+	}
+
+	// Also collect known IDs from approved (not yet fetched) emails.
+	approved, err := p.st.ListApproved(ctx, "", "")
+	if err != nil {
+		log.Printf("IMAP poll: list approved: %v", err)
+	} else {
+		for _, e := range approved {
+			if e.IMAPMessageID != "" {
+				knownIDs = append(knownIDs, e.IMAPMessageID)
+			}
+		}
+	}
+
+	// A folder that cannot be polled fails the attempt, but does not hold
+	// up the others.
+	p.mu.Lock()
+	folders := p.folders
+	p.mu.Unlock()
+	var errs []error
+	for _, folder := range folders {
+		fetched, err := p.client.Poll(ctx, folder.Name, knownIDs)
+		if err != nil {
+			if len(folders) > 1 {
+				err = fmt.Errorf("%s: %w", folder.Name, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		for _, f := range fetched {
+			if _, err := p.deliver(ctx, f, imap.FolderReceived, folder); err != nil {
+				log.Printf("IMAP poll: %v", err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Deliver files an inbound message that did not come through IMAP, e.g. one
+// handed over by a local MTA over LMTP, exactly like a fetched one: routed,
+// checked against block rules and signatures, and approved if trusted. f's
+// MessageID must be empty, as the message is in no IMAP folder to move. It
+// returns the new email's ID. Deliver works on a Poller that is never Run,
+// whose client may be nil.
+func (p *Poller) Deliver(ctx context.Context, f imap.FetchedEmail) (string, error) {
+	f.MessageID = ""
+	return p.deliver(ctx, f, "", Folder{})
+}
+
+// deliver saves f, fetched from folder (zero if it did not come through
+// IMAP), as a pending inbound email filed in mailbox and applies the inbound
+// policies and rules to it. It goes to the folder's queue, or if that is
+// empty to the queue its recipients are routed to. Only saving it can fail; later steps
+// log their failures and leave the email pending.
+func (p *Poller) deliver(ctx context.Context, f imap.FetchedEmail, mailbox string, folder Folder) (string, error) {
+	queue := folder.Queue
+	if queue == "" {
+		queue = p.router.Queue(f.DeliveredTo())
+	}
+	id, err := p.st.SaveInbound(ctx, f.Sender, f.Recipients, f.Subject, f.Body, f.RawMessage, f.MessageID, mailbox, queue)
+	if err != nil {
+		return "", fmt.Errorf("save inbound: %w", err)
+	}
+	if f.EnvelopeRecipients != nil {
+		if err := p.st.SetEnvelopeRecipients(ctx, id, f.EnvelopeRecipients); err != nil {
+			log.Printf("Inbound: record envelope recipients for %s: %v", id, err)
+		}
+	}
+	log.Printf("Received inbound email %s from %s (subject: %s, queue: %s)", id, f.Sender, f.Subject, queue)
+	if folder.Spam {
+		if err := p.st.AddTag(ctx, id, SpamTag); err != nil {
+			log.Printf("Inbound: tag %s as spam: %v", id, err)
+		}
+	}
+	if p.rejectBlocked(ctx, id, f) {
+		return id, nil
+	}
+	if p.dropSystemMail(ctx, id, f) {
+		return id, nil
+	}
+	rule := p.applyRules(ctx, id, f)
+	if rule.Action == rules.ActionReject && p.reject(ctx, id, f, "rule:"+rule.Name) {
+		log.Printf("Rejected inbound email %s from %s by rule %q", id, f.Sender, rule.Name)
+		return id, nil
+	}
+	p.recordDelivery(ctx, id, f.RawMessage)
+	autoReply, loop := p.tagAutoReply(ctx, id, f)
+	if sig := p.verifier.Verify(f.RawMessage); sig != nil {
+		if err := p.st.SetSignature(ctx, id, *sig); err != nil {
+			log.Printf("Inbound: record signature for %s: %v", id, err)
+		}
+		if sig.Status == store.SignatureInvalid {
+			log.Printf("Inbound email %s has an invalid %s signature: %s", id, sig.Protocol, sig.Detail)
+			return id, nil
+		}
+	}
+	if folder.Spam {
+		// Whoever it claims to be from, the provider thought it spam.
+		return id, nil
+	}
+	if autoReply && p.decideAutoReply(ctx, id, f, loop) {
+		return id, nil
+	}
+	if rule.Action == rules.ActionApprove {
+		p.approve(ctx, id, f, "rule:"+rule.Name)
+		return id, nil
+	}
+	p.approveTrusted(ctx, id, f)
+	return id, nil
+}
+
+// applyRules tags a just-saved email with the tags of every rule matching it
+// and returns the first matching rule with an action (ActionHold if none).
+// Failures to tag are logged.
+func (p *Poller) applyRules(ctx context.Context, id string, f imap.FetchedEmail) rules.Rule {
+	p.mu.Lock()
+	engine := p.rules
+	p.mu.Unlock()
+	msg := rules.Message{
+		Direction: store.DirectionInbound, Sender: f.Sender, Recipients: f.Recipients,
+		Subject: f.Subject, Body: f.Body, Size: len(f.RawMessage),
+	}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(f.RawMessage)); err == nil {
+		msg.Header = parsed.Header
+	}
+	for _, tag := range engine.Tags(msg) {
+		if err := p.st.AddTag(ctx, id, tag); err != nil {
+			log.Printf("Inbound: tag %s as %s: %v", id, tag, err)
+		}
+	}
+	rule, _ := engine.Evaluate(msg)
+	return rule
+}
+
+// tagAutoReply tags a just-saved email that is an auto-reply, and reports
+// whether it is one and whether it is part of a loop. Failures to tag are
+// logged.
+func (p *Poller) tagAutoReply(ctx context.Context, id string, f imap.FetchedEmail) (auto, loop bool) {
+	reason := autoreply.Detect(f.RawMessage)
+	if reason == "" {
+		return false, false
+	}
+	tags := []string{autoreply.Tag}
+	if loop = p.replies.Loop(f.Sender); loop {
+		tags = append(tags, autoreply.LoopTag)
+		log.Printf("Inbound email %s is an auto-reply in a loop with %s (%s)", id, f.Sender, reason)
+	} else {
+		log.Printf("Inbound email %s is an auto-reply (%s)", id, reason)
+	}
+	for _, tag := range tags {
+		if err := p.st.AddTag(ctx, id, tag); err != nil {
+			log.Printf("Inbound: tag %s as %s: %v", id, tag, err)
+		}
+	}
+	return true, loop
+}
+
+// decideAutoReply applies the auto-reply policy to a just-saved auto-reply
+// and reports whether it decided on it. An auto-reply in a loop is never
+// approved: whatever reads it might answer and keep the loop going.
+func (p *Poller) decideAutoReply(ctx context.Context, id string, f imap.FetchedEmail, loop bool) bool {
+	switch p.replies.Action() {
+	case autoreply.ActionApprove:
+		if loop {
+			return false
+		}
+		p.approve(ctx, id, f, autoreply.Reviewer)
+		return true
+	case autoreply.ActionArchive:
+		if !p.reject(ctx, id, f, autoreply.Reviewer) {
+			return false
+		}
+		log.Printf("Archived inbound auto-reply %s from %s without review", id, f.Sender)
+		return true
+	}
+	return false
+}
+
+// recordDelivery updates the delivery status of a relayed email when the
+// just-saved email is a delivery status notification for it. The
+// notification itself stays held for review like any other inbound mail.
+func (p *Poller) recordDelivery(ctx context.Context, id string, raw []byte) {
+	report, ok := dsn.Parse(raw)
+	if !ok || report.EnvelopeID == "" {
+		return
+	}
+	status := report.Status()
+	if status == "" {
+		return
+	}
+	if err := p.st.UpdateDelivery(ctx, report.EnvelopeID, status, report.Detail()); err != nil {
+		log.Printf("Inbound: record delivery status from %s: %v", id, err)
+		return
+	}
+	log.Printf("Delivery status for envelope %s: %s (%s)", report.EnvelopeID, status, report.Detail())
+	// Only notifications for mail mailescrow relayed get this far, so a
+	// forged one cannot suppress arbitrary addresses.
+	if n, err := p.suppress.AddBounces(ctx, report); err != nil {
+		log.Printf("Inbound: suppress bounced recipients from %s: %v", id, err)
+	} else if n > 0 {
+		log.Printf("Added %d bounced recipient(s) of envelope %s to the suppression list", n, report.EnvelopeID)
+	}
+}
+
+// rejectBlocked rejects a just-saved email if a block rule matches its sender,
+// and reports whether it did. Failures are logged and leave the email pending.
+func (p *Poller) rejectBlocked(ctx context.Context, id string, f imap.FetchedEmail) bool {
+	blocked, err := p.contacts.Blocked(ctx, store.DirectionInbound, f.Sender)
+	if err != nil {
+		log.Printf("Inbound: check block rules for %s: %v", id, err)
+		return false
+	}
+	if blocked == "" {
+		return false
+	}
+	if !p.reject(ctx, id, f, contacts.BlockReviewer) {
+		return false
+	}
+	log.Printf("Rejected inbound email %s from %s: %s is blocked", id, f.Sender, blocked)
+	return true
+}
+
+// dropSystemMail rejects a just-saved email, without notice, if it is
+// mailescrow's own mail come back: it has reached its recipients already,
+// and held it would notify reviewers about their own notifications.
+func (p *Poller) dropSystemMail(ctx context.Context, id string, f imap.FetchedEmail) bool {
+	rcpts := f.EnvelopeRecipients
+	if rcpts == nil {
+		rcpts = f.Recipients
+	}
+	kind := p.system.Check(f.RawMessage, rcpts)
+	if kind == "" || !p.reject(ctx, id, f, sysmail.ReviewerPrefix+kind) {
+		return false
+	}
+	log.Printf("Dropped inbound email %s: it is mailescrow's own %s mail", id, kind)
+	return true
+}
+
+// approveTrusted approves a just-saved email if its sender is a trusted
+// contact or allowed by an allow rule. Failures are logged and leave the
+// email pending.
+func (p *Poller) approveTrusted(ctx context.Context, id string, f imap.FetchedEmail) {
+	approver, err := p.contacts.Approver(ctx, store.DirectionInbound, f.Sender, f.Recipients)
+	if err != nil {
+		log.Printf("Inbound: check contacts for %s: %v", id, err)
+		return
+	}
+	if approver == "" {
+		return
+	}
+	p.approve(ctx, id, f, approver)
+}
+
+// reject rejects a just-saved email on behalf of reviewer, without notifying
+// its sender, and reports whether it did. Failures are logged; if rejecting
+// fails the email stays pending.
+func (p *Poller) reject(ctx context.Context, id string, f imap.FetchedEmail, reviewer string) bool {
+	if err := p.st.Reject(ctx, id, 0); err != nil { // just saved, so at version 0
+		log.Printf("Inbound: reject %s: %v", id, err)
+		return false
+	}
+	if f.MessageID != "" {
+		if err := p.client.MoveMessage(ctx, f.MessageID, imap.FolderReceived, imap.FolderRejected); err != nil {
+			log.Printf("IMAP move email %s to rejected: %v", id, err)
+		}
+	}
+	if err := p.st.RecordDecision(ctx, store.Decision{
+		EmailID:   id,
+		Direction: store.DirectionInbound,
+		Sender:    f.Sender,
+		Subject:   f.Subject,
+		Decision:  store.DecisionRejected,
+		Reviewer:  reviewer,
+
+		RawMessage: f.RawMessage,
+	}); err != nil {
+		log.Printf("record decision for %s: %v", id, err)
+	}
+	return true
+}
+
+// approve approves a just-saved email on behalf of approver. Failures are
+// logged and leave the email pending.
+func (p *Poller) approve(ctx context.Context, id string, f imap.FetchedEmail, approver string) {
+	if err := p.st.Approve(ctx, id, approver, 0); err != nil { // just saved, so at version 0
+		log.Printf("Inbound: approve %s: %v", id, err)
+		return
+	}
+	p.approved.Publish()
+	if f.MessageID != "" {
+		if err := p.client.MoveMessage(ctx, f.MessageID, imap.FolderReceived, imap.FolderApproved); err != nil {
+			log.Printf("IMAP move email %s to approved: %v", id, err)
+		} else if err := p.st.UpdateIMAPMailbox(ctx, id, imap.FolderApproved); err != nil {
+			log.Printf("update imap mailbox for %s: %v", id, err)
+		}
+	}
+	if err := p.st.RecordDecision(ctx, store.Decision{
+		EmailID:   id,
+		Direction: store.DirectionInbound,
+		Sender:    f.Sender,
+		Subject:   f.Subject,
+		Decision:  store.DecisionApproved,
+		Reviewer:  approver,
+
+		RawMessage: f.RawMessage,
+	}); err != nil {
+		log.Printf("record decision for %s: %v", id, err)
+	}
+	log.Printf("Auto-approved inbound email %s from %s (approved by %s)", id, f.Sender, approver)
+}
+
+func (p *Poller) recordFailure(ctx context.Context, err error) {
+	metrics.IMAPPollFailures.Inc()
+
+	p.mu.Lock()
+	now := p.now()
+	if p.status.ConsecutiveFailures == 0 {
+		p.status.FailingSince = now
+	}
+	p.status.ConsecutiveFailures++
+	p.status.LastError = err.Error()
+	if p.status.State == StateHalfOpen || p.status.ConsecutiveFailures >= p.opts.FailureThreshold {
+		if p.status.State != StateOpen && p.status.State != StateHalfOpen {
+			log.Printf("IMAP poller circuit open after %d consecutive failures", p.status.ConsecutiveFailures)
+		}
+		p.status.State = StateOpen
+		p.setStateMetric(StateOpen)
+	}
+	metrics.IMAPConsecutiveFailures.Set(float64(p.status.ConsecutiveFailures))
+
+	failingFor := now.Sub(p.status.FailingSince)
+	shouldAlert := p.opts.AlertAfter > 0 && failingFor >= p.opts.AlertAfter && !p.alerted
+	if shouldAlert {
+		p.alerted = true
+	}
+	status := p.status
+	p.mu.Unlock()
+
+	if shouldAlert {
+		log.Printf("IMAP polling has been failing for %s", failingFor.Round(time.Second))
+		p.notify(ctx, notify.Event{
+			Type:    notify.EventIMAPPollFailing,
+			Message: fmt.Sprintf("IMAP polling has failed %d times over %s: %s", status.ConsecutiveFailures, failingFor.Round(time.Second), status.LastError),
+		})
+	}
+}
+
+func (p *Poller) recordSuccess(ctx context.Context) {
+	p.mu.Lock()
+	failures := p.status.ConsecutiveFailures
+	wasAlerted := p.alerted
+	p.status = Status{State: StateClosed, LastSuccess: p.now()}
+	p.alerted = false
+	p.setStateMetric(StateClosed)
+	p.mu.Unlock()
+	metrics.IMAPConsecutiveFailures.Set(0)
+
+	if failures > 0 {
+		log.Printf("IMAP polling recovered after %d failures", failures)
+	}
+	if wasAlerted {
+		p.notify(ctx, notify.Event{
+			Type:    notify.EventIMAPPollRecovered,
+			Message: fmt.Sprintf("IMAP polling recovered after %d failures", failures),
+		})
+	}
+}
+
+func (p *Poller) notify(ctx context.Context, e notify.Event) {
+	p.mu.Lock()
+	notifier := p.notifier
+	p.mu.Unlock()
+	if notifier == nil {
+		return
+	}
+	if err := notifier.Notify(ctx, e); err != nil {
+		log.Printf("IMAP poller notify: %v", err)
+	}
+}
+
+// nextDelay returns how long to wait before the next attempt: the interval
+// after a success, otherwise interval·2^(failures-1) capped at MaxBackoff,
+// with jitter.
+func (p *Poller) nextDelay() time.Duration {
+	p.mu.Lock()
+	failures, interval := p.status.ConsecutiveFailures, p.interval
+	p.mu.Unlock()
+	if failures == 0 {
+		return interval
+	}
+	d := interval
+	for i := 1; i < failures && d < p.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	return p.jitter(min(d, p.opts.MaxBackoff))
+}
+
+// setStateMetric reports s as the current breaker state.
+func (p *Poller) setStateMetric(s State) {
+	for _, state := range []State{StateClosed, StateOpen, StateHalfOpen} {
+		v := 0.0
+		if state == s {
+			v = 1
+		}
+		metrics.IMAPCircuitState.Set(v, string(state))
+	}
+}
+
+// equalJitter returns a random duration in [d/2, d).
+func equalJitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half)
+}
@@ -0,0 +1,537 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/autoreply"
+	"github.com/albert/mailescrow/internal/contacts"
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/pubsub"
+	"github.com/albert/mailescrow/internal/routing"
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/signature"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/sysmail"
+)
+
+type fakeFetcher struct {
+	err     error
+	fetched []imap.FetchedEmail            // in INBOX
+	folders map[string][]imap.FetchedEmail // in other folders
+	moved   []string                       // "messageID:to"
+}
+
+func (f *fakeFetcher) MoveMessage(_ context.Context, messageID, _, toMailbox string) error {
+	f.moved = append(f.moved, messageID+":"+toMailbox)
+	return nil
+}
+
+func (f *fakeFetcher) Poll(_ context.Context, folder string, _ []string) ([]imap.FetchedEmail, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if folder != imap.FolderInbox {
+		out, ok := f.folders[folder]
+		if !ok {
+			return nil, errors.New("no such folder")
+		}
+		f.folders[folder] = nil
+		return out, nil
+	}
+	out := f.fetched
+	f.fetched = nil
+	return out, nil
+}
+
+type recordingNotifier struct {
+	events []notify.Event
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, e notify.Event) error {
+	n.events = append(n.events, e)
+	return nil
+}
+
+func newTestPoller(t *testing.T, f Fetcher, n notify.Notifier, opts Options) (*Poller, *store.Store) {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	p := New(f, st, routing.New(nil), n, time.Minute, opts)
+	p.jitter = func(d time.Duration) time.Duration { return d }
+	return p, st
+}
+
+func TestPollSavesFetchedMail(t *testing.T) {
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{{MessageID: "<m1@x>", Sender: "a@x.com", Recipients: []string{"me@x.com"}, Subject: "Hi", Body: "hello", RawMessage: []byte("Subject: Hi\r\n\r\nhello")}}}
+	p, st := newTestPoller(t, f, nil, Options{})
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || pending[0].IMAPMessageID != "<m1@x>" || pending[0].Queue != routing.DefaultQueue {
+		t.Errorf("pending = %+v, want one inbound email in the default queue", pending)
+	}
+	if s := p.Status(); s.State != StateClosed || s.LastSuccess.IsZero() {
+		t.Errorf("status = %+v, want closed with last success", s)
+	}
+}
+
+func TestPollWatchFolders(t *testing.T) {
+	f := &fakeFetcher{
+		fetched: []imap.FetchedEmail{{MessageID: "<m1@x>", Sender: "a@x.com", Recipients: []string{"billing@x.com"}, Subject: "Invoice", RawMessage: []byte("Subject: Invoice\r\n\r\n")}},
+		folders: map[string][]imap.FetchedEmail{
+			"Support": {{MessageID: "<m2@x>", Sender: "b@x.com", Recipients: []string{"billing@x.com"}, Subject: "Help", RawMessage: []byte("Subject: Help\r\n\r\n")}},
+		},
+	}
+	p, st := newTestPoller(t, f, nil, Options{})
+	p.router = routing.New([]routing.Route{{Match: "billing@*", Queue: "billing"}})
+	if err := p.SetFolders([]Folder{{Name: imap.FolderInbox}, {Name: "Missing"}, {Name: "Support", Queue: "support"}}); err != nil {
+		t.Fatalf("set folders: %v", err)
+	}
+
+	// A folder that cannot be polled fails the attempt, after the others.
+	if err := p.Poll(t.Context()); err == nil || !strings.Contains(err.Error(), "Missing") {
+		t.Errorf("poll error = %v, want one naming the missing folder", err)
+	}
+	pending, _ := st.ListPending(t.Context())
+	queues := make(map[string]string)
+	for _, e := range pending {
+		queues[e.Subject] = e.Queue
+	}
+	if want := map[string]string{"Invoice": "billing", "Help": "support"}; !maps.Equal(queues, want) {
+		t.Errorf("queues = %v, want %v: routed from INBOX, the folder's queue from Support", queues, want)
+	}
+
+	for name, folders := range map[string][]Folder{
+		"none":      nil,
+		"empty":     {{Name: ""}},
+		"duplicate": {{Name: "INBOX"}, {Name: "INBOX", Queue: "x"}},
+		"own":       {{Name: imap.FolderReceived}},
+	} {
+		if err := p.SetFolders(folders); err == nil {
+			t.Errorf("%s: SetFolders succeeded, want an error", name)
+		}
+	}
+}
+
+func TestDeliverWithoutIMAP(t *testing.T) {
+	p, st := newTestPoller(t, nil, nil, Options{})
+	book := contacts.New(st, 0)
+	if err := book.Allow(t.Context(), store.DirectionInbound, "friend@x.com", "admin", ""); err != nil {
+		t.Fatalf("allow: %v", err)
+	}
+	p.SetContacts(book)
+
+	id, err := p.Deliver(t.Context(), imap.FetchedEmail{MessageID: "<m1@x>", Sender: "friend@x.com", Recipients: []string{"me@x.com"}, Subject: "Hi", RawMessage: []byte("Subject: Hi\r\n\r\n")})
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	e, err := st.Get(t.Context(), id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if e.Status != store.StatusApproved || e.IMAPMessageID != "" || e.IMAPMailbox != "" {
+		t.Errorf("delivered email = %+v, want approved and in no IMAP folder", e)
+	}
+}
+
+func TestRoutesCatchAllByEnvelopeRecipient(t *testing.T) {
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{{
+		MessageID: "<m1@x>", Sender: "a@x.com", Recipients: []string{"undisclosed-recipients:;"},
+		EnvelopeRecipients: []string{"billing@x.com"}, Subject: "Invoice", RawMessage: []byte("Subject: Invoice\r\n\r\n"),
+	}}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	p.router = routing.New([]routing.Route{{Match: "billing@*", Queue: "billing"}})
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 {
+		t.Fatalf("pending = %d, want 1", len(pending))
+	}
+	if pending[0].Queue != "billing" {
+		t.Errorf("queue = %q, want billing from the envelope recipient", pending[0].Queue)
+	}
+	if got := pending[0].EnvelopeRecipients; len(got) != 1 || got[0] != "billing@x.com" {
+		t.Errorf("envelope recipients = %v, want [billing@x.com]", got)
+	}
+}
+
+func TestBackoffAndCircuitBreaker(t *testing.T) {
+	f := &fakeFetcher{err: errors.New("connection refused")}
+	p, _ := newTestPoller(t, f, nil, Options{MaxBackoff: 5 * time.Minute, FailureThreshold: 3})
+
+	wantDelays := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute}
+	for i, want := range wantDelays {
+		_ = p.Poll(t.Context())
+		if got := p.nextDelay(); got != want {
+			t.Errorf("after %d failures delay = %s, want %s", i+1, got, want)
+		}
+	}
+	s := p.Status()
+	if s.State != StateOpen || s.ConsecutiveFailures != 4 || s.LastError != "connection refused" {
+		t.Errorf("status = %+v, want open after 4 failures", s)
+	}
+
+	// The next attempt is a half-open trial; success closes the breaker.
+	f.err = nil
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if s := p.Status(); s.State != StateClosed || s.ConsecutiveFailures != 0 {
+		t.Errorf("status = %+v, want closed after recovery", s)
+	}
+	if got := p.nextDelay(); got != time.Minute {
+		t.Errorf("delay after recovery = %s, want interval", got)
+	}
+}
+
+func TestSetIntervalAndNotifier(t *testing.T) {
+	f := &fakeFetcher{err: errors.New("timeout")}
+	p, _ := newTestPoller(t, f, nil, Options{AlertAfter: time.Minute})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	p.SetInterval(5 * time.Minute)
+	if got := p.nextDelay(); got != 5*time.Minute {
+		t.Errorf("delay = %s, want the new interval", got)
+	}
+
+	n := &recordingNotifier{}
+	p.SetNotifier(n)
+	_ = p.Poll(t.Context())
+	now = now.Add(2 * time.Minute)
+	_ = p.Poll(t.Context())
+	if len(n.events) != 1 {
+		t.Errorf("events = %+v, want the alert sent to the new notifier", n.events)
+	}
+}
+
+func TestAlertsOnceWhenFailingTooLong(t *testing.T) {
+	f := &fakeFetcher{err: errors.New("timeout")}
+	n := &recordingNotifier{}
+	p, _ := newTestPoller(t, f, n, Options{AlertAfter: 10 * time.Minute})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	_ = p.Poll(t.Context())
+	now = now.Add(5 * time.Minute)
+	_ = p.Poll(t.Context())
+	if len(n.events) != 0 {
+		t.Fatalf("alerted after 5m, want threshold of 10m: %+v", n.events)
+	}
+	now = now.Add(5 * time.Minute)
+	_ = p.Poll(t.Context())
+	now = now.Add(5 * time.Minute)
+	_ = p.Poll(t.Context())
+	if len(n.events) != 1 || n.events[0].Type != notify.EventIMAPPollFailing {
+		t.Fatalf("events = %+v, want one imap_poll_failing", n.events)
+	}
+
+	f.err = nil
+	_ = p.Poll(t.Context())
+	if len(n.events) != 2 || n.events[1].Type != notify.EventIMAPPollRecovered {
+		t.Errorf("events = %+v, want recovery notification", n.events)
+	}
+}
+
+func TestPollSpamFolder(t *testing.T) {
+	f := &fakeFetcher{folders: map[string][]imap.FetchedEmail{
+		"Junk": {{MessageID: "<s1@x>", Sender: "friend@x.com", Recipients: []string{"me@x.com"}, Subject: "Prize", RawMessage: []byte("Subject: Prize\r\n\r\n")}},
+	}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	book := contacts.New(st, 1)
+	_ = book.Learn(t.Context(), &store.Email{Direction: store.DirectionInbound, Sender: "friend@x.com"})
+	p.SetContacts(book)
+	if err := p.SetFolders([]Folder{{Name: imap.FolderInbox}, {Name: "Junk", Spam: true}}); err != nil {
+		t.Fatalf("set folders: %v", err)
+	}
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || strings.Join(pending[0].Tags, ",") != SpamTag {
+		t.Fatalf("pending = %+v, want the trusted sender's email held and tagged spam", pending)
+	}
+	if len(f.moved) != 0 {
+		t.Errorf("moved = %v, want it left in received", f.moved)
+	}
+}
+
+func TestApprovesTrustedSenders(t *testing.T) {
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{
+		{MessageID: "<known@x>", Sender: "Friend@x.com", Recipients: []string{"me@x.com"}, Subject: "Hi", Body: "b", RawMessage: []byte("raw")},
+		{MessageID: "<new@x>", Sender: "stranger@x.com", Recipients: []string{"me@x.com"}, Subject: "Hey", Body: "b", RawMessage: []byte("raw")},
+	}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	book := contacts.New(st, 1)
+	_ = book.Learn(t.Context(), &store.Email{Direction: store.DirectionInbound, Sender: "friend@x.com"})
+	p.SetContacts(book)
+	approvals := pubsub.New()
+	p.SetApprovals(approvals)
+	woken := approvals.Wait()
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	select {
+	case <-woken:
+	default:
+		t.Error("auto-approval did not publish to the approvals topic")
+	}
+	approved, _ := st.ListApproved(t.Context(), "", "")
+	if len(approved) != 1 || approved[0].IMAPMessageID != "<known@x>" || approved[0].ApprovedBy != contacts.Reviewer {
+		t.Errorf("approved = %+v, want the trusted sender's email approved by contacts", approved)
+	}
+	if approved[0].IMAPMailbox != imap.FolderApproved || len(f.moved) != 1 {
+		t.Errorf("mailbox = %q, moved = %v; want moved to approved", approved[0].IMAPMailbox, f.moved)
+	}
+	if pending, _ := st.ListPending(t.Context()); len(pending) != 1 {
+		t.Errorf("pending = %d, want the stranger's email held", len(pending))
+	}
+}
+
+// capture is a relay.Sender keeping what it is given.
+type capture struct{ sent []*store.Email }
+
+func (c *capture) Send(_ context.Context, email *store.Email) error {
+	c.sent = append(c.sent, email)
+	return nil
+}
+
+func TestDropsOwnSystemMail(t *testing.T) {
+	relayed := &capture{}
+	system := sysmail.New(relayed)
+	raw := []byte("Message-Id: <n1@mailescrow>\r\nFrom: escrow@x.com\r\nSubject: [mailescrow] 1 new email waiting for review\r\n\r\nbody\r\n")
+	if err := system.Sender(sysmail.KindReview).Send(t.Context(), &store.Email{Recipients: []string{"me@x.com"}, RawMessage: raw}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	stamped := relayed.sent[0].RawMessage
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{
+		{MessageID: "<n1@mailescrow>", Sender: "escrow@x.com", Recipients: []string{"me@x.com"}, Subject: "Notification", Body: "b", RawMessage: stamped},
+		{MessageID: "<forged@x>", Sender: "escrow@x.com", Recipients: []string{"me@x.com"}, Subject: "Forged", Body: "b", RawMessage: append([]byte(sysmail.Header+": review; forged\r\n"), raw...)},
+		{MessageID: "<copy@x>", Sender: "escrow@x.com", Recipients: []string{"me@x.com"}, EnvelopeRecipients: []string{"other@x.com"}, Subject: "Copy", Body: "b", RawMessage: stamped},
+	}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	p.SetSystemMail(system)
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if approved, _ := st.ListApproved(t.Context(), "", ""); len(approved) != 0 {
+		t.Errorf("approved = %+v, want system mail never approved", approved)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 2 || pending[0].Subject == "Notification" || pending[1].Subject == "Notification" {
+		t.Errorf("pending = %+v, want the forged stamp and the copy to another recipient held", pending)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	if len(decisions) != 1 || decisions[0].Subject != "Notification" || decisions[0].Decision != store.DecisionRejected || decisions[0].Reviewer != sysmail.ReviewerPrefix+sysmail.KindReview {
+		t.Errorf("decisions = %+v, want the notification dropped as system mail", decisions)
+	}
+}
+
+func TestRejectsBlockedSenders(t *testing.T) {
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{
+		{MessageID: "<spam@x>", Sender: "eve@Spam.example", Recipients: []string{"me@x.com"}, Subject: "Win", Body: "b", RawMessage: []byte("raw")},
+		{MessageID: "<new@x>", Sender: "stranger@x.com", Recipients: []string{"me@x.com"}, Subject: "Hey", Body: "b", RawMessage: []byte("raw")},
+	}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	book := contacts.New(st, 0)
+	if err := book.Block(t.Context(), store.DirectionInbound, "spam.example", "alice", ""); err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	p.SetContacts(book)
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || pending[0].Sender != "stranger@x.com" {
+		t.Errorf("pending = %+v, want only the stranger's email held", pending)
+	}
+	if len(f.moved) != 1 || f.moved[0] != "<spam@x>:"+imap.FolderRejected {
+		t.Errorf("moved = %v, want the blocked email moved to rejected", f.moved)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	if len(decisions) != 1 || decisions[0].Decision != store.DecisionRejected || decisions[0].Reviewer != contacts.BlockReviewer {
+		t.Errorf("decisions = %+v, want one rejection by the blocklist", decisions)
+	}
+	if r, _ := st.GetBlockRule(t.Context(), store.DirectionInbound, "spam.example"); r == nil || r.Suppressed != 1 {
+		t.Errorf("rule = %+v, want one suppressed email", r)
+	}
+}
+
+func TestAppliesRules(t *testing.T) {
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{
+		{MessageID: "<bad@x>", Sender: "eve@x.com", Recipients: []string{"me@x.com"}, Subject: "Win", Body: "b", RawMessage: []byte("Subject: Win\r\n\r\nb")},
+		{MessageID: "<ok@x>", Sender: "alerts@x.com", Recipients: []string{"me@x.com"}, Subject: "Disk", Body: "b", RawMessage: []byte("Subject: Disk\r\n\r\nb")},
+		{MessageID: "<inv@x>", Sender: "shop@x.com", Recipients: []string{"me@x.com"}, Subject: "Invoice", Body: "b", RawMessage: []byte("X-Kind: invoice\r\nSubject: Invoice\r\n\r\nb")},
+	}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	engine, err := rules.New([]rules.Rule{
+		{Name: "outbound-only", Direction: store.DirectionOutbound, Action: rules.ActionReject},
+		{Name: "no-eve", Sender: "eve@x.com", Action: rules.ActionReject},
+		{Name: "alerts", Direction: store.DirectionInbound, Sender: "alerts@x.com", Action: rules.ActionApprove},
+		{Name: "invoices", When: `email.headers["x-kind"] == "invoice"`, Tags: []string{"invoice"}},
+	})
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	p.SetRules(engine)
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || pending[0].Sender != "shop@x.com" || !slices.Equal(pending[0].Tags, []string{"invoice"}) {
+		t.Errorf("pending = %+v, want only the invoice held, tagged", pending)
+	}
+	if !slices.Equal(f.moved, []string{"<bad@x>:" + imap.FolderRejected, "<ok@x>:" + imap.FolderApproved}) {
+		t.Errorf("moved = %v, want eve's email rejected and the alert approved", f.moved)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	reviewers := make([]string, 0, len(decisions))
+	for _, d := range decisions {
+		reviewers = append(reviewers, d.Reviewer)
+	}
+	slices.Sort(reviewers)
+	if !slices.Equal(reviewers, []string{"rule:alerts", "rule:no-eve"}) {
+		t.Errorf("decided by %v, want rule:alerts and rule:no-eve", reviewers)
+	}
+}
+
+func TestAutoReplies(t *testing.T) {
+	ooo := func(id, sender string) imap.FetchedEmail {
+		return imap.FetchedEmail{MessageID: id, Sender: sender, Recipients: []string{"me@x.com"}, Subject: "Out of office", Body: "b",
+			RawMessage: []byte("From: " + sender + "\r\nAuto-Submitted: auto-replied\r\nSubject: Out of office\r\n\r\nBack on Monday\r\n")}
+	}
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{
+		ooo("<a1@x>", "away@x.com"),
+		{MessageID: "<p1@x>", Sender: "person@x.com", Recipients: []string{"me@x.com"}, Subject: "Hi", Body: "b", RawMessage: []byte("Subject: Hi\r\n\r\nhello")},
+		ooo("<l1@x>", "loop@x.com"),
+		ooo("<l2@x>", "loop@x.com"),
+	}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	replies, err := autoreply.New(autoreply.ActionApprove, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("new policy: %v", err)
+	}
+	p.SetAutoReplies(replies)
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	approved, _ := st.ListApproved(t.Context(), "", "")
+	if len(approved) != 2 || approved[0].ApprovedBy != autoreply.Reviewer || approved[1].ApprovedBy != autoreply.Reviewer {
+		t.Errorf("approved = %+v, want the first auto-reply of each sender approved by the policy", approved)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 2 || pending[0].Sender != "person@x.com" || len(pending[0].Tags) != 0 {
+		t.Fatalf("pending = %+v, want the person's email held untagged and the loop held", pending)
+	}
+	if got := strings.Join(pending[1].Tags, ","); pending[1].IMAPMessageID != "<l2@x>" || got != autoreply.Tag+","+autoreply.LoopTag {
+		t.Errorf("held auto-reply %s tagged %q, want <l2@x> tagged as a loop", pending[1].IMAPMessageID, got)
+	}
+
+	if err := replies.SetAction(autoreply.ActionArchive); err != nil {
+		t.Fatalf("set action: %v", err)
+	}
+	f.fetched = []imap.FetchedEmail{ooo("<a2@x>", "other@x.com")}
+	f.moved = nil
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if len(f.moved) != 1 || f.moved[0] != "<a2@x>:"+imap.FolderRejected {
+		t.Errorf("moved = %v, want the auto-reply moved to rejected", f.moved)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	if len(decisions) == 0 || decisions[0].Decision != store.DecisionRejected || decisions[0].Reviewer != autoreply.Reviewer {
+		t.Errorf("decisions = %+v, want the auto-reply archived by the policy", decisions)
+	}
+}
+
+func TestHoldsTrustedSenderWithInvalidSignature(t *testing.T) {
+	raw := []byte("From: friend@x.com\r\n" +
+		`Content-Type: multipart/signed; protocol="application/pkcs7-signature"; boundary="b"` + "\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nPay me\r\n" +
+		"--b\r\nContent-Type: application/pkcs7-signature\r\n\r\nnot a signature\r\n" +
+		"--b--\r\n")
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{
+		{MessageID: "<spoof@x>", Sender: "friend@x.com", Recipients: []string{"me@x.com"}, Subject: "Pay", Body: "Pay me", RawMessage: raw},
+	}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	book := contacts.New(st, 1)
+	_ = book.Learn(t.Context(), &store.Email{Direction: store.DirectionInbound, Sender: "friend@x.com"})
+	p.SetContacts(book)
+	v, _ := signature.New("", "")
+	p.SetVerifier(v)
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 {
+		t.Fatalf("pending = %d, want the email held despite the trusted sender", len(pending))
+	}
+	if sig := pending[0].Signature; sig == nil || sig.Protocol != store.SignatureSMIME || sig.Status != store.SignatureInvalid {
+		t.Errorf("signature = %+v, want invalid smime", sig)
+	}
+}
+
+func TestRecordsDeliveryStatusNotifications(t *testing.T) {
+	raw := []byte("From: MAILER-DAEMON@relay.x.com\r\n" +
+		"Subject: Undeliverable\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/delivery-status\r\n" +
+		"\r\n" +
+		"Original-Envelope-Id: env-1\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822;bob@x.com\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"--b--\r\n")
+	f := &fakeFetcher{fetched: []imap.FetchedEmail{{MessageID: "<dsn@x>", Sender: "MAILER-DAEMON@relay.x.com", Recipients: []string{"me@x.com"}, Subject: "Undeliverable", RawMessage: raw}}}
+	p, st := newTestPoller(t, f, nil, Options{})
+	list, err := suppression.New(st, suppression.ActionHold)
+	if err != nil {
+		t.Fatalf("new suppression list: %v", err)
+	}
+	p.SetSuppression(list)
+	if err := st.RecordDecision(t.Context(), store.Decision{
+		EmailID: "e1", Direction: store.DirectionOutbound, Decision: store.DecisionApproved, Reviewer: "alice", EnvelopeID: "env-1",
+	}); err != nil {
+		t.Fatalf("record decision: %v", err)
+	}
+
+	if err := p.Poll(t.Context()); err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	if len(decisions) != 1 || decisions[0].DeliveryStatus != store.DeliveryFailed || decisions[0].DeliveryDetail != "bob@x.com failed (5.1.1)" {
+		t.Errorf("decisions = %+v, want delivery failed for bob@x.com", decisions)
+	}
+	if got, _ := st.Suppressed(t.Context(), []string{"bob@x.com"}); len(got) != 1 || got[0].Reason != store.SuppressionBounced {
+		t.Errorf("suppressed = %+v, want bob@x.com as bounced", got)
+	}
+	if pending, _ := st.ListPending(t.Context()); len(pending) != 1 {
+		t.Errorf("pending = %d, want the notification held for review", len(pending))
+	}
+}
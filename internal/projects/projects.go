@@ -0,0 +1,191 @@
+// Package projects caps how much mail each project may keep in the store, so
+// that one noisy tenant cannot fill a shared instance. A project is the tag
+// an SMTP user's held submissions, an API token's, or the internal
+// listener's, carry.
+package projects
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// The limits a project can exceed.
+const (
+	LimitMessageSize = "message_size"
+	LimitPending     = "pending"
+	LimitStorage     = "storage"
+)
+
+// Limit caps one project. Zero fields are no limit.
+type Limit struct {
+	Project         string
+	MaxPending      int   // emails pending review
+	MaxStorageBytes int64 // raw messages held, in any status
+	MaxMessageBytes int64 // each submitted message
+}
+
+// Limits checks submissions against the limits of their project.
+type Limits struct {
+	st store.Reader
+
+	mu       sync.Mutex
+	limits   map[string]Limit
+	notifier notify.Notifier // may be nil; exceeded limits are then only logged
+	exceeded map[string]bool // project and limit notified on, until a check passes
+}
+
+// New creates Limits. notifier may be nil.
+func New(st store.Reader, limits []Limit, notifier notify.Notifier) (*Limits, error) {
+	l := &Limits{st: st, notifier: notifier, exceeded: make(map[string]bool)}
+	if err := l.SetLimits(limits); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetLimits replaces the limits, e.g. on a configuration reload.
+func (l *Limits) SetLimits(limits []Limit) error {
+	byProject := make(map[string]Limit, len(limits))
+	for _, lim := range limits {
+		project, err := store.NormalizeTag(lim.Project)
+		if err != nil {
+			return fmt.Errorf("project %q: %w", lim.Project, err)
+		}
+		if _, dup := byProject[project]; dup {
+			return fmt.Errorf("project %q is limited twice", project)
+		}
+		if lim.MaxPending < 0 || lim.MaxStorageBytes < 0 || lim.MaxMessageBytes < 0 {
+			return fmt.Errorf("project %q: limits cannot be negative", project)
+		}
+		lim.Project = project
+		byProject[project] = lim
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = byProject
+	return nil
+}
+
+// SetNotifier replaces where exceeded limits are sent, e.g. on a
+// configuration reload. n may be nil.
+func (l *Limits) SetNotifier(n notify.Notifier) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notifier = n
+}
+
+// Result describes a submission checked against its project's limits.
+type Result struct {
+	Exceeded string // the limit exceeded, e.g. LimitPending; empty if none
+	Limit    int64
+}
+
+// Message returns the reason a submission exceeding r is refused.
+func (r Result) Message(project string) string {
+	switch r.Exceeded {
+	case LimitMessageSize:
+		return fmt.Sprintf("message larger than project %s allows (%d bytes)", project, r.Limit)
+	case LimitPending:
+		return fmt.Sprintf("project %s has too many emails pending review (%d)", project, r.Limit)
+	case LimitStorage:
+		return fmt.Sprintf("project %s is over its storage limit (%d MB)", project, r.Limit>>20)
+	}
+	return ""
+}
+
+// CheckSize checks a message of size bytes against the project's message
+// size limit. A nil Limits never limits.
+func (l *Limits) CheckSize(ctx context.Context, project string, size int) Result {
+	lim, ok := l.limit(project)
+	if !ok {
+		return Result{}
+	}
+	var res Result
+	if lim.MaxMessageBytes > 0 && int64(size) > lim.MaxMessageBytes {
+		res = Result{Exceeded: LimitMessageSize, Limit: lim.MaxMessageBytes}
+	}
+	l.report(ctx, project, LimitMessageSize, res)
+	if res.Exceeded != "" {
+		metrics.ProjectLimitExceeded.Inc(res.Exceeded)
+	}
+	return res
+}
+
+// Check checks whether the project may have one more email held for review.
+// A nil Limits never limits.
+func (l *Limits) Check(ctx context.Context, project string) (Result, error) {
+	return l.CheckWith(ctx, project, store.TagUsage{})
+}
+
+// CheckWith is Check for an email to be held along with emails of the
+// project that are not stored yet, such as the earlier ones of a batch.
+// unsaved is their usage.
+func (l *Limits) CheckWith(ctx context.Context, project string, unsaved store.TagUsage) (Result, error) {
+	lim, ok := l.limit(project)
+	if !ok || (lim.MaxPending <= 0 && lim.MaxStorageBytes <= 0) {
+		return Result{}, nil
+	}
+	u, err := l.st.TagUsage(ctx, lim.Project)
+	if err != nil {
+		return Result{}, fmt.Errorf("check project %s usage: %w", lim.Project, err)
+	}
+	u.Pending += unsaved.Pending
+	u.Bytes += unsaved.Bytes
+	pending, storage := Result{}, Result{}
+	if lim.MaxPending > 0 && u.Pending >= lim.MaxPending {
+		pending = Result{Exceeded: LimitPending, Limit: int64(lim.MaxPending)}
+	}
+	if lim.MaxStorageBytes > 0 && u.Bytes >= lim.MaxStorageBytes {
+		storage = Result{Exceeded: LimitStorage, Limit: lim.MaxStorageBytes}
+	}
+	l.report(ctx, project, LimitPending, pending)
+	l.report(ctx, project, LimitStorage, storage)
+	res := storage
+	if pending.Exceeded != "" {
+		res = pending
+	}
+	if res.Exceeded != "" {
+		metrics.ProjectLimitExceeded.Inc(res.Exceeded)
+	}
+	return res, nil
+}
+
+func (l *Limits) limit(project string) (Limit, bool) {
+	if l == nil || project == "" {
+		return Limit{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim, ok := l.limits[project]
+	return lim, ok
+}
+
+// report notifies when res exceeded limit for the first time since a check
+// of it last passed.
+func (l *Limits) report(ctx context.Context, project, limit string, res Result) {
+	key := project + "/" + limit
+	l.mu.Lock()
+	notifier, first := l.notifier, !l.exceeded[key]
+	if res.Exceeded == "" {
+		delete(l.exceeded, key)
+	} else {
+		l.exceeded[key] = true
+	}
+	l.mu.Unlock()
+	if res.Exceeded == "" || !first || notifier == nil {
+		return
+	}
+	if err := notifier.Notify(ctx, notify.Event{
+		Type:    notify.EventProjectLimit,
+		Message: res.Message(project),
+		Tags:    []string{project},
+	}); err != nil {
+		log.Printf("project limit notify for %s: %v", project, err)
+	}
+}
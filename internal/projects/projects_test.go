@@ -0,0 +1,89 @@
+package projects
+
+import (
+	"context"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type recordingNotifier struct {
+	events []notify.Event
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, e notify.Event) error {
+	n.events = append(n.events, e)
+	return nil
+}
+
+func TestCheck(t *testing.T) {
+	st := store.NewMemory()
+	n := &recordingNotifier{}
+	l, err := New(st, []Limit{{Project: "Billing", MaxPending: 2, MaxStorageBytes: 10, MaxMessageBytes: 100}}, n)
+	if err != nil {
+		t.Fatalf("new limits: %v", err)
+	}
+	hold := func(raw string) string {
+		t.Helper()
+		id, err := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "S", "B", []byte(raw))
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if err := st.AddTag(t.Context(), id, "billing"); err != nil {
+			t.Fatalf("add tag: %v", err)
+		}
+		return id
+	}
+
+	if res := l.CheckSize(t.Context(), "billing", 101); res.Exceeded != LimitMessageSize || res.Limit != 100 {
+		t.Errorf("check size = %+v, want the message size limit exceeded", res)
+	}
+	if res := l.CheckSize(t.Context(), "other", 101); res.Exceeded != "" {
+		t.Errorf("check size of an unlimited project = %+v", res)
+	}
+
+	first := hold("12345")
+	if res, err := l.Check(t.Context(), "billing"); err != nil || res.Exceeded != "" {
+		t.Errorf("check with one pending = %+v, %v; want within limits", res, err)
+	}
+	if res, _ := l.CheckWith(t.Context(), "billing", store.TagUsage{Pending: 1}); res.Exceeded != LimitPending {
+		t.Errorf("check with one pending and one unsaved = %+v, want the pending limit exceeded", res)
+	}
+	second := hold("12")
+	for range 2 {
+		if res, _ := l.Check(t.Context(), "billing"); res.Exceeded != LimitPending {
+			t.Errorf("check with two pending = %+v, want the pending limit exceeded", res)
+		}
+	}
+	// Approved mail no longer counts as pending, but still takes space.
+	_ = st.Approve(t.Context(), first, "alice", 0)
+	_ = st.Approve(t.Context(), second, "alice", 0)
+	hold("345")
+	if res, _ := l.Check(t.Context(), "billing"); res.Exceeded != LimitStorage {
+		t.Errorf("check with 10 bytes held = %+v, want the storage limit exceeded", res)
+	}
+
+	if len(n.events) != 3 {
+		t.Errorf("notified %+v, want once for each limit exceeded", n.events)
+	}
+	for _, e := range n.events {
+		if e.Type != notify.EventProjectLimit || len(e.Tags) != 1 || e.Tags[0] != "billing" {
+			t.Errorf("event = %+v, want a project limit event tagged billing", e)
+		}
+	}
+
+	var none *Limits
+	if res, err := none.Check(t.Context(), "billing"); err != nil || res.Exceeded != "" {
+		t.Errorf("nil limits check = %+v, %v; want no limit", res, err)
+	}
+	for name, limits := range map[string][]Limit{
+		"bad name":  {{Project: "no spaces"}},
+		"duplicate": {{Project: "billing"}, {Project: "Billing"}},
+		"negative":  {{Project: "billing", MaxPending: -1}},
+	} {
+		if err := l.SetLimits(limits); err == nil {
+			t.Errorf("%s: SetLimits succeeded", name)
+		}
+	}
+}
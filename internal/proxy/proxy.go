@@ -0,0 +1,134 @@
+// Package proxy dials the relay and the IMAP server through an outbound
+// proxy (network.proxy_url), for networks whose egress must go through a
+// corporate proxy or an SSH tunnel. SOCKS5 and HTTP CONNECT proxies are
+// supported; an SSH tunnel opened with ssh -D is a SOCKS5 proxy.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// Dialer opens connections. *net.Dialer is one; so is what New returns.
+// Connecting through a proxy is bounded by the context, not by a timeout of
+// the dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// New returns a Dialer connecting through the proxy at rawURL:
+// "socks5://host:port" (or "socks5h://", the same: names are always resolved
+// by the proxy) or "http://host:port" for a proxy supporting CONNECT. A user
+// and password in the URL authenticate to the proxy.
+func New(rawURL string) (Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err // leave out the URL, which may hold a password
+		}
+		return nil, fmt.Errorf("proxy url: %w", err)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy url %q: want scheme://host:port", u.Redacted())
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *xproxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &xproxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := xproxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{})
+		if err != nil {
+			return nil, fmt.Errorf("proxy url %q: %w", u.Redacted(), err)
+		}
+		return d.(Dialer), nil // SOCKS5 returns a ContextDialer
+	case "http":
+		d := &httpDialer{addr: u.Host}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("proxy url %q: scheme must be socks5 or http", u.Redacted())
+	}
+}
+
+// httpDialer tunnels connections through an HTTP proxy with CONNECT.
+type httpDialer struct {
+	addr string // host:port of the proxy
+	auth string // Proxy-Authorization header; empty for none
+}
+
+func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy: %w", err)
+	}
+	// Cancelling ctx during the CONNECT expires the connection, failing
+	// whatever call is blocked on it.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	br, err := d.connect(conn, addr)
+	if !stop() && err == nil {
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// The server spoke first (SMTP and IMAP both greet), and the greeting
+		// came with the proxy's reply.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect asks the proxy on conn for a tunnel to addr, returning the reader
+// the proxy's reply was read with.
+func (d *httpDialer) connect(conn net.Conn, addr string) (*bufio.Reader, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("proxy connect: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("proxy connect: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused the connection to %s: %s", addr, resp.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// listen serves each connection to a new listener with handle.
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// connectProxy is an HTTP proxy tunneling CONNECT requests carrying auth,
+// answering others with 407.
+func connectProxy(t *testing.T, auth string) string {
+	return listen(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer target.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(target, br) }()
+		_, _ = io.Copy(conn, target)
+	})
+}
+
+func TestHTTPProxy(t *testing.T) {
+	// The server greets first, as SMTP and IMAP servers do, then echoes.
+	server := listen(t, func(conn net.Conn) {
+		_, _ = io.WriteString(conn, "220 hello\r\n")
+		_, _ = io.Copy(conn, conn)
+	})
+	proxyAddr := connectProxy(t, "Basic dXNlcjpzM2NyZXQ=") // user:s3cret
+
+	d, err := New("http://user:s3cret@" + proxyAddr)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	conn, err := d.DialContext(t.Context(), "tcp", server)
+	if err != nil {
+		t.Fatalf("dial through proxy: %v", err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if line, err := br.ReadString('\n'); err != nil || line != "220 hello\r\n" {
+		t.Fatalf("greeting = %q, %v", line, err)
+	}
+	_, _ = io.WriteString(conn, "EHLO me\r\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "EHLO me\r\n" {
+		t.Errorf("echo = %q, %v", line, err)
+	}
+
+	d, _ = New("http://" + proxyAddr)
+	if _, err := d.DialContext(t.Context(), "tcp", server); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("dial without credentials: %v, want the proxy's 407", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, u := range []string{"socks5://127.0.0.1:1080", "socks5h://user:pw@proxy.internal:1080", "http://proxy.internal:3128"} {
+		if _, err := New(u); err != nil {
+			t.Errorf("New(%q): %v", u, err)
+		}
+	}
+	for _, u := range []string{"proxy.internal:3128", "http://proxy.internal", "ftp://proxy.internal:21", "https://proxy.internal:443", "http://user:pw@%zz"} {
+		if _, err := New(u); err == nil {
+			t.Errorf("New(%q) succeeded, want an error", u)
+		} else if strings.Contains(err.Error(), "pw") {
+			t.Errorf("New(%q) error %q shows the password", u, err)
+		}
+	}
+}
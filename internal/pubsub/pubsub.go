@@ -0,0 +1,40 @@
+// Package pubsub wakes goroutines waiting for an event, such as long-polling
+// API requests waiting for inbound mail to be approved.
+package pubsub
+
+import "sync"
+
+// Topic broadcasts that something happened to every current waiter. Events
+// carry no payload; waiters re-check the state they are interested in.
+type Topic struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// New creates a Topic.
+func New() *Topic {
+	return &Topic{ch: make(chan struct{})}
+}
+
+// Wait returns a channel that is closed by the next Publish. Take it before
+// checking state so an event published in between is not missed. A nil
+// Topic never publishes.
+func (t *Topic) Wait() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ch
+}
+
+// Publish wakes every goroutine waiting on the topic.
+func (t *Topic) Publish() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	close(t.ch)
+	t.ch = make(chan struct{})
+}
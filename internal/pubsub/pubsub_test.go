@@ -0,0 +1,40 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishWakesWaiters(t *testing.T) {
+	topic := New()
+	first, second := topic.Wait(), topic.Wait()
+	select {
+	case <-first:
+		t.Fatal("woken before Publish")
+	default:
+	}
+
+	topic.Publish()
+	for _, ch := range []<-chan struct{}{first, second} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("waiter not woken by Publish")
+		}
+	}
+
+	// Waiters that arrive after a Publish wait for the next one.
+	select {
+	case <-topic.Wait():
+		t.Error("new waiter woken by an earlier Publish")
+	default:
+	}
+}
+
+func TestNilTopic(t *testing.T) {
+	var topic *Topic
+	topic.Publish()
+	if topic.Wait() != nil {
+		t.Error("nil topic returned a channel")
+	}
+}
@@ -0,0 +1,219 @@
+// Package quota limits how many emails each sender, or each API token, may
+// submit per hour and per day. Counters live in the store so they survive
+// restarts.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// What happens to a submission made while its sender is over quota.
+const (
+	ActionHold   = "hold"   // keep it for review, flagged quota_exceeded
+	ActionRefuse = "refuse" // reject the submission
+)
+
+// Limiter counts submissions per key, a sender address or an API token (see
+// TokenKey), in fixed UTC hour and day windows.
+type Limiter struct {
+	st  store.ReadWriter
+	now func() time.Time
+
+	mu     sync.Mutex
+	limits limits
+}
+
+type limits struct {
+	perHour int // 0 means unlimited
+	perDay  int // 0 means unlimited
+	action  string
+}
+
+// New creates a Limiter. An empty action defaults to ActionHold.
+func New(st store.ReadWriter, perHour, perDay int, action string) (*Limiter, error) {
+	l := &Limiter{st: st, now: time.Now}
+	if err := l.SetLimits(perHour, perDay, action); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetLimits replaces the limits and action, e.g. on a configuration reload.
+// Counts already taken in the current windows are kept.
+func (l *Limiter) SetLimits(perHour, perDay int, action string) error {
+	switch action {
+	case "":
+		action = ActionHold
+	case ActionHold, ActionRefuse:
+	default:
+		return fmt.Errorf("unknown quota action %q", action)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits{perHour: perHour, perDay: perDay, action: action}
+	return nil
+}
+
+// Enabled reports whether any limit is set. A nil Limiter is not enabled.
+func (l *Limiter) Enabled() bool {
+	if l == nil {
+		return false
+	}
+	lim := l.current()
+	return lim.perHour > 0 || lim.perDay > 0
+}
+
+func (l *Limiter) current() limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// TokenKey is the key submissions made with the API token id are counted
+// under.
+func TokenKey(id string) string {
+	return "token:" + id
+}
+
+// Result describes a submission checked against the quota.
+type Result struct {
+	Exceeded bool
+	Refuse   bool   // Exceeded and the configured action is to refuse
+	Period   string // window that was exceeded: "hour" or "day"
+	Limit    int
+
+	key   string
+	taken []window // counters the submission was added to; see Release
+}
+
+// window is one counter of a key.
+type window struct {
+	period string
+	start  time.Time
+}
+
+// Take records one submission under key, a sender address or a TokenKey,
+// and reports whether it exceeded the quota. A submission refused for being
+// over quota is not counted. A nil Limiter never limits.
+func (l *Limiter) Take(ctx context.Context, key string) (Result, error) {
+	if !l.Enabled() {
+		return Result{}, nil
+	}
+	lim := l.current()
+	key = strings.ToLower(key)
+	hour, day := l.windows()
+
+	if err := l.st.PruneQuota(ctx, day); err != nil {
+		return Result{}, err
+	}
+
+	res := Result{key: key}
+	for _, w := range []struct {
+		period string
+		start  time.Time
+		limit  int
+	}{
+		{store.QuotaPeriodHour, hour, lim.perHour},
+		{store.QuotaPeriodDay, day, lim.perDay},
+	} {
+		if w.limit <= 0 {
+			continue
+		}
+		n, err := l.st.IncrementQuota(ctx, key, w.period, w.start)
+		if err != nil {
+			_ = l.Release(ctx, res)
+			return Result{}, err
+		}
+		res.taken = append(res.taken, window{w.period, w.start})
+		if n > w.limit && !res.Exceeded {
+			res.Exceeded, res.Refuse, res.Period, res.Limit = true, lim.action == ActionRefuse, w.period, w.limit
+		}
+	}
+	if res.Exceeded {
+		metrics.QuotaExceeded.Inc(lim.action)
+	}
+	if res.Refuse {
+		if err := l.Release(ctx, res); err != nil {
+			return Result{}, err
+		}
+		res.taken = nil
+	}
+	return res, nil
+}
+
+// Release takes back a submission Take counted, for callers that go on to
+// refuse it, so only accepted submissions use up the quota. A nil Limiter
+// does nothing.
+func (l *Limiter) Release(ctx context.Context, res Result) error {
+	if l == nil {
+		return nil
+	}
+	for _, w := range res.taken {
+		if err := l.st.DecrementQuota(ctx, res.key, w.period, w.start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage is a sender's or an API token's submission count in the current
+// windows.
+type Usage struct {
+	Sender    string // the key counted under: an address, or a TokenKey
+	HourCount int
+	HourLimit int
+	DayCount  int
+	DayLimit  int
+}
+
+// Usage returns current-window counts for every sender that has submitted
+// mail today, ordered by sender. A nil Limiter returns nothing.
+func (l *Limiter) Usage(ctx context.Context) ([]Usage, error) {
+	if l == nil {
+		return nil, nil
+	}
+	lim := l.current()
+	hour, day := l.windows()
+	counters, err := l.st.ListQuotaUsage(ctx, day)
+	if err != nil {
+		return nil, err
+	}
+
+	bySender := make(map[string]*Usage)
+	for _, c := range counters {
+		u, ok := bySender[c.Sender]
+		if !ok {
+			u = &Usage{Sender: c.Sender, HourLimit: lim.perHour, DayLimit: lim.perDay}
+			bySender[c.Sender] = u
+		}
+		switch {
+		case c.Period == store.QuotaPeriodHour && c.WindowStart.Equal(hour):
+			u.HourCount = c.Count
+		case c.Period == store.QuotaPeriodDay && c.WindowStart.Equal(day):
+			u.DayCount = c.Count
+		}
+	}
+
+	usage := make([]Usage, 0, len(bySender))
+	for _, u := range bySender {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Sender < usage[j].Sender })
+	return usage, nil
+}
+
+// windows returns the start of the current UTC hour and day.
+func (l *Limiter) windows() (hour, day time.Time) {
+	now := l.now().UTC()
+	hour = now.Truncate(time.Hour)
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return hour, day
+}
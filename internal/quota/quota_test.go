@@ -0,0 +1,148 @@
+package quota
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestTakeHourlyLimit(t *testing.T) {
+	l, err := New(newTestStore(t), 2, 0, ActionRefuse)
+	if err != nil {
+		t.Fatalf("new limiter: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	for i := range 2 {
+		res, err := l.Take(t.Context(), "App@Example.com")
+		if err != nil {
+			t.Fatalf("take: %v", err)
+		}
+		if res.Exceeded {
+			t.Fatalf("submission %d exceeded quota of 2", i+1)
+		}
+	}
+	res, err := l.Take(t.Context(), "app@example.com")
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	if !res.Exceeded || !res.Refuse || res.Period != store.QuotaPeriodHour || res.Limit != 2 {
+		t.Errorf("third submission = %+v, want refused hourly quota of 2", res)
+	}
+
+	// The next hour starts a fresh window.
+	now = now.Add(time.Hour)
+	if res, _ := l.Take(t.Context(), "app@example.com"); res.Exceeded {
+		t.Errorf("new hour = %+v, want within quota", res)
+	}
+}
+
+func TestTakeDailyLimitHolds(t *testing.T) {
+	l, _ := New(newTestStore(t), 0, 1, "")
+	if res, _ := l.Take(t.Context(), "a@x.com"); res.Exceeded {
+		t.Fatalf("first = %+v, want within quota", res)
+	}
+	res, _ := l.Take(t.Context(), "a@x.com")
+	if !res.Exceeded || res.Refuse || res.Period != store.QuotaPeriodDay {
+		t.Errorf("second = %+v, want held over daily quota", res)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	l, _ := New(newTestStore(t), 1, 0, ActionRefuse)
+	res, _ := l.Take(t.Context(), TokenKey("ci"))
+	if res.Exceeded {
+		t.Fatalf("first = %+v, want within quota", res)
+	}
+	if err := l.Release(t.Context(), res); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if res, _ := l.Take(t.Context(), TokenKey("ci")); res.Exceeded {
+		t.Errorf("after release = %+v, want within quota", res)
+	}
+	if res, _ := l.Take(t.Context(), TokenKey("ci")); !res.Refuse {
+		t.Errorf("over quota = %+v, want refused", res)
+	}
+	// The refused submission was not counted.
+	usage, _ := l.Usage(t.Context())
+	if len(usage) != 1 || usage[0].HourCount != 1 {
+		t.Errorf("usage = %+v, want 1", usage)
+	}
+	if err := (*Limiter)(nil).Release(t.Context(), res); err != nil {
+		t.Errorf("nil limiter release: %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	l, _ := New(newTestStore(t), 10, 100, ActionHold)
+	now := time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	_, _ = l.Take(t.Context(), "b@x.com")
+	_, _ = l.Take(t.Context(), "a@x.com")
+	now = now.Add(time.Hour)
+	_, _ = l.Take(t.Context(), "a@x.com")
+
+	usage, err := l.Usage(t.Context())
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	want := []Usage{
+		{Sender: "a@x.com", HourCount: 1, HourLimit: 10, DayCount: 2, DayLimit: 100},
+		{Sender: "b@x.com", HourCount: 0, HourLimit: 10, DayCount: 1, DayLimit: 100},
+	}
+	if len(usage) != len(want) || usage[0] != want[0] || usage[1] != want[1] {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if res, err := l.Take(t.Context(), "a@x.com"); err != nil || res.Exceeded {
+		t.Errorf("nil Take = %+v, %v", res, err)
+	}
+	if _, err := New(nil, 1, 1, "explode"); err == nil {
+		t.Error("expected error for unknown action")
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	l, _ := New(newTestStore(t), 0, 0, "")
+	if l.Enabled() {
+		t.Error("limiter without limits reports enabled")
+	}
+	if res, _ := l.Take(t.Context(), "a@x.com"); res.Exceeded {
+		t.Fatalf("unlimited = %+v, want within quota", res)
+	}
+
+	if err := l.SetLimits(1, 0, ActionRefuse); err != nil {
+		t.Fatalf("set limits: %v", err)
+	}
+	if !l.Enabled() {
+		t.Error("limiter with an hourly limit reports disabled")
+	}
+	_, _ = l.Take(t.Context(), "a@x.com")
+	if res, _ := l.Take(t.Context(), "a@x.com"); !res.Exceeded || !res.Refuse {
+		t.Errorf("second = %+v, want refused under the new limit", res)
+	}
+
+	if err := l.SetLimits(5, 5, "explode"); err == nil {
+		t.Error("expected error for unknown action")
+	}
+	if res, _ := l.Take(t.Context(), "b@x.com"); res.Limit != 0 || res.Exceeded {
+		t.Errorf("after failed SetLimits = %+v, want the previous limits kept", res)
+	}
+}
@@ -0,0 +1,220 @@
+// Package recipients checks recipient addresses when mail is submitted, so
+// clearly undeliverable mail is refused up front instead of failing at relay
+// time.
+package recipients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Limits from RFC 5321 section 4.5.3.1.
+const (
+	maxLocalPart = 64
+	maxDomain    = 255
+	maxLabel     = 63
+	maxPath      = 254 // 256-octet path minus the angle brackets
+)
+
+// DefaultTimeout bounds the DNS lookups for one address.
+const DefaultTimeout = 5 * time.Second
+
+// Problem explains why an address was refused.
+type Problem struct {
+	Address string
+	Reason  string
+	Syntax  bool // the address is malformed, rather than its domain not accepting mail
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Address, p.Reason)
+}
+
+// Resolver looks up mail exchangers. *net.Resolver implements it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Validator checks recipient syntax and, optionally, that the recipient's
+// domain accepts mail.
+type Validator struct {
+	checkMX  bool
+	resolver Resolver
+	timeout  time.Duration
+}
+
+// New creates a Validator. If checkMX is true, recipient domains must have
+// an MX record, or an address record to fall back on, and no null MX.
+func New(checkMX bool) *Validator {
+	return &Validator{checkMX: checkMX, resolver: net.DefaultResolver, timeout: DefaultTimeout}
+}
+
+// Check returns why addr cannot receive mail, or nil if it looks deliverable.
+// DNS failures other than a missing domain never refuse an address. A nil
+// Validator checks syntax only.
+func (v *Validator) Check(ctx context.Context, addr string) *Problem {
+	domain, err := Parse(addr)
+	if err != nil {
+		return &Problem{Address: addr, Reason: err.Error(), Syntax: true}
+	}
+	if v == nil || !v.checkMX || strings.HasPrefix(domain, "[") {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+
+	mxs, err := v.resolver.LookupMX(ctx, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && strings.TrimSuffix(mxs[0].Host, ".") == "" {
+			return &Problem{Address: addr, Reason: fmt.Sprintf("domain %s does not accept mail (null MX)", domain)}
+		}
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		log.Printf("MX lookup for %s: %v", domain, err)
+		return nil
+	}
+	// No MX records: RFC 5321 falls back to the domain's own address.
+	if _, err := v.resolver.LookupHost(ctx, domain); err != nil {
+		if isNotFound(err) {
+			return &Problem{Address: addr, Reason: fmt.Sprintf("domain %s has no mail server", domain)}
+		}
+		log.Printf("host lookup for %s: %v", domain, err)
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// Parse checks that addr is an RFC 5321 mailbox (local-part@domain, without
+// display name or angle brackets) and returns its domain. UTF-8 is allowed
+// in the local part and domain as in RFC 6531.
+func Parse(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("empty address")
+	}
+	if len(addr) > maxPath {
+		return "", fmt.Errorf("address longer than %d characters", maxPath)
+	}
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return "", errors.New("missing @")
+	}
+	local, domain := addr[:at], addr[at+1:]
+	if err := checkLocalPart(local); err != nil {
+		return "", err
+	}
+	if err := checkDomain(domain); err != nil {
+		return "", err
+	}
+	return domain, nil
+}
+
+func checkLocalPart(local string) error {
+	switch {
+	case local == "":
+		return errors.New("missing local part before @")
+	case len(local) > maxLocalPart:
+		return fmt.Errorf("local part longer than %d characters", maxLocalPart)
+	}
+	if strings.HasPrefix(local, `"`) {
+		return checkQuotedString(local)
+	}
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return errors.New("local part has an empty dot-separated segment")
+		}
+		for _, c := range atom {
+			if !isAtext(c) {
+				return fmt.Errorf("local part contains %q; quote it or remove it", c)
+			}
+		}
+	}
+	return nil
+}
+
+func checkQuotedString(s string) error {
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return errors.New("unterminated quoted local part")
+	}
+	inner := s[1 : len(s)-1]
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case c == '\\':
+			i++
+			if i == len(inner) || inner[i] < ' ' || inner[i] > '~' {
+				return errors.New("invalid escape in quoted local part")
+			}
+		case c == '"':
+			return errors.New("unescaped quote in quoted local part")
+		case c < ' ' || c == 0x7f:
+			return errors.New("control character in quoted local part")
+		}
+	}
+	return nil
+}
+
+// isAtext reports whether c may appear in an unquoted local-part atom.
+func isAtext(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c >= 0x80 && c != 0xfffd:
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", c)
+}
+
+func checkDomain(domain string) error {
+	switch {
+	case domain == "":
+		return errors.New("missing domain after @")
+	case len(domain) > maxDomain:
+		return fmt.Errorf("domain longer than %d characters", maxDomain)
+	}
+	if strings.HasPrefix(domain, "[") {
+		return checkAddressLiteral(domain)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		switch {
+		case label == "":
+			return fmt.Errorf("domain %s has an empty label", domain)
+		case len(label) > maxLabel:
+			return fmt.Errorf("domain label %s longer than %d characters", label, maxLabel)
+		case strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-"):
+			return fmt.Errorf("domain label %s starts or ends with a hyphen", label)
+		}
+		for _, c := range label {
+			if !(c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80 && c != 0xfffd) {
+				return fmt.Errorf("domain %s contains %q", domain, c)
+			}
+		}
+	}
+	return nil
+}
+
+func checkAddressLiteral(domain string) error {
+	literal, ok := strings.CutSuffix(domain[1:], "]")
+	if !ok {
+		return errors.New("unterminated address literal")
+	}
+	if v6, ok := strings.CutPrefix(literal, "IPv6:"); ok {
+		if ip, err := netip.ParseAddr(v6); err == nil && ip.Is6() {
+			return nil
+		}
+	} else if ip, err := netip.ParseAddr(literal); err == nil && ip.Is4() {
+		return nil
+	}
+	return fmt.Errorf("invalid address literal %s", domain)
+}
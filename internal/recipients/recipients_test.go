@@ -0,0 +1,129 @@
+package recipients
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{
+		"bob@example.com",
+		"first.last+tag@mail.example.co.uk",
+		`"john doe"@example.com`,
+		`"quote\"d"@example.com`,
+		"o'brien@example.com",
+		"user@[192.0.2.1]",
+		"user@[IPv6:2001:db8::1]",
+		"josé@bücher.example",
+		"ops@localhost",
+	}
+	for _, addr := range valid {
+		if _, err := Parse(addr); err != nil {
+			t.Errorf("Parse(%q): %v", addr, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"":                                 "empty",
+		"bob":                              "missing @",
+		"@example.com":                     "missing local part",
+		"bob@":                             "missing domain",
+		"Bob <bob@example.com>":            "contains",
+		"bob..smith@example.com":           "empty dot-separated",
+		".bob@example.com":                 "empty dot-separated",
+		"bob smith@example.com":            "contains",
+		`"bob@example.com`:                 "unterminated",
+		"bob@exa mple.com":                 "contains",
+		"bob@example..com":                 "empty label",
+		"bob@-example.com":                 "hyphen",
+		"bob@example.com.":                 "empty label",
+		"bob@[300.1.1.1]":                  "address literal",
+		"bob@[192.0.2.1":                   "unterminated",
+		strings.Repeat("a", 65) + "@x.com": "local part longer",
+		"bob@" + strings.Repeat("a", 64) + ".com": "label",
+	}
+	for addr, want := range invalid {
+		if _, err := Parse(addr); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q) = %v, want error containing %q", addr, err, want)
+		}
+	}
+}
+
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string]bool
+	err   error // returned by every lookup when set
+}
+
+func (f fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if mx, ok := f.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.hosts[host] {
+		return []string{"192.0.2.1"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestCheckMX(t *testing.T) {
+	v := New(true)
+	v.resolver = fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com":    {{Host: "mx.example.com.", Pref: 10}},
+			"nomail.example": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string]bool{"a-only.example": true},
+	}
+
+	tests := []struct {
+		addr   string
+		reason string // empty when the address is accepted
+	}{
+		{"bob@example.com", ""},
+		{"bob@a-only.example", ""},
+		{"bob@[192.0.2.1]", ""},
+		{"bob@nomail.example", "null MX"},
+		{"bob@missing.example", "no mail server"},
+		{"bob@", "missing domain"},
+	}
+	for _, tt := range tests {
+		p := v.Check(t.Context(), tt.addr)
+		switch {
+		case tt.reason == "" && p != nil:
+			t.Errorf("Check(%q) = %v, want accepted", tt.addr, p)
+		case tt.reason != "" && (p == nil || !strings.Contains(p.Reason, tt.reason)):
+			t.Errorf("Check(%q) = %v, want reason containing %q", tt.addr, p, tt.reason)
+		}
+	}
+}
+
+func TestCheckToleratesDNSFailures(t *testing.T) {
+	v := New(true)
+	v.resolver = fakeResolver{err: errors.New("i/o timeout")}
+	if p := v.Check(t.Context(), "bob@example.com"); p != nil {
+		t.Errorf("Check with failing DNS = %v, want accepted", p)
+	}
+}
+
+func TestNilValidatorChecksSyntaxOnly(t *testing.T) {
+	var v *Validator
+	if p := v.Check(t.Context(), "bob@missing.invalid"); p != nil {
+		t.Errorf("Check = %v, want accepted without MX lookup", p)
+	}
+	if p := v.Check(t.Context(), "bob"); p == nil || !p.Syntax {
+		t.Errorf("Check = %v, want syntax problem", p)
+	}
+}
@@ -0,0 +1,251 @@
+// Package reconcile compares the emails held in the database with the
+// messages in the mailescrow IMAP folders, which drift apart when a move
+// fails or someone files mail by hand, and optionally repairs the difference.
+package reconcile
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Kinds of discrepancy.
+const (
+	KindOrphaned = "orphaned" // a message in the received folder has no email
+	KindMisfiled = "misfiled" // an email's message is in another folder than recorded
+	KindMissing  = "missing"  // an email's message is in none of the folders
+)
+
+// inbox is where orphaned messages are returned for the poller to import.
+const inbox = "INBOX"
+
+// folders are listed in the order mail moves through them, so a message moved
+// while a check runs is still seen in one of them.
+var folders = []string{imap.FolderReceived, imap.FolderApproved, imap.FolderRejected, imap.FolderRead}
+
+// Mailbox lists and files messages in IMAP folders. *imap.Client implements it.
+type Mailbox interface {
+	ListMessageIDs(ctx context.Context, mailbox string) ([]string, error)
+	MoveMessage(ctx context.Context, messageID, fromMailbox, toMailbox string) error
+	Append(ctx context.Context, mailbox string, raw []byte) error
+}
+
+// Discrepancy is one difference between the database and the folders.
+type Discrepancy struct {
+	Kind      string
+	MessageID string
+	EmailID   string // empty for KindOrphaned
+	Status    string // the email's status; empty for KindOrphaned
+	Recorded  string // the folder the email records; empty for KindOrphaned
+	Found     string // the folder the message is in; empty for KindMissing
+	Fixed     bool
+	Err       error // why fixing failed
+}
+
+// String describes d and, if it was fixed, how.
+func (d Discrepancy) String() string {
+	var s string
+	switch d.Kind {
+	case KindOrphaned:
+		s = fmt.Sprintf("%s: message %s in %s has no email", d.Kind, d.MessageID, d.Found)
+	case KindMisfiled:
+		s = fmt.Sprintf("%s: %s email %s records %s but its message is in %s", d.Kind, d.Status, d.EmailID, d.Recorded, d.Found)
+	default:
+		s = fmt.Sprintf("%s: %s email %s records %s but its message %s is in no folder", d.Kind, d.Status, d.EmailID, d.Recorded, d.MessageID)
+	}
+	switch {
+	case d.Err != nil:
+		s += fmt.Sprintf(" (fix failed: %v)", d.Err)
+	case d.Fixed:
+		s += " (" + fixDescriptions[d.Kind] + ")"
+	}
+	return s
+}
+
+var fixDescriptions = map[string]string{
+	KindOrphaned: "moved to " + inbox + " to be imported again",
+	KindMisfiled: "email updated",
+	KindMissing:  "restored from the stored copy",
+}
+
+// Reconciler checks the store against the IMAP folders.
+type Reconciler struct {
+	st     store.ReadWriter
+	client Mailbox
+	now    func() time.Time
+}
+
+// New creates a Reconciler.
+func New(st store.ReadWriter, client Mailbox) *Reconciler {
+	return &Reconciler{st: st, client: client, now: time.Now}
+}
+
+// Run checks every interval until ctx is cancelled, logging what it finds and
+// fixing it if fix is set.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration, fix bool) {
+	log.Printf("IMAP reconciliation started (interval: %s, fix: %t)", interval, fix)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		found, err := r.Check(ctx, fix)
+		if err != nil {
+			log.Printf("IMAP reconciliation: %v", err)
+		}
+		for _, d := range found {
+			log.Printf("IMAP reconciliation: %s", d)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check compares held inbound emails with the folders and returns the
+// discrepancies, repairing each if fix is set:
+//
+//   - an orphaned message is moved back to INBOX, for the poller to import;
+//   - a misfiled email is updated to the folder its message is in;
+//   - a missing message is appended again from the email's raw message.
+//
+// Emails and messages with IMAP moves still queued are skipped, as are
+// emails saved after the check began. Fix failures are recorded on the
+// discrepancy; listing failures stop the check.
+func (r *Reconciler) Check(ctx context.Context, fix bool) ([]Discrepancy, error) {
+	start := r.now()
+
+	// Folders first: a message is moved into received before its email is
+	// saved, so an email listed afterwards is not taken for an orphan.
+	where := make(map[string]string) // Message-Id → first folder it is in
+	var received []string
+	for _, folder := range folders {
+		ids, err := r.client.ListMessageIDs(ctx, folder)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", folder, err)
+		}
+		if folder == imap.FolderReceived {
+			received = ids
+		}
+		for _, id := range ids {
+			if _, ok := where[id]; !ok {
+				where[id] = folder
+			}
+		}
+	}
+
+	emails, err := r.heldEmails(ctx)
+	if err != nil {
+		return nil, err
+	}
+	movingEmails, movingMessages, err := r.queuedMoves(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Discrepancy
+	held := make(map[string]bool, len(emails))
+	for _, e := range emails {
+		held[e.IMAPMessageID] = true
+		if movingEmails[e.ID] || e.ReceivedAt.After(start) {
+			continue
+		}
+		folder, ok := where[e.IMAPMessageID]
+		if ok && e.IMAPMailbox == folder {
+			continue
+		}
+		d := Discrepancy{Kind: KindMisfiled, MessageID: e.IMAPMessageID, EmailID: e.ID, Status: e.Status, Recorded: e.IMAPMailbox, Found: folder}
+		if !ok {
+			d.Kind = KindMissing
+		}
+		found = append(found, d)
+	}
+	for _, id := range received {
+		if !held[id] && !movingMessages[id] {
+			found = append(found, Discrepancy{Kind: KindOrphaned, MessageID: id, Found: imap.FolderReceived})
+		}
+	}
+
+	counts := map[string]int{KindOrphaned: 0, KindMisfiled: 0, KindMissing: 0}
+	for i := range found {
+		counts[found[i].Kind]++
+		if fix {
+			found[i].Err = r.fix(ctx, found[i])
+			found[i].Fixed = found[i].Err == nil
+		}
+	}
+	for kind, n := range counts {
+		metrics.IMAPDiscrepancies.Set(float64(n), kind)
+	}
+	return found, nil
+}
+
+// heldEmails returns the inbound emails, pending or approved, filed in IMAP.
+func (r *Reconciler) heldEmails(ctx context.Context) ([]store.Email, error) {
+	pending, err := r.st.ListPendingSummaries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list pending: %w", err)
+	}
+	approved, err := r.st.ListApproved(ctx, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("list approved: %w", err)
+	}
+	var emails []store.Email
+	for _, e := range append(pending, approved...) {
+		if e.Direction == store.DirectionInbound && e.IMAPMessageID != "" {
+			emails = append(emails, e)
+		}
+	}
+	return emails, nil
+}
+
+// queuedMoves returns the emails and Message-Ids with an IMAP move queued,
+// whose folders are about to change. Failed moves count too, as an operator
+// may retry them.
+func (r *Reconciler) queuedMoves(ctx context.Context) (emails, messages map[string]bool, err error) {
+	queued, err := r.st.ListJobs(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list jobs: %w", err)
+	}
+	emails, messages = make(map[string]bool), make(map[string]bool)
+	for _, job := range queued {
+		if job.Kind != jobs.KindIMAPMove {
+			continue
+		}
+		emails[job.EmailID] = true
+		var p struct {
+			MessageID string `json:"message_id"`
+		}
+		if err := json.Unmarshal(job.Payload, &p); err == nil {
+			messages[p.MessageID] = true
+		}
+	}
+	return emails, messages, nil
+}
+
+func (r *Reconciler) fix(ctx context.Context, d Discrepancy) error {
+	switch d.Kind {
+	case KindOrphaned:
+		return r.client.MoveMessage(ctx, d.MessageID, imap.FolderReceived, inbox)
+	case KindMisfiled:
+		return r.st.UpdateIMAPMailbox(ctx, d.EmailID, d.Found)
+	default:
+		e, err := r.st.Get(ctx, d.EmailID)
+		if err != nil {
+			return err
+		}
+		if len(e.RawMessage) == 0 {
+			return fmt.Errorf("no stored copy of email %s", d.EmailID)
+		}
+		return r.client.Append(ctx, cmp.Or(d.Recorded, imap.FolderReceived), e.RawMessage)
+	}
+}
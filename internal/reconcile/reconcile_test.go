@@ -0,0 +1,131 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// fakeMailbox holds Message-Ids by folder.
+type fakeMailbox struct {
+	folders  map[string][]string
+	appended map[string][][]byte
+}
+
+func (f *fakeMailbox) ListMessageIDs(_ context.Context, mailbox string) ([]string, error) {
+	return f.folders[mailbox], nil
+}
+
+func (f *fakeMailbox) MoveMessage(_ context.Context, messageID, from, to string) error {
+	i := slices.Index(f.folders[from], messageID)
+	if i < 0 {
+		return fmt.Errorf("message not found in %s: %s", from, messageID)
+	}
+	f.folders[from] = slices.Delete(f.folders[from], i, i+1)
+	f.folders[to] = append(f.folders[to], messageID)
+	return nil
+}
+
+func (f *fakeMailbox) Append(_ context.Context, mailbox string, raw []byte) error {
+	f.appended[mailbox] = append(f.appended[mailbox], raw)
+	return nil
+}
+
+func TestCheck(t *testing.T) {
+	ctx := t.Context()
+	st := store.NewMemory()
+	save := func(msgID, mailbox string) string {
+		t.Helper()
+		raw := []byte("Message-Id: " + msgID + "\r\n\r\nbody")
+		id, err := st.SaveInbound(ctx, "a@example.com", []string{"me@example.com"}, "s", "body", raw, msgID, mailbox, "")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+		return id
+	}
+	save("<ok@x>", imap.FolderReceived)
+	misfiled := save("<misfiled@x>", imap.FolderReceived)
+	missing := save("<missing@x>", imap.FolderApproved)
+	if err := st.Approve(ctx, missing, "alice", 0); err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	moving := save("<moving@x>", imap.FolderReceived)
+	if _, err := st.AddJob(ctx, store.Job{Kind: jobs.KindIMAPMove, EmailID: moving, Payload: []byte(`{"message_id":"<moving@x>"}`), Status: store.JobPending}); err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+	if _, err := st.AddJob(ctx, store.Job{Kind: jobs.KindIMAPMove, Payload: []byte(`{"message_id":"<rejected@x>"}`), Status: store.JobPending}); err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+
+	mb := &fakeMailbox{
+		folders: map[string][]string{
+			imap.FolderReceived: {"<ok@x>", "<orphan@x>", "<rejected@x>"},
+			imap.FolderRejected: {"<misfiled@x>"},
+		},
+		appended: make(map[string][][]byte),
+	}
+	r := New(st, mb)
+
+	found, err := r.Check(ctx, false)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	want := []Discrepancy{
+		{Kind: KindMisfiled, MessageID: "<misfiled@x>", EmailID: misfiled, Status: store.StatusPending, Recorded: imap.FolderReceived, Found: imap.FolderRejected},
+		{Kind: KindMissing, MessageID: "<missing@x>", EmailID: missing, Status: store.StatusApproved, Recorded: imap.FolderApproved},
+		{Kind: KindOrphaned, MessageID: "<orphan@x>", Found: imap.FolderReceived},
+	}
+	if !slices.Equal(found, want) {
+		t.Fatalf("found:\n%v\nwant:\n%v", found, want)
+	}
+	if got := metrics.IMAPDiscrepancies.Value(KindMissing); got != 1 {
+		t.Errorf("missing gauge = %v, want 1", got)
+	}
+	if len(mb.appended) != 0 || len(mb.folders["INBOX"]) != 0 {
+		t.Error("check without fix changed the folders")
+	}
+
+	found, err = r.Check(ctx, true)
+	if err != nil {
+		t.Fatalf("check and fix: %v", err)
+	}
+	for _, d := range found {
+		if !d.Fixed {
+			t.Errorf("not fixed: %s", d)
+		}
+	}
+	if got := mb.folders["INBOX"]; !slices.Equal(got, []string{"<orphan@x>"}) {
+		t.Errorf("INBOX = %v, want the orphan", got)
+	}
+	if got := mb.appended[imap.FolderApproved]; len(got) != 1 {
+		t.Errorf("appended to approved = %d messages, want 1", len(got))
+	}
+	if e, _ := st.Get(ctx, misfiled); e.IMAPMailbox != imap.FolderRejected {
+		t.Errorf("misfiled mailbox = %q, want %s", e.IMAPMailbox, imap.FolderRejected)
+	}
+}
+
+func TestCheckSkipsNewEmails(t *testing.T) {
+	ctx := t.Context()
+	st := store.NewMemory()
+	if _, err := st.SaveInbound(ctx, "a@example.com", nil, "s", "body", []byte("x"), "<new@x>", imap.FolderReceived, ""); err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	r := New(st, &fakeMailbox{folders: map[string][]string{}})
+	r.now = func() time.Time { return time.Now().Add(-time.Minute) } // the check began before the save
+
+	found, err := r.Check(ctx, false)
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(found) != 0 {
+		t.Errorf("found %v, want nothing for an email saved during the check", found)
+	}
+}
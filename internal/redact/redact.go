@@ -0,0 +1,213 @@
+// Package redact removes sensitive data, such as card numbers and API keys,
+// from held mail before it is stored or shown to reviewers.
+package redact
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Built-in pattern names.
+const (
+	CreditCard = "credit_card" // 13–19 digit card numbers passing the Luhn check
+	SSN        = "ssn"         // US social security numbers, e.g. 123-45-6789
+	APIKey     = "api_key"     // well-known key formats and "api_key: ..." style assignments
+)
+
+// Policies for the raw message of held mail.
+const (
+	RawKeep    = "keep"    // store it as received
+	RawEncrypt = "encrypt" // store it encrypted; see store.Lifecycle.SetRawKey
+	RawDrop    = "drop"    // don't store it for inbound mail, whose original stays in the mailbox
+)
+
+// Pattern is a named regular expression to redact. If it has a capturing
+// group only the group's text is redacted, e.g. the value of a "key=value"
+// pair.
+type Pattern struct {
+	Name string
+	Expr string
+}
+
+type pattern struct {
+	name  string
+	re    *regexp.Regexp
+	valid func(match string) bool // nil accepts every match
+}
+
+var builtins = map[string]pattern{
+	CreditCard: {re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhn},
+	SSN:        {re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), valid: validSSN},
+	APIKey: {re: regexp.MustCompile(`\b(?:AKIA[0-9A-Z]{16}|[sr]k_(?:live|test)_[0-9A-Za-z]{16,}|gh[pousr]_[0-9A-Za-z]{36,}|xox[abposr]-[0-9A-Za-z-]{10,}|AIza[0-9A-Za-z_-]{35})\b|` +
+		`(?i:\b(?:api[_-]?key|api[_-]?secret|access[_-]?token|secret[_-]?key)["']?\s*[:=]\s*["']?)([^\s"']{8,})`)},
+}
+
+// Redactor replaces matches of its patterns with "[redacted:<name>]". A nil
+// *Redactor changes nothing.
+type Redactor struct {
+	patterns []pattern
+}
+
+// New creates a Redactor for the named built-in patterns and the custom ones.
+// It returns nil if there are none.
+func New(names []string, custom []Pattern) (*Redactor, error) {
+	var r Redactor
+	for _, name := range names {
+		p, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction pattern %q (want %s, %s or %s)", name, CreditCard, SSN, APIKey)
+		}
+		p.name = name
+		r.patterns = append(r.patterns, p)
+	}
+	for _, c := range custom {
+		if c.Name == "" {
+			return nil, fmt.Errorf("redaction pattern %q has no name", c.Expr)
+		}
+		re, err := regexp.Compile(c.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %s: %w", c.Name, err)
+		}
+		if re.NumSubexp() > 1 {
+			return nil, fmt.Errorf("redaction pattern %s: at most one capturing group", c.Name)
+		}
+		r.patterns = append(r.patterns, pattern{name: c.Name, re: re})
+	}
+	if len(r.patterns) == 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// Redact returns s with every match replaced.
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, p := range r.patterns {
+		s = p.replace(s)
+	}
+	return s
+}
+
+// RedactBytes is Redact for a message, e.g. a raw message shown to a reviewer.
+func (r *Redactor) RedactBytes(b []byte) []byte {
+	if r == nil {
+		return b
+	}
+	return []byte(r.Redact(string(b)))
+}
+
+func (p pattern) replace(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range p.re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[0], m[1]
+		// Redact the capturing group, if the pattern has one and it matched.
+		for i := 2; i+1 < len(m); i += 2 {
+			if m[i] >= 0 {
+				start, end = m[i], m[i+1]
+				break
+			}
+		}
+		if p.valid != nil && !p.valid(s[start:end]) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString("[redacted:" + p.name + "]")
+		last = end
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// luhn reports whether the digits of number pass the Luhn checksum used by
+// card numbers.
+func luhn(number string) bool {
+	var digits []int
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, int(c-'0'))
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// validSSN rejects numbers the Social Security Administration never issues,
+// which are common as placeholders and in unrelated identifiers.
+func validSSN(ssn string) bool {
+	area, group, serial := ssn[0:3], ssn[4:6], ssn[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// Store redacts the subject and body of held mail as it is saved to the
+// wrapped store, and drops the raw message of inbound mail under RawDrop,
+// also from recorded decisions.
+// Everything else passes through.
+type Store struct {
+	store.EmailStore
+	r       *Redactor
+	dropRaw bool
+}
+
+// NewStore wraps st. raw is RawKeep, RawEncrypt or RawDrop; encryption is
+// the wrapped store's business (store.Lifecycle.SetRawKey).
+func NewStore(st store.EmailStore, r *Redactor, raw string) *Store {
+	return &Store{EmailStore: st, r: r, dropRaw: raw == RawDrop}
+}
+
+// SaveOutbound saves a redacted copy of the subject and body. The raw
+// message is kept whatever the policy, since it is what gets relayed.
+func (s *Store) SaveOutbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte) (string, error) {
+	return s.EmailStore.SaveOutbound(ctx, sender, recipients, s.r.Redact(subject), s.r.Redact(body), rawMessage)
+}
+
+// SaveOutboundBatch saves redacted copies of the subjects and bodies, as
+// SaveOutbound does.
+func (s *Store) SaveOutboundBatch(ctx context.Context, emails []store.Email) ([]string, error) {
+	redacted := make([]store.Email, len(emails))
+	for i, e := range emails {
+		e.Subject, e.Body = s.r.Redact(e.Subject), s.r.Redact(e.Body)
+		redacted[i] = e
+	}
+	return s.EmailStore.SaveOutboundBatch(ctx, redacted)
+}
+
+// RecordDecision records d without the raw message of inbound mail under
+// RawDrop, so wrapped stores such as the archive never see it.
+func (s *Store) RecordDecision(ctx context.Context, d store.Decision) error {
+	if s.dropRaw && d.Direction == store.DirectionInbound {
+		d.RawMessage = nil
+	}
+	return s.EmailStore.RecordDecision(ctx, d)
+}
+
+// SaveInbound saves a redacted copy of the subject and body, and no raw
+// message under RawDrop.
+func (s *Store) SaveInbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte, imapMessageID, imapMailbox, queue string) (string, error) {
+	if s.dropRaw {
+		rawMessage = []byte{}
+	}
+	return s.EmailStore.SaveInbound(ctx, sender, recipients, s.r.Redact(subject), s.r.Redact(body), rawMessage, imapMessageID, imapMailbox, queue)
+}
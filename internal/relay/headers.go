@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Traceability headers stamped on relayed messages.
+const (
+	HeaderID         = "X-Mailescrow-Id"
+	HeaderApprovedBy = "X-Mailescrow-Approved-By"
+	HeaderApprovedAt = "X-Mailescrow-Approved-At"
+)
+
+// RewriteHeaders returns a copy of raw with every header named in strip
+// removed (case-insensitively, including folded continuation lines). If stamp
+// is true, any existing X-Mailescrow-* headers are dropped and fresh ones
+// describing email's approval are prepended. The body is left untouched.
+func RewriteHeaders(raw []byte, email *store.Email, stamp bool, strip []string) []byte {
+	if !stamp && len(strip) == 0 {
+		return raw
+	}
+
+	eol := []byte("\r\n")
+	headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	if lf := bytes.Index(raw, []byte("\n\n")); headerEnd < 0 || (lf >= 0 && lf < headerEnd) {
+		headerEnd = lf
+		eol = []byte("\n")
+	}
+	var header, rest []byte
+	if headerEnd < 0 {
+		// No header/body separator: treat the whole message as headers.
+		header = raw
+	} else {
+		// Keep the last header line's terminator with the header block so
+		// rest starts with the blank separator line.
+		header, rest = raw[:headerEnd+len(eol)], raw[headerEnd+len(eol):]
+	}
+
+	drop := make(map[string]bool, len(strip)+3)
+	for _, name := range strip {
+		drop[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	if stamp {
+		drop[HeaderID] = true
+		drop[HeaderApprovedBy] = true
+		drop[HeaderApprovedAt] = true
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(raw) + 256)
+	if stamp {
+		approvedAt := email.ApprovedAt
+		if approvedAt.IsZero() {
+			approvedAt = time.Now().UTC()
+		}
+		writeHeader(&out, HeaderID, email.ID, eol)
+		writeHeader(&out, HeaderApprovedBy, email.ApprovedBy, eol)
+		writeHeader(&out, HeaderApprovedAt, approvedAt.Format(time.RFC1123Z), eol)
+	}
+
+	skipping := false
+	for _, line := range bytes.SplitAfter(header, eol) {
+		if len(line) == 0 {
+			continue
+		}
+		continuation := line[0] == ' ' || line[0] == '\t'
+		if !continuation {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			skipping = drop[textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))]
+		}
+		if skipping {
+			continue
+		}
+		out.Write(line)
+	}
+	out.Write(rest)
+	return out.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, name, value string, eol []byte) {
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(strings.NewReplacer("\r", " ", "\n", " ").Replace(value))
+	buf.Write(eol)
+}
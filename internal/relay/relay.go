@@ -2,14 +2,25 @@ package relay
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	netsmtp "net/smtp"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/albert/mailescrow/internal/proxy"
 	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/tlsclient"
+	"github.com/albert/mailescrow/internal/tracing"
 )
 
 // Sender is the interface for sending emails upstream.
@@ -17,6 +28,18 @@ type Sender interface {
 	Send(ctx context.Context, email *store.Email) error
 }
 
+// Previewer is implemented by senders that rewrite messages before sending.
+type Previewer interface {
+	// Preview returns the raw message exactly as Send would transmit it.
+	Preview(email *store.Email) []byte
+}
+
+// ErrUnsupported is returned by Send when the message needs an SMTP
+// extension the upstream does not offer: 8BITMIME for 8-bit content, or
+// SMTPUTF8 for UTF-8 addresses or headers. Relaying it anyway could corrupt
+// it, so it is not sent.
+var ErrUnsupported = errors.New("upstream cannot relay this message")
+
 // Relay sends approved emails to an upstream SMTP server.
 type Relay struct {
 	host     string
@@ -24,6 +47,16 @@ type Relay struct {
 	username string
 	password string
 	useTLS   bool
+
+	timeout time.Duration // limit on connecting and on each command; 0 waits indefinitely
+	dialer  proxy.Dialer  // connects to the upstream; nil dials directly. See SetDialer
+	tls     *tls.Config   // for implicit TLS and STARTTLS; nil uses the defaults. See SetTLSConfig
+
+	stampHeaders bool     // add X-Mailescrow-* traceability headers
+	stripHeaders []string // header names removed before relaying
+
+	dsnNotify string // RCPT NOTIFY parameter, e.g. "FAILURE,DELAY"; empty requests no DSNs
+	dsnRet    string // MAIL RET parameter: "FULL", "HDRS" or empty for the upstream's default
 }
 
 // New creates a new Relay configured to connect to the upstream SMTP server.
@@ -37,63 +70,292 @@ func New(host string, port int, username, password string, useTLS bool) *Relay {
 	}
 }
 
-// Send forwards an approved email via the upstream SMTP server using its raw message.
-func (r *Relay) Send(ctx context.Context, email *store.Email) error {
-	addr := net.JoinHostPort(r.host, strconv.Itoa(r.port))
+// SetHeaderRewrite configures how message headers are rewritten before relay.
+// If stamp is true, X-Mailescrow-Id/Approved-By/Approved-At headers are added;
+// every header named in strip is removed.
+func (r *Relay) SetHeaderRewrite(stamp bool, strip []string) {
+	r.stampHeaders = stamp
+	r.stripHeaders = strip
+}
 
-	var c *netsmtp.Client
-	var err error
+// SetTimeout limits how long Send waits for the upstream: to connect and
+// greet, and for the reply to each command, including the transfer of the
+// message. 0 waits indefinitely, bounded only by the context.
+func (r *Relay) SetTimeout(d time.Duration) {
+	r.timeout = d
+}
 
-	if r.useTLS {
-		tlsConfig := &tls.Config{ServerName: r.host}
-		conn, err := (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
-		if err != nil {
-			return fmt.Errorf("tls dial: %w", err)
+// SetDialer connects to the upstream with d, e.g. through the proxy of
+// network.proxy_url, instead of directly. The timeout of SetTimeout still
+// bounds connecting, proxy handshake included.
+func (r *Relay) SetDialer(d proxy.Dialer) {
+	r.dialer = d
+}
+
+// SetTLSConfig verifies the upstream, and authenticates to it, with cfg
+// (see tlsclient.Load) for implicit TLS and STARTTLS alike. Its ServerName
+// is set to the relay host.
+func (r *Relay) SetTLSConfig(cfg *tls.Config) {
+	r.tls = cfg
+}
+
+// SetDSN asks the upstream for delivery status notifications (RFC 3461) on
+// relayed mail. notify lists the conditions to report ("success", "failure",
+// "delay") or is "never"; an empty list requests none. ret selects whether
+// DSNs return the "full" message or only its "hdrs", or is empty for the
+// upstream's default. DSNs are only requested from upstreams that advertise
+// the DSN extension.
+func (r *Relay) SetDSN(notify []string, ret string) error {
+	var conds []string
+	for _, n := range notify {
+		n = strings.ToUpper(strings.TrimSpace(n))
+		switch n {
+		case "SUCCESS", "FAILURE", "DELAY":
+		case "NEVER":
+			if len(notify) > 1 {
+				return errors.New(`dsn notify "never" cannot be combined with other conditions`)
+			}
+		default:
+			return fmt.Errorf("unknown dsn notify condition %q", n)
 		}
-		c, err = netsmtp.NewClient(conn, r.host)
+		conds = append(conds, n)
+	}
+	ret = strings.ToUpper(ret)
+	switch ret {
+	case "", "FULL", "HDRS":
+	default:
+		return fmt.Errorf("dsn ret must be full or hdrs, not %q", ret)
+	}
+	r.dsnNotify = strings.Join(conds, ",")
+	r.dsnRet = ret
+	return nil
+}
+
+// dial connects to the upstream, with TLS from the start if configured,
+// within the timeout of SetTimeout.
+func (r *Relay) dial(ctx context.Context) (net.Conn, error) {
+	addr := net.JoinHostPort(r.host, strconv.Itoa(r.port))
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	var dialer proxy.Dialer = &net.Dialer{}
+	if r.dialer != nil {
+		dialer = r.dialer
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if !r.useTLS {
 		if err != nil {
-			return fmt.Errorf("smtp client over tls: %w", err)
+			return nil, fmt.Errorf("smtp dial: %w", err)
 		}
-	} else {
-		c, err = netsmtp.Dial(addr)
-		if err != nil {
-			return fmt.Errorf("smtp dial: %w", err)
+		return conn, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tls dial: %w", err)
+	}
+	tc := tls.Client(conn, tlsclient.ForHost(r.tls, r.host))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("tls dial: %w", err)
+	}
+	return tc, nil
+}
+
+// Preview returns the raw message as Send would transmit it, with headers
+// stamped and stripped according to SetHeaderRewrite.
+func (r *Relay) Preview(email *store.Email) []byte {
+	return RewriteHeaders(email.RawMessage, email, r.stampHeaders, r.stripHeaders)
+}
+
+// Send forwards an approved email via the upstream SMTP server using its raw
+// message. When DSNs are requested, email.EnvelopeID is set to the ENVID sent
+// with it: the email's ID, or a new UUID for mail that has none.
+func (r *Relay) Send(ctx context.Context, email *store.Email) (err error) {
+	ctx, span := tracing.Start(ctx, "relay.send",
+		attribute.String("mailescrow.email_id", email.ID),
+		attribute.String("server.address", r.host),
+		attribute.Int("mailescrow.recipients", len(email.Recipients)))
+	defer func() { tracing.End(span, err) }()
+
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	// net/smtp has no context support: cancelling ctx expires the
+	// connection's deadline, failing whatever call is blocked on it.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("%v: %w", err, context.Cause(ctx))
+		}
+	}()
+	deadline := func() {
+		if r.timeout > 0 {
+			_ = conn.SetDeadline(time.Now().Add(r.timeout))
+		}
+		if ctx.Err() != nil { // cancelled meanwhile; keep the connection expired
+			_ = conn.SetDeadline(time.Now())
 		}
+	}
+
+	deadline()
+	c, err := netsmtp.NewClient(conn, r.host)
+	if err != nil {
+		return fmt.Errorf("smtp client: %w", err)
+	}
+	if !r.useTLS {
 		// Try STARTTLS if available.
+		deadline()
 		if ok, _ := c.Extension("STARTTLS"); ok {
-			if err := c.StartTLS(&tls.Config{ServerName: r.host}); err != nil {
+			if err := c.StartTLS(tlsclient.ForHost(r.tls, r.host)); err != nil {
 				return fmt.Errorf("starttls: %w", err)
 			}
 		}
 	}
-	defer func() { _ = c.Close() }()
 
 	if r.username != "" {
+		deadline()
 		auth := netsmtp.PlainAuth("", r.username, r.password, r.host)
 		if err := c.Auth(auth); err != nil {
 			return fmt.Errorf("auth: %w", err)
 		}
 	}
 
-	if err := c.Mail(email.Sender); err != nil {
+	raw := r.Preview(email)
+	eightBit, utf8 := needs(email.Sender, email.Recipients, raw)
+	if ok, _ := c.Extension("8BITMIME"); eightBit && !ok {
+		return fmt.Errorf("%w: it has 8-bit content and the upstream does not support 8BITMIME", ErrUnsupported)
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); utf8 && !ok {
+		return fmt.Errorf("%w: it has UTF-8 addresses or headers and the upstream does not support SMTPUTF8", ErrUnsupported)
+	}
+
+	var envID string
+	if r.dsnNotify != "" {
+		if ok, _ := c.Extension("DSN"); ok {
+			envID = cmp.Or(email.ID, uuid.New().String())
+		}
+	}
+
+	deadline()
+	if err := r.mail(c, email.Sender, utf8, envID); err != nil {
 		return fmt.Errorf("mail from: %w", err)
 	}
 	for _, rcpt := range email.Recipients {
-		if err := c.Rcpt(rcpt); err != nil {
+		deadline()
+		if envID == "" {
+			err = c.Rcpt(rcpt)
+		} else {
+			err = command(c, 25, fmt.Sprintf("RCPT TO:<%s> NOTIFY=%s ORCPT=rfc822;%s", rcpt, r.dsnNotify, xtext(rcpt)))
+		}
+		if err != nil {
 			return fmt.Errorf("rcpt to %s: %w", rcpt, err)
 		}
 	}
 
+	deadline()
 	w, err := c.Data()
 	if err != nil {
 		return fmt.Errorf("data: %w", err)
 	}
-	if _, err := bytes.NewReader(email.RawMessage).WriteTo(w); err != nil {
+	deadline()
+	if _, err := bytes.NewReader(raw).WriteTo(w); err != nil {
 		return fmt.Errorf("write message: %w", err)
 	}
+	deadline()
 	if err := w.Close(); err != nil {
 		return fmt.Errorf("close data: %w", err)
 	}
 
-	return c.Quit()
+	// The upstream accepted the message when DATA closed: failing now would
+	// have it unapproved and relayed again.
+	deadline()
+	if err := c.Quit(); err != nil {
+		log.Printf("relay email %s: quit after the upstream accepted it: %v", email.ID, err)
+	}
+	if r.dsnNotify != "NEVER" { // no DSN will come back to track
+		email.EnvelopeID = envID
+	}
+	return nil
+}
+
+// mail sends MAIL FROM with BODY=8BITMIME if the upstream supports it,
+// SMTPUTF8 if utf8 (RFC 6531 asks for it only when needed), and the RET and
+// ENVID parameters if envID is set.
+func (r *Relay) mail(c *netsmtp.Client, from string, utf8 bool, envID string) error {
+	line := "MAIL FROM:<" + from + ">"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		line += " BODY=8BITMIME"
+	}
+	if utf8 {
+		line += " SMTPUTF8"
+	}
+	if envID != "" {
+		if r.dsnRet != "" {
+			line += " RET=" + r.dsnRet
+		}
+		line += " ENVID=" + xtext(envID)
+	}
+	return command(c, 250, line)
+}
+
+// needs reports which SMTP extensions relaying raw from and to rcpts takes:
+// 8BITMIME for any byte outside ASCII, and SMTPUTF8 for one in an address or
+// the header (RFC 6532).
+func needs(from string, rcpts []string, raw []byte) (eightBit, utf8 bool) {
+	eightBit = !isASCII(raw)
+	header := raw
+	if i := bytes.Index(raw, []byte("\n\r\n")); i >= 0 {
+		header = raw[:i]
+	}
+	if i := bytes.Index(header, []byte("\n\n")); i >= 0 {
+		header = header[:i]
+	}
+	utf8 = !isASCII(header) || !isASCII([]byte(from))
+	for _, rcpt := range rcpts {
+		utf8 = utf8 || !isASCII([]byte(rcpt))
+	}
+	return eightBit, utf8
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// command sends an SMTP command that net/smtp's Client has no method for and
+// reads the reply, which must start with expectCode.
+func command(c *netsmtp.Client, expectCode int, line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("smtp: a line must not contain CR or LF")
+	}
+	id, err := c.Text.Cmd("%s", line)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expectCode)
+	return err
+}
+
+// xtext encodes s for an ESMTP parameter value (RFC 3461, section 4).
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
 }
@@ -2,8 +2,13 @@ package relay
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -14,11 +19,14 @@ import (
 
 // mockSMTPServer is a minimal SMTP server for testing the relay.
 type mockSMTPServer struct {
-	addr     string
-	listener net.Listener
-
-	mu       sync.Mutex
-	received []receivedMessage
+	addr       string
+	listener   net.Listener
+	extensions []string // advertised in reply to EHLO
+
+	mu        sync.Mutex
+	quitHangs bool // never answer QUIT, like an upstream that stalls after accepting the message
+	received  []receivedMessage
+	commands  []string // MAIL and RCPT commands as sent
 }
 
 type receivedMessage struct {
@@ -27,7 +35,7 @@ type receivedMessage struct {
 	Data string
 }
 
-func newMockSMTPServer(t *testing.T) *mockSMTPServer {
+func newMockSMTPServer(t *testing.T, extensions ...string) *mockSMTPServer {
 	t.Helper()
 
 	lis, err := net.Listen("tcp", "127.0.0.1:0")
@@ -36,8 +44,9 @@ func newMockSMTPServer(t *testing.T) *mockSMTPServer {
 	}
 
 	s := &mockSMTPServer{
-		addr:     lis.Addr().String(),
-		listener: lis,
+		addr:       lis.Addr().String(),
+		listener:   lis,
+		extensions: extensions,
 	}
 
 	go s.serve(t)
@@ -102,17 +111,33 @@ func (s *mockSMTPServer) handleConn(t *testing.T, conn net.Conn) {
 		upper := strings.ToUpper(line)
 		switch {
 		case strings.HasPrefix(upper, "EHLO") || strings.HasPrefix(upper, "HELO"):
-			write("250 Hello")
+			reply := append([]string{"Hello"}, s.extensions...)
+			for i, l := range reply {
+				if i < len(reply)-1 {
+					write("250-" + l)
+				} else {
+					write("250 " + l)
+				}
+			}
 		case strings.HasPrefix(upper, "MAIL FROM:"):
 			from = extractAddr(line)
+			s.record(line)
 			write("250 OK")
 		case strings.HasPrefix(upper, "RCPT TO:"):
 			to = append(to, extractAddr(line))
+			s.record(line)
 			write("250 OK")
 		case upper == "DATA":
 			write("354 Start mail input")
 			inData = true
 		case upper == "QUIT":
+			s.mu.Lock()
+			hang := s.quitHangs
+			s.mu.Unlock()
+			if hang {
+				_, _ = io.Copy(io.Discard, r) // until the client gives up
+				return
+			}
 			write("221 Bye")
 			return
 		default:
@@ -135,6 +160,18 @@ func extractAddr(line string) string {
 	return line
 }
 
+func (s *mockSMTPServer) record(command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = append(s.commands, command)
+}
+
+func (s *mockSMTPServer) getCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
 func (s *mockSMTPServer) getReceived() []receivedMessage {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -227,3 +264,313 @@ func TestRelaySendConnectionRefused(t *testing.T) {
 		t.Fatal("expected error when connecting to closed port")
 	}
 }
+
+// recordingDialer dials directly, recording the addresses it is asked for.
+type recordingDialer struct {
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.addrs = append(d.addrs, addr)
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestRelaySendThroughDialer(t *testing.T) {
+	mock := newMockSMTPServer(t)
+	host, portStr, _ := net.SplitHostPort(mock.addr)
+	port, _ := strconv.Atoi(portStr)
+
+	r := New(host, port, "", "", false)
+	d := &recordingDialer{}
+	r.SetDialer(d)
+	email := &store.Email{
+		ID:         "test-proxy",
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		RawMessage: []byte("Subject: Test\r\n\r\nHello"),
+	}
+	if err := r.Send(t.Context(), email); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(d.addrs) != 1 || d.addrs[0] != mock.addr || len(mock.getReceived()) != 1 {
+		t.Errorf("dialed %v, received %d messages; want one through the dialer to %s", d.addrs, len(mock.getReceived()), mock.addr)
+	}
+}
+
+// newHungSMTPServer accepts connections and never answers, like an upstream
+// that hangs before its greeting.
+func newHungSMTPServer(t *testing.T) (string, int) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		lis.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	addr := lis.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestRelaySendTimeout(t *testing.T) {
+	host, port := newHungSMTPServer(t)
+	r := New(host, port, "", "", false)
+	r.SetTimeout(100 * time.Millisecond)
+
+	email := &store.Email{ID: "test-4", Sender: "alice@example.com", Recipients: []string{"bob@example.com"}}
+	start := time.Now()
+	err := r.Send(t.Context(), email)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("send = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("send took %v", d)
+	}
+}
+
+func TestRelaySendQuitTimeout(t *testing.T) {
+	mock := newMockSMTPServer(t)
+	mock.mu.Lock()
+	mock.quitHangs = true
+	mock.mu.Unlock()
+	host, portStr, _ := net.SplitHostPort(mock.addr)
+	port := 0
+	fmt.Sscanf(portStr, "%d", &port)
+	r := New(host, port, "", "", false)
+	r.SetTimeout(100 * time.Millisecond)
+
+	email := &store.Email{ID: "test-6", Sender: "alice@example.com", Recipients: []string{"bob@example.com"}, RawMessage: []byte("Subject: Hi\r\n\r\nHello\r\n")}
+	if err := r.Send(t.Context(), email); err != nil {
+		t.Fatalf("send = %v, want success once the message was accepted", err)
+	}
+	if got := mock.getReceived(); len(got) != 1 {
+		t.Errorf("upstream received %d messages, want 1", len(got))
+	}
+}
+
+func TestRelaySendCancelled(t *testing.T) {
+	host, port := newHungSMTPServer(t)
+	r := New(host, port, "", "", false)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	email := &store.Email{ID: "test-5", Sender: "alice@example.com", Recipients: []string{"bob@example.com"}}
+	if err := r.Send(ctx, email); !errors.Is(err, context.Canceled) {
+		t.Fatalf("send = %v, want context.Canceled", err)
+	}
+}
+
+func TestRewriteHeadersStampAndStrip(t *testing.T) {
+	raw := []byte("Received: from internal.host\r\n\tby relay.internal\r\n" +
+		"From: a@example.com\r\n" +
+		"X-Mailescrow-Id: spoofed\r\n" +
+		"Subject: Hi\r\n" +
+		"\r\n" +
+		"Received: in body stays\r\n")
+	email := &store.Email{ID: "id-1", ApprovedBy: "alice", ApprovedAt: time.Date(2026, 2, 20, 10, 0, 0, 0, time.UTC)}
+
+	got := string(RewriteHeaders(raw, email, true, []string{"received"}))
+
+	want := "X-Mailescrow-Id: id-1\r\n" +
+		"X-Mailescrow-Approved-By: alice\r\n" +
+		"X-Mailescrow-Approved-At: Fri, 20 Feb 2026 10:00:00 +0000\r\n" +
+		"From: a@example.com\r\n" +
+		"Subject: Hi\r\n" +
+		"\r\n" +
+		"Received: in body stays\r\n"
+	if got != want {
+		t.Errorf("rewritten message:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestRewriteHeadersNoopWithoutOptions(t *testing.T) {
+	raw := []byte("Subject: Hi\r\n\r\nbody")
+	if got := RewriteHeaders(raw, &store.Email{}, false, nil); string(got) != string(raw) {
+		t.Errorf("message changed without options: %q", got)
+	}
+}
+
+func TestRewriteHeadersStripsLastHeader(t *testing.T) {
+	raw := []byte("Subject: Hi\nReceived: x\n\nbody")
+	got := string(RewriteHeaders(raw, &store.Email{}, false, []string{"Received"}))
+	if got != "Subject: Hi\n\nbody" {
+		t.Errorf("rewritten message = %q", got)
+	}
+}
+
+func TestRelaySendStampsHeaders(t *testing.T) {
+	mock := newMockSMTPServer(t)
+
+	host, portStr, _ := net.SplitHostPort(mock.addr)
+	port := 0
+	fmt.Sscanf(portStr, "%d", &port)
+
+	r := New(host, port, "", "", false)
+	r.SetHeaderRewrite(true, []string{"Received"})
+
+	email := &store.Email{
+		ID:         "test-4",
+		Sender:     "alice@example.com",
+		Recipients: []string{"bob@example.com"},
+		RawMessage: []byte("Received: from secret\r\nSubject: Test\r\n\r\nHello"),
+		ApprovedBy: "carol",
+	}
+	if err := r.Send(t.Context(), email); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	msgs := mock.getReceived()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 received message, got %d", len(msgs))
+	}
+	if strings.Contains(msgs[0].Data, "from secret") {
+		t.Errorf("Received header not stripped: %q", msgs[0].Data)
+	}
+	if !strings.Contains(msgs[0].Data, "X-Mailescrow-Approved-By: carol") {
+		t.Errorf("approval header missing: %q", msgs[0].Data)
+	}
+}
+
+func TestRelaySendRequestsDSN(t *testing.T) {
+	email := func() *store.Email {
+		return &store.Email{
+			ID:         "test-dsn",
+			Sender:     "alice@example.com",
+			Recipients: []string{"bob+news@example.com"},
+			RawMessage: []byte("Subject: Test\r\n\r\nHello"),
+		}
+	}
+	send := func(mock *mockSMTPServer) *store.Email {
+		t.Helper()
+		host, portStr, _ := net.SplitHostPort(mock.addr)
+		port := 0
+		fmt.Sscanf(portStr, "%d", &port)
+		r := New(host, port, "", "", false)
+		if err := r.SetDSN([]string{"failure", "delay"}, "hdrs"); err != nil {
+			t.Fatalf("set dsn: %v", err)
+		}
+		e := email()
+		if err := r.Send(t.Context(), e); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		return e
+	}
+
+	// Without the DSN extension the upstream gets plain commands.
+	plain := newMockSMTPServer(t)
+	if e := send(plain); e.EnvelopeID != "" {
+		t.Errorf("envelope ID = %q without DSN support, want none", e.EnvelopeID)
+	}
+	want := []string{"MAIL FROM:<alice@example.com>", "RCPT TO:<bob+news@example.com>"}
+	if got := plain.getCommands(); !slices.Equal(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	dsn := newMockSMTPServer(t, "DSN", "8BITMIME")
+	if e := send(dsn); e.EnvelopeID != "test-dsn" {
+		t.Errorf("envelope ID = %q, want the email ID", e.EnvelopeID)
+	}
+	want = []string{
+		"MAIL FROM:<alice@example.com> BODY=8BITMIME RET=HDRS ENVID=test-dsn",
+		"RCPT TO:<bob+news@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;bob+2Bnews@example.com",
+	}
+	if got := dsn.getCommands(); !slices.Equal(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+	if len(dsn.getReceived()) != 1 {
+		t.Errorf("received %d messages, want 1", len(dsn.getReceived()))
+	}
+}
+
+func TestRelaySendNegotiatesEncoding(t *testing.T) {
+	send := func(mock *mockSMTPServer, rcpt, raw string) error {
+		t.Helper()
+		host, portStr, _ := net.SplitHostPort(mock.addr)
+		port := 0
+		fmt.Sscanf(portStr, "%d", &port)
+		return New(host, port, "", "", false).Send(t.Context(), &store.Email{
+			ID:         "test-encoding",
+			Sender:     "alice@example.com",
+			Recipients: []string{rcpt},
+			RawMessage: []byte(raw),
+		})
+	}
+	const (
+		ascii    = "Subject: Hello\r\n\r\nHello"
+		body8    = "Subject: Hello\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nGrüße"
+		header8  = "Subject: Grüße\r\n\r\nHello"
+		utf8Rcpt = "jörg@example.com"
+	)
+	for _, tt := range []struct {
+		name       string
+		extensions []string
+		rcpt, raw  string
+		want       string // the MAIL command, or "" if Send must fail with ErrUnsupported
+	}{
+		{"ascii", nil, "bob@example.com", ascii, "MAIL FROM:<alice@example.com>"},
+		{"ascii to smtputf8", []string{"8BITMIME", "SMTPUTF8"}, "bob@example.com", ascii, "MAIL FROM:<alice@example.com> BODY=8BITMIME"},
+		{"8-bit body", []string{"8BITMIME"}, "bob@example.com", body8, "MAIL FROM:<alice@example.com> BODY=8BITMIME"},
+		{"8-bit body without 8bitmime", nil, "bob@example.com", body8, ""},
+		{"utf-8 header", []string{"8BITMIME", "SMTPUTF8"}, "bob@example.com", header8, "MAIL FROM:<alice@example.com> BODY=8BITMIME SMTPUTF8"},
+		{"utf-8 header without smtputf8", []string{"8BITMIME"}, "bob@example.com", header8, ""},
+		{"utf-8 recipient", []string{"8BITMIME", "SMTPUTF8"}, utf8Rcpt, ascii, "MAIL FROM:<alice@example.com> BODY=8BITMIME SMTPUTF8"},
+		{"utf-8 recipient without smtputf8", []string{"8BITMIME"}, utf8Rcpt, ascii, ""},
+	} {
+		mock := newMockSMTPServer(t, tt.extensions...)
+		err := send(mock, tt.rcpt, tt.raw)
+		if tt.want == "" {
+			if !errors.Is(err, ErrUnsupported) {
+				t.Errorf("%s: send = %v, want ErrUnsupported", tt.name, err)
+			}
+			if cmds := mock.getCommands(); len(cmds) != 0 {
+				t.Errorf("%s: commands = %q, want none", tt.name, cmds)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: send: %v", tt.name, err)
+			continue
+		}
+		if cmds := mock.getCommands(); len(cmds) == 0 || cmds[0] != tt.want {
+			t.Errorf("%s: commands = %q, want %q first", tt.name, cmds, tt.want)
+		}
+		if msgs := mock.getReceived(); len(msgs) != 1 || !strings.Contains(msgs[0].Data, tt.raw[strings.LastIndex(tt.raw, "\n")+1:]) {
+			t.Errorf("%s: received %+v, want the message unchanged", tt.name, msgs)
+		}
+	}
+}
+
+func TestSetDSNRejectsInvalidOptions(t *testing.T) {
+	r := New("127.0.0.1", 1, "", "", false)
+	for _, tt := range []struct {
+		notify []string
+		ret    string
+	}{
+		{[]string{"sometimes"}, ""},
+		{[]string{"never", "failure"}, ""},
+		{[]string{"failure"}, "body"},
+	} {
+		if err := r.SetDSN(tt.notify, tt.ret); err == nil {
+			t.Errorf("SetDSN(%q, %q): expected error", tt.notify, tt.ret)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Sink is a Sender that delivers nothing, for staging environments
+// exercising approvals without risking real email (relay.provider blackhole
+// or file). It logs every message it is given and, with a directory, also
+// writes each there as an .eml file.
+type Sink struct {
+	dir string // where messages are written; empty only logs them
+	now func() time.Time
+
+	stampHeaders bool
+	stripHeaders []string
+}
+
+// NewSink creates a Sink writing messages to dir, created if missing, or
+// only logging them if dir is empty.
+func NewSink(dir string) (*Sink, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create sink directory: %w", err)
+		}
+	}
+	return &Sink{dir: dir, now: time.Now}, nil
+}
+
+// SetHeaderRewrite rewrites headers as Relay.SetHeaderRewrite does, so what
+// the sink keeps is what the relay would have sent.
+func (s *Sink) SetHeaderRewrite(stamp bool, strip []string) {
+	s.stampHeaders = stamp
+	s.stripHeaders = strip
+}
+
+// Preview returns the raw message as Send keeps it, with headers stamped and
+// stripped according to SetHeaderRewrite.
+func (s *Sink) Preview(email *store.Email) []byte {
+	return RewriteHeaders(email.RawMessage, email, s.stampHeaders, s.stripHeaders)
+}
+
+// Send logs email instead of delivering it and, with a directory, writes it
+// there. The file starts with the envelope, as Return-Path and one
+// X-Original-To per recipient, followed by the message as it would have been
+// relayed.
+func (s *Sink) Send(_ context.Context, email *store.Email) error {
+	raw := s.Preview(email)
+	if s.dir == "" {
+		log.Printf("Relay sink: discarded email %s from %s to %s (%d bytes)", email.ID, email.Sender, strings.Join(email.Recipients, ", "), len(raw))
+		return nil
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "Return-Path: <%s>\r\n", email.Sender)
+	for _, rcpt := range email.Recipients {
+		fmt.Fprintf(&msg, "X-Original-To: %s\r\n", rcpt)
+	}
+	msg.Write(raw)
+
+	// Written under a dot name, then renamed, so readers never see a
+	// partial message.
+	name := fmt.Sprintf("%s-%s.eml", s.now().UTC().Format("20060102T150405Z"), uuid.NewString())
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := os.WriteFile(tmp, msg.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("write to sink: %w", err)
+	}
+	path := filepath.Join(s.dir, name)
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write to sink: %w", err)
+	}
+	log.Printf("Relay sink: wrote email %s from %s to %s to %s", email.ID, email.Sender, strings.Join(email.Recipients, ", "), path)
+	return nil
+}
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestSinkWritesMessages(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sink")
+	s, err := NewSink(dir)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	s.now = func() time.Time { return time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC) }
+	s.SetHeaderRewrite(true, []string{"Received"})
+
+	email := &store.Email{
+		ID:         "e1",
+		Sender:     "app@example.com",
+		Recipients: []string{"bob@example.com", "carol@example.com"},
+		ApprovedBy: "alice",
+		RawMessage: []byte("Received: from app\r\nSubject: Staging\r\n\r\nHello\r\n"),
+	}
+	if err := s.Send(t.Context(), email); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), "20260302T100000Z-") || !strings.HasSuffix(files[0].Name(), ".eml") {
+		t.Fatalf("files = %v, want one .eml named by time", files)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	got := string(data)
+	if !strings.HasPrefix(got, "Return-Path: <app@example.com>\r\nX-Original-To: bob@example.com\r\nX-Original-To: carol@example.com\r\n") {
+		t.Errorf("message does not start with the envelope:\n%s", got)
+	}
+	if !strings.Contains(got, "X-Mailescrow-Approved-By: alice\r\n") || strings.Contains(got, "Received:") || !strings.HasSuffix(got, "Subject: Staging\r\n\r\nHello\r\n") {
+		t.Errorf("message not rewritten as the relay would:\n%s", got)
+	}
+}
+
+func TestSinkBlackhole(t *testing.T) {
+	s, err := NewSink("")
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	if err := s.Send(t.Context(), &store.Email{ID: "e1", Sender: "app@example.com", Recipients: []string{"bob@example.com"}, RawMessage: []byte("Subject: x\r\n\r\n")}); err != nil {
+		t.Errorf("send: %v", err)
+	}
+}
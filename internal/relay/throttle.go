@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// ErrThrottled is returned by Throttle.Send when sending now would exceed a
+// rate limit.
+var ErrThrottled = errors.New("relay rate limit reached")
+
+// Throttle wraps a Sender, limiting how many messages it sends per minute
+// and per hour so that a large batch of approvals does not get the account
+// banned by the upstream provider. Every send counts, whether the upstream
+// accepted it or not. The counts are kept in memory and start over when the
+// process restarts.
+//
+// A nil *Throttle never throttles.
+type Throttle struct {
+	next      Sender
+	perMinute int // 0 is no limit
+	perHour   int // 0 is no limit
+	now       func() time.Time
+
+	mu   sync.Mutex
+	sent []time.Time // sends within the last hour, oldest first
+}
+
+// ThrottleStatus describes how close a Throttle is to its limits.
+type ThrottleStatus struct {
+	PerMinute  int // limits; 0 is none
+	PerHour    int
+	LastMinute int       // messages sent in the last minute
+	LastHour   int       // messages sent in the last hour; counted only with an hourly limit
+	Until      time.Time // when sending may resume; zero if it may now
+}
+
+// NewThrottle creates a Throttle sending through next at most perMinute
+// messages per minute and perHour per hour. A limit of 0 is no limit.
+func NewThrottle(next Sender, perMinute, perHour int) (*Throttle, error) {
+	if perMinute < 0 || perHour < 0 {
+		return nil, errors.New("relay rate limits must not be negative")
+	}
+	return &Throttle{next: next, perMinute: perMinute, perHour: perHour, now: time.Now}, nil
+}
+
+// Next returns when the next message may be sent: now, or when the oldest
+// send counting against a limit that has been reached drops out of it.
+func (t *Throttle) Next(now time.Time) time.Time {
+	if t == nil {
+		return now
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.due(now)
+}
+
+// due is Next with t.mu held.
+func (t *Throttle) due(now time.Time) time.Time {
+	t.prune(now)
+	at := now
+	if n := len(t.sent); t.perMinute > 0 && n >= t.perMinute {
+		at = laterOf(at, t.sent[n-t.perMinute].Add(time.Minute))
+	}
+	if n := len(t.sent); t.perHour > 0 && n >= t.perHour {
+		at = laterOf(at, t.sent[n-t.perHour].Add(time.Hour))
+	}
+	return at
+}
+
+// Status returns the counts against each limit, and the time sending is
+// throttled until, zero if a message may be sent now.
+func (t *Throttle) Status(now time.Time) ThrottleStatus {
+	if t == nil {
+		return ThrottleStatus{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := ThrottleStatus{PerMinute: t.perMinute, PerHour: t.perHour}
+	if at := t.due(now); at.After(now) {
+		st.Until = at
+	}
+	if t.perHour > 0 {
+		st.LastHour = len(t.sent)
+	}
+	for _, at := range t.sent {
+		if now.Sub(at) < time.Minute {
+			st.LastMinute++
+		}
+	}
+	return st
+}
+
+// Send sends email if no limit has been reached, and otherwise returns an
+// error wrapping ErrThrottled without sending it.
+func (t *Throttle) Send(ctx context.Context, email *store.Email) error {
+	t.mu.Lock()
+	now := t.now()
+	if at := t.due(now); at.After(now) {
+		t.mu.Unlock()
+		return fmt.Errorf("%w, next send at %s", ErrThrottled, at.UTC().Format(time.RFC3339))
+	}
+	t.sent = append(t.sent, now)
+	t.mu.Unlock()
+	return t.next.Send(ctx, email)
+}
+
+// Preview returns the raw message as the wrapped sender transmits it.
+func (t *Throttle) Preview(email *store.Email) []byte {
+	if p, ok := t.next.(Previewer); ok {
+		return p.Preview(email)
+	}
+	return email.RawMessage
+}
+
+// prune forgets sends that no longer count against any limit.
+func (t *Throttle) prune(now time.Time) {
+	keep := time.Minute
+	if t.perHour > 0 {
+		keep = time.Hour
+	}
+	i := 0
+	for i < len(t.sent) && now.Sub(t.sent[i]) >= keep {
+		i++
+	}
+	t.sent = t.sent[i:]
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type countingSender struct{ n int }
+
+func (c *countingSender) Send(context.Context, *store.Email) error {
+	c.n++
+	return nil
+}
+
+func TestThrottleLimits(t *testing.T) {
+	next := &countingSender{}
+	th, err := NewThrottle(next, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	now := start
+	th.now = func() time.Time { return now }
+	send := func() error { return th.Send(t.Context(), &store.Email{}) }
+
+	for range 2 {
+		if err := send(); err != nil {
+			t.Fatalf("send within the limits: %v", err)
+		}
+		now = now.Add(time.Second)
+	}
+	// Two sent in the last minute: the next slot opens when the first is a
+	// minute old.
+	if err := send(); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("third send in a minute: err = %v, want ErrThrottled", err)
+	}
+	if at := th.Next(now); !at.Equal(start.Add(time.Minute)) {
+		t.Errorf("next = %v, want a minute after the first send", at)
+	}
+	st := th.Status(now)
+	if st.LastMinute != 2 || st.LastHour != 2 || !st.Until.Equal(start.Add(time.Minute)) {
+		t.Errorf("status = %+v", st)
+	}
+
+	now = start.Add(time.Minute)
+	if err := send(); err != nil {
+		t.Fatalf("send once the minute is over: %v", err)
+	}
+	// Three sent in the last hour: the hourly limit holds the next one.
+	now = start.Add(5 * time.Minute)
+	if at := th.Next(now); !at.Equal(start.Add(time.Hour)) {
+		t.Errorf("next = %v, want an hour after the first send", at)
+	}
+	now = start.Add(time.Hour)
+	if err := send(); err != nil {
+		t.Fatalf("send once the hour is over: %v", err)
+	}
+	if next.n != 4 {
+		t.Errorf("sent %d messages, want 4", next.n)
+	}
+	if st := th.Status(now.Add(2 * time.Hour)); st.LastHour != 0 || !st.Until.IsZero() {
+		t.Errorf("status after a quiet spell = %+v", st)
+	}
+}
+
+func TestThrottleNil(t *testing.T) {
+	var th *Throttle
+	now := time.Now()
+	if at := th.Next(now); !at.Equal(now) {
+		t.Errorf("nil throttle holds mail until %v", at)
+	}
+	if st := th.Status(now); st != (ThrottleStatus{}) {
+		t.Errorf("nil throttle status = %+v", st)
+	}
+	if _, err := NewThrottle(&countingSender{}, -1, 0); err == nil {
+		t.Error("negative limit accepted")
+	}
+}
@@ -0,0 +1,288 @@
+// Package reputation looks up outbound recipient domains and inbound sender
+// IP addresses in DNS block lists (URIBLs and DNSBLs) and in the operator's
+// local reputation table, so reviewers are warned about listed
+// counterparties and rules can act on them.
+package reputation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// DefaultTimeout bounds the DNS lookups for one check.
+const DefaultTimeout = 3 * time.Second
+
+// cacheTTL is how long a block list answer is reused.
+const cacheTTL = 15 * time.Minute
+
+// ListLocal is the List of a listing from the local reputation table.
+const ListLocal = "local"
+
+// Listing says a domain or IP address is on a block list.
+type Listing struct {
+	Subject string // the domain or IP address looked up
+	List    string // the block list zone, or ListLocal
+	Reason  string // the list's TXT record or the local note; may be empty
+}
+
+func (l Listing) String() string {
+	where := "listed on " + l.List
+	if l.List == ListLocal {
+		where = "blocked in the local reputation table"
+	}
+	if l.Reason == "" {
+		return fmt.Sprintf("%s is %s", l.Subject, where)
+	}
+	return fmt.Sprintf("%s is %s: %s", l.Subject, where, l.Reason)
+}
+
+// Resolver looks up block list entries. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Checker checks reputations. A nil *Checker never reports a listing.
+type Checker struct {
+	st       store.Reader
+	dnsbls   []string // IP address lists, e.g. zen.spamhaus.org
+	uribls   []string // domain lists, e.g. dbl.spamhaus.org
+	resolver Resolver
+	timeout  time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cached // by query name
+}
+
+type cached struct {
+	listed  bool
+	reason  string
+	expires time.Time
+}
+
+// New creates a Checker that consults the local reputation table in st and
+// then the given DNS block list zones.
+func New(st store.Reader, dnsbls, uribls []string) *Checker {
+	return &Checker{
+		st:       st,
+		dnsbls:   dnsbls,
+		uribls:   uribls,
+		resolver: net.DefaultResolver,
+		timeout:  DefaultTimeout,
+		now:      time.Now,
+		cache:    make(map[string]cached),
+	}
+}
+
+// CheckEmail returns the listings relevant to e: its recipient domains if it
+// is outbound, its sender's IP address (see SenderIP) if it is inbound.
+// raw is the message, needed for inbound mail only.
+func (c *Checker) CheckEmail(ctx context.Context, e *store.Email, raw []byte) []Listing {
+	if c == nil {
+		return nil
+	}
+	if e.Direction == store.DirectionInbound {
+		ip, ok := SenderIP(raw)
+		if !ok {
+			return nil
+		}
+		return c.CheckIP(ctx, ip)
+	}
+	return c.CheckRecipients(ctx, e.Recipients)
+}
+
+// CheckRecipients returns the listings of the domains of rcpts, each domain
+// checked once.
+func (c *Checker) CheckRecipients(ctx context.Context, rcpts []string) []Listing {
+	if c == nil {
+		return nil
+	}
+	var domains []string
+	for _, rcpt := range rcpts {
+		domain, err := recipients.Parse(rcpt)
+		if err != nil || strings.HasPrefix(domain, "[") {
+			continue
+		}
+		domain = strings.ToLower(domain)
+		if !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	var listings []Listing
+	for _, d := range domains {
+		listings = append(listings, c.CheckDomain(ctx, d)...)
+	}
+	return listings
+}
+
+// CheckDomain returns the listings of domain. A local entry for the domain
+// or a parent domain decides on its own; otherwise the URIBLs are queried.
+func (c *Checker) CheckDomain(ctx context.Context, domain string) []Listing {
+	if c == nil {
+		return nil
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for d := domain; strings.Contains(d, "."); {
+		if l, decided := c.local(ctx, d, domain); decided {
+			return l
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return c.query(ctx, domain, domain, c.uribls)
+}
+
+// CheckIP returns the listings of ip. A local entry decides on its own;
+// otherwise the DNSBLs are queried.
+func (c *Checker) CheckIP(ctx context.Context, ip netip.Addr) []Listing {
+	if c == nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	if l, decided := c.local(ctx, ip.String(), ip.String()); decided {
+		return l
+	}
+	return c.query(ctx, ip.String(), reverse(ip), c.dnsbls)
+}
+
+// local looks key up in the local reputation table and reports whether an
+// entry was found, and so decides subject's reputation.
+func (c *Checker) local(ctx context.Context, key, subject string) ([]Listing, bool) {
+	e, err := c.st.GetReputation(ctx, key)
+	if err != nil {
+		log.Printf("reputation: look up %s: %v", key, err)
+		return nil, false
+	}
+	if e == nil {
+		return nil, false
+	}
+	if e.Reputation != store.ReputationBlocked {
+		return nil, true
+	}
+	reason := e.Note
+	if key != subject {
+		reason = strings.TrimSuffix(key+" is blocked; "+reason, "; ")
+	}
+	return []Listing{{Subject: subject, List: ListLocal, Reason: reason}}, true
+}
+
+// query looks name up in each zone. Lookup failures other than "not
+// listed" are logged and never list the subject.
+func (c *Checker) query(ctx context.Context, subject, name string, zones []string) []Listing {
+	if len(zones) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var listings []Listing
+	for _, zone := range zones {
+		q := name + "." + strings.Trim(zone, ".")
+		r, err := c.lookup(ctx, q)
+		if err != nil {
+			log.Printf("reputation: query %s: %v", q, err)
+			continue
+		}
+		if r.listed {
+			listings = append(listings, Listing{Subject: subject, List: zone, Reason: r.reason})
+		}
+	}
+	return listings
+}
+
+func (c *Checker) lookup(ctx context.Context, q string) (cached, error) {
+	now := c.now()
+	c.mu.Lock()
+	r, ok := c.cache[q]
+	c.mu.Unlock()
+	if ok && now.Before(r.expires) {
+		return r, nil
+	}
+
+	addrs, err := c.resolver.LookupHost(ctx, q)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		r = cached{}
+	case err != nil:
+		return cached{}, err
+	default:
+		// Lists answer with an address in 127.0.0.0/8; 127.255.255.0/24 is
+		// how Spamhaus reports a refused query rather than a listing.
+		for _, a := range addrs {
+			ip, err := netip.ParseAddr(a)
+			if err == nil && ip.Is4() && ip.As4()[0] == 127 && !(ip.As4()[1] == 255 && ip.As4()[2] == 255) {
+				r.listed = true
+			}
+		}
+		if !r.listed {
+			return cached{}, fmt.Errorf("unexpected answer %v", addrs)
+		}
+		if txt, err := c.resolver.LookupTXT(ctx, q); err == nil {
+			r.reason = strings.Join(txt, " ")
+		}
+	}
+	r.expires = now.Add(cacheTTL)
+	c.mu.Lock()
+	c.cache[q] = r
+	c.mu.Unlock()
+	return r, nil
+}
+
+// reverse returns ip in DNSBL query form: octets (IPv4) or nibbles (IPv6)
+// in reverse order, dot-separated.
+func reverse(ip netip.Addr) string {
+	b := ip.AsSlice()
+	var parts []string
+	for i := len(b) - 1; i >= 0; i-- {
+		if ip.Is4() {
+			parts = append(parts, fmt.Sprint(b[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%x", b[i]&0xf), fmt.Sprintf("%x", b[i]>>4))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// receivedFrom matches the bracketed client address in the from clause of a
+// Received header, e.g. "from mx.example.org (mx.example.org [192.0.2.1])".
+var receivedFrom = regexp.MustCompile(`(?i)^\s*from\s[^;]*?\[(?:IPv6:)?([0-9a-f.:]+)\]`)
+
+// SenderIP returns the address of the client that handed raw to the first
+// mail server on the way to the mailbox: the first public address in the
+// from clauses of the Received headers, newest first.
+func SenderIP(raw []byte) (netip.Addr, bool) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	for _, h := range msg.Header["Received"] {
+		m := receivedFrom.FindStringSubmatch(h)
+		if m == nil {
+			continue
+		}
+		ip, err := netip.ParseAddr(m[1])
+		if err != nil {
+			continue
+		}
+		ip = ip.Unmap()
+		if ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,178 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeResolver struct {
+	hosts   map[string][]string
+	txt     map[string][]string
+	queries []string
+}
+
+func (f *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	f.queries = append(f.queries, host)
+	if host == "fail.example" || strings.HasSuffix(host, ".broken.example") {
+		return nil, errors.New("server failure")
+	}
+	if addrs, ok := f.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (f *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return f.txt[name], nil
+}
+
+func newChecker(t *testing.T, dnsbls, uribls []string) (*Checker, *fakeResolver, store.EmailStore) {
+	t.Helper()
+	st := store.NewMemory()
+	c := New(st, dnsbls, uribls)
+	r := &fakeResolver{
+		hosts: map[string][]string{
+			"spam.example.dbl.example":    {"127.0.1.2"},
+			"refused.example.dbl.example": {"127.255.255.254"},
+			"1.2.0.192.zen.example":       {"127.0.0.2"},
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example": {"127.0.0.3"},
+		},
+		txt: map[string][]string{
+			"1.2.0.192.zen.example": {"https://example.org/lookup?ip=192.0.2.1"},
+		},
+	}
+	c.resolver = r
+	return c, r, st
+}
+
+func TestCheckDomain(t *testing.T) {
+	c, r, st := newChecker(t, nil, []string{"dbl.example", "broken.example"})
+	ctx := t.Context()
+
+	got := c.CheckDomain(ctx, "Spam.Example")
+	if len(got) != 1 || got[0].Subject != "spam.example" || got[0].List != "dbl.example" {
+		t.Errorf("listed domain = %+v, want one dbl.example listing", got)
+	}
+	if got := c.CheckDomain(ctx, "clean.example"); got != nil {
+		t.Errorf("clean domain = %+v, want none", got)
+	}
+	if got := c.CheckDomain(ctx, "refused.example"); got != nil {
+		t.Errorf("refused query = %+v, want none", got)
+	}
+
+	// Answers are cached.
+	n := len(r.queries)
+	c.CheckDomain(ctx, "spam.example")
+	if len(r.queries) != n+1 { // broken.example is never cached
+		t.Errorf("repeat check made %d queries, want 1", len(r.queries)-n)
+	}
+
+	// A local entry for a parent domain decides without the lists.
+	if err := st.SetReputation(ctx, store.ReputationEntry{Subject: "spam.example", Reputation: store.ReputationTrusted}); err != nil {
+		t.Fatalf("set reputation: %v", err)
+	}
+	if got := c.CheckDomain(ctx, "spam.example"); got != nil {
+		t.Errorf("trusted domain = %+v, want none", got)
+	}
+	if err := st.SetReputation(ctx, store.ReputationEntry{Subject: "phish.example", Reputation: store.ReputationBlocked, Note: "phishing"}); err != nil {
+		t.Fatalf("set reputation: %v", err)
+	}
+	got = c.CheckDomain(ctx, "login.phish.example")
+	if len(got) != 1 || got[0].List != ListLocal || got[0].Subject != "login.phish.example" || !strings.Contains(got[0].Reason, "phishing") {
+		t.Errorf("subdomain of blocked domain = %+v, want a local listing", got)
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	c, _, st := newChecker(t, []string{"zen.example"}, nil)
+	ctx := t.Context()
+
+	got := c.CheckIP(ctx, netip.MustParseAddr("192.0.2.1"))
+	if len(got) != 1 || got[0].Reason != "https://example.org/lookup?ip=192.0.2.1" {
+		t.Errorf("listed IPv4 = %+v, want a listing with the TXT reason", got)
+	}
+	if got := c.CheckIP(ctx, netip.MustParseAddr("2001:db8::1")); len(got) != 1 {
+		t.Errorf("listed IPv6 = %+v, want one listing", got)
+	}
+	if got := c.CheckIP(ctx, netip.MustParseAddr("192.0.2.2")); got != nil {
+		t.Errorf("clean IP = %+v, want none", got)
+	}
+
+	if err := st.SetReputation(ctx, store.ReputationEntry{Subject: "192.0.2.2", Reputation: store.ReputationBlocked}); err != nil {
+		t.Fatalf("set reputation: %v", err)
+	}
+	got = c.CheckIP(ctx, netip.MustParseAddr("192.0.2.2"))
+	if len(got) != 1 || got[0].String() != "192.0.2.2 is blocked in the local reputation table" {
+		t.Errorf("locally blocked IP = %+v", got)
+	}
+}
+
+func TestCheckEmail(t *testing.T) {
+	c, _, _ := newChecker(t, []string{"zen.example"}, []string{"dbl.example"})
+	ctx := t.Context()
+
+	out := &store.Email{Direction: store.DirectionOutbound, Recipients: []string{"a@spam.example", "b@SPAM.example", "c@clean.example"}}
+	if got := c.CheckEmail(ctx, out, nil); len(got) != 1 || got[0].Subject != "spam.example" {
+		t.Errorf("outbound = %+v, want spam.example listed once", got)
+	}
+
+	raw := []byte("Received: from mx.local ([10.0.0.5]) by imap.example.org; Mon, 2 Mar 2026 10:00:00 +0000\r\n" +
+		"Received: from mail.sender.example (mail.sender.example [192.0.2.1]) by mx.example.org; Mon, 2 Mar 2026 09:59:59 +0000\r\n" +
+		"From: a@sender.example\r\n\r\nHi\r\n")
+	in := &store.Email{Direction: store.DirectionInbound}
+	if got := c.CheckEmail(ctx, in, raw); len(got) != 1 || got[0].Subject != "192.0.2.1" {
+		t.Errorf("inbound = %+v, want the sender IP listed", got)
+	}
+
+	var nilChecker *Checker
+	if got := nilChecker.CheckEmail(ctx, out, nil); got != nil {
+		t.Errorf("nil checker = %+v, want none", got)
+	}
+}
+
+func TestSenderIP(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"public", "Received: from a (a [198.51.100.7]) by b; Mon, 2 Mar 2026 10:00:00 +0000\r\n\r\n", "198.51.100.7"},
+		{"skips private hops", "Received: from x ([127.0.0.1]) by y\r\nReceived: from z (z [IPv6:2001:db8::25]) by mx\r\n\r\n", "2001:db8::25"},
+		{"no from clause", "Received: by mx.example.org; Mon, 2 Mar 2026 10:00:00 +0000\r\n\r\n", ""},
+		{"no received", "From: a@example.com\r\n\r\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, ok := SenderIP([]byte(tt.raw))
+			if tt.want == "" {
+				if ok {
+					t.Errorf("SenderIP = %s, want none", ip)
+				}
+				return
+			}
+			if !ok || ip.String() != tt.want {
+				t.Errorf("SenderIP = %s, %v; want %s", ip, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	c, r, _ := newChecker(t, nil, []string{"dbl.example"})
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	c.CheckDomain(t.Context(), "spam.example")
+	c.CheckDomain(t.Context(), "spam.example")
+	now = now.Add(cacheTTL)
+	c.CheckDomain(t.Context(), "spam.example")
+	if len(r.queries) != 2 {
+		t.Errorf("made %d queries, want 2 (one cached)", len(r.queries))
+	}
+}
@@ -0,0 +1,137 @@
+// Package retention deletes records once they are older than their configured
+// retention period, so the database does not grow forever.
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/trends"
+)
+
+// Policy is how long each kind of record is kept. Zero keeps it forever.
+type Policy struct {
+	History  time.Duration // reviewer decisions, copies of relayed mail and reviewers' edits
+	Rejected time.Duration // decisions to reject, usually shorter than History
+	Audit    time.Duration // audit log entries
+}
+
+// Enabled reports whether any record is ever purged.
+func (p Policy) Enabled() bool {
+	return p.History > 0 || p.Rejected > 0 || p.Audit > 0
+}
+
+// Purger applies a Policy to the store. Only the store's owner creates one,
+// as purging also vacuums the database.
+type Purger struct {
+	st  store.EmailStore
+	now func() time.Time
+
+	mu     sync.Mutex // guards policy, which a reload may replace
+	policy Policy
+}
+
+// New creates a Purger.
+func New(st store.EmailStore, policy Policy) *Purger {
+	return &Purger{st: st, policy: policy, now: time.Now}
+}
+
+// SetPolicy replaces the policy. It applies from the next purge.
+func (p *Purger) SetPolicy(policy Policy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policy = policy
+}
+
+// Run purges every interval until ctx is cancelled. While the policy is not
+// Enabled, nothing is purged.
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	p.mu.Lock()
+	policy := p.policy
+	p.mu.Unlock()
+	log.Printf("Retention purge started (history: %s, rejected: %s, audit: %s, interval: %s)",
+		policy.History, policy.Rejected, policy.Audit, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Purge(ctx); err != nil {
+			log.Printf("Retention purge: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge deletes every expired record, then vacuums the database if anything
+// was deleted. The finished days are rolled up into the daily stats first,
+// so the records still count towards them. It stops at the first error.
+func (p *Purger) Purge(ctx context.Context) error {
+	p.mu.Lock()
+	policy := p.policy
+	p.mu.Unlock()
+	if !policy.Enabled() {
+		return nil
+	}
+	now := p.now()
+	if _, err := trends.RollUp(ctx, p.st, now); err != nil {
+		return fmt.Errorf("roll up daily stats: %w", err)
+	}
+	total := 0
+	purge := func(record string, keep time.Duration, prune func(before time.Time) (int, error)) error {
+		if keep <= 0 {
+			return nil
+		}
+		n, err := prune(now.Add(-keep))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Retention: deleted %d %s records older than %s", n, record, keep)
+			metrics.RetentionPurged.Add(float64(n), record)
+		}
+		total += n
+		return nil
+	}
+
+	if err := purge("rejected", policy.Rejected, func(before time.Time) (int, error) {
+		return p.st.PruneDecisions(ctx, store.DecisionRejected, before)
+	}); err != nil {
+		return err
+	}
+	if err := purge("history", policy.History, func(before time.Time) (int, error) {
+		return p.st.PruneDecisions(ctx, "", before)
+	}); err != nil {
+		return err
+	}
+	if err := purge("sent", policy.History, func(before time.Time) (int, error) {
+		return p.st.PruneSent(ctx, before)
+	}); err != nil {
+		return err
+	}
+	if err := purge("edits", policy.History, func(before time.Time) (int, error) {
+		return p.st.PruneEdits(ctx, before)
+	}); err != nil {
+		return err
+	}
+	if err := purge("audit", policy.Audit, func(before time.Time) (int, error) {
+		return p.st.PruneAudit(ctx, before)
+	}); err != nil {
+		return err
+	}
+
+	if total > 0 {
+		if err := p.st.Vacuum(ctx); err != nil {
+			return fmt.Errorf("after deleting %d records: %w", total, err)
+		}
+	}
+	return nil
+}
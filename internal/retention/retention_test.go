@@ -0,0 +1,132 @@
+package retention
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestPurge(t *testing.T) {
+	st := newTestStore(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	ctx := t.Context()
+
+	for _, d := range []store.Decision{
+		{EmailID: "approved-60d", Decision: store.DecisionApproved, DecidedAt: now.AddDate(0, 0, -60)},
+		{EmailID: "rejected-60d", Decision: store.DecisionRejected, DecidedAt: now.AddDate(0, 0, -60)},
+		{EmailID: "approved-100d", Decision: store.DecisionApproved, DecidedAt: now.AddDate(0, 0, -100)},
+		{EmailID: "rejected-10d", Decision: store.DecisionRejected, DecidedAt: now.AddDate(0, 0, -10)},
+	} {
+		if err := st.RecordDecision(ctx, d); err != nil {
+			t.Fatalf("record decision: %v", err)
+		}
+	}
+	for _, age := range []int{400, 100} {
+		if err := st.RecordAudit(ctx, store.AuditEntry{At: now.AddDate(0, 0, -age), Actor: "alice", Action: "token.create"}); err != nil {
+			t.Fatalf("record audit: %v", err)
+		}
+	}
+	for _, age := range []int{100, 60} {
+		m := store.SentMessage{MessageID: fmt.Sprintf("<%dd@example.com>", age), SentAt: now.AddDate(0, 0, -age)}
+		if err := st.RecordSent(ctx, m); err != nil {
+			t.Fatalf("record sent: %v", err)
+		}
+	}
+	var edited []string
+	for _, age := range []int{100, 60} {
+		id, err := st.SaveOutbound(ctx, "me@example.com", []string{"bob@example.org"}, "Quote", "", []byte("Subject: Quote\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		e := store.Edit{EmailID: id, Reviewer: "alice", EditedAt: now.AddDate(0, 0, -age), After: store.EditedFields{Subject: "Revised quote"}}
+		if err := st.EditEmail(ctx, e, []byte("Subject: Revised quote\r\n\r\n"), 0); err != nil {
+			t.Fatalf("edit: %v", err)
+		}
+		edited = append(edited, id)
+	}
+
+	p := New(st, Policy{History: 90 * 24 * time.Hour, Rejected: 30 * 24 * time.Hour, Audit: 365 * 24 * time.Hour})
+	p.now = func() time.Time { return now }
+	before := metrics.RetentionPurged.Value("rejected")
+	if err := p.Purge(ctx); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+
+	decisions, _ := st.ListDecisions(ctx, 10)
+	var ids []string
+	for _, d := range decisions {
+		ids = append(ids, d.EmailID)
+	}
+	if len(ids) != 2 || ids[0] != "rejected-10d" || ids[1] != "approved-60d" {
+		t.Errorf("remaining decisions = %v, want [rejected-10d approved-60d]", ids)
+	}
+	if entries, _ := st.ListAudit(ctx, 10); len(entries) != 1 {
+		t.Errorf("remaining audit entries = %d, want 1", len(entries))
+	}
+	if m, _ := st.GetSent(ctx, "<100d@example.com>"); m != nil {
+		t.Error("sent message older than the history retention kept")
+	}
+	if m, _ := st.GetSent(ctx, "<60d@example.com>"); m == nil {
+		t.Error("recent sent message purged")
+	}
+	if edits, _ := st.ListEdits(ctx, edited); len(edits) != 1 || edits[0].EmailID != edited[1] {
+		t.Errorf("remaining edits = %+v, want the recent one", edits)
+	}
+	if got := metrics.RetentionPurged.Value("rejected") - before; got != 1 {
+		t.Errorf("rejected purged = %v, want 1", got)
+	}
+	// The purged decisions were rolled up into the daily stats first.
+	stats, err := st.ListDailyStats(ctx, now.AddDate(0, 0, -100))
+	if err != nil {
+		t.Fatalf("list daily stats: %v", err)
+	}
+	if len(stats) != 100 {
+		t.Fatalf("daily stats = %d days, want every day up to yesterday", len(stats))
+	}
+	if d := stats[59]; d.Approved != 1 || d.Rejected != 1 {
+		t.Errorf("daily stats 60 days ago = %+v, want 1 approved and 1 rejected", d)
+	}
+	if d := stats[99]; d.Approved != 1 {
+		t.Errorf("daily stats 100 days ago = %+v, want 1 approved", d)
+	}
+}
+
+func TestZeroPolicyKeepsEverything(t *testing.T) {
+	st := newTestStore(t)
+	if err := st.RecordDecision(t.Context(), store.Decision{EmailID: "ancient", Decision: store.DecisionRejected, DecidedAt: time.Unix(0, 0)}); err != nil {
+		t.Fatalf("record decision: %v", err)
+	}
+	if (Policy{}).Enabled() {
+		t.Error("zero policy should be disabled")
+	}
+	if err := New(st, Policy{}).Purge(t.Context()); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if decisions, _ := st.ListDecisions(t.Context(), 10); len(decisions) != 1 {
+		t.Errorf("zero policy deleted decisions")
+	}
+
+	// A policy set later applies from the next purge.
+	p := New(st, Policy{})
+	p.SetPolicy(Policy{Rejected: 24 * time.Hour})
+	if err := p.Purge(t.Context()); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if decisions, _ := st.ListDecisions(t.Context(), 10); len(decisions) != 0 {
+		t.Errorf("decisions after setting a policy = %d, want 0", len(decisions))
+	}
+}
@@ -0,0 +1,261 @@
+// Package reviewmail emails reviewers a summary of the pending queue when new
+// mail is held for review, or while the queue is longer than a threshold.
+//
+// Notifications go straight through the relay and are never held themselves.
+// Should one come back into escrow anyway, say because a reviewer address is
+// the monitored mailbox, it is recognised by its header and triggers no
+// other; and at most one notification is sent per interval. Auto-replies
+// (tagged autoreply.Tag) are left out: they neither trigger a notification
+// nor count towards the threshold.
+package reviewmail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/albert/mailescrow/internal/autoreply"
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Header marks the notifications sent by a Notifier.
+const Header = "X-Mailescrow-Notification"
+
+// maxListed is how many new emails a notification lists; the rest are
+// counted.
+const maxListed = 20
+
+// DefaultCheckInterval is how often Run checks the queue unless overridden.
+const DefaultCheckInterval = time.Minute
+
+// Notifier checks the pending queue and emails reviewers about it.
+type Notifier struct {
+	st       store.Reader
+	sender   relay.Sender
+	fromAddr string
+	fromName string
+	link     string // the web UI's pending queue; may be empty
+	now      func() time.Time
+
+	mu         sync.Mutex
+	to         []string        // empty sends nothing; replaced by SetReviewers on a configuration reload
+	threshold  int             // also notify while more than this many are pending; 0 disables
+	interval   time.Duration   // minimum time between two notifications
+	checkEvery time.Duration   // how often Run checks the queue
+	seeded     bool            // whether the first check has run
+	seen       map[string]bool // pending emails already notified about, or ignored
+	lastSent   time.Time
+}
+
+// New creates a Notifier sending to the reviewer addresses to from fromAddr,
+// at most once per interval. A positive threshold also sends a reminder
+// every interval while more than threshold emails are pending. link, if not
+// empty, is included for reviewers to open the queue. With no addresses it
+// sends nothing until SetReviewers sets some.
+func New(st store.Reader, sender relay.Sender, fromAddr, fromName string, to []string, threshold int, interval time.Duration, link string) *Notifier {
+	return &Notifier{
+		st:         st,
+		sender:     sender,
+		fromAddr:   fromAddr,
+		fromName:   fromName,
+		to:         to,
+		link:       link,
+		now:        time.Now,
+		threshold:  threshold,
+		interval:   interval,
+		checkEvery: DefaultCheckInterval,
+		seen:       make(map[string]bool),
+	}
+}
+
+// SetReviewers replaces who is notified, the threshold and the interval, as
+// in New, e.g. on a configuration reload. Empty to stops the notifications.
+func (n *Notifier) SetReviewers(to []string, threshold int, interval time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.to, n.threshold, n.interval = to, threshold, interval
+}
+
+// SetCheckInterval sets how often Run checks the queue, from the next check
+// on. d <= 0 keeps the default.
+func (n *Notifier) SetCheckInterval(d time.Duration) {
+	if d <= 0 {
+		d = DefaultCheckInterval
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.checkEvery = d
+}
+
+// Run checks the queue every check interval until ctx is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	n.mu.Lock()
+	if len(n.to) > 0 {
+		log.Printf("Reviewer notifications started (to: %s, threshold: %d, at most every %s)", strings.Join(n.to, ", "), n.threshold, n.interval)
+	}
+	n.mu.Unlock()
+
+	for {
+		if err := n.Check(ctx); err != nil {
+			log.Printf("reviewer notification: %v", err)
+		}
+		n.mu.Lock()
+		timer := time.NewTimer(n.checkEvery)
+		n.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Check emails the reviewers if mail was held since the last notification,
+// or if the queue is longer than the threshold, unless a notification was
+// sent less than an interval ago. Mail already pending on the first check is
+// taken as known, as is mail held while there was no one to notify. If
+// sending fails, the new mail is included next time.
+func (n *Notifier) Check(ctx context.Context) error {
+	n.mu.Lock()
+	if len(n.to) == 0 {
+		n.seeded = false
+		n.mu.Unlock()
+		return nil
+	}
+	n.mu.Unlock()
+	pending, err := n.st.ListPendingSummaries(ctx)
+	if err != nil {
+		return fmt.Errorf("list pending: %w", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.to) == 0 {
+		return nil // stopped meanwhile
+	}
+
+	stillPending := make(map[string]bool, len(pending))
+	var fresh []store.Email
+	total := 0
+	for _, e := range pending {
+		stillPending[e.ID] = true
+		if slices.Contains(e.Tags, autoreply.Tag) {
+			continue
+		}
+		total++
+		if !n.seeded || n.seen[e.ID] {
+			n.seen[e.ID] = true
+			continue
+		}
+		if n.ownNotification(ctx, e) {
+			n.seen[e.ID] = true
+			continue
+		}
+		fresh = append(fresh, e)
+	}
+	n.seeded = true
+	// Forget emails that have since been approved or rejected.
+	for id := range n.seen {
+		if !stillPending[id] {
+			delete(n.seen, id)
+		}
+	}
+
+	over := n.threshold > 0 && total > n.threshold
+	if len(fresh) == 0 && !over {
+		return nil
+	}
+	if n.now().Sub(n.lastSent) < n.interval {
+		return nil
+	}
+	if err := n.send(ctx, fresh, total); err != nil {
+		return fmt.Errorf("send to %s: %w", strings.Join(n.to, ", "), err)
+	}
+	n.lastSent = n.now()
+	for _, e := range fresh {
+		n.seen[e.ID] = true
+	}
+	log.Printf("Notified reviewers of %d new and %d pending emails", len(fresh), total)
+	return nil
+}
+
+// ownNotification reports whether e is a notification this Notifier sent
+// that came back into escrow.
+func (n *Notifier) ownNotification(ctx context.Context, e store.Email) bool {
+	if !strings.EqualFold(e.Sender, n.fromAddr) {
+		return false
+	}
+	full, err := n.st.Get(ctx, e.ID)
+	if err != nil {
+		return false
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(full.RawMessage))
+	return err == nil && msg.Header.Get(Header) != ""
+}
+
+// send emails the reviewers a summary: the new emails, oldest first, and the
+// length of the queue.
+func (n *Notifier) send(ctx context.Context, fresh []store.Email, total int) error {
+	var subject string
+	var body strings.Builder
+	switch len(fresh) {
+	case 0:
+		subject = fmt.Sprintf("%d emails waiting for review", total)
+		fmt.Fprintf(&body, "%d emails are waiting for review, more than the %d expected.\n", total, n.threshold)
+	case 1:
+		subject = "1 new email waiting for review"
+		fmt.Fprintf(&body, "1 new email was held for review; %d pending in total.\n", total)
+	default:
+		subject = fmt.Sprintf("%d new emails waiting for review", len(fresh))
+		fmt.Fprintf(&body, "%d new emails were held for review; %d pending in total.\n", len(fresh), total)
+	}
+	if len(fresh) > 0 {
+		body.WriteString("\n")
+		tw := tabwriter.NewWriter(&body, 0, 0, 2, ' ', 0)
+		for _, e := range fresh[:min(len(fresh), maxListed)] {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", e.ReceivedAt.UTC().Format("2006-01-02 15:04 MST"), e.Direction, e.Sender, e.Subject)
+		}
+		_ = tw.Flush()
+		if len(fresh) > maxListed {
+			fmt.Fprintf(&body, "  … and %d more\n", len(fresh)-maxListed)
+		}
+	}
+	if n.link != "" {
+		fmt.Fprintf(&body, "\nReview the queue: %s\n", n.link)
+	}
+	subject = "[mailescrow] " + subject
+
+	from := (&mail.Address{Name: n.fromName, Address: n.fromAddr}).String()
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "Date: %s\r\n", n.now().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(&raw, "Message-Id: <%s@mailescrow>\r\n", uuid.New().String())
+	fmt.Fprintf(&raw, "From: %s\r\n", from)
+	fmt.Fprintf(&raw, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	raw.WriteString("Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&raw, "%s: pending\r\n", Header)
+	raw.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	raw.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+	return n.sender.Send(ctx, &store.Email{
+		ID:         uuid.New().String(),
+		Direction:  store.DirectionOutbound,
+		Sender:     n.fromAddr,
+		Recipients: n.to,
+		Subject:    subject,
+		Body:       body.String(),
+		RawMessage: raw.Bytes(),
+	})
+}
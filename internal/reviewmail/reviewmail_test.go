@@ -0,0 +1,246 @@
+package reviewmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/autoreply"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeSender struct {
+	sent []*store.Email
+	err  error
+}
+
+func (f *fakeSender) Send(_ context.Context, email *store.Email) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, email)
+	return nil
+}
+
+// clock is a settable time for Notifier.now.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newNotifier(st store.Reader, sender *fakeSender, threshold int) (*Notifier, *clock) {
+	c := &clock{t: time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)}
+	n := New(st, sender, "escrow@example.com", "mailescrow", []string{"reviewers@example.com"}, threshold, 15*time.Minute, "https://escrow.example.com/")
+	n.now = c.now
+	return n, c
+}
+
+func check(t *testing.T, n *Notifier) {
+	t.Helper()
+	if err := n.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+}
+
+func TestNotifiesOfNewMail(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	if _, err := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, "Held before start", "b", []byte("raw")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	sender := &fakeSender{}
+	n, c := newNotifier(st, sender, 0)
+
+	// Mail pending at startup is not news.
+	check(t, n)
+	if len(sender.sent) != 0 {
+		t.Fatalf("sent %d notifications at startup, want none", len(sender.sent))
+	}
+
+	if _, err := st.SaveInbound(ctx, "alice@example.com", []string{"ops@example.com"}, "Invoice", "b", []byte("raw"), "", "", ""); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	check(t, n)
+	if len(sender.sent) != 1 {
+		t.Fatalf("sent %d notifications, want 1", len(sender.sent))
+	}
+	email := sender.sent[0]
+	if email.Subject != "[mailescrow] 1 new email waiting for review" || email.Recipients[0] != "reviewers@example.com" || email.Direction != store.DirectionOutbound {
+		t.Errorf("notification = %+v", email)
+	}
+	if !strings.Contains(email.Body, "alice@example.com") || strings.Contains(email.Body, "Held before start") || !strings.Contains(email.Body, "2 pending in total") || !strings.Contains(email.Body, "https://escrow.example.com/") {
+		t.Errorf("body = %q", email.Body)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(email.RawMessage))
+	if err != nil {
+		t.Fatalf("parse notification: %v", err)
+	}
+	if msg.Header.Get(Header) == "" || msg.Header.Get("Auto-Submitted") != "auto-generated" {
+		t.Errorf("headers = %v", msg.Header)
+	}
+
+	// Nothing new: nothing sent.
+	c.t = c.t.Add(time.Hour)
+	check(t, n)
+	if len(sender.sent) != 1 {
+		t.Errorf("sent %d notifications without new mail, want 1", len(sender.sent))
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	sender := &fakeSender{}
+	n, c := newNotifier(st, sender, 0)
+	check(t, n)
+
+	save := func(subject string) {
+		t.Helper()
+		if _, err := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, subject, "b", []byte("raw")); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	save("First")
+	check(t, n)
+	save("Second")
+	save("Third")
+	c.t = c.t.Add(5 * time.Minute)
+	check(t, n)
+	if len(sender.sent) != 1 {
+		t.Fatalf("sent %d notifications within the interval, want 1", len(sender.sent))
+	}
+
+	// Once the interval has passed, the mail held meanwhile is reported.
+	c.t = c.t.Add(15 * time.Minute)
+	check(t, n)
+	if len(sender.sent) != 2 || sender.sent[1].Subject != "[mailescrow] 2 new emails waiting for review" {
+		t.Fatalf("notifications = %d, want a second one for 2 emails", len(sender.sent))
+	}
+}
+
+func TestIgnoresOwnNotifications(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	sender := &fakeSender{}
+	n, c := newNotifier(st, sender, 0)
+	check(t, n)
+
+	// A notification delivered to the monitored mailbox is held as inbound mail.
+	raw := "From: mailescrow <escrow@example.com>\r\nSubject: [mailescrow] 1 new email waiting for review\r\n" + Header + ": pending\r\n\r\nbody\r\n"
+	if _, err := st.SaveInbound(ctx, "escrow@example.com", []string{"reviewers@example.com"}, "[mailescrow] 1 new email waiting for review", "body", []byte(raw), "", "", ""); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	c.t = c.t.Add(time.Hour)
+	check(t, n)
+	if len(sender.sent) != 0 {
+		t.Errorf("sent %d notifications about a notification, want none", len(sender.sent))
+	}
+}
+
+func TestIgnoresAutoReplies(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	sender := &fakeSender{}
+	n, c := newNotifier(st, sender, 1)
+	check(t, n)
+
+	for range 2 {
+		id, err := st.SaveInbound(ctx, "away@example.com", []string{"ops@example.com"}, "Out of office", "b", []byte("raw"), "", "", "")
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		if err := st.AddTag(ctx, id, autoreply.Tag); err != nil {
+			t.Fatalf("tag: %v", err)
+		}
+	}
+	c.t = c.t.Add(time.Hour)
+	check(t, n)
+	if len(sender.sent) != 0 {
+		t.Fatalf("sent %d notifications about auto-replies, want none", len(sender.sent))
+	}
+
+	if _, err := st.SaveInbound(ctx, "alice@example.com", []string{"ops@example.com"}, "Invoice", "b", []byte("raw"), "", "", ""); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	check(t, n)
+	if len(sender.sent) != 1 || strings.Contains(sender.sent[0].Body, "away@example.com") || !strings.Contains(sender.sent[0].Body, "1 pending in total") {
+		t.Errorf("notifications = %+v, want one about alice's email alone", sender.sent)
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	for range 3 {
+		if _, err := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, "Queued", "b", []byte("raw")); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	sender := &fakeSender{}
+	n, c := newNotifier(st, sender, 2)
+
+	// Over the threshold, reviewers are reminded every interval.
+	check(t, n)
+	c.t = c.t.Add(time.Minute)
+	check(t, n)
+	if len(sender.sent) != 1 || sender.sent[0].Subject != "[mailescrow] 3 emails waiting for review" {
+		t.Fatalf("notifications = %+v, want one reminder", sender.sent)
+	}
+	c.t = c.t.Add(15 * time.Minute)
+	check(t, n)
+	if len(sender.sent) != 2 {
+		t.Errorf("sent %d notifications, want a second reminder", len(sender.sent))
+	}
+}
+
+func TestRetriesAfterSendFailure(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	sender := &fakeSender{err: errors.New("421 try again later")}
+	n, _ := newNotifier(st, sender, 0)
+	check(t, n)
+
+	if _, err := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, "Held", "b", []byte("raw")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := n.Check(ctx); err == nil {
+		t.Fatal("expected the send failure to be returned")
+	}
+	sender.err = nil
+	check(t, n)
+	if len(sender.sent) != 1 || !strings.Contains(sender.sent[0].Body, "Held") {
+		t.Errorf("notifications = %+v, want the held email reported after the failure", sender.sent)
+	}
+}
+
+func TestSetReviewers(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	sender := &fakeSender{}
+	n, c := newNotifier(st, sender, 0)
+	n.SetReviewers(nil, 0, 15*time.Minute)
+	check(t, n)
+
+	// Mail held while there is no one to notify is not news once there is.
+	if _, err := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, "Unnoticed", "b", []byte("raw")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	check(t, n)
+	n.SetReviewers([]string{"oncall@example.com"}, 0, 15*time.Minute)
+	check(t, n)
+	if len(sender.sent) != 0 {
+		t.Fatalf("sent %+v, want nothing for mail held before there were reviewers", sender.sent)
+	}
+
+	if _, err := st.SaveOutbound(ctx, "app@example.com", []string{"bob@example.com"}, "Noticed", "b", []byte("raw")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	c.t = c.t.Add(time.Minute)
+	check(t, n)
+	if len(sender.sent) != 1 || sender.sent[0].Recipients[0] != "oncall@example.com" || !strings.Contains(sender.sent[0].Body, "Noticed") {
+		t.Errorf("notifications = %+v, want one to oncall about the new email", sender.sent)
+	}
+}
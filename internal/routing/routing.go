@@ -0,0 +1,44 @@
+// Package routing assigns inbound emails to named consumer queues based on
+// their recipient addresses.
+package routing
+
+import (
+	"path"
+	"strings"
+)
+
+// DefaultQueue receives inbound mail that matches no route.
+const DefaultQueue = "default"
+
+// Route maps recipient addresses matching Match to Queue. Match is a
+// case-insensitive glob over the full address, e.g. "support@example.com",
+// "support@*" or "*@billing.example.com".
+type Route struct {
+	Match string
+	Queue string
+}
+
+// Router picks a queue for an inbound email.
+type Router struct {
+	routes []Route
+}
+
+// New creates a Router. Routes are evaluated in order; the first match wins.
+func New(routes []Route) *Router {
+	return &Router{routes: routes}
+}
+
+// Queue returns the queue for the first route matching any of recipients, or
+// DefaultQueue if none match. Recipients are tried in order for each route, so
+// route order takes precedence over recipient order.
+func (r *Router) Queue(recipients []string) string {
+	for _, route := range r.routes {
+		pattern := strings.ToLower(route.Match)
+		for _, rcpt := range recipients {
+			if ok, _ := path.Match(pattern, strings.ToLower(rcpt)); ok {
+				return route.Queue
+			}
+		}
+	}
+	return DefaultQueue
+}
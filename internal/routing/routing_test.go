@@ -0,0 +1,36 @@
+package routing
+
+import "testing"
+
+func TestQueue(t *testing.T) {
+	r := New([]Route{
+		{Match: "support@example.com", Queue: "support"},
+		{Match: "*@billing.example.com", Queue: "billing"},
+		{Match: "sales@*", Queue: "sales"},
+	})
+
+	tests := []struct {
+		recipients []string
+		want       string
+	}{
+		{[]string{"support@example.com"}, "support"},
+		{[]string{"Support@Example.com"}, "support"},
+		{[]string{"invoices@billing.example.com"}, "billing"},
+		{[]string{"sales@other.org"}, "sales"},
+		{[]string{"nobody@example.com"}, DefaultQueue},
+		{nil, DefaultQueue},
+		// Route order wins over recipient order.
+		{[]string{"sales@x.org", "support@example.com"}, "support"},
+	}
+	for _, tt := range tests {
+		if got := r.Queue(tt.recipients); got != tt.want {
+			t.Errorf("Queue(%v) = %q, want %q", tt.recipients, got, tt.want)
+		}
+	}
+}
+
+func TestQueueNoRoutes(t *testing.T) {
+	if got := New(nil).Queue([]string{"a@example.com"}); got != DefaultQueue {
+		t.Errorf("Queue = %q, want %q", got, DefaultQueue)
+	}
+}
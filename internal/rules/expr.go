@@ -0,0 +1,160 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cel.dev/cel-go/cel"
+	celast "cel.dev/cel-go/common/ast"
+	"cel.dev/cel-go/common/operators"
+	"cel.dev/cel-go/common/types"
+	"cel.dev/cel-go/ext"
+)
+
+// A rule's When is a CEL expression (https://cel.dev) that must evaluate to
+// a bool. It sees one variable, email, with these fields:
+//
+//	email.direction    "outbound" or "inbound"
+//	email.from         envelope sender
+//	email.to           envelope recipients (list of strings)
+//	email.subject      decoded subject
+//	email.body         decoded text body
+//	email.size         size of the raw message in bytes
+//	email.headers      first value of each header, keyed by lower-cased name
+//	email.listed       a recipient domain is on a block list (outbound only;
+//	                   only looked up for rules that read it)
+//	email.annotations  scanner findings on a held message, each a map with
+//	                   source, kind, severity, score, summary and findings;
+//	                   empty when the message is submitted
+//
+// KB, MB and GB are integer constants, e.g. email.size > 1 * MB. The
+// strings extension (lowerAscii, split, ...) is available.
+
+// maxCost bounds the work one evaluation may do, so a pathological
+// expression cannot stall a submission.
+const maxCost = 1_000_000
+
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("email", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Constant("KB", cel.IntType, types.Int(1<<10)),
+		cel.Constant("MB", cel.IntType, types.Int(1<<20)),
+		cel.Constant("GB", cel.IntType, types.Int(1<<30)),
+		ext.Strings(),
+	)
+})
+
+// allFields stands for every field of email in the fields compile returns,
+// when the expression uses email other than by naming a field.
+const allFields = "*"
+
+// compile parses and type-checks expr, and returns it with the fields of
+// email it reads.
+func compile(expr string) (cel.Program, map[string]bool, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, nil, fmt.Errorf("create CEL environment: %w", err)
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, nil, iss.Err()
+	}
+	if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+		return nil, nil, fmt.Errorf("expression is a %s, want a bool", t)
+	}
+	prg, err := env.Program(ast, cel.CostLimit(maxCost))
+	if err != nil {
+		return nil, nil, err
+	}
+	return prg, fields(ast.NativeRep().Expr()), nil
+}
+
+// fields returns the fields of email that expr reads, as email.name or
+// email["name"]. If email is used any other
+// way, such as iterated over or indexed with a computed key, the result has
+// allFields.
+func fields(expr celast.Expr) map[string]bool {
+	found := make(map[string]bool)
+	named := make(map[int64]bool) // IDs of the email identifiers a field is read from
+	celast.PreOrderVisit(expr, celast.NewExprVisitor(func(e celast.Expr) {
+		switch e.Kind() {
+		case celast.SelectKind:
+			if sel := e.AsSelect(); isEmail(sel.Operand()) {
+				found[sel.FieldName()] = true
+				named[sel.Operand().ID()] = true
+			}
+		case celast.CallKind:
+			call := e.AsCall()
+			args := call.Args()
+			if call.FunctionName() != operators.Index || len(args) != 2 || !isEmail(args[0]) || args[1].Kind() != celast.LiteralKind {
+				return
+			}
+			if name, ok := args[1].AsLiteral().Value().(string); ok {
+				found[name] = true
+				named[args[0].ID()] = true
+			}
+		}
+	}))
+	celast.PreOrderVisit(expr, celast.NewExprVisitor(func(e celast.Expr) {
+		if isEmail(e) && !named[e.ID()] {
+			found[allFields] = true
+		}
+	}))
+	return found
+}
+
+func isEmail(e celast.Expr) bool {
+	return e.Kind() == celast.IdentKind && e.AsIdent() == "email"
+}
+
+// eval runs prg against m.
+func eval(prg cel.Program, m Message) (bool, error) {
+	headers := make(map[string]string, len(m.Header))
+	for name, values := range m.Header {
+		if len(values) > 0 {
+			headers[strings.ToLower(name)] = values[0]
+		}
+	}
+	to := m.Recipients
+	if to == nil {
+		to = []string{}
+	}
+	annotations := make([]map[string]any, 0, len(m.Annotations))
+	for _, a := range m.Annotations {
+		findings := a.Findings
+		if findings == nil {
+			findings = []string{}
+		}
+		annotations = append(annotations, map[string]any{
+			"source":   a.Source,
+			"kind":     a.Kind,
+			"severity": a.Severity,
+			"score":    a.Score,
+			"summary":  a.Summary,
+			"findings": findings,
+		})
+	}
+	out, _, err := prg.Eval(map[string]any{
+		"email": map[string]any{
+			"direction":   m.Direction,
+			"from":        m.Sender,
+			"to":          to,
+			"subject":     m.Subject,
+			"body":        m.Body,
+			"size":        m.Size,
+			"headers":     headers,
+			"listed":      m.Listed,
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	ok, isBool := out.Value().(bool)
+	if !isBool {
+		return false, errors.New("expression did not evaluate to a bool")
+	}
+	return ok, nil
+}
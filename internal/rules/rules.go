@@ -0,0 +1,210 @@
+// Package rules evaluates operator-defined policy rules against a message's
+// envelope to decide whether it is held for review, approved automatically,
+// or rejected outright, and which tags it is labelled with.
+package rules
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"path"
+	"slices"
+	"strings"
+
+	"cel.dev/cel-go/cel"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Action is what a matching rule does with a message.
+type Action string
+
+const (
+	ActionHold    Action = "hold"    // keep for human review (the default)
+	ActionApprove Action = "approve" // skip review
+	ActionReject  Action = "reject"  // refuse the message
+)
+
+// Reputations a rule can require, checked against the recipient domains'
+// block list listings.
+const (
+	ReputationListed = "listed" // some recipient domain is listed
+	ReputationClean  = "clean"  // no recipient domain is listed
+)
+
+// Rule matches messages by direction, sender, recipients, reputation and a
+// CEL expression. Empty fields match anything. Sender and Recipient are
+// case-insensitive globs over the full address (e.g. "*@example.com");
+// Recipient must match every recipient. A rule with Tags and no Action only
+// labels the messages it matches and leaves the decision to later rules.
+type Rule struct {
+	Name       string
+	Direction  string // "outbound", "inbound" or "" for both
+	Sender     string
+	Recipient  string
+	Reputation string // ReputationListed, ReputationClean or "" for either
+	When       string // CEL expression over the message, see expr.go
+	Action     Action
+	Tags       []string
+
+	when  cel.Program     // compiled When; nil if empty
+	reads map[string]bool // fields of email When reads; see fields
+}
+
+// Message is what a rule is evaluated against: the envelope and, for When
+// expressions, the parsed message.
+type Message struct {
+	Direction  string
+	Sender     string
+	Recipients []string
+	Listed     bool // a recipient domain is on a block list; see Engine.UsesReputation
+
+	Subject string      // decoded
+	Body    string      // decoded text body
+	Size    int         // bytes of the raw message
+	Header  mail.Header // may be nil
+
+	Annotations []store.Annotation // scanner findings; only known once the message is held
+}
+
+// Engine evaluates rules in order; the first match wins.
+type Engine struct {
+	rules []Rule
+}
+
+// New validates rules and returns an Engine. Tags are normalized with
+// store.NormalizeTag.
+func New(rules []Rule) (*Engine, error) {
+	rules = slices.Clone(rules)
+	for i, r := range rules {
+		switch r.Action {
+		case ActionHold, ActionApprove, ActionReject:
+		case "":
+			if len(r.Tags) == 0 {
+				return nil, fmt.Errorf("rule %d (%s): needs an action or tags", i, r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %d (%s): unknown action %q", i, r.Name, r.Action)
+		}
+		switch r.Reputation {
+		case "", ReputationListed, ReputationClean:
+		default:
+			return nil, fmt.Errorf("rule %d (%s): unknown reputation %q", i, r.Name, r.Reputation)
+		}
+		tags := make([]string, len(r.Tags))
+		for j, tag := range r.Tags {
+			t, err := store.NormalizeTag(tag)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d (%s): %w", i, r.Name, err)
+			}
+			tags[j] = t
+		}
+		rules[i].Tags = tags
+		if r.When != "" {
+			prg, reads, err := compile(r.When)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d (%s): when: %w", i, r.Name, err)
+			}
+			rules[i].when, rules[i].reads = prg, reads
+		}
+		for _, pattern := range []string{r.Sender, r.Recipient} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d (%s): invalid pattern %q: %w", i, r.Name, pattern, err)
+			}
+		}
+	}
+	return &Engine{rules: rules}, nil
+}
+
+// Evaluate returns the first rule with an action matching m. If none match,
+// it returns a zero Rule with ActionHold and ok=false.
+func (e *Engine) Evaluate(m Message) (rule Rule, ok bool) {
+	if e != nil {
+		for _, r := range e.rules {
+			if r.Action != "" && r.matches(m) {
+				return r, true
+			}
+		}
+	}
+	return Rule{Action: ActionHold}, false
+}
+
+// Tags returns the tags of every rule matching m, sorted and without
+// duplicates. Unlike the action, tags do not stop at the first match.
+func (e *Engine) Tags(m Message) []string {
+	if e == nil {
+		return nil
+	}
+	var tags []string
+	for _, r := range e.rules {
+		if r.matches(m) {
+			tags = append(tags, r.Tags...)
+		}
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// UsesReputation reports whether any rule matches on reputation, so callers
+// only look up Message.Listed when it matters.
+func (e *Engine) UsesReputation() bool {
+	if e == nil {
+		return false
+	}
+	return slices.ContainsFunc(e.rules, func(r Rule) bool {
+		return r.Reputation != "" || r.whenReads("listed")
+	})
+}
+
+// ForAnnotations returns an Engine with only the rules whose When looks at
+// email.annotations, for evaluating a held message again once a scanner has
+// annotated it.
+func (e *Engine) ForAnnotations() *Engine {
+	if e == nil {
+		return nil
+	}
+	return &Engine{rules: slices.DeleteFunc(slices.Clone(e.rules), func(r Rule) bool {
+		return !r.whenReads("annotations")
+	})}
+}
+
+// whenReads reports whether r's When reads field of email.
+func (r Rule) whenReads(field string) bool {
+	return r.reads[field] || r.reads[allFields]
+}
+
+func (r Rule) matches(m Message) bool {
+	if r.Direction != "" && r.Direction != m.Direction {
+		return false
+	}
+	if r.Sender != "" && !matchAddr(r.Sender, m.Sender) {
+		return false
+	}
+	if r.Reputation != "" && (r.Reputation == ReputationListed) != m.Listed {
+		return false
+	}
+	if r.Recipient != "" {
+		if len(m.Recipients) == 0 {
+			return false
+		}
+		for _, rcpt := range m.Recipients {
+			if !matchAddr(r.Recipient, rcpt) {
+				return false
+			}
+		}
+	}
+	if r.when != nil {
+		ok, err := eval(r.when, m)
+		if err != nil {
+			log.Printf("rules: rule %q: evaluate when: %v", r.Name, err)
+			return false
+		}
+		return ok
+	}
+	return true
+}
+
+func matchAddr(pattern, addr string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(addr))
+	return ok
+}
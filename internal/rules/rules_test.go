@@ -0,0 +1,216 @@
+package rules
+
+import (
+	"net/mail"
+	"slices"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestEvaluate(t *testing.T) {
+	e, err := New([]Rule{
+		{Name: "block-spammer", Sender: "*@spam.example", Action: ActionReject},
+		{Name: "alerts", Direction: "outbound", Sender: "alerts@example.com", Recipient: "*@example.com", Action: ActionApprove},
+	})
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		msg  Message
+		want Action
+		rule string
+	}{
+		{"trusted alert", Message{Direction: "outbound", Sender: "alerts@example.com", Recipients: []string{"ops@example.com"}}, ActionApprove, "alerts"},
+		{"case insensitive", Message{Direction: "outbound", Sender: "Alerts@Example.com", Recipients: []string{"OPS@example.com"}}, ActionApprove, "alerts"},
+		{"one external recipient holds", Message{Direction: "outbound", Sender: "alerts@example.com", Recipients: []string{"ops@example.com", "x@other.org"}}, ActionHold, ""},
+		{"wrong direction holds", Message{Direction: "inbound", Sender: "alerts@example.com", Recipients: []string{"ops@example.com"}}, ActionHold, ""},
+		{"reject any direction", Message{Direction: "inbound", Sender: "bad@spam.example", Recipients: []string{"me@example.com"}}, ActionReject, "block-spammer"},
+		{"no match holds", Message{Direction: "outbound", Sender: "someone@example.com", Recipients: []string{"a@b.c"}}, ActionHold, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, _ := e.Evaluate(tt.msg)
+			if rule.Action != tt.want || rule.Name != tt.rule {
+				t.Errorf("Evaluate = %s (%q), want %s (%q)", rule.Action, rule.Name, tt.want, tt.rule)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	e, err := New([]Rule{
+		{Name: "invoices", Direction: "outbound", Recipient: "*@billing.example", Tags: []string{"Invoice"}},
+		{Name: "newsletter", Sender: "news@example.com", Action: ActionHold, Tags: []string{"marketing"}},
+		{Name: "external", Recipient: "*@billing.example", Tags: []string{"external", "invoice"}},
+	})
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+
+	msg := Message{Direction: "outbound", Sender: "news@example.com", Recipients: []string{"ap@billing.example"}}
+	if got, want := e.Tags(msg), []string{"external", "invoice", "marketing"}; !slices.Equal(got, want) {
+		t.Errorf("Tags = %v, want %v", got, want)
+	}
+	// The tag-only rule comes first but does not decide the action.
+	if rule, _ := e.Evaluate(msg); rule.Name != "newsletter" {
+		t.Errorf("Evaluate = %q, want newsletter", rule.Name)
+	}
+	if got := e.Tags(Message{Direction: "outbound", Sender: "a@example.com", Recipients: []string{"b@example.com"}}); got != nil {
+		t.Errorf("Tags without a match = %v, want nil", got)
+	}
+}
+
+func TestNewRejectsInvalidRules(t *testing.T) {
+	if _, err := New([]Rule{{Name: "bad", Action: "explode"}}); err == nil {
+		t.Error("expected error for unknown action")
+	}
+	if _, err := New([]Rule{{Name: "bad", Sender: "[", Action: ActionHold}}); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+	if _, err := New([]Rule{{Name: "bad"}}); err == nil {
+		t.Error("expected error for a rule with neither action nor tags")
+	}
+	if _, err := New([]Rule{{Name: "bad", Tags: []string{"two words"}}}); err == nil {
+		t.Error("expected error for invalid tag")
+	}
+}
+
+func TestNilEngineHolds(t *testing.T) {
+	var e *Engine
+	if rule, ok := e.Evaluate(Message{Direction: "outbound"}); ok || rule.Action != ActionHold {
+		t.Errorf("nil engine = %+v, %v; want hold, false", rule, ok)
+	}
+}
+
+func TestReputation(t *testing.T) {
+	e, err := New([]Rule{
+		{Name: "hold-listed", Direction: "outbound", Reputation: ReputationListed, Action: ActionHold, Tags: []string{"listed"}},
+		{Name: "internal", Recipient: "*@example.com", Reputation: ReputationClean, Action: ActionApprove},
+	})
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	if !e.UsesReputation() {
+		t.Error("UsesReputation = false, want true")
+	}
+	clean := Message{Direction: "outbound", Sender: "app@example.com", Recipients: []string{"ops@example.com"}}
+	if rule, _ := e.Evaluate(clean); rule.Name != "internal" {
+		t.Errorf("clean message matched %q, want internal", rule.Name)
+	}
+	listed := clean
+	listed.Listed = true
+	if rule, _ := e.Evaluate(listed); rule.Name != "hold-listed" {
+		t.Errorf("listed message matched %q, want hold-listed", rule.Name)
+	}
+
+	if _, err := New([]Rule{{Name: "bad", Reputation: "shady", Action: ActionHold}}); err == nil {
+		t.Error("expected error for unknown reputation")
+	}
+	if e, _ := New([]Rule{{Name: "plain", Action: ActionHold}}); e.UsesReputation() {
+		t.Error("UsesReputation = true without reputation rules")
+	}
+}
+
+func TestUsesReputationWhen(t *testing.T) {
+	tests := []struct {
+		when string
+		want bool
+	}{
+		{`email.listed`, true},
+		{`email["listed"] && email.size > 1 * KB`, true},
+		{`has(email.listed)`, true},
+		{`email.exists(k, k == "to")`, true}, // may read any field
+		{`email.subject.contains("listed")`, false},
+		{`email.headers["x-listed"] == "yes"`, false},
+		{`"listed" in email.headers`, false},
+	}
+	for _, tt := range tests {
+		e, err := New([]Rule{{Name: "r", When: tt.when, Action: ActionHold}})
+		if err != nil {
+			t.Fatalf("New(%q): %v", tt.when, err)
+		}
+		if got := e.UsesReputation(); got != tt.want {
+			t.Errorf("UsesReputation with when %q = %t, want %t", tt.when, got, tt.want)
+		}
+	}
+}
+
+func TestWhen(t *testing.T) {
+	e, err := New([]Rule{
+		{Name: "big-to-gmail", When: `email.size > 1 * MB && email.to.exists(t, t.endsWith("@gmail.com"))`, Action: ActionReject},
+		{Name: "invoices", When: `email.subject.lowerAscii().contains("invoice")`, Tags: []string{"invoice"}},
+		{Name: "bulk", When: `email.headers["precedence"] == "bulk"`, Action: ActionApprove},
+		{Name: "missing-field", When: `email.nope == 1`, Action: ActionReject},
+	})
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	msg := func(size int, subject string, header mail.Header, to ...string) Message {
+		return Message{Direction: "outbound", Sender: "app@example.com", Recipients: to, Subject: subject, Size: size, Header: header}
+	}
+
+	tests := []struct {
+		name string
+		msg  Message
+		rule string
+	}{
+		{"large to gmail", msg(2<<20, "Report", nil, "ops@example.com", "me@gmail.com"), "big-to-gmail"},
+		{"small to gmail", msg(100, "Report", nil, "me@gmail.com"), ""},
+		{"large elsewhere", msg(2<<20, "Report", nil, "ops@example.com"), ""},
+		{"header", msg(100, "News", mail.Header{"Precedence": {"bulk"}}, "ops@example.com"), "bulk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// missing-field fails to evaluate and never matches.
+			if rule, _ := e.Evaluate(tt.msg); rule.Name != tt.rule {
+				t.Errorf("Evaluate = %q, want %q", rule.Name, tt.rule)
+			}
+		})
+	}
+	if got := e.Tags(msg(100, "Your INVOICE", nil, "a@example.com")); !slices.Equal(got, []string{"invoice"}) {
+		t.Errorf("Tags = %v, want [invoice]", got)
+	}
+
+	for _, bad := range []string{`email.size >`, `email.size + 1`, `nope == 1`} {
+		if _, err := New([]Rule{{Name: "bad", When: bad, Action: ActionHold}}); err == nil {
+			t.Errorf("New accepted when %q", bad)
+		}
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	e, err := New([]Rule{
+		{Name: "to-gmail", Recipient: "*@gmail.com", Action: ActionReject},
+		{Name: "phishing", When: `email.annotations.exists(a, a.kind == "phishing" && a.score >= 0.9)`, Action: ActionReject},
+		{Name: "dlp", When: `email.annotations.exists(a, a.kind == "dlp" && size(a.findings) > 0)`, Tags: []string{"dlp"}},
+	})
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	annotated := e.ForAnnotations()
+	msg := Message{Direction: "inbound", Sender: "a@example.com", Recipients: []string{"me@gmail.com"}, Annotations: []store.Annotation{
+		{Source: "scanner", Kind: "phishing", Severity: store.SeverityCritical, Score: 0.95},
+		{Source: "scanner", Kind: "dlp", Severity: store.SeverityWarning, Findings: []string{"IBAN"}},
+	}}
+
+	// Only rules looking at annotations are evaluated again.
+	if rule, ok := annotated.Evaluate(msg); !ok || rule.Name != "phishing" {
+		t.Errorf("Evaluate = %q, %t; want phishing", rule.Name, ok)
+	}
+	if got := annotated.Tags(msg); !slices.Equal(got, []string{"dlp"}) {
+		t.Errorf("Tags = %v, want [dlp]", got)
+	}
+	msg.Annotations[0].Score = 0.2
+	if rule, ok := annotated.Evaluate(msg); ok {
+		t.Errorf("low score matched %q", rule.Name)
+	}
+	if rule, _ := e.Evaluate(Message{Recipients: []string{"me@gmail.com"}}); rule.Name != "to-gmail" {
+		t.Errorf("without annotations Evaluate = %q, want to-gmail", rule.Name)
+	}
+	if (*Engine)(nil).ForAnnotations() != nil {
+		t.Error("nil engine's annotation rules are not nil")
+	}
+}
@@ -0,0 +1,260 @@
+// Package signature detects S/MIME and PGP signed messages and verifies them
+// against configured trust anchors, so reviewers can tell authentic senders
+// from spoofs.
+package signature
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/smallstep/pkcs7"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Verifier checks message signatures against S/MIME trust anchors and an
+// OpenPGP keyring.
+type Verifier struct {
+	roots   *x509.CertPool     // nil when no S/MIME trust anchors are configured
+	keyring openpgp.EntityList // public keys of known PGP signers
+}
+
+// New creates a Verifier from a PEM file of S/MIME CA certificates and an
+// armored OpenPGP public keyring. Either path may be empty; signatures that
+// cannot be tied to a trust anchor are then reported as untrusted.
+func New(smimeTrustAnchors, pgpKeyring string) (*Verifier, error) {
+	v := &Verifier{}
+	if smimeTrustAnchors != "" {
+		pem, err := os.ReadFile(smimeTrustAnchors)
+		if err != nil {
+			return nil, fmt.Errorf("read S/MIME trust anchors: %w", err)
+		}
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", smimeTrustAnchors)
+		}
+	}
+	if pgpKeyring != "" {
+		f, err := os.Open(pgpKeyring)
+		if err != nil {
+			return nil, fmt.Errorf("open PGP keyring: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		v.keyring, err = openpgp.ReadArmoredKeyRing(f)
+		if err != nil {
+			return nil, fmt.Errorf("read PGP keyring: %w", err)
+		}
+	}
+	return v, nil
+}
+
+// Verify inspects a raw RFC 5322 message and returns the result of verifying
+// its signature, or nil if the message is not signed. Supported formats are
+// multipart/signed (S/MIME and PGP/MIME), opaque S/MIME signed-data and
+// inline PGP clear-signed text. A nil Verifier verifies nothing.
+func (v *Verifier) Verify(raw []byte) *store.Signature {
+	if v == nil {
+		return nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil
+	}
+	var sender string
+	if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		sender = addr.Address
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/signed":
+		parts := splitMultipart(body, params["boundary"])
+		if len(parts) < 2 {
+			return nil
+		}
+		sigHeader, sigBody := readPart(parts[1])
+		switch strings.ToLower(params["protocol"]) {
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			return v.verifySMIME(parts[0], decode(sigHeader, sigBody), sender)
+		case "application/pgp-signature":
+			return v.verifyPGP(parts[0], sigBody, sender)
+		}
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		if strings.EqualFold(params["smime-type"], "signed-data") {
+			return v.verifySMIME(nil, decode(msg.Header, body), sender)
+		}
+	case "", "text/plain":
+		return v.verifyClearsigned(decode(msg.Header, body), sender)
+	}
+	return nil
+}
+
+// verifySMIME checks a PKCS#7 signature. content is the signed MIME entity
+// for detached signatures and nil when the content is embedded in der.
+func (v *Verifier) verifySMIME(content, der []byte, sender string) *store.Signature {
+	sig := &store.Signature{Protocol: store.SignatureSMIME}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return invalid(sig, "malformed signature: %v", err)
+	}
+	if content != nil {
+		p7.Content = content
+	}
+	cert := p7.GetOnlySigner()
+	if cert == nil {
+		return invalid(sig, "expected exactly one signer")
+	}
+	sig.Signer = cert.Subject.CommonName
+	if len(cert.EmailAddresses) > 0 {
+		sig.Signer = cert.EmailAddresses[0]
+	}
+
+	if err := p7.Verify(); err != nil {
+		return invalid(sig, "%v", err)
+	}
+	if !matchesSender(cert.EmailAddresses, sender) {
+		return invalid(sig, "certificate is not issued to the sender %s", sender)
+	}
+	if v.roots == nil {
+		return untrusted(sig, "no S/MIME trust anchors configured")
+	}
+	if err := p7.VerifyWithChain(v.roots); err != nil {
+		return untrusted(sig, "%v", err)
+	}
+	sig.Status = store.SignatureValid
+	return sig
+}
+
+// verifyPGP checks a PGP/MIME detached signature over the signed entity.
+func (v *Verifier) verifyPGP(content, armored []byte, sender string) *store.Signature {
+	sig := &store.Signature{Protocol: store.SignaturePGP}
+	signer, err := openpgp.CheckArmoredDetachedSignature(v.keyring, bytes.NewReader(content), bytes.NewReader(armored), nil)
+	return pgpResult(sig, signer, err, sender)
+}
+
+// verifyClearsigned checks an inline clear-signed PGP message. It returns nil
+// if body contains no clear-signed block.
+func (v *Verifier) verifyClearsigned(body []byte, sender string) *store.Signature {
+	block, _ := clearsign.Decode(body)
+	if block == nil {
+		return nil
+	}
+	sig := &store.Signature{Protocol: store.SignaturePGP}
+	signer, err := block.VerifySignature(v.keyring, nil)
+	return pgpResult(sig, signer, err, sender)
+}
+
+func pgpResult(sig *store.Signature, signer *openpgp.Entity, err error, sender string) *store.Signature {
+	if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		return untrusted(sig, "signing key is not in the keyring")
+	}
+	if err != nil {
+		return invalid(sig, "%v", err)
+	}
+	var emails []string
+	for _, id := range signer.Identities {
+		emails = append(emails, id.UserId.Email)
+	}
+	if id := signer.PrimaryIdentity(); id != nil {
+		sig.Signer = id.Name
+	}
+	if !matchesSender(emails, sender) {
+		return invalid(sig, "key does not belong to the sender %s", sender)
+	}
+	sig.Status = store.SignatureValid
+	return sig
+}
+
+func invalid(sig *store.Signature, format string, args ...any) *store.Signature {
+	sig.Status = store.SignatureInvalid
+	sig.Detail = fmt.Sprintf(format, args...)
+	return sig
+}
+
+func untrusted(sig *store.Signature, format string, args ...any) *store.Signature {
+	sig.Status = store.SignatureUntrusted
+	sig.Detail = fmt.Sprintf(format, args...)
+	return sig
+}
+
+func matchesSender(addresses []string, sender string) bool {
+	for _, a := range addresses {
+		if strings.EqualFold(a, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMultipart returns the raw bytes of each body part, headers included,
+// with CRLF line endings. Signatures cover the part exactly as transmitted,
+// which mime/multipart does not preserve.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	if boundary == "" {
+		return nil
+	}
+	b := append([]byte("\r\n"), canonicalize(body)...)
+	var parts [][]byte
+	for _, seg := range bytes.Split(b, []byte("\r\n--"+boundary))[1:] {
+		if bytes.HasPrefix(seg, []byte("--")) {
+			break
+		}
+		// Skip transport padding after the boundary.
+		_, part, ok := bytes.Cut(seg, []byte("\r\n"))
+		if !ok {
+			return nil
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// readPart splits a raw body part into its header and body.
+func readPart(part []byte) (mail.Header, []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(part))
+	if err != nil {
+		return mail.Header{}, part
+	}
+	body, _ := io.ReadAll(msg.Body)
+	return msg.Header, body
+}
+
+// decode undoes the Content-Transfer-Encoding of a part body.
+func decode(header mail.Header, body []byte) []byte {
+	var r io.Reader
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body))
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// canonicalize converts line endings to CRLF.
+func canonicalize(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
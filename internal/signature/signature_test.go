@@ -0,0 +1,254 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/smallstep/pkcs7"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// signedEntity is the first part of a multipart/signed message as covered by
+// the signature: the CRLF before the next boundary belongs to the boundary.
+const signedEntity = "Content-Type: text/plain; charset=utf-8\r\n\r\nWire the money today."
+
+// writeFile writes content to a file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+func multipartSigned(from, protocol, sigPart string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"Subject: Payment\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		`Content-Type: multipart/signed; protocol="` + protocol + `"; boundary="sig"` + "\r\n" +
+		"\r\n" +
+		"--sig\r\n" + signedEntity + "\r\n" +
+		"--sig\r\n" + sigPart + "\r\n" +
+		"--sig--\r\n")
+}
+
+// smimeFixture is a CA and a leaf certificate issued to alice@example.com.
+type smimeFixture struct {
+	caPEM []byte
+	leaf  *x509.Certificate
+	key   *ecdsa.PrivateKey
+}
+
+func newSMIMEFixture(t *testing.T) smimeFixture {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "Alice"},
+		EmailAddresses: []string{"alice@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create leaf: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDER)
+	return smimeFixture{caPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), leaf: leaf, key: key}
+}
+
+func (f smimeFixture) sign(t *testing.T, content []byte) string {
+	t.Helper()
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		t.Fatalf("new signed data: %v", err)
+	}
+	if err := sd.AddSigner(f.leaf, f.key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatalf("add signer: %v", err)
+	}
+	sd.Detach()
+	der, err := sd.Finish()
+	if err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	return "Content-Type: application/pkcs7-signature; name=smime.p7s\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(der)
+}
+
+func TestVerifySMIME(t *testing.T) {
+	f := newSMIMEFixture(t)
+	sigPart := f.sign(t, []byte(signedEntity))
+	anchored, err := New(writeFile(t, "ca.pem", f.caPEM), "")
+	if err != nil {
+		t.Fatalf("new verifier: %v", err)
+	}
+	unanchored, _ := New("", "")
+
+	tests := []struct {
+		name     string
+		v        *Verifier
+		msg      []byte
+		status   string
+		contains string
+	}{
+		{"valid", anchored, multipartSigned("Alice <alice@example.com>", "application/pkcs7-signature", sigPart), store.SignatureValid, ""},
+		{"no trust anchors", unanchored, multipartSigned("alice@example.com", "application/pkcs7-signature", sigPart), store.SignatureUntrusted, "trust anchors"},
+		{"spoofed sender", anchored, multipartSigned("ceo@example.com", "application/pkcs7-signature", sigPart), store.SignatureInvalid, "ceo@example.com"},
+		{"tampered", anchored, bytes.Replace(multipartSigned("alice@example.com", "application/pkcs7-signature", sigPart), []byte("today"), []byte("now!!"), 1), store.SignatureInvalid, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := tt.v.Verify(tt.msg)
+			if sig == nil {
+				t.Fatal("Verify returned nil for a signed message")
+			}
+			if sig.Protocol != store.SignatureSMIME || sig.Status != tt.status || !strings.Contains(sig.Detail, tt.contains) {
+				t.Errorf("signature = %+v, want %s with detail containing %q", sig, tt.status, tt.contains)
+			}
+			if sig.Signer != "alice@example.com" {
+				t.Errorf("signer = %q, want alice@example.com", sig.Signer)
+			}
+		})
+	}
+}
+
+func TestVerifySMIMELFLineEndings(t *testing.T) {
+	f := newSMIMEFixture(t)
+	msg := multipartSigned("alice@example.com", "application/pkcs7-signature", f.sign(t, []byte(signedEntity)))
+	v, _ := New(writeFile(t, "ca.pem", f.caPEM), "")
+
+	sig := v.Verify(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")))
+	if sig == nil || sig.Status != store.SignatureValid {
+		t.Errorf("signature = %+v, want valid after CRLF canonicalization", sig)
+	}
+}
+
+func newPGPEntity(t *testing.T, email string) (*openpgp.Entity, string) {
+	t.Helper()
+	e, err := openpgp.NewEntity("Alice", "", email, nil)
+	if err != nil {
+		t.Fatalf("new entity: %v", err)
+	}
+	var buf bytes.Buffer
+	w, _ := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err := e.Serialize(w); err != nil {
+		t.Fatalf("serialize key: %v", err)
+	}
+	_ = w.Close()
+	return e, writeFile(t, "keyring.asc", buf.Bytes())
+}
+
+func TestVerifyPGPMIME(t *testing.T) {
+	alice, keyring := newPGPEntity(t, "alice@example.com")
+	var sigBuf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sigBuf, alice, strings.NewReader(signedEntity), nil); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	sigPart := "Content-Type: application/pgp-signature\r\n\r\n" + sigBuf.String()
+	withKey, err := New("", keyring)
+	if err != nil {
+		t.Fatalf("new verifier: %v", err)
+	}
+	withoutKey, _ := New("", "")
+
+	tests := []struct {
+		name   string
+		v      *Verifier
+		from   string
+		status string
+	}{
+		{"valid", withKey, "alice@example.com", store.SignatureValid},
+		{"unknown key", withoutKey, "alice@example.com", store.SignatureUntrusted},
+		{"spoofed sender", withKey, "mallory@example.com", store.SignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := tt.v.Verify(multipartSigned(tt.from, "application/pgp-signature", sigPart))
+			if sig == nil || sig.Protocol != store.SignaturePGP || sig.Status != tt.status {
+				t.Errorf("signature = %+v, want pgp %s", sig, tt.status)
+			}
+		})
+	}
+}
+
+func TestVerifyClearsigned(t *testing.T) {
+	alice, keyring := newPGPEntity(t, "alice@example.com")
+	var body bytes.Buffer
+	w, err := clearsign.Encode(&body, alice.PrivateKey, nil)
+	if err != nil {
+		t.Fatalf("clearsign: %v", err)
+	}
+	_, _ = w.Write([]byte("Wire the money today.\n"))
+	_ = w.Close()
+	v, _ := New("", keyring)
+
+	msg := "From: alice@example.com\r\nSubject: Payment\r\n\r\n" + body.String()
+	sig := v.Verify([]byte(msg))
+	if sig == nil || sig.Status != store.SignatureValid || !strings.Contains(sig.Signer, "alice@example.com") {
+		t.Errorf("signature = %+v, want valid by alice", sig)
+	}
+
+	tampered := strings.Replace(msg, "today", "now!!", 1)
+	if sig := v.Verify([]byte(tampered)); sig == nil || sig.Status != store.SignatureInvalid {
+		t.Errorf("tampered signature = %+v, want invalid", sig)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	v, _ := New("", "")
+	if sig := v.Verify([]byte("From: a@example.com\r\nSubject: Hi\r\n\r\nHello\r\n")); sig != nil {
+		t.Errorf("signature = %+v, want nil for an unsigned message", sig)
+	}
+	var nilVerifier *Verifier
+	if sig := nilVerifier.Verify([]byte(multipartSigned("a@example.com", "application/pgp-signature", ""))); sig != nil {
+		t.Errorf("nil verifier returned %+v", sig)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "missing.pem"), ""); err == nil {
+		t.Error("expected error for missing trust anchors file")
+	}
+	if _, err := New(writeFile(t, "empty.pem", []byte("not a certificate")), ""); err == nil {
+		t.Error("expected error for trust anchors file without certificates")
+	}
+	if _, err := New("", writeFile(t, "bad.asc", []byte("not a keyring"))); err == nil {
+		t.Error("expected error for malformed keyring")
+	}
+}
@@ -0,0 +1,125 @@
+// Package sla watches the pending queue and raises an alert when an email has
+// been waiting for review longer than the configured maximum age.
+package sla
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Monitor checks pending emails against a maximum age. Each email is alerted
+// on at most once while it stays pending.
+type Monitor struct {
+	st     store.Reader
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	notifier notify.Notifier // may be nil; breaches are then only logged
+
+	alerted map[string]bool
+}
+
+// New creates a Monitor. notifier may be nil.
+func New(st store.Reader, notifier notify.Notifier, maxAge time.Duration) *Monitor {
+	return &Monitor{
+		st:       st,
+		notifier: notifier,
+		maxAge:   maxAge,
+		now:      time.Now,
+		alerted:  make(map[string]bool),
+	}
+}
+
+// SetNotifier replaces where breaches are sent, e.g. on a configuration
+// reload. n may be nil.
+func (m *Monitor) SetNotifier(n notify.Notifier) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifier = n
+}
+
+// Run checks the queue every interval until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	log.Printf("SLA monitor started (max pending age: %s, interval: %s)", m.maxAge, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.Check(ctx); err != nil {
+			log.Printf("SLA check: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check performs a single pass over the pending queue and returns the first
+// error encountered listing emails. Notification failures are logged and the
+// email is retried on the next pass.
+func (m *Monitor) Check(ctx context.Context) error {
+	oldest, err := m.st.OldestPendingAge(ctx, m.now())
+	if err != nil {
+		return fmt.Errorf("oldest pending: %w", err)
+	}
+	if oldest < m.maxAge {
+		// Nothing can be in breach, including anything alerted on earlier.
+		clear(m.alerted)
+		return nil
+	}
+
+	emails, err := m.st.ListPendingSummaries(ctx)
+	if err != nil {
+		return fmt.Errorf("list pending: %w", err)
+	}
+
+	m.mu.Lock()
+	notifier := m.notifier
+	m.mu.Unlock()
+
+	stillPending := make(map[string]bool, len(emails))
+	for _, e := range emails {
+		stillPending[e.ID] = true
+		age := m.now().Sub(e.ReceivedAt)
+		if age < m.maxAge || m.alerted[e.ID] {
+			continue
+		}
+
+		log.Printf("SLA exceeded: email %s pending for %s (subject: %s)", e.ID, age.Round(time.Second), e.Subject)
+		if notifier != nil {
+			if err := notifier.Notify(ctx, notify.Event{
+				Type:       notify.EventSLAExceeded,
+				Message:    fmt.Sprintf("email pending for %s, exceeding SLA of %s", age.Round(time.Second), m.maxAge),
+				EmailID:    e.ID,
+				Direction:  e.Direction,
+				Sender:     e.Sender,
+				Subject:    e.Subject,
+				ReceivedAt: e.ReceivedAt,
+				Tags:       e.Tags,
+			}); err != nil {
+				log.Printf("SLA notify for %s: %v", e.ID, err)
+				continue
+			}
+		}
+		metrics.SLABreaches.Inc(e.Direction)
+		m.alerted[e.ID] = true
+	}
+
+	// Forget emails that have since been approved or rejected.
+	for id := range m.alerted {
+		if !stillPending[id] {
+			delete(m.alerted, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package sla
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type recordingNotifier struct {
+	events []notify.Event
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, e notify.Event) error {
+	n.events = append(n.events, e)
+	return nil
+}
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestCheckAlertsOncePerEmail(t *testing.T) {
+	st := newTestStore(t)
+	id, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Slow", "body", []byte("raw"))
+	_ = st.AddTag(t.Context(), id, "invoice")
+
+	n := &recordingNotifier{}
+	m := New(st, n, time.Hour)
+
+	// Not yet old enough.
+	if err := m.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(n.events) != 0 {
+		t.Fatalf("expected no alerts before SLA age, got %d", len(n.events))
+	}
+
+	// Two hours later the email breaches the SLA.
+	m.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := m.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(n.events) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(n.events))
+	}
+	if n.events[0].EmailID != id || n.events[0].Type != notify.EventSLAExceeded {
+		t.Errorf("event = %+v, want sla_exceeded for %s", n.events[0], id)
+	}
+	if tags := n.events[0].Tags; len(tags) != 1 || tags[0] != "invoice" {
+		t.Errorf("event tags = %v, want [invoice]", tags)
+	}
+
+	// A second pass must not re-alert.
+	if err := m.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(n.events) != 1 {
+		t.Errorf("expected alert to fire once, got %d", len(n.events))
+	}
+
+	// Once the email is handled it is forgotten.
+	_ = st.Delete(t.Context(), id)
+	if err := m.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(m.alerted) != 0 {
+		t.Errorf("alerted set = %v, want empty after email left the queue", m.alerted)
+	}
+}
@@ -0,0 +1,92 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/textproto"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// SetInternal sets up the internal listener profile served by ServeInternal:
+// clients connecting from one of networks, IP addresses and CIDR ranges, may
+// submit mail without AUTH, and their held mail is tagged with project. The
+// listener set up with Serve is unaffected.
+func (s *Server) SetInternal(networks []string, project string) error {
+	if len(networks) == 0 {
+		return errors.New("no allowed networks")
+	}
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, n := range networks {
+		prefix, err := netip.ParsePrefix(n)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(n)
+			if addrErr != nil {
+				return fmt.Errorf("allowed network %q is not an IP address or CIDR range", n)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	if project != "" {
+		var err error
+		if project, err = store.NormalizeTag(project); err != nil {
+			return fmt.Errorf("project: %w", err)
+		}
+	}
+	s.internalNets, s.internalProject = prefixes, project
+	return nil
+}
+
+// ServeInternal listens on addr for the internal listener profile (see
+// SetInternal), e.g. port 25 for internal apps that cannot authenticate.
+// Connections from outside the allowed networks are refused with 554.
+// Blocks until Shutdown.
+func (s *Server) ServeInternal(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	log.Printf("SMTP (internal) listening on %s", l.Addr())
+	return s.serveInternal(l)
+}
+
+func (s *Server) serveInternal(l net.Listener) error {
+	return s.internal.serve(l, s.handleInternal)
+}
+
+func (s *Server) handleInternal(ctx context.Context, conn net.Conn) {
+	tp := textproto.NewConn(conn)
+	if !s.internalAllowed(conn.RemoteAddr()) {
+		log.Printf("SMTP (internal): refused connection from %s: not in an allowed network", conn.RemoteAddr())
+		_ = tp.PrintfLine("554 5.7.1 %s does not accept mail from your address", s.hostname)
+		return
+	}
+	s.run(&session{s: s, ctx: ctx, conn: conn, tp: tp, internal: true, user: User{Project: s.internalProject}})
+}
+
+// internalAllowed reports whether addr is in one of the internal listener's
+// allowed networks.
+func (s *Server) internalAllowed(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range s.internalNets {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authRequired reports whether the client must AUTH before MAIL FROM: never
+// on the internal listener.
+func (sess *session) authRequired() bool {
+	return !sess.internal && sess.s.authRequired()
+}
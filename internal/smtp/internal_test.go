@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// listenInternal starts srv's internal listener on a loopback port and
+// returns its address.
+func listenInternal(t *testing.T, srv *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.serveInternal(l) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+	return l.Addr().String()
+}
+
+func TestSetInternalValidates(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeSender{}, nil)
+	for name, networks := range map[string][]string{
+		"none":    nil,
+		"invalid": {"10.0.0.0/33"},
+		"name":    {"intranet"},
+	} {
+		if err := srv.SetInternal(networks, "internal"); err == nil {
+			t.Errorf("%s: SetInternal succeeded", name)
+		}
+	}
+	if err := srv.SetInternal([]string{"10.0.0.0/8"}, "no spaces"); err == nil {
+		t.Error("SetInternal with an invalid project succeeded")
+	}
+}
+
+func TestInternalListener(t *testing.T) {
+	srv, st := newTestServer(t, &fakeSender{}, nil)
+	srv.SetAuth("app", "s3cret")
+	if err := srv.SetInternal([]string{"192.0.2.0/24", "127.0.0.1"}, "Internal"); err != nil {
+		t.Fatalf("set internal: %v", err)
+	}
+	addr, internal := listen(t, srv), listenInternal(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err == nil {
+		t.Error("send without AUTH on the primary listener succeeded")
+	}
+	if err := netsmtp.SendMail(internal, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send on the internal listener: %v", err)
+	}
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	if len(pending) != 1 || strings.Join(pending[0].Tags, ",") != "internal" {
+		t.Fatalf("pending = %+v, want one email tagged internal", pending)
+	}
+}
+
+func TestInternalListenerRefusesOtherNetworks(t *testing.T) {
+	srv, st := newTestServer(t, &fakeSender{}, nil)
+	if err := srv.SetInternal([]string{"192.0.2.0/24"}, ""); err != nil {
+		t.Fatalf("set internal: %v", err)
+	}
+	addr := listenInternal(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	line, err := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+	if err != nil || !strings.HasPrefix(line, "554 5.7.1") {
+		t.Errorf("greeting = %q, %v; want 554", line, err)
+	}
+	if n := pendingCount(t, st); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+}
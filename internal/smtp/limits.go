@@ -0,0 +1,111 @@
+package smtp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// refuse answers a connection over the limit of max with 421 and closes it.
+func refuse(conn net.Conn, max int) {
+	log.Printf("Refused connection from %s: %d connections already open", conn.RemoteAddr(), max)
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, _ = fmt.Fprintf(conn, "421 4.7.0 Too many connections, try again later\r\n")
+	_ = conn.Close()
+}
+
+// timeoutConn is a connection each read and write of which must finish
+// within a timeout, so a client that stops sending or reading is dropped
+// rather than holding its session open forever.
+type timeoutConn struct {
+	net.Conn
+	read, write time.Duration // 0 is none
+}
+
+// newTimeoutConn wraps conn with the given timeouts, or returns it as it is
+// if there are none.
+func newTimeoutConn(conn net.Conn, read, write time.Duration) net.Conn {
+	if read <= 0 && write <= 0 {
+		return conn
+	}
+	return &timeoutConn{Conn: conn, read: read, write: write}
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.read > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.write > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// clientIP returns the IP address conn comes from, or its whole remote
+// address if it has no port, as for a Unix socket.
+func clientIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// rateLimiter limits the messages a client may send a minute. A nil
+// rateLimiter allows any number.
+type rateLimiter struct {
+	perMinute int
+	now       func() time.Time
+
+	mu   sync.Mutex
+	sent map[string][]time.Time // per client, within the last minute, oldest first
+}
+
+// newRateLimiter returns a rateLimiter allowing perMinute messages a minute
+// per client, or nil if perMinute <= 0.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{perMinute: perMinute, now: time.Now, sent: make(map[string][]time.Time)}
+}
+
+// allow reports whether client may send another message, counting it if so.
+func (l *rateLimiter) allow(client string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	cutoff := now.Add(-time.Minute)
+	// Forget the clients that sent nothing within the minute, so the map
+	// stays as small as the set of active clients.
+	for c, times := range l.sent {
+		i := 0
+		for i < len(times) && !times[i].After(cutoff) {
+			i++
+		}
+		if i == len(times) {
+			delete(l.sent, c)
+		} else {
+			l.sent[c] = times[i:]
+		}
+	}
+	if len(l.sent[client]) >= l.perMinute {
+		return false
+	}
+	l.sent[client] = append(l.sent[client], now)
+	return true
+}
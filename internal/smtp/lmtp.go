@@ -0,0 +1,252 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/albert/mailescrow/internal/imap"
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/tracing"
+)
+
+// Deliverer files inbound mail for review. *poller.Poller implements it.
+type Deliverer interface {
+	Deliver(ctx context.Context, f imap.FetchedEmail) (string, error)
+}
+
+// LMTPServer accepts inbound mail over LMTP (RFC 2033), so a local MTA such
+// as Postfix or Exim can deliver to mailescrow directly instead of to a
+// mailbox it polls. Each message is held for review once, with the RCPT
+// addresses as its envelope recipients; there is no authentication, so
+// listen only where the MTA alone can connect.
+type LMTPServer struct {
+	deliverer Deliverer
+	hostname  string
+	maxBytes  int64
+	maxRcpts  int
+
+	sessions sessions
+}
+
+// NewLMTP creates an LMTPServer handing messages to d.
+func NewLMTP(d Deliverer) *LMTPServer {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "mailescrow"
+	}
+	return &LMTPServer{
+		deliverer: d,
+		hostname:  hostname,
+		maxBytes:  DefaultMaxMessageBytes,
+		maxRcpts:  DefaultMaxRecipients,
+		sessions:  newSessions(),
+	}
+}
+
+// SetMaxMessageBytes sets the largest accepted message size. n <= 0 keeps the default.
+func (s *LMTPServer) SetMaxMessageBytes(n int64) {
+	if n > 0 {
+		s.maxBytes = n
+	}
+}
+
+// SetMaxRecipients sets the number of RCPT TO commands accepted per message;
+// further ones are refused with 452. n <= 0 keeps the default.
+func (s *LMTPServer) SetMaxRecipients(n int) {
+	if n > 0 {
+		s.maxRcpts = n
+	}
+}
+
+// SetMaxConnections sets the number of connections served at once; further
+// ones are refused with 421. n <= 0 keeps the default.
+func (s *LMTPServer) SetMaxConnections(n int) {
+	s.sessions.setMaxConns(n)
+}
+
+// SetTimeouts sets how long a client may take to send each command or part
+// of a message (read) and to take each reply (write) before it is
+// disconnected. 0 disables a timeout.
+func (s *LMTPServer) SetTimeouts(read, write time.Duration) {
+	s.sessions.readTimeout, s.sessions.writeTimeout = read, write
+}
+
+// Serve listens on addr, a TCP address or "unix:" followed by the path of a
+// Unix socket, and handles LMTP sessions. Blocks until Shutdown.
+func (s *LMTPServer) Serve(addr string) error {
+	l, err := listenOn(addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	log.Printf("LMTP listening on %s", addr)
+	return s.serve(l)
+}
+
+func (s *LMTPServer) serve(l net.Listener) error {
+	return s.sessions.serve(l, s.handle)
+}
+
+// Shutdown stops accepting connections and waits for open sessions to finish
+// until ctx is done, after which remaining connections are closed.
+func (s *LMTPServer) Shutdown(ctx context.Context) error {
+	return s.sessions.shutdown(ctx)
+}
+
+// listenOn listens on a TCP address, or on a Unix socket for "unix:path". A
+// socket left behind at path by an earlier run is replaced; any other file
+// there is an error.
+func listenOn(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func (s *LMTPServer) handle(ctx context.Context, conn net.Conn) {
+	sess := &session{ctx: ctx, conn: conn, tp: textproto.NewConn(conn)}
+	sess.reply(220, "%s LMTP mailescrow ready", s.hostname)
+
+	for {
+		line, err := sess.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			sess.helo = arg
+			sess.reset()
+			sess.replyLines(250, []string{s.hostname, "8BITMIME", "ENHANCEDSTATUSCODES", "PIPELINING", fmt.Sprintf("SIZE %d", s.maxBytes)})
+		case "HELO", "EHLO":
+			// RFC 2033 section 4.1: LMTP servers must not accept these.
+			sess.reply(500, "5.5.1 This is an LMTP server, use LHLO")
+		case "MAIL":
+			s.mail(sess, arg)
+		case "RCPT":
+			s.rcpt(sess, arg)
+		case "DATA":
+			s.data(sess, arg)
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "2.0.0 OK")
+		case "NOOP":
+			sess.reply(250, "2.0.0 OK")
+		case "QUIT":
+			sess.reply(221, "2.0.0 Bye")
+			return
+		case "VRFY":
+			sess.reply(252, "2.5.0 Cannot VRFY user")
+		default:
+			sess.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (s *LMTPServer) mail(sess *session, arg string) {
+	if sess.helo == "" {
+		sess.reply(503, "5.5.1 Send LHLO first")
+		return
+	}
+	if sess.hasFrom {
+		sess.reply(503, "5.5.1 Sender already specified")
+		return
+	}
+	addr, ok := parsePath(arg, "FROM:")
+	if !ok {
+		sess.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	sess.from = addr
+	sess.hasFrom = true
+	sess.reply(250, "2.1.0 OK")
+}
+
+func (s *LMTPServer) rcpt(sess *session, arg string) {
+	if !sess.hasFrom {
+		sess.reply(503, "5.5.1 Need MAIL before RCPT")
+		return
+	}
+	addr, ok := parsePath(arg, "TO:")
+	if !ok || addr == "" {
+		sess.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(sess.rcpts) >= s.maxRcpts {
+		sess.reply(452, "4.5.3 Too many recipients (at most %d)", s.maxRcpts)
+		return
+	}
+	if _, err := recipients.Parse(addr); err != nil {
+		sess.reply(553, "5.1.3 Bad recipient address syntax: %v", err)
+		return
+	}
+	sess.rcpts = append(sess.rcpts, addr)
+	sess.reply(250, "2.1.5 OK")
+}
+
+// data reads the message and, as LMTP requires, answers once per accepted
+// recipient. The message is stored once, so every answer is the same.
+func (s *LMTPServer) data(sess *session, arg string) {
+	if arg != "" {
+		sess.reply(501, "5.5.4 DATA takes no arguments")
+		return
+	}
+	if len(sess.rcpts) == 0 {
+		sess.reply(503, "5.5.1 Need RCPT before DATA")
+		return
+	}
+	sess.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	dr := sess.tp.DotReader()
+	body, err := io.ReadAll(io.LimitReader(dr, s.maxBytes+1))
+	if err != nil {
+		return
+	}
+	code, msg := 552, "5.3.4 Message too big"
+	if int64(len(body)) > s.maxBytes {
+		_, _ = io.Copy(io.Discard, dr)
+	} else {
+		code, msg = s.deliver(sess, body)
+	}
+	for range sess.rcpts {
+		sess.reply(code, "%s", msg)
+	}
+	sess.reset()
+}
+
+// deliver hands the session's message to the Deliverer and returns the reply
+// for each of its recipients.
+func (s *LMTPServer) deliver(sess *session, body []byte) (int, string) {
+	raw := sess.received(s.hostname, "LMTP", body)
+	raw = append([]byte("Return-Path: <"+sess.from+">\r\n"), raw...)
+	f := imap.ParseMessage(raw)
+	f.EnvelopeRecipients = sess.rcpts
+	if f.Sender == "" {
+		f.Sender = sess.from
+	}
+
+	ctx, span := tracing.Start(context.Background(), "lmtp.deliver", attribute.Int("mailescrow.recipients", len(sess.rcpts)))
+	id, err := s.deliverer.Deliver(ctx, f)
+	tracing.End(span, err)
+	if err != nil {
+		log.Printf("LMTP: deliver message from %s: %v", sess.from, err)
+		return 451, "4.3.0 Could not store message, try again later"
+	}
+	return 250, "2.0.0 OK queued as " + id
+}
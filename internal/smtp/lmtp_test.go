@@ -0,0 +1,117 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/imap"
+)
+
+type fakeDeliverer struct {
+	err       error
+	delivered []imap.FetchedEmail
+}
+
+func (d *fakeDeliverer) Deliver(_ context.Context, f imap.FetchedEmail) (string, error) {
+	if d.err != nil {
+		return "", d.err
+	}
+	d.delivered = append(d.delivered, f)
+	return "e1", nil
+}
+
+// dialLMTP starts srv on a Unix socket and returns a client connection that
+// has read the greeting.
+func dialLMTP(t *testing.T, srv *LMTPServer) *textproto.Conn {
+	t.Helper()
+	addr := "unix:" + filepath.Join(t.TempDir(), "lmtp.sock")
+	go func() { _ = srv.Serve(addr) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+
+	var conn net.Conn
+	var err error
+	for range 50 {
+		if conn, err = net.Dial("unix", strings.TrimPrefix(addr, "unix:")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c := textproto.NewConn(conn)
+	t.Cleanup(func() { c.Close() })
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	return c
+}
+
+func cmd(t *testing.T, c *textproto.Conn, expectCode int, format string, args ...any) {
+	t.Helper()
+	if err := c.PrintfLine(format, args...); err != nil {
+		t.Fatalf("send %q: %v", format, err)
+	}
+	if _, msg, err := c.ReadResponse(expectCode); err != nil {
+		t.Fatalf("%s: %v (%s)", format, err, msg)
+	}
+}
+
+func TestLMTPDelivers(t *testing.T) {
+	d := &fakeDeliverer{}
+	c := dialLMTP(t, NewLMTP(d))
+
+	cmd(t, c, 500, "EHLO mta.example.com")
+	cmd(t, c, 503, "MAIL FROM:<bounce@example.org>")
+	cmd(t, c, 250, "LHLO mta.example.com")
+	cmd(t, c, 250, "MAIL FROM:<bounce@example.org>")
+	cmd(t, c, 250, "RCPT TO:<billing@example.com>")
+	cmd(t, c, 250, "RCPT TO:<ops@example.com>")
+	cmd(t, c, 354, "DATA")
+	w := c.DotWriter()
+	_, _ = w.Write([]byte(testMessage))
+	_ = w.Close()
+	for range 2 { // one reply per recipient
+		if _, msg, err := c.ReadResponse(250); err != nil || !strings.Contains(msg, "e1") {
+			t.Fatalf("data reply: %v (%s)", err, msg)
+		}
+	}
+
+	if len(d.delivered) != 1 {
+		t.Fatalf("delivered %d messages, want 1", len(d.delivered))
+	}
+	f := d.delivered[0]
+	if f.Sender != "app@example.com" || f.Subject != "Disk full" {
+		t.Errorf("delivered %+v", f)
+	}
+	if len(f.EnvelopeRecipients) != 2 || f.EnvelopeRecipients[0] != "billing@example.com" {
+		t.Errorf("envelope recipients = %v, want the RCPT addresses", f.EnvelopeRecipients)
+	}
+	if raw := string(f.RawMessage); !strings.HasPrefix(raw, "Return-Path: <bounce@example.org>\r\nReceived: from mta.example.com ([local])\r\n") || !strings.Contains(raw, "with LMTP") {
+		t.Errorf("raw message = %q, want Return-Path and Received headers", raw)
+	}
+}
+
+func TestLMTPDeliveryFailure(t *testing.T) {
+	d := &fakeDeliverer{err: errors.New("database is locked")}
+	c := dialLMTP(t, NewLMTP(d))
+
+	cmd(t, c, 250, "LHLO mta.example.com")
+	cmd(t, c, 250, "MAIL FROM:<bounce@example.org>")
+	cmd(t, c, 250, "RCPT TO:<billing@example.com>")
+	cmd(t, c, 553, "RCPT TO:<billing@>")
+	cmd(t, c, 354, "DATA")
+	w := c.DotWriter()
+	_, _ = w.Write([]byte(testMessage))
+	_ = w.Close()
+	if _, _, err := c.ReadResponse(451); err != nil {
+		t.Fatalf("data reply: %v, want 451 so the MTA retries", err)
+	}
+	cmd(t, c, 250, "NOOP") // exactly one reply for the one accepted recipient
+}
@@ -0,0 +1,945 @@
+// Package smtp implements a minimal SMTP submission server so applications can
+// hand mail to mailescrow without using the REST API. Messages matching an
+// auto-approve rule are relayed upstream synchronously and the upstream's
+// response is returned to the client; everything else is held for review.
+// LMTPServer is the inbound counterpart, taking mail for review from a local
+// MTA.
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/albert/mailescrow/internal/contacts"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/policy"
+	"github.com/albert/mailescrow/internal/projects"
+	"github.com/albert/mailescrow/internal/quota"
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/reputation"
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/sysmail"
+	"github.com/albert/mailescrow/internal/tracing"
+	"github.com/albert/mailescrow/internal/window"
+)
+
+// DefaultMaxMessageBytes is the largest message accepted unless overridden.
+const DefaultMaxMessageBytes = 25 << 20
+
+// DefaultMaxRecipients is the number of recipients accepted per message
+// unless overridden; RFC 5321 requires servers to accept at least 100.
+const DefaultMaxRecipients = 100
+
+// DefaultMaxConnections is the number of connections served at once unless
+// overridden; further ones are refused with 421.
+const DefaultMaxConnections = 100
+
+// Defaults for how long a client may take to send each command or part of a
+// message, and to take each reply. RFC 5321 section 4.5.3.2 asks for at
+// least five minutes between commands.
+const (
+	DefaultReadTimeout  = 5 * time.Minute
+	DefaultWriteTimeout = time.Minute
+)
+
+// DefaultCheckTimeout bounds the lookups for each RCPT address unless
+// overridden, as relay.timeout does by default.
+const DefaultCheckTimeout = time.Minute
+
+// Server accepts SMTP submissions.
+type Server struct {
+	st         store.ReadWriter
+	relay      relay.Sender
+	quota      *quota.Limiter        // may be nil
+	suppress   *suppression.List     // may be nil; nothing is then suppressed
+	projects   *projects.Limits      // may be nil; projects are then unlimited
+	contacts   *contacts.Book        // may be nil
+	recipients *recipients.Validator // may be nil; RCPT addresses are then checked for syntax only
+	reputation *reputation.Checker   // may be nil; reputation rules then see every message as clean
+	system     *sysmail.Mailer       // may be nil; mailescrow's own mail is then held like any other
+	windows    *window.Schedule      // may be nil; approved mail is then relayed at once
+	jobs       *jobs.Queue           // sends mail scheduled by windows
+	hostname   string
+
+	username string // single plaintext account, see SetAuth
+	password string
+	maxBytes int64
+	maxRcpts int
+	rate     *rateLimiter  // nil is no limit
+	checkFor time.Duration // bounds the lookups for each RCPT address, see SetCheckTimeout
+	tls      *tls.Config   // nil offers no STARTTLS
+
+	mu       sync.Mutex
+	rules    *rules.Engine // replaced by SetRules on a configuration reload
+	policies *policy.Set   // replaced by SetPolicies on a configuration reload
+	users    *Users        // replaced by SetUsers on a configuration reload
+
+	sessions sessions
+
+	internalNets    []netip.Prefix // see SetInternal
+	internalProject string
+	internal        sessions
+}
+
+// New creates a Server. engine may be nil, in which case every message is held.
+func New(st store.ReadWriter, sender relay.Sender, engine *rules.Engine) *Server {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "mailescrow"
+	}
+	return &Server{
+		st:       st,
+		relay:    sender,
+		rules:    engine,
+		hostname: hostname,
+		maxBytes: DefaultMaxMessageBytes,
+		maxRcpts: DefaultMaxRecipients,
+		checkFor: DefaultCheckTimeout,
+		sessions: newSessions(),
+		internal: newSessions(),
+	}
+}
+
+// SetAuth requires clients to authenticate with username and password
+// (AUTH PLAIN or LOGIN). An empty username disables this account; clients
+// may still AUTH as one of the users set with SetUsers.
+func (s *Server) SetAuth(username, password string) {
+	s.username = username
+	s.password = password
+}
+
+// SetUsers replaces the accounts with bcrypt-hashed passwords clients may
+// authenticate as, in addition to the one set with SetAuth. Once either is
+// set, clients must AUTH before MAIL FROM. users may be nil.
+func (s *Server) SetUsers(users *Users) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+}
+
+// SetRules replaces the rules applied to messages submitted from now on.
+// engine may be nil, in which case every message is held.
+func (s *Server) SetRules(engine *rules.Engine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = engine
+}
+
+// SetPolicies replaces the recipient domain policies layered over the rules
+// for messages submitted from now on. policies may be nil.
+func (s *Server) SetPolicies(policies *policy.Set) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = policies
+}
+
+// SetQuota limits submissions per envelope sender. A sender over quota is
+// either refused or has its mail held (never auto-approved) and flagged.
+func (s *Server) SetQuota(l *quota.Limiter) {
+	s.quota = l
+}
+
+// SetSuppression checks recipients against the suppression list. Suppressed
+// recipients are either refused at RCPT or have the mail to them held (never
+// auto-approved) and flagged.
+func (s *Server) SetSuppression(l *suppression.List) {
+	s.suppress = l
+}
+
+// SetProjects refuses submissions whose project is over one of its limits:
+// too large a message, or too many emails or bytes held.
+func (s *Server) SetProjects(l *projects.Limits) {
+	s.projects = l
+}
+
+// SetContacts relays mail to trusted contacts without review, like an
+// approve rule.
+func (s *Server) SetContacts(b *contacts.Book) {
+	s.contacts = b
+}
+
+// SetRecipients sets how RCPT addresses are validated, e.g. with an MX check.
+func (s *Server) SetRecipients(v *recipients.Validator) {
+	s.recipients = v
+}
+
+// SetReputation sets how recipient domains are checked for rules that match
+// on reputation.
+func (s *Server) SetReputation(c *reputation.Checker) {
+	s.reputation = c
+}
+
+// SetSystemMail drops mail m sent, mailescrow's own bounces and
+// notifications, instead of holding it, should the relay hand it back to
+// this server.
+func (s *Server) SetSystemMail(m *sysmail.Mailer) {
+	s.system = m
+}
+
+// SetWindows holds mail approved without review while its sending window is
+// closed, scheduling it on q to be relayed once the window opens.
+func (s *Server) SetWindows(w *window.Schedule, q *jobs.Queue) {
+	s.windows = w
+	s.jobs = q
+}
+
+// SetMaxMessageBytes sets the largest accepted message size. n <= 0 keeps the default.
+func (s *Server) SetMaxMessageBytes(n int64) {
+	if n > 0 {
+		s.maxBytes = n
+	}
+}
+
+// SetMaxRecipients sets the number of RCPT TO commands accepted per message;
+// further ones are refused with 452. n <= 0 keeps the default.
+func (s *Server) SetMaxRecipients(n int) {
+	if n > 0 {
+		s.maxRcpts = n
+	}
+}
+
+// SetMaxConnections sets the number of connections served at once; further
+// ones are refused with 421. n <= 0 keeps the default.
+func (s *Server) SetMaxConnections(n int) {
+	s.sessions.setMaxConns(n)
+	s.internal.setMaxConns(n)
+}
+
+// SetTimeouts sets how long a client may take to send each command or part
+// of a message (read) and to take each reply (write) before it is
+// disconnected. 0 disables a timeout.
+func (s *Server) SetTimeouts(read, write time.Duration) {
+	s.sessions.readTimeout, s.sessions.writeTimeout = read, write
+	s.internal.readTimeout, s.internal.writeTimeout = read, write
+}
+
+// SetCheckTimeout bounds the lookups made for each RCPT address, such as
+// the recipient's MX check and the suppression list, so a slow DNS server
+// or database cannot stall the session. 0 disables the timeout; the lookups
+// still end with the session.
+func (s *Server) SetCheckTimeout(d time.Duration) {
+	s.checkFor = d
+}
+
+// SetMaxMessageRate limits each client IP address to perMinute messages a
+// minute; further MAIL commands are refused with 450 until the rate drops.
+// 0 is no limit.
+func (s *Server) SetMaxMessageRate(perMinute int) {
+	s.rate = newRateLimiter(perMinute)
+}
+
+// Serve listens on addr and handles SMTP sessions. Blocks until Shutdown.
+func (s *Server) Serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	log.Printf("SMTP listening on %s", l.Addr())
+	return s.serve(l)
+}
+
+func (s *Server) serve(l net.Listener) error {
+	return s.sessions.serve(l, s.handle)
+}
+
+// Shutdown stops accepting connections, on the internal listener too, and
+// waits for open sessions to finish until ctx is done, after which remaining
+// connections are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return errors.Join(s.sessions.shutdown(ctx), s.internal.shutdown(ctx))
+}
+
+// sessions runs a handler for each connection accepted on a listener and
+// keeps track of them for a graceful shutdown. Connections beyond maxConns
+// are refused, and each read and write on a connection must finish within
+// its timeout.
+type sessions struct {
+	maxConns     int
+	readTimeout  time.Duration // 0 is none
+	writeTimeout time.Duration // 0 is none
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	ctx      context.Context // parent of each session's; cancelled when shutdown closes them
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// newSessions returns sessions with the default limits.
+func newSessions() sessions {
+	return sessions{maxConns: DefaultMaxConnections, readTimeout: DefaultReadTimeout, writeTimeout: DefaultWriteTimeout}
+}
+
+// setMaxConns sets maxConns. n <= 0 keeps the default.
+func (ss *sessions) setMaxConns(n int) {
+	if n > 0 {
+		ss.maxConns = n
+	}
+}
+
+func (ss *sessions) serve(l net.Listener, handle func(context.Context, net.Conn)) error {
+	ss.mu.Lock()
+	ss.listener = l
+	if ss.conns == nil {
+		ss.conns = make(map[net.Conn]struct{})
+		ss.ctx, ss.cancel = context.WithCancel(context.Background())
+	}
+	base := ss.ctx
+	ss.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		ss.mu.Lock()
+		if len(ss.conns) >= ss.maxConns {
+			ss.mu.Unlock()
+			go refuse(conn, ss.maxConns)
+			continue
+		}
+		conn = newTimeoutConn(conn, ss.readTimeout, ss.writeTimeout)
+		ss.conns[conn] = struct{}{}
+		ss.mu.Unlock()
+		ss.wg.Add(1)
+		go func() {
+			defer ss.wg.Done()
+			ctx, cancel := context.WithCancel(base)
+			defer func() {
+				cancel()
+				ss.mu.Lock()
+				delete(ss.conns, conn)
+				ss.mu.Unlock()
+				_ = conn.Close()
+			}()
+			handle(ctx, conn)
+		}()
+	}
+}
+
+func (ss *sessions) shutdown(ctx context.Context) error {
+	ss.mu.Lock()
+	var err error
+	if ss.listener != nil {
+		err = ss.listener.Close()
+	}
+	ss.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ss.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		ss.mu.Lock()
+		if ss.cancel != nil {
+			ss.cancel()
+		}
+		for conn := range ss.conns {
+			_ = conn.Close()
+		}
+		ss.mu.Unlock()
+		<-done
+	}
+	return err
+}
+
+// session holds the state of one SMTP or LMTP connection.
+type session struct {
+	s        *Server         // nil for LMTP
+	ctx      context.Context // done once the connection is closed
+	conn     net.Conn
+	tp       *textproto.Conn
+	internal bool                 // on the internal listener, where AUTH is never required
+	tlsState *tls.ConnectionState // set once STARTTLS succeeded
+
+	helo          string
+	authenticated bool
+	user          User // the account authenticated as
+	from          string
+	hasFrom       bool
+	rcpts         []string
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	s.run(&session{s: s, ctx: ctx, conn: conn, tp: textproto.NewConn(conn)})
+}
+
+// run answers sess's commands until the client quits or hangs up.
+func (s *Server) run(sess *session) {
+	sess.reply(220, "%s ESMTP mailescrow ready", s.hostname)
+
+	for {
+		line, err := sess.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			sess.helo = arg
+			sess.reset()
+			sess.reply(250, "%s", s.hostname)
+		case "EHLO":
+			sess.helo = arg
+			sess.reset()
+			ext := []string{s.hostname, "8BITMIME", "PIPELINING", fmt.Sprintf("SIZE %d", s.maxBytes)}
+			if s.tls != nil && sess.tlsState == nil {
+				ext = append(ext, "STARTTLS")
+			}
+			if sess.authRequired() {
+				if sess.clientCN() != "" {
+					ext = append(ext, "AUTH PLAIN LOGIN EXTERNAL")
+				} else {
+					ext = append(ext, "AUTH PLAIN LOGIN")
+				}
+			}
+			sess.replyLines(250, ext)
+		case "STARTTLS":
+			if !sess.startTLS(arg) {
+				return
+			}
+		case "AUTH":
+			sess.auth(arg)
+		case "MAIL":
+			sess.mail(arg)
+		case "RCPT":
+			sess.rcpt(arg)
+		case "DATA":
+			sess.data(arg)
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "2.0.0 OK")
+		case "NOOP":
+			sess.reply(250, "2.0.0 OK")
+		case "QUIT":
+			sess.reply(221, "2.0.0 Bye")
+			return
+		case "VRFY":
+			sess.reply(252, "2.5.0 Cannot VRFY user")
+		default:
+			sess.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (sess *session) reply(code int, format string, args ...any) {
+	_ = sess.tp.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (sess *session) replyLines(code int, lines []string) {
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		_ = sess.tp.PrintfLine("%d%s%s", code, sep, l)
+	}
+}
+
+func (sess *session) reset() {
+	sess.from = ""
+	sess.hasFrom = false
+	sess.rcpts = nil
+}
+
+func (sess *session) auth(arg string) {
+	if !sess.authRequired() {
+		sess.reply(502, "5.5.1 AUTH not enabled")
+		return
+	}
+	if sess.authenticated {
+		sess.reply(503, "5.5.1 Already authenticated")
+		return
+	}
+	mech, initial, _ := strings.Cut(arg, " ")
+
+	var user, pass string
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		resp := initial
+		if resp == "" {
+			var ok bool
+			if resp, ok = sess.challenge(""); !ok {
+				return
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(resp)
+		if err != nil {
+			sess.reply(501, "5.5.2 Invalid base64")
+			return
+		}
+		// authzid NUL authcid NUL passwd
+		parts := bytes.Split(decoded, []byte{0})
+		if len(parts) != 3 {
+			sess.reply(501, "5.5.2 Invalid PLAIN response")
+			return
+		}
+		user, pass = string(parts[1]), string(parts[2])
+	case "LOGIN":
+		u, ok := sess.challenge("Username:")
+		if !ok {
+			return
+		}
+		p, ok := sess.challenge("Password:")
+		if !ok {
+			return
+		}
+		ub, err1 := base64.StdEncoding.DecodeString(u)
+		pb, err2 := base64.StdEncoding.DecodeString(p)
+		if err1 != nil || err2 != nil {
+			sess.reply(501, "5.5.2 Invalid base64")
+			return
+		}
+		user, pass = string(ub), string(pb)
+	case "EXTERNAL":
+		sess.authExternal(initial)
+		return
+	default:
+		sess.reply(504, "5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	account, ok := sess.s.authenticate(user, pass)
+	if !ok {
+		log.Printf("SMTP auth failed for %q from %s", user, sess.conn.RemoteAddr())
+		sess.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	sess.authenticated = true
+	sess.user = account
+	sess.reply(235, "2.7.0 Authentication successful")
+}
+
+// challenge sends a 334 prompt and returns the client's response. A "*"
+// response cancels the exchange.
+func (sess *session) challenge(prompt string) (string, bool) {
+	_ = sess.tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := sess.tp.ReadLine()
+	if err != nil {
+		return "", false
+	}
+	if line == "*" {
+		sess.reply(501, "5.0.0 Authentication cancelled")
+		return "", false
+	}
+	return strings.TrimSpace(line), true
+}
+
+func (sess *session) mail(arg string) {
+	if !sess.authenticated && sess.authRequired() {
+		sess.reply(530, "5.7.0 Authentication required")
+		return
+	}
+	if sess.hasFrom {
+		sess.reply(503, "5.5.1 Sender already specified")
+		return
+	}
+	addr, ok := parsePath(arg, "FROM:")
+	if !ok {
+		sess.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	if _, err := recipients.Parse(addr); err != nil {
+		sess.reply(553, "5.1.7 Bad sender address syntax: %v", err)
+		return
+	}
+	if !sess.user.mayUseSender(addr) {
+		log.Printf("SMTP: refused sender %q for user %q", addr, sess.user.Username)
+		sess.reply(553, "5.7.1 Sender address not allowed for %s", sess.user.Username)
+		return
+	}
+	if client := clientIP(sess.conn); !sess.s.rate.allow(client) {
+		log.Printf("SMTP: refused message from %q: %s sent more than %d messages in the last minute", addr, client, sess.s.rate.perMinute)
+		sess.reply(450, "4.7.1 Too many messages, try again later")
+		return
+	}
+	sess.from = addr
+	sess.hasFrom = true
+	sess.reply(250, "2.1.0 OK")
+}
+
+func (sess *session) rcpt(arg string) {
+	if !sess.hasFrom {
+		sess.reply(503, "5.5.1 Need MAIL before RCPT")
+		return
+	}
+	addr, ok := parsePath(arg, "TO:")
+	if !ok || addr == "" {
+		sess.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(sess.rcpts) >= sess.s.maxRcpts {
+		// RFC 5321 section 4.5.3.1.10: 452, so the client sends the rest in
+		// another transaction.
+		sess.reply(452, "4.5.3 Too many recipients (at most %d)", sess.s.maxRcpts)
+		return
+	}
+	ctx, cancel := sess.checkContext()
+	defer cancel()
+	if p := sess.s.recipients.Check(ctx, addr); p != nil {
+		if p.Syntax {
+			sess.reply(553, "5.1.3 Bad recipient address syntax: %s", p.Reason)
+		} else {
+			sess.reply(550, "5.1.2 Bad destination domain: %s", p.Reason)
+		}
+		return
+	}
+	if !sess.user.mayUseRecipient(addr) {
+		log.Printf("SMTP: refused recipient %q for user %q", addr, sess.user.Username)
+		sess.reply(550, "5.7.1 Recipient address not allowed for %s", sess.user.Username)
+		return
+	}
+	if res, err := sess.s.suppress.Check(ctx, []string{addr}); err != nil {
+		log.Printf("SMTP: %v", err) // held for review at DATA, as the check fails again
+	} else if res.Refuse {
+		log.Printf("SMTP: refused recipient %q: on the suppression list", addr)
+		sess.reply(550, "5.7.1 Recipient is on the suppression list: %s", res.Addresses())
+		return
+	}
+	sess.rcpts = append(sess.rcpts, addr)
+	sess.reply(250, "2.1.5 OK")
+}
+
+// checkContext returns the context for the lookups on one RCPT address: the
+// session's, bounded by the server's check timeout.
+func (sess *session) checkContext() (context.Context, context.CancelFunc) {
+	if sess.s.checkFor <= 0 {
+		return context.WithCancel(sess.ctx)
+	}
+	return context.WithTimeout(sess.ctx, sess.s.checkFor)
+}
+
+func (sess *session) data(arg string) {
+	if arg != "" {
+		sess.reply(501, "5.5.4 DATA takes no arguments")
+		return
+	}
+	if len(sess.rcpts) == 0 {
+		sess.reply(503, "5.5.1 Need RCPT before DATA")
+		return
+	}
+	sess.reply(354, "Start mail input; end with <CRLF>.<CRLF>")
+
+	dr := sess.tp.DotReader()
+	body, err := io.ReadAll(io.LimitReader(dr, sess.s.maxBytes+1))
+	if err != nil {
+		return
+	}
+	if int64(len(body)) > sess.s.maxBytes {
+		_, _ = io.Copy(io.Discard, dr)
+		sess.reset()
+		sess.reply(552, "5.3.4 Message too big")
+		return
+	}
+
+	if msg, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+		if err := sess.user.checkFromHeader(msg.Header); err != nil {
+			log.Printf("SMTP: refused message from user %q: %v", sess.user.Username, err)
+			sess.reset()
+			sess.reply(550, "5.7.1 %s for %s", err, sess.user.Username)
+			return
+		}
+	}
+
+	ctx, span := tracing.Start(context.Background(), "smtp.deliver", attribute.Int("mailescrow.recipients", len(sess.rcpts)))
+	// RFC 3848 protocol types.
+	proto := "ESMTP"
+	if sess.tlsState != nil {
+		proto += "S"
+	}
+	if sess.authenticated {
+		proto += "A"
+	}
+	code, msg := sess.s.deliver(ctx, sess.from, sess.rcpts, sess.received(sess.s.hostname, proto, body), sess.user.Project)
+	span.SetAttributes(attribute.Int("smtp.reply_code", code))
+	span.End()
+	sess.reset()
+	sess.reply(code, "%s", msg)
+}
+
+// received prepends a Received trace header to raw, recording that hostname
+// got it with proto. raw comes from a DotReader, which ends lines in LF; the
+// message returned ends them in CRLF, as RFC 5322 requires.
+func (sess *session) received(hostname, proto string, raw []byte) []byte {
+	remote := sess.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	} else if remote == "" || remote == "@" { // a Unix socket's unnamed peer
+		remote = "local"
+	}
+	header := fmt.Sprintf("Received: from %s ([%s])\r\n\tby %s (mailescrow) with %s;\r\n\t%s\r\n",
+		sess.helo, remote, hostname, proto, time.Now().Format(time.RFC1123Z))
+	return append([]byte(header), toCRLF(raw)...)
+}
+
+// toCRLF ends every line of b in CRLF.
+func toCRLF(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) {
+		return b
+	}
+	return bytes.ReplaceAll(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+// deliver applies the rules to a submitted message and returns the SMTP reply.
+// project, if set, tags the message when it is held.
+func (s *Server) deliver(ctx context.Context, from string, rcpts []string, raw []byte, project string) (code int, reply string) {
+	subject, body := mimetext.Parse(raw)
+	s.mu.Lock()
+	engine, policies := s.rules, s.policies
+	s.mu.Unlock()
+	msg := rules.Message{Direction: store.DirectionOutbound, Sender: from, Recipients: rcpts, Subject: subject, Body: body, Size: len(raw)}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		msg.Header = parsed.Header
+	}
+	if res := s.projects.CheckSize(ctx, project, len(raw)); res.Exceeded != "" {
+		log.Printf("SMTP: refused message from %s: %s", from, res.Message(project))
+		return 552, "5.3.4 Message too big for project " + project
+	}
+	if engine.UsesReputation() {
+		msg.Listed = len(s.reputation.CheckRecipients(ctx, rcpts)) > 0
+	}
+	rule, _ := engine.Evaluate(msg)
+	req := policies.For(rcpts)
+	action, decidedBy := req.Decide(rule)
+
+	if blocked, err := s.contacts.Blocked(ctx, store.DirectionOutbound, from); err != nil {
+		log.Printf("SMTP: check block rules: %v", err)
+	} else if blocked != "" {
+		log.Printf("SMTP: rejected message from %s to %v: %s is blocked", from, rcpts, blocked)
+		s.record(ctx, from, subject, store.DecisionRejected, contacts.BlockReviewer, "", raw)
+		return 550, "5.7.1 Sender is blocked"
+	}
+	if kind := s.system.Check(raw, rcpts); kind != "" {
+		// The relay has sent it once already: relaying it again would send
+		// it twice, or round in a loop, and holding it would notify
+		// reviewers about their own notifications.
+		log.Printf("SMTP: dropped message from %s: it is mailescrow's own %s mail, come back through the relay", from, kind)
+		s.record(ctx, from, subject, store.DecisionRejected, sysmail.ReviewerPrefix+kind, "", raw)
+		return 250, "2.0.0 OK dropped, already sent by mailescrow"
+	}
+	if action == rules.ActionReject {
+		log.Printf("SMTP: rejected message from %s to %v by %s", from, rcpts, decidedBy)
+		s.record(ctx, from, subject, store.DecisionRejected, decidedBy, "", raw)
+		return 550, "5.7.1 Message rejected by policy"
+	}
+
+	q, err := s.quota.Take(ctx, from)
+	if err != nil {
+		log.Printf("SMTP: check quota for %s: %v", from, err)
+		return 451, "4.3.0 Could not check quota, try again later"
+	}
+	if q.Refuse {
+		log.Printf("SMTP: refused message from %s: over %s quota of %d", from, q.Period, q.Limit)
+		return 450, fmt.Sprintf("4.7.1 Sender quota exceeded (%d per %s), try again later", q.Limit, q.Period)
+	}
+	// A message refused from here on does not use up the sender's quota.
+	defer func() {
+		if code >= 400 {
+			if err := s.quota.Release(ctx, q); err != nil {
+				log.Printf("SMTP: release quota for %s: %v", from, err)
+			}
+		}
+	}()
+
+	// Mail to a suppressed recipient, or whose recipients could not be
+	// checked, is held for review.
+	supp, err := s.suppress.Check(ctx, rcpts)
+	if err != nil {
+		log.Printf("SMTP: %v", err)
+	}
+	if supp.Refuse {
+		log.Printf("SMTP: refused message from %s: %s suppressed", from, supp.Addresses())
+		return 550, "5.7.1 Recipient is on the suppression list: " + supp.Addresses()
+	}
+	held := q.Exceeded || err != nil || len(supp.Suppressed) > 0
+
+	// approver is who lets the message skip review: an approve rule or
+	// policy, an allow rule or the address book. Mail a policy holds is
+	// never approved by the latter two.
+	var approver string
+	if action == rules.ActionApprove {
+		approver = decidedBy
+	} else if !req.Review() {
+		if approver, err = s.contacts.Approver(ctx, store.DirectionOutbound, from, rcpts); err != nil {
+			log.Printf("SMTP: check contacts: %v", err)
+		}
+	}
+
+	tags := engine.Tags(msg)
+	if project != "" {
+		tags = append(tags, project)
+	}
+	// Approved mail whose sending window is closed is held, approved, until
+	// the window opens.
+	var opens time.Time
+	var windowName string
+	if approver != "" && !held {
+		now := time.Now()
+		opens, windowName = s.windows.Next(&store.Email{Direction: store.DirectionOutbound, Sender: from, Recipients: rcpts, Tags: tags}, now)
+		if !opens.After(now) {
+			return s.relayApproved(ctx, from, rcpts, subject, body, raw, approver)
+		}
+	}
+
+	p, err := s.projects.Check(ctx, project)
+	if err != nil {
+		log.Printf("SMTP: %v", err)
+		return 451, "4.3.0 Could not check project limits, try again later"
+	}
+	if p.Exceeded != "" {
+		log.Printf("SMTP: refused message from %s: %s", from, p.Message(project))
+		return 452, "4.3.1 " + p.Message(project) + ", try again later"
+	}
+
+	id, err := s.st.SaveOutbound(ctx, from, rcpts, subject, body, raw)
+	if err != nil {
+		log.Printf("SMTP: save message from %s: %v", from, err)
+		return 451, "4.3.0 Could not queue message, try again later"
+	}
+	if q.Exceeded {
+		if err := s.st.AddFlag(ctx, id, store.FlagQuotaExceeded); err != nil {
+			log.Printf("SMTP: flag message %s: %v", id, err)
+		}
+	}
+	if len(supp.Suppressed) > 0 {
+		if err := s.st.AddFlag(ctx, id, store.FlagSuppressed); err != nil {
+			log.Printf("SMTP: flag message %s: %v", id, err)
+		}
+	}
+	for _, tag := range tags {
+		if err := s.st.AddTag(ctx, id, tag); err != nil {
+			log.Printf("SMTP: tag message %s: %v", id, err)
+		}
+	}
+	if !opens.IsZero() {
+		return s.scheduleApproved(ctx, id, from, subject, approver, opens, windowName)
+	}
+	log.Printf("SMTP: held message %s from %s for review", id, from)
+	return 250, "2.0.0 OK held for review as " + id
+}
+
+// relayApproved relays a message approved by approver and returns the SMTP
+// reply: the upstream's, should it refuse the message.
+func (s *Server) relayApproved(ctx context.Context, from string, rcpts []string, subject, body string, raw []byte, approver string) (int, string) {
+	email := &store.Email{
+		Direction:  store.DirectionOutbound,
+		Status:     store.StatusApproved,
+		Sender:     from,
+		Recipients: rcpts,
+		Subject:    subject,
+		Body:       body,
+		RawMessage: raw,
+		ReceivedAt: time.Now().UTC(),
+		ApprovedBy: approver,
+		ApprovedAt: time.Now().UTC(),
+	}
+	if err := s.relay.Send(ctx, email); err != nil {
+		log.Printf("SMTP: relay message from %s (approved by %s): %v", from, approver, err)
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			return tpErr.Code, firstLine(tpErr.Msg)
+		}
+		if errors.Is(err, relay.ErrUnsupported) {
+			return 554, "5.6.3 Upstream relay cannot take this message unchanged"
+		}
+		return 451, "4.4.1 Upstream relay unavailable, try again later"
+	}
+	log.Printf("SMTP: relayed message from %s to %v (auto-approved by %s)", from, rcpts, approver)
+	s.record(ctx, from, subject, store.DecisionApproved, approver, email.EnvelopeID, raw)
+	return 250, "2.0.0 OK relayed"
+}
+
+// scheduleApproved schedules the held message id, approved by approver, to
+// be relayed at at, when the sending window called windowName opens. Should
+// that fail, the message is left for review.
+func (s *Server) scheduleApproved(ctx context.Context, id, from, subject, approver string, at time.Time, windowName string) (int, string) {
+	if err := s.st.Approve(ctx, id, approver, 0); err != nil {
+		log.Printf("SMTP: approve message %s (holding it for review): %v", id, err)
+		return 250, "2.0.0 OK held for review as " + id
+	}
+	d := store.Decision{
+		EmailID:   id,
+		Direction: store.DirectionOutbound,
+		Sender:    from,
+		Subject:   subject,
+		Decision:  store.DecisionApproved,
+		Reviewer:  approver,
+	}
+	if err := s.jobs.ScheduleSend(ctx, id, d, at); err != nil {
+		if err := s.st.Unapprove(context.WithoutCancel(ctx), id); err != nil {
+			log.Printf("SMTP: return message %s to review after failed scheduling: %v", id, err)
+		}
+		log.Printf("SMTP: schedule message %s (holding it for review): %v", id, err)
+		return 250, "2.0.0 OK held for review as " + id
+	}
+	log.Printf("SMTP: scheduled message %s from %s for %s by sending window %s (auto-approved by %s)", id, from, at.Format(time.RFC3339), windowName, approver)
+	return 250, "2.0.0 OK scheduled for " + at.UTC().Format(time.RFC3339) + " as " + id
+}
+
+// record logs an automatic decision on raw in the decision history.
+// Automatic decisions have no email ID since the message is never stored;
+// envelopeID is the ENVID of relayed mail for which DSNs were requested.
+func (s *Server) record(ctx context.Context, from, subject, decision, reviewer, envelopeID string, raw []byte) {
+	if err := s.st.RecordDecision(ctx, store.Decision{
+		Direction:  store.DirectionOutbound,
+		Sender:     from,
+		Subject:    subject,
+		Decision:   decision,
+		Reviewer:   reviewer,
+		EnvelopeID: envelopeID,
+		RawMessage: raw,
+	}); err != nil {
+		log.Printf("SMTP: record decision: %v", err)
+	}
+}
+
+// parsePath extracts the address from "FROM:<addr> [params]" or "TO:<addr>".
+// The null reverse-path "<>" yields an empty address.
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", false
+	}
+	return rest[1:end], true
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,790 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/contacts"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/policy"
+	"github.com/albert/mailescrow/internal/projects"
+	"github.com/albert/mailescrow/internal/quota"
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/reputation"
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/sysmail"
+	"github.com/albert/mailescrow/internal/window"
+)
+
+type fakeSender struct {
+	sent []*store.Email
+	err  error
+}
+
+func (f *fakeSender) Send(_ context.Context, email *store.Email) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, email)
+	return nil
+}
+
+func newTestServer(t *testing.T, sender *fakeSender, ruleList []rules.Rule) (*Server, *store.Store) {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	engine, err := rules.New(ruleList)
+	if err != nil {
+		t.Fatalf("new rules: %v", err)
+	}
+	return New(st, sender, engine), st
+}
+
+// listen starts srv on a loopback port and returns its address.
+func listen(t *testing.T, srv *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() { _ = srv.serve(l) }()
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+	return l.Addr().String()
+}
+
+func pendingCount(t *testing.T, st *store.Store) int {
+	t.Helper()
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	return len(pending)
+}
+
+const testMessage = "From: app@example.com\r\nTo: ops@example.com\r\nSubject: Disk full\r\n\r\nPlease look.\r\n"
+
+var trusted = []rules.Rule{{Name: "alerts", Sender: "alerts@example.com", Action: rules.ActionApprove}}
+
+func TestHoldsUnmatchedMessage(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, trusted)
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 0 {
+		t.Fatalf("relayed %d messages, want 0", len(sender.sent))
+	}
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("pending = %d, want 1", len(pending))
+	}
+	e := pending[0]
+	if e.Sender != "app@example.com" || e.Subject != "Disk full" || e.Body != "Please look." {
+		t.Errorf("held email = %+v", e)
+	}
+	if !strings.HasPrefix(string(e.RawMessage), "Received: from ") {
+		t.Errorf("raw message missing Received header: %q", e.RawMessage)
+	}
+	if n := strings.Count(string(e.RawMessage), "\n"); n == 0 || n != strings.Count(string(e.RawMessage), "\r\n") {
+		t.Errorf("raw message has lines not ending in CRLF: %q", e.RawMessage)
+	}
+}
+
+func TestRelaysAutoApprovedMessage(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, trusted)
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 1 {
+		t.Fatalf("relayed %d messages, want 1", len(sender.sent))
+	}
+	if got := sender.sent[0].ApprovedBy; got != "rule:alerts" {
+		t.Errorf("ApprovedBy = %q, want rule:alerts", got)
+	}
+	if n := pendingCount(t, st); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+	decisions, err := st.ListDecisions(t.Context(), 10)
+	if err != nil {
+		t.Fatalf("list decisions: %v", err)
+	}
+	if len(decisions) != 1 || decisions[0].Reviewer != "rule:alerts" || decisions[0].Decision != store.DecisionApproved {
+		t.Errorf("decisions = %+v, want one approval by rule:alerts", decisions)
+	}
+}
+
+func TestSchedulesAutoApprovedMessageInClosedWindow(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, trusted)
+	// A one-hour window opening two hours from now is closed.
+	opens := time.Duration((time.Now().UTC().Hour()+2)%24) * time.Hour
+	windows, err := window.New([]window.Window{{Name: "office", Recipient: "*@example.com", Start: opens, End: opens + time.Hour, Location: time.UTC}})
+	if err != nil {
+		t.Fatalf("new windows: %v", err)
+	}
+	q := jobs.New(st)
+	srv.SetWindows(windows, q)
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 0 {
+		t.Fatalf("relayed %d messages, want none before the window opens", len(sender.sent))
+	}
+	emails, err := st.ListScheduled(t.Context())
+	if err != nil || len(emails) != 1 {
+		t.Fatalf("scheduled = %d (%v), want 1", len(emails), err)
+	}
+	if e := emails[0]; e.ApprovedBy != "rule:alerts" || e.ScheduledAt.Hour() != int(opens/time.Hour) {
+		t.Errorf("scheduled email approved by %q for %v, want rule:alerts at the next %s", e.ApprovedBy, e.ScheduledAt, opens)
+	}
+	list, err := q.List(t.Context())
+	if err != nil || len(list) != 1 || list[0].Kind != jobs.KindSend || list[0].EmailID != emails[0].ID {
+		t.Errorf("jobs = %+v (%v), want one send job for the scheduled email", list, err)
+	}
+	if decisions, _ := st.ListDecisions(t.Context(), 10); len(decisions) != 0 {
+		t.Errorf("decisions = %+v, want none before the email is sent", decisions)
+	}
+}
+
+func TestReturnsUpstreamResponseCode(t *testing.T) {
+	sender := &fakeSender{err: &textproto.Error{Code: 554, Msg: "5.7.1 Relay access denied"}}
+	srv, _ := newTestServer(t, sender, trusted)
+	addr := listen(t, srv)
+
+	err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 554 {
+		t.Fatalf("send error = %v, want upstream 554", err)
+	}
+}
+
+func TestRefusesMessageUpstreamCannotTake(t *testing.T) {
+	sender := &fakeSender{err: fmt.Errorf("%w: it has 8-bit content and the upstream does not support 8BITMIME", relay.ErrUnsupported)}
+	srv, _ := newTestServer(t, sender, trusted)
+	addr := listen(t, srv)
+
+	err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 554 || !strings.HasPrefix(tpErr.Msg, "5.6.3") {
+		t.Fatalf("send error = %v, want 554 5.6.3", err)
+	}
+}
+
+func TestRejectRule(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, []rules.Rule{{Name: "block", Recipient: "*@competitor.example", Action: rules.ActionReject}})
+	addr := listen(t, srv)
+
+	err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ceo@competitor.example"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Fatalf("send error = %v, want 550", err)
+	}
+	if n := pendingCount(t, st); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+}
+
+func TestReputationRule(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, []rules.Rule{
+		{Name: "listed", Reputation: rules.ReputationListed, Action: rules.ActionReject},
+		{Name: "clean", Reputation: rules.ReputationClean, Action: rules.ActionApprove},
+	})
+	if err := st.SetReputation(t.Context(), store.ReputationEntry{Subject: "competitor.example", Reputation: store.ReputationBlocked}); err != nil {
+		t.Fatalf("set reputation: %v", err)
+	}
+	srv.SetReputation(reputation.New(st, nil, nil))
+	addr := listen(t, srv)
+
+	err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com", "ceo@competitor.example"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Fatalf("send to a listed domain = %v, want 550", err)
+	}
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send to a clean domain: %v", err)
+	}
+	if len(sender.sent) != 1 {
+		t.Errorf("relayed %d messages, want the clean one", len(sender.sent))
+	}
+}
+
+func TestWhenRule(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, []rules.Rule{
+		{Name: "disk-alerts", When: `email.subject.startsWith("Disk") && email.headers["to"] == "ops@example.com" && email.body.contains("look")`, Action: rules.ActionApprove},
+	})
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	other := strings.Replace(testMessage, "Subject: Disk full", "Subject: Weekly report", 1)
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(other)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].Subject != "Disk full" {
+		t.Errorf("relayed %+v, want only the disk alert", sender.sent)
+	}
+	if n := pendingCount(t, st); n != 1 {
+		t.Errorf("pending = %d, want the report held", n)
+	}
+}
+
+func TestSetRulesAppliesToLaterMessages(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, nil)
+	addr := listen(t, srv)
+
+	engine, err := rules.New([]rules.Rule{{Name: "block", Recipient: "*@competitor.example", Action: rules.ActionReject}})
+	if err != nil {
+		t.Fatalf("new rules: %v", err)
+	}
+	srv.SetRules(engine)
+
+	err = netsmtp.SendMail(addr, nil, "app@example.com", []string{"ceo@competitor.example"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Fatalf("send error = %v, want 550 from the replaced rules", err)
+	}
+	if n := pendingCount(t, st); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+}
+
+func TestDomainPolicies(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, trusted)
+	policies, err := policy.New([]policy.Policy{
+		{Domain: "*.gov", Approvals: 2},
+		{Domain: "internal.example.com", Action: rules.ActionApprove},
+		{Domain: "competitor.example", Action: rules.ActionReject},
+	})
+	if err != nil {
+		t.Fatalf("new policies: %v", err)
+	}
+	srv.SetPolicies(policies)
+	addr := listen(t, srv)
+
+	// The policy approves mail no rule matches.
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@internal.example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send to an approved domain: %v", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].ApprovedBy != "policy:internal.example.com" {
+		t.Fatalf("sent = %+v, want one approved by the policy", sender.sent)
+	}
+	// Needing two approvals, it holds mail an approve rule matches.
+	if err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"desk@agency.gov"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send to a reviewed domain: %v", err)
+	}
+	if n := pendingCount(t, st); n != 1 || len(sender.sent) != 1 {
+		t.Errorf("pending = %d, sent = %d; want the message held", n, len(sender.sent))
+	}
+	err = netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ceo@competitor.example"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Errorf("send to a rejected domain = %v, want 550", err)
+	}
+}
+
+func TestTagRules(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, []rules.Rule{
+		{Name: "ops", Recipient: "ops@example.com", Tags: []string{"ops"}},
+		{Name: "app", Sender: "app@example.com", Action: rules.ActionHold, Tags: []string{"Monitoring"}},
+	})
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("pending = %d, want 1", len(pending))
+	}
+	if got := strings.Join(pending[0].Tags, ","); got != "monitoring,ops" {
+		t.Errorf("tags = %q, want monitoring,ops", got)
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, nil)
+	srv.SetAuth("app", "s3cret")
+	addr := listen(t, srv)
+
+	dial := func() *netsmtp.Client {
+		t.Helper()
+		c, err := netsmtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	c := dial()
+	if err := c.Mail("app@example.com"); err == nil {
+		t.Fatal("MAIL before AUTH should fail")
+	}
+	// net/smtp only allows PLAIN without TLS to localhost, which the test
+	// server is. The client hangs up after a failed AUTH, hence a new dial.
+	if err := c.Auth(netsmtp.PlainAuth("", "app", "wrong", "127.0.0.1")); err == nil {
+		t.Fatal("AUTH with wrong password should fail")
+	}
+
+	c = dial()
+	if err := c.Auth(netsmtp.PlainAuth("", "app", "s3cret", "127.0.0.1")); err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	if err := c.Mail("app@example.com"); err != nil {
+		t.Fatalf("mail: %v", err)
+	}
+	if err := c.Rcpt("ops@example.com"); err != nil {
+		t.Fatalf("rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("data: %v", err)
+	}
+	_, _ = w.Write([]byte(testMessage))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close data: %v", err)
+	}
+	if n := pendingCount(t, st); n != 1 {
+		t.Errorf("pending = %d, want 1", n)
+	}
+}
+
+func TestMessageTooBig(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeSender{}, nil)
+	srv.SetMaxMessageBytes(16)
+	addr := listen(t, srv)
+
+	err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 552 {
+		t.Fatalf("send error = %v, want 552", err)
+	}
+}
+
+func TestQuotaExceededHoldsTrustedMail(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, trusted)
+	limiter, err := quota.New(st, 1, 0, quota.ActionHold)
+	if err != nil {
+		t.Fatalf("new limiter: %v", err)
+	}
+	srv.SetQuota(limiter)
+	addr := listen(t, srv)
+
+	for range 2 {
+		if err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	if len(sender.sent) != 1 {
+		t.Errorf("relayed %d messages, want 1 within quota", len(sender.sent))
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || !pending[0].HasFlag(store.FlagQuotaExceeded) {
+		t.Errorf("pending = %+v, want one email flagged quota_exceeded", pending)
+	}
+}
+
+func TestSuppressedRecipients(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, trusted)
+	if err := st.AddSuppression(t.Context(), store.Suppression{Address: "ops@example.com", Reason: store.SuppressionBounced}); err != nil {
+		t.Fatalf("add suppression: %v", err)
+	}
+	list, err := suppression.New(st, suppression.ActionHold)
+	if err != nil {
+		t.Fatalf("new suppression list: %v", err)
+	}
+	srv.SetSuppression(list)
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("relayed %d messages, want mail to a suppressed recipient held", len(sender.sent))
+	}
+	pending, _ := st.ListPending(t.Context())
+	if len(pending) != 1 || !pending[0].HasFlag(store.FlagSuppressed) {
+		t.Errorf("pending = %+v, want one email flagged suppressed", pending)
+	}
+
+	if err := list.SetAction(suppression.ActionRefuse); err != nil {
+		t.Fatalf("set action: %v", err)
+	}
+	err = netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Errorf("send to suppressed recipient = %v, want 550", err)
+	}
+}
+
+func TestProjectLimits(t *testing.T) {
+	srv, st := newTestServer(t, &fakeSender{}, nil)
+	if err := srv.SetInternal([]string{"127.0.0.1"}, "internal"); err != nil {
+		t.Fatalf("set internal: %v", err)
+	}
+	limits, err := projects.New(st, []projects.Limit{{Project: "internal", MaxPending: 1, MaxMessageBytes: 1024}}, nil)
+	if err != nil {
+		t.Fatalf("new project limits: %v", err)
+	}
+	srv.SetProjects(limits)
+	addr := listenInternal(t, srv)
+	code := func(err error) int {
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			return tpErr.Code
+		}
+		return 0
+	}
+
+	big := testMessage + strings.Repeat("x", 1024) + "\r\n"
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(big)); code(err) != 552 {
+		t.Errorf("send over the project's message size: %v, want 552", err)
+	}
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); code(err) != 452 {
+		t.Errorf("send over the project's pending limit: %v, want 452", err)
+	}
+	if n := pendingCount(t, st); n != 1 {
+		t.Errorf("pending = %d, want 1 within the project's limits", n)
+	}
+}
+
+func TestRelaysMailToTrustedContacts(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, nil)
+	book := contacts.New(st, 1)
+	_ = book.Learn(t.Context(), &store.Email{Direction: store.DirectionOutbound, Recipients: []string{"ops@example.com"}})
+	srv.SetContacts(book)
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"stranger@example.org"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].ApprovedBy != contacts.Reviewer {
+		t.Errorf("sent = %+v, want one message approved by contacts", sender.sent)
+	}
+	if n := pendingCount(t, st); n != 1 {
+		t.Errorf("pending = %d, want the message to a stranger held", n)
+	}
+}
+
+func TestDropsOwnSystemMail(t *testing.T) {
+	relayed := &fakeSender{}
+	system := sysmail.New(relayed)
+	if err := system.Sender(sysmail.KindReview).Send(t.Context(), &store.Email{Recipients: []string{"ops@example.com"}, RawMessage: []byte("Message-Id: <n1@mailescrow>\r\n" + testMessage)}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	notification := relayed.sent[0].RawMessage
+
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, trusted)
+	srv.SetSystemMail(system)
+	book := contacts.New(st, 0)
+	if err := book.Block(t.Context(), store.DirectionOutbound, "eve@example.org", "alice", ""); err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	srv.SetContacts(book)
+	addr := listen(t, srv)
+
+	if err := netsmtp.SendMail(addr, nil, "escrow@example.com", []string{"ops@example.com"}, notification); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(sender.sent) != 0 || pendingCount(t, st) != 0 {
+		t.Fatalf("sent %d, pending %d; want the notification dropped", len(sender.sent), pendingCount(t, st))
+	}
+	decisions, _ := st.ListDecisions(t.Context(), 10)
+	if len(decisions) != 1 || decisions[0].Decision != store.DecisionRejected || decisions[0].Reviewer != "system:review" {
+		t.Errorf("decisions = %+v, want the notification dropped as system mail", decisions)
+	}
+
+	// The stamp does not carry over to other recipients, even from an
+	// approved sender, nor let a blocked sender through.
+	if err := netsmtp.SendMail(addr, nil, "alerts@example.com", []string{"ops@example.com", "eve@example.org"}, notification); err != nil {
+		t.Fatalf("send to other recipients: %v", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].ApprovedBy != "rule:alerts" {
+		t.Errorf("sent = %+v, want the copy to other recipients treated like any other message", sender.sent)
+	}
+	err := netsmtp.SendMail(addr, nil, "eve@example.org", []string{"ops@example.com"}, notification)
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Errorf("blocked sender: err = %v, want 550", err)
+	}
+}
+
+func TestRejectsBlockedSenders(t *testing.T) {
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, nil)
+	book := contacts.New(st, 0)
+	if err := book.Block(t.Context(), store.DirectionOutbound, "app@example.com", "alice", ""); err != nil {
+		t.Fatalf("block: %v", err)
+	}
+	srv.SetContacts(book)
+	addr := listen(t, srv)
+
+	err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage))
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 {
+		t.Fatalf("send error = %v, want 550", err)
+	}
+	if len(sender.sent) != 0 || pendingCount(t, st) != 0 {
+		t.Errorf("sent %d, pending %d; want the message neither relayed nor held", len(sender.sent), pendingCount(t, st))
+	}
+	if err := netsmtp.SendMail(addr, nil, "other@example.com", []string{"ops@example.com"}, []byte(testMessage)); err != nil {
+		t.Fatalf("send from another sender: %v", err)
+	}
+}
+
+func TestRejectsInvalidRecipient(t *testing.T) {
+	srv, st := newTestServer(t, &fakeSender{}, nil)
+	addr := listen(t, srv)
+
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Mail("app@example.com"); err != nil {
+		t.Fatalf("mail: %v", err)
+	}
+	err = c.Rcpt("bob..smith@example.com")
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 553 || !strings.HasPrefix(tpErr.Msg, "5.1.3") {
+		t.Fatalf("rcpt error = %v, want 553 5.1.3", err)
+	}
+	if err := c.Rcpt("ops@example.com"); err != nil {
+		t.Fatalf("rcpt after refused recipient: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("data: %v", err)
+	}
+	_, _ = w.Write([]byte(testMessage))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close data: %v", err)
+	}
+	if n := pendingCount(t, st); n != 1 {
+		t.Errorf("pending = %d, want 1", n)
+	}
+}
+
+func TestRejectsInvalidSender(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeSender{}, nil)
+	addr := listen(t, srv)
+
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	for _, from := range []string{"app", "app@", "app@@example.com", ""} {
+		err := c.Mail(from)
+		var tpErr *textproto.Error
+		if !errors.As(err, &tpErr) || tpErr.Code != 553 || !strings.HasPrefix(tpErr.Msg, "5.1.7") {
+			t.Errorf("mail %q error = %v, want 553 5.1.7", from, err)
+		}
+	}
+	if err := c.Mail("app@example.com"); err != nil {
+		t.Fatalf("mail after refused senders: %v", err)
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	srv, st := newTestServer(t, &fakeSender{}, nil)
+	srv.SetMaxRecipients(2)
+	addr := listen(t, srv)
+
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Mail("app@example.com"); err != nil {
+		t.Fatalf("mail: %v", err)
+	}
+	for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+		if err := c.Rcpt(rcpt); err != nil {
+			t.Fatalf("rcpt %s: %v", rcpt, err)
+		}
+	}
+	err = c.Rcpt("c@example.com")
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 452 || !strings.HasPrefix(tpErr.Msg, "4.5.3") {
+		t.Fatalf("third rcpt error = %v, want 452 4.5.3", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("data: %v", err)
+	}
+	_, _ = w.Write([]byte(testMessage))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close data: %v", err)
+	}
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	if len(pending) != 1 || len(pending[0].Recipients) != 2 {
+		t.Errorf("pending = %+v, want one email to the two accepted recipients", pending)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeSender{}, nil)
+	srv.SetMaxConnections(1)
+	addr := listen(t, srv)
+
+	first, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer first.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial second: %v", err)
+	}
+	defer conn.Close()
+	line, err := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+	if err != nil || !strings.HasPrefix(line, "421 4.7.0") {
+		t.Errorf("second connection got %q, %v; want 421", line, err)
+	}
+
+	// Once the first session ends, a new connection is served.
+	if err := first.Quit(); err != nil {
+		t.Fatalf("quit: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := netsmtp.Dial(addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial after quit: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeSender{}, nil)
+	srv.SetTimeouts(50*time.Millisecond, time.Second)
+	addr := listen(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	// An idle client is disconnected.
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadString('\n'); !errors.Is(err, io.EOF) {
+		t.Errorf("read after idling = %v, want EOF once the server hangs up", err)
+	}
+}
+
+func TestCheckContext(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeSender{}, nil)
+	srv.SetCheckTimeout(time.Second)
+	ctx, cancel := context.WithCancel(t.Context())
+	sess := &session{s: srv, ctx: ctx}
+
+	check, stop := sess.checkContext()
+	defer stop()
+	if deadline, ok := check.Deadline(); !ok || time.Until(deadline) > time.Second {
+		t.Errorf("deadline = %v, %v; want within the check timeout", deadline, ok)
+	}
+	cancel()
+	if check.Err() == nil {
+		t.Error("check context outlived its session")
+	}
+
+	srv.SetCheckTimeout(0)
+	unbounded, stop := (&session{s: srv, ctx: t.Context()}).checkContext()
+	defer stop()
+	if _, ok := unbounded.Deadline(); ok {
+		t.Error("deadline set with the check timeout disabled")
+	}
+}
+
+func TestMaxMessageRate(t *testing.T) {
+	srv, _ := newTestServer(t, &fakeSender{}, nil)
+	srv.SetMaxMessageRate(2)
+	now := time.Now()
+	srv.rate.now = func() time.Time { return now }
+	addr := listen(t, srv)
+
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	for i := range 2 {
+		if err := c.Mail("app@example.com"); err != nil {
+			t.Fatalf("mail %d: %v", i, err)
+		}
+		if err := c.Reset(); err != nil {
+			t.Fatalf("reset: %v", err)
+		}
+	}
+	err = c.Mail("app@example.com")
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 450 || !strings.HasPrefix(tpErr.Msg, "4.7.1") {
+		t.Fatalf("third mail error = %v, want 450 4.7.1", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := c.Mail("app@example.com"); err != nil {
+		t.Errorf("mail a minute later: %v", err)
+	}
+}
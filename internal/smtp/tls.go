@@ -0,0 +1,120 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// LoadTLS builds the TLS configuration offered with STARTTLS from a
+// certificate and key file. With clientCAFile set, clients may present a
+// certificate signed by one of its CAs and authenticate with it by AUTH
+// EXTERNAL; clients without one can still use STARTTLS.
+func LoadTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client CA %s: no PEM certificates", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// SetTLS offers STARTTLS with cfg on both listeners, e.g. from LoadTLS. nil
+// offers no TLS.
+func (s *Server) SetTLS(cfg *tls.Config) {
+	s.tls = cfg
+}
+
+// startTLS upgrades the session's connection to TLS. As RFC 3207 requires,
+// the client starts over with EHLO. It returns false if the handshake failed,
+// when the connection can no longer be used.
+func (sess *session) startTLS(arg string) bool {
+	switch {
+	case sess.s.tls == nil:
+		sess.reply(502, "5.5.1 STARTTLS not available")
+		return true
+	case sess.tlsState != nil:
+		sess.reply(503, "5.5.1 TLS already active")
+		return true
+	case arg != "":
+		sess.reply(501, "5.5.4 STARTTLS takes no arguments")
+		return true
+	}
+	sess.reply(220, "2.0.0 Ready to start TLS")
+	conn := tls.Server(sess.conn, sess.s.tls)
+	if err := conn.Handshake(); err != nil {
+		log.Printf("SMTP: TLS handshake with %s failed: %v", sess.conn.RemoteAddr(), err)
+		return false
+	}
+	state := conn.ConnectionState()
+	sess.conn, sess.tp, sess.tlsState = conn, textproto.NewConn(conn), &state
+	sess.helo = ""
+	sess.reset()
+	return true
+}
+
+// clientCN returns the common name of the client certificate verified during
+// the TLS handshake, or "" if the client presented none.
+func (sess *session) clientCN() string {
+	if sess.tlsState == nil || len(sess.tlsState.VerifiedChains) == 0 {
+		return ""
+	}
+	return sess.tlsState.VerifiedChains[0][0].Subject.CommonName
+}
+
+// authExternal authenticates the client as the user its certificate is
+// mapped to (RFC 4422 appendix A). initial, the optional authorization
+// identity, must then be empty or that user's name.
+func (sess *session) authExternal(initial string) {
+	cn := sess.clientCN()
+	if cn == "" {
+		sess.reply(504, "5.7.4 EXTERNAL requires a client certificate")
+		return
+	}
+	if initial == "" {
+		var ok bool
+		if initial, ok = sess.challenge(""); !ok {
+			return
+		}
+	}
+	authzid, err := decodeAuthzid(initial)
+	if err != nil {
+		sess.reply(501, "5.5.2 Invalid base64")
+		return
+	}
+	account, ok := sess.s.authenticateCert(cn)
+	if !ok || (authzid != "" && authzid != account.Username) {
+		log.Printf("SMTP auth failed for certificate %q from %s", cn, sess.conn.RemoteAddr())
+		sess.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	sess.authenticated = true
+	sess.user = account
+	sess.reply(235, "2.7.0 Authentication successful")
+}
+
+// decodeAuthzid decodes an AUTH EXTERNAL response; "=" is an empty one.
+func decodeAuthzid(resp string) (string, error) {
+	if resp == "=" {
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(resp)
+	return strings.TrimSpace(string(b)), err
+}
@@ -0,0 +1,233 @@
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, signed by parent (self-signed if
+// parent is nil).
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves c's certificate and key as PEM files in dir and returns their
+// paths.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// externalAuth is AUTH EXTERNAL with an optional authorization identity.
+type externalAuth string
+
+func (a externalAuth) Start(*netsmtp.ServerInfo) (string, []byte, error) {
+	return "EXTERNAL", []byte(a), nil
+}
+
+// Next answers the server's empty challenge, sent when the client gave no
+// initial response, with an empty one.
+func (a externalAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func TestLoadTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "localhost", ca).write(t, dir, "server")
+
+	if _, err := LoadTLS(certFile, filepath.Join(dir, "missing.key"), ""); err == nil {
+		t.Error("LoadTLS without the key succeeded")
+	}
+	if _, err := LoadTLS(certFile, keyFile, keyFile); err == nil {
+		t.Error("LoadTLS with a client CA file holding no certificate succeeded")
+	}
+	cfg, err := LoadTLS(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("load tls: %v", err)
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Errorf("client auth without a CA = %v, want none", cfg.ClientAuth)
+	}
+	if cfg, err = LoadTLS(certFile, keyFile, caFile); err != nil {
+		t.Fatalf("load tls with client CA: %v", err)
+	}
+	if cfg.ClientAuth != tls.VerifyClientCertIfGiven || cfg.ClientCAs == nil {
+		t.Errorf("client auth with a CA = %v, want certificates verified if given", cfg.ClientAuth)
+	}
+}
+
+func TestAuthExternal(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "localhost", ca).write(t, dir, "server")
+	cfg, err := LoadTLS(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("load tls: %v", err)
+	}
+	users, err := NewUsers([]User{
+		{Username: "ci", ClientCertCN: "ci.apps.example.com", Project: "ci"},
+		{Username: "billing", PasswordHash: hash(t, "b-pass")},
+	})
+	if err != nil {
+		t.Fatalf("new users: %v", err)
+	}
+	srv, st := newTestServer(t, &fakeSender{}, nil)
+	srv.SetUsers(users)
+	srv.SetTLS(cfg)
+	addr := listen(t, srv)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(client *testCert) *netsmtp.Client {
+		t.Helper()
+		c, err := netsmtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			t.Fatal("STARTTLS not offered")
+		}
+		tlsCfg := &tls.Config{ServerName: "localhost", RootCAs: roots}
+		if client != nil {
+			tlsCfg.Certificates = []tls.Certificate{client.tlsCert()}
+		}
+		if err := c.StartTLS(tlsCfg); err != nil {
+			t.Fatalf("starttls: %v", err)
+		}
+		return c
+	}
+	code := func(err error) int {
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			return tpErr.Code
+		}
+		return 0
+	}
+
+	c := dial(nil)
+	if ok, mechs := c.Extension("AUTH"); !ok || strings.Contains(mechs, "EXTERNAL") {
+		t.Errorf("AUTH without a client certificate = %q, want no EXTERNAL", mechs)
+	}
+	if err := c.Auth(externalAuth("")); code(err) != 504 {
+		t.Errorf("AUTH EXTERNAL without a client certificate: %v, want 504", err)
+	}
+
+	if err := dial(newTestCert(t, "unknown.example.com", ca)).Auth(externalAuth("")); code(err) != 535 {
+		t.Errorf("AUTH EXTERNAL with an unmapped certificate: %v, want 535", err)
+	}
+	if err := dial(newTestCert(t, "ci.apps.example.com", ca)).Auth(externalAuth("billing")); code(err) != 535 {
+		t.Errorf("AUTH EXTERNAL as another user: %v, want 535", err)
+	}
+	if err := dial(newTestCert(t, "ci.apps.example.com", nil)).Auth(externalAuth("")); err == nil {
+		t.Error("AUTH EXTERNAL with a certificate from another CA succeeded")
+	}
+	if err := dial(nil).Auth(netsmtp.PlainAuth("", "ci", "", "127.0.0.1")); code(err) != 535 {
+		t.Errorf("AUTH PLAIN as a certificate-only user: %v, want 535", err)
+	}
+
+	c = dial(newTestCert(t, "ci.apps.example.com", ca))
+	if ok, mechs := c.Extension("AUTH"); !ok || !strings.Contains(mechs, "EXTERNAL") {
+		t.Errorf("AUTH with a client certificate = %q, want EXTERNAL", mechs)
+	}
+	if err := c.Auth(externalAuth("ci")); err != nil {
+		t.Fatalf("auth external: %v", err)
+	}
+	if err := c.Mail("app@example.com"); err != nil {
+		t.Fatalf("mail: %v", err)
+	}
+	if err := c.Rcpt("ops@example.com"); err != nil {
+		t.Fatalf("rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("data: %v", err)
+	}
+	_, _ = w.Write([]byte(testMessage))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close data: %v", err)
+	}
+
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	if len(pending) != 1 {
+		t.Fatalf("pending = %d, want 1", len(pending))
+	}
+	if tags := strings.Join(pending[0].Tags, ","); tags != "ci" {
+		t.Errorf("tags = %q, want the certificate user's project", tags)
+	}
+	if !strings.Contains(string(pending[0].RawMessage), "with ESMTPSA;") {
+		t.Errorf("Received header does not record ESMTPSA:\n%s", pending[0].RawMessage)
+	}
+}
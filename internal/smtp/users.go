@@ -0,0 +1,200 @@
+package smtp
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// User is an account allowed to submit mail over SMTP.
+type User struct {
+	Username     string
+	PasswordHash string // bcrypt, e.g. from `htpasswd -nbBC 10 "" secret`; empty for none
+	// ClientCertCN is the common name of the client certificate the user
+	// may authenticate with by AUTH EXTERNAL; empty for none.
+	ClientCertCN string
+
+	// AllowedFromDomains restricts the envelope sender and From header to
+	// these domains. Empty allows any sender.
+	AllowedFromDomains []string
+	// AllowedRecipientDomains restricts RCPT TO addresses to these domains.
+	// Empty allows any recipient.
+	AllowedRecipientDomains []string
+	// Project tags the user's held submissions; empty for none.
+	Project string
+}
+
+// Users is a validated set of SMTP accounts, built with NewUsers.
+type Users struct {
+	byName map[string]User
+	byCert map[string]User // by ClientCertCN
+}
+
+// dummyHash is compared against when a username is unknown, so a failed
+// login takes as long whether or not the user exists.
+var dummyHash = []byte("$2a$10$rWPB4JG.3yqCCrAv11eHbOSuPqS0ldluD1V8TCF9ZAcmrjdHbx0Cu")
+
+// NewUsers validates list: usernames and certificate names must be unique,
+// each user needs a bcrypt password hash or a certificate name, and projects
+// must be valid tags.
+func NewUsers(list []User) (*Users, error) {
+	u := &Users{byName: make(map[string]User, len(list)), byCert: make(map[string]User)}
+	for i, user := range list {
+		if user.Username == "" {
+			return nil, fmt.Errorf("user %d: username is required", i)
+		}
+		if _, dup := u.byName[user.Username]; dup {
+			return nil, fmt.Errorf("user %q is listed twice", user.Username)
+		}
+		if user.PasswordHash == "" && user.ClientCertCN == "" {
+			return nil, fmt.Errorf("user %q: password_hash or client_cert_cn is required", user.Username)
+		}
+		if user.PasswordHash != "" {
+			if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+				return nil, fmt.Errorf("user %q: password_hash is not a bcrypt hash: %w", user.Username, err)
+			}
+		}
+		if user.ClientCertCN != "" {
+			if other, dup := u.byCert[user.ClientCertCN]; dup {
+				return nil, fmt.Errorf("users %q and %q have the same client_cert_cn", other.Username, user.Username)
+			}
+		}
+		if user.Project != "" {
+			project, err := store.NormalizeTag(user.Project)
+			if err != nil {
+				return nil, fmt.Errorf("user %q: project: %w", user.Username, err)
+			}
+			user.Project = project
+		}
+		var err error
+		if user.AllowedFromDomains, err = normalizeDomains(user.AllowedFromDomains); err != nil {
+			return nil, fmt.Errorf("user %q: allowed from domain %w", user.Username, err)
+		}
+		if user.AllowedRecipientDomains, err = normalizeDomains(user.AllowedRecipientDomains); err != nil {
+			return nil, fmt.Errorf("user %q: allowed recipient domain %w", user.Username, err)
+		}
+		u.byName[user.Username] = user
+		if user.ClientCertCN != "" {
+			u.byCert[user.ClientCertCN] = user
+		}
+	}
+	return u, nil
+}
+
+// normalizeDomains returns a lower-cased copy of domains, or an error naming
+// the first entry that is not a domain.
+func normalizeDomains(domains []string) ([]string, error) {
+	out := slices.Clone(domains)
+	for i, d := range out {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "" || strings.Contains(d, "@") {
+			return nil, fmt.Errorf("%q is invalid", domains[i])
+		}
+		out[i] = d
+	}
+	return out, nil
+}
+
+// authenticate checks the credentials against the configured single user
+// and the user list, returning the account they belong to.
+func (s *Server) authenticate(username, password string) (User, bool) {
+	s.mu.Lock()
+	users := s.users
+	s.mu.Unlock()
+
+	if s.username != "" {
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+		if userOK && passOK {
+			return User{Username: username}, true
+		}
+	}
+	user, ok := users.lookup(username)
+	hash := []byte(user.PasswordHash)
+	if !ok || user.PasswordHash == "" { // certificate-only users have no password
+		hash, ok = dummyHash, false
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return User{}, false
+	}
+	return user, true
+}
+
+// authenticateCert returns the user whose client certificate has common
+// name cn.
+func (s *Server) authenticateCert(cn string) (User, bool) {
+	s.mu.Lock()
+	users := s.users
+	s.mu.Unlock()
+	if users == nil {
+		return User{}, false
+	}
+	user, ok := users.byCert[cn]
+	return user, ok
+}
+
+func (u *Users) lookup(username string) (User, bool) {
+	if u == nil {
+		return User{}, false
+	}
+	user, ok := u.byName[username]
+	return user, ok
+}
+
+func (u *Users) empty() bool {
+	return u == nil || len(u.byName) == 0
+}
+
+// authRequired reports whether clients must AUTH before MAIL FROM.
+func (s *Server) authRequired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.username != "" || !s.users.empty()
+}
+
+// mayUseSender reports whether user may submit mail from addr.
+func (user User) mayUseSender(addr string) bool {
+	return inDomains(user.AllowedFromDomains, addr)
+}
+
+// mayUseRecipient reports whether user may submit mail to addr.
+func (user User) mayUseRecipient(addr string) bool {
+	return inDomains(user.AllowedRecipientDomains, addr)
+}
+
+// inDomains reports whether addr is in one of domains, or domains is empty.
+func inDomains(domains []string, addr string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return false
+	}
+	return slices.Contains(domains, strings.ToLower(addr[at+1:]))
+}
+
+// checkFromHeader returns an error unless every address in the message's
+// From header is one user may send from.
+func (user User) checkFromHeader(header mail.Header) error {
+	if len(user.AllowedFromDomains) == 0 {
+		return nil
+	}
+	addrs, err := header.AddressList("From")
+	if err != nil {
+		return errors.New("missing or unreadable From header")
+	}
+	for _, a := range addrs {
+		if !user.mayUseSender(a.Address) {
+			return fmt.Errorf("From address %s not allowed", a.Address)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package smtp
+
+import (
+	"errors"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hash password: %v", err)
+	}
+	return string(h)
+}
+
+func TestNewUsersValidates(t *testing.T) {
+	valid := hash(t, "pw")
+	for name, list := range map[string][]User{
+		"no username":   {{PasswordHash: valid}},
+		"duplicate":     {{Username: "a", PasswordHash: valid}, {Username: "a", PasswordHash: valid}},
+		"plaintext":     {{Username: "a", PasswordHash: "pw"}},
+		"bad project":   {{Username: "a", PasswordHash: valid, Project: "no spaces"}},
+		"address":       {{Username: "a", PasswordHash: valid, AllowedFromDomains: []string{"a@example.com"}}},
+		"empty domain":  {{Username: "a", PasswordHash: valid, AllowedFromDomains: []string{" "}}},
+		"recipient":     {{Username: "a", PasswordHash: valid, AllowedRecipientDomains: []string{"ops@example.com"}}},
+		"no credential": {{Username: "a"}},
+		"shared cert":   {{Username: "a", ClientCertCN: "app"}, {Username: "b", ClientCertCN: "app"}},
+	} {
+		if _, err := NewUsers(list); err == nil {
+			t.Errorf("%s: NewUsers succeeded", name)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	users, err := NewUsers([]User{
+		{Username: "billing", PasswordHash: hash(t, "b-pass"), AllowedFromDomains: []string{"Billing.example.com"}, Project: "Billing"},
+		{Username: "ci", PasswordHash: hash(t, "c-pass")},
+	})
+	if err != nil {
+		t.Fatalf("new users: %v", err)
+	}
+	sender := &fakeSender{}
+	srv, st := newTestServer(t, sender, nil)
+	srv.SetUsers(users)
+	addr := listen(t, srv)
+
+	send := func(user, pass, from, msg string) error {
+		t.Helper()
+		c, err := netsmtp.Dial(addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer c.Close()
+		if err := c.Auth(netsmtp.PlainAuth("", user, pass, "127.0.0.1")); err != nil {
+			return err
+		}
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		if err := c.Rcpt("ops@example.com"); err != nil {
+			return err
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		_, _ = w.Write([]byte(msg))
+		return w.Close()
+	}
+	code := func(err error) int {
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			return tpErr.Code
+		}
+		return 0
+	}
+
+	if err := netsmtp.SendMail(addr, nil, "app@example.com", []string{"ops@example.com"}, []byte(testMessage)); err == nil {
+		t.Error("send without AUTH succeeded")
+	}
+	if err := send("billing", "c-pass", "app@billing.example.com", testMessage); code(err) != 535 {
+		t.Errorf("AUTH with another user's password: %v, want 535", err)
+	}
+	if err := send("nobody", "b-pass", "app@billing.example.com", testMessage); code(err) != 535 {
+		t.Errorf("AUTH as unknown user: %v, want 535", err)
+	}
+	if err := send("billing", "b-pass", "app@example.com", testMessage); code(err) != 553 {
+		t.Errorf("sender outside the allowed domains: %v, want 553", err)
+	}
+	// testMessage's From header is app@example.com.
+	if err := send("billing", "b-pass", "app@billing.example.com", testMessage); code(err) != 550 {
+		t.Errorf("From header outside the allowed domains: %v, want 550", err)
+	}
+	if n := pendingCount(t, st); n != 0 {
+		t.Fatalf("pending = %d after refused submissions, want 0", n)
+	}
+
+	billing := strings.Replace(testMessage, "From: app@example.com", "From: Billing <invoices@billing.example.com>", 1)
+	if err := send("billing", "b-pass", "invoices@billing.example.com", billing); err != nil {
+		t.Fatalf("send as billing: %v", err)
+	}
+	if err := send("ci", "c-pass", "app@example.com", testMessage); err != nil {
+		t.Fatalf("send as ci: %v", err)
+	}
+	pending, err := st.ListPending(t.Context())
+	if err != nil {
+		t.Fatalf("list pending: %v", err)
+	}
+	tags := make(map[string]string)
+	for _, e := range pending {
+		tags[e.Sender] = strings.Join(e.Tags, ",")
+	}
+	if tags["invoices@billing.example.com"] != "billing" || tags["app@example.com"] != "" || len(tags) != 2 {
+		t.Errorf("tags by sender = %v, want billing's submission tagged with its project only", tags)
+	}
+}
+
+func TestUserRecipientDomains(t *testing.T) {
+	users, err := NewUsers([]User{{Username: "support", PasswordHash: hash(t, "s-pass"), AllowedRecipientDomains: []string{"Customers.example.com"}}})
+	if err != nil {
+		t.Fatalf("new users: %v", err)
+	}
+	srv, st := newTestServer(t, &fakeSender{}, nil)
+	srv.SetUsers(users)
+	addr := listen(t, srv)
+
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.Auth(netsmtp.PlainAuth("", "support", "s-pass", "127.0.0.1")); err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	if err := c.Mail("app@example.com"); err != nil {
+		t.Fatalf("mail: %v", err)
+	}
+	err = c.Rcpt("ops@example.com")
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != 550 || !strings.HasPrefix(tpErr.Msg, "5.7.1") {
+		t.Fatalf("rcpt outside the allowed domains = %v, want 550 5.7.1", err)
+	}
+	if err := c.Rcpt("ann@customers.example.com"); err != nil {
+		t.Fatalf("rcpt in an allowed domain: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("data: %v", err)
+	}
+	_, _ = w.Write([]byte(testMessage))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close data: %v", err)
+	}
+	if n := pendingCount(t, st); n != 1 {
+		t.Errorf("pending = %d, want 1", n)
+	}
+}
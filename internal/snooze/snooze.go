@@ -0,0 +1,87 @@
+// Package snooze returns snoozed pending emails to the pending list when
+// their snooze expires, and tells the reviewers.
+package snooze
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Waker ends expired snoozes. Each woken email is notified on once.
+type Waker struct {
+	st  store.Writer
+	now func() time.Time
+
+	mu       sync.Mutex
+	notifier notify.Notifier // may be nil; woken emails are then only logged
+}
+
+// New creates a Waker. notifier may be nil.
+func New(st store.Writer, notifier notify.Notifier) *Waker {
+	return &Waker{st: st, notifier: notifier, now: time.Now}
+}
+
+// SetNotifier replaces where woken emails are sent, e.g. on a configuration
+// reload. n may be nil.
+func (w *Waker) SetNotifier(n notify.Notifier) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.notifier = n
+}
+
+// Run wakes expired snoozes every interval until ctx is cancelled.
+func (w *Waker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Check(ctx); err != nil {
+			log.Printf("snooze check: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check wakes the emails whose snooze has expired. Notification failures are
+// logged; the email is back in the pending list regardless.
+func (w *Waker) Check(ctx context.Context) error {
+	emails, err := w.st.WakeSnoozed(ctx, w.now())
+	if err != nil {
+		return fmt.Errorf("wake snoozed: %w", err)
+	}
+
+	w.mu.Lock()
+	notifier := w.notifier
+	w.mu.Unlock()
+
+	for _, e := range emails {
+		log.Printf("Snooze expired: email %s is pending again (snoozed by %s, subject: %s)", e.ID, e.SnoozedBy, e.Subject)
+		if notifier == nil {
+			continue
+		}
+		if err := notifier.Notify(ctx, notify.Event{
+			Type:       notify.EventSnoozeExpired,
+			Message:    fmt.Sprintf("snooze by %s expired; email is pending again", e.SnoozedBy),
+			EmailID:    e.ID,
+			Direction:  e.Direction,
+			Sender:     e.Sender,
+			Subject:    e.Subject,
+			Reviewer:   e.SnoozedBy,
+			ReceivedAt: e.ReceivedAt,
+			Tags:       e.Tags,
+		}); err != nil {
+			log.Printf("snooze notify for %s: %v", e.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package snooze
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type recordingNotifier struct {
+	events []notify.Event
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, e notify.Event) error {
+	n.events = append(n.events, e)
+	return nil
+}
+
+func TestCheckNotifiesOnceWhenSnoozeExpires(t *testing.T) {
+	st := store.NewMemory()
+	id, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Later", "body", []byte("raw"))
+	until := time.Now().Add(time.Hour)
+	if err := st.Snooze(t.Context(), id, "alice", until); err != nil {
+		t.Fatalf("snooze: %v", err)
+	}
+
+	n := &recordingNotifier{}
+	w := New(st, n)
+	if err := w.Check(t.Context()); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(n.events) != 0 {
+		t.Fatalf("notified %d times before the snooze expired", len(n.events))
+	}
+
+	w.now = func() time.Time { return until }
+	for range 2 {
+		if err := w.Check(t.Context()); err != nil {
+			t.Fatalf("check: %v", err)
+		}
+	}
+	if len(n.events) != 1 {
+		t.Fatalf("notified %d times, want 1", len(n.events))
+	}
+	if e := n.events[0]; e.Type != notify.EventSnoozeExpired || e.EmailID != id || e.Reviewer != "alice" || e.Subject != "Later" {
+		t.Errorf("event = %+v, want snooze_expired for %s by alice", e, id)
+	}
+	if email, _ := st.Get(t.Context(), id); !email.SnoozedUntil.IsZero() {
+		t.Errorf("still snoozed until %v", email.SnoozedUntil)
+	}
+}
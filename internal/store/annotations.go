@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Annotation severities, in increasing order.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Severities lists the annotation severities in increasing order.
+var Severities = []string{SeverityInfo, SeverityWarning, SeverityCritical}
+
+// Annotation is a finding an automated scanner attached to a held email,
+// such as a phishing score, DLP matches or the result of link analysis.
+// Annotations are deleted with their email.
+type Annotation struct {
+	ID        string
+	EmailID   string
+	Source    string   // the scanner that made it, e.g. "rspamd"
+	Kind      string   // what was checked, e.g. "phishing", "dlp", "links"
+	Severity  string   // SeverityInfo | SeverityWarning | SeverityCritical
+	Score     float64  // scanner-defined, e.g. a phishing probability; 0 if none
+	Summary   string   // one line, shown on the badge
+	Findings  []string // individual matches, e.g. DLP hits or suspicious links
+	CreatedBy string   // "token:<name>", or "api" without a token
+	CreatedAt time.Time
+}
+
+// AddAnnotation stores a on its email, assigning it a UUID. A zero
+// CreatedAt means now. It fails if the email does not exist.
+func (s *Store) AddAnnotation(ctx context.Context, a Annotation) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	id := uuid.New().String()
+	findingsJSON, err := json.Marshal(a.Findings)
+	if err != nil {
+		return "", fmt.Errorf("marshal findings: %w", err)
+	}
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now().UTC()
+	}
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO annotations (id, email_id, source, kind, severity, score, summary, findings, created_by, created_at)
+		 SELECT ?, id, ?, ?, ?, ?, ?, ?, ?, ? FROM emails WHERE id = ?`,
+		id, a.Source, a.Kind, a.Severity, a.Score, a.Summary, string(findingsJSON), a.CreatedBy, a.CreatedAt.UTC(), a.EmailID,
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert annotation: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return "", fmt.Errorf("email not found: %s", a.EmailID)
+	}
+	return id, nil
+}
+
+// ListAnnotations returns the annotations of an email, oldest first.
+func (s *Store) ListAnnotations(ctx context.Context, emailID string) ([]Annotation, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, email_id, source, kind, severity, score, summary, findings, created_by, created_at
+		 FROM annotations WHERE email_id = ? ORDER BY created_at, rowid`, emailID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query annotations: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var annotations []Annotation
+	for rows.Next() {
+		var a Annotation
+		var findingsJSON string
+		if err := rows.Scan(&a.ID, &a.EmailID, &a.Source, &a.Kind, &a.Severity, &a.Score, &a.Summary, &findingsJSON, &a.CreatedBy, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan annotation: %w", err)
+		}
+		if err := json.Unmarshal([]byte(findingsJSON), &a.Findings); err != nil {
+			return nil, fmt.Errorf("unmarshal findings: %w", err)
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxMIMEDepth bounds how deeply nested multiparts are searched.
+const maxMIMEDepth = 10
+
+// hasAttachments reports whether raw, a MIME message, has a part with
+// Content-Disposition: attachment. Messages that fail to parse have none.
+func hasAttachments(raw []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return false
+	}
+	return partHasAttachments(textproto.MIMEHeader(msg.Header), msg.Body, 0)
+}
+
+func partHasAttachments(header textproto.MIMEHeader, body io.Reader, depth int) bool {
+	if disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")); disposition == "attachment" {
+		return true
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || depth >= maxMIMEDepth {
+		return false
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			return false
+		}
+		if partHasAttachments(part.Header, part, depth+1) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// nextApprovalSeq numbers an approval after every email approved so far and
+// every checkpoint, so a consumer's checkpoint never covers mail approved
+// after it was saved, even once the mail it was saved at is deleted.
+const nextApprovalSeq = `(SELECT COALESCE(MAX(n), 0) + 1 FROM (
+	SELECT MAX(approval_seq) AS n FROM emails UNION ALL SELECT MAX(position) FROM consumer_checkpoints))`
+
+// ListApprovedAfter returns approved inbound emails approved after position
+// after (see Email.ApprovalSeq), in the order they were approved, without
+// their raw messages as ListApproved does. If queue is non-empty only emails
+// routed to that queue are returned.
+func (s *Store) ListApprovedAfter(ctx context.Context, queue string, after int64) ([]Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + approvedColumns + ` FROM emails WHERE direction = ? AND status = ? AND approval_seq > ?`
+	args := []any{DirectionInbound, StatusApproved, after}
+	if queue != "" {
+		query += ` AND queue = ?`
+		args = append(args, queue)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY approval_seq ASC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query emails: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	return s.scanEmails(rows)
+}
+
+// GetCheckpoint returns how far consumer has read queue ("" for every
+// queue), an Email.ApprovalSeq; 0 if it has not read it yet.
+func (s *Store) GetCheckpoint(ctx context.Context, consumer, queue string) (int64, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var position int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT position FROM consumer_checkpoints WHERE consumer = ? AND queue = ?`, consumer, queue,
+	).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get checkpoint: %w", err)
+	}
+	return position, nil
+}
+
+// SaveCheckpoint records that consumer has read queue up to position. A
+// checkpoint never moves back.
+func (s *Store) SaveCheckpoint(ctx context.Context, consumer, queue string, position int64) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT INTO consumer_checkpoints (consumer, queue, position, updated_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT (consumer, queue) DO UPDATE SET position = MAX(position, excluded.position), updated_at = excluded.updated_at`,
+		consumer, queue, position, time.Now().UTC(),
+	); err != nil {
+		return fmt.Errorf("save checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// DailyStats counts a UTC day's mail. Days are rolled up from the emails and
+// decisions held when the day is over, and kept after those are purged so
+// the stats page can show trends beyond the retention periods.
+type DailyStats struct {
+	Day      time.Time // midnight UTC
+	Received int       // emails held for review
+	Approved int       // decisions to approve, by reviewers or rules
+	Rejected int       // decisions to reject
+	Relayed  int       // outbound emails relayed and inbound emails forwarded
+	Bounced  int       // of those relayed, how many the upstream reported undeliverable
+}
+
+// statsDayLayout is how days are keyed in the daily_stats table.
+const statsDayLayout = time.DateOnly
+
+// startOfDay returns midnight UTC of t's day in UTC.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// dayCounter counts the records of one day into a DailyStats.
+type dayCounter struct {
+	stats      DailyStats
+	end        time.Time
+	received   map[string]bool // IDs of the emails received
+	unrecorded int             // emails received without an ID, refused outright
+}
+
+func newDayCounter(day time.Time) *dayCounter {
+	start := startOfDay(day)
+	return &dayCounter{stats: DailyStats{Day: start}, end: start.AddDate(0, 0, 1), received: make(map[string]bool)}
+}
+
+func (c *dayCounter) within(t time.Time) bool {
+	return !t.Before(c.stats.Day) && t.Before(c.end)
+}
+
+// email counts an email held now, received at receivedAt.
+func (c *dayCounter) email(id string, receivedAt time.Time) {
+	if c.within(receivedAt) {
+		c.received[id] = true
+	}
+}
+
+// decision counts d, and the email it decided on if that was received on
+// the day: emails decided on have usually been deleted.
+func (c *dayCounter) decision(d Decision) {
+	if c.within(d.DecidedAt.Add(-d.Latency)) {
+		if d.EmailID == "" {
+			c.unrecorded++
+		} else {
+			c.received[d.EmailID] = true
+		}
+	}
+	if !c.within(d.DecidedAt) {
+		return
+	}
+	switch d.Decision {
+	case DecisionApproved:
+		c.stats.Approved++
+		if d.Direction == DirectionOutbound {
+			c.stats.Relayed++
+		}
+	case DecisionRejected:
+		c.stats.Rejected++
+	case DecisionForwarded:
+		c.stats.Relayed++
+	}
+	if d.DeliveryStatus == DeliveryFailed {
+		c.stats.Bounced++
+	}
+}
+
+func (c *dayCounter) result() DailyStats {
+	c.stats.Received = len(c.received) + c.unrecorded
+	return c.stats
+}
+
+// RollUpStats counts the mail of the UTC day of day from the emails and
+// decisions held, and saves the counts, replacing any earlier roll-up of
+// the day. Bounces are counted as far as they have been reported.
+func (s *Store) RollUpStats(ctx context.Context, day time.Time) (DailyStats, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	c := newDayCounter(day)
+	// An email decided on is received before its decision, so every
+	// decision that matters was made on the day or since.
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT email_id, direction, decision, latency_seconds, decided_at, COALESCE(delivery_status, '') FROM decisions WHERE decided_at >= ?`,
+		c.stats.Day,
+	)
+	if err != nil {
+		return DailyStats{}, fmt.Errorf("count decisions: %w", err)
+	}
+	for rows.Next() {
+		var d Decision
+		var latency float64
+		if err := rows.Scan(&d.EmailID, &d.Direction, &d.Decision, &latency, &d.DecidedAt, &d.DeliveryStatus); err != nil {
+			rows.Close()
+			return DailyStats{}, fmt.Errorf("count decisions: %w", err)
+		}
+		d.Latency = time.Duration(latency * float64(time.Second))
+		c.decision(d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return DailyStats{}, fmt.Errorf("count decisions: %w", err)
+	}
+
+	rows, err = s.db.QueryContext(ctx, `SELECT id, received_at FROM emails WHERE received_at >= ? AND received_at < ?`, c.stats.Day, c.end)
+	if err != nil {
+		return DailyStats{}, fmt.Errorf("count emails: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		var receivedAt time.Time
+		if err := rows.Scan(&id, &receivedAt); err != nil {
+			rows.Close()
+			return DailyStats{}, fmt.Errorf("count emails: %w", err)
+		}
+		c.email(id, receivedAt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return DailyStats{}, fmt.Errorf("count emails: %w", err)
+	}
+
+	stats := c.result()
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO daily_stats (day, received, approved, rejected, relayed, bounced) VALUES (?, ?, ?, ?, ?, ?)`,
+		stats.Day.Format(statsDayLayout), stats.Received, stats.Approved, stats.Rejected, stats.Relayed, stats.Bounced,
+	); err != nil {
+		return DailyStats{}, fmt.Errorf("save daily stats: %w", err)
+	}
+	return stats, nil
+}
+
+// NextStatsDay returns the first day to roll up: the day after the latest
+// one rolled up or, before the first roll-up, the day of the oldest email
+// or decision held. It returns the zero time if there is nothing to roll up.
+func (s *Store) NextStatsDay(ctx context.Context) (time.Time, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var latest sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT MAX(day) FROM daily_stats`).Scan(&latest); err != nil {
+		return time.Time{}, fmt.Errorf("latest daily stats: %w", err)
+	}
+	if latest.Valid {
+		day, err := time.Parse(statsDayLayout, latest.String)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("latest daily stats: %w", err)
+		}
+		return day.AddDate(0, 0, 1), nil
+	}
+
+	var oldest time.Time
+	for _, query := range []string{`SELECT MIN(received_at) FROM emails`, `SELECT MIN(decided_at) FROM decisions`} {
+		var at sql.NullString
+		if err := s.db.QueryRowContext(ctx, query).Scan(&at); err != nil {
+			return time.Time{}, fmt.Errorf("oldest record: %w", err)
+		}
+		if t := parseTimestamp(at.String); at.Valid && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return time.Time{}, nil
+	}
+	return startOfDay(oldest), nil
+}
+
+// ListDailyStats returns the days rolled up since since, newest first.
+func (s *Store) ListDailyStats(ctx context.Context, since time.Time) ([]DailyStats, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT day, received, approved, rejected, relayed, bounced FROM daily_stats WHERE day >= ? ORDER BY day DESC`,
+		startOfDay(since).Format(statsDayLayout),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list daily stats: %w", err)
+	}
+	defer rows.Close()
+
+	var list []DailyStats
+	for rows.Next() {
+		var d DailyStats
+		var day string
+		if err := rows.Scan(&day, &d.Received, &d.Approved, &d.Rejected, &d.Relayed, &d.Bounced); err != nil {
+			return nil, fmt.Errorf("scan daily stats: %w", err)
+		}
+		if d.Day, err = time.Parse(statsDayLayout, day); err != nil {
+			return nil, fmt.Errorf("scan daily stats: %w", err)
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
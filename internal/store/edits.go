@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+)
+
+// Edit is a reviewer's change to a pending outbound email, kept with the
+// versions before and after it. Edits are kept after their email is deleted,
+// so the history can show what was changed.
+type Edit struct {
+	EmailID  string
+	Reviewer string
+	EditedAt time.Time
+	Before   EditedFields
+	After    EditedFields
+}
+
+// EditedFields are the parts of an email a reviewer can edit.
+type EditedFields struct {
+	Recipients []string `json:"recipients"`
+	Subject    string   `json:"subject"`
+	Body       string   `json:"body"`
+}
+
+// EditEmail replaces the recipients, subject, body and raw message of the
+// pending email e.EmailID with e.After and rawMessage, and records e. The
+// approvals given so far were for the old version and are dropped. Like
+// Approve it takes the version the caller last saw and returns ErrConflict
+// if the email has changed since or is no longer pending. A zero EditedAt
+// means now.
+func (s *Store) EditEmail(ctx context.Context, e Edit, rawMessage []byte, version int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if e.EditedAt.IsZero() {
+		e.EditedAt = time.Now().UTC()
+	}
+	recipientsJSON, err := json.Marshal(e.After.Recipients)
+	if err != nil {
+		return fmt.Errorf("marshal recipients: %w", err)
+	}
+	before, err := json.Marshal(e.Before)
+	if err != nil {
+		return fmt.Errorf("marshal edit: %w", err)
+	}
+	after, err := json.Marshal(e.After)
+	if err != nil {
+		return fmt.Errorf("marshal edit: %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE emails SET recipients = ?, subject = ?, body = ?, raw_message = ?, has_attachments = ?, snippet = ?, approvals = NULL, version = version + 1
+		 WHERE id = ? AND status = ? AND version = ?`,
+		string(recipientsJSON), e.After.Subject, e.After.Body, s.seal(rawMessage), hasAttachments(rawMessage), mimetext.Snippet(e.After.Body),
+		e.EmailID, StatusPending, version,
+	)
+	if err != nil {
+		return fmt.Errorf("edit email: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		_ = tx.Rollback()
+		if err := s.checkExists(ctx, e.EmailID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO edits (email_id, reviewer, edited_at, old_version, new_version) VALUES (?, ?, ?, ?, ?)`,
+		e.EmailID, e.Reviewer, e.EditedAt.UTC(), s.seal(before), s.seal(after),
+	); err != nil {
+		return fmt.Errorf("insert edit: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// ListEdits returns the edits of the given emails, oldest first.
+func (s *Store) ListEdits(ctx context.Context, emailIDs []string) ([]Edit, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if len(emailIDs) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(emailIDs))
+	for i, id := range emailIDs {
+		args[i] = id
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT email_id, reviewer, edited_at, old_version, new_version FROM edits
+		 WHERE email_id IN (?`+strings.Repeat(", ?", len(emailIDs)-1)+`) ORDER BY id ASC`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query edits: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var edits []Edit
+	for rows.Next() {
+		var e Edit
+		var before, after []byte
+		if err := rows.Scan(&e.EmailID, &e.Reviewer, &e.EditedAt, &before, &after); err != nil {
+			return nil, fmt.Errorf("scan edit: %w", err)
+		}
+		if err := s.unsealEdit(before, &e.Before); err != nil {
+			return nil, err
+		}
+		if err := s.unsealEdit(after, &e.After); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate edits: %w", err)
+	}
+	return edits, nil
+}
+
+// PruneEdits deletes the edits made before before and returns how many were
+// deleted.
+func (s *Store) PruneEdits(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM edits WHERE edited_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("prune edits: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("prune edits: %w", err)
+	}
+	return int(n), nil
+}
+
+// unsealEdit unseals b and decodes the version of an email it holds into f.
+func (s *Store) unsealEdit(b []byte, f *EditedFields) error {
+	b, err := s.unseal(b)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, f); err != nil {
+		return fmt.Errorf("unmarshal edit: %w", err)
+	}
+	return nil
+}
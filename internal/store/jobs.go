@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job statuses.
+const (
+	JobPending = "pending" // waiting until RunAt
+	JobRunning = "running" // being run
+	JobFailed  = "failed"  // out of attempts; kept until an operator retries or discards it
+)
+
+// Job is a side effect of a decision, such as moving an IMAP message or
+// notifying a sender, persisted so that it survives failures and restarts
+// until it succeeds. See package jobs.
+type Job struct {
+	ID        string
+	Kind      string // what the job does, e.g. "imap_move"
+	EmailID   string // the email the job is about; empty if none
+	Payload   []byte // kind-specific JSON
+	Status    string // JobPending | JobRunning | JobFailed
+	Attempts  int    // runs started so far
+	LastError string // error of the latest failed run
+	RunAt     time.Time
+	CreatedAt time.Time
+}
+
+// ErrJobNotFound is returned for a job that does not exist or is not in the
+// status the call needs.
+var ErrJobNotFound = errors.New("job not found")
+
+// AddJob stores j, assigning it a UUID. A zero CreatedAt means now and a zero
+// RunAt means CreatedAt. Payloads are encrypted like raw messages (see
+// SetRawKey), as they may carry one.
+func (s *Store) AddJob(ctx context.Context, j Job) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	id := uuid.New().String()
+	if j.CreatedAt.IsZero() {
+		j.CreatedAt = time.Now().UTC()
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = j.CreatedAt
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO jobs (id, kind, email_id, payload, status, attempts, last_error, run_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, j.Kind, j.EmailID, s.seal(j.Payload), j.Status, j.Attempts, j.LastError, j.RunAt.UTC(), j.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert job: %w", err)
+	}
+	return id, nil
+}
+
+// jobColumns is the column list scanned by scanJob, in order.
+const jobColumns = `id, kind, email_id, payload, status, attempts, last_error, run_at, created_at`
+
+func (s *Store) scanJob(row rowScanner) (*Job, error) {
+	var j Job
+	if err := row.Scan(&j.ID, &j.Kind, &j.EmailID, &j.Payload, &j.Status, &j.Attempts, &j.LastError, &j.RunAt, &j.CreatedAt); err != nil {
+		return nil, err
+	}
+	payload, err := s.unseal(j.Payload)
+	if err != nil {
+		return nil, err
+	}
+	j.Payload = payload
+	return &j, nil
+}
+
+// ClaimJob marks the pending job that has been due the longest as running,
+// counting the attempt, and returns it. It returns nil if no job is due at
+// now.
+func (s *Store) ClaimJob(ctx context.Context, now time.Time) (*Job, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// A single statement, so two workers can never claim the same job.
+	j, err := s.scanJob(s.db.QueryRowContext(ctx,
+		`UPDATE jobs SET status = ?, attempts = attempts + 1
+		 WHERE id = (SELECT id FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at, created_at LIMIT 1)
+		 RETURNING `+jobColumns,
+		JobRunning, JobPending, now.UTC(),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim job: %w", err)
+	}
+	return j, nil
+}
+
+// RetryJobAt returns a running job that failed with lastError to the queue,
+// due at runAt.
+func (s *Store) RetryJobAt(ctx context.Context, id, lastError string, runAt time.Time) error {
+	return s.updateJob(ctx, `UPDATE jobs SET status = ?, last_error = ?, run_at = ? WHERE id = ? AND status = ?`,
+		JobPending, lastError, runAt.UTC(), id, JobRunning)
+}
+
+// FailJob marks a running job that failed with lastError as failed for good.
+func (s *Store) FailJob(ctx context.Context, id, lastError string) error {
+	return s.updateJob(ctx, `UPDATE jobs SET status = ?, last_error = ? WHERE id = ? AND status = ?`,
+		JobFailed, lastError, id, JobRunning)
+}
+
+// RequeueJob makes a pending or failed job due now with a fresh set of
+// attempts.
+func (s *Store) RequeueJob(ctx context.Context, id string) error {
+	return s.updateJob(ctx, `UPDATE jobs SET status = ?, attempts = 0, run_at = ? WHERE id = ? AND status != ?`,
+		JobPending, time.Now().UTC(), id, JobRunning)
+}
+
+// DeleteJob deletes a job, once it has succeeded or been discarded.
+func (s *Store) DeleteJob(ctx context.Context, id string) error {
+	return s.updateJob(ctx, `DELETE FROM jobs WHERE id = ?`, id)
+}
+
+// updateJob runs a statement changing one job, returning ErrJobNotFound if
+// it changed none.
+func (s *Store) updateJob(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("update job: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// ResetRunningJobs returns jobs left running, by a process that stopped
+// before they finished, to the queue and returns how many there were.
+func (s *Store) ResetRunningJobs(ctx context.Context) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `UPDATE jobs SET status = ? WHERE status = ?`, JobPending, JobRunning)
+	if err != nil {
+		return 0, fmt.Errorf("reset running jobs: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("reset running jobs: %w", err)
+	}
+	return int(n), nil
+}
+
+// ListJobs returns every job, oldest first.
+func (s *Store) ListJobs(ctx context.Context) ([]Job, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+jobColumns+` FROM jobs ORDER BY created_at`)
+	if err != nil {
+		return nil, fmt.Errorf("query jobs: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var jobs []Job
+	for rows.Next() {
+		j, err := s.scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TrackedLink is a link in a relayed outbound email that was rewritten
+// through mailescrow's click redirect. Tracked links outlive their email, so
+// clicks are still counted once it has been relayed and deleted.
+type TrackedLink struct {
+	ID          string // the token in the click URL
+	EmailID     string
+	Subject     string // of the email, kept for the stats page
+	URL         string // where a click is redirected to
+	Clicks      int
+	CreatedAt   time.Time
+	LastClickAt time.Time // zero until first clicked
+}
+
+// ClickStats sums the clicks on the tracked links of one email.
+type ClickStats struct {
+	EmailID     string
+	Subject     string
+	Links       int
+	Clicks      int
+	LastClickAt time.Time // zero if no link was clicked
+}
+
+// TrackLinks stores links, skipping those whose ID is already stored, so an
+// email relayed again keeps the clicks counted so far. A zero CreatedAt
+// means now.
+func (s *Store) TrackLinks(ctx context.Context, links []TrackedLink) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	for _, l := range links {
+		if l.CreatedAt.IsZero() {
+			l.CreatedAt = now
+		}
+		if _, err := s.db.ExecContext(ctx,
+			`INSERT OR IGNORE INTO tracked_links (id, email_id, subject, url, clicks, created_at) VALUES (?, ?, ?, ?, 0, ?)`,
+			l.ID, l.EmailID, l.Subject, l.URL, l.CreatedAt.UTC(),
+		); err != nil {
+			return fmt.Errorf("insert tracked link: %w", err)
+		}
+	}
+	return nil
+}
+
+// ClickLink counts a click at the given time on the tracked link with the
+// given ID and returns the link, or nil if there is none.
+func (s *Store) ClickLink(ctx context.Context, id string, at time.Time) (*TrackedLink, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var l TrackedLink
+	var lastClickAt sql.NullTime
+	err := s.db.QueryRowContext(ctx,
+		`UPDATE tracked_links SET clicks = clicks + 1, last_click_at = ? WHERE id = ?
+		 RETURNING id, email_id, subject, url, clicks, created_at, last_click_at`,
+		at.UTC(), id,
+	).Scan(&l.ID, &l.EmailID, &l.Subject, &l.URL, &l.Clicks, &l.CreatedAt, &lastClickAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("click tracked link: %w", err)
+	}
+	l.LastClickAt = lastClickAt.Time
+	return &l, nil
+}
+
+// ListClickStats returns the click counts of the emails with tracked links,
+// most clicked first, at most limit of them.
+func (s *Store) ListClickStats(ctx context.Context, limit int) ([]ClickStats, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT email_id, MAX(subject), COUNT(*), SUM(clicks), COALESCE(MAX(last_click_at), ''), MAX(created_at) AS tracked_at
+		 FROM tracked_links GROUP BY email_id ORDER BY SUM(clicks) DESC, tracked_at DESC LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query click stats: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var stats []ClickStats
+	for rows.Next() {
+		var cs ClickStats
+		var last, trackedAt string
+		if err := rows.Scan(&cs.EmailID, &cs.Subject, &cs.Links, &cs.Clicks, &last, &trackedAt); err != nil {
+			return nil, fmt.Errorf("scan click stats: %w", err)
+		}
+		cs.LastClickAt = parseTimestamp(last)
+		stats = append(stats, cs)
+	}
+	return stats, rows.Err()
+}
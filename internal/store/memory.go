@@ -0,0 +1,2158 @@
+package store
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+)
+
+// Memory is an EmailStore that keeps everything in process memory. It backs
+// the ephemeral demo mode (db.driver: memory) and tests; nothing survives a
+// restart. Results are copies, so callers may modify them freely.
+type Memory struct {
+	mu sync.Mutex
+
+	seq         int64 // insertion counter; breaks ties in time-ordered listings
+	emails      map[string]*memEmail
+	decisions   []memDecision
+	quota       map[quotaKey]int
+	contacts    map[contactKey]int
+	idempotency map[string]IdempotencyKey
+	tokens      []*memToken
+	shares      []*memShareLink
+	annotations []*memAnnotation
+	links       []*memLink
+	unsubscribe []*memUnsubscribe
+	suppressed  map[string]Suppression
+	sent        map[string]SentMessage
+	edits       []Edit
+	dailyStats  map[time.Time]DailyStats
+	settings    map[string]Setting
+	checkpoints map[checkpointKey]int64
+	audit       []memAudit
+	reputation  map[string]ReputationEntry
+	jobs        []*memJob
+	webhooks    []*memWebhook
+	deliveries  []*memDelivery
+	allow       map[allowKey]AllowRule
+	block       map[allowKey]BlockRule
+}
+
+type memEmail struct {
+	Email
+	seq int64
+}
+
+type memDecision struct {
+	Decision
+	seq int64
+}
+
+type memToken struct {
+	APIToken
+	seq int64
+}
+
+type memUnsubscribe struct {
+	UnsubscribeLink
+	seq int64
+}
+
+type memShareLink struct {
+	ShareLink
+	seq int64
+}
+
+type memAnnotation struct {
+	Annotation
+	seq int64
+}
+
+type memLink struct {
+	TrackedLink
+	seq int64
+}
+
+type memAudit struct {
+	AuditEntry
+	seq int64
+}
+
+type memJob struct {
+	Job
+	seq int64
+}
+
+type memWebhook struct {
+	Webhook
+	seq int64
+}
+
+type memDelivery struct {
+	WebhookDelivery
+	seq int64
+}
+
+type quotaKey struct {
+	sender, period string
+	windowStart    int64
+}
+
+type checkpointKey struct {
+	consumer, queue string
+}
+
+// allowKey keys allow and block rules.
+type allowKey struct {
+	direction, sender string
+}
+
+type contactKey struct {
+	address, direction string
+}
+
+// NewMemory creates an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		emails:      make(map[string]*memEmail),
+		quota:       make(map[quotaKey]int),
+		contacts:    make(map[contactKey]int),
+		idempotency: make(map[string]IdempotencyKey),
+		reputation:  make(map[string]ReputationEntry),
+		suppressed:  make(map[string]Suppression),
+		allow:       make(map[allowKey]AllowRule),
+		block:       make(map[allowKey]BlockRule),
+		sent:        make(map[string]SentMessage),
+		dailyStats:  make(map[time.Time]DailyStats),
+		settings:    make(map[string]Setting),
+		checkpoints: make(map[checkpointKey]int64),
+	}
+}
+
+func (m *Memory) next() int64 {
+	m.seq++
+	return m.seq
+}
+
+// SaveOutbound persists a new outbound email, assigning it a UUID.
+func (m *Memory) SaveOutbound(_ context.Context, sender string, recipients []string, subject, body string, rawMessage []byte) (string, error) {
+	return m.save(Email{
+		Direction: DirectionOutbound, Sender: sender, Recipients: recipients,
+		Subject: subject, Body: body, RawMessage: rawMessage,
+	}), nil
+}
+
+// SaveInbound persists a new inbound email from IMAP polling into queue.
+func (m *Memory) SaveInbound(_ context.Context, sender string, recipients []string, subject, body string, rawMessage []byte, imapMessageID, imapMailbox, queue string) (string, error) {
+	return m.save(Email{
+		Direction: DirectionInbound, Sender: sender, Recipients: recipients,
+		Subject: subject, Body: body, RawMessage: rawMessage,
+		IMAPMessageID: imapMessageID, IMAPMailbox: imapMailbox, Queue: queue,
+		InReplyTo: inReplyTo(rawMessage),
+	}), nil
+}
+
+// SaveOutboundBatch persists new outbound emails with their flags and tags
+// all at once, and returns their IDs in order.
+func (m *Memory) SaveOutboundBatch(_ context.Context, emails []Email) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(emails))
+	for _, e := range emails {
+		tags := slices.Clone(e.Tags)
+		slices.Sort(tags)
+		ids = append(ids, m.insert(Email{
+			Direction: DirectionOutbound, Sender: e.Sender, Recipients: e.Recipients,
+			Subject: e.Subject, Body: e.Body, RawMessage: e.RawMessage,
+			Flags: slices.Clone(e.Flags), Tags: slices.Compact(tags),
+		}))
+	}
+	return ids, nil
+}
+
+func (m *Memory) save(e Email) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insert(e)
+}
+
+// insert adds e as a new pending email. m.mu must be held.
+func (m *Memory) insert(e Email) string {
+	e.ID = uuid.New().String()
+	e.Status = StatusPending
+	e.ReceivedAt = time.Now().UTC()
+	e.HasAttachment = hasAttachments(e.RawMessage)
+	e.Snippet = mimetext.Snippet(e.Body)
+	m.emails[e.ID] = &memEmail{Email: cloneEmail(e), seq: m.next()}
+	return e.ID
+}
+
+// ListPending returns all pending emails, oldest first.
+func (m *Memory) ListPending(_ context.Context) ([]Email, error) {
+	return m.list(func(e *Email) bool { return e.Status == StatusPending }, false), nil
+}
+
+// ListPendingSummaries returns all pending emails with bodies cut to
+// PreviewLength characters and no raw message, as Store does.
+func (m *Memory) ListPendingSummaries(_ context.Context) ([]Email, error) {
+	return m.list(func(e *Email) bool { return e.Status == StatusPending }, true), nil
+}
+
+// ListPendingPage returns one page of email summaries matching q, and the
+// number of matches across all pages.
+func (m *Memory) ListPendingPage(_ context.Context, q PendingQuery) ([]Email, int, error) {
+	status := cmp.Or(q.Status, StatusPending)
+	emails := m.list(func(e *Email) bool {
+		return e.Status == status &&
+			(q.Direction == "" || e.Direction == q.Direction) &&
+			(q.Queue == "" || e.Queue == q.Queue) &&
+			(!q.HasAttachments || e.HasAttachment) &&
+			(q.Tag == "" || slices.Contains(e.Tags, q.Tag)) &&
+			(q.ReceivedBefore.IsZero() || e.ReceivedAt.Before(q.ReceivedBefore)) &&
+			(q.ReceivedAfter.IsZero() || !e.ReceivedAt.Before(q.ReceivedAfter)) &&
+			(q.SnoozedAt.IsZero() && !q.Snoozed || q.Snoozed == snoozedAt(e, q.SnoozedAt))
+	}, true)
+
+	// emails is oldest first, so a stable sort keeps age as the tie-break.
+	slices.SortStableFunc(emails, func(a, b Email) int {
+		var c int
+		switch q.Sort {
+		case SortSender:
+			c = strings.Compare(strings.ToLower(a.Sender), strings.ToLower(b.Sender))
+		case SortSubject:
+			c = strings.Compare(strings.ToLower(a.Subject), strings.ToLower(b.Subject))
+		default:
+			c = a.ReceivedAt.Compare(b.ReceivedAt)
+		}
+		if q.Desc {
+			c = -c
+		}
+		return c
+	})
+
+	total := len(emails)
+	start := min(max(q.Offset, 0), total)
+	end := total
+	if q.Limit > 0 {
+		end = min(start+q.Limit, total)
+	}
+	return emails[start:end], total, nil
+}
+
+// ListApproved returns approved inbound emails, oldest first, without their
+// raw messages as Store does. If queue is non-empty only emails routed to
+// that queue are returned, and if tag is non-empty only emails with that tag.
+func (m *Memory) ListApproved(_ context.Context, queue, tag string) ([]Email, error) {
+	return withoutRaw(m.list(func(e *Email) bool {
+		return e.Direction == DirectionInbound && e.Status == StatusApproved &&
+			(queue == "" || e.Queue == queue) &&
+			(tag == "" || slices.Contains(e.Tags, tag))
+	}, false)), nil
+}
+
+// ListApprovedAfter returns approved inbound emails approved after position
+// after, in the order they were approved, without their raw messages. If
+// queue is non-empty only emails routed to that queue are returned.
+func (m *Memory) ListApprovedAfter(_ context.Context, queue string, after int64) ([]Email, error) {
+	emails := m.list(func(e *Email) bool {
+		return e.Direction == DirectionInbound && e.Status == StatusApproved &&
+			e.ApprovalSeq > after && (queue == "" || e.Queue == queue)
+	}, false)
+	slices.SortFunc(emails, func(a, b Email) int { return cmp.Compare(a.ApprovalSeq, b.ApprovalSeq) })
+	return withoutRaw(emails), nil
+}
+
+// withoutRaw drops the raw messages of emails.
+func withoutRaw(emails []Email) []Email {
+	for i := range emails {
+		emails[i].RawMessage = nil
+	}
+	return emails
+}
+
+// ListScheduled returns scheduled outbound emails as summaries, the next to
+// be relayed first.
+func (m *Memory) ListScheduled(_ context.Context) ([]Email, error) {
+	emails := m.list(func(e *Email) bool { return e.Status == StatusScheduled }, true)
+	slices.SortStableFunc(emails, func(a, b Email) int { return a.ScheduledAt.Compare(b.ScheduledAt) })
+	return emails, nil
+}
+
+// ListInFlight returns outbound emails left relaying or sent, the oldest
+// first.
+func (m *Memory) ListInFlight(_ context.Context) ([]Email, error) {
+	return m.list(func(e *Email) bool { return e.Status == StatusRelaying || e.Status == StatusSent }, false), nil
+}
+
+func (m *Memory) list(match func(*Email) bool, summary bool) []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found []*memEmail
+	for _, e := range m.emails {
+		if match(&e.Email) {
+			found = append(found, e)
+		}
+	}
+	slices.SortFunc(found, func(a, b *memEmail) int {
+		return cmp.Or(a.ReceivedAt.Compare(b.ReceivedAt), cmp.Compare(a.seq, b.seq))
+	})
+	var emails []Email
+	for _, e := range found {
+		emails = append(emails, copyEmail(e.Email, summary))
+	}
+	return emails
+}
+
+// Get retrieves a single email by ID.
+func (m *Memory) Get(_ context.Context, id string) (*Email, error) {
+	return m.get(id, false)
+}
+
+// GetSummary retrieves a single email by ID with its body cut to a preview and
+// no raw message.
+func (m *Memory) GetSummary(_ context.Context, id string) (*Email, error) {
+	return m.get(id, true)
+}
+
+// OpenRaw returns a reader over the raw message of email id, empty if it was
+// not stored.
+func (m *Memory) OpenRaw(_ context.Context, id string) (io.ReadCloser, error) {
+	e, err := m.get(id, false)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(e.RawMessage)), nil
+}
+
+func (m *Memory) get(id string, summary bool) (*Email, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return nil, fmt.Errorf("email not found: %s", id)
+	}
+	c := copyEmail(e.Email, summary)
+	return &c, nil
+}
+
+// CountPending returns the number of pending emails.
+func (m *Memory) CountPending(_ context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, e := range m.emails {
+		if e.Status == StatusPending {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CountByStatus returns the number of emails per direction and status,
+// ordered by direction, then status. Combinations without emails are omitted.
+func (m *Memory) CountByStatus(_ context.Context) ([]StatusCount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byKey := make(map[[2]string]int)
+	for _, e := range m.emails {
+		byKey[[2]string{e.Direction, e.Status}]++
+	}
+	var counts []StatusCount
+	for k, n := range byKey {
+		counts = append(counts, StatusCount{Direction: k[0], Status: k[1], Count: n})
+	}
+	slices.SortFunc(counts, func(a, b StatusCount) int {
+		return cmp.Or(strings.Compare(a.Direction, b.Direction), strings.Compare(a.Status, b.Status))
+	})
+	return counts, nil
+}
+
+// OldestPendingAge returns how long the oldest pending email has waited at
+// now, or 0 if nothing is pending.
+func (m *Memory) OldestPendingAge(_ context.Context, now time.Time) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var oldest time.Time
+	for _, e := range m.emails {
+		if e.Status == StatusPending && (oldest.IsZero() || e.ReceivedAt.Before(oldest)) {
+			oldest = e.ReceivedAt
+		}
+	}
+	if oldest.IsZero() {
+		return 0, nil
+	}
+	return now.Sub(oldest), nil
+}
+
+// update applies fn to the email with the given id.
+func (m *Memory) update(id string, fn func(*Email)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	fn(&e.Email)
+	return nil
+}
+
+// Approve sets a pending email's status to approved, recording who approved
+// it and when. It returns ErrConflict unless the email is still pending at
+// version.
+func (m *Memory) Approve(_ context.Context, id, approvedBy string, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusPending || e.Version != version {
+		return ErrConflict
+	}
+	e.Status = StatusApproved
+	e.ApprovedBy = approvedBy
+	e.ApprovedAt = time.Now().UTC()
+	e.ApprovalSeq = m.next()
+	e.Version++
+	return nil
+}
+
+// AddApproval records a's approval of a pending email that needs more than
+// one, leaving it pending. It returns ErrConflict unless the email is still
+// pending at version.
+func (m *Memory) AddApproval(_ context.Context, id string, a Approval, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusPending || e.Version != version {
+		return ErrConflict
+	}
+	if a.At.IsZero() {
+		a.At = time.Now().UTC()
+	}
+	e.Approvals = append(e.Approvals, a)
+	e.Version++
+	return nil
+}
+
+// EditEmail replaces the recipients, subject, body and raw message of the
+// pending email e.EmailID with e.After and rawMessage, and records e. The
+// approvals given so far were for the old version and are dropped. Like
+// Approve it takes the version the caller last saw and returns ErrConflict
+// if the email has changed since or is no longer pending. A zero EditedAt
+// means now.
+func (m *Memory) EditEmail(_ context.Context, e Edit, rawMessage []byte, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	email, ok := m.emails[e.EmailID]
+	if !ok {
+		return fmt.Errorf("email not found: %s", e.EmailID)
+	}
+	if email.Status != StatusPending || email.Version != version {
+		return ErrConflict
+	}
+	if e.EditedAt.IsZero() {
+		e.EditedAt = time.Now().UTC()
+	}
+	e = cloneEdit(e)
+	email.Recipients = slices.Clone(e.After.Recipients)
+	email.Subject = e.After.Subject
+	email.Body = e.After.Body
+	email.RawMessage = slices.Clone(rawMessage)
+	email.HasAttachment = hasAttachments(rawMessage)
+	email.Snippet = mimetext.Snippet(e.After.Body)
+	email.Approvals = nil
+	email.Version++
+	m.edits = append(m.edits, e)
+	return nil
+}
+
+// Unapprove returns an approved email to pending, e.g. when relaying it
+// failed. It returns ErrConflict if the email is not approved.
+func (m *Memory) Unapprove(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusApproved {
+		return ErrConflict
+	}
+	e.Status = StatusPending
+	e.ApprovedBy = ""
+	e.ApprovedAt = time.Time{}
+	e.ApprovalSeq = 0
+	e.Version++
+	return nil
+}
+
+// Schedule marks an approved outbound email to be relayed at at. It returns
+// ErrConflict if the email is not approved.
+func (m *Memory) Schedule(_ context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusApproved {
+		return ErrConflict
+	}
+	e.Status = StatusScheduled
+	e.ScheduledAt = at.UTC()
+	e.Version++
+	return nil
+}
+
+// Reschedule moves a scheduled email to be relayed at at instead. It returns
+// ErrConflict if the email is not scheduled.
+func (m *Memory) Reschedule(_ context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusScheduled {
+		return ErrConflict
+	}
+	e.ScheduledAt = at.UTC()
+	e.Version++
+	return nil
+}
+
+// snoozedAt reports whether e is snoozed at at, or at all if at is zero.
+func snoozedAt(e *Email, at time.Time) bool {
+	if at.IsZero() {
+		return !e.SnoozedUntil.IsZero()
+	}
+	return e.SnoozedUntil.After(at)
+}
+
+// Snooze hides a pending email from the default pending list until until. It
+// returns ErrConflict if the email is not pending.
+func (m *Memory) Snooze(_ context.Context, id, by string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusPending {
+		return ErrConflict
+	}
+	e.SnoozedUntil = until.UTC()
+	e.SnoozedBy = by
+	return nil
+}
+
+// Unsnooze returns a snoozed email to the pending list at once.
+func (m *Memory) Unsnooze(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	e.SnoozedUntil, e.SnoozedBy = time.Time{}, ""
+	return nil
+}
+
+// WakeSnoozed ends the snoozes that expired at or before now and returns the
+// pending emails woken as summaries, the earliest snoozed until first.
+func (m *Memory) WakeSnoozed(_ context.Context, now time.Time) ([]Email, error) {
+	expired := func(e *Email) bool { return !e.SnoozedUntil.IsZero() && !e.SnoozedUntil.After(now) }
+	emails := m.list(func(e *Email) bool { return e.Status == StatusPending && expired(e) }, true)
+	slices.SortStableFunc(emails, func(a, b Email) int { return a.SnoozedUntil.Compare(b.SnoozedUntil) })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.emails {
+		if expired(&e.Email) {
+			e.SnoozedUntil, e.SnoozedBy = time.Time{}, ""
+		}
+	}
+	return emails, nil
+}
+
+// BeginRelay marks an approved or scheduled outbound email as relaying. It
+// returns ErrConflict if the email is in any other status.
+func (m *Memory) BeginRelay(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Direction != DirectionOutbound || (e.Status != StatusApproved && e.Status != StatusScheduled) {
+		return ErrConflict
+	}
+	e.Status = StatusRelaying
+	e.Version++
+	return nil
+}
+
+// AbortRelay returns a relaying email to status after the relay refused it.
+// It returns ErrConflict if the email is not relaying.
+func (m *Memory) AbortRelay(_ context.Context, id, status string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusRelaying {
+		return ErrConflict
+	}
+	e.Status = status
+	e.Version++
+	return nil
+}
+
+// MarkSent records that the relay accepted a relaying email. Marking a sent
+// email again does nothing; any other status is ErrConflict.
+func (m *Memory) MarkSent(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	switch e.Status {
+	case StatusSent:
+		return nil
+	case StatusRelaying:
+		e.Status = StatusSent
+		e.RelayedAt = time.Now().UTC()
+		e.Version++
+		return nil
+	}
+	return ErrConflict
+}
+
+// Reject deletes a pending email. It returns ErrConflict unless the email is
+// still pending at version.
+func (m *Memory) Reject(_ context.Context, id string, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[id]
+	if !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	if e.Status != StatusPending || e.Version != version {
+		return ErrConflict
+	}
+	delete(m.emails, id)
+	m.shares = slices.DeleteFunc(m.shares, func(l *memShareLink) bool { return l.EmailID == id })
+	m.annotations = slices.DeleteFunc(m.annotations, func(a *memAnnotation) bool { return a.EmailID == id })
+	return nil
+}
+
+// UpdateIMAPMailbox updates the IMAP mailbox field for an email.
+func (m *Memory) UpdateIMAPMailbox(_ context.Context, id, mailbox string) error {
+	return m.update(id, func(e *Email) { e.IMAPMailbox = mailbox })
+}
+
+// AddFlag sets flag on an email. Setting a flag that is already present is a no-op.
+func (m *Memory) AddFlag(_ context.Context, id, flag string) error {
+	return m.update(id, func(e *Email) {
+		if !e.HasFlag(flag) {
+			e.Flags = append(e.Flags, flag)
+		}
+	})
+}
+
+// SetSignature records the signature verification result for an email.
+func (m *Memory) SetSignature(_ context.Context, id string, sig Signature) error {
+	return m.update(id, func(e *Email) { e.Signature = &sig })
+}
+
+// SetEnvelopeRecipients records the addresses an inbound email was delivered to.
+func (m *Memory) SetEnvelopeRecipients(_ context.Context, id string, recipients []string) error {
+	return m.update(id, func(e *Email) { e.EnvelopeRecipients = slices.Clone(recipients) })
+}
+
+// AddTag applies tag to an email. Adding a tag that is already present is a
+// no-op.
+func (m *Memory) AddTag(_ context.Context, id, tag string) error {
+	return m.update(id, func(e *Email) {
+		if i, found := slices.BinarySearch(e.Tags, tag); !found {
+			e.Tags = slices.Insert(e.Tags, i, tag)
+		}
+	})
+}
+
+// RemoveTag removes tag from an email. Removing a tag that is not present is
+// a no-op.
+func (m *Memory) RemoveTag(_ context.Context, id, tag string) error {
+	return m.update(id, func(e *Email) {
+		e.Tags = slices.DeleteFunc(e.Tags, func(t string) bool { return t == tag })
+		if len(e.Tags) == 0 {
+			e.Tags = nil
+		}
+	})
+}
+
+// ListTags returns every tag applied to a held email, sorted.
+func (m *Memory) ListTags(_ context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tags []string
+	for _, e := range m.emails {
+		tags = append(tags, e.Tags...)
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags), nil
+}
+
+// TagUsage returns how many emails tagged tag are pending and how much space
+// the raw messages of all emails tagged tag take.
+func (m *Memory) TagUsage(_ context.Context, tag string) (TagUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var u TagUsage
+	for _, e := range m.emails {
+		if _, found := slices.BinarySearch(e.Tags, tag); !found {
+			continue
+		}
+		if e.Status == StatusPending {
+			u.Pending++
+		}
+		u.Bytes += int64(len(e.RawMessage))
+	}
+	return u, nil
+}
+
+// Delete removes an email by ID.
+func (m *Memory) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.emails[id]; !ok {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	delete(m.emails, id)
+	m.shares = slices.DeleteFunc(m.shares, func(l *memShareLink) bool { return l.EmailID == id })
+	m.annotations = slices.DeleteFunc(m.annotations, func(a *memAnnotation) bool { return a.EmailID == id })
+	return nil
+}
+
+// RecordDecision appends a reviewer decision to the decision log.
+func (m *Memory) RecordDecision(_ context.Context, d Decision) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d.DecidedAt.IsZero() {
+		d.DecidedAt = time.Now().UTC()
+	}
+	if d.EnvelopeID != "" && d.DeliveryStatus == "" {
+		d.DeliveryStatus = DeliveryRequested
+	}
+	d.RawMessage = nil
+	m.decisions = append(m.decisions, memDecision{Decision: d, seq: m.next()})
+	return nil
+}
+
+// UpdateDelivery records the delivery status reported by a DSN on the
+// decision that relayed the mail with envelopeID.
+func (m *Memory) UpdateDelivery(_ context.Context, envelopeID, status, detail string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for i := range m.decisions {
+		if d := &m.decisions[i]; d.EnvelopeID == envelopeID {
+			d.DeliveryStatus, d.DeliveryDetail = status, detail
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no decision with envelope ID %s", envelopeID)
+	}
+	return nil
+}
+
+// ListDecisions returns the most recent decisions, newest first, up to limit.
+func (m *Memory) ListDecisions(_ context.Context, limit int) ([]Decision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sorted := slices.Clone(m.decisions)
+	slices.SortFunc(sorted, func(a, b memDecision) int {
+		return cmp.Or(b.DecidedAt.Compare(a.DecidedAt), cmp.Compare(b.seq, a.seq))
+	})
+	var decisions []Decision
+	for _, d := range sorted[:clampLimit(limit, len(sorted))] {
+		decisions = append(decisions, d.Decision)
+	}
+	return decisions, nil
+}
+
+// ListDecisionPage returns one page of the decisions matching q, newest
+// first, and the number of matches across all pages.
+func (m *Memory) ListDecisionPage(ctx context.Context, q DecisionQuery) ([]Decision, int, error) {
+	var match func(d Decision) bool
+	switch q.Outcome {
+	case "":
+		match = func(Decision) bool { return true }
+	case OutcomeRejected:
+		match = func(d Decision) bool { return d.Decision == DecisionRejected }
+	case OutcomeSent:
+		match = func(d Decision) bool {
+			return d.Decision == DecisionApproved && d.Direction == DirectionOutbound && d.DeliveryStatus != DeliveryFailed
+		}
+	case OutcomeBounced:
+		match = func(d Decision) bool { return d.DeliveryStatus == DeliveryFailed }
+	default:
+		return nil, 0, fmt.Errorf("unknown outcome %q", q.Outcome)
+	}
+	all, _ := m.ListDecisions(ctx, -1)
+	var decisions []Decision
+	for _, d := range all {
+		if match(d) {
+			decisions = append(decisions, d)
+		}
+	}
+	total := len(decisions)
+	start := min(max(q.Offset, 0), total)
+	end := total
+	if q.Limit > 0 {
+		end = min(start+q.Limit, total)
+	}
+	return decisions[start:end], total, nil
+}
+
+// LastDecision returns the most recent decision on an email, or nil if none
+// was recorded.
+func (m *Memory) LastDecision(_ context.Context, emailID string) (*Decision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var last *memDecision
+	for i, d := range m.decisions {
+		if d.EmailID != emailID {
+			continue
+		}
+		if last == nil || cmp.Or(d.DecidedAt.Compare(last.DecidedAt), cmp.Compare(d.seq, last.seq)) > 0 {
+			last = &m.decisions[i]
+		}
+	}
+	if last == nil {
+		return nil, nil
+	}
+	d := last.Decision
+	return &d, nil
+}
+
+// ListReviewerStats returns per-reviewer decision counts and latencies,
+// ordered by reviewer name. Forwards are left out: they are not decisions.
+func (m *Memory) ListReviewerStats(_ context.Context) ([]ReviewerStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byReviewer := make(map[string]*ReviewerStats)
+	totals := make(map[string]time.Duration)
+	for _, d := range m.decisions {
+		if d.Decision.Decision != DecisionApproved && d.Decision.Decision != DecisionRejected {
+			continue
+		}
+		rs, ok := byReviewer[d.Reviewer]
+		if !ok {
+			rs = &ReviewerStats{Reviewer: d.Reviewer}
+			byReviewer[d.Reviewer] = rs
+		}
+		switch d.Decision.Decision {
+		case DecisionApproved:
+			rs.Approved++
+		case DecisionRejected:
+			rs.Rejected++
+		}
+		totals[d.Reviewer] += d.Latency
+		rs.MaxLatency = max(rs.MaxLatency, d.Latency)
+		if d.DecidedAt.After(rs.LastDecisionAt) {
+			rs.LastDecisionAt = d.DecidedAt
+		}
+	}
+	var stats []ReviewerStats
+	for _, rs := range byReviewer {
+		if n := rs.Approved + rs.Rejected; n > 0 {
+			rs.AverageLatency = totals[rs.Reviewer] / time.Duration(n)
+		}
+		stats = append(stats, *rs)
+	}
+	slices.SortFunc(stats, func(a, b ReviewerStats) int { return strings.Compare(a.Reviewer, b.Reviewer) })
+	return stats, nil
+}
+
+// IncrementQuota adds one to sender's submission count for the window of the
+// given period starting at windowStart and returns the new count.
+func (m *Memory) IncrementQuota(_ context.Context, sender, period string, windowStart time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := quotaKey{sender: sender, period: period, windowStart: windowStart.Unix()}
+	m.quota[k]++
+	return m.quota[k], nil
+}
+
+// DecrementQuota takes one from sender's submission count for the window of
+// the given period starting at windowStart, never going below zero.
+func (m *Memory) DecrementQuota(_ context.Context, sender, period string, windowStart time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := quotaKey{sender: sender, period: period, windowStart: windowStart.Unix()}
+	if m.quota[k] > 0 {
+		m.quota[k]--
+	}
+	return nil
+}
+
+// ListQuotaUsage returns counters for windows starting at or after since,
+// ordered by sender, then period.
+func (m *Memory) ListQuotaUsage(_ context.Context, since time.Time) ([]QuotaUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var usage []QuotaUsage
+	for k, n := range m.quota {
+		if k.windowStart >= since.Unix() {
+			usage = append(usage, QuotaUsage{Sender: k.sender, Period: k.period, WindowStart: time.Unix(k.windowStart, 0).UTC(), Count: n})
+		}
+	}
+	slices.SortFunc(usage, func(a, b QuotaUsage) int {
+		return cmp.Or(strings.Compare(a.Sender, b.Sender), strings.Compare(a.Period, b.Period), b.WindowStart.Compare(a.WindowStart))
+	})
+	return usage, nil
+}
+
+// PruneQuota deletes counters for windows that started before before.
+func (m *Memory) PruneQuota(_ context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.quota {
+		if k.windowStart < before.Unix() {
+			delete(m.quota, k)
+		}
+	}
+	return nil
+}
+
+// RecordContacts increments the approval count of each address for direction.
+// Addresses are stored lower-cased.
+func (m *Memory) RecordContacts(_ context.Context, direction string, addresses []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, addr := range addresses {
+		m.contacts[contactKey{address: strings.ToLower(addr), direction: direction}]++
+	}
+	return nil
+}
+
+// ContactCounts returns the approval count for each of addresses in
+// direction, keyed by lower-cased address. Unknown addresses map to 0.
+func (m *Memory) ContactCounts(_ context.Context, direction string, addresses []string) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := make(map[string]int, len(addresses))
+	for _, addr := range addresses {
+		addr = strings.ToLower(addr)
+		counts[addr] = m.contacts[contactKey{address: addr, direction: direction}]
+	}
+	return counts, nil
+}
+
+// GetIdempotencyKey returns the submission recorded under key at or after
+// since, or nil if there is none.
+func (m *Memory) GetIdempotencyKey(_ context.Context, key string, since time.Time) (*IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.idempotency[key]
+	if !ok || k.CreatedAt.Unix() < since.Unix() {
+		return nil, nil
+	}
+	return &k, nil
+}
+
+// SaveIdempotencyKey records a submission under k.Key, replacing any earlier
+// record of the same key. A zero CreatedAt means now.
+func (m *Memory) SaveIdempotencyKey(_ context.Context, k IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k.CreatedAt.IsZero() {
+		k.CreatedAt = time.Now()
+	}
+	// Store keeps whole seconds; do the same so both backends expire keys alike.
+	k.CreatedAt = time.Unix(k.CreatedAt.Unix(), 0).UTC()
+	m.idempotency[k.Key] = k
+	return nil
+}
+
+// PruneIdempotencyKeys deletes keys recorded before before.
+func (m *Memory) PruneIdempotencyKeys(_ context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, k := range m.idempotency {
+		if k.CreatedAt.Unix() < before.Unix() {
+			delete(m.idempotency, key)
+		}
+	}
+	return nil
+}
+
+// CreateAPIToken stores a new token, assigning it a UUID. A zero CreatedAt
+// means now. Token hashes must be unique.
+func (m *Memory) CreateAPIToken(_ context.Context, t APIToken) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.tokens {
+		if existing.Hash == t.Hash {
+			return "", fmt.Errorf("insert API token: duplicate token hash")
+		}
+	}
+	t.ID = uuid.New().String()
+	t.Scopes = slices.Clone(t.Scopes)
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now().UTC()
+	}
+	t.LastUsedAt, t.RevokedAt = time.Time{}, time.Time{}
+	m.tokens = append(m.tokens, &memToken{APIToken: t, seq: m.next()})
+	return t.ID, nil
+}
+
+// ListAPITokens returns all tokens, revoked and expired ones included, newest first.
+func (m *Memory) ListAPITokens(_ context.Context) ([]APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sorted := slices.Clone(m.tokens)
+	slices.SortFunc(sorted, func(a, b *memToken) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(b.seq, a.seq))
+	})
+	var tokens []APIToken
+	for _, t := range sorted {
+		tokens = append(tokens, cloneToken(t.APIToken))
+	}
+	return tokens, nil
+}
+
+// GetAPITokenByHash returns the token with the given hash, or nil if there is none.
+func (m *Memory) GetAPITokenByHash(_ context.Context, hash string) (*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.Hash == hash {
+			c := cloneToken(t.APIToken)
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// TouchAPIToken sets the last-used time of a token.
+func (m *Memory) TouchAPIToken(_ context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.ID == id {
+			t.LastUsedAt = at.UTC()
+		}
+	}
+	return nil
+}
+
+// RevokeAPIToken marks a token revoked. Revoking an unknown or already
+// revoked token is an error.
+func (m *Memory) RevokeAPIToken(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.ID == id && t.RevokedAt.IsZero() {
+			t.RevokedAt = time.Now().UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("API token not found: %s", id)
+}
+
+// CreateShareLink stores a new share link, assigning it a UUID. A zero
+// CreatedAt means now. Token hashes must be unique.
+func (m *Memory) CreateShareLink(_ context.Context, l ShareLink) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.shares {
+		if existing.Hash == l.Hash {
+			return "", fmt.Errorf("insert share link: duplicate token hash")
+		}
+	}
+	l.ID = uuid.New().String()
+	if l.CreatedAt.IsZero() {
+		l.CreatedAt = time.Now().UTC()
+	}
+	m.shares = append(m.shares, &memShareLink{ShareLink: l, seq: m.next()})
+	return l.ID, nil
+}
+
+// ListShareLinks returns the share links of an email, revoked and expired
+// ones included, newest first.
+func (m *Memory) ListShareLinks(_ context.Context, emailID string) ([]ShareLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sorted []*memShareLink
+	for _, l := range m.shares {
+		if l.EmailID == emailID {
+			sorted = append(sorted, l)
+		}
+	}
+	slices.SortFunc(sorted, func(a, b *memShareLink) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(b.seq, a.seq))
+	})
+	var links []ShareLink
+	for _, l := range sorted {
+		links = append(links, l.ShareLink)
+	}
+	return links, nil
+}
+
+// GetShareLinkByHash returns the share link with the given hash, or nil if
+// there is none.
+func (m *Memory) GetShareLinkByHash(_ context.Context, hash string) (*ShareLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.shares {
+		if l.Hash == hash {
+			c := l.ShareLink
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// RevokeShareLink marks a share link revoked. Revoking an unknown or already
+// revoked link is an error.
+func (m *Memory) RevokeShareLink(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.shares {
+		if l.ID == id && l.RevokedAt.IsZero() {
+			l.RevokedAt = time.Now().UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("share link not found: %s", id)
+}
+
+// RecordAudit appends an entry to the audit log. A zero At means now.
+func (m *Memory) RecordAudit(_ context.Context, e AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	m.audit = append(m.audit, memAudit{AuditEntry: e, seq: m.next()})
+	return nil
+}
+
+// ListAudit returns the most recent audit entries, newest first.
+func (m *Memory) ListAudit(_ context.Context, limit int) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sorted := slices.Clone(m.audit)
+	slices.SortFunc(sorted, func(a, b memAudit) int {
+		return cmp.Or(b.At.Compare(a.At), cmp.Compare(b.seq, a.seq))
+	})
+	var entries []AuditEntry
+	for _, e := range sorted[:clampLimit(limit, len(sorted))] {
+		entries = append(entries, e.AuditEntry)
+	}
+	return entries, nil
+}
+
+// SetReputation records e, replacing any entry for the same subject. The
+// subject is stored lower-cased; a zero CreatedAt means now.
+func (m *Memory) SetReputation(_ context.Context, e ReputationEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	e.Subject = strings.ToLower(e.Subject)
+	m.reputation[e.Subject] = e
+	return nil
+}
+
+// GetReputation returns the entry for subject, or nil if there is none.
+func (m *Memory) GetReputation(_ context.Context, subject string) (*ReputationEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.reputation[strings.ToLower(subject)]
+	if !ok {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+// ListReputation returns every reputation entry, ordered by subject.
+func (m *Memory) ListReputation(_ context.Context) ([]ReputationEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []ReputationEntry
+	for _, e := range m.reputation {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b ReputationEntry) int { return strings.Compare(a.Subject, b.Subject) })
+	return entries, nil
+}
+
+// DeleteReputation removes the entry for subject.
+func (m *Memory) DeleteReputation(_ context.Context, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(subject)
+	if _, ok := m.reputation[key]; !ok {
+		return fmt.Errorf("reputation entry not found: %s", subject)
+	}
+	delete(m.reputation, key)
+	return nil
+}
+
+// AddAllowRule records r. The sender is stored lower-cased; a zero CreatedAt
+// means now. A rule that already exists for the direction and sender is kept
+// as it is.
+func (m *Memory) AddAllowRule(_ context.Context, r AllowRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.Sender = strings.ToLower(r.Sender)
+	key := allowKey{r.Direction, r.Sender}
+	if _, ok := m.allow[key]; ok {
+		return nil
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC()
+	}
+	m.allow[key] = r
+	return nil
+}
+
+// GetAllowRule returns the rule for sender in direction, or nil if there is
+// none.
+func (m *Memory) GetAllowRule(_ context.Context, direction, sender string) (*AllowRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.allow[allowKey{direction, strings.ToLower(sender)}]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// ListAllowRules returns every allow rule, ordered by direction and sender.
+func (m *Memory) ListAllowRules(_ context.Context) ([]AllowRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []AllowRule
+	for _, r := range m.allow {
+		list = append(list, r)
+	}
+	slices.SortFunc(list, func(a, b AllowRule) int {
+		return cmp.Or(strings.Compare(a.Direction, b.Direction), strings.Compare(a.Sender, b.Sender))
+	})
+	return list, nil
+}
+
+// DeleteAllowRule removes the rule for sender in direction.
+func (m *Memory) DeleteAllowRule(_ context.Context, direction, sender string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := allowKey{direction, strings.ToLower(sender)}
+	if _, ok := m.allow[key]; !ok {
+		return fmt.Errorf("allow rule not found: %s %s", direction, sender)
+	}
+	delete(m.allow, key)
+	return nil
+}
+
+// AddBlockRule records r. The subject is stored lower-cased; a zero CreatedAt
+// means now. A rule that already exists for the direction and subject is kept
+// as it is.
+func (m *Memory) AddBlockRule(_ context.Context, r BlockRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.Subject = strings.ToLower(r.Subject)
+	key := allowKey{r.Direction, r.Subject}
+	if _, ok := m.block[key]; ok {
+		return nil
+	}
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC()
+	}
+	r.Suppressed = 0
+	m.block[key] = r
+	return nil
+}
+
+// GetBlockRule returns the rule for subject (an address or a domain) in
+// direction, or nil if there is none.
+func (m *Memory) GetBlockRule(_ context.Context, direction, subject string) (*BlockRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.block[allowKey{direction, strings.ToLower(subject)}]
+	if !ok {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// ListBlockRules returns every block rule, ordered by direction and subject.
+func (m *Memory) ListBlockRules(_ context.Context) ([]BlockRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []BlockRule
+	for _, r := range m.block {
+		list = append(list, r)
+	}
+	slices.SortFunc(list, func(a, b BlockRule) int {
+		return cmp.Or(strings.Compare(a.Direction, b.Direction), strings.Compare(a.Subject, b.Subject))
+	})
+	return list, nil
+}
+
+// CountSuppressed counts an email rejected by the rule for subject in
+// direction.
+func (m *Memory) CountSuppressed(_ context.Context, direction, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := allowKey{direction, strings.ToLower(subject)}
+	if r, ok := m.block[key]; ok {
+		r.Suppressed++
+		m.block[key] = r
+	}
+	return nil
+}
+
+// DeleteBlockRule removes the rule for subject in direction.
+func (m *Memory) DeleteBlockRule(_ context.Context, direction, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := allowKey{direction, strings.ToLower(subject)}
+	if _, ok := m.block[key]; !ok {
+		return fmt.Errorf("block rule not found: %s %s", direction, subject)
+	}
+	delete(m.block, key)
+	return nil
+}
+
+// PruneDecisions deletes decisions made before before and returns how many
+// were deleted. An empty decision prunes both approvals and rejections.
+func (m *Memory) PruneDecisions(_ context.Context, decision string, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.decisions)
+	m.decisions = slices.DeleteFunc(m.decisions, func(d memDecision) bool {
+		return d.DecidedAt.Before(before) && (decision == "" || d.Decision.Decision == decision)
+	})
+	return n - len(m.decisions), nil
+}
+
+// PruneAudit deletes audit entries recorded before before and returns how
+// many were deleted.
+func (m *Memory) PruneAudit(_ context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.audit)
+	m.audit = slices.DeleteFunc(m.audit, func(e memAudit) bool { return e.At.Before(before) })
+	return n - len(m.audit), nil
+}
+
+// AddJob stores j, assigning it a UUID. A zero CreatedAt means now and a zero
+// RunAt means CreatedAt.
+func (m *Memory) AddJob(_ context.Context, j Job) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j.ID = uuid.New().String()
+	j.Payload = slices.Clone(j.Payload)
+	if j.CreatedAt.IsZero() {
+		j.CreatedAt = time.Now().UTC()
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = j.CreatedAt
+	}
+	m.jobs = append(m.jobs, &memJob{Job: j, seq: m.next()})
+	return j.ID, nil
+}
+
+// ClaimJob marks the pending job that has been due the longest as running,
+// counting the attempt, and returns it. It returns nil if no job is due at
+// now.
+func (m *Memory) ClaimJob(_ context.Context, now time.Time) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due *memJob
+	for _, j := range m.jobs {
+		if j.Status != JobPending || j.RunAt.After(now) {
+			continue
+		}
+		if due == nil || cmp.Or(j.RunAt.Compare(due.RunAt), j.CreatedAt.Compare(due.CreatedAt), cmp.Compare(j.seq, due.seq)) < 0 {
+			due = j
+		}
+	}
+	if due == nil {
+		return nil, nil
+	}
+	due.Status = JobRunning
+	due.Attempts++
+	j := cloneJob(due.Job)
+	return &j, nil
+}
+
+// RetryJobAt returns a running job that failed with lastError to the queue,
+// due at runAt.
+func (m *Memory) RetryJobAt(_ context.Context, id, lastError string, runAt time.Time) error {
+	return m.updateJob(id, func(j *Job) bool {
+		if j.Status != JobRunning {
+			return false
+		}
+		j.Status, j.LastError, j.RunAt = JobPending, lastError, runAt
+		return true
+	})
+}
+
+// FailJob marks a running job that failed with lastError as failed for good.
+func (m *Memory) FailJob(_ context.Context, id, lastError string) error {
+	return m.updateJob(id, func(j *Job) bool {
+		if j.Status != JobRunning {
+			return false
+		}
+		j.Status, j.LastError = JobFailed, lastError
+		return true
+	})
+}
+
+// RequeueJob makes a pending or failed job due now with a fresh set of
+// attempts.
+func (m *Memory) RequeueJob(_ context.Context, id string) error {
+	return m.updateJob(id, func(j *Job) bool {
+		if j.Status == JobRunning {
+			return false
+		}
+		j.Status, j.Attempts, j.RunAt = JobPending, 0, time.Now().UTC()
+		return true
+	})
+}
+
+// DeleteJob deletes a job, once it has succeeded or been discarded.
+func (m *Memory) DeleteJob(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.jobs)
+	m.jobs = slices.DeleteFunc(m.jobs, func(j *memJob) bool { return j.ID == id })
+	if len(m.jobs) == n {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// updateJob applies change to job id, returning ErrJobNotFound if there is
+// no such job or change reports that it does not apply.
+func (m *Memory) updateJob(id string, change func(*Job) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if j.ID == id {
+			if !change(&j.Job) {
+				return ErrJobNotFound
+			}
+			return nil
+		}
+	}
+	return ErrJobNotFound
+}
+
+// ResetRunningJobs returns running jobs to the queue and returns how many
+// there were. A Memory starts empty, so this only matters in tests.
+func (m *Memory) ResetRunningJobs(_ context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, j := range m.jobs {
+		if j.Status == JobRunning {
+			j.Status = JobPending
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ListJobs returns every job, oldest first.
+func (m *Memory) ListJobs(_ context.Context) ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sorted := slices.Clone(m.jobs)
+	slices.SortFunc(sorted, func(a, b *memJob) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.seq, b.seq))
+	})
+	var jobs []Job
+	for _, j := range sorted {
+		jobs = append(jobs, cloneJob(j.Job))
+	}
+	return jobs, nil
+}
+
+// AddAnnotation stores a on its email, assigning it a UUID. A zero
+// CreatedAt means now. It fails if the email does not exist.
+func (m *Memory) AddAnnotation(_ context.Context, a Annotation) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.emails[a.EmailID]; !ok {
+		return "", fmt.Errorf("email not found: %s", a.EmailID)
+	}
+	a.ID = uuid.New().String()
+	a.Findings = slices.Clone(a.Findings)
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now().UTC()
+	}
+	m.annotations = append(m.annotations, &memAnnotation{Annotation: a, seq: m.next()})
+	return a.ID, nil
+}
+
+// ListAnnotations returns the annotations of an email, oldest first.
+func (m *Memory) ListAnnotations(_ context.Context, emailID string) ([]Annotation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sorted []*memAnnotation
+	for _, a := range m.annotations {
+		if a.EmailID == emailID {
+			sorted = append(sorted, a)
+		}
+	}
+	slices.SortFunc(sorted, func(a, b *memAnnotation) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.seq, b.seq))
+	})
+	var annotations []Annotation
+	for _, a := range sorted {
+		c := a.Annotation
+		c.Findings = slices.Clone(c.Findings)
+		annotations = append(annotations, c)
+	}
+	return annotations, nil
+}
+
+// TrackLinks stores links, skipping those whose ID is already stored, so an
+// email relayed again keeps the clicks counted so far. A zero CreatedAt
+// means now.
+func (m *Memory) TrackLinks(_ context.Context, links []TrackedLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	for _, l := range links {
+		if slices.ContainsFunc(m.links, func(existing *memLink) bool { return existing.ID == l.ID }) {
+			continue
+		}
+		if l.CreatedAt.IsZero() {
+			l.CreatedAt = now
+		}
+		l.Clicks, l.LastClickAt = 0, time.Time{}
+		m.links = append(m.links, &memLink{TrackedLink: l, seq: m.next()})
+	}
+	return nil
+}
+
+// ClickLink counts a click at the given time on the tracked link with the
+// given ID and returns the link, or nil if there is none.
+func (m *Memory) ClickLink(_ context.Context, id string, at time.Time) (*TrackedLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.links {
+		if l.ID == id {
+			l.Clicks++
+			l.LastClickAt = at.UTC()
+			c := l.TrackedLink
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// AddUnsubscribeLinks stores links, skipping those whose ID is already
+// stored. A zero CreatedAt means now.
+func (m *Memory) AddUnsubscribeLinks(_ context.Context, links []UnsubscribeLink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	for _, l := range links {
+		if slices.ContainsFunc(m.unsubscribe, func(existing *memUnsubscribe) bool { return existing.ID == l.ID }) {
+			continue
+		}
+		if l.CreatedAt.IsZero() {
+			l.CreatedAt = now
+		}
+		l.Address, l.UnsubscribedAt = strings.ToLower(l.Address), time.Time{}
+		m.unsubscribe = append(m.unsubscribe, &memUnsubscribe{UnsubscribeLink: l, seq: m.next()})
+	}
+	return nil
+}
+
+// Unsubscribe opts out the recipient of the unsubscribe link with the given
+// ID and returns the link, or nil if there is none.
+func (m *Memory) Unsubscribe(_ context.Context, id string, at time.Time) (*UnsubscribeLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.unsubscribe {
+		if l.ID == id {
+			if l.UnsubscribedAt.IsZero() {
+				l.UnsubscribedAt = at.UTC()
+			}
+			c := l.UnsubscribeLink
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// OptedOut returns those of addresses whose recipient has unsubscribed.
+func (m *Memory) OptedOut(_ context.Context, addresses []string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []string
+	for _, a := range addresses {
+		if slices.ContainsFunc(m.unsubscribe, func(l *memUnsubscribe) bool {
+			return l.Address == strings.ToLower(a) && !l.UnsubscribedAt.IsZero()
+		}) {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// ListOptOuts returns, for each opted-out recipient, the link they last
+// unsubscribed with, the most recent first.
+func (m *Memory) ListOptOuts(_ context.Context) ([]UnsubscribeLink, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found []*memUnsubscribe
+	for _, l := range m.unsubscribe {
+		if !l.UnsubscribedAt.IsZero() {
+			found = append(found, l)
+		}
+	}
+	slices.SortFunc(found, func(a, b *memUnsubscribe) int {
+		return cmp.Or(b.UnsubscribedAt.Compare(a.UnsubscribedAt), cmp.Compare(b.seq, a.seq))
+	})
+	var links []UnsubscribeLink
+	seen := make(map[string]bool)
+	for _, l := range found {
+		if !seen[l.Address] {
+			seen[l.Address] = true
+			links = append(links, l.UnsubscribeLink)
+		}
+	}
+	return links, nil
+}
+
+// Resubscribe removes address's opt-out. It returns an error if the address
+// has not unsubscribed.
+func (m *Memory) Resubscribe(_ context.Context, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for _, l := range m.unsubscribe {
+		if l.Address == strings.ToLower(address) && !l.UnsubscribedAt.IsZero() {
+			l.UnsubscribedAt = time.Time{}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no opt-out for %s", address)
+	}
+	return nil
+}
+
+// AddSuppression records e, replacing any entry for the same address. The
+// address is stored lower-cased; a zero CreatedAt means now.
+func (m *Memory) AddSuppression(_ context.Context, e Suppression) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.Address = strings.ToLower(e.Address)
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	m.suppressed[e.Address] = e
+	return nil
+}
+
+// Suppressed returns the entries of those of addresses that are on the
+// suppression list, in the order given.
+func (m *Memory) Suppressed(_ context.Context, addresses []string) ([]Suppression, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []Suppression
+	for _, a := range addresses {
+		if e, ok := m.suppressed[strings.ToLower(a)]; ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// ListSuppressions returns every suppressed address, the most recently added
+// first.
+func (m *Memory) ListSuppressions(_ context.Context) ([]Suppression, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []Suppression
+	for _, e := range m.suppressed {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b Suppression) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Address, b.Address)
+	})
+	return entries, nil
+}
+
+// DeleteSuppression removes address from the suppression list.
+func (m *Memory) DeleteSuppression(_ context.Context, address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(address)
+	if _, ok := m.suppressed[key]; !ok {
+		return fmt.Errorf("suppression not found: %s", address)
+	}
+	delete(m.suppressed, key)
+	return nil
+}
+
+// RecordSent stores msg, replacing any message recorded with the same
+// Message-Id. A zero SentAt means now.
+func (m *Memory) RecordSent(_ context.Context, msg SentMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg.SentAt.IsZero() {
+		msg.SentAt = time.Now().UTC()
+	}
+	msg.Recipients = slices.Clone(msg.Recipients)
+	m.sent[msg.MessageID] = msg
+	return nil
+}
+
+// GetSent returns the relayed message with the given Message-Id, or nil if
+// there is none.
+func (m *Memory) GetSent(_ context.Context, messageID string) (*SentMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg, ok := m.sent[messageID]
+	if !ok {
+		return nil, nil
+	}
+	msg.Recipients = slices.Clone(msg.Recipients)
+	return &msg, nil
+}
+
+// PruneSent deletes the messages relayed before before and returns how many
+// were deleted.
+func (m *Memory) PruneSent(_ context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.sent)
+	maps.DeleteFunc(m.sent, func(_ string, msg SentMessage) bool { return msg.SentAt.Before(before) })
+	return n - len(m.sent), nil
+}
+
+// ListEdits returns the edits of the given emails, oldest first.
+func (m *Memory) ListEdits(_ context.Context, emailIDs []string) ([]Edit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var edits []Edit
+	for _, e := range m.edits {
+		if slices.Contains(emailIDs, e.EmailID) {
+			edits = append(edits, cloneEdit(e))
+		}
+	}
+	return edits, nil
+}
+
+// PruneEdits deletes the edits made before before and returns how many were
+// deleted.
+func (m *Memory) PruneEdits(_ context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.edits)
+	m.edits = slices.DeleteFunc(m.edits, func(e Edit) bool { return e.EditedAt.Before(before) })
+	return n - len(m.edits), nil
+}
+
+// RollUpStats counts the mail of the UTC day of day from the emails and
+// decisions held, and saves the counts, replacing any earlier roll-up of
+// the day. Bounces are counted as far as they have been reported.
+func (m *Memory) RollUpStats(_ context.Context, day time.Time) (DailyStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := newDayCounter(day)
+	for _, d := range m.decisions {
+		c.decision(d.Decision)
+	}
+	for _, e := range m.emails {
+		c.email(e.ID, e.ReceivedAt)
+	}
+	stats := c.result()
+	m.dailyStats[stats.Day] = stats
+	return stats, nil
+}
+
+// NextStatsDay returns the first day to roll up: the day after the latest
+// one rolled up or, before the first roll-up, the day of the oldest email
+// or decision held. It returns the zero time if there is nothing to roll up.
+func (m *Memory) NextStatsDay(_ context.Context) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.dailyStats) > 0 {
+		return slices.MaxFunc(slices.Collect(maps.Keys(m.dailyStats)), time.Time.Compare).AddDate(0, 0, 1), nil
+	}
+	var oldest time.Time
+	for _, e := range m.emails {
+		if oldest.IsZero() || e.ReceivedAt.Before(oldest) {
+			oldest = e.ReceivedAt
+		}
+	}
+	for _, d := range m.decisions {
+		if oldest.IsZero() || d.DecidedAt.Before(oldest) {
+			oldest = d.DecidedAt
+		}
+	}
+	if oldest.IsZero() {
+		return time.Time{}, nil
+	}
+	return startOfDay(oldest), nil
+}
+
+// ListDailyStats returns the days rolled up since since, newest first.
+func (m *Memory) ListDailyStats(_ context.Context, since time.Time) ([]DailyStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	since = startOfDay(since)
+	var list []DailyStats
+	for day, stats := range m.dailyStats {
+		if !day.Before(since) {
+			list = append(list, stats)
+		}
+	}
+	slices.SortFunc(list, func(a, b DailyStats) int { return b.Day.Compare(a.Day) })
+	return list, nil
+}
+
+// GetCheckpoint returns how far consumer has read queue; 0 if it has not
+// read it yet.
+func (m *Memory) GetCheckpoint(_ context.Context, consumer, queue string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoints[checkpointKey{consumer, queue}], nil
+}
+
+// SaveCheckpoint records that consumer has read queue up to position. A
+// checkpoint never moves back.
+func (m *Memory) SaveCheckpoint(_ context.Context, consumer, queue string, position int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := checkpointKey{consumer, queue}
+	m.checkpoints[key] = max(m.checkpoints[key], position)
+	return nil
+}
+
+// ListSettings returns the settings changed at runtime, by key.
+func (m *Memory) ListSettings(_ context.Context) ([]Setting, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var settings []Setting
+	for _, key := range slices.Sorted(maps.Keys(m.settings)) {
+		settings = append(settings, m.settings[key])
+	}
+	return settings, nil
+}
+
+// SaveSetting stores st, replacing the setting with the same key. A zero
+// UpdatedAt means now.
+func (m *Memory) SaveSetting(_ context.Context, st Setting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st.UpdatedAt.IsZero() {
+		st.UpdatedAt = time.Now().UTC()
+	}
+	m.settings[st.Key] = st
+	return nil
+}
+
+// DeleteSetting removes the setting key, so the config file applies again.
+// Deleting a setting that was never changed is not an error.
+func (m *Memory) DeleteSetting(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.settings, key)
+	return nil
+}
+
+// ListClickStats returns the click counts of the emails with tracked links,
+// most clicked first, at most limit of them.
+func (m *Memory) ListClickStats(_ context.Context, limit int) ([]ClickStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byEmail := make(map[string]*ClickStats)
+	trackedAt := make(map[string]int64) // seq of the email's latest link
+	for _, l := range m.links {
+		cs, ok := byEmail[l.EmailID]
+		if !ok {
+			cs = &ClickStats{EmailID: l.EmailID, Subject: l.Subject}
+			byEmail[l.EmailID] = cs
+		}
+		cs.Links++
+		cs.Clicks += l.Clicks
+		if l.LastClickAt.After(cs.LastClickAt) {
+			cs.LastClickAt = l.LastClickAt
+		}
+		trackedAt[l.EmailID] = max(trackedAt[l.EmailID], l.seq)
+	}
+	stats := make([]ClickStats, 0, len(byEmail))
+	for _, cs := range byEmail {
+		stats = append(stats, *cs)
+	}
+	slices.SortFunc(stats, func(a, b ClickStats) int {
+		return cmp.Or(cmp.Compare(b.Clicks, a.Clicks), cmp.Compare(trackedAt[b.EmailID], trackedAt[a.EmailID]))
+	})
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats, nil
+}
+
+// CreateWebhook stores w, assigning it a UUID. A zero CreatedAt means now.
+func (m *Memory) CreateWebhook(_ context.Context, w Webhook) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.ID = uuid.New().String()
+	w.Events = slices.Clone(w.Events)
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = time.Now().UTC()
+	}
+	m.webhooks = append(m.webhooks, &memWebhook{Webhook: w, seq: m.next()})
+	return w.ID, nil
+}
+
+// ListWebhooks returns the webhooks of an API token, or every webhook if
+// tokenID is empty, oldest first.
+func (m *Memory) ListWebhooks(_ context.Context, tokenID string) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sorted []*memWebhook
+	for _, w := range m.webhooks {
+		if tokenID == "" || w.TokenID == tokenID {
+			sorted = append(sorted, w)
+		}
+	}
+	slices.SortFunc(sorted, func(a, b *memWebhook) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.seq, b.seq))
+	})
+	var webhooks []Webhook
+	for _, w := range sorted {
+		c := w.Webhook
+		c.Events = slices.Clone(c.Events)
+		webhooks = append(webhooks, c)
+	}
+	return webhooks, nil
+}
+
+// GetWebhook returns the webhook with the given ID, or nil if there is none.
+func (m *Memory) GetWebhook(_ context.Context, id string) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, w := range m.webhooks {
+		if w.ID == id {
+			c := w.Webhook
+			c.Events = slices.Clone(c.Events)
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteWebhook deletes a webhook and its deliveries, returning
+// ErrWebhookNotFound if there is no such webhook.
+func (m *Memory) DeleteWebhook(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.webhooks)
+	m.webhooks = slices.DeleteFunc(m.webhooks, func(w *memWebhook) bool { return w.ID == id })
+	if len(m.webhooks) == n {
+		return ErrWebhookNotFound
+	}
+	m.deliveries = slices.DeleteFunc(m.deliveries, func(d *memDelivery) bool { return d.WebhookID == id })
+	return nil
+}
+
+// AddWebhookDelivery stores d, assigning it a UUID. A zero CreatedAt means
+// now and a zero UpdatedAt means CreatedAt.
+func (m *Memory) AddWebhookDelivery(_ context.Context, d WebhookDelivery) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d.ID = uuid.New().String()
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	if d.UpdatedAt.IsZero() {
+		d.UpdatedAt = d.CreatedAt
+	}
+	m.deliveries = append(m.deliveries, &memDelivery{WebhookDelivery: d, seq: m.next()})
+	return d.ID, nil
+}
+
+// UpdateWebhookDelivery records the outcome of an attempt at delivery d.ID:
+// its status, attempts, response code, last error and UpdatedAt (now if
+// zero). It returns ErrWebhookNotFound if there is no such delivery.
+func (m *Memory) UpdateWebhookDelivery(_ context.Context, d WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d.UpdatedAt.IsZero() {
+		d.UpdatedAt = time.Now().UTC()
+	}
+	for _, existing := range m.deliveries {
+		if existing.ID == d.ID {
+			existing.Status, existing.Attempts, existing.ResponseCode = d.Status, d.Attempts, d.ResponseCode
+			existing.LastError, existing.UpdatedAt = d.LastError, d.UpdatedAt
+			return nil
+		}
+	}
+	return ErrWebhookNotFound
+}
+
+// ListWebhookDeliveries returns the most recent deliveries to a webhook,
+// newest first, up to limit.
+func (m *Memory) ListWebhookDeliveries(_ context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sorted []*memDelivery
+	for _, d := range m.deliveries {
+		if d.WebhookID == webhookID {
+			sorted = append(sorted, d)
+		}
+	}
+	slices.SortFunc(sorted, func(a, b *memDelivery) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(b.seq, a.seq))
+	})
+	var deliveries []WebhookDelivery
+	for _, d := range sorted[:min(limit, len(sorted))] {
+		deliveries = append(deliveries, d.WebhookDelivery)
+	}
+	return deliveries, nil
+}
+
+// Vacuum does nothing: deleted records are already garbage collected.
+func (m *Memory) Vacuum(_ context.Context) error {
+	return nil
+}
+
+// Maintain does nothing; there is no file to compact.
+func (m *Memory) Maintain(_ context.Context) error {
+	return nil
+}
+
+// Size counts the records held, under the names of the SQLite tables that
+// would hold them. There is no file, so every byte count is 0.
+func (m *Memory) Size(_ context.Context) (Size, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tags := 0
+	for _, e := range m.emails {
+		tags += len(e.Tags)
+	}
+	return Size{Rows: map[string]int{
+		"emails":               len(m.emails),
+		"email_tags":           tags,
+		"decisions":            len(m.decisions),
+		"quota_counters":       len(m.quota),
+		"contacts":             len(m.contacts),
+		"idempotency_keys":     len(m.idempotency),
+		"api_tokens":           len(m.tokens),
+		"share_links":          len(m.shares),
+		"annotations":          len(m.annotations),
+		"tracked_links":        len(m.links),
+		"unsubscribe_links":    len(m.unsubscribe),
+		"suppressions":         len(m.suppressed),
+		"sent_messages":        len(m.sent),
+		"edits":                len(m.edits),
+		"daily_stats":          len(m.dailyStats),
+		"settings":             len(m.settings),
+		"consumer_checkpoints": len(m.checkpoints),
+		"audit_log":            len(m.audit),
+		"reputation":           len(m.reputation),
+		"jobs":                 len(m.jobs),
+		"webhooks":             len(m.webhooks),
+		"webhook_deliveries":   len(m.deliveries),
+		"allow_rules":          len(m.allow),
+		"block_rules":          len(m.block),
+	}}, nil
+}
+
+// SetRawKey is a no-op; raw messages never leave the process.
+func (m *Memory) SetRawKey(_ []byte) error {
+	return nil
+}
+
+// Close is a no-op; the contents are dropped with the Memory itself.
+func (m *Memory) Close() error {
+	return nil
+}
+
+// clampLimit applies a SQL-style LIMIT to n results: negative means no limit.
+func clampLimit(limit, n int) int {
+	if limit < 0 || limit > n {
+		return n
+	}
+	return limit
+}
+
+// copyEmail returns a copy of e, reduced to a summary as the summary queries
+// return it when summary is true.
+func copyEmail(e Email, summary bool) Email {
+	c := cloneEmail(e)
+	if summary {
+		c.RawMessage = nil
+		truncatePreview(&c)
+	}
+	return c
+}
+
+// cloneEmail copies e so the copy shares no slices or pointers with it.
+func cloneEmail(e Email) Email {
+	e.Recipients = slices.Clone(e.Recipients)
+	e.EnvelopeRecipients = slices.Clone(e.EnvelopeRecipients)
+	e.Flags = slices.Clone(e.Flags)
+	e.Tags = slices.Clone(e.Tags)
+	e.Approvals = slices.Clone(e.Approvals)
+	e.RawMessage = slices.Clone(e.RawMessage)
+	if e.Signature != nil {
+		sig := *e.Signature
+		e.Signature = &sig
+	}
+	return e
+}
+
+func cloneEdit(e Edit) Edit {
+	e.Before.Recipients = slices.Clone(e.Before.Recipients)
+	e.After.Recipients = slices.Clone(e.After.Recipients)
+	return e
+}
+
+func cloneJob(j Job) Job {
+	j.Payload = slices.Clone(j.Payload)
+	return j
+}
+
+func cloneToken(t APIToken) APIToken {
+	t.Scopes = slices.Clone(t.Scopes)
+	return t
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rawChunkSize is how much of a raw message OpenRaw's reader reads from the
+// database at a time.
+const rawChunkSize = 1 << 20
+
+// OpenRaw returns a reader over the raw message of email id, empty if the
+// raw message was not stored. Unless the message is encrypted (see
+// SetRawKey), it is read in chunks as the reader is read rather than copied
+// into one buffer, so serving a large message does not take memory its size.
+// Reading fails if the message changes size meanwhile, as when it is edited.
+func (s *Store) OpenRaw(ctx context.Context, id string) (io.ReadCloser, error) {
+	qctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var size int64
+	var first []byte
+	err := s.db.QueryRowContext(qctx,
+		`SELECT length(raw_message), substr(raw_message, 1, ?) FROM emails WHERE id = ?`, rawChunkSize, id,
+	).Scan(&size, &first)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("email not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query raw message: %w", err)
+	}
+	if !bytes.HasPrefix(first, sealedPrefix) {
+		return &rawReader{s: s, ctx: ctx, id: id, size: size, off: int64(len(first)), buf: first}, nil
+	}
+
+	// An encrypted message can only be decrypted whole.
+	var sealed []byte
+	if err := s.db.QueryRowContext(qctx, `SELECT raw_message FROM emails WHERE id = ?`, id).Scan(&sealed); err != nil {
+		return nil, fmt.Errorf("query raw message: %w", err)
+	}
+	raw, err := s.unseal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(raw)), nil
+}
+
+// rawReader reads an unencrypted raw message of size bytes rawChunkSize at
+// a time.
+type rawReader struct {
+	s    *Store
+	ctx  context.Context
+	id   string
+	size int64
+
+	off int64  // of the next chunk
+	buf []byte // rest of the current chunk
+}
+
+func (r *rawReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.off >= r.size {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *rawReader) next() error {
+	ctx, cancel := r.s.withTimeout(r.ctx)
+	defer cancel()
+
+	var chunk []byte
+	err := r.s.db.QueryRowContext(ctx,
+		`SELECT substr(raw_message, ?, ?) FROM emails WHERE id = ? AND length(raw_message) = ?`,
+		r.off+1, rawChunkSize, r.id, r.size,
+	).Scan(&chunk)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("raw message of email %s changed while it was read", r.id)
+	}
+	if err != nil {
+		return fmt.Errorf("read raw message: %w", err)
+	}
+	if len(chunk) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.buf = chunk
+	r.off += int64(len(chunk))
+	return nil
+}
+
+func (r *rawReader) Close() error {
+	r.buf = nil
+	r.off = r.size
+	return nil
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// sealedPrefix starts a raw message encrypted by SetRawKey. The GCM nonce
+// and the ciphertext follow it.
+var sealedPrefix = []byte("mailescrow-sealed-v1:")
+
+// SetRawKey encrypts the raw messages saved from now on with AES-256-GCM
+// under key, which must be 32 bytes, and decrypts them as they are read.
+// Raw messages saved without a key stay readable.
+func (s *Store) SetRawKey(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("raw message key is %d bytes, want 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("raw message key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("raw message key: %w", err)
+	}
+	s.rawKey = aead
+	return nil
+}
+
+// seal encrypts raw if a key is set. An empty raw message, one that was not
+// stored, stays empty.
+func (s *Store) seal(raw []byte) []byte {
+	if s.rawKey == nil || len(raw) == 0 {
+		return raw
+	}
+	nonce := make([]byte, s.rawKey.NonceSize())
+	_, _ = rand.Read(nonce) // never fails
+	out := append(bytes.Clone(sealedPrefix), nonce...)
+	return s.rawKey.Seal(out, nonce, raw, nil)
+}
+
+// unseal decrypts raw if seal encrypted it.
+func (s *Store) unseal(raw []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(raw, sealedPrefix)
+	if !ok {
+		return raw, nil
+	}
+	if s.rawKey == nil {
+		return nil, errors.New("raw message is encrypted and no key is set")
+	}
+	n := s.rawKey.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("encrypted raw message is truncated")
+	}
+	raw, err := s.rawKey.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt raw message: %w", err)
+	}
+	return raw, nil
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// SentMessage is an outbound email as it was relayed, kept after the email
+// is deleted so that replies to it can be shown with the message they
+// answer. Inbound email links to it through Email.InReplyTo.
+type SentMessage struct {
+	MessageID  string // the Message-Id header, angle brackets included
+	EmailID    string
+	Sender     string
+	Recipients []string
+	Subject    string
+	Body       string
+	SentAt     time.Time
+}
+
+// RecordSent stores m, replacing any message recorded with the same
+// Message-Id, such as an earlier relay of the same email. A zero SentAt
+// means now.
+func (s *Store) RecordSent(ctx context.Context, m SentMessage) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if m.SentAt.IsZero() {
+		m.SentAt = time.Now().UTC()
+	}
+	recipientsJSON, err := json.Marshal(m.Recipients)
+	if err != nil {
+		return fmt.Errorf("marshal recipients: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO sent_messages (message_id, email_id, sender, recipients, subject, body, sent_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.MessageID, m.EmailID, m.Sender, string(recipientsJSON), m.Subject, s.seal([]byte(m.Body)), m.SentAt.UTC(),
+	); err != nil {
+		return fmt.Errorf("insert sent message: %w", err)
+	}
+	return nil
+}
+
+// GetSent returns the relayed message with the given Message-Id, or nil if
+// there is none.
+func (s *Store) GetSent(ctx context.Context, messageID string) (*SentMessage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var m SentMessage
+	var recipientsJSON string
+	var body []byte
+	err := s.db.QueryRowContext(ctx,
+		`SELECT message_id, email_id, sender, recipients, subject, body, sent_at FROM sent_messages WHERE message_id = ?`, messageID,
+	).Scan(&m.MessageID, &m.EmailID, &m.Sender, &recipientsJSON, &m.Subject, &body, &m.SentAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get sent message: %w", err)
+	}
+	if err := json.Unmarshal([]byte(recipientsJSON), &m.Recipients); err != nil {
+		return nil, fmt.Errorf("unmarshal recipients: %w", err)
+	}
+	if body, err = s.unseal(body); err != nil {
+		return nil, err
+	}
+	m.Body = string(body)
+	return &m, nil
+}
+
+// PruneSent deletes the messages relayed before before and returns how many
+// were deleted.
+func (s *Store) PruneSent(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM sent_messages WHERE sent_at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("prune sent messages: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("prune sent messages: %w", err)
+	}
+	return int(n), nil
+}
+
+// inReplyTo returns the first message ID in the In-Reply-To header of raw, a
+// MIME message, or "" if it has none.
+func inReplyTo(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	h := msg.Header.Get("In-Reply-To")
+	start := strings.IndexByte(h, '<')
+	end := strings.IndexByte(h, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return h[start : end+1]
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Setting is a configuration setting changed at runtime, overriding the
+// config file. Value is YAML, as the setting is written in the config file.
+type Setting struct {
+	Key       string // dotted config key, e.g. "quota"
+	Value     string
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// ListSettings returns the settings changed at runtime, by key.
+func (s *Store) ListSettings(ctx context.Context) ([]Setting, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT key, value, updated_by, updated_at FROM settings ORDER BY key`)
+	if err != nil {
+		return nil, fmt.Errorf("list settings: %w", err)
+	}
+	defer rows.Close()
+
+	var settings []Setting
+	for rows.Next() {
+		var st Setting
+		if err := rows.Scan(&st.Key, &st.Value, &st.UpdatedBy, &st.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("scan setting: %w", err)
+		}
+		settings = append(settings, st)
+	}
+	return settings, rows.Err()
+}
+
+// SaveSetting stores st, replacing the setting with the same key. A zero
+// UpdatedAt means now.
+func (s *Store) SaveSetting(ctx context.Context, st Setting) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if st.UpdatedAt.IsZero() {
+		st.UpdatedAt = time.Now().UTC()
+	}
+	if _, err := s.db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO settings (key, value, updated_by, updated_at) VALUES (?, ?, ?, ?)`,
+		st.Key, st.Value, st.UpdatedBy, st.UpdatedAt.UTC(),
+	); err != nil {
+		return fmt.Errorf("save setting: %w", err)
+	}
+	return nil
+}
+
+// DeleteSetting removes the setting key, so the config file applies again.
+// Deleting a setting that was never changed is not an error.
+func (s *Store) DeleteSetting(ctx context.Context, key string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM settings WHERE key = ?`, key); err != nil {
+		return fmt.Errorf("delete setting: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Snooze hides a pending email from the default pending list until until,
+// recording who snoozed it. Snoozing a snoozed email again moves its wake-up
+// time. It returns ErrConflict if the email is not pending.
+func (s *Store) Snooze(ctx context.Context, id, by string, until time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET snoozed_until = ?, snoozed_by = ? WHERE id = ? AND status = ?`,
+		until.UTC(), by, id, StatusPending,
+	)
+	if err != nil {
+		return fmt.Errorf("snooze email: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// Unsnooze returns a snoozed email to the pending list at once. Unsnoozing an
+// email that is not snoozed does nothing.
+func (s *Store) Unsnooze(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET snoozed_until = NULL, snoozed_by = NULL WHERE id = ?`, id,
+	); err != nil {
+		return fmt.Errorf("unsnooze email: %w", err)
+	}
+	return s.checkExists(ctx, id)
+}
+
+// WakeSnoozed ends the snoozes that expired at or before now and returns the
+// pending emails woken, as summaries, the earliest snoozed until first. Their
+// SnoozedUntil and SnoozedBy still say how they were snoozed. Snoozes of
+// emails decided on while snoozed are cleared without being returned.
+func (s *Store) WakeSnoozed(ctx context.Context, now time.Time) ([]Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT `+summaryColumns+` FROM emails WHERE status = ? AND snoozed_until <= ? ORDER BY snoozed_until ASC, received_at ASC`,
+		StatusPending, now.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query emails: %w", err)
+	}
+	emails, err := s.scanEmails(rows)
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE emails SET snoozed_until = NULL, snoozed_by = NULL WHERE snoozed_until <= ?`, now.UTC(),
+	); err != nil {
+		return nil, fmt.Errorf("wake snoozed: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	for i := range emails {
+		truncatePreview(&emails[i])
+	}
+	return emails, nil
+}
@@ -1,29 +1,75 @@
 package store
 
 import (
+	"cmp"
 	"context"
+	"crypto/cipher"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	_ "modernc.org/sqlite"
+
+	"github.com/albert/mailescrow/internal/mimetext"
 )
 
 const (
 	DirectionOutbound = "outbound"
 	DirectionInbound  = "inbound"
 
-	StatusPending  = "pending"
-	StatusApproved = "approved"
+	StatusPending   = "pending"
+	StatusApproved  = "approved"
+	StatusScheduled = "scheduled" // outbound, approved and waiting for its sending window
+	StatusRelaying  = "relaying"  // outbound, being handed to the relay; whether it was delivered is unknown until it is sent
+	StatusSent      = "sent"      // outbound, accepted by the relay; deleted once its decision is recorded
+
+	DecisionApproved  = "approved"
+	DecisionRejected  = "rejected"
+	DecisionForwarded = "forwarded" // approved inbound mail resent to a person; not counted in reviewer stats
+
+	// FlagQuotaExceeded marks an email submitted while its sender was over quota.
+	FlagQuotaExceeded = "quota_exceeded"
+	// FlagRelayInterrupted marks an email returned to review because
+	// mailescrow stopped while relaying it: it may already have been sent.
+	FlagRelayInterrupted = "relay_interrupted"
+	// FlagSuppressed marks an email submitted to a recipient on the
+	// suppression list.
+	FlagSuppressed = "suppressed"
+
+	QuotaPeriodHour = "hour"
+	QuotaPeriodDay  = "day"
+
+	SignatureSMIME = "smime"
+	SignaturePGP   = "pgp"
+
+	SignatureValid     = "valid"     // verified, trusted and made by the sender
+	SignatureUntrusted = "untrusted" // could not be tied to a trust anchor or known key
+	SignatureInvalid   = "invalid"   // does not match the content or the sender
+
+	// Delivery statuses of relayed mail, from the DSNs the upstream returns.
+	DeliveryRequested = "requested" // DSNs were requested; none has arrived yet
+	DeliveryDelivered = "delivered"
+	DeliveryRelayed   = "relayed" // passed on to a system that does not return DSNs
+	DeliveryDelayed   = "delayed"
+	DeliveryFailed    = "failed"
 )
 
 // Email represents a held email in the store.
 type Email struct {
 	ID            string
 	Direction     string // "outbound" | "inbound"
-	Status        string // "pending" | "approved"
+	Status        string // "pending" | "approved" | "scheduled" | "relaying" | "sent"
 	Sender        string
 	Recipients    []string
 	Subject       string
@@ -32,56 +78,896 @@ type Email struct {
 	ReceivedAt    time.Time
 	IMAPMessageID string // inbound only
 	IMAPMailbox   string // inbound only, current IMAP folder
+	Queue         string // inbound only, consumer queue chosen by routing rules
+	ApprovedBy    string // reviewer who approved the email; empty while pending
+	ApprovedAt    time.Time
+	ApprovalSeq   int64      // position in the order emails were approved, for consumer checkpoints; 0 unless approved
+	ScheduledAt   time.Time  // when a scheduled email is relayed
+	RelayedAt     time.Time  // when the relay accepted a sent email
+	Flags         []string   // e.g. FlagQuotaExceeded
+	Truncated     bool       // Body holds only a preview; see ListPendingSummaries
+	Snippet       string     // one-line summary of Body, see mimetext.Snippet; empty for mail stored before snippets
+	HasAttachment bool       // the raw message has a part with Content-Disposition: attachment
+	Signature     *Signature // inbound only; nil when the message is not signed
+	InReplyTo     string     // inbound only, the first message ID in its In-Reply-To header; see GetSent
+	Approvals     []Approval // approvals so far of pending mail needing several, oldest first; see AddApproval
+	SnoozedUntil  time.Time  // when a snoozed pending email returns to the pending list; zero unless snoozed
+	SnoozedBy     string     // reviewer who snoozed the email
+
+	// EnvelopeRecipients is where an inbound email was actually delivered,
+	// from its Delivered-To/X-Original-To/Envelope-To headers; for mail
+	// reaching a catch-all mailbox it differs from the To header. Nil when
+	// those headers are absent.
+	EnvelopeRecipients []string
+
+	// Tags are labels applied by reviewers or rules, e.g. "invoice", sorted.
+	Tags []string
+
+	// Version counts the email's status changes. Approve and Reject take the
+	// version the caller last saw, so of two reviewers deciding at once only
+	// the first succeeds.
+	Version int
+
+	// EnvelopeID is set by the relay to the ENVID it sent when requesting
+	// DSNs for the email. It is not stored with the email; the decision
+	// recorded for the relay keeps it.
+	EnvelopeID string
 }
 
-// EmailStore is the interface for email persistence operations.
-type EmailStore interface {
-	SaveOutbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte) (string, error)
-	SaveInbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte, imapMessageID, imapMailbox string) (string, error)
+// Signature is the result of verifying a signed message.
+type Signature struct {
+	Protocol string `json:"protocol"` // SignatureSMIME | SignaturePGP
+	Status   string `json:"status"`   // SignatureValid | SignatureUntrusted | SignatureInvalid
+	Signer   string `json:"signer,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// Approval is one reviewer's approval of an email that needs several before
+// it is approved.
+type Approval struct {
+	Reviewer string    `json:"reviewer"`
+	Reason   string    `json:"reason,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// HasFlag reports whether flag is set on the email.
+func (e Email) HasFlag(flag string) bool {
+	return slices.Contains(e.Flags, flag)
+}
+
+// MaxTagLength bounds the length of a tag.
+const MaxTagLength = 64
+
+// NormalizeTag trims and lower-cases tag and checks that it is a valid tag:
+// letters, digits, '-', '_' and '.', starting with a letter or digit.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", errors.New("tag is empty")
+	}
+	if len(tag) > MaxTagLength {
+		return "", fmt.Errorf("tag %q is longer than %d characters", tag, MaxTagLength)
+	}
+	for i, r := range tag {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case i > 0 && (r == '-' || r == '_' || r == '.'):
+		default:
+			return "", fmt.Errorf("tag %q may only contain letters, digits, '-', '_' and '.', starting with a letter or digit", tag)
+		}
+	}
+	return tag, nil
+}
+
+// ErrConflict is returned by Approve, Unapprove and Reject when the email
+// exists but is no longer in the expected status or at the expected version:
+// someone else decided on it first. LastDecision tells who.
+var ErrConflict = errors.New("email was already handled")
+
+// Decision records a reviewer's approve/reject action on an email. Decisions
+// outlive the email itself so reviewer activity can be reported on.
+type Decision struct {
+	EmailID   string
+	Direction string // "outbound" | "inbound"
+	Sender    string
+	Subject   string
+	Decision  string // "approved" | "rejected"
+	Reviewer  string
+	Latency   time.Duration // time from ReceivedAt to the decision
+	DecidedAt time.Time
+
+	// EnvelopeID is the ENVID of relayed mail for which DSNs were requested.
+	// DeliveryStatus starts as DeliveryRequested and follows the DSNs that
+	// come back; DeliveryDetail describes the latest one per recipient.
+	EnvelopeID     string
+	DeliveryStatus string
+	DeliveryDetail string
+
+	ForwardedTo string // the address a DecisionForwarded resent the email to
+
+	// Reason is why the reviewers decided as they did, if they were asked.
+	Reason string
+
+	// RawMessage is the message decided on, for wrappers of RecordDecision
+	// such as the on-disk archive. It is never stored.
+	RawMessage []byte `json:"-"`
+}
+
+// Sort orders accepted by PendingQuery.
+const (
+	SortAge     = "age"     // by received time, oldest first
+	SortSender  = "sender"  // case-insensitive
+	SortSubject = "subject" // case-insensitive
+)
+
+// PendingQuery selects a page of held emails for ListPendingPage: pending
+// ones unless Status says otherwise.
+type PendingQuery struct {
+	Status         string    // StatusPending (default), StatusApproved or StatusScheduled
+	Direction      string    // DirectionOutbound or DirectionInbound; empty for both
+	Queue          string    // inbound consumer queue; empty for any
+	HasAttachments bool      // only emails with attachments
+	Tag            string    // only emails with this tag; empty for any
+	ReceivedBefore time.Time // only emails received before this; zero for any
+	ReceivedAfter  time.Time // only emails received at or after this; zero for any
+	SnoozedAt      time.Time // leave out emails still snoozed at this time; zero to include them
+	Snoozed        bool      // only emails snoozed at SnoozedAt (or ever, if zero)
+	Sort           string    // SortAge (default), SortSender or SortSubject
+	Desc           bool      // reverse the sort order
+	Offset         int
+	Limit          int // 0 means no limit
+}
+
+// Outcomes selected by DecisionQuery. Rejected and sent emails are gone from
+// the store, so their decisions are all that is left of them.
+const (
+	OutcomeRejected = "rejected" // rejected by a reviewer
+	OutcomeSent     = "sent"     // outbound, approved and relayed, and not reported failed
+	OutcomeBounced  = "bounced"  // outbound, relayed and then reported failed by a DSN
+)
+
+// DecisionQuery selects a page of decisions for ListDecisionPage, newest
+// first.
+type DecisionQuery struct {
+	Outcome string // OutcomeRejected, OutcomeSent or OutcomeBounced; empty for any decision
+	Offset  int
+	Limit   int // 0 means no limit
+}
+
+// StatusCount is the number of held emails with a direction and status.
+type StatusCount struct {
+	Direction string
+	Status    string
+	Count     int
+}
+
+// TagUsage is how much mail carrying a tag is held.
+type TagUsage struct {
+	Pending int   // pending emails
+	Bytes   int64 // stored size of the raw messages of emails in any status
+}
+
+// ReviewerStats aggregates decisions made by a single reviewer.
+type ReviewerStats struct {
+	Reviewer       string
+	Approved       int
+	Rejected       int
+	AverageLatency time.Duration
+	MaxLatency     time.Duration
+	LastDecisionAt time.Time
+}
+
+// QuotaUsage is the number of submissions by a sender in one quota window.
+type QuotaUsage struct {
+	Sender      string
+	Period      string // "hour" | "day"
+	WindowStart time.Time
+	Count       int
+}
+
+// Contact is an address that has appeared on human-approved mail: a recipient
+// of approved outbound mail or a sender of approved inbound mail.
+type Contact struct {
+	Address        string
+	Direction      string // direction of the approved mail
+	ApprovedCount  int
+	LastApprovedAt time.Time
+}
+
+// APIToken is a credential for the REST API. Only a hash of the token is
+// stored; the plaintext is shown once when the token is created.
+type APIToken struct {
+	ID         string
+	Name       string
+	Hash       string // hex SHA-256 of the token
+	Scopes     []string
+	Project    string // tag and project limits of the mail it submits; empty for none
+	CreatedBy  string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // zero means the token never expires
+	LastUsedAt time.Time // zero until first used
+	RevokedAt  time.Time // zero unless revoked
+}
+
+// ShareLink grants read-only access to one email, without an account, until
+// it expires. Only a hash of its token is stored; the URL holding the token
+// is shown once when the link is created.
+type ShareLink struct {
+	ID        string
+	EmailID   string
+	Hash      string // hex SHA-256 of the token
+	CreatedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt time.Time // zero unless revoked
+}
+
+// AuditEntry records an administrative action or a use of an API token.
+type AuditEntry struct {
+	At     time.Time
+	Actor  string // reviewer name, or "token:<name>" for API token use
+	Action string // e.g. "token.create", "token.revoke", "POST /api/emails"
+	Detail string
+}
+
+// Local reputations of a domain or IP address.
+const (
+	ReputationBlocked = "blocked" // warn about it as if a block list listed it
+	ReputationTrusted = "trusted" // never warn, whatever the block lists say
+)
+
+// ReputationEntry is an operator's verdict on a domain or IP address. It is
+// consulted before, and overrides, the DNS block lists.
+type ReputationEntry struct {
+	Subject    string // lower-cased domain or IP address
+	Reputation string // ReputationBlocked | ReputationTrusted
+	Note       string
+	CreatedBy  string
+	CreatedAt  time.Time
+}
+
+// AllowRule lets every email from a sender in one direction skip review. It
+// is made by a reviewer approving an email "and always allow this sender".
+type AllowRule struct {
+	Direction string // DirectionOutbound | DirectionInbound
+	Sender    string // lower-cased address
+	EmailID   string // the email approved when the rule was made; empty if none
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// BlockRule rejects every email from a sender, or from any address at a
+// domain, in one direction without review. It is made by a reviewer
+// rejecting an email "and blocking the sender".
+type BlockRule struct {
+	Direction  string // DirectionOutbound | DirectionInbound
+	Subject    string // lower-cased address, or domain for every address at it
+	EmailID    string // the email rejected when the rule was made; empty if none
+	CreatedBy  string
+	CreatedAt  time.Time
+	Suppressed int // emails rejected by the rule so far
+}
+
+// IdempotencyKey remembers the outcome of an API submission made with an
+// Idempotency-Key header so retries return it instead of creating duplicates.
+type IdempotencyKey struct {
+	Key         string
+	RequestHash string // fingerprint of the request body the key was first used with
+	EmailID     string
+	Status      string // status returned to the client: "pending" | "sent"
+	CreatedAt   time.Time
+}
+
+// Reader queries held emails and the records kept about them.
+type Reader interface {
 	ListPending(ctx context.Context) ([]Email, error)
-	ListApproved(ctx context.Context) ([]Email, error)
+	ListPendingSummaries(ctx context.Context) ([]Email, error)
+	ListPendingPage(ctx context.Context, q PendingQuery) ([]Email, int, error)
+	ListApproved(ctx context.Context, queue, tag string) ([]Email, error)
+	ListApprovedAfter(ctx context.Context, queue string, after int64) ([]Email, error)
+	GetCheckpoint(ctx context.Context, consumer, queue string) (int64, error)
+	ListScheduled(ctx context.Context) ([]Email, error)
+	ListInFlight(ctx context.Context) ([]Email, error)
 	Get(ctx context.Context, id string) (*Email, error)
-	Approve(ctx context.Context, id string) error
+	GetSummary(ctx context.Context, id string) (*Email, error)
+	OpenRaw(ctx context.Context, id string) (io.ReadCloser, error)
+	CountPending(ctx context.Context) (int, error)
+	CountByStatus(ctx context.Context) ([]StatusCount, error)
+	OldestPendingAge(ctx context.Context, now time.Time) (time.Duration, error)
+	ListDecisions(ctx context.Context, limit int) ([]Decision, error)
+	ListDecisionPage(ctx context.Context, q DecisionQuery) ([]Decision, int, error)
+	LastDecision(ctx context.Context, emailID string) (*Decision, error)
+	ListReviewerStats(ctx context.Context) ([]ReviewerStats, error)
+	ListQuotaUsage(ctx context.Context, since time.Time) ([]QuotaUsage, error)
+	ContactCounts(ctx context.Context, direction string, addresses []string) (map[string]int, error)
+	GetIdempotencyKey(ctx context.Context, key string, since time.Time) (*IdempotencyKey, error)
+	ListAPITokens(ctx context.Context) ([]APIToken, error)
+	GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error)
+	ListShareLinks(ctx context.Context, emailID string) ([]ShareLink, error)
+	GetShareLinkByHash(ctx context.Context, hash string) (*ShareLink, error)
+	ListAnnotations(ctx context.Context, emailID string) ([]Annotation, error)
+	ListClickStats(ctx context.Context, limit int) ([]ClickStats, error)
+	OptedOut(ctx context.Context, addresses []string) ([]string, error)
+	ListOptOuts(ctx context.Context) ([]UnsubscribeLink, error)
+	Suppressed(ctx context.Context, addresses []string) ([]Suppression, error)
+	ListSuppressions(ctx context.Context) ([]Suppression, error)
+	GetSent(ctx context.Context, messageID string) (*SentMessage, error)
+	ListEdits(ctx context.Context, emailIDs []string) ([]Edit, error)
+	NextStatsDay(ctx context.Context) (time.Time, error)
+	ListDailyStats(ctx context.Context, since time.Time) ([]DailyStats, error)
+	ListSettings(ctx context.Context) ([]Setting, error)
+	ListAudit(ctx context.Context, limit int) ([]AuditEntry, error)
+	ListTags(ctx context.Context) ([]string, error)
+	TagUsage(ctx context.Context, tag string) (TagUsage, error)
+	GetReputation(ctx context.Context, subject string) (*ReputationEntry, error)
+	ListReputation(ctx context.Context) ([]ReputationEntry, error)
+	ListJobs(ctx context.Context) ([]Job, error)
+	ListWebhooks(ctx context.Context, tokenID string) ([]Webhook, error)
+	GetWebhook(ctx context.Context, id string) (*Webhook, error)
+	ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error)
+	GetAllowRule(ctx context.Context, direction, sender string) (*AllowRule, error)
+	ListAllowRules(ctx context.Context) ([]AllowRule, error)
+	GetBlockRule(ctx context.Context, direction, subject string) (*BlockRule, error)
+	ListBlockRules(ctx context.Context) ([]BlockRule, error)
+}
+
+// Writer creates and changes held emails and the records kept about them.
+type Writer interface {
+	SaveOutbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte) (string, error)
+	SaveOutboundBatch(ctx context.Context, emails []Email) ([]string, error)
+	SaveInbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte, imapMessageID, imapMailbox, queue string) (string, error)
+	Approve(ctx context.Context, id, approvedBy string, version int) error
+	AddApproval(ctx context.Context, id string, a Approval, version int) error
+	EditEmail(ctx context.Context, e Edit, rawMessage []byte, version int) error
+	Unapprove(ctx context.Context, id string) error
+	Schedule(ctx context.Context, id string, at time.Time) error
+	Reschedule(ctx context.Context, id string, at time.Time) error
+	Snooze(ctx context.Context, id, by string, until time.Time) error
+	Unsnooze(ctx context.Context, id string) error
+	WakeSnoozed(ctx context.Context, now time.Time) ([]Email, error)
+	BeginRelay(ctx context.Context, id string) error
+	AbortRelay(ctx context.Context, id, status string) error
+	MarkSent(ctx context.Context, id string) error
+	Reject(ctx context.Context, id string, version int) error
 	UpdateIMAPMailbox(ctx context.Context, id, mailbox string) error
+	AddFlag(ctx context.Context, id, flag string) error
+	SetSignature(ctx context.Context, id string, sig Signature) error
+	SetEnvelopeRecipients(ctx context.Context, id string, recipients []string) error
+	AddTag(ctx context.Context, id, tag string) error
+	RemoveTag(ctx context.Context, id, tag string) error
 	Delete(ctx context.Context, id string) error
+	RecordDecision(ctx context.Context, d Decision) error
+	UpdateDelivery(ctx context.Context, envelopeID, status, detail string) error
+	IncrementQuota(ctx context.Context, sender, period string, windowStart time.Time) (int, error)
+	DecrementQuota(ctx context.Context, sender, period string, windowStart time.Time) error
+	PruneQuota(ctx context.Context, before time.Time) error
+	RecordContacts(ctx context.Context, direction string, addresses []string) error
+	SaveIdempotencyKey(ctx context.Context, k IdempotencyKey) error
+	PruneIdempotencyKeys(ctx context.Context, before time.Time) error
+	CreateAPIToken(ctx context.Context, t APIToken) (string, error)
+	TouchAPIToken(ctx context.Context, id string, at time.Time) error
+	RevokeAPIToken(ctx context.Context, id string) error
+	CreateShareLink(ctx context.Context, l ShareLink) (string, error)
+	RevokeShareLink(ctx context.Context, id string) error
+	AddAnnotation(ctx context.Context, a Annotation) (string, error)
+	TrackLinks(ctx context.Context, links []TrackedLink) error
+	ClickLink(ctx context.Context, id string, at time.Time) (*TrackedLink, error)
+	AddUnsubscribeLinks(ctx context.Context, links []UnsubscribeLink) error
+	Unsubscribe(ctx context.Context, id string, at time.Time) (*UnsubscribeLink, error)
+	Resubscribe(ctx context.Context, address string) error
+	AddSuppression(ctx context.Context, e Suppression) error
+	DeleteSuppression(ctx context.Context, address string) error
+	RecordSent(ctx context.Context, m SentMessage) error
+	RecordAudit(ctx context.Context, e AuditEntry) error
+	SetReputation(ctx context.Context, e ReputationEntry) error
+	DeleteReputation(ctx context.Context, subject string) error
+	AddAllowRule(ctx context.Context, r AllowRule) error
+	DeleteAllowRule(ctx context.Context, direction, sender string) error
+	AddBlockRule(ctx context.Context, r BlockRule) error
+	CountSuppressed(ctx context.Context, direction, subject string) error
+	DeleteBlockRule(ctx context.Context, direction, subject string) error
+	PruneDecisions(ctx context.Context, decision string, before time.Time) (int, error)
+	PruneAudit(ctx context.Context, before time.Time) (int, error)
+	PruneSent(ctx context.Context, before time.Time) (int, error)
+	PruneEdits(ctx context.Context, before time.Time) (int, error)
+	RollUpStats(ctx context.Context, day time.Time) (DailyStats, error)
+	SaveSetting(ctx context.Context, st Setting) error
+	DeleteSetting(ctx context.Context, key string) error
+	SaveCheckpoint(ctx context.Context, consumer, queue string, position int64) error
+	AddJob(ctx context.Context, j Job) (string, error)
+	ClaimJob(ctx context.Context, now time.Time) (*Job, error)
+	RetryJobAt(ctx context.Context, id, lastError string, runAt time.Time) error
+	FailJob(ctx context.Context, id, lastError string) error
+	RequeueJob(ctx context.Context, id string) error
+	DeleteJob(ctx context.Context, id string) error
+	ResetRunningJobs(ctx context.Context) (int, error)
+	CreateWebhook(ctx context.Context, w Webhook) (string, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	AddWebhookDelivery(ctx context.Context, d WebhookDelivery) (string, error)
+	UpdateWebhookDelivery(ctx context.Context, d WebhookDelivery) error
+}
+
+// Lifecycle maintains and releases a storage backend. Only its owner (main)
+// uses it.
+type Lifecycle interface {
+	Vacuum(ctx context.Context) error
+	Maintain(ctx context.Context) error
+	Size(ctx context.Context) (Size, error)
+	SetRawKey(key []byte) error
+	Close() error
+}
+
+// ReadWriter is what components that share the store depend on.
+type ReadWriter interface {
+	Reader
+	Writer
+}
+
+// EmailStore is a complete storage backend: SQLite (Store) or in-memory (Memory).
+type EmailStore interface {
+	ReadWriter
+	Lifecycle
+}
+
+var (
+	_ EmailStore = (*Store)(nil)
+	_ EmailStore = (*Memory)(nil)
+)
+
+// Storage drivers accepted by Open (db.driver).
+const (
+	DriverSQLite = "sqlite"
+	DriverMemory = "memory"
+)
+
+// Open opens the backend selected by driver. path is the SQLite database file;
+// the memory driver ignores it and loses everything on exit. A positive
+// queryTimeout bounds every SQLite call except Vacuum, so a locked or hung
+// database fails the call instead of blocking its caller indefinitely.
+func Open(driver, path string, queryTimeout time.Duration) (EmailStore, error) {
+	switch driver {
+	case DriverSQLite, "":
+		st, err := open(path, queryTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	case DriverMemory:
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown db driver %q", driver)
 }
 
 // Store manages email persistence in SQLite.
 type Store struct {
-	db *sql.DB
+	db           *sql.DB
+	queryTimeout time.Duration // per-call deadline; 0 leaves calls bounded only by their context
+	rawKey       cipher.AEAD   // encrypts raw messages at rest; nil stores them as received
+}
+
+// withTimeout derives the context a store call runs under.
+func (s *Store) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
+// busyTimeout is how long a connection waits for another connection's write
+// lock before failing with SQLITE_BUSY.
+const busyTimeout = 5 * time.Second
+
+// querySpans traces each statement run on behalf of a traced operation (an
+// HTTP request, a poll) and nothing else, so schema setup and untraced
+// background work don't each start a trace of their own.
+var querySpans = otelsql.SpanOptions{
+	OmitConnResetSession: true,
+	OmitConnPrepare:      true,
+	OmitRows:             true,
+	SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+		return trace.SpanContextFromContext(ctx).IsValid()
+	},
 }
 
 // New opens (or creates) the SQLite database at path and initializes the schema.
 func New(path string) (*Store, error) {
-	db, err := sql.Open("sqlite", path)
+	return open(path, 0)
+}
+
+func open(path string, queryTimeout time.Duration) (*Store, error) {
+	// SQLite can't interrupt a connection waiting for a lock, so that wait
+	// must end by itself within the query timeout.
+	busy := busyTimeout
+	if queryTimeout > 0 {
+		busy = min(busy, queryTimeout)
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	// New databases use incremental auto-vacuum, so Maintain can free the
+	// pages of deleted rows without rebuilding the file.
+	db, err := otelsql.Open("sqlite", fmt.Sprintf("%s%s_pragma=busy_timeout(%d)&_pragma=auto_vacuum(incremental)", path, sep, busy.Milliseconds()),
+		otelsql.WithAttributes(attribute.String("db.system.name", "sqlite")),
+		otelsql.WithSpanOptions(querySpans))
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
 
-	if _, err := db.ExecContext(context.Background(), `
-		CREATE TABLE IF NOT EXISTS emails (
-			id              TEXT PRIMARY KEY,
-			direction       TEXT NOT NULL,
-			status          TEXT NOT NULL,
-			sender          TEXT NOT NULL,
-			recipients      TEXT NOT NULL,
-			subject         TEXT NOT NULL,
-			body            TEXT NOT NULL,
-			raw_message     BLOB NOT NULL,
-			received_at     TIMESTAMP NOT NULL,
-			imap_message_id TEXT,
-			imap_mailbox    TEXT
-		)
-	`); err != nil {
-		_ = db.Close()
-		return nil, fmt.Errorf("create table: %w", err)
+	for _, stmt := range schema {
+		if _, err := db.ExecContext(context.Background(), stmt); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("create schema: %w", err)
+		}
+	}
+	for _, c := range addedColumns {
+		added, err := addColumnIfMissing(context.Background(), db, c.table, c.column, c.definition)
+		if err == nil && added && columnFills[c.table+"."+c.column] != "" {
+			_, err = db.ExecContext(context.Background(), columnFills[c.table+"."+c.column])
+		}
+		if err == nil && added && columnBackfills[c.table+"."+c.column] != nil {
+			err = columnBackfills[c.table+"."+c.column](context.Background(), db)
+		}
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("migrate %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	return &Store{db: db, queryTimeout: queryTimeout}, nil
+}
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS emails (
+		id              TEXT PRIMARY KEY,
+		direction       TEXT NOT NULL,
+		status          TEXT NOT NULL,
+		sender          TEXT NOT NULL,
+		recipients      TEXT NOT NULL,
+		subject         TEXT NOT NULL,
+		body            TEXT NOT NULL,
+		raw_message     BLOB NOT NULL,
+		received_at     TIMESTAMP NOT NULL,
+		imap_message_id TEXT,
+		imap_mailbox    TEXT
+	)`,
+	`CREATE TABLE IF NOT EXISTS decisions (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		email_id        TEXT NOT NULL,
+		direction       TEXT NOT NULL,
+		decision        TEXT NOT NULL,
+		reviewer        TEXT NOT NULL,
+		latency_seconds REAL NOT NULL,
+		decided_at      TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS quota_counters (
+		sender       TEXT NOT NULL,
+		period       TEXT NOT NULL,
+		window_start INTEGER NOT NULL,
+		count        INTEGER NOT NULL,
+		PRIMARY KEY (sender, period, window_start)
+	)`,
+	`CREATE TABLE IF NOT EXISTS contacts (
+		address          TEXT NOT NULL,
+		direction        TEXT NOT NULL,
+		approved_count   INTEGER NOT NULL,
+		last_approved_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (address, direction)
+	)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key          TEXT PRIMARY KEY,
+		request_hash TEXT NOT NULL,
+		email_id     TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		created_at   INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		id           TEXT PRIMARY KEY,
+		name         TEXT NOT NULL,
+		token_hash   TEXT NOT NULL UNIQUE,
+		scopes       TEXT NOT NULL,
+		created_by   TEXT NOT NULL,
+		created_at   TIMESTAMP NOT NULL,
+		expires_at   TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at   TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS share_links (
+		id         TEXT PRIMARY KEY,
+		email_id   TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS share_links_email ON share_links (email_id)`,
+	`CREATE TABLE IF NOT EXISTS annotations (
+		id         TEXT PRIMARY KEY,
+		email_id   TEXT NOT NULL,
+		source     TEXT NOT NULL,
+		kind       TEXT NOT NULL,
+		severity   TEXT NOT NULL,
+		score      REAL NOT NULL,
+		summary    TEXT NOT NULL,
+		findings   TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS annotations_email ON annotations (email_id)`,
+	// Tracked links are kept after their email is relayed and deleted.
+	`CREATE TABLE IF NOT EXISTS tracked_links (
+		id            TEXT PRIMARY KEY,
+		email_id      TEXT NOT NULL,
+		subject       TEXT NOT NULL,
+		url           TEXT NOT NULL,
+		clicks        INTEGER NOT NULL,
+		created_at    TIMESTAMP NOT NULL,
+		last_click_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS tracked_links_email ON tracked_links (email_id)`,
+	// Unsubscribe links are kept after their email is relayed and deleted;
+	// the addresses that used one are opted out.
+	`CREATE TABLE IF NOT EXISTS unsubscribe_links (
+		id              TEXT PRIMARY KEY,
+		address         TEXT NOT NULL,
+		email_id        TEXT NOT NULL,
+		subject         TEXT NOT NULL,
+		created_at      TIMESTAMP NOT NULL,
+		unsubscribed_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS unsubscribe_links_address ON unsubscribe_links (address)`,
+	// Addresses outbound mail must not be sent to, kept until removed.
+	`CREATE TABLE IF NOT EXISTS suppressions (
+		address    TEXT PRIMARY KEY,
+		reason     TEXT NOT NULL,
+		note       TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	// Relayed outbound messages are kept after their email is deleted, for
+	// the replies to them.
+	`CREATE TABLE IF NOT EXISTS sent_messages (
+		message_id TEXT PRIMARY KEY,
+		email_id   TEXT NOT NULL,
+		sender     TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		subject    TEXT NOT NULL,
+		body       BLOB NOT NULL,
+		sent_at    TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sent_messages_sent_at ON sent_messages (sent_at)`,
+	// Reviewers' edits of outbound mail are kept after their email is
+	// deleted, for the history.
+	`CREATE TABLE IF NOT EXISTS edits (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		email_id    TEXT NOT NULL,
+		reviewer    TEXT NOT NULL,
+		edited_at   TIMESTAMP NOT NULL,
+		old_version BLOB NOT NULL,
+		new_version BLOB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS edits_email ON edits (email_id)`,
+	// Daily counters are never purged: they are what is left of the
+	// emails and decisions they count.
+	`CREATE TABLE IF NOT EXISTS daily_stats (
+		day      TEXT PRIMARY KEY,
+		received INTEGER NOT NULL,
+		approved INTEGER NOT NULL,
+		rejected INTEGER NOT NULL,
+		relayed  INTEGER NOT NULL,
+		bounced  INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS settings (
+		key        TEXT PRIMARY KEY,
+		value      TEXT NOT NULL,
+		updated_by TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS consumer_checkpoints (
+		consumer   TEXT NOT NULL,
+		queue      TEXT NOT NULL,
+		position   INTEGER NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (consumer, queue)
+	)`,
+	`CREATE TABLE IF NOT EXISTS reputation (
+		subject    TEXT PRIMARY KEY,
+		reputation TEXT NOT NULL,
+		note       TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS allow_rules (
+		direction  TEXT NOT NULL,
+		sender     TEXT NOT NULL,
+		email_id   TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (direction, sender)
+	)`,
+	`CREATE TABLE IF NOT EXISTS block_rules (
+		direction  TEXT NOT NULL,
+		subject    TEXT NOT NULL,
+		email_id   TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		suppressed INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (direction, subject)
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id     INTEGER PRIMARY KEY AUTOINCREMENT,
+		at     TIMESTAMP NOT NULL,
+		actor  TEXT NOT NULL,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS email_tags (
+		email_id TEXT NOT NULL,
+		tag      TEXT NOT NULL,
+		PRIMARY KEY (email_id, tag)
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_tags_tag ON email_tags (tag)`,
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id         TEXT PRIMARY KEY,
+		kind       TEXT NOT NULL,
+		email_id   TEXT NOT NULL,
+		payload    BLOB NOT NULL,
+		status     TEXT NOT NULL,
+		attempts   INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		run_at     TIMESTAMP NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS jobs_due ON jobs (status, run_at)`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id         TEXT PRIMARY KEY,
+		token_id   TEXT NOT NULL,
+		url        TEXT NOT NULL,
+		events     TEXT NOT NULL,
+		direction  TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id            TEXT PRIMARY KEY,
+		webhook_id    TEXT NOT NULL,
+		event         TEXT NOT NULL,
+		email_id      TEXT NOT NULL,
+		status        TEXT NOT NULL,
+		attempts      INTEGER NOT NULL,
+		response_code INTEGER NOT NULL,
+		last_error    TEXT NOT NULL,
+		created_at    TIMESTAMP NOT NULL,
+		updated_at    TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook_id, created_at)`,
+	// Tags go with their email however it is deleted.
+	`CREATE TRIGGER IF NOT EXISTS email_tags_delete AFTER DELETE ON emails BEGIN
+		DELETE FROM email_tags WHERE email_id = OLD.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS share_links_delete AFTER DELETE ON emails BEGIN
+		DELETE FROM share_links WHERE email_id = OLD.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS annotations_delete AFTER DELETE ON emails BEGIN
+		DELETE FROM annotations WHERE email_id = OLD.id;
+	END`,
+}
+
+// addedColumns lists columns introduced after a table was first created.
+// They are added to existing databases on startup.
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"emails", "approved_by", "TEXT"},
+	{"emails", "approved_at", "TIMESTAMP"},
+	{"emails", "queue", "TEXT"},
+	{"decisions", "sender", "TEXT"},
+	{"decisions", "subject", "TEXT"},
+	{"emails", "flags", "TEXT"},
+	{"emails", "signature", "TEXT"},
+	{"emails", "has_attachments", "INTEGER"},
+	{"emails", "envelope_recipients", "TEXT"},
+	{"decisions", "envelope_id", "TEXT"},
+	{"decisions", "delivery_status", "TEXT"},
+	{"decisions", "delivery_detail", "TEXT"},
+	{"emails", "version", "INTEGER NOT NULL DEFAULT 0"},
+	{"emails", "snippet", "TEXT"},
+	{"decisions", "forwarded_to", "TEXT"},
+	{"emails", "scheduled_at", "TIMESTAMP"},
+	{"emails", "relayed_at", "TIMESTAMP"},
+	{"emails", "in_reply_to", "TEXT"},
+	{"emails", "approvals", "TEXT"},
+	{"decisions", "reason", "TEXT"},
+	{"emails", "approval_seq", "INTEGER"},
+	{"emails", "snoozed_until", "TIMESTAMP"},
+	{"emails", "snoozed_by", "TEXT"},
+	{"api_tokens", "project", "TEXT"},
+}
+
+// columnFills sets an added column (by "table.column") on the rows that
+// existed before it, once, when it is added.
+var columnFills = map[string]string{
+	// Mail approved before approvals were numbered, in the order it was
+	// stored, so consumer checkpoints see it.
+	"emails.approval_seq": `UPDATE emails SET approval_seq = rowid WHERE approved_at IS NOT NULL`,
+}
+
+// columnBackfills are like columnFills, for columns computed in Go rather
+// than SQL.
+var columnBackfills = map[string]func(context.Context, *sql.DB) error{
+	// So the attachments filter finds the mail stored before it.
+	"emails.has_attachments": fillHasAttachments,
+}
+
+// fillHasAttachments sets has_attachments on every email from its raw
+// message. Raw messages were never encrypted before the column existed.
+func fillHasAttachments(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `SELECT id, raw_message FROM emails`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		if hasAttachments(raw) {
+			ids = append(ids, id)
+		}
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.ExecContext(ctx, `UPDATE emails SET has_attachments = 0`); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `UPDATE emails SET has_attachments = 1 WHERE id = ?`, id); err != nil {
+			return err
+		}
 	}
+	return tx.Commit()
+}
 
-	return &Store{db: db}, nil
+// addColumnIfMissing adds a column unless table has it, and reports whether
+// it did.
+func addColumnIfMissing(ctx context.Context, db *sql.DB, table, column, definition string) (bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err == nil, err
 }
 
 // SaveOutbound persists a new outbound email, assigning it a UUID.
 func (s *Store) SaveOutbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	id := uuid.New().String()
 	recipientsJSON, err := json.Marshal(recipients)
 	if err != nil {
@@ -89,9 +975,9 @@ func (s *Store) SaveOutbound(ctx context.Context, sender string, recipients []st
 	}
 
 	_, err = s.db.ExecContext(ctx,
-		`INSERT INTO emails (id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL)`,
-		id, DirectionOutbound, StatusPending, sender, string(recipientsJSON), subject, body, rawMessage, time.Now().UTC(),
+		`INSERT INTO emails (id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox, has_attachments, snippet)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL, ?, ?)`,
+		id, DirectionOutbound, StatusPending, sender, string(recipientsJSON), subject, body, s.seal(rawMessage), time.Now().UTC(), hasAttachments(rawMessage), mimetext.Snippet(body),
 	)
 	if err != nil {
 		return "", fmt.Errorf("insert email: %w", err)
@@ -99,8 +985,63 @@ func (s *Store) SaveOutbound(ctx context.Context, sender string, recipients []st
 	return id, nil
 }
 
-// SaveInbound persists a new inbound email from IMAP polling.
-func (s *Store) SaveInbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte, imapMessageID, imapMailbox string) (string, error) {
+// SaveOutboundBatch persists new outbound emails with their flags and tags in
+// one transaction, so either all of them are saved or none is, and returns
+// their IDs in order. Of each email only what SaveOutbound takes, Flags and
+// Tags are read.
+func (s *Store) SaveOutboundBatch(ctx context.Context, emails []Email) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now().UTC()
+	ids := make([]string, 0, len(emails))
+	for _, e := range emails {
+		id := uuid.New().String()
+		recipientsJSON, err := json.Marshal(e.Recipients)
+		if err != nil {
+			return nil, fmt.Errorf("marshal recipients: %w", err)
+		}
+		var flags sql.NullString
+		if len(e.Flags) > 0 {
+			b, err := json.Marshal(e.Flags)
+			if err != nil {
+				return nil, fmt.Errorf("marshal flags: %w", err)
+			}
+			flags = nullString(string(b))
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO emails (id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox, has_attachments, snippet, flags)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL, ?, ?, ?)`,
+			id, DirectionOutbound, StatusPending, e.Sender, string(recipientsJSON), e.Subject, e.Body, s.seal(e.RawMessage), now, hasAttachments(e.RawMessage), mimetext.Snippet(e.Body), flags,
+		); err != nil {
+			return nil, fmt.Errorf("insert email: %w", err)
+		}
+		for _, tag := range e.Tags {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO email_tags (email_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING`, id, tag,
+			); err != nil {
+				return nil, fmt.Errorf("add tag: %w", err)
+			}
+		}
+		ids = append(ids, id)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return ids, nil
+}
+
+// SaveInbound persists a new inbound email from IMAP polling into queue.
+func (s *Store) SaveInbound(ctx context.Context, sender string, recipients []string, subject, body string, rawMessage []byte, imapMessageID, imapMailbox, queue string) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	id := uuid.New().String()
 	recipientsJSON, err := json.Marshal(recipients)
 	if err != nil {
@@ -108,9 +1049,9 @@ func (s *Store) SaveInbound(ctx context.Context, sender string, recipients []str
 	}
 
 	_, err = s.db.ExecContext(ctx,
-		`INSERT INTO emails (id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		id, DirectionInbound, StatusPending, sender, string(recipientsJSON), subject, body, rawMessage, time.Now().UTC(), imapMessageID, imapMailbox,
+		`INSERT INTO emails (id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox, queue, has_attachments, snippet, in_reply_to)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, DirectionInbound, StatusPending, sender, string(recipientsJSON), subject, body, s.seal(rawMessage), time.Now().UTC(), imapMessageID, imapMailbox, queue, hasAttachments(rawMessage), mimetext.Snippet(body), nullString(inReplyTo(rawMessage)),
 	)
 	if err != nil {
 		return "", fmt.Errorf("insert email: %w", err)
@@ -120,9 +1061,11 @@ func (s *Store) SaveInbound(ctx context.Context, sender string, recipients []str
 
 // ListPending returns all pending emails (for web UI).
 func (s *Store) ListPending(ctx context.Context) ([]Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox
-		 FROM emails WHERE status = ? ORDER BY received_at ASC`,
+		`SELECT `+emailColumns+` FROM emails WHERE status = ? ORDER BY received_at ASC`,
 		StatusPending,
 	)
 	if err != nil {
@@ -130,115 +1073,1831 @@ func (s *Store) ListPending(ctx context.Context) ([]Email, error) {
 	}
 	defer func() { _ = rows.Close() }()
 
-	return scanEmails(rows)
+	return s.scanEmails(rows)
 }
 
-// ListApproved returns all approved inbound emails (for GET /api/emails).
-func (s *Store) ListApproved(ctx context.Context) ([]Email, error) {
+// ListPendingSummaries returns all pending emails like ListPending, but with
+// Body cut to PreviewLength characters and no RawMessage, so rendering a long
+// queue does not load every message into memory.
+func (s *Store) ListPendingSummaries(ctx context.Context) ([]Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	rows, err := s.db.QueryContext(ctx,
-		`SELECT id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox
-		 FROM emails WHERE direction = ? AND status = ? ORDER BY received_at ASC`,
-		DirectionInbound, StatusApproved,
+		`SELECT `+summaryColumns+` FROM emails WHERE status = ? ORDER BY received_at ASC`,
+		StatusPending,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("query emails: %w", err)
 	}
 	defer func() { _ = rows.Close() }()
 
-	return scanEmails(rows)
+	emails, err := s.scanEmails(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range emails {
+		truncatePreview(&emails[i])
+	}
+	return emails, nil
 }
 
-// Get retrieves a single email by ID.
-func (s *Store) Get(ctx context.Context, id string) (*Email, error) {
-	var e Email
-	var recipientsJSON string
-	var imapMessageID, imapMailbox sql.NullString
-	err := s.db.QueryRowContext(ctx,
-		`SELECT id, direction, status, sender, recipients, subject, body, raw_message, received_at, imap_message_id, imap_mailbox
-		 FROM emails WHERE id = ?`, id,
-	).Scan(&e.ID, &e.Direction, &e.Status, &e.Sender, &recipientsJSON, &e.Subject, &e.Body, &e.RawMessage, &e.ReceivedAt, &imapMessageID, &imapMailbox)
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("email not found: %s", id)
+// sortColumns maps PendingQuery.Sort to an ORDER BY expression.
+var sortColumns = map[string]string{
+	SortAge:     "received_at",
+	SortSender:  "sender COLLATE NOCASE",
+	SortSubject: "subject COLLATE NOCASE",
+}
+
+// ListPendingPage returns one page of email summaries (as
+// ListPendingSummaries) matching q, and the number of matches across all pages.
+func (s *Store) ListPendingPage(ctx context.Context, q PendingQuery) ([]Email, int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	where := ` WHERE status = ?`
+	args := []any{cmp.Or(q.Status, StatusPending)}
+	if q.Direction != "" {
+		where += ` AND direction = ?`
+		args = append(args, q.Direction)
 	}
-	if err != nil {
-		return nil, fmt.Errorf("query email: %w", err)
+	if q.Queue != "" {
+		where += ` AND queue = ?`
+		args = append(args, q.Queue)
 	}
-	if err := json.Unmarshal([]byte(recipientsJSON), &e.Recipients); err != nil {
-		return nil, fmt.Errorf("unmarshal recipients: %w", err)
+	if q.HasAttachments {
+		where += ` AND has_attachments = 1`
+	}
+	if q.Tag != "" {
+		where += ` AND id IN (SELECT email_id FROM email_tags WHERE tag = ?)`
+		args = append(args, q.Tag)
+	}
+	if !q.ReceivedBefore.IsZero() {
+		where += ` AND received_at < ?`
+		args = append(args, q.ReceivedBefore.UTC())
+	}
+	if !q.ReceivedAfter.IsZero() {
+		where += ` AND received_at >= ?`
+		args = append(args, q.ReceivedAfter.UTC())
+	}
+	switch {
+	case q.Snoozed && q.SnoozedAt.IsZero():
+		where += ` AND snoozed_until IS NOT NULL`
+	case q.Snoozed:
+		where += ` AND snoozed_until > ?`
+		args = append(args, q.SnoozedAt.UTC())
+	case !q.SnoozedAt.IsZero():
+		where += ` AND (snoozed_until IS NULL OR snoozed_until <= ?)`
+		args = append(args, q.SnoozedAt.UTC())
 	}
-	e.IMAPMessageID = imapMessageID.String
-	e.IMAPMailbox = imapMailbox.String
-	return &e, nil
-}
 
-// Approve sets an email's status to approved.
-func (s *Store) Approve(ctx context.Context, id string) error {
-	res, err := s.db.ExecContext(ctx, `UPDATE emails SET status = ? WHERE id = ?`, StatusApproved, id)
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM emails`+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count emails: %w", err)
+	}
+
+	order, ok := sortColumns[q.Sort]
+	if !ok {
+		order = sortColumns[SortAge]
+	}
+	if q.Desc {
+		order += ` DESC`
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+summaryColumns+` FROM emails`+where+` ORDER BY `+order+`, received_at ASC, id ASC LIMIT ? OFFSET ?`,
+		append(args, limit, max(q.Offset, 0))...,
+	)
 	if err != nil {
-		return fmt.Errorf("approve email: %w", err)
+		return nil, 0, fmt.Errorf("query emails: %w", err)
 	}
-	n, err := res.RowsAffected()
+	defer func() { _ = rows.Close() }()
+
+	emails, err := s.scanEmails(rows)
 	if err != nil {
-		return fmt.Errorf("rows affected: %w", err)
+		return nil, 0, err
 	}
-	if n == 0 {
-		return fmt.Errorf("email not found: %s", id)
+	for i := range emails {
+		truncatePreview(&emails[i])
 	}
-	return nil
+	return emails, total, nil
 }
 
-// UpdateIMAPMailbox updates the IMAP mailbox field for an email.
-func (s *Store) UpdateIMAPMailbox(ctx context.Context, id, mailbox string) error {
-	res, err := s.db.ExecContext(ctx, `UPDATE emails SET imap_mailbox = ? WHERE id = ?`, mailbox, id)
-	if err != nil {
-		return fmt.Errorf("update imap mailbox: %w", err)
+// ListApproved returns approved inbound emails (for GET /api/emails) without
+// their raw messages, which OpenRaw reads. If queue is non-empty only emails
+// routed to that queue are returned, and if tag is non-empty only emails with
+// that tag.
+func (s *Store) ListApproved(ctx context.Context, queue, tag string) ([]Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `SELECT ` + approvedColumns + ` FROM emails WHERE direction = ? AND status = ?`
+	args := []any{DirectionInbound, StatusApproved}
+	if queue != "" {
+		query += ` AND queue = ?`
+		args = append(args, queue)
 	}
-	n, err := res.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("rows affected: %w", err)
+	if tag != "" {
+		query += ` AND id IN (SELECT email_id FROM email_tags WHERE tag = ?)`
+		args = append(args, tag)
 	}
-	if n == 0 {
-		return fmt.Errorf("email not found: %s", id)
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY received_at ASC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query emails: %w", err)
 	}
-	return nil
+	defer func() { _ = rows.Close() }()
+
+	return s.scanEmails(rows)
 }
 
-// Delete removes an email by ID.
-func (s *Store) Delete(ctx context.Context, id string) error {
-	res, err := s.db.ExecContext(ctx, `DELETE FROM emails WHERE id = ?`, id)
+// ListScheduled returns scheduled outbound emails as summaries (see
+// ListPendingSummaries), the next to be relayed first.
+func (s *Store) ListScheduled(ctx context.Context) ([]Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+summaryColumns+` FROM emails WHERE status = ? ORDER BY scheduled_at ASC, received_at ASC`,
+		StatusScheduled,
+	)
 	if err != nil {
-		return fmt.Errorf("delete email: %w", err)
+		return nil, fmt.Errorf("query emails: %w", err)
 	}
-	n, err := res.RowsAffected()
+	defer func() { _ = rows.Close() }()
+
+	emails, err := s.scanEmails(rows)
 	if err != nil {
-		return fmt.Errorf("rows affected: %w", err)
+		return nil, err
 	}
-	if n == 0 {
-		return fmt.Errorf("email not found: %s", id)
+	for i := range emails {
+		truncatePreview(&emails[i])
 	}
-	return nil
+	return emails, nil
 }
 
-// Close closes the database connection.
-func (s *Store) Close() error {
-	return s.db.Close()
+// Get retrieves a single email by ID.
+func (s *Store) Get(ctx context.Context, id string) (*Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	e, err := s.scanEmail(s.db.QueryRowContext(ctx,
+		`SELECT `+emailColumns+` FROM emails WHERE id = ?`, id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email not found: %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query email: %w", err)
+	}
+	return e, nil
 }
 
-func scanEmails(rows *sql.Rows) ([]Email, error) {
-	var emails []Email
-	for rows.Next() {
-		var e Email
-		var recipientsJSON string
-		var imapMessageID, imapMailbox sql.NullString
-		if err := rows.Scan(&e.ID, &e.Direction, &e.Status, &e.Sender, &recipientsJSON, &e.Subject, &e.Body, &e.RawMessage, &e.ReceivedAt, &imapMessageID, &imapMailbox); err != nil {
-			return nil, fmt.Errorf("scan email: %w", err)
-		}
-		if err := json.Unmarshal([]byte(recipientsJSON), &e.Recipients); err != nil {
-			return nil, fmt.Errorf("unmarshal recipients: %w", err)
-		}
-		e.IMAPMessageID = imapMessageID.String
-		e.IMAPMailbox = imapMailbox.String
-		emails = append(emails, e)
+// GetSummary retrieves a single email by ID with its body cut to a preview and
+// no raw message, as ListPendingSummaries does.
+func (s *Store) GetSummary(ctx context.Context, id string) (*Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	e, err := s.scanEmail(s.db.QueryRowContext(ctx,
+		`SELECT `+summaryColumns+` FROM emails WHERE id = ?`, id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email not found: %s", id)
 	}
-	return emails, rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("query email: %w", err)
+	}
+	truncatePreview(e)
+	return e, nil
+}
+
+// CountPending returns the number of pending emails.
+func (s *Store) CountPending(ctx context.Context) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM emails WHERE status = ?`, StatusPending).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count pending: %w", err)
+	}
+	return n, nil
+}
+
+// CountByStatus returns the number of emails per direction and status,
+// ordered by direction, then status. Combinations without emails are omitted.
+func (s *Store) CountByStatus(ctx context.Context) ([]StatusCount, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT direction, status, COUNT(*) FROM emails GROUP BY direction, status ORDER BY direction ASC, status ASC`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("count by status: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var counts []StatusCount
+	for rows.Next() {
+		var c StatusCount
+		if err := rows.Scan(&c.Direction, &c.Status, &c.Count); err != nil {
+			return nil, fmt.Errorf("scan status count: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// OldestPendingAge returns how long the oldest pending email has waited at
+// now, or 0 if nothing is pending.
+func (s *Store) OldestPendingAge(ctx context.Context, now time.Time) (time.Duration, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var oldest sql.NullString
+	if err := s.db.QueryRowContext(ctx, `SELECT MIN(received_at) FROM emails WHERE status = ?`, StatusPending).Scan(&oldest); err != nil {
+		return 0, fmt.Errorf("oldest pending: %w", err)
+	}
+	if !oldest.Valid {
+		return 0, nil
+	}
+	return now.Sub(parseTimestamp(oldest.String)), nil
+}
+
+// Approve sets a pending email's status to approved, recording who approved
+// it and when. It returns ErrConflict unless the email is still pending at
+// version.
+func (s *Store) Approve(ctx context.Context, id, approvedBy string, version int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET status = ?, approved_by = ?, approved_at = ?, approval_seq = `+nextApprovalSeq+`, version = version + 1
+		 WHERE id = ? AND status = ? AND version = ?`,
+		StatusApproved, approvedBy, time.Now().UTC(), id, StatusPending, version,
+	)
+	if err != nil {
+		return fmt.Errorf("approve email: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// AddApproval records a's approval of a pending email that needs more than
+// one, leaving it pending. It returns ErrConflict unless the email is still
+// pending at version.
+func (s *Store) AddApproval(ctx context.Context, id string, a Approval, version int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if a.At.IsZero() {
+		a.At = time.Now().UTC()
+	}
+	approvalJSON, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("marshal approval: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET approvals = json_insert(COALESCE(approvals, '[]'), '$[#]', json(?)), version = version + 1
+		 WHERE id = ? AND status = ? AND version = ?`,
+		string(approvalJSON), id, StatusPending, version,
+	)
+	if err != nil {
+		return fmt.Errorf("add approval: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// Unapprove returns an approved email to pending, e.g. when relaying it
+// failed. It returns ErrConflict if the email is not approved.
+func (s *Store) Unapprove(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET status = ?, approved_by = NULL, approved_at = NULL, approval_seq = NULL, version = version + 1
+		 WHERE id = ? AND status = ?`,
+		StatusPending, id, StatusApproved,
+	)
+	if err != nil {
+		return fmt.Errorf("unapprove email: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// Schedule marks an approved outbound email to be relayed at at, once its
+// sending window opens. It returns ErrConflict if the email is not approved.
+func (s *Store) Schedule(ctx context.Context, id string, at time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET status = ?, scheduled_at = ?, version = version + 1 WHERE id = ? AND status = ?`,
+		StatusScheduled, at.UTC(), id, StatusApproved,
+	)
+	if err != nil {
+		return fmt.Errorf("schedule email: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// Reschedule moves a scheduled email to be relayed at at instead. It returns
+// ErrConflict if the email is not scheduled.
+func (s *Store) Reschedule(ctx context.Context, id string, at time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET scheduled_at = ?, version = version + 1 WHERE id = ? AND status = ?`,
+		at.UTC(), id, StatusScheduled,
+	)
+	if err != nil {
+		return fmt.Errorf("reschedule email: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// BeginRelay marks an approved or scheduled outbound email as relaying, just
+// before it is handed to the relay. It returns ErrConflict if the email is
+// in any other status, in particular if it is already relaying or sent, so
+// that of two attempts to relay an email only one does.
+func (s *Store) BeginRelay(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET status = ?, version = version + 1 WHERE id = ? AND direction = ? AND status IN (?, ?)`,
+		StatusRelaying, id, DirectionOutbound, StatusApproved, StatusScheduled,
+	)
+	if err != nil {
+		return fmt.Errorf("begin relay: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// AbortRelay returns a relaying email to status, StatusApproved or
+// StatusScheduled, after the relay refused it. It returns ErrConflict if the
+// email is not relaying.
+func (s *Store) AbortRelay(ctx context.Context, id, status string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET status = ?, version = version + 1 WHERE id = ? AND status = ?`,
+		status, id, StatusRelaying,
+	)
+	if err != nil {
+		return fmt.Errorf("abort relay: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// MarkSent records that the relay accepted a relaying email. Marking a sent
+// email again does nothing; any other status is ErrConflict.
+func (s *Store) MarkSent(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET status = ?, relayed_at = ?, version = version + 1 WHERE id = ? AND status = ?`,
+		StatusSent, time.Now().UTC(), id, StatusRelaying,
+	)
+	if err != nil {
+		return fmt.Errorf("mark sent: %w", err)
+	}
+	if err := s.checkChanged(ctx, res, id); !errors.Is(err, ErrConflict) {
+		return err
+	}
+	var status string
+	if err := s.db.QueryRowContext(ctx, `SELECT status FROM emails WHERE id = ?`, id).Scan(&status); err != nil {
+		return fmt.Errorf("query email: %w", err)
+	}
+	if status == StatusSent {
+		return nil
+	}
+	return ErrConflict
+}
+
+// ListInFlight returns outbound emails left relaying or sent, the oldest
+// first: normally none, as they are only in those statuses while an approval
+// is being relayed.
+func (s *Store) ListInFlight(ctx context.Context) ([]Email, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+emailColumns+` FROM emails WHERE status IN (?, ?) ORDER BY received_at ASC`,
+		StatusRelaying, StatusSent,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query emails: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	return s.scanEmails(rows)
+}
+
+// Reject deletes a pending email. It returns ErrConflict unless the email is
+// still pending at version.
+func (s *Store) Reject(ctx context.Context, id string, version int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM emails WHERE id = ? AND status = ? AND version = ?`, id, StatusPending, version)
+	if err != nil {
+		return fmt.Errorf("reject email: %w", err)
+	}
+	return s.checkChanged(ctx, res, id)
+}
+
+// checkChanged returns nil if res changed a row, and otherwise ErrConflict
+// or a not-found error depending on whether the email exists.
+func (s *Store) checkChanged(ctx context.Context, res sql.Result, id string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	if err := s.checkExists(ctx, id); err != nil {
+		return err
+	}
+	return ErrConflict
+}
+
+// UpdateIMAPMailbox updates the IMAP mailbox field for an email.
+func (s *Store) UpdateIMAPMailbox(ctx context.Context, id, mailbox string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `UPDATE emails SET imap_mailbox = ? WHERE id = ?`, mailbox, id)
+	if err != nil {
+		return fmt.Errorf("update imap mailbox: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	return nil
+}
+
+// AddFlag sets flag on an email. Setting a flag that is already present is a no-op.
+func (s *Store) AddFlag(ctx context.Context, id, flag string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE emails SET flags = CASE
+			WHEN EXISTS (SELECT 1 FROM json_each(COALESCE(flags, '[]')) WHERE value = ?1) THEN flags
+			ELSE json_insert(COALESCE(flags, '[]'), '$[#]', ?1)
+		 END
+		 WHERE id = ?2`, flag, id)
+	if err != nil {
+		return fmt.Errorf("add flag: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	return nil
+}
+
+// SetSignature records the signature verification result for an email.
+func (s *Store) SetSignature(ctx context.Context, id string, sig Signature) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	sigJSON, err := json.Marshal(sig)
+	if err != nil {
+		return fmt.Errorf("marshal signature: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE emails SET signature = ? WHERE id = ?`, string(sigJSON), id)
+	if err != nil {
+		return fmt.Errorf("set signature: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	return nil
+}
+
+// SetEnvelopeRecipients records the addresses an inbound email was delivered to.
+func (s *Store) SetEnvelopeRecipients(ctx context.Context, id string, recipients []string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	recipientsJSON, err := json.Marshal(recipients)
+	if err != nil {
+		return fmt.Errorf("marshal envelope recipients: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE emails SET envelope_recipients = ? WHERE id = ?`, string(recipientsJSON), id)
+	if err != nil {
+		return fmt.Errorf("set envelope recipients: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	return nil
+}
+
+// AddTag applies tag to an email. Adding a tag that is already present is a
+// no-op. tag must already be normalized (see NormalizeTag).
+func (s *Store) AddTag(ctx context.Context, id, tag string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO email_tags (email_id, tag) SELECT id, ? FROM emails WHERE id = ?
+		 ON CONFLICT DO NOTHING`, tag, id)
+	if err != nil {
+		return fmt.Errorf("add tag: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return s.checkExists(ctx, id)
+	}
+	return nil
+}
+
+// RemoveTag removes tag from an email. Removing a tag that is not present is
+// a no-op.
+func (s *Store) RemoveTag(ctx context.Context, id, tag string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM email_tags WHERE email_id = ? AND tag = ?`, id, tag); err != nil {
+		return fmt.Errorf("remove tag: %w", err)
+	}
+	return s.checkExists(ctx, id)
+}
+
+// checkExists returns an error if there is no email with the given id.
+func (s *Store) checkExists(ctx context.Context, id string) error {
+	var n int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM emails WHERE id = ?`, id).Scan(&n); err != nil {
+		return fmt.Errorf("query email: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	return nil
+}
+
+// ListTags returns every tag applied to a held email, sorted.
+func (s *Store) ListTags(ctx context.Context) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT tag FROM email_tags ORDER BY tag ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query tags: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("scan tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// TagUsage returns how many emails tagged tag are pending and how much space
+// the raw messages of all emails tagged tag take.
+func (s *Store) TagUsage(ctx context.Context, tag string) (TagUsage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var u TagUsage
+	if err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(CASE WHEN status = ? THEN 1 END), COALESCE(SUM(length(raw_message)), 0)
+		 FROM emails WHERE id IN (SELECT email_id FROM email_tags WHERE tag = ?)`, StatusPending, tag,
+	).Scan(&u.Pending, &u.Bytes); err != nil {
+		return TagUsage{}, fmt.Errorf("tag usage: %w", err)
+	}
+	return u, nil
+}
+
+// Delete removes an email by ID.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM emails WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete email: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("email not found: %s", id)
+	}
+	return nil
+}
+
+// RecordDecision appends a reviewer decision to the decision log. A decision
+// with an EnvelopeID and no DeliveryStatus gets DeliveryRequested.
+func (s *Store) RecordDecision(ctx context.Context, d Decision) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if d.DecidedAt.IsZero() {
+		d.DecidedAt = time.Now().UTC()
+	}
+	if d.EnvelopeID != "" && d.DeliveryStatus == "" {
+		d.DeliveryStatus = DeliveryRequested
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO decisions (email_id, direction, sender, subject, decision, reviewer, latency_seconds, decided_at, envelope_id, delivery_status, delivery_detail, forwarded_to, reason)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.EmailID, d.Direction, d.Sender, d.Subject, d.Decision, d.Reviewer, d.Latency.Seconds(), d.DecidedAt.UTC(),
+		nullString(d.EnvelopeID), nullString(d.DeliveryStatus), nullString(d.DeliveryDetail), nullString(d.ForwardedTo), nullString(d.Reason),
+	)
+	if err != nil {
+		return fmt.Errorf("insert decision: %w", err)
+	}
+	return nil
+}
+
+// UpdateDelivery records the delivery status reported by a DSN on the
+// decision that relayed the mail with envelopeID.
+func (s *Store) UpdateDelivery(ctx context.Context, envelopeID, status, detail string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE decisions SET delivery_status = ?, delivery_detail = ? WHERE envelope_id = ?`,
+		status, detail, envelopeID)
+	if err != nil {
+		return fmt.Errorf("update delivery: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no decision with envelope ID %s", envelopeID)
+	}
+	return nil
+}
+
+// ListDecisions returns the most recent decisions, newest first, up to limit.
+func (s *Store) ListDecisions(ctx context.Context, limit int) ([]Decision, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT email_id, direction, COALESCE(sender, ''), COALESCE(subject, ''), decision, reviewer, latency_seconds, decided_at,
+		        COALESCE(envelope_id, ''), COALESCE(delivery_status, ''), COALESCE(delivery_detail, ''), COALESCE(forwarded_to, ''), COALESCE(reason, '')
+		 FROM decisions ORDER BY decided_at DESC, id DESC LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query decisions: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	return scanDecisions(rows)
+}
+
+// scanDecisions reads the decisions selected by ListDecisions.
+func scanDecisions(rows *sql.Rows) ([]Decision, error) {
+	var decisions []Decision
+	for rows.Next() {
+		var d Decision
+		var latency float64
+		if err := rows.Scan(&d.EmailID, &d.Direction, &d.Sender, &d.Subject, &d.Decision, &d.Reviewer, &latency, &d.DecidedAt,
+			&d.EnvelopeID, &d.DeliveryStatus, &d.DeliveryDetail, &d.ForwardedTo, &d.Reason); err != nil {
+			return nil, fmt.Errorf("scan decision: %w", err)
+		}
+		d.Latency = secondsToDuration(latency)
+		decisions = append(decisions, d)
+	}
+	return decisions, rows.Err()
+}
+
+// outcomeConditions are the WHERE clauses of the decisions with each outcome.
+var outcomeConditions = map[string]string{
+	OutcomeRejected: `decision = '` + DecisionRejected + `'`,
+	OutcomeSent:     `decision = '` + DecisionApproved + `' AND direction = '` + DirectionOutbound + `' AND COALESCE(delivery_status, '') != '` + DeliveryFailed + `'`,
+	OutcomeBounced:  `delivery_status = '` + DeliveryFailed + `'`,
+}
+
+// ListDecisionPage returns one page of the decisions matching q, newest
+// first, and the number of matches across all pages.
+func (s *Store) ListDecisionPage(ctx context.Context, q DecisionQuery) ([]Decision, int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var where string
+	if q.Outcome != "" {
+		cond, ok := outcomeConditions[q.Outcome]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown outcome %q", q.Outcome)
+		}
+		where = ` WHERE ` + cond
+	}
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM decisions`+where).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count decisions: %w", err)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT email_id, direction, COALESCE(sender, ''), COALESCE(subject, ''), decision, reviewer, latency_seconds, decided_at,
+		        COALESCE(envelope_id, ''), COALESCE(delivery_status, ''), COALESCE(delivery_detail, ''), COALESCE(forwarded_to, ''), COALESCE(reason, '')
+		 FROM decisions`+where+` ORDER BY decided_at DESC, id DESC LIMIT ? OFFSET ?`, limit, max(q.Offset, 0),
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query decisions: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	decisions, err := scanDecisions(rows)
+	return decisions, total, err
+}
+
+// LastDecision returns the most recent decision on an email, or nil if none
+// was recorded.
+func (s *Store) LastDecision(ctx context.Context, emailID string) (*Decision, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var d Decision
+	var latency float64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT email_id, direction, COALESCE(sender, ''), COALESCE(subject, ''), decision, reviewer, latency_seconds, decided_at,
+		        COALESCE(envelope_id, ''), COALESCE(delivery_status, ''), COALESCE(delivery_detail, ''), COALESCE(forwarded_to, ''), COALESCE(reason, '')
+		 FROM decisions WHERE email_id = ? ORDER BY decided_at DESC, id DESC LIMIT 1`, emailID,
+	).Scan(&d.EmailID, &d.Direction, &d.Sender, &d.Subject, &d.Decision, &d.Reviewer, &latency, &d.DecidedAt,
+		&d.EnvelopeID, &d.DeliveryStatus, &d.DeliveryDetail, &d.ForwardedTo, &d.Reason)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query decision: %w", err)
+	}
+	d.Latency = secondsToDuration(latency)
+	return &d, nil
+}
+
+// ListReviewerStats returns per-reviewer decision counts and latencies,
+// ordered by reviewer name. Forwards are left out: they are not decisions.
+func (s *Store) ListReviewerStats(ctx context.Context) ([]ReviewerStats, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT reviewer,
+		        SUM(CASE WHEN decision = ? THEN 1 ELSE 0 END),
+		        SUM(CASE WHEN decision = ? THEN 1 ELSE 0 END),
+		        AVG(latency_seconds),
+		        MAX(latency_seconds),
+		        MAX(decided_at)
+		 FROM decisions WHERE decision IN (?, ?) GROUP BY reviewer ORDER BY reviewer ASC`,
+		DecisionApproved, DecisionRejected, DecisionApproved, DecisionRejected,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query reviewer stats: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var stats []ReviewerStats
+	for rows.Next() {
+		var rs ReviewerStats
+		var avg, maxLatency float64
+		var last string
+		if err := rows.Scan(&rs.Reviewer, &rs.Approved, &rs.Rejected, &avg, &maxLatency, &last); err != nil {
+			return nil, fmt.Errorf("scan reviewer stats: %w", err)
+		}
+		rs.AverageLatency = secondsToDuration(avg)
+		rs.MaxLatency = secondsToDuration(maxLatency)
+		rs.LastDecisionAt = parseTimestamp(last)
+		stats = append(stats, rs)
+	}
+	return stats, rows.Err()
+}
+
+// IncrementQuota adds one to sender's submission count for the window of the
+// given period starting at windowStart and returns the new count.
+func (s *Store) IncrementQuota(ctx context.Context, sender, period string, windowStart time.Time) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO quota_counters (sender, period, window_start, count) VALUES (?, ?, ?, 1)
+		 ON CONFLICT (sender, period, window_start) DO UPDATE SET count = count + 1
+		 RETURNING count`,
+		sender, period, windowStart.Unix(),
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("increment quota: %w", err)
+	}
+	return count, nil
+}
+
+// DecrementQuota takes one from sender's submission count for the window of
+// the given period starting at windowStart, never going below zero.
+func (s *Store) DecrementQuota(ctx context.Context, sender, period string, windowStart time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx,
+		`UPDATE quota_counters SET count = count - 1
+		 WHERE sender = ? AND period = ? AND window_start = ? AND count > 0`,
+		sender, period, windowStart.Unix(),
+	); err != nil {
+		return fmt.Errorf("decrement quota: %w", err)
+	}
+	return nil
+}
+
+// ListQuotaUsage returns counters for windows starting at or after since,
+// ordered by sender, then period.
+func (s *Store) ListQuotaUsage(ctx context.Context, since time.Time) ([]QuotaUsage, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT sender, period, window_start, count FROM quota_counters
+		 WHERE window_start >= ? ORDER BY sender ASC, period ASC, window_start DESC`, since.Unix(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query quota usage: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var usage []QuotaUsage
+	for rows.Next() {
+		var u QuotaUsage
+		var start int64
+		if err := rows.Scan(&u.Sender, &u.Period, &start, &u.Count); err != nil {
+			return nil, fmt.Errorf("scan quota usage: %w", err)
+		}
+		u.WindowStart = time.Unix(start, 0).UTC()
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// PruneQuota deletes counters for windows that started before before.
+func (s *Store) PruneQuota(ctx context.Context, before time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM quota_counters WHERE window_start < ?`, before.Unix()); err != nil {
+		return fmt.Errorf("prune quota: %w", err)
+	}
+	return nil
+}
+
+// RecordContacts increments the approval count of each address for direction.
+// Addresses are stored lower-cased.
+func (s *Store) RecordContacts(ctx context.Context, direction string, addresses []string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now().UTC()
+	for _, addr := range addresses {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO contacts (address, direction, approved_count, last_approved_at) VALUES (?, ?, 1, ?)
+			 ON CONFLICT (address, direction) DO UPDATE SET approved_count = approved_count + 1, last_approved_at = excluded.last_approved_at`,
+			strings.ToLower(addr), direction, now,
+		)
+		if err != nil {
+			return fmt.Errorf("upsert contact: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// ContactCounts returns the approval count for each of addresses in
+// direction, keyed by lower-cased address. Unknown addresses map to 0.
+func (s *Store) ContactCounts(ctx context.Context, direction string, addresses []string) (map[string]int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	counts := make(map[string]int, len(addresses))
+	for _, addr := range addresses {
+		addr = strings.ToLower(addr)
+		var n int
+		err := s.db.QueryRowContext(ctx,
+			`SELECT approved_count FROM contacts WHERE address = ? AND direction = ?`, addr, direction,
+		).Scan(&n)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("query contact: %w", err)
+		}
+		counts[addr] = n
+	}
+	return counts, nil
+}
+
+// GetIdempotencyKey returns the submission recorded under key at or after
+// since, or nil if there is none.
+func (s *Store) GetIdempotencyKey(ctx context.Context, key string, since time.Time) (*IdempotencyKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	k := IdempotencyKey{Key: key}
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT request_hash, email_id, status, created_at FROM idempotency_keys WHERE key = ? AND created_at >= ?`,
+		key, since.Unix(),
+	).Scan(&k.RequestHash, &k.EmailID, &k.Status, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query idempotency key: %w", err)
+	}
+	k.CreatedAt = time.Unix(createdAt, 0).UTC()
+	return &k, nil
+}
+
+// SaveIdempotencyKey records a submission under k.Key, replacing any expired
+// record of the same key. A zero CreatedAt means now.
+func (s *Store) SaveIdempotencyKey(ctx context.Context, k IdempotencyKey) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if k.CreatedAt.IsZero() {
+		k.CreatedAt = time.Now()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (key, request_hash, email_id, status, created_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (key) DO UPDATE SET request_hash = excluded.request_hash, email_id = excluded.email_id,
+		   status = excluded.status, created_at = excluded.created_at`,
+		k.Key, k.RequestHash, k.EmailID, k.Status, k.CreatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("save idempotency key: %w", err)
+	}
+	return nil
+}
+
+// PruneIdempotencyKeys deletes keys recorded before before.
+func (s *Store) PruneIdempotencyKeys(ctx context.Context, before time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < ?`, before.Unix()); err != nil {
+		return fmt.Errorf("prune idempotency keys: %w", err)
+	}
+	return nil
+}
+
+// CreateAPIToken stores a new token, assigning it a UUID. A zero CreatedAt
+// means now.
+func (s *Store) CreateAPIToken(ctx context.Context, t APIToken) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	id := uuid.New().String()
+	scopesJSON, err := json.Marshal(t.Scopes)
+	if err != nil {
+		return "", fmt.Errorf("marshal scopes: %w", err)
+	}
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now().UTC()
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO api_tokens (id, name, token_hash, scopes, project, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, t.Name, t.Hash, string(scopesJSON), nullString(t.Project), t.CreatedBy, t.CreatedAt, nullTime(t.ExpiresAt),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert API token: %w", err)
+	}
+	return id, nil
+}
+
+// apiTokenColumns is the column list scanned by scanAPIToken, in order.
+const apiTokenColumns = `id, name, token_hash, scopes, COALESCE(project, ''), created_by, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	var t APIToken
+	var scopesJSON string
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.Name, &t.Hash, &scopesJSON, &t.Project, &t.CreatedBy, &t.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(scopesJSON), &t.Scopes); err != nil {
+		return nil, fmt.Errorf("unmarshal scopes: %w", err)
+	}
+	t.ExpiresAt = expiresAt.Time
+	t.LastUsedAt = lastUsedAt.Time
+	t.RevokedAt = revokedAt.Time
+	return &t, nil
+}
+
+// ListAPITokens returns all tokens, revoked and expired ones included, newest first.
+func (s *Store) ListAPITokens(ctx context.Context) ([]APIToken, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("query API tokens: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan API token: %w", err)
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+// GetAPITokenByHash returns the token with the given hash, or nil if there is none.
+func (s *Store) GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	t, err := scanAPIToken(s.db.QueryRowContext(ctx, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query API token: %w", err)
+	}
+	return t, nil
+}
+
+// TouchAPIToken sets the last-used time of a token.
+func (s *Store) TouchAPIToken(ctx context.Context, id string, at time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, `UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, at.UTC(), id); err != nil {
+		return fmt.Errorf("touch API token: %w", err)
+	}
+	return nil
+}
+
+// RevokeAPIToken marks a token revoked. Revoking an unknown or already
+// revoked token is an error.
+func (s *Store) RevokeAPIToken(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("revoke API token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("API token not found: %s", id)
+	}
+	return nil
+}
+
+// CreateShareLink stores a new share link, assigning it a UUID. A zero
+// CreatedAt means now.
+func (s *Store) CreateShareLink(ctx context.Context, l ShareLink) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	id := uuid.New().String()
+	if l.CreatedAt.IsZero() {
+		l.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO share_links (id, email_id, token_hash, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, l.EmailID, l.Hash, l.CreatedBy, l.CreatedAt.UTC(), l.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert share link: %w", err)
+	}
+	return id, nil
+}
+
+// shareLinkColumns is the column list scanned by scanShareLink, in order.
+const shareLinkColumns = `id, email_id, token_hash, created_by, created_at, expires_at, revoked_at`
+
+func scanShareLink(row rowScanner) (*ShareLink, error) {
+	var l ShareLink
+	var revokedAt sql.NullTime
+	if err := row.Scan(&l.ID, &l.EmailID, &l.Hash, &l.CreatedBy, &l.CreatedAt, &l.ExpiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	l.RevokedAt = revokedAt.Time
+	return &l, nil
+}
+
+// ListShareLinks returns the share links of an email, revoked and expired
+// ones included, newest first.
+func (s *Store) ListShareLinks(ctx context.Context, emailID string) ([]ShareLink, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+shareLinkColumns+` FROM share_links WHERE email_id = ? ORDER BY created_at DESC`, emailID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query share links: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var links []ShareLink
+	for rows.Next() {
+		l, err := scanShareLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan share link: %w", err)
+		}
+		links = append(links, *l)
+	}
+	return links, rows.Err()
+}
+
+// GetShareLinkByHash returns the share link with the given hash, or nil if
+// there is none.
+func (s *Store) GetShareLinkByHash(ctx context.Context, hash string) (*ShareLink, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	l, err := scanShareLink(s.db.QueryRowContext(ctx, `SELECT `+shareLinkColumns+` FROM share_links WHERE token_hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query share link: %w", err)
+	}
+	return l, nil
+}
+
+// RevokeShareLink marks a share link revoked. Revoking an unknown or already
+// revoked link is an error.
+func (s *Store) RevokeShareLink(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE share_links SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return fmt.Errorf("revoke share link: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("share link not found: %s", id)
+	}
+	return nil
+}
+
+// RecordAudit appends an entry to the audit log. A zero At means now.
+func (s *Store) RecordAudit(ctx context.Context, e AuditEntry) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO audit_log (at, actor, action, detail) VALUES (?, ?, ?, ?)`, e.At.UTC(), e.Actor, e.Action, e.Detail,
+	)
+	if err != nil {
+		return fmt.Errorf("insert audit entry: %w", err)
+	}
+	return nil
+}
+
+// ListAudit returns the most recent audit entries, newest first.
+func (s *Store) ListAudit(ctx context.Context, limit int) ([]AuditEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT at, actor, action, detail FROM audit_log ORDER BY at DESC, id DESC LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query audit log: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.At, &e.Actor, &e.Action, &e.Detail); err != nil {
+			return nil, fmt.Errorf("scan audit entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// SetReputation records e, replacing any entry for the same subject. The
+// subject is stored lower-cased; a zero CreatedAt means now.
+func (s *Store) SetReputation(ctx context.Context, e ReputationEntry) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO reputation (subject, reputation, note, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (subject) DO UPDATE SET reputation = excluded.reputation, note = excluded.note,
+		 created_by = excluded.created_by, created_at = excluded.created_at`,
+		strings.ToLower(e.Subject), e.Reputation, e.Note, e.CreatedBy, e.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("upsert reputation: %w", err)
+	}
+	return nil
+}
+
+// GetReputation returns the entry for subject, or nil if there is none.
+func (s *Store) GetReputation(ctx context.Context, subject string) (*ReputationEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var e ReputationEntry
+	err := s.db.QueryRowContext(ctx,
+		`SELECT subject, reputation, note, created_by, created_at FROM reputation WHERE subject = ?`, strings.ToLower(subject),
+	).Scan(&e.Subject, &e.Reputation, &e.Note, &e.CreatedBy, &e.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query reputation: %w", err)
+	}
+	return &e, nil
+}
+
+// ListReputation returns every reputation entry, ordered by subject.
+func (s *Store) ListReputation(ctx context.Context) ([]ReputationEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT subject, reputation, note, created_by, created_at FROM reputation ORDER BY subject`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query reputation: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var entries []ReputationEntry
+	for rows.Next() {
+		var e ReputationEntry
+		if err := rows.Scan(&e.Subject, &e.Reputation, &e.Note, &e.CreatedBy, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan reputation: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteReputation removes the entry for subject.
+func (s *Store) DeleteReputation(ctx context.Context, subject string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM reputation WHERE subject = ?`, strings.ToLower(subject))
+	if err != nil {
+		return fmt.Errorf("delete reputation: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("reputation entry not found: %s", subject)
+	}
+	return nil
+}
+
+// AddAllowRule records r. The sender is stored lower-cased; a zero CreatedAt
+// means now. A rule that already exists for the direction and sender is kept
+// as it is.
+func (s *Store) AddAllowRule(ctx context.Context, r AllowRule) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO allow_rules (direction, sender, email_id, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (direction, sender) DO NOTHING`,
+		r.Direction, strings.ToLower(r.Sender), r.EmailID, r.CreatedBy, r.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("insert allow rule: %w", err)
+	}
+	return nil
+}
+
+// GetAllowRule returns the rule for sender in direction, or nil if there is
+// none.
+func (s *Store) GetAllowRule(ctx context.Context, direction, sender string) (*AllowRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var r AllowRule
+	err := s.db.QueryRowContext(ctx,
+		`SELECT direction, sender, email_id, created_by, created_at FROM allow_rules WHERE direction = ? AND sender = ?`,
+		direction, strings.ToLower(sender),
+	).Scan(&r.Direction, &r.Sender, &r.EmailID, &r.CreatedBy, &r.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query allow rule: %w", err)
+	}
+	return &r, nil
+}
+
+// ListAllowRules returns every allow rule, ordered by direction and sender.
+func (s *Store) ListAllowRules(ctx context.Context) ([]AllowRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT direction, sender, email_id, created_by, created_at FROM allow_rules ORDER BY direction, sender`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query allow rules: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var list []AllowRule
+	for rows.Next() {
+		var r AllowRule
+		if err := rows.Scan(&r.Direction, &r.Sender, &r.EmailID, &r.CreatedBy, &r.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan allow rule: %w", err)
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// DeleteAllowRule removes the rule for sender in direction.
+func (s *Store) DeleteAllowRule(ctx context.Context, direction, sender string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM allow_rules WHERE direction = ? AND sender = ?`, direction, strings.ToLower(sender))
+	if err != nil {
+		return fmt.Errorf("delete allow rule: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("allow rule not found: %s %s", direction, sender)
+	}
+	return nil
+}
+
+// AddBlockRule records r. The subject is stored lower-cased; a zero CreatedAt
+// means now. A rule that already exists for the direction and subject is kept
+// as it is.
+func (s *Store) AddBlockRule(ctx context.Context, r BlockRule) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO block_rules (direction, subject, email_id, created_by, created_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (direction, subject) DO NOTHING`,
+		r.Direction, strings.ToLower(r.Subject), r.EmailID, r.CreatedBy, r.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("insert block rule: %w", err)
+	}
+	return nil
+}
+
+// GetBlockRule returns the rule for subject (an address or a domain) in
+// direction, or nil if there is none.
+func (s *Store) GetBlockRule(ctx context.Context, direction, subject string) (*BlockRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var r BlockRule
+	err := s.db.QueryRowContext(ctx,
+		`SELECT direction, subject, email_id, created_by, created_at, suppressed FROM block_rules WHERE direction = ? AND subject = ?`,
+		direction, strings.ToLower(subject),
+	).Scan(&r.Direction, &r.Subject, &r.EmailID, &r.CreatedBy, &r.CreatedAt, &r.Suppressed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query block rule: %w", err)
+	}
+	return &r, nil
+}
+
+// ListBlockRules returns every block rule, ordered by direction and subject.
+func (s *Store) ListBlockRules(ctx context.Context) ([]BlockRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT direction, subject, email_id, created_by, created_at, suppressed FROM block_rules ORDER BY direction, subject`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query block rules: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var list []BlockRule
+	for rows.Next() {
+		var r BlockRule
+		if err := rows.Scan(&r.Direction, &r.Subject, &r.EmailID, &r.CreatedBy, &r.CreatedAt, &r.Suppressed); err != nil {
+			return nil, fmt.Errorf("scan block rule: %w", err)
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// CountSuppressed counts an email rejected by the rule for subject in
+// direction.
+func (s *Store) CountSuppressed(ctx context.Context, direction, subject string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE block_rules SET suppressed = suppressed + 1 WHERE direction = ? AND subject = ?`,
+		direction, strings.ToLower(subject),
+	)
+	if err != nil {
+		return fmt.Errorf("count suppressed: %w", err)
+	}
+	return nil
+}
+
+// DeleteBlockRule removes the rule for subject in direction.
+func (s *Store) DeleteBlockRule(ctx context.Context, direction, subject string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM block_rules WHERE direction = ? AND subject = ?`, direction, strings.ToLower(subject))
+	if err != nil {
+		return fmt.Errorf("delete block rule: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("block rule not found: %s %s", direction, subject)
+	}
+	return nil
+}
+
+// PruneDecisions deletes decisions made before before and returns how many
+// were deleted. An empty decision prunes both approvals and rejections.
+// Timestamps are stored in UTC, so they compare correctly as text.
+func (s *Store) PruneDecisions(ctx context.Context, decision string, before time.Time) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := `DELETE FROM decisions WHERE decided_at < ?`
+	args := []any{before.UTC()}
+	if decision != "" {
+		query += ` AND decision = ?`
+		args = append(args, decision)
+	}
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("prune decisions: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("prune decisions: %w", err)
+	}
+	return int(n), nil
+}
+
+// PruneAudit deletes audit entries recorded before before and returns how
+// many were deleted.
+func (s *Store) PruneAudit(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM audit_log WHERE at < ?`, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("prune audit log: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("prune audit log: %w", err)
+	}
+	return int(n), nil
+}
+
+// Vacuum rebuilds the database file, returning the space freed by deleted
+// rows to the filesystem. It can take far longer than a query on a large
+// database, so the query timeout does not apply.
+func (s *Store) Vacuum(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	return nil
+}
+
+// Maintain frees the pages of deleted rows and refreshes the statistics the
+// query planner uses. A database created without incremental auto-vacuum is
+// converted first, which rebuilds it once like Vacuum. The query timeout does
+// not apply.
+func (s *Store) Maintain(ctx context.Context) error {
+	var mode int
+	if err := s.db.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return fmt.Errorf("read auto_vacuum: %w", err)
+	}
+	if mode != autoVacuumIncremental {
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			return fmt.Errorf("convert to incremental vacuum: %w", err)
+		}
+		defer conn.Close()
+		// The mode only sticks once VACUUM rebuilds the file on the same
+		// connection.
+		for _, stmt := range []string{`PRAGMA auto_vacuum = INCREMENTAL`, `VACUUM`} {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("convert to incremental vacuum: %w", err)
+			}
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, `PRAGMA optimize`); err != nil {
+		return fmt.Errorf("optimize: %w", err)
+	}
+	// incremental_vacuum frees one page per step, so it must be read to the
+	// end rather than executed.
+	rows, err := s.db.QueryContext(ctx, `PRAGMA incremental_vacuum`)
+	if err != nil {
+		return fmt.Errorf("incremental vacuum: %w", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("incremental vacuum: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `ANALYZE`); err != nil {
+		return fmt.Errorf("analyze: %w", err)
+	}
+	return nil
+}
+
+// autoVacuumIncremental is PRAGMA auto_vacuum's value for INCREMENTAL.
+const autoVacuumIncremental = 2
+
+// Size describes how much space the database takes.
+type Size struct {
+	Bytes     int64          // database file
+	FreeBytes int64          // unused pages in the file, reclaimed by maintenance
+	WALBytes  int64          // write-ahead log; 0 when there is none
+	Rows      map[string]int // rows per table
+}
+
+// Size measures the database file, its write-ahead log and every table.
+func (s *Store) Size(ctx context.Context) (Size, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var pages, free, pageSize int64
+	for _, p := range []struct {
+		pragma string
+		dst    *int64
+	}{{`PRAGMA page_count`, &pages}, {`PRAGMA freelist_count`, &free}, {`PRAGMA page_size`, &pageSize}} {
+		if err := s.db.QueryRowContext(ctx, p.pragma).Scan(p.dst); err != nil {
+			return Size{}, fmt.Errorf("measure database: %w", err)
+		}
+	}
+	size := Size{Bytes: pages * pageSize, FreeBytes: free * pageSize, Rows: make(map[string]int)}
+
+	var file string
+	if err := s.db.QueryRowContext(ctx, `SELECT file FROM pragma_database_list WHERE name = 'main'`).Scan(&file); err != nil {
+		return Size{}, fmt.Errorf("measure database: %w", err)
+	}
+	if file != "" {
+		if fi, err := os.Stat(file + "-wal"); err == nil {
+			size.WALBytes = fi.Size()
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return Size{}, fmt.Errorf("list tables: %w", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return Size{}, fmt.Errorf("list tables: %w", err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Size{}, fmt.Errorf("list tables: %w", err)
+	}
+	for _, table := range tables {
+		var n int
+		if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM "`+table+`"`).Scan(&n); err != nil {
+			return Size{}, fmt.Errorf("count rows of %s: %w", table, err)
+		}
+		size.Rows[table] = n
+	}
+	return size, nil
+}
+
+// DBStats reports the database connection pool statistics.
+func (s *Store) DBStats() sql.DBStats {
+	return s.db.Stats()
+}
+
+// nullTime stores a zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// nullString stores an empty string as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Close closes the database connection.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// emailColumns is the column list scanned by scanEmail, in order.
+const emailColumns = `id, direction, status, sender, recipients, subject, body, raw_message, received_at,
+	imap_message_id, imap_mailbox, queue, approved_by, approved_at, approval_seq, flags, signature, has_attachments,
+	envelope_recipients, version, snippet, scheduled_at, relayed_at, in_reply_to, approvals, snoozed_until, snoozed_by,
+	(SELECT json_group_array(tag) FROM (SELECT tag FROM email_tags WHERE email_id = emails.id ORDER BY tag))`
+
+// PreviewLength is the number of body characters kept by the summary queries.
+const PreviewLength = 500
+
+// summaryColumns matches emailColumns but selects one character past the
+// preview, so truncatePreview can tell whether the body was cut, and leaves
+// the raw message NULL.
+var summaryColumns = strings.NewReplacer(
+	"body, raw_message", fmt.Sprintf("substr(body, 1, %d), NULL", PreviewLength+1),
+).Replace(emailColumns)
+
+// approvedColumns matches emailColumns but leaves the raw message NULL, so
+// listing approved mail for consumers, who get the body, does not load every
+// raw message at once.
+var approvedColumns = strings.Replace(emailColumns, "body, raw_message", "body, NULL", 1)
+
+// truncatePreview cuts a body selected through summaryColumns to
+// PreviewLength characters and marks the email as truncated if it was longer.
+func truncatePreview(e *Email) {
+	runes := []rune(e.Body)
+	if len(runes) > PreviewLength {
+		e.Body = string(runes[:PreviewLength])
+		e.Truncated = true
+	}
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func (s *Store) scanEmail(row rowScanner) (*Email, error) {
+	var e Email
+	var recipientsJSON string
+	var imapMessageID, imapMailbox, queue, approvedBy, flags, signature, envelope, snippet, inReplyTo, approvals, snoozedBy, tags sql.NullString
+	var approvedAt, scheduledAt, relayedAt, snoozedUntil sql.NullTime
+	var approvalSeq sql.NullInt64
+	var attachments sql.NullBool
+	if err := row.Scan(&e.ID, &e.Direction, &e.Status, &e.Sender, &recipientsJSON, &e.Subject, &e.Body, &e.RawMessage, &e.ReceivedAt,
+		&imapMessageID, &imapMailbox, &queue, &approvedBy, &approvedAt, &approvalSeq, &flags, &signature, &attachments,
+		&envelope, &e.Version, &snippet, &scheduledAt, &relayedAt, &inReplyTo, &approvals, &snoozedUntil, &snoozedBy, &tags); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(recipientsJSON), &e.Recipients); err != nil {
+		return nil, fmt.Errorf("unmarshal recipients: %w", err)
+	}
+	if flags.Valid {
+		if err := json.Unmarshal([]byte(flags.String), &e.Flags); err != nil {
+			return nil, fmt.Errorf("unmarshal flags: %w", err)
+		}
+	}
+	if envelope.Valid {
+		if err := json.Unmarshal([]byte(envelope.String), &e.EnvelopeRecipients); err != nil {
+			return nil, fmt.Errorf("unmarshal envelope recipients: %w", err)
+		}
+	}
+	if tags.Valid && tags.String != "[]" {
+		if err := json.Unmarshal([]byte(tags.String), &e.Tags); err != nil {
+			return nil, fmt.Errorf("unmarshal tags: %w", err)
+		}
+	}
+	if approvals.Valid {
+		if err := json.Unmarshal([]byte(approvals.String), &e.Approvals); err != nil {
+			return nil, fmt.Errorf("unmarshal approvals: %w", err)
+		}
+	}
+	if signature.Valid {
+		e.Signature = &Signature{}
+		if err := json.Unmarshal([]byte(signature.String), e.Signature); err != nil {
+			return nil, fmt.Errorf("unmarshal signature: %w", err)
+		}
+	}
+	e.IMAPMessageID = imapMessageID.String
+	e.IMAPMailbox = imapMailbox.String
+	e.Queue = queue.String
+	e.ApprovedBy = approvedBy.String
+	e.ApprovedAt = approvedAt.Time
+	e.ApprovalSeq = approvalSeq.Int64
+	e.ScheduledAt = scheduledAt.Time
+	e.RelayedAt = relayedAt.Time
+	e.SnoozedUntil = snoozedUntil.Time
+	e.SnoozedBy = snoozedBy.String
+	e.HasAttachment = attachments.Bool
+	e.Snippet = snippet.String
+	e.InReplyTo = inReplyTo.String
+	raw, err := s.unseal(e.RawMessage)
+	if err != nil {
+		return nil, err
+	}
+	e.RawMessage = raw
+	return &e, nil
+}
+
+func (s *Store) scanEmails(rows *sql.Rows) ([]Email, error) {
+	var emails []Email
+	for rows.Next() {
+		e, err := s.scanEmail(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan email: %w", err)
+		}
+		emails = append(emails, *e)
+	}
+	return emails, rows.Err()
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// parseTimestamp parses a TIMESTAMP value returned from an aggregate, where the
+// driver hands back the stored text rather than a time.Time.
+func parseTimestamp(s string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999 -0700 MST", "2006-01-02 15:04:05.999999999-07:00", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
 }
@@ -1,267 +1,2470 @@
 package store
 
 import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
-func newTestStore(t *testing.T) *Store {
-	t.Helper()
-	dbPath := filepath.Join(t.TempDir(), "test.db")
-	st, err := New(dbPath)
-	if err != nil {
-		t.Fatalf("new store: %v", err)
-	}
-	t.Cleanup(func() { st.Close() })
-	return st
+func newTestStore(t *testing.T, driver string) EmailStore {
+	t.Helper()
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	st, err := Open(driver, dbPath, 0)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// forEachDriver runs test against every storage backend, so Memory stays
+// interchangeable with Store.
+func forEachDriver(t *testing.T, test func(t *testing.T, st EmailStore)) {
+	for _, driver := range []string{DriverSQLite, DriverMemory} {
+		t.Run(driver, func(t *testing.T) {
+			test(t, newTestStore(t, driver))
+		})
+	}
+}
+
+func TestSaveOutboundAndGet(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, err := st.SaveOutbound(t.Context(), "alice@example.com", []string{"bob@example.com"}, "Hello", "Hi Bob", []byte("raw message"))
+		if err != nil {
+			t.Fatalf("save outbound: %v", err)
+		}
+		if id == "" {
+			t.Fatal("expected non-empty id")
+		}
+
+		email, err := st.Get(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+
+		if email.ID != id {
+			t.Errorf("id = %q, want %q", email.ID, id)
+		}
+		if email.Direction != DirectionOutbound {
+			t.Errorf("direction = %q, want %q", email.Direction, DirectionOutbound)
+		}
+		if email.Status != StatusPending {
+			t.Errorf("status = %q, want %q", email.Status, StatusPending)
+		}
+		if email.Sender != "alice@example.com" {
+			t.Errorf("sender = %q, want %q", email.Sender, "alice@example.com")
+		}
+		if len(email.Recipients) != 1 || email.Recipients[0] != "bob@example.com" {
+			t.Errorf("recipients = %v, want [bob@example.com]", email.Recipients)
+		}
+		if email.Subject != "Hello" {
+			t.Errorf("subject = %q, want %q", email.Subject, "Hello")
+		}
+		if email.Body != "Hi Bob" {
+			t.Errorf("body = %q, want %q", email.Body, "Hi Bob")
+		}
+		if string(email.RawMessage) != "raw message" {
+			t.Errorf("raw_message = %q, want %q", email.RawMessage, "raw message")
+		}
+		if email.ReceivedAt.IsZero() {
+			t.Error("received_at should not be zero")
+		}
+		if email.IMAPMessageID != "" {
+			t.Errorf("imap_message_id = %q, want empty", email.IMAPMessageID)
+		}
+	})
+}
+
+func TestSaveOutboundBatch(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ids, err := st.SaveOutboundBatch(t.Context(), []Email{
+			{Sender: "a@x.com", Recipients: []string{"b@x.com"}, Subject: "First", Body: "body1", RawMessage: []byte("raw1"), Tags: []string{"zeta", "billing"}},
+			{Sender: "c@x.com", Recipients: []string{"d@x.com"}, Subject: "Second", Body: "body2", RawMessage: []byte("raw2"), Flags: []string{FlagQuotaExceeded}},
+		})
+		if err != nil {
+			t.Fatalf("save batch: %v", err)
+		}
+		if len(ids) != 2 {
+			t.Fatalf("ids = %v, want 2", ids)
+		}
+		first, err := st.Get(t.Context(), ids[0])
+		if err != nil {
+			t.Fatalf("get first: %v", err)
+		}
+		if first.Status != StatusPending || first.Direction != DirectionOutbound || first.Subject != "First" || string(first.RawMessage) != "raw1" {
+			t.Errorf("first = %+v, want the pending outbound email saved", first)
+		}
+		if !slices.Equal(first.Tags, []string{"billing", "zeta"}) || len(first.Flags) != 0 {
+			t.Errorf("first tags, flags = %v, %v, want [billing zeta], none", first.Tags, first.Flags)
+		}
+		second, err := st.Get(t.Context(), ids[1])
+		if err != nil {
+			t.Fatalf("get second: %v", err)
+		}
+		if second.Sender != "c@x.com" || !second.HasFlag(FlagQuotaExceeded) || len(second.Tags) != 0 {
+			t.Errorf("second = %+v, want flagged, untagged", second)
+		}
+	})
+}
+
+func TestSaveInboundAndGet(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, err := st.SaveInbound(t.Context(), "sender@example.com", []string{"me@example.com"}, "Inbound", "body", []byte("raw"),
+			"<msg123@example.com>", "mailescrow/received", "default")
+		if err != nil {
+			t.Fatalf("save inbound: %v", err)
+		}
+
+		email, err := st.Get(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+
+		if email.Direction != DirectionInbound {
+			t.Errorf("direction = %q, want %q", email.Direction, DirectionInbound)
+		}
+		if email.IMAPMessageID != "<msg123@example.com>" {
+			t.Errorf("imap_message_id = %q, want %q", email.IMAPMessageID, "<msg123@example.com>")
+		}
+		if email.IMAPMailbox != "mailescrow/received" {
+			t.Errorf("imap_mailbox = %q, want %q", email.IMAPMailbox, "mailescrow/received")
+		}
+		if email.Queue != "default" {
+			t.Errorf("queue = %q, want default", email.Queue)
+		}
+	})
+}
+
+func TestSaveMultipleRecipients(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		rcpts := []string{"bob@example.com", "carol@example.com", "dave@example.com"}
+		id, err := st.SaveOutbound(t.Context(), "alice@example.com", rcpts, "Group", "Hello all", []byte("raw"))
+		if err != nil {
+			t.Fatalf("save outbound: %v", err)
+		}
+
+		email, err := st.Get(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if len(email.Recipients) != 3 {
+			t.Fatalf("recipients count = %d, want 3", len(email.Recipients))
+		}
+		for i, want := range rcpts {
+			if email.Recipients[i] != want {
+				t.Errorf("recipients[%d] = %q, want %q", i, email.Recipients[i], want)
+			}
+		}
+	})
+}
+
+func TestListPending(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		// Empty list.
+		emails, err := st.ListPending(t.Context())
+		if err != nil {
+			t.Fatalf("list pending: %v", err)
+		}
+		if len(emails) != 0 {
+			t.Fatalf("expected 0 emails, got %d", len(emails))
+		}
+
+		// Save two outbound and one inbound.
+		st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "First", "body1", []byte("raw1"))
+		st.SaveOutbound(t.Context(), "c@x.com", []string{"d@x.com"}, "Second", "body2", []byte("raw2"))
+		id3, _ := st.SaveInbound(t.Context(), "e@x.com", []string{"f@x.com"}, "Third", "body3", []byte("raw3"), "<m3>", "mailescrow/received", "default")
+
+		// Approve the inbound email; it should not show in ListPending.
+		_ = st.Approve(t.Context(), id3, "alice", 0)
+
+		emails, err = st.ListPending(t.Context())
+		if err != nil {
+			t.Fatalf("list pending: %v", err)
+		}
+		if len(emails) != 2 {
+			t.Fatalf("expected 2 pending emails, got %d", len(emails))
+		}
+		if emails[0].Subject != "First" {
+			t.Errorf("first email subject = %q, want %q", emails[0].Subject, "First")
+		}
+		if emails[1].Subject != "Second" {
+			t.Errorf("second email subject = %q, want %q", emails[1].Subject, "Second")
+		}
+	})
+}
+
+func TestAggregateCounts(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		now := time.Now()
+		if n, err := st.CountPending(t.Context()); err != nil || n != 0 {
+			t.Fatalf("count pending on empty store = %d, %v", n, err)
+		}
+		if age, err := st.OldestPendingAge(t.Context(), now); err != nil || age != 0 {
+			t.Fatalf("oldest pending age on empty store = %v, %v", age, err)
+		}
+
+		st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "First", "body1", []byte("raw1"))
+		st.SaveInbound(t.Context(), "e@x.com", []string{"f@x.com"}, "Second", "body2", []byte("raw2"), "<m2>", "mailescrow/received", "default")
+		id3, _ := st.SaveInbound(t.Context(), "g@x.com", []string{"h@x.com"}, "Third", "body3", []byte("raw3"), "<m3>", "mailescrow/received", "default")
+		_ = st.Approve(t.Context(), id3, "alice", 0)
+
+		if n, err := st.CountPending(t.Context()); err != nil || n != 2 {
+			t.Errorf("count pending = %d, %v; want 2", n, err)
+		}
+		counts, err := st.CountByStatus(t.Context())
+		if err != nil {
+			t.Fatalf("count by status: %v", err)
+		}
+		want := []StatusCount{
+			{DirectionInbound, StatusApproved, 1},
+			{DirectionInbound, StatusPending, 1},
+			{DirectionOutbound, StatusPending, 1},
+		}
+		if !slices.Equal(counts, want) {
+			t.Errorf("counts = %+v, want %+v", counts, want)
+		}
+
+		first, _ := st.ListPending(t.Context())
+		later := first[0].ReceivedAt.Add(time.Hour)
+		if age, err := st.OldestPendingAge(t.Context(), later); err != nil || age != time.Hour {
+			t.Errorf("oldest pending age = %v, %v; want 1h", age, err)
+		}
+	})
+}
+
+func TestListPendingPage(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		withAttachment := []byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+			"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\n\r\n%PDF\r\n--b--\r\n")
+		st.SaveOutbound(t.Context(), "carol@x.com", []string{"b@x.com"}, "banana", "1", []byte("raw"))
+		st.SaveInbound(t.Context(), "alice@x.com", []string{"f@x.com"}, "Cherry", "2", withAttachment, "<m2>", "mailescrow/received", "billing")
+		st.SaveOutbound(t.Context(), "Bob@x.com", []string{"b@x.com"}, "apple", "3", withAttachment)
+		id, _ := st.SaveInbound(t.Context(), "dave@x.com", []string{"f@x.com"}, "Approved", "4", []byte("raw"), "<m4>", "mailescrow/received", "billing")
+		_ = st.Approve(t.Context(), id, "alice", 0)
+
+		subjects := func(q PendingQuery) (string, int) {
+			t.Helper()
+			emails, total, err := st.ListPendingPage(t.Context(), q)
+			if err != nil {
+				t.Fatalf("list pending page %+v: %v", q, err)
+			}
+			var got []string
+			for _, e := range emails {
+				if e.RawMessage != nil {
+					t.Errorf("%s: raw message loaded for a page", e.Subject)
+				}
+				got = append(got, e.Subject)
+			}
+			return strings.Join(got, ","), total
+		}
+
+		hourAgo, inAnHour := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+		tests := []struct {
+			q     PendingQuery
+			want  string
+			total int
+		}{
+			{PendingQuery{}, "banana,Cherry,apple", 3},
+			{PendingQuery{Desc: true}, "apple,Cherry,banana", 3},
+			{PendingQuery{Sort: SortSender}, "Cherry,apple,banana", 3},
+			{PendingQuery{Sort: SortSubject, Desc: true}, "Cherry,banana,apple", 3},
+			{PendingQuery{Direction: DirectionOutbound}, "banana,apple", 2},
+			{PendingQuery{Queue: "billing"}, "Cherry", 1},
+			{PendingQuery{HasAttachments: true}, "Cherry,apple", 2},
+			{PendingQuery{Limit: 2}, "banana,Cherry", 3},
+			{PendingQuery{Offset: 2, Limit: 2}, "apple", 3},
+			{PendingQuery{Offset: 5, Limit: 2}, "", 3},
+			{PendingQuery{ReceivedBefore: hourAgo}, "", 0},
+			{PendingQuery{ReceivedBefore: inAnHour, Direction: DirectionInbound}, "Cherry", 1},
+			{PendingQuery{ReceivedAfter: hourAgo}, "banana,Cherry,apple", 3},
+			{PendingQuery{ReceivedAfter: inAnHour}, "", 0},
+			{PendingQuery{Status: StatusApproved}, "Approved", 1},
+			{PendingQuery{Status: StatusScheduled}, "", 0},
+		}
+		for _, tt := range tests {
+			if got, total := subjects(tt.q); got != tt.want || total != tt.total {
+				t.Errorf("%+v: got %q (total %d), want %q (total %d)", tt.q, got, total, tt.want, tt.total)
+			}
+		}
+	})
+}
+
+func TestListPendingSummaries(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		long := strings.Repeat("é", PreviewLength+10)
+		longID, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Long", long, []byte("raw1"))
+		st.SaveOutbound(t.Context(), "c@x.com", []string{"d@x.com"}, "Short", "body2", []byte("raw2"))
+
+		emails, err := st.ListPendingSummaries(t.Context())
+		if err != nil {
+			t.Fatalf("list pending summaries: %v", err)
+		}
+		if len(emails) != 2 {
+			t.Fatalf("expected 2 emails, got %d", len(emails))
+		}
+		if got := emails[0].Body; got != long[:len(long)-10*len("é")] || !emails[0].Truncated {
+			t.Errorf("long preview = %d chars, truncated %v; want %d chars, truncated", len([]rune(got)), emails[0].Truncated, PreviewLength)
+		}
+		if emails[1].Body != "body2" || emails[1].Truncated {
+			t.Errorf("short preview = %q, truncated %v; want full body", emails[1].Body, emails[1].Truncated)
+		}
+		if emails[1].Snippet != "body2" || !strings.HasSuffix(emails[0].Snippet, "…") {
+			t.Errorf("snippets = %q, %q; want them stored at save", emails[0].Snippet, emails[1].Snippet)
+		}
+		for _, e := range emails {
+			if e.RawMessage != nil {
+				t.Errorf("%s: raw message loaded in summary", e.Subject)
+			}
+		}
+
+		e, err := st.GetSummary(t.Context(), longID)
+		if err != nil {
+			t.Fatalf("get summary: %v", err)
+		}
+		if !e.Truncated || e.RawMessage != nil || e.Recipients[0] != "b@x.com" {
+			t.Errorf("summary = %+v", e)
+		}
+		if _, err := st.GetSummary(t.Context(), "nonexistent-id"); err == nil {
+			t.Error("expected error for nonexistent id")
+		}
+	})
+}
+
+func TestListApproved(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id1, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Inbound1", "body1", []byte("raw1"), "<m1>", "mailescrow/received", "default")
+		id2, _ := st.SaveInbound(t.Context(), "c@x.com", []string{"d@x.com"}, "Inbound2", "body2", []byte("raw2"), "<m2>", "mailescrow/received", "default")
+		_, _ = st.SaveOutbound(t.Context(), "e@x.com", []string{"f@x.com"}, "Outbound", "body3", []byte("raw3"))
+
+		// Approve only the first inbound.
+		_ = st.Approve(t.Context(), id1, "alice", 0)
+
+		// Approve the outbound too — it should NOT appear in ListApproved.
+		_ = st.Approve(t.Context(), id2, "alice", 0)
+		_ = st.Approve(t.Context(), id2, "alice", 0) // already approved, may fail silently
+
+		emails, err := st.ListApproved(t.Context(), "", "")
+		if err != nil {
+			t.Fatalf("list approved: %v", err)
+		}
+		// Both inbound emails are approved.
+		if len(emails) != 2 {
+			t.Fatalf("expected 2 approved inbound emails, got %d", len(emails))
+		}
+		for _, e := range emails {
+			if e.Direction != DirectionInbound {
+				t.Errorf("expected inbound, got %q", e.Direction)
+			}
+			if e.Status != StatusApproved {
+				t.Errorf("expected approved, got %q", e.Status)
+			}
+		}
+	})
+}
+
+func TestApprove(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"), "<m>", "mailescrow/received", "default")
+
+		if err := st.Approve(t.Context(), id, "alice", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+
+		email, err := st.Get(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if email.Status != StatusApproved {
+			t.Errorf("status = %q, want approved", email.Status)
+		}
+		if email.ApprovedBy != "alice" {
+			t.Errorf("approved_by = %q, want alice", email.ApprovedBy)
+		}
+		if email.ApprovedAt.IsZero() {
+			t.Error("approved_at should be set")
+		}
+	})
+}
+
+func TestApproveNotFound(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		if err := st.Approve(t.Context(), "nonexistent", "alice", 0); err == nil {
+			t.Fatal("expected error for nonexistent id")
+		}
+	})
+}
+
+func TestApproveAndRejectCompareAndSet(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		id, _ := st.SaveOutbound(ctx, "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"))
+
+		if err := st.Approve(ctx, id, "alice", 1); !errors.Is(err, ErrConflict) {
+			t.Errorf("approve at a stale version = %v, want ErrConflict", err)
+		}
+		if err := st.Approve(ctx, id, "alice", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		if err := st.Approve(ctx, id, "bob", 0); !errors.Is(err, ErrConflict) {
+			t.Errorf("second approve = %v, want ErrConflict", err)
+		}
+		if err := st.Reject(ctx, id, 1); !errors.Is(err, ErrConflict) {
+			t.Errorf("reject of an approved email = %v, want ErrConflict", err)
+		}
+
+		// A failed relay returns the email to review at a new version.
+		if err := st.Unapprove(ctx, id); err != nil {
+			t.Fatalf("unapprove: %v", err)
+		}
+		email, err := st.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if email.Status != StatusPending || email.ApprovedBy != "" || email.Version != 2 {
+			t.Errorf("after unapprove: status %q, approved_by %q, version %d; want pending, none, 2", email.Status, email.ApprovedBy, email.Version)
+		}
+		if err := st.Unapprove(ctx, id); !errors.Is(err, ErrConflict) {
+			t.Errorf("unapprove of a pending email = %v, want ErrConflict", err)
+		}
+
+		if err := st.Reject(ctx, id, 2); err != nil {
+			t.Fatalf("reject: %v", err)
+		}
+		if err := st.Reject(ctx, id, 2); err == nil || errors.Is(err, ErrConflict) {
+			t.Errorf("reject of a deleted email = %v, want not found", err)
+		}
+	})
+}
+
+func TestAddApproval(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		id, _ := st.SaveOutbound(ctx, "a@x.com", []string{"b@agency.gov"}, "Test", "body", []byte("raw"))
+
+		if err := st.AddApproval(ctx, id, Approval{Reviewer: "alice", Reason: "contract signed"}, 1); !errors.Is(err, ErrConflict) {
+			t.Errorf("add approval at a stale version = %v, want ErrConflict", err)
+		}
+		if err := st.AddApproval(ctx, id, Approval{Reviewer: "alice", Reason: "contract signed"}, 0); err != nil {
+			t.Fatalf("add approval: %v", err)
+		}
+		summaries, err := st.ListPendingSummaries(ctx)
+		if err != nil {
+			t.Fatalf("list summaries: %v", err)
+		}
+		if len(summaries) != 1 || summaries[0].Status != StatusPending || summaries[0].Version != 1 {
+			t.Fatalf("after a first approval: %+v, want it pending at version 1", summaries)
+		}
+		if a := summaries[0].Approvals; len(a) != 1 || a[0].Reviewer != "alice" || a[0].Reason != "contract signed" || a[0].At.IsZero() {
+			t.Errorf("approvals = %+v", a)
+		}
+
+		if err := st.Approve(ctx, id, "bob", 1); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		if err := st.AddApproval(ctx, id, Approval{Reviewer: "carol"}, 2); !errors.Is(err, ErrConflict) {
+			t.Errorf("add approval to an approved email = %v, want ErrConflict", err)
+		}
+		email, err := st.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if email.ApprovedBy != "bob" || len(email.Approvals) != 1 {
+			t.Errorf("approved by %q with approvals %+v, want bob after alice", email.ApprovedBy, email.Approvals)
+		}
+	})
+}
+
+func TestSchedule(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		id, _ := st.SaveOutbound(ctx, "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"))
+
+		at := time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC)
+		if err := st.Schedule(ctx, id, at); !errors.Is(err, ErrConflict) {
+			t.Errorf("schedule of a pending email = %v, want ErrConflict", err)
+		}
+		if err := st.Reschedule(ctx, id, at); !errors.Is(err, ErrConflict) {
+			t.Errorf("reschedule of a pending email = %v, want ErrConflict", err)
+		}
+		if err := st.Approve(ctx, id, "alice", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		if err := st.Schedule(ctx, id, at); err != nil {
+			t.Fatalf("schedule: %v", err)
+		}
+
+		email, err := st.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if email.Status != StatusScheduled || !email.ScheduledAt.Equal(at) || email.ApprovedBy != "alice" {
+			t.Errorf("after schedule: status %q, scheduled_at %v, approved_by %q; want scheduled, %v, alice", email.Status, email.ScheduledAt, email.ApprovedBy, at)
+		}
+		if err := st.Schedule(ctx, id, at); !errors.Is(err, ErrConflict) {
+			t.Errorf("second schedule = %v, want ErrConflict", err)
+		}
+		later := at.Add(time.Hour)
+		if err := st.Reschedule(ctx, id, later); err != nil {
+			t.Fatalf("reschedule: %v", err)
+		}
+		if email, _ := st.Get(ctx, id); email.Status != StatusScheduled || !email.ScheduledAt.Equal(later) {
+			t.Errorf("after reschedule: status %q, scheduled_at %v; want scheduled, %v", email.Status, email.ScheduledAt, later)
+		}
+
+		scheduled, err := st.ListScheduled(ctx)
+		if err != nil {
+			t.Fatalf("list scheduled: %v", err)
+		}
+		if len(scheduled) != 1 || scheduled[0].ID != id {
+			t.Errorf("scheduled = %+v, want just %s", scheduled, id)
+		}
+		approved, err := st.ListApproved(ctx, "", "")
+		if err != nil {
+			t.Fatalf("list approved: %v", err)
+		}
+		if len(approved) != 0 {
+			t.Errorf("approved = %d emails, want scheduled mail left out", len(approved))
+		}
+	})
+}
+
+func TestSnooze(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		snoozed, _ := st.SaveOutbound(ctx, "a@x.com", []string{"b@x.com"}, "Snoozed", "body", []byte("raw"))
+		other, _ := st.SaveOutbound(ctx, "a@x.com", []string{"b@x.com"}, "Other", "body", []byte("raw"))
+
+		now := time.Now().UTC()
+		until := now.Add(time.Hour)
+		if err := st.Snooze(ctx, snoozed, "alice", until); err != nil {
+			t.Fatalf("snooze: %v", err)
+		}
+		email, err := st.Get(ctx, snoozed)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if !email.SnoozedUntil.Equal(until) || email.SnoozedBy != "alice" {
+			t.Errorf("after snooze: until %v by %q, want %v by alice", email.SnoozedUntil, email.SnoozedBy, until)
+		}
+
+		page := func(q PendingQuery) []string {
+			t.Helper()
+			emails, _, err := st.ListPendingPage(ctx, q)
+			if err != nil {
+				t.Fatalf("list pending page: %v", err)
+			}
+			var subjects []string
+			for _, e := range emails {
+				subjects = append(subjects, e.Subject)
+			}
+			return subjects
+		}
+		if got := page(PendingQuery{}); len(got) != 2 {
+			t.Errorf("without a snooze filter = %v, want both", got)
+		}
+		if got := page(PendingQuery{SnoozedAt: now}); !slices.Equal(got, []string{"Other"}) {
+			t.Errorf("awake now = %v, want [Other]", got)
+		}
+		if got := page(PendingQuery{SnoozedAt: now, Snoozed: true}); !slices.Equal(got, []string{"Snoozed"}) {
+			t.Errorf("snoozed now = %v, want [Snoozed]", got)
+		}
+		if got := page(PendingQuery{SnoozedAt: until}); len(got) != 2 {
+			t.Errorf("awake once the snooze ends = %v, want both", got)
+		}
+
+		woken, err := st.WakeSnoozed(ctx, now)
+		if err != nil {
+			t.Fatalf("wake before the snooze ends: %v", err)
+		}
+		if len(woken) != 0 {
+			t.Errorf("woken before the snooze ends = %d, want 0", len(woken))
+		}
+		woken, err = st.WakeSnoozed(ctx, until)
+		if err != nil {
+			t.Fatalf("wake: %v", err)
+		}
+		if len(woken) != 1 || woken[0].ID != snoozed || woken[0].SnoozedBy != "alice" {
+			t.Fatalf("woken = %+v, want %s snoozed by alice", woken, snoozed)
+		}
+		if email, _ := st.Get(ctx, snoozed); !email.SnoozedUntil.IsZero() {
+			t.Errorf("snoozed until %v after waking, want zero", email.SnoozedUntil)
+		}
+		if woken, _ := st.WakeSnoozed(ctx, until); len(woken) != 0 {
+			t.Errorf("woken twice: %+v", woken)
+		}
+
+		if err := st.Snooze(ctx, other, "bob", until); err != nil {
+			t.Fatalf("snooze other: %v", err)
+		}
+		if err := st.Unsnooze(ctx, other); err != nil {
+			t.Fatalf("unsnooze: %v", err)
+		}
+		if got := page(PendingQuery{SnoozedAt: now}); len(got) != 2 {
+			t.Errorf("awake after unsnooze = %v, want both", got)
+		}
+		if err := st.Approve(ctx, other, "bob", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		if err := st.Snooze(ctx, other, "bob", until); !errors.Is(err, ErrConflict) {
+			t.Errorf("snooze of an approved email = %v, want ErrConflict", err)
+		}
+		if err := st.Snooze(ctx, "missing", "bob", until); err == nil || errors.Is(err, ErrConflict) {
+			t.Errorf("snooze of a missing email = %v, want not found", err)
+		}
+	})
+}
+
+func TestRelayStates(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		id, _ := st.SaveOutbound(ctx, "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"))
+		status := func() string {
+			t.Helper()
+			email, err := st.Get(ctx, id)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			return email.Status
+		}
+
+		if err := st.BeginRelay(ctx, id); !errors.Is(err, ErrConflict) {
+			t.Errorf("begin relay of a pending email = %v, want ErrConflict", err)
+		}
+		if err := st.Approve(ctx, id, "alice", 0); err != nil {
+			t.Fatalf("approve: %v", err)
+		}
+		if err := st.MarkSent(ctx, id); !errors.Is(err, ErrConflict) {
+			t.Errorf("mark sent of an approved email = %v, want ErrConflict", err)
+		}
+
+		// A refused relay returns the email to where it was.
+		if err := st.BeginRelay(ctx, id); err != nil {
+			t.Fatalf("begin relay: %v", err)
+		}
+		if err := st.BeginRelay(ctx, id); !errors.Is(err, ErrConflict) {
+			t.Errorf("second begin relay = %v, want ErrConflict", err)
+		}
+		if err := st.AbortRelay(ctx, id, StatusApproved); err != nil {
+			t.Fatalf("abort relay: %v", err)
+		}
+		if got := status(); got != StatusApproved {
+			t.Errorf("status after abort = %q, want approved", got)
+		}
+		if err := st.AbortRelay(ctx, id, StatusApproved); !errors.Is(err, ErrConflict) {
+			t.Errorf("abort of an email not relaying = %v, want ErrConflict", err)
+		}
+
+		if err := st.BeginRelay(ctx, id); err != nil {
+			t.Fatalf("begin relay: %v", err)
+		}
+		inFlight, err := st.ListInFlight(ctx)
+		if err != nil || len(inFlight) != 1 || inFlight[0].Status != StatusRelaying {
+			t.Fatalf("in flight = %+v (%v), want the relaying email", inFlight, err)
+		}
+		for range 2 { // marking sent again is a no-op
+			if err := st.MarkSent(ctx, id); err != nil {
+				t.Fatalf("mark sent: %v", err)
+			}
+		}
+		email, err := st.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if email.Status != StatusSent || email.RelayedAt.IsZero() || email.ApprovedBy != "alice" {
+			t.Errorf("after sent: status %q, relayed_at %v, approved_by %q", email.Status, email.RelayedAt, email.ApprovedBy)
+		}
+		if err := st.BeginRelay(ctx, id); !errors.Is(err, ErrConflict) {
+			t.Errorf("begin relay of a sent email = %v, want ErrConflict", err)
+		}
+		if err := st.Unapprove(ctx, id); !errors.Is(err, ErrConflict) {
+			t.Errorf("unapprove of a sent email = %v, want ErrConflict", err)
+		}
+
+		// Scheduled mail can be relayed too; inbound mail never is.
+		scheduled, _ := st.SaveOutbound(ctx, "a@x.com", []string{"b@x.com"}, "Later", "body", []byte("raw"))
+		_ = st.Approve(ctx, scheduled, "alice", 0)
+		_ = st.Schedule(ctx, scheduled, time.Now().Add(time.Hour))
+		if err := st.BeginRelay(ctx, scheduled); err != nil {
+			t.Errorf("begin relay of a scheduled email: %v", err)
+		}
+		inbound, _ := st.SaveInbound(ctx, "c@x.com", []string{"a@x.com"}, "In", "body", []byte("raw"), "", "", "")
+		_ = st.Approve(ctx, inbound, "alice", 0)
+		if err := st.BeginRelay(ctx, inbound); !errors.Is(err, ErrConflict) {
+			t.Errorf("begin relay of inbound mail = %v, want ErrConflict", err)
+		}
+		if inFlight, _ := st.ListInFlight(ctx); len(inFlight) != 2 {
+			t.Errorf("in flight = %d emails, want 2", len(inFlight))
+		}
+	})
+}
+
+func TestLastDecision(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		if d, err := st.LastDecision(ctx, "e1"); err != nil || d != nil {
+			t.Fatalf("LastDecision without decisions = %+v, %v; want nil", d, err)
+		}
+		now := time.Now().UTC()
+		_ = st.RecordDecision(ctx, Decision{EmailID: "e1", Direction: DirectionOutbound, Decision: DecisionApproved, Reviewer: "alice", DecidedAt: now.Add(-time.Minute)})
+		_ = st.RecordDecision(ctx, Decision{EmailID: "e1", Direction: DirectionOutbound, Decision: DecisionRejected, Reviewer: "bob", DecidedAt: now})
+		_ = st.RecordDecision(ctx, Decision{EmailID: "e2", Direction: DirectionOutbound, Decision: DecisionApproved, Reviewer: "carol", DecidedAt: now.Add(time.Minute)})
+
+		d, err := st.LastDecision(ctx, "e1")
+		if err != nil {
+			t.Fatalf("LastDecision: %v", err)
+		}
+		if d == nil || d.Reviewer != "bob" || d.Decision != DecisionRejected {
+			t.Errorf("LastDecision = %+v, want bob's rejection", d)
+		}
+	})
+}
+
+func TestUpdateIMAPMailbox(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"), "<m>", "mailescrow/received", "default")
+
+		if err := st.UpdateIMAPMailbox(t.Context(), id, "mailescrow/approved"); err != nil {
+			t.Fatalf("update imap mailbox: %v", err)
+		}
+
+		email, err := st.Get(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if email.IMAPMailbox != "mailescrow/approved" {
+			t.Errorf("imap_mailbox = %q, want mailescrow/approved", email.IMAPMailbox)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"))
+
+		if err := st.Delete(t.Context(), id); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+
+		_, err := st.Get(t.Context(), id)
+		if err == nil {
+			t.Fatal("expected error after delete, got nil")
+		}
+	})
+}
+
+func TestDeleteNotFound(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		err := st.Delete(t.Context(), "nonexistent-id")
+		if err == nil {
+			t.Fatal("expected error for nonexistent id")
+		}
+	})
+}
+
+func TestGetNotFound(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		_, err := st.Get(t.Context(), "nonexistent-id")
+		if err == nil {
+			t.Fatal("expected error for nonexistent id")
+		}
+	})
+}
+
+func TestSaveGeneratesUniqueIDs(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id1, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test1", "body", []byte("raw"))
+		id2, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test2", "body", []byte("raw"))
+
+		if id1 == id2 {
+			t.Errorf("expected unique IDs, got %q twice", id1)
+		}
+	})
+}
+
+func TestRecordDecisionAndReviewerStats(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		decisions := []Decision{
+			{EmailID: "1", Direction: DirectionOutbound, Decision: DecisionApproved, Reviewer: "alice", Latency: 10 * time.Second},
+			{EmailID: "2", Direction: DirectionInbound, Decision: DecisionRejected, Reviewer: "alice", Latency: 30 * time.Second},
+			{EmailID: "3", Direction: DirectionOutbound, Decision: DecisionApproved, Reviewer: "bob", Latency: time.Minute, Reason: "alice: ok; bob: ok"},
+			{EmailID: "2", Direction: DirectionInbound, Decision: DecisionForwarded, Reviewer: "alice", Latency: time.Hour, ForwardedTo: "ops@x.com"},
+		}
+		for _, d := range decisions {
+			if err := st.RecordDecision(t.Context(), d); err != nil {
+				t.Fatalf("record decision: %v", err)
+			}
+		}
+
+		if d, _ := st.LastDecision(t.Context(), "3"); d == nil || d.Reason != "alice: ok; bob: ok" {
+			t.Errorf("last decision on 3 = %+v, want its reason", d)
+		}
+
+		stats, err := st.ListReviewerStats(t.Context())
+		if err != nil {
+			t.Fatalf("list reviewer stats: %v", err)
+		}
+		if len(stats) != 2 {
+			t.Fatalf("expected 2 reviewers, got %d", len(stats))
+		}
+
+		alice := stats[0]
+		if alice.Reviewer != "alice" {
+			t.Fatalf("first reviewer = %q, want alice", alice.Reviewer)
+		}
+		if alice.Approved != 1 || alice.Rejected != 1 {
+			t.Errorf("alice approved/rejected = %d/%d, want 1/1", alice.Approved, alice.Rejected)
+		}
+		if alice.AverageLatency != 20*time.Second {
+			t.Errorf("alice avg latency = %v, want 20s", alice.AverageLatency)
+		}
+		if alice.MaxLatency != 30*time.Second {
+			t.Errorf("alice max latency = %v, want 30s", alice.MaxLatency)
+		}
+		if alice.LastDecisionAt.IsZero() {
+			t.Error("alice last decision should not be zero")
+		}
+		if stats[1].Reviewer != "bob" || stats[1].Approved != 1 {
+			t.Errorf("bob stats = %+v, want 1 approval", stats[1])
+		}
+	})
+}
+
+func TestMigrateAddsColumnsToExistingDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+
+	// Create a database with the original emails schema.
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE emails (
+		id TEXT PRIMARY KEY, direction TEXT NOT NULL, status TEXT NOT NULL, sender TEXT NOT NULL,
+		recipients TEXT NOT NULL, subject TEXT NOT NULL, body TEXT NOT NULL, raw_message BLOB NOT NULL,
+		received_at TIMESTAMP NOT NULL, imap_message_id TEXT, imap_mailbox TEXT)`); err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	withAttachment := "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\n\r\n%PDF\r\n--b--\r\n"
+	for _, row := range []struct{ id, raw string }{{"plain", "Subject: hi\r\n\r\nhello\r\n"}, {"attached", withAttachment}} {
+		if _, err := db.Exec(`INSERT INTO emails VALUES (?, 'outbound', 'pending', 'a@x.com', '["b@x.com"]', 'Old', 'body', ?, ?, NULL, NULL)`,
+			row.id, []byte(row.raw), time.Now().UTC()); err != nil {
+			t.Fatalf("insert old email: %v", err)
+		}
+	}
+	db.Close()
+
+	st, err := New(dbPath)
+	if err != nil {
+		t.Fatalf("new store on old schema: %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	// Mail stored before has_attachments existed is found by the filter.
+	attached, total, err := st.ListPendingPage(t.Context(), PendingQuery{HasAttachments: true})
+	if err != nil {
+		t.Fatalf("list with attachments: %v", err)
+	}
+	if total != 1 || len(attached) != 1 || attached[0].ID != "attached" {
+		t.Errorf("with attachments = %v (total %d), want only the old email with one", attached, total)
+	}
+
+	id, err := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Old", "body", []byte("raw"), "<m>", "mailescrow/received", "default")
+	if err != nil {
+		t.Fatalf("save inbound: %v", err)
+	}
+	if err := st.Approve(t.Context(), id, "bob", 0); err != nil {
+		t.Fatalf("approve after migration: %v", err)
+	}
+}
+
+func TestListApprovedByQueue(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		idSupport, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"support@x.com"}, "Help", "body", []byte("raw"), "<m1>", "mailescrow/received", "support")
+		idBilling, _ := st.SaveInbound(t.Context(), "b@x.com", []string{"billing@x.com"}, "Invoice", "body", []byte("raw"), "<m2>", "mailescrow/received", "billing")
+		_ = st.Approve(t.Context(), idSupport, "alice", 0)
+		_ = st.Approve(t.Context(), idBilling, "alice", 0)
+
+		support, err := st.ListApproved(t.Context(), "support", "")
+		if err != nil {
+			t.Fatalf("list approved: %v", err)
+		}
+		if len(support) != 1 || support[0].ID != idSupport {
+			t.Errorf("support queue = %v, want only %s", support, idSupport)
+		}
+
+		all, err := st.ListApproved(t.Context(), "", "")
+		if err != nil {
+			t.Fatalf("list approved: %v", err)
+		}
+		if len(all) != 2 {
+			t.Errorf("all queues returned %d emails, want 2", len(all))
+		}
+	})
+}
+
+func TestListApprovedAfterCheckpoint(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		first, _ := st.SaveInbound(ctx, "a@x.com", []string{"support@x.com"}, "First", "body", []byte("raw"), "<m1>", "mailescrow/received", "support")
+		second, _ := st.SaveInbound(ctx, "b@x.com", []string{"billing@x.com"}, "Second", "body", []byte("raw"), "<m2>", "mailescrow/received", "billing")
+		_ = st.Approve(ctx, second, "alice", 0)
+		_ = st.Approve(ctx, first, "alice", 0)
+
+		// In the order they were approved, not received.
+		all, err := st.ListApprovedAfter(ctx, "", 0)
+		if err != nil {
+			t.Fatalf("list approved after: %v", err)
+		}
+		if len(all) != 2 || all[0].ID != second || all[1].ID != first || all[0].ApprovalSeq >= all[1].ApprovalSeq {
+			t.Fatalf("approved after 0 = %+v, want %s then %s", all, second, first)
+		}
+		if support, _ := st.ListApprovedAfter(ctx, "support", 0); len(support) != 1 || support[0].ID != first {
+			t.Errorf("support queue = %+v, want only %s", support, first)
+		}
+		if rest, _ := st.ListApprovedAfter(ctx, "", all[0].ApprovalSeq); len(rest) != 1 || rest[0].ID != first {
+			t.Errorf("approved after the first approval = %+v, want only %s", rest, first)
+		}
+
+		if pos, err := st.GetCheckpoint(ctx, "tok1", ""); err != nil || pos != 0 {
+			t.Errorf("unsaved checkpoint = %d, %v, want 0", pos, err)
+		}
+		if err := st.SaveCheckpoint(ctx, "tok1", "", all[1].ApprovalSeq); err != nil {
+			t.Fatalf("save checkpoint: %v", err)
+		}
+		if err := st.SaveCheckpoint(ctx, "tok1", "", all[0].ApprovalSeq); err != nil {
+			t.Fatalf("save checkpoint: %v", err)
+		}
+		if pos, _ := st.GetCheckpoint(ctx, "tok1", ""); pos != all[1].ApprovalSeq {
+			t.Errorf("checkpoint = %d, want %d: it never moves back", pos, all[1].ApprovalSeq)
+		}
+		if pos, _ := st.GetCheckpoint(ctx, "tok1", "support"); pos != 0 {
+			t.Errorf("support checkpoint = %d, want 0: each queue has its own", pos)
+		}
+
+		// Mail approved once the mail a checkpoint was saved at is gone is
+		// still after it.
+		_ = st.Delete(ctx, first)
+		_ = st.Delete(ctx, second)
+		third, _ := st.SaveInbound(ctx, "c@x.com", []string{"support@x.com"}, "Third", "body", []byte("raw"), "<m3>", "mailescrow/received", "support")
+		_ = st.Approve(ctx, third, "alice", 0)
+		if rest, _ := st.ListApprovedAfter(ctx, "", all[1].ApprovalSeq); len(rest) != 1 || rest[0].ID != third {
+			t.Errorf("approved after the checkpoint = %+v, want only %s", rest, third)
+		}
+	})
+}
+
+func TestListDecisions(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		base := time.Now().UTC()
+		for i, subject := range []string{"First", "Second", "Third"} {
+			if err := st.RecordDecision(t.Context(), Decision{
+				EmailID: subject, Direction: DirectionOutbound, Sender: "a@x.com", Subject: subject,
+				Decision: DecisionApproved, Reviewer: "alice", Latency: time.Second,
+				DecidedAt: base.Add(time.Duration(i) * time.Minute),
+			}); err != nil {
+				t.Fatalf("record decision: %v", err)
+			}
+		}
+
+		decisions, err := st.ListDecisions(t.Context(), 2)
+		if err != nil {
+			t.Fatalf("list decisions: %v", err)
+		}
+		if len(decisions) != 2 {
+			t.Fatalf("expected 2 decisions, got %d", len(decisions))
+		}
+		if decisions[0].Subject != "Third" || decisions[1].Subject != "Second" {
+			t.Errorf("decisions = %q, %q; want newest first", decisions[0].Subject, decisions[1].Subject)
+		}
+		if decisions[0].Sender != "a@x.com" || decisions[0].Latency != time.Second {
+			t.Errorf("decision = %+v, want sender and latency preserved", decisions[0])
+		}
+
+		if err := st.RecordDecision(t.Context(), Decision{
+			EmailID: "Third", Direction: DirectionInbound, Decision: DecisionForwarded, Reviewer: "alice", ForwardedTo: "ops@x.com",
+			DecidedAt: base.Add(time.Hour),
+		}); err != nil {
+			t.Fatalf("record forward: %v", err)
+		}
+		last, err := st.LastDecision(t.Context(), "Third")
+		if err != nil || last == nil || last.Decision != DecisionForwarded || last.ForwardedTo != "ops@x.com" {
+			t.Errorf("last decision = %+v, %v, want the forward to ops@x.com", last, err)
+		}
+	})
+}
+
+func TestListDecisionPage(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		base := time.Now().UTC()
+		for i, d := range []Decision{
+			{EmailID: "sent", Direction: DirectionOutbound, Decision: DecisionApproved, EnvelopeID: "env-1"},
+			{EmailID: "bounced", Direction: DirectionOutbound, Decision: DecisionApproved, EnvelopeID: "env-2"},
+			{EmailID: "rejected", Direction: DirectionInbound, Decision: DecisionRejected},
+			{EmailID: "fetched", Direction: DirectionInbound, Decision: DecisionApproved},
+			{EmailID: "unsent", Direction: DirectionOutbound, Decision: DecisionRejected},
+		} {
+			d.Reviewer, d.DecidedAt = "alice", base.Add(time.Duration(i)*time.Minute)
+			if err := st.RecordDecision(t.Context(), d); err != nil {
+				t.Fatalf("record decision: %v", err)
+			}
+		}
+		if err := st.UpdateDelivery(t.Context(), "env-2", DeliveryFailed, ""); err != nil {
+			t.Fatalf("update delivery: %v", err)
+		}
+
+		tests := []struct {
+			q     DecisionQuery
+			want  string
+			total int
+		}{
+			{DecisionQuery{}, "unsent,fetched,rejected,bounced,sent", 5},
+			{DecisionQuery{Offset: 1, Limit: 2}, "fetched,rejected", 5},
+			{DecisionQuery{Outcome: OutcomeRejected}, "unsent,rejected", 2},
+			{DecisionQuery{Outcome: OutcomeSent}, "sent", 1},
+			{DecisionQuery{Outcome: OutcomeBounced}, "bounced", 1},
+		}
+		for _, tt := range tests {
+			decisions, total, err := st.ListDecisionPage(t.Context(), tt.q)
+			if err != nil {
+				t.Fatalf("list decision page %+v: %v", tt.q, err)
+			}
+			var ids []string
+			for _, d := range decisions {
+				ids = append(ids, d.EmailID)
+			}
+			if got := strings.Join(ids, ","); got != tt.want || total != tt.total {
+				t.Errorf("%+v: got %q (total %d), want %q (total %d)", tt.q, got, total, tt.want, tt.total)
+			}
+		}
+		if _, _, err := st.ListDecisionPage(t.Context(), DecisionQuery{Outcome: "lost"}); err == nil {
+			t.Error("expected error for an unknown outcome")
+		}
+	})
+}
+
+func TestUpdateDelivery(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		for _, d := range []Decision{
+			{EmailID: "e1", Direction: DirectionOutbound, Decision: DecisionApproved, Reviewer: "alice", EnvelopeID: "env-1"},
+			{EmailID: "e2", Direction: DirectionOutbound, Decision: DecisionApproved, Reviewer: "alice"},
+		} {
+			if err := st.RecordDecision(t.Context(), d); err != nil {
+				t.Fatalf("record decision: %v", err)
+			}
+		}
+		decisions, _ := st.ListDecisions(t.Context(), 10)
+		if len(decisions) != 2 {
+			t.Fatalf("decisions = %d, want 2", len(decisions))
+		}
+		if d := decisions[1]; d.EnvelopeID != "env-1" || d.DeliveryStatus != DeliveryRequested {
+			t.Errorf("relayed decision = %+v, want envelope env-1, status requested", d)
+		}
+		if d := decisions[0]; d.EnvelopeID != "" || d.DeliveryStatus != "" {
+			t.Errorf("decision without DSN = %+v, want no delivery status", d)
+		}
+
+		if err := st.UpdateDelivery(t.Context(), "env-1", DeliveryFailed, "b@x.com failed (5.1.1)"); err != nil {
+			t.Fatalf("update delivery: %v", err)
+		}
+		decisions, _ = st.ListDecisions(t.Context(), 10)
+		if d := decisions[1]; d.DeliveryStatus != DeliveryFailed || d.DeliveryDetail != "b@x.com failed (5.1.1)" {
+			t.Errorf("after DSN = %+v, want failed with detail", d)
+		}
+
+		if err := st.UpdateDelivery(t.Context(), "unknown", DeliveryDelivered, ""); err == nil {
+			t.Error("expected error for an unknown envelope ID")
+		}
+	})
+}
+
+func TestAddFlag(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "S", "B", []byte("raw"))
+
+		for range 2 {
+			if err := st.AddFlag(t.Context(), id, FlagQuotaExceeded); err != nil {
+				t.Fatalf("add flag: %v", err)
+			}
+		}
+		email, err := st.Get(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if len(email.Flags) != 1 || !email.HasFlag(FlagQuotaExceeded) {
+			t.Errorf("flags = %v, want [%s]", email.Flags, FlagQuotaExceeded)
+		}
+
+		if err := st.AddFlag(t.Context(), "nonexistent", FlagQuotaExceeded); err == nil {
+			t.Error("expected error for nonexistent email")
+		}
+	})
+}
+
+func TestSetSignature(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "S", "B", []byte("raw"), "<m1>", "mailescrow/received", "default")
+
+		email, _ := st.Get(t.Context(), id)
+		if email.Signature != nil {
+			t.Fatalf("signature = %+v before verification, want nil", email.Signature)
+		}
+
+		want := Signature{Protocol: SignaturePGP, Status: SignatureValid, Signer: "A <a@x.com>"}
+		if err := st.SetSignature(t.Context(), id, want); err != nil {
+			t.Fatalf("set signature: %v", err)
+		}
+		email, err := st.GetSummary(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get summary: %v", err)
+		}
+		if email.Signature == nil || *email.Signature != want {
+			t.Errorf("signature = %+v, want %+v", email.Signature, want)
+		}
+
+		if err := st.SetSignature(t.Context(), "nonexistent", want); err == nil {
+			t.Error("expected error for nonexistent email")
+		}
+	})
+}
+
+func TestSetEnvelopeRecipients(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		id, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"list@x.com"}, "S", "B", []byte("raw"), "<m1>", "mailescrow/received", "default")
+
+		email, _ := st.Get(t.Context(), id)
+		if email.EnvelopeRecipients != nil {
+			t.Fatalf("envelope recipients = %v before parsing, want nil", email.EnvelopeRecipients)
+		}
+
+		if err := st.SetEnvelopeRecipients(t.Context(), id, []string{"sales@x.com"}); err != nil {
+			t.Fatalf("set envelope recipients: %v", err)
+		}
+		email, err := st.GetSummary(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get summary: %v", err)
+		}
+		if !slices.Equal(email.EnvelopeRecipients, []string{"sales@x.com"}) {
+			t.Errorf("envelope recipients = %v, want [sales@x.com]", email.EnvelopeRecipients)
+		}
+		if !slices.Equal(email.Recipients, []string{"list@x.com"}) {
+			t.Errorf("recipients = %v, want the To header unchanged", email.Recipients)
+		}
+
+		if err := st.SetEnvelopeRecipients(t.Context(), "nonexistent", []string{"sales@x.com"}); err == nil {
+			t.Error("expected error for nonexistent email")
+		}
+	})
+}
+
+func TestTags(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		invoice, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Invoice", "B", []byte("raw"), "<m1>", "mailescrow/received", "default")
+		other, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Other", "B", []byte("raw"))
+
+		for _, tag := range []string{"urgent", "invoice", "invoice"} {
+			if err := st.AddTag(t.Context(), invoice, tag); err != nil {
+				t.Fatalf("add tag %s: %v", tag, err)
+			}
+		}
+		email, err := st.GetSummary(t.Context(), invoice)
+		if err != nil {
+			t.Fatalf("get summary: %v", err)
+		}
+		if want := []string{"invoice", "urgent"}; !slices.Equal(email.Tags, want) {
+			t.Errorf("tags = %v, want %v", email.Tags, want)
+		}
+		if email, _ := st.Get(t.Context(), other); email.Tags != nil {
+			t.Errorf("untagged email has tags %v", email.Tags)
+		}
+
+		page, total, err := st.ListPendingPage(t.Context(), PendingQuery{Tag: "invoice"})
+		if err != nil {
+			t.Fatalf("list pending page: %v", err)
+		}
+		if total != 1 || len(page) != 1 || page[0].ID != invoice {
+			t.Errorf("tag filter returned %d of %d, want only %s", len(page), total, invoice)
+		}
+		tags, err := st.ListTags(t.Context())
+		if err != nil {
+			t.Fatalf("list tags: %v", err)
+		}
+		if want := []string{"invoice", "urgent"}; !slices.Equal(tags, want) {
+			t.Errorf("list tags = %v, want %v", tags, want)
+		}
+
+		if u, err := st.TagUsage(t.Context(), "invoice"); err != nil || u != (TagUsage{Pending: 1, Bytes: 3}) {
+			t.Errorf("tag usage = %+v, %v; want one pending email of 3 bytes", u, err)
+		}
+
+		_ = st.Approve(t.Context(), invoice, "alice", 0)
+		if u, _ := st.TagUsage(t.Context(), "invoice"); u != (TagUsage{Bytes: 3}) {
+			t.Errorf("tag usage after approval = %+v, want none pending, the bytes still stored", u)
+		}
+		if approved, _ := st.ListApproved(t.Context(), "", "invoice"); len(approved) != 1 {
+			t.Errorf("approved with tag = %d emails, want 1", len(approved))
+		}
+		if approved, _ := st.ListApproved(t.Context(), "", "marketing"); len(approved) != 0 {
+			t.Errorf("approved with unused tag = %d emails, want 0", len(approved))
+		}
+
+		if err := st.RemoveTag(t.Context(), invoice, "urgent"); err != nil {
+			t.Fatalf("remove tag: %v", err)
+		}
+		if email, _ := st.Get(t.Context(), invoice); !slices.Equal(email.Tags, []string{"invoice"}) {
+			t.Errorf("tags after removal = %v, want [invoice]", email.Tags)
+		}
+
+		if err := st.Delete(t.Context(), invoice); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if tags, _ := st.ListTags(t.Context()); len(tags) != 0 {
+			t.Errorf("tags of deleted email still listed: %v", tags)
+		}
+
+		if err := st.AddTag(t.Context(), "nonexistent", "invoice"); err == nil {
+			t.Error("expected error adding a tag to a nonexistent email")
+		}
+		if err := st.RemoveTag(t.Context(), "nonexistent", "invoice"); err == nil {
+			t.Error("expected error removing a tag from a nonexistent email")
+		}
+	})
+}
+
+func TestNormalizeTag(t *testing.T) {
+	for in, want := range map[string]string{"Invoice": "invoice", " follow-up ": "follow-up", "q3.report_2": "q3.report_2"} {
+		if got, err := NormalizeTag(in); err != nil || got != want {
+			t.Errorf("NormalizeTag(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "  ", "-lead", "two words", "café", strings.Repeat("a", MaxTagLength+1)} {
+		if _, err := NormalizeTag(in); err == nil {
+			t.Errorf("NormalizeTag(%q): expected error", in)
+		}
+	}
+}
+
+func TestQuotaCounters(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		hour := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+		for want := 1; want <= 3; want++ {
+			got, err := st.IncrementQuota(t.Context(), "a@x.com", QuotaPeriodHour, hour)
+			if err != nil {
+				t.Fatalf("increment: %v", err)
+			}
+			if got != want {
+				t.Errorf("count = %d, want %d", got, want)
+			}
+		}
+		if n, _ := st.IncrementQuota(t.Context(), "a@x.com", QuotaPeriodHour, hour.Add(time.Hour)); n != 1 {
+			t.Errorf("next window count = %d, want 1", n)
+		}
+		if n, _ := st.IncrementQuota(t.Context(), "b@x.com", QuotaPeriodHour, hour); n != 1 {
+			t.Errorf("other sender count = %d, want 1", n)
+		}
+
+		if err := st.DecrementQuota(t.Context(), "b@x.com", QuotaPeriodHour, hour); err != nil {
+			t.Fatalf("decrement: %v", err)
+		}
+		_ = st.DecrementQuota(t.Context(), "b@x.com", QuotaPeriodHour, hour)
+		if n, _ := st.IncrementQuota(t.Context(), "b@x.com", QuotaPeriodHour, hour); n != 1 {
+			t.Errorf("count after decrementing below zero = %d, want 1", n)
+		}
+
+		usage, err := st.ListQuotaUsage(t.Context(), hour.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("list usage: %v", err)
+		}
+		if len(usage) != 1 || usage[0].Sender != "a@x.com" || usage[0].Count != 1 || !usage[0].WindowStart.Equal(hour.Add(time.Hour)) {
+			t.Errorf("usage = %+v, want a@x.com 1 in the second window", usage)
+		}
+
+		if err := st.PruneQuota(t.Context(), hour.Add(time.Hour)); err != nil {
+			t.Fatalf("prune: %v", err)
+		}
+		usage, _ = st.ListQuotaUsage(t.Context(), time.Time{})
+		if len(usage) != 1 {
+			t.Errorf("after prune usage = %+v, want only the second window", usage)
+		}
+	})
+}
+
+func TestContacts(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		if err := st.RecordContacts(t.Context(), DirectionOutbound, []string{"Bob@Example.com", "carol@example.com"}); err != nil {
+			t.Fatalf("record contacts: %v", err)
+		}
+		if err := st.RecordContacts(t.Context(), DirectionOutbound, []string{"bob@example.com"}); err != nil {
+			t.Fatalf("record contacts: %v", err)
+		}
+
+		counts, err := st.ContactCounts(t.Context(), DirectionOutbound, []string{"BOB@example.com", "carol@example.com", "dave@example.com"})
+		if err != nil {
+			t.Fatalf("contact counts: %v", err)
+		}
+		if counts["bob@example.com"] != 2 || counts["carol@example.com"] != 1 || counts["dave@example.com"] != 0 {
+			t.Errorf("counts = %v, want bob 2, carol 1, dave 0", counts)
+		}
+
+		// Contacts are tracked per direction.
+		counts, _ = st.ContactCounts(t.Context(), DirectionInbound, []string{"bob@example.com"})
+		if counts["bob@example.com"] != 0 {
+			t.Errorf("inbound count = %d, want 0", counts["bob@example.com"])
+		}
+	})
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		created := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+
+		if k, err := st.GetIdempotencyKey(t.Context(), "retry-1", time.Time{}); err != nil || k != nil {
+			t.Fatalf("unknown key = %+v, %v; want nil", k, err)
+		}
+		want := IdempotencyKey{Key: "retry-1", RequestHash: "abc", EmailID: "e1", Status: StatusPending, CreatedAt: created}
+		if err := st.SaveIdempotencyKey(t.Context(), want); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		got, err := st.GetIdempotencyKey(t.Context(), "retry-1", created)
+		if err != nil || got == nil || *got != want {
+			t.Fatalf("key = %+v, %v; want %+v", got, err, want)
+		}
+		if got, _ := st.GetIdempotencyKey(t.Context(), "retry-1", created.Add(time.Second)); got != nil {
+			t.Errorf("expired key = %+v, want nil", got)
+		}
+
+		// Saving an expired key again replaces it.
+		if err := st.SaveIdempotencyKey(t.Context(), IdempotencyKey{Key: "retry-1", RequestHash: "def", EmailID: "e2", Status: StatusPending, CreatedAt: created.Add(time.Hour)}); err != nil {
+			t.Fatalf("resave: %v", err)
+		}
+		if got, _ := st.GetIdempotencyKey(t.Context(), "retry-1", created); got == nil || got.EmailID != "e2" {
+			t.Errorf("replaced key = %+v, want e2", got)
+		}
+
+		if err := st.PruneIdempotencyKeys(t.Context(), created.Add(2*time.Hour)); err != nil {
+			t.Fatalf("prune: %v", err)
+		}
+		if got, _ := st.GetIdempotencyKey(t.Context(), "retry-1", time.Time{}); got != nil {
+			t.Errorf("after prune key = %+v, want nil", got)
+		}
+	})
+}
+
+func TestAPITokens(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		expires := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+
+		id, err := st.CreateAPIToken(t.Context(), APIToken{Name: "agent", Hash: "h1", Scopes: []string{"send", "read"}, Project: "billing", CreatedBy: "alice", ExpiresAt: expires})
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := st.CreateAPIToken(t.Context(), APIToken{Name: "dup", Hash: "h1", Scopes: []string{"read"}, CreatedBy: "alice"}); err == nil {
+			t.Error("expected error for duplicate hash")
+		}
+
+		tok, err := st.GetAPITokenByHash(t.Context(), "h1")
+		if err != nil || tok == nil {
+			t.Fatalf("get by hash = %+v, %v", tok, err)
+		}
+		if tok.ID != id || tok.Name != "agent" || len(tok.Scopes) != 2 || tok.Project != "billing" || !tok.ExpiresAt.Equal(expires) || !tok.LastUsedAt.IsZero() || !tok.RevokedAt.IsZero() {
+			t.Errorf("token = %+v", tok)
+		}
+		if tok, _ := st.GetAPITokenByHash(t.Context(), "unknown"); tok != nil {
+			t.Errorf("unknown hash = %+v, want nil", tok)
+		}
+
+		used := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+		if err := st.TouchAPIToken(t.Context(), id, used); err != nil {
+			t.Fatalf("touch: %v", err)
+		}
+		if err := st.RevokeAPIToken(t.Context(), id); err != nil {
+			t.Fatalf("revoke: %v", err)
+		}
+		if err := st.RevokeAPIToken(t.Context(), id); err == nil {
+			t.Error("expected error revoking twice")
+		}
+		tokens, err := st.ListAPITokens(t.Context())
+		if err != nil || len(tokens) != 1 {
+			t.Fatalf("list = %+v, %v", tokens, err)
+		}
+		if !tokens[0].LastUsedAt.Equal(used) || tokens[0].RevokedAt.IsZero() {
+			t.Errorf("listed token = %+v, want last used and revoked", tokens[0])
+		}
+	})
+}
+
+func TestShareLinks(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		emailID, err := st.SaveInbound(t.Context(), "a@example.com", []string{"b@example.com"}, "s", "b", []byte("raw"), "", "", "")
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		expires := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+		id, err := st.CreateShareLink(t.Context(), ShareLink{EmailID: emailID, Hash: "h1", CreatedBy: "alice", ExpiresAt: expires})
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := st.CreateShareLink(t.Context(), ShareLink{EmailID: emailID, Hash: "h1", CreatedBy: "alice", ExpiresAt: expires}); err == nil {
+			t.Error("expected error for duplicate hash")
+		}
+
+		l, err := st.GetShareLinkByHash(t.Context(), "h1")
+		if err != nil || l == nil {
+			t.Fatalf("get by hash = %+v, %v", l, err)
+		}
+		if l.ID != id || l.EmailID != emailID || l.CreatedBy != "alice" || !l.ExpiresAt.Equal(expires) || !l.RevokedAt.IsZero() {
+			t.Errorf("link = %+v", l)
+		}
+		if l, _ := st.GetShareLinkByHash(t.Context(), "unknown"); l != nil {
+			t.Errorf("unknown hash = %+v, want nil", l)
+		}
+
+		if err := st.RevokeShareLink(t.Context(), id); err != nil {
+			t.Fatalf("revoke: %v", err)
+		}
+		if err := st.RevokeShareLink(t.Context(), id); err == nil {
+			t.Error("expected error revoking twice")
+		}
+		links, err := st.ListShareLinks(t.Context(), emailID)
+		if err != nil || len(links) != 1 || links[0].RevokedAt.IsZero() {
+			t.Fatalf("list = %+v, %v; want one revoked link", links, err)
+		}
+		if links, _ := st.ListShareLinks(t.Context(), "other"); len(links) != 0 {
+			t.Errorf("links of another email = %+v, want none", links)
+		}
+
+		// Links go with their email.
+		if err := st.Delete(t.Context(), emailID); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if l, _ := st.GetShareLinkByHash(t.Context(), "h1"); l != nil {
+			t.Errorf("link of deleted email = %+v, want nil", l)
+		}
+	})
+}
+
+func TestAnnotations(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		emailID, err := st.SaveInbound(ctx, "a@example.com", []string{"b@example.com"}, "s", "b", []byte("raw"), "", "", "")
+		if err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		first, err := st.AddAnnotation(ctx, Annotation{
+			EmailID: emailID, Source: "scanner", Kind: "phishing", Severity: SeverityCritical, Score: 0.97,
+			Summary: "Credential harvesting page", Findings: []string{"https://login.example.net"}, CreatedBy: "token:scanner",
+			CreatedAt: time.Now().Add(-time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		if _, err := st.AddAnnotation(ctx, Annotation{EmailID: emailID, Source: "dlp", Kind: "dlp", Severity: SeverityInfo, Summary: "Clean"}); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		if _, err := st.AddAnnotation(ctx, Annotation{EmailID: "missing", Source: "dlp", Kind: "dlp", Severity: SeverityInfo}); err == nil {
+			t.Error("expected error annotating a missing email")
+		}
+
+		list, err := st.ListAnnotations(ctx, emailID)
+		if err != nil || len(list) != 2 {
+			t.Fatalf("list = %d (%v), want 2", len(list), err)
+		}
+		if a := list[0]; a.ID != first || a.Severity != SeverityCritical || a.Score != 0.97 || !slices.Equal(a.Findings, []string{"https://login.example.net"}) || a.CreatedBy != "token:scanner" {
+			t.Errorf("oldest annotation = %+v", a)
+		}
+		if a := list[1]; a.Kind != "dlp" || len(a.Findings) != 0 {
+			t.Errorf("newest annotation = %+v", a)
+		}
+
+		// Annotations go with their email.
+		if err := st.Delete(ctx, emailID); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if list, _ := st.ListAnnotations(ctx, emailID); len(list) != 0 {
+			t.Errorf("annotations of deleted email = %d, want 0", len(list))
+		}
+	})
+}
+
+func TestTrackedLinks(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		links := []TrackedLink{
+			{ID: "a1", EmailID: "a", Subject: "Welcome", URL: "https://example.com/start", CreatedAt: base},
+			{ID: "a2", EmailID: "a", Subject: "Welcome", URL: "https://example.com/help", CreatedAt: base},
+			{ID: "b1", EmailID: "b", Subject: "Invoice", URL: "https://example.com/pay", CreatedAt: base.Add(time.Hour)},
+		}
+		if err := st.TrackLinks(ctx, links); err != nil {
+			t.Fatalf("track: %v", err)
+		}
+		if _, err := st.ClickLink(ctx, "a1", base.Add(time.Minute)); err != nil {
+			t.Fatalf("click: %v", err)
+		}
+		l, err := st.ClickLink(ctx, "a1", base.Add(2*time.Minute))
+		if err != nil {
+			t.Fatalf("click: %v", err)
+		}
+		if l == nil || l.URL != "https://example.com/start" || l.Clicks != 2 || !l.LastClickAt.Equal(base.Add(2*time.Minute)) {
+			t.Errorf("clicked link = %+v", l)
+		}
+		if l, err := st.ClickLink(ctx, "missing", base); err != nil || l != nil {
+			t.Errorf("click unknown link = %+v, %v; want nil", l, err)
+		}
+
+		// Tracking the same links again keeps their clicks.
+		if err := st.TrackLinks(ctx, links[:1]); err != nil {
+			t.Fatalf("track again: %v", err)
+		}
+		stats, err := st.ListClickStats(ctx, 10)
+		if err != nil || len(stats) != 2 {
+			t.Fatalf("stats = %+v (%v), want 2 emails", stats, err)
+		}
+		if cs := stats[0]; cs.EmailID != "a" || cs.Subject != "Welcome" || cs.Links != 2 || cs.Clicks != 2 || !cs.LastClickAt.Equal(base.Add(2*time.Minute)) {
+			t.Errorf("most clicked = %+v", cs)
+		}
+		if cs := stats[1]; cs.EmailID != "b" || cs.Links != 1 || cs.Clicks != 0 || !cs.LastClickAt.IsZero() {
+			t.Errorf("unclicked = %+v", cs)
+		}
+		if stats, _ := st.ListClickStats(ctx, 1); len(stats) != 1 {
+			t.Errorf("limited stats = %d, want 1", len(stats))
+		}
+	})
+}
+
+func TestUnsubscribeLinks(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		links := []UnsubscribeLink{
+			{ID: "a1", Address: "Bob@Example.org", EmailID: "a", Subject: "Spring sale", CreatedAt: base},
+			{ID: "b1", Address: "bob@example.org", EmailID: "b", Subject: "Summer sale", CreatedAt: base.Add(time.Hour)},
+			{ID: "c1", Address: "carol@example.org", EmailID: "c", Subject: "Summer sale", CreatedAt: base.Add(time.Hour)},
+		}
+		if err := st.AddUnsubscribeLinks(ctx, links); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		if out, err := st.OptedOut(ctx, []string{"bob@example.org"}); err != nil || len(out) != 0 {
+			t.Errorf("opted out before unsubscribing = %v, %v", out, err)
+		}
+
+		l, err := st.Unsubscribe(ctx, "a1", base.Add(2*time.Hour))
+		if err != nil {
+			t.Fatalf("unsubscribe: %v", err)
+		}
+		if l == nil || l.Address != "bob@example.org" || l.EmailID != "a" || !l.UnsubscribedAt.Equal(base.Add(2*time.Hour)) {
+			t.Errorf("unsubscribed link = %+v", l)
+		}
+		if l, _ := st.Unsubscribe(ctx, "a1", base.Add(3*time.Hour)); l == nil || !l.UnsubscribedAt.Equal(base.Add(2*time.Hour)) {
+			t.Errorf("unsubscribing again = %+v, want the first time kept", l)
+		}
+		if l, err := st.Unsubscribe(ctx, "missing", base); err != nil || l != nil {
+			t.Errorf("unsubscribe unknown link = %+v, %v; want nil", l, err)
+		}
+		if _, err := st.Unsubscribe(ctx, "c1", base.Add(4*time.Hour)); err != nil {
+			t.Fatalf("unsubscribe carol: %v", err)
+		}
+		// Adding a link again does not undo its opt-out.
+		if err := st.AddUnsubscribeLinks(ctx, links[:1]); err != nil {
+			t.Fatalf("add again: %v", err)
+		}
+
+		out, err := st.OptedOut(ctx, []string{"BOB@example.org", "dave@example.org", "carol@example.org"})
+		if err != nil {
+			t.Fatalf("opted out: %v", err)
+		}
+		if !slices.Equal(out, []string{"BOB@example.org", "carol@example.org"}) {
+			t.Errorf("opted out = %v, want bob and carol as given", out)
+		}
+		optOuts, err := st.ListOptOuts(ctx)
+		if err != nil {
+			t.Fatalf("list opt-outs: %v", err)
+		}
+		if len(optOuts) != 2 || optOuts[0].Address != "carol@example.org" || optOuts[1].Address != "bob@example.org" || optOuts[1].Subject != "Spring sale" {
+			t.Errorf("opt-outs = %+v, want carol then bob", optOuts)
+		}
+
+		if err := st.Resubscribe(ctx, "Bob@example.org"); err != nil {
+			t.Fatalf("resubscribe: %v", err)
+		}
+		if out, _ := st.OptedOut(ctx, []string{"bob@example.org"}); len(out) != 0 {
+			t.Errorf("opted out after resubscribing = %v", out)
+		}
+		if err := st.Resubscribe(ctx, "bob@example.org"); err == nil {
+			t.Error("resubscribing an address that is not opted out succeeded")
+		}
+	})
+}
+
+func TestSuppressions(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		for _, e := range []Suppression{
+			{Address: "Bob@Example.org", Reason: SuppressionUnsubscribed, CreatedBy: "alice", CreatedAt: base},
+			{Address: "bob@example.org", Reason: SuppressionBounced, Note: "5.1.1", CreatedBy: "dsn", CreatedAt: base.Add(2 * time.Hour)},
+			{Address: "carol@example.org", Reason: SuppressionComplained, CreatedBy: "alice", CreatedAt: base.Add(time.Hour)},
+		} {
+			if err := st.AddSuppression(ctx, e); err != nil {
+				t.Fatalf("add suppression: %v", err)
+			}
+		}
+
+		got, err := st.Suppressed(ctx, []string{"carol@example.org", "dave@example.org", "BOB@example.org"})
+		if err != nil {
+			t.Fatalf("suppressed: %v", err)
+		}
+		if len(got) != 2 || got[0].Address != "carol@example.org" || got[1].Address != "bob@example.org" || got[1].Reason != SuppressionBounced || got[1].Note != "5.1.1" {
+			t.Errorf("suppressed = %+v, want carol then bob, bounced", got)
+		}
+		list, err := st.ListSuppressions(ctx)
+		if err != nil {
+			t.Fatalf("list suppressions: %v", err)
+		}
+		if len(list) != 2 || list[0].Address != "bob@example.org" || !list[0].CreatedAt.Equal(base.Add(2*time.Hour)) || list[1].Address != "carol@example.org" {
+			t.Errorf("suppressions = %+v, want bob then carol", list)
+		}
+
+		if err := st.DeleteSuppression(ctx, "Bob@example.org"); err != nil {
+			t.Fatalf("delete suppression: %v", err)
+		}
+		if got, _ := st.Suppressed(ctx, []string{"bob@example.org"}); len(got) != 0 {
+			t.Errorf("suppressed after delete = %+v", got)
+		}
+		if err := st.DeleteSuppression(ctx, "bob@example.org"); err == nil {
+			t.Error("deleting an address that is not suppressed succeeded")
+		}
+	})
 }
 
-func TestSaveOutboundAndGet(t *testing.T) {
-	st := newTestStore(t)
+func TestSentMessages(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		sent := SentMessage{MessageID: "<q1@example.com>", EmailID: "e1", Sender: "me@example.com", Recipients: []string{"bob@example.org"}, Subject: "Quote", Body: "Our offer.", SentAt: base}
+		if err := st.RecordSent(ctx, sent); err != nil {
+			t.Fatalf("record sent: %v", err)
+		}
+		sent.Body = "Our revised offer."
+		if err := st.RecordSent(ctx, sent); err != nil {
+			t.Fatalf("record sent again: %v", err)
+		}
+		got, err := st.GetSent(ctx, "<q1@example.com>")
+		if err != nil || got == nil {
+			t.Fatalf("get sent = %v, %v", got, err)
+		}
+		if got.EmailID != "e1" || got.Body != "Our revised offer." || len(got.Recipients) != 1 || !got.SentAt.Equal(base) {
+			t.Errorf("sent message = %+v", got)
+		}
+		if got, err := st.GetSent(ctx, "<missing@example.com>"); err != nil || got != nil {
+			t.Errorf("get unknown = %+v, %v; want nil", got, err)
+		}
+
+		raw := "From: bob@example.org\r\nIn-Reply-To: <q1@example.com> <q0@example.com>\r\nSubject: Re: Quote\r\n\r\nDeal.\r\n"
+		id, _ := st.SaveInbound(ctx, "bob@example.org", []string{"me@example.com"}, "Re: Quote", "Deal.", []byte(raw), "", "", "")
+		if e, _ := st.Get(ctx, id); e.InReplyTo != "<q1@example.com>" {
+			t.Errorf("in reply to = %q, want the first message ID", e.InReplyTo)
+		}
+		id, _ = st.SaveInbound(ctx, "bob@example.org", []string{"me@example.com"}, "Hello", "hi", []byte("Subject: Hello\r\n\r\nhi"), "", "", "")
+		if e, _ := st.Get(ctx, id); e.InReplyTo != "" {
+			t.Errorf("in reply to = %q, want none", e.InReplyTo)
+		}
+
+		if n, err := st.PruneSent(ctx, base); err != nil || n != 0 {
+			t.Errorf("prune before sending = %d, %v; want 0", n, err)
+		}
+		if n, err := st.PruneSent(ctx, base.Add(time.Second)); err != nil || n != 1 {
+			t.Errorf("prune = %d, %v; want 1", n, err)
+		}
+	})
+}
+
+func TestEditEmail(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		id, _ := st.SaveOutbound(ctx, "me@example.com", []string{"bob@example.org"}, "Quote", "Our offer.", []byte("Subject: Quote\r\n\r\nOur offer.\r\n"))
+		email, _ := st.Get(ctx, id)
+		edit := Edit{
+			EmailID:  id,
+			Reviewer: "alice",
+			Before:   EditedFields{Recipients: email.Recipients, Subject: email.Subject, Body: email.Body},
+			After:    EditedFields{Recipients: []string{"carol@example.org"}, Subject: "Revised quote", Body: "Our revised offer."},
+		}
+		raw := []byte("Subject: Revised quote\r\n\r\nOur revised offer.\r\n")
+		if err := st.EditEmail(ctx, edit, raw, email.Version); err != nil {
+			t.Fatalf("edit: %v", err)
+		}
+		got, _ := st.Get(ctx, id)
+		if got.Subject != "Revised quote" || got.Body != "Our revised offer." || len(got.Recipients) != 1 || got.Recipients[0] != "carol@example.org" || string(got.RawMessage) != string(raw) {
+			t.Errorf("edited email = %+v", got)
+		}
+		if got.Snippet != "Our revised offer." || got.Version != email.Version+1 {
+			t.Errorf("snippet = %q, version = %d", got.Snippet, got.Version)
+		}
+		if err := st.EditEmail(ctx, edit, raw, email.Version); !errors.Is(err, ErrConflict) {
+			t.Errorf("edit at a stale version: err = %v, want ErrConflict", err)
+		}
+
+		edits, err := st.ListEdits(ctx, []string{id, "other"})
+		if err != nil || len(edits) != 1 {
+			t.Fatalf("list edits = %+v, %v", edits, err)
+		}
+		if e := edits[0]; e.Reviewer != "alice" || e.Before.Subject != "Quote" || e.After.Recipients[0] != "carol@example.org" || e.EditedAt.IsZero() {
+			t.Errorf("edit = %+v", e)
+		}
+
+		// Edits outlive their email, for the history.
+		if err := st.Delete(ctx, id); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if edits, _ := st.ListEdits(ctx, []string{id}); len(edits) != 1 {
+			t.Errorf("edits after delete = %d, want 1", len(edits))
+		}
+		if n, err := st.PruneEdits(ctx, time.Now().Add(time.Minute)); err != nil || n != 1 {
+			t.Errorf("prune = %d, %v; want 1", n, err)
+		}
+	})
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		for i, action := range []string{"token.create", "POST /api/emails", "token.revoke"} {
+			if err := st.RecordAudit(t.Context(), AuditEntry{At: base.Add(time.Duration(i) * time.Minute), Actor: "alice", Action: action}); err != nil {
+				t.Fatalf("record: %v", err)
+			}
+		}
+		entries, err := st.ListAudit(t.Context(), 2)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if len(entries) != 2 || entries[0].Action != "token.revoke" || entries[1].Action != "POST /api/emails" || !entries[0].At.Equal(base.Add(2*time.Minute)) {
+			t.Errorf("entries = %+v, want the two newest", entries)
+		}
+	})
+}
+
+func TestReputation(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		if e, err := st.GetReputation(t.Context(), "spam.example"); err != nil || e != nil {
+			t.Fatalf("unknown subject = %+v, %v; want nil", e, err)
+		}
+		for _, e := range []ReputationEntry{
+			{Subject: "Spam.Example", Reputation: ReputationTrusted, CreatedBy: "alice"},
+			{Subject: "spam.example", Reputation: ReputationBlocked, Note: "phishing", CreatedBy: "bob"},
+			{Subject: "192.0.2.1", Reputation: ReputationBlocked, CreatedBy: "bob"},
+		} {
+			if err := st.SetReputation(t.Context(), e); err != nil {
+				t.Fatalf("set reputation: %v", err)
+			}
+		}
+
+		e, err := st.GetReputation(t.Context(), "SPAM.example")
+		if err != nil || e == nil {
+			t.Fatalf("get reputation = %+v, %v", e, err)
+		}
+		if e.Subject != "spam.example" || e.Reputation != ReputationBlocked || e.Note != "phishing" || e.CreatedBy != "bob" || e.CreatedAt.IsZero() {
+			t.Errorf("entry = %+v, want the replacement", e)
+		}
+		list, err := st.ListReputation(t.Context())
+		if err != nil {
+			t.Fatalf("list reputation: %v", err)
+		}
+		if len(list) != 2 || list[0].Subject != "192.0.2.1" || list[1].Subject != "spam.example" {
+			t.Errorf("list = %+v, want two entries ordered by subject", list)
+		}
+
+		if err := st.DeleteReputation(t.Context(), "Spam.Example"); err != nil {
+			t.Fatalf("delete reputation: %v", err)
+		}
+		if err := st.DeleteReputation(t.Context(), "spam.example"); err == nil {
+			t.Error("deleting a missing entry succeeded")
+		}
+		if e, _ := st.GetReputation(t.Context(), "spam.example"); e != nil {
+			t.Errorf("deleted entry = %+v, want nil", e)
+		}
+	})
+}
+
+func TestAllowRules(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		if r, err := st.GetAllowRule(t.Context(), DirectionInbound, "a@example.com"); err != nil || r != nil {
+			t.Fatalf("unknown rule = %+v, %v; want nil", r, err)
+		}
+		for _, r := range []AllowRule{
+			{Direction: DirectionInbound, Sender: "A@Example.com", EmailID: "e1", CreatedBy: "alice"},
+			{Direction: DirectionInbound, Sender: "a@example.com", EmailID: "e2", CreatedBy: "bob"},
+			{Direction: DirectionOutbound, Sender: "a@example.com", CreatedBy: "bob"},
+		} {
+			if err := st.AddAllowRule(t.Context(), r); err != nil {
+				t.Fatalf("add allow rule: %v", err)
+			}
+		}
+
+		r, err := st.GetAllowRule(t.Context(), DirectionInbound, "a@EXAMPLE.com")
+		if err != nil || r == nil {
+			t.Fatalf("get allow rule = %+v, %v", r, err)
+		}
+		if r.Sender != "a@example.com" || r.EmailID != "e1" || r.CreatedBy != "alice" || r.CreatedAt.IsZero() {
+			t.Errorf("rule = %+v, want the first one kept", r)
+		}
+		list, err := st.ListAllowRules(t.Context())
+		if err != nil {
+			t.Fatalf("list allow rules: %v", err)
+		}
+		if len(list) != 2 || list[0].Direction != DirectionInbound || list[1].Direction != DirectionOutbound {
+			t.Errorf("list = %+v, want one rule per direction", list)
+		}
+
+		if err := st.DeleteAllowRule(t.Context(), DirectionInbound, "A@example.com"); err != nil {
+			t.Fatalf("delete allow rule: %v", err)
+		}
+		if err := st.DeleteAllowRule(t.Context(), DirectionInbound, "a@example.com"); err == nil {
+			t.Error("deleting a missing rule succeeded")
+		}
+		if r, _ := st.GetAllowRule(t.Context(), DirectionOutbound, "a@example.com"); r == nil {
+			t.Error("deleting the inbound rule removed the outbound one")
+		}
+	})
+}
+
+func TestBlockRules(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		for _, r := range []BlockRule{
+			{Direction: DirectionInbound, Subject: "Spam.Example", EmailID: "e1", CreatedBy: "alice"},
+			{Direction: DirectionInbound, Subject: "spam.example", CreatedBy: "bob"},
+			{Direction: DirectionInbound, Subject: "bob@example.org", CreatedBy: "bob"},
+		} {
+			if err := st.AddBlockRule(t.Context(), r); err != nil {
+				t.Fatalf("add block rule: %v", err)
+			}
+		}
+		for range 2 {
+			if err := st.CountSuppressed(t.Context(), DirectionInbound, "SPAM.example"); err != nil {
+				t.Fatalf("count suppressed: %v", err)
+			}
+		}
+		// Counting for a rule deleted meanwhile is not an error.
+		if err := st.CountSuppressed(t.Context(), DirectionOutbound, "spam.example"); err != nil {
+			t.Errorf("count suppressed without a rule: %v", err)
+		}
+
+		r, err := st.GetBlockRule(t.Context(), DirectionInbound, "spam.example")
+		if err != nil || r == nil {
+			t.Fatalf("get block rule = %+v, %v", r, err)
+		}
+		if r.Subject != "spam.example" || r.CreatedBy != "alice" || r.Suppressed != 2 || r.CreatedAt.IsZero() {
+			t.Errorf("rule = %+v, want the first one, counted twice", r)
+		}
+		if r, _ := st.GetBlockRule(t.Context(), DirectionOutbound, "spam.example"); r != nil {
+			t.Errorf("outbound rule = %+v, want nil", r)
+		}
+		list, err := st.ListBlockRules(t.Context())
+		if err != nil {
+			t.Fatalf("list block rules: %v", err)
+		}
+		if len(list) != 2 || list[0].Subject != "bob@example.org" || list[1].Subject != "spam.example" {
+			t.Errorf("list = %+v, want two rules ordered by subject", list)
+		}
+
+		if err := st.DeleteBlockRule(t.Context(), DirectionInbound, "Spam.Example"); err != nil {
+			t.Fatalf("delete block rule: %v", err)
+		}
+		if err := st.DeleteBlockRule(t.Context(), DirectionInbound, "spam.example"); err == nil {
+			t.Error("deleting a missing rule succeeded")
+		}
+	})
+}
+
+func TestPrune(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		decisions := []Decision{
+			{EmailID: "old-approved", Decision: DecisionApproved, DecidedAt: base},
+			{EmailID: "old-rejected", Decision: DecisionRejected, DecidedAt: base.Add(time.Hour)},
+			{EmailID: "new-rejected", Decision: DecisionRejected, DecidedAt: base.Add(48 * time.Hour)},
+			{EmailID: "new-approved", Decision: DecisionApproved, DecidedAt: base.Add(48 * time.Hour).In(time.FixedZone("CET", 3600))},
+		}
+		for _, d := range decisions {
+			if err := st.RecordDecision(ctx, d); err != nil {
+				t.Fatalf("record decision: %v", err)
+			}
+		}
+		for i := range 3 {
+			if err := st.RecordAudit(ctx, AuditEntry{At: base.Add(time.Duration(i) * 24 * time.Hour), Actor: "alice", Action: "token.create"}); err != nil {
+				t.Fatalf("record audit: %v", err)
+			}
+		}
+
+		n, err := st.PruneDecisions(ctx, DecisionRejected, base.Add(24*time.Hour))
+		if err != nil || n != 1 {
+			t.Fatalf("prune rejected = %d, %v, want 1", n, err)
+		}
+		n, err = st.PruneDecisions(ctx, "", base.Add(24*time.Hour))
+		if err != nil || n != 1 {
+			t.Fatalf("prune all = %d, %v, want 1", n, err)
+		}
+		remaining, err := st.ListDecisions(ctx, 10)
+		if err != nil {
+			t.Fatalf("list decisions: %v", err)
+		}
+		if len(remaining) != 2 || remaining[0].EmailID == "old-approved" || remaining[1].EmailID == "old-approved" {
+			t.Errorf("remaining decisions = %+v, want the two new ones", remaining)
+		}
+
+		n, err = st.PruneAudit(ctx, base.Add(36*time.Hour))
+		if err != nil || n != 2 {
+			t.Fatalf("prune audit = %d, %v, want 2", n, err)
+		}
+		if entries, _ := st.ListAudit(ctx, 10); len(entries) != 1 {
+			t.Errorf("remaining audit entries = %d, want 1", len(entries))
+		}
+		if err := st.Vacuum(ctx); err != nil {
+			t.Errorf("vacuum: %v", err)
+		}
+	})
+}
+
+func TestDailyStats(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		if day, err := st.NextStatsDay(ctx); err != nil || !day.IsZero() {
+			t.Fatalf("next stats day of an empty store = %v, %v, want zero", day, err)
+		}
+
+		base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+		decisions := []Decision{
+			{EmailID: "a", Direction: DirectionOutbound, Decision: DecisionApproved, Latency: time.Hour, DecidedAt: base},
+			{EmailID: "b", Direction: DirectionInbound, Decision: DecisionApproved, DecidedAt: base.Add(time.Hour)},
+			{EmailID: "b", Direction: DirectionInbound, Decision: DecisionForwarded, DecidedAt: base.Add(time.Hour)},
+			{EmailID: "c", Direction: DirectionOutbound, Decision: DecisionApproved, Latency: time.Minute, DecidedAt: base.Add(2 * time.Hour), EnvelopeID: "env-c"},
+			{Direction: DirectionOutbound, Decision: DecisionRejected, DecidedAt: base.Add(3 * time.Hour)},
+			// Received on the first day, rejected on the second.
+			{EmailID: "d", Direction: DirectionOutbound, Decision: DecisionRejected, Latency: 24 * time.Hour, DecidedAt: base.Add(24 * time.Hour)},
+		}
+		for _, d := range decisions {
+			if err := st.RecordDecision(ctx, d); err != nil {
+				t.Fatalf("record decision: %v", err)
+			}
+		}
+		if err := st.UpdateDelivery(ctx, "env-c", DeliveryFailed, "550 no such user"); err != nil {
+			t.Fatalf("update delivery: %v", err)
+		}
+
+		first, err := st.NextStatsDay(ctx)
+		if err != nil || !first.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("next stats day = %v, %v, want the day of the oldest decision", first, err)
+		}
+		got, err := st.RollUpStats(ctx, base)
+		if err != nil {
+			t.Fatalf("roll up: %v", err)
+		}
+		want := DailyStats{Day: first, Received: 5, Approved: 3, Rejected: 1, Relayed: 3, Bounced: 1}
+		if got != want {
+			t.Errorf("first day = %+v, want %+v", got, want)
+		}
+		second, err := st.RollUpStats(ctx, first.AddDate(0, 0, 1).Add(23*time.Hour))
+		if err != nil {
+			t.Fatalf("roll up: %v", err)
+		}
+		if want := (DailyStats{Day: first.AddDate(0, 0, 1), Rejected: 1}); second != want {
+			t.Errorf("second day = %+v, want %+v", second, want)
+		}
+		if day, err := st.NextStatsDay(ctx); err != nil || !day.Equal(first.AddDate(0, 0, 2)) {
+			t.Errorf("next stats day = %v, %v, want the day after the last roll-up", day, err)
+		}
+
+		// The counters outlive the decisions they count.
+		if _, err := st.PruneDecisions(ctx, "", base.AddDate(0, 0, 7)); err != nil {
+			t.Fatalf("prune decisions: %v", err)
+		}
+		list, err := st.ListDailyStats(ctx, time.Time{})
+		if err != nil {
+			t.Fatalf("list daily stats: %v", err)
+		}
+		if len(list) != 2 || list[0] != second || list[1] != want {
+			t.Errorf("daily stats = %+v, want both days, newest first", list)
+		}
+		if list, _ := st.ListDailyStats(ctx, second.Day.Add(time.Hour)); len(list) != 1 || list[0] != second {
+			t.Errorf("daily stats since the second day = %+v", list)
+		}
+
+		// Emails still held are counted on the day they were received.
+		if _, err := st.SaveOutbound(ctx, "alice@example.com", []string{"bob@example.com"}, "Hello", "Hi", []byte("raw")); err != nil {
+			t.Fatalf("save outbound: %v", err)
+		}
+		if today, err := st.RollUpStats(ctx, time.Now()); err != nil || today.Received != 1 {
+			t.Errorf("today = %+v, %v, want 1 received", today, err)
+		}
+	})
+}
+
+func TestSettings(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		if settings, err := st.ListSettings(ctx); err != nil || len(settings) != 0 {
+			t.Fatalf("list settings = %v, %v, want none", settings, err)
+		}
+		for _, s := range []Setting{
+			{Key: "quota", Value: "per_hour: 10\n", UpdatedBy: "alice"},
+			{Key: "rules", Value: "[]\n", UpdatedBy: "alice"},
+			{Key: "quota", Value: "per_hour: 20\n", UpdatedBy: "bob"},
+		} {
+			if err := st.SaveSetting(ctx, s); err != nil {
+				t.Fatalf("save setting: %v", err)
+			}
+		}
+		settings, err := st.ListSettings(ctx)
+		if err != nil {
+			t.Fatalf("list settings: %v", err)
+		}
+		if len(settings) != 2 || settings[0].Key != "quota" || settings[0].Value != "per_hour: 20\n" || settings[0].UpdatedBy != "bob" || settings[0].UpdatedAt.IsZero() || settings[1].Key != "rules" {
+			t.Errorf("settings = %+v", settings)
+		}
+
+		if err := st.DeleteSetting(ctx, "quota"); err != nil {
+			t.Fatalf("delete setting: %v", err)
+		}
+		if err := st.DeleteSetting(ctx, "quota"); err != nil {
+			t.Errorf("delete a deleted setting: %v", err)
+		}
+		if settings, _ := st.ListSettings(ctx); len(settings) != 1 || settings[0].Key != "rules" {
+			t.Errorf("settings after delete = %+v", settings)
+		}
+	})
+}
+
+func TestMaintain(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		for i := range 50 {
+			if err := st.RecordAudit(ctx, AuditEntry{At: time.Now(), Actor: "alice", Action: "token.create", Detail: strings.Repeat("x", 1000*i)}); err != nil {
+				t.Fatalf("record audit: %v", err)
+			}
+		}
+		if _, err := st.PruneAudit(ctx, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("prune audit: %v", err)
+		}
+		if err := st.RecordDecision(ctx, Decision{EmailID: "e1", Decision: DecisionApproved, DecidedAt: time.Now()}); err != nil {
+			t.Fatalf("record decision: %v", err)
+		}
+
+		if err := st.Maintain(ctx); err != nil {
+			t.Fatalf("maintain: %v", err)
+		}
+		size, err := st.Size(ctx)
+		if err != nil {
+			t.Fatalf("size: %v", err)
+		}
+		if size.Rows["decisions"] != 1 || size.Rows["audit_log"] != 0 {
+			t.Errorf("rows = %v, want 1 decision and no audit entries", size.Rows)
+		}
+		if size.FreeBytes != 0 {
+			t.Errorf("free bytes after maintenance = %d, want 0", size.FreeBytes)
+		}
+		if _, ok := st.(*Store); ok && size.Bytes == 0 {
+			t.Error("database size = 0")
+		}
+	})
+}
 
-	id, err := st.SaveOutbound(t.Context(), "alice@example.com", []string{"bob@example.com"}, "Hello", "Hi Bob", []byte("raw message"))
+// A database created before incremental auto-vacuum was the default is
+// converted by its first maintenance.
+func TestMaintainConvertsAutoVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite", path)
 	if err != nil {
-		t.Fatalf("save outbound: %v", err)
+		t.Fatal(err)
 	}
-	if id == "" {
-		t.Fatal("expected non-empty id")
+	if _, err := db.Exec(`CREATE TABLE emails (id TEXT PRIMARY KEY, raw_message BLOB NOT NULL)`); err != nil {
+		t.Fatal(err)
 	}
+	db.Close()
 
-	email, err := st.Get(t.Context(), id)
+	st, err := New(path)
 	if err != nil {
-		t.Fatalf("get: %v", err)
-	}
-
-	if email.ID != id {
-		t.Errorf("id = %q, want %q", email.ID, id)
-	}
-	if email.Direction != DirectionOutbound {
-		t.Errorf("direction = %q, want %q", email.Direction, DirectionOutbound)
-	}
-	if email.Status != StatusPending {
-		t.Errorf("status = %q, want %q", email.Status, StatusPending)
-	}
-	if email.Sender != "alice@example.com" {
-		t.Errorf("sender = %q, want %q", email.Sender, "alice@example.com")
-	}
-	if len(email.Recipients) != 1 || email.Recipients[0] != "bob@example.com" {
-		t.Errorf("recipients = %v, want [bob@example.com]", email.Recipients)
-	}
-	if email.Subject != "Hello" {
-		t.Errorf("subject = %q, want %q", email.Subject, "Hello")
+		t.Fatalf("new store: %v", err)
 	}
-	if email.Body != "Hi Bob" {
-		t.Errorf("body = %q, want %q", email.Body, "Hi Bob")
+	defer st.Close()
+	mode := func() int {
+		t.Helper()
+		var m int
+		if err := st.db.QueryRow(`PRAGMA auto_vacuum`).Scan(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m
 	}
-	if string(email.RawMessage) != "raw message" {
-		t.Errorf("raw_message = %q, want %q", email.RawMessage, "raw message")
+	if m := mode(); m != 0 {
+		t.Fatalf("auto_vacuum before maintenance = %d, want 0", m)
 	}
-	if email.ReceivedAt.IsZero() {
-		t.Error("received_at should not be zero")
+	if err := st.Maintain(t.Context()); err != nil {
+		t.Fatalf("maintain: %v", err)
 	}
-	if email.IMAPMessageID != "" {
-		t.Errorf("imap_message_id = %q, want empty", email.IMAPMessageID)
+	if m := mode(); m != autoVacuumIncremental {
+		t.Errorf("auto_vacuum after maintenance = %d, want %d", m, autoVacuumIncremental)
 	}
 }
 
-func TestSaveInboundAndGet(t *testing.T) {
-	st := newTestStore(t)
+func TestQuerySpans(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
 
-	id, err := st.SaveInbound(t.Context(), "sender@example.com", []string{"me@example.com"}, "Inbound", "body", []byte("raw"),
-		"<msg123@example.com>", "mailescrow/received")
-	if err != nil {
-		t.Fatalf("save inbound: %v", err)
+	st := newTestStore(t, DriverSQLite)
+	if _, err := st.CountPending(t.Context()); err != nil {
+		t.Fatalf("untraced count: %v", err)
 	}
-
-	email, err := st.Get(t.Context(), id)
-	if err != nil {
-		t.Fatalf("get: %v", err)
+	if n := len(sr.Ended()); n != 0 {
+		t.Fatalf("%d spans recorded outside a trace, want 0", n)
 	}
 
-	if email.Direction != DirectionInbound {
-		t.Errorf("direction = %q, want %q", email.Direction, DirectionInbound)
+	ctx, parent := otel.Tracer("test").Start(t.Context(), "request")
+	if _, err := st.CountPending(ctx); err != nil {
+		t.Fatalf("traced count: %v", err)
 	}
-	if email.IMAPMessageID != "<msg123@example.com>" {
-		t.Errorf("imap_message_id = %q, want %q", email.IMAPMessageID, "<msg123@example.com>")
+	parent.End()
+
+	var queries int
+	for _, s := range sr.Ended() {
+		if s.Parent().SpanID() == parent.SpanContext().SpanID() {
+			queries++
+		}
 	}
-	if email.IMAPMailbox != "mailescrow/received" {
-		t.Errorf("imap_mailbox = %q, want %q", email.IMAPMailbox, "mailescrow/received")
+	if queries == 0 {
+		t.Error("no query span recorded under the request span")
 	}
 }
 
-func TestSaveMultipleRecipients(t *testing.T) {
-	st := newTestStore(t)
-
-	rcpts := []string{"bob@example.com", "carol@example.com", "dave@example.com"}
-	id, err := st.SaveOutbound(t.Context(), "alice@example.com", rcpts, "Group", "Hello all", []byte("raw"))
+func TestQueryTimeout(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	st, err := Open(DriverSQLite, dbPath, 100*time.Millisecond)
 	if err != nil {
-		t.Fatalf("save outbound: %v", err)
+		t.Fatalf("open store: %v", err)
 	}
+	t.Cleanup(func() { st.Close() })
 
-	email, err := st.Get(t.Context(), id)
+	// Hold the write lock from another connection, as a hung writer would.
+	locker, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		t.Fatalf("get: %v", err)
+		t.Fatalf("open: %v", err)
 	}
-	if len(email.Recipients) != 3 {
-		t.Fatalf("recipients count = %d, want 3", len(email.Recipients))
+	t.Cleanup(func() { locker.Close() })
+	conn, err := locker.Conn(t.Context())
+	if err != nil {
+		t.Fatalf("conn: %v", err)
 	}
-	for i, want := range rcpts {
-		if email.Recipients[i] != want {
-			t.Errorf("recipients[%d] = %q, want %q", i, email.Recipients[i], want)
-		}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.ExecContext(t.Context(), `BEGIN EXCLUSIVE`); err != nil {
+		t.Fatalf("lock: %v", err)
 	}
-}
-
-func TestListPending(t *testing.T) {
-	st := newTestStore(t)
 
-	// Empty list.
-	emails, err := st.ListPending(t.Context())
-	if err != nil {
-		t.Fatalf("list pending: %v", err)
+	start := time.Now()
+	_, err = st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Stuck", "body", []byte("raw"))
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("save succeeded while the database was locked")
 	}
-	if len(emails) != 0 {
-		t.Fatalf("expected 0 emails, got %d", len(emails))
+	if elapsed >= busyTimeout {
+		t.Errorf("save returned after %v, want it cut short by the 100ms query timeout", elapsed)
 	}
 
-	// Save two outbound and one inbound.
-	st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "First", "body1", []byte("raw1"))
-	st.SaveOutbound(t.Context(), "c@x.com", []string{"d@x.com"}, "Second", "body2", []byte("raw2"))
-	id3, _ := st.SaveInbound(t.Context(), "e@x.com", []string{"f@x.com"}, "Third", "body3", []byte("raw3"), "<m3>", "mailescrow/received")
-
-	// Approve the inbound email; it should not show in ListPending.
-	_ = st.Approve(t.Context(), id3)
-
-	emails, err = st.ListPending(t.Context())
-	if err != nil {
-		t.Fatalf("list pending: %v", err)
+	if _, err := conn.ExecContext(t.Context(), `ROLLBACK`); err != nil {
+		t.Fatalf("unlock: %v", err)
 	}
-	if len(emails) != 2 {
-		t.Fatalf("expected 2 pending emails, got %d", len(emails))
+	if _, err := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Free", "body", []byte("raw")); err != nil {
+		t.Errorf("save after unlock: %v", err)
 	}
-	if emails[0].Subject != "First" {
-		t.Errorf("first email subject = %q, want %q", emails[0].Subject, "First")
+
+	// A query that runs too long is interrupted at the deadline.
+	ctx, cancel := st.(*Store).withTimeout(t.Context())
+	defer cancel()
+	start = time.Now()
+	var n int
+	err = st.(*Store).db.QueryRowContext(ctx,
+		`WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c`).Scan(&n)
+	if err == nil {
+		t.Fatal("endless query returned")
 	}
-	if emails[1].Subject != "Second" {
-		t.Errorf("second email subject = %q, want %q", emails[1].Subject, "Second")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("endless query ran for %v, want it interrupted after 100ms", elapsed)
 	}
 }
 
-func TestListApproved(t *testing.T) {
-	st := newTestStore(t)
-
-	id1, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Inbound1", "body1", []byte("raw1"), "<m1>", "mailescrow/received")
-	id2, _ := st.SaveInbound(t.Context(), "c@x.com", []string{"d@x.com"}, "Inbound2", "body2", []byte("raw2"), "<m2>", "mailescrow/received")
-	_, _ = st.SaveOutbound(t.Context(), "e@x.com", []string{"f@x.com"}, "Outbound", "body3", []byte("raw3"))
+func TestOpenRaw(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		// Longer than a chunk, and not a whole number of them.
+		large := []byte("Subject: Big\r\n\r\n" + strings.Repeat("0123456789", rawChunkSize/4))
+		id, _ := st.SaveOutbound(ctx, "alice@example.com", []string{"bob@example.com"}, "Big", "body", large)
+		dropped, _ := st.SaveInbound(ctx, "alice@example.com", []string{"bob@example.com"}, "Dropped", "body", []byte{}, "<m1>", "mailescrow/received", "")
 
-	// Approve only the first inbound.
-	_ = st.Approve(t.Context(), id1)
+		for id, want := range map[string][]byte{id: large, dropped: nil} {
+			raw, err := st.OpenRaw(ctx, id)
+			if err != nil {
+				t.Fatalf("open raw: %v", err)
+			}
+			got, err := io.ReadAll(raw)
+			_ = raw.Close()
+			if err != nil {
+				t.Fatalf("read raw: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("raw message of %s is %d bytes, want %d", id, len(got), len(want))
+			}
+		}
+		if _, err := st.OpenRaw(ctx, "missing"); err == nil {
+			t.Error("open raw of a missing email succeeded")
+		}
+	})
+}
 
-	// Approve the outbound too — it should NOT appear in ListApproved.
-	_ = st.Approve(t.Context(), id2)
-	_ = st.Approve(t.Context(), id2) // already approved, may fail silently
+func TestOpenRawFailsWhenEdited(t *testing.T) {
+	st := newTestStore(t, DriverSQLite)
+	ctx := t.Context()
+	large := []byte(strings.Repeat("x", rawChunkSize+10))
+	id, _ := st.SaveOutbound(ctx, "alice@example.com", []string{"bob@example.com"}, "Big", "body", large)
 
-	emails, err := st.ListApproved(t.Context())
+	raw, err := st.OpenRaw(ctx, id)
 	if err != nil {
-		t.Fatalf("list approved: %v", err)
+		t.Fatalf("open raw: %v", err)
 	}
-	// Both inbound emails are approved.
-	if len(emails) != 2 {
-		t.Fatalf("expected 2 approved inbound emails, got %d", len(emails))
+	defer raw.Close()
+	if _, err := io.ReadFull(raw, make([]byte, rawChunkSize)); err != nil {
+		t.Fatalf("read first chunk: %v", err)
 	}
-	for _, e := range emails {
-		if e.Direction != DirectionInbound {
-			t.Errorf("expected inbound, got %q", e.Direction)
-		}
-		if e.Status != StatusApproved {
-			t.Errorf("expected approved, got %q", e.Status)
-		}
+	if _, err := st.(*Store).db.Exec(`UPDATE emails SET raw_message = ? WHERE id = ?`, []byte("short"), id); err != nil {
+		t.Fatalf("edit raw: %v", err)
+	}
+	if _, err := io.ReadAll(raw); err == nil {
+		t.Error("reading on after the raw message changed succeeded")
 	}
 }
 
-func TestApprove(t *testing.T) {
-	st := newTestStore(t)
-
-	id, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"), "<m>", "mailescrow/received")
-
-	if err := st.Approve(t.Context(), id); err != nil {
-		t.Fatalf("approve: %v", err)
+func TestRawKey(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	st, err := Open(DriverSQLite, dbPath, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
 	}
-
-	email, err := st.Get(t.Context(), id)
+	defer st.Close()
+	plainID, err := st.SaveOutbound(t.Context(), "alice@example.com", []string{"bob@example.com"}, "Plain", "body", []byte("plain raw"))
 	if err != nil {
-		t.Fatalf("get: %v", err)
+		t.Fatalf("save plain: %v", err)
 	}
-	if email.Status != StatusApproved {
-		t.Errorf("status = %q, want approved", email.Status)
+	if err := st.SetRawKey([]byte("short")); err == nil {
+		t.Error("expected an error for a short key")
 	}
-}
-
-func TestApproveNotFound(t *testing.T) {
-	st := newTestStore(t)
-	if err := st.Approve(t.Context(), "nonexistent"); err == nil {
-		t.Fatal("expected error for nonexistent id")
+	key := []byte(strings.Repeat("k", 32))
+	if err := st.SetRawKey(key); err != nil {
+		t.Fatalf("set raw key: %v", err)
+	}
+	sealedID, err := st.SaveOutbound(t.Context(), "alice@example.com", []string{"bob@example.com"}, "Sealed", "body", []byte("secret raw"))
+	if err != nil {
+		t.Fatalf("save sealed: %v", err)
 	}
-}
 
-func TestUpdateIMAPMailbox(t *testing.T) {
-	st := newTestStore(t)
+	var stored []byte
+	if err := st.(*Store).db.QueryRow(`SELECT raw_message FROM emails WHERE id = ?`, sealedID).Scan(&stored); err != nil {
+		t.Fatalf("query raw: %v", err)
+	}
+	if strings.Contains(string(stored), "secret raw") {
+		t.Errorf("raw message stored in the clear: %q", stored)
+	}
+	for id, want := range map[string]string{plainID: "plain raw", sealedID: "secret raw"} {
+		e, err := st.Get(t.Context(), id)
+		if err != nil {
+			t.Fatalf("get %s: %v", id, err)
+		}
+		if string(e.RawMessage) != want {
+			t.Errorf("raw message = %q, want %q", e.RawMessage, want)
+		}
+		raw, err := st.OpenRaw(t.Context(), id)
+		if err != nil {
+			t.Fatalf("open raw %s: %v", id, err)
+		}
+		if got, err := io.ReadAll(raw); err != nil || string(got) != want {
+			t.Errorf("read raw = %q, %v, want %q", got, err, want)
+		}
+	}
 
-	id, _ := st.SaveInbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"), "<m>", "mailescrow/received")
+	// Job payloads may carry a raw message, so they are encrypted too.
+	if _, err := st.AddJob(t.Context(), Job{Kind: "relay", Payload: []byte("secret payload"), Status: JobPending}); err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+	if err := st.(*Store).db.QueryRow(`SELECT payload FROM jobs`).Scan(&stored); err != nil {
+		t.Fatalf("query payload: %v", err)
+	}
+	if strings.Contains(string(stored), "secret payload") {
+		t.Errorf("job payload stored in the clear: %q", stored)
+	}
+	if jobs, err := st.ListJobs(t.Context()); err != nil || len(jobs) != 1 || string(jobs[0].Payload) != "secret payload" {
+		t.Errorf("jobs = %+v, %v, want the decrypted payload", jobs, err)
+	}
 
-	if err := st.UpdateIMAPMailbox(t.Context(), id, "mailescrow/approved"); err != nil {
-		t.Fatalf("update imap mailbox: %v", err)
+	// So are the bodies of sent messages.
+	if err := st.RecordSent(t.Context(), SentMessage{MessageID: "<s1@example.com>", Body: "secret body"}); err != nil {
+		t.Fatalf("record sent: %v", err)
+	}
+	if err := st.(*Store).db.QueryRow(`SELECT body FROM sent_messages`).Scan(&stored); err != nil {
+		t.Fatalf("query body: %v", err)
+	}
+	if strings.Contains(string(stored), "secret body") {
+		t.Errorf("sent message stored in the clear: %q", stored)
+	}
+	if m, err := st.GetSent(t.Context(), "<s1@example.com>"); err != nil || m.Body != "secret body" {
+		t.Errorf("sent message = %+v, %v, want the decrypted body", m, err)
 	}
 
-	email, err := st.Get(t.Context(), id)
+	// Without the key the encrypted message cannot be read.
+	st2, err := Open(DriverSQLite, dbPath, 0)
 	if err != nil {
-		t.Fatalf("get: %v", err)
+		t.Fatalf("reopen: %v", err)
 	}
-	if email.IMAPMailbox != "mailescrow/approved" {
-		t.Errorf("imap_mailbox = %q, want mailescrow/approved", email.IMAPMailbox)
+	defer st2.Close()
+	if _, err := st2.Get(t.Context(), sealedID); err == nil {
+		t.Error("expected an error reading an encrypted message without the key")
 	}
 }
 
-func TestDelete(t *testing.T) {
-	st := newTestStore(t)
-
-	id, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test", "body", []byte("raw"))
+func TestJobs(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		now := time.Now().UTC()
+		later, err := st.AddJob(ctx, Job{Kind: "webhook", Payload: []byte(`{"n":2}`), Status: JobPending, RunAt: now.Add(time.Hour)})
+		if err != nil {
+			t.Fatalf("add later job: %v", err)
+		}
+		due, err := st.AddJob(ctx, Job{Kind: "imap_move", EmailID: "e1", Payload: []byte(`{"n":1}`), Status: JobPending})
+		if err != nil {
+			t.Fatalf("add due job: %v", err)
+		}
 
-	if err := st.Delete(t.Context(), id); err != nil {
-		t.Fatalf("delete: %v", err)
-	}
+		j, err := st.ClaimJob(ctx, now.Add(time.Minute))
+		if err != nil {
+			t.Fatalf("claim: %v", err)
+		}
+		if j == nil || j.ID != due || j.Status != JobRunning || j.Attempts != 1 || j.EmailID != "e1" || string(j.Payload) != `{"n":1}` {
+			t.Fatalf("claimed %+v, want the due job running at attempt 1", j)
+		}
+		if j, err := st.ClaimJob(ctx, now.Add(time.Minute)); err != nil || j != nil {
+			t.Fatalf("second claim = %+v, %v, want nothing due", j, err)
+		}
 
-	_, err := st.Get(t.Context(), id)
-	if err == nil {
-		t.Fatal("expected error after delete, got nil")
-	}
-}
+		if err := st.RetryJobAt(ctx, due, "timeout", now.Add(2*time.Hour)); err != nil {
+			t.Fatalf("retry: %v", err)
+		}
+		if err := st.RetryJobAt(ctx, due, "timeout", now); !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("retrying a job that is not running: %v, want ErrJobNotFound", err)
+		}
+		j, err = st.ClaimJob(ctx, now.Add(90*time.Minute))
+		if err != nil || j == nil || j.ID != later {
+			t.Fatalf("claim after an hour = %+v, %v, want the later job", j, err)
+		}
+		if err := st.FailJob(ctx, later, "gone"); err != nil {
+			t.Fatalf("fail: %v", err)
+		}
 
-func TestDeleteNotFound(t *testing.T) {
-	st := newTestStore(t)
+		jobs, err := st.ListJobs(ctx)
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if len(jobs) != 2 || jobs[0].ID != later || jobs[0].Status != JobFailed || jobs[0].LastError != "gone" ||
+			jobs[1].Status != JobPending || jobs[1].LastError != "timeout" || !jobs[1].RunAt.Equal(now.Add(2*time.Hour)) {
+			t.Errorf("jobs = %+v", jobs)
+		}
 
-	err := st.Delete(t.Context(), "nonexistent-id")
-	if err == nil {
-		t.Fatal("expected error for nonexistent id")
-	}
+		if err := st.RequeueJob(ctx, later); err != nil {
+			t.Fatalf("requeue: %v", err)
+		}
+		j, err = st.ClaimJob(ctx, time.Now().Add(time.Second))
+		if err != nil || j == nil || j.ID != later || j.Attempts != 1 {
+			t.Fatalf("claim after requeue = %+v, %v, want the requeued job at attempt 1", j, err)
+		}
+		if n, err := st.ResetRunningJobs(ctx); err != nil || n != 1 {
+			t.Errorf("reset running = %d, %v, want 1", n, err)
+		}
+		if err := st.DeleteJob(ctx, later); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if err := st.DeleteJob(ctx, later); !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("deleting a deleted job: %v, want ErrJobNotFound", err)
+		}
+	})
 }
 
-func TestGetNotFound(t *testing.T) {
-	st := newTestStore(t)
-
-	_, err := st.Get(t.Context(), "nonexistent-id")
-	if err == nil {
-		t.Fatal("expected error for nonexistent id")
-	}
-}
+func TestWebhooks(t *testing.T) {
+	forEachDriver(t, func(t *testing.T, st EmailStore) {
+		ctx := t.Context()
+		mine, err := st.CreateWebhook(ctx, Webhook{TokenID: "t1", URL: "https://a.example/hook", Events: []string{"email_approved"}, Direction: DirectionInbound})
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		theirs, err := st.CreateWebhook(ctx, Webhook{TokenID: "t2", URL: "https://b.example/hook"})
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
 
-func TestSaveGeneratesUniqueIDs(t *testing.T) {
-	st := newTestStore(t)
+		list, err := st.ListWebhooks(ctx, "t1")
+		if err != nil || len(list) != 1 || list[0].ID != mine {
+			t.Fatalf("list t1 = %+v (%v), want only %s", list, err, mine)
+		}
+		if w := list[0]; w.URL != "https://a.example/hook" || !slices.Equal(w.Events, []string{"email_approved"}) || w.Direction != DirectionInbound {
+			t.Errorf("webhook = %+v", w)
+		}
+		if all, err := st.ListWebhooks(ctx, ""); err != nil || len(all) != 2 {
+			t.Errorf("list all = %d (%v), want 2", len(all), err)
+		}
+		if w, err := st.GetWebhook(ctx, theirs); err != nil || w == nil || w.TokenID != "t2" || len(w.Events) != 0 {
+			t.Errorf("get = %+v (%v)", w, err)
+		}
+		if w, err := st.GetWebhook(ctx, "missing"); err != nil || w != nil {
+			t.Errorf("get missing = %+v (%v), want nil", w, err)
+		}
 
-	id1, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test1", "body", []byte("raw"))
-	id2, _ := st.SaveOutbound(t.Context(), "a@x.com", []string{"b@x.com"}, "Test2", "body", []byte("raw"))
+		first, err := st.AddWebhookDelivery(ctx, WebhookDelivery{WebhookID: mine, Event: "email_approved", EmailID: "e1", Status: WebhookPending, CreatedAt: time.Now().Add(-time.Minute)})
+		if err != nil {
+			t.Fatalf("add delivery: %v", err)
+		}
+		if _, err := st.AddWebhookDelivery(ctx, WebhookDelivery{WebhookID: mine, Event: "email_approved", EmailID: "e2", Status: WebhookPending}); err != nil {
+			t.Fatalf("add delivery: %v", err)
+		}
+		if err := st.UpdateWebhookDelivery(ctx, WebhookDelivery{ID: first, Status: WebhookSucceeded, Attempts: 2, ResponseCode: 204, LastError: ""}); err != nil {
+			t.Fatalf("update delivery: %v", err)
+		}
+		if err := st.UpdateWebhookDelivery(ctx, WebhookDelivery{ID: "missing"}); !errors.Is(err, ErrWebhookNotFound) {
+			t.Errorf("update missing delivery: %v, want ErrWebhookNotFound", err)
+		}
+		deliveries, err := st.ListWebhookDeliveries(ctx, mine, 10)
+		if err != nil || len(deliveries) != 2 {
+			t.Fatalf("deliveries = %d (%v), want 2", len(deliveries), err)
+		}
+		if d := deliveries[1]; d.ID != first || d.EmailID != "e1" || d.Status != WebhookSucceeded || d.Attempts != 2 || d.ResponseCode != 204 {
+			t.Errorf("oldest delivery = %+v", d)
+		}
+		if deliveries, _ := st.ListWebhookDeliveries(ctx, mine, 1); len(deliveries) != 1 || deliveries[0].EmailID != "e2" {
+			t.Errorf("limited deliveries = %+v, want the newest", deliveries)
+		}
 
-	if id1 == id2 {
-		t.Errorf("expected unique IDs, got %q twice", id1)
-	}
+		if err := st.DeleteWebhook(ctx, mine); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if err := st.DeleteWebhook(ctx, mine); !errors.Is(err, ErrWebhookNotFound) {
+			t.Errorf("deleting a deleted webhook: %v, want ErrWebhookNotFound", err)
+		}
+		if deliveries, _ := st.ListWebhookDeliveries(ctx, mine, 10); len(deliveries) != 0 {
+			t.Errorf("deliveries of a deleted webhook = %d, want 0", len(deliveries))
+		}
+	})
 }
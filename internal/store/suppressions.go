@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Reasons an address is on the suppression list.
+const (
+	SuppressionBounced      = "bounced"      // mail to it bounced permanently
+	SuppressionComplained   = "complained"   // its owner reported mail as spam
+	SuppressionUnsubscribed = "unsubscribed" // its owner asked not to be mailed
+)
+
+// Suppression is an address outbound mail must not be sent to. Entries are
+// kept until removed.
+type Suppression struct {
+	Address   string // lower-cased
+	Reason    string // SuppressionBounced | SuppressionComplained | SuppressionUnsubscribed
+	Note      string // e.g. the bounce's status and diagnostic
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+const suppressionColumns = `address, reason, note, created_by, created_at`
+
+// AddSuppression records e, replacing any entry for the same address. The
+// address is stored lower-cased; a zero CreatedAt means now.
+func (s *Store) AddSuppression(ctx context.Context, e Suppression) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO suppressions (`+suppressionColumns+`) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (address) DO UPDATE SET reason = excluded.reason, note = excluded.note,
+		 created_by = excluded.created_by, created_at = excluded.created_at`,
+		strings.ToLower(e.Address), e.Reason, e.Note, e.CreatedBy, e.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("upsert suppression: %w", err)
+	}
+	return nil
+}
+
+// Suppressed returns the entries of those of addresses, compared
+// case-insensitively, that are on the suppression list, in the order given.
+func (s *Store) Suppressed(ctx context.Context, addresses []string) ([]Suppression, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var entries []Suppression
+	for _, a := range addresses {
+		e, err := scanSuppression(s.db.QueryRowContext(ctx,
+			`SELECT `+suppressionColumns+` FROM suppressions WHERE address = ?`, strings.ToLower(a),
+		))
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("query suppression: %w", err)
+		}
+		entries = append(entries, *e)
+	}
+	return entries, nil
+}
+
+// ListSuppressions returns every suppressed address, the most recently added
+// first.
+func (s *Store) ListSuppressions(ctx context.Context) ([]Suppression, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+suppressionColumns+` FROM suppressions ORDER BY created_at DESC, address`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query suppressions: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var entries []Suppression
+	for rows.Next() {
+		e, err := scanSuppression(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan suppression: %w", err)
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteSuppression removes address from the suppression list.
+func (s *Store) DeleteSuppression(ctx context.Context, address string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM suppressions WHERE address = ?`, strings.ToLower(address))
+	if err != nil {
+		return fmt.Errorf("delete suppression: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("suppression not found: %s", address)
+	}
+	return nil
+}
+
+func scanSuppression(row rowScanner) (*Suppression, error) {
+	var e Suppression
+	if err := row.Scan(&e.Address, &e.Reason, &e.Note, &e.CreatedBy, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UnsubscribeLink is the List-Unsubscribe URL of a relayed outbound email
+// for its recipient. Links outlive their email, so a recipient can still
+// unsubscribe once it has been relayed and deleted. A recipient who used any
+// of their links is opted out.
+type UnsubscribeLink struct {
+	ID             string // the token in the unsubscribe URL
+	Address        string // the recipient, lower-cased
+	EmailID        string
+	Subject        string // of the email, kept for the rules page
+	CreatedAt      time.Time
+	UnsubscribedAt time.Time // zero until the recipient unsubscribes
+}
+
+const unsubscribeColumns = `id, address, email_id, subject, created_at, unsubscribed_at`
+
+// AddUnsubscribeLinks stores links, skipping those whose ID is already
+// stored, so an email relayed again keeps its links. A zero CreatedAt means
+// now.
+func (s *Store) AddUnsubscribeLinks(ctx context.Context, links []UnsubscribeLink) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	for _, l := range links {
+		if l.CreatedAt.IsZero() {
+			l.CreatedAt = now
+		}
+		if _, err := s.db.ExecContext(ctx,
+			`INSERT OR IGNORE INTO unsubscribe_links (id, address, email_id, subject, created_at) VALUES (?, ?, ?, ?, ?)`,
+			l.ID, strings.ToLower(l.Address), l.EmailID, l.Subject, l.CreatedAt.UTC(),
+		); err != nil {
+			return fmt.Errorf("insert unsubscribe link: %w", err)
+		}
+	}
+	return nil
+}
+
+// Unsubscribe opts out the recipient of the unsubscribe link with the given
+// ID at the given time, and returns the link, or nil if there is none.
+// Unsubscribing again keeps the first time.
+func (s *Store) Unsubscribe(ctx context.Context, id string, at time.Time) (*UnsubscribeLink, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	l, err := scanUnsubscribeLink(s.db.QueryRowContext(ctx,
+		`UPDATE unsubscribe_links SET unsubscribed_at = COALESCE(unsubscribed_at, ?) WHERE id = ?
+		 RETURNING `+unsubscribeColumns,
+		at.UTC(), id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unsubscribe: %w", err)
+	}
+	return l, nil
+}
+
+// OptedOut returns those of addresses, compared case-insensitively, whose
+// recipient has unsubscribed, as given.
+func (s *Store) OptedOut(ctx context.Context, addresses []string) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var out []string
+	for _, a := range addresses {
+		var n int
+		if err := s.db.QueryRowContext(ctx,
+			`SELECT COUNT(*) FROM unsubscribe_links WHERE address = ? AND unsubscribed_at IS NOT NULL`, strings.ToLower(a),
+		).Scan(&n); err != nil {
+			return nil, fmt.Errorf("query opt-outs: %w", err)
+		}
+		if n > 0 {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+// ListOptOuts returns, for each opted-out recipient, the link they last
+// unsubscribed with, the most recent first.
+func (s *Store) ListOptOuts(ctx context.Context) ([]UnsubscribeLink, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+unsubscribeColumns+` FROM unsubscribe_links WHERE unsubscribed_at IS NOT NULL
+		 ORDER BY unsubscribed_at DESC, created_at DESC`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query opt-outs: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var links []UnsubscribeLink
+	seen := make(map[string]bool)
+	for rows.Next() {
+		l, err := scanUnsubscribeLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan opt-out: %w", err)
+		}
+		if !seen[l.Address] {
+			seen[l.Address] = true
+			links = append(links, *l)
+		}
+	}
+	return links, rows.Err()
+}
+
+// Resubscribe removes address's opt-out, so mail to it is sent again. It
+// returns an error if the address has not unsubscribed.
+func (s *Store) Resubscribe(ctx context.Context, address string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE unsubscribe_links SET unsubscribed_at = NULL WHERE address = ? AND unsubscribed_at IS NOT NULL`,
+		strings.ToLower(address),
+	)
+	if err != nil {
+		return fmt.Errorf("resubscribe: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no opt-out for %s", address)
+	}
+	return nil
+}
+
+func scanUnsubscribeLink(row rowScanner) (*UnsubscribeLink, error) {
+	var l UnsubscribeLink
+	var unsubscribedAt sql.NullTime
+	if err := row.Scan(&l.ID, &l.Address, &l.EmailID, &l.Subject, &l.CreatedAt, &unsubscribedAt); err != nil {
+		return nil, err
+	}
+	l.UnsubscribedAt = unsubscribedAt.Time
+	return &l, nil
+}
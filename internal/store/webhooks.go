@@ -0,0 +1,233 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook is an endpoint an API token registered to be told about events,
+// such as decisions on held emails. See package webhooks.
+type Webhook struct {
+	ID        string
+	TokenID   string // the API token that registered it and may manage it
+	URL       string
+	Events    []string // event types delivered; empty means every type
+	Direction string   // only events about emails in this direction; empty means both
+	CreatedAt time.Time
+}
+
+// Webhook delivery statuses.
+const (
+	WebhookPending   = "pending"   // queued, or waiting to be retried
+	WebhookSucceeded = "succeeded" // the endpoint answered 2xx
+	WebhookFailed    = "failed"    // out of attempts
+)
+
+// WebhookDelivery is one event sent, or being sent, to a Webhook. Deliveries
+// are deleted with their webhook.
+type WebhookDelivery struct {
+	ID           string
+	WebhookID    string
+	Event        string // event type
+	EmailID      string // the email the event is about; empty if none
+	Status       string // WebhookPending | WebhookSucceeded | WebhookFailed
+	Attempts     int    // requests made so far
+	ResponseCode int    // HTTP status of the latest attempt; 0 if it got no response
+	LastError    string // error of the latest failed attempt
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// ErrWebhookNotFound is returned for a webhook or delivery that does not
+// exist.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// CreateWebhook stores w, assigning it a UUID. A zero CreatedAt means now.
+func (s *Store) CreateWebhook(ctx context.Context, w Webhook) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	id := uuid.New().String()
+	eventsJSON, err := json.Marshal(w.Events)
+	if err != nil {
+		return "", fmt.Errorf("marshal events: %w", err)
+	}
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = time.Now().UTC()
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO webhooks (id, token_id, url, events, direction, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, w.TokenID, w.URL, string(eventsJSON), w.Direction, w.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert webhook: %w", err)
+	}
+	return id, nil
+}
+
+// webhookColumns is the column list scanned by scanWebhook, in order.
+const webhookColumns = `id, token_id, url, events, direction, created_at`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var w Webhook
+	var eventsJSON string
+	if err := row.Scan(&w.ID, &w.TokenID, &w.URL, &eventsJSON, &w.Direction, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(eventsJSON), &w.Events); err != nil {
+		return nil, fmt.Errorf("unmarshal events: %w", err)
+	}
+	return &w, nil
+}
+
+// ListWebhooks returns the webhooks of an API token, or every webhook if
+// tokenID is empty, oldest first.
+func (s *Store) ListWebhooks(ctx context.Context, tokenID string) ([]Webhook, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+webhookColumns+` FROM webhooks WHERE ? = '' OR token_id = ? ORDER BY created_at, id`, tokenID, tokenID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query webhooks: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, *w)
+	}
+	return webhooks, rows.Err()
+}
+
+// GetWebhook returns the webhook with the given ID, or nil if there is none.
+func (s *Store) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	w, err := scanWebhook(s.db.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query webhook: %w", err)
+	}
+	return w, nil
+}
+
+// DeleteWebhook deletes a webhook and its deliveries, returning
+// ErrWebhookNotFound if there is no such webhook.
+func (s *Store) DeleteWebhook(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete webhook: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return fmt.Errorf("delete webhook deliveries: %w", err)
+	}
+	return tx.Commit()
+}
+
+// AddWebhookDelivery stores d, assigning it a UUID. A zero CreatedAt means
+// now and a zero UpdatedAt means CreatedAt.
+func (s *Store) AddWebhookDelivery(ctx context.Context, d WebhookDelivery) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	id := uuid.New().String()
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now().UTC()
+	}
+	if d.UpdatedAt.IsZero() {
+		d.UpdatedAt = d.CreatedAt
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries (id, webhook_id, event, email_id, status, attempts, response_code, last_error, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, d.WebhookID, d.Event, d.EmailID, d.Status, d.Attempts, d.ResponseCode, d.LastError, d.CreatedAt.UTC(), d.UpdatedAt.UTC(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert webhook delivery: %w", err)
+	}
+	return id, nil
+}
+
+// UpdateWebhookDelivery records the outcome of an attempt at delivery d.ID:
+// its status, attempts, response code, last error and UpdatedAt (now if
+// zero). It returns ErrWebhookNotFound if there is no such delivery.
+func (s *Store) UpdateWebhookDelivery(ctx context.Context, d WebhookDelivery) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if d.UpdatedAt.IsZero() {
+		d.UpdatedAt = time.Now().UTC()
+	}
+	res, err := s.db.ExecContext(ctx,
+		`UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, last_error = ?, updated_at = ? WHERE id = ?`,
+		d.Status, d.Attempts, d.ResponseCode, d.LastError, d.UpdatedAt.UTC(), d.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("update webhook delivery: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the most recent deliveries to a webhook,
+// newest first, up to limit.
+func (s *Store) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, webhook_id, event, email_id, status, attempts, response_code, last_error, created_at, updated_at
+		 FROM webhook_deliveries WHERE webhook_id = ? ORDER BY created_at DESC, rowid DESC LIMIT ?`, webhookID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query webhook deliveries: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.EmailID, &d.Status, &d.Attempts, &d.ResponseCode, &d.LastError, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
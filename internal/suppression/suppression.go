@@ -0,0 +1,112 @@
+// Package suppression keeps outbound mail from reaching addresses on the
+// suppression list: addresses that bounced, complained or unsubscribed.
+// Entries are added by reviewers, through the API, and from the permanent
+// failures in delivery status notifications.
+package suppression
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/albert/mailescrow/internal/dsn"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// What happens to mail to a suppressed address.
+const (
+	ActionHold   = "hold"   // keep it for review, flagged suppressed
+	ActionRefuse = "refuse" // reject the submission, and refuse to approve it
+)
+
+// BounceReviewer is who suppression list entries added from bounces are
+// created by.
+const BounceReviewer = "dsn"
+
+// List checks recipients against the suppression list.
+type List struct {
+	st store.ReadWriter
+
+	mu     sync.Mutex
+	action string
+}
+
+// New creates a List. An empty action defaults to ActionHold.
+func New(st store.ReadWriter, action string) (*List, error) {
+	l := &List{st: st}
+	if err := l.SetAction(action); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetAction replaces the action, e.g. on a configuration reload.
+func (l *List) SetAction(action string) error {
+	switch action {
+	case "":
+		action = ActionHold
+	case ActionHold, ActionRefuse:
+	default:
+		return fmt.Errorf("unknown suppression action %q", action)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.action = action
+	return nil
+}
+
+// Result describes recipients checked against the suppression list.
+type Result struct {
+	Suppressed []store.Suppression // the entries of the suppressed recipients
+	Refuse     bool                // some are, and the configured action is to refuse
+}
+
+// Check looks up recipients on the suppression list. A nil List suppresses
+// nothing.
+func (l *List) Check(ctx context.Context, recipients []string) (Result, error) {
+	if l == nil {
+		return Result{}, nil
+	}
+	entries, err := l.st.Suppressed(ctx, recipients)
+	if err != nil {
+		return Result{}, fmt.Errorf("check suppression list: %w", err)
+	}
+	l.mu.Lock()
+	action := l.action
+	l.mu.Unlock()
+	return Result{Suppressed: entries, Refuse: len(entries) > 0 && action == ActionRefuse}, nil
+}
+
+// Addresses returns the suppressed addresses, e.g. for an error message.
+func (r Result) Addresses() string {
+	addrs := make([]string, 0, len(r.Suppressed))
+	for _, e := range r.Suppressed {
+		addrs = append(addrs, e.Address+" ("+e.Reason+")")
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// AddBounces adds the recipients report says bounced permanently to the
+// suppression list and returns how many it added. A nil List adds nothing.
+func (l *List) AddBounces(ctx context.Context, report *dsn.Report) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+	bounced := report.Bounced()
+	for _, rcpt := range bounced {
+		note := rcpt.Status
+		if rcpt.Diagnostic != "" {
+			note += ": " + rcpt.Diagnostic
+		}
+		if err := l.st.AddSuppression(ctx, store.Suppression{
+			Address:   rcpt.Address,
+			Reason:    store.SuppressionBounced,
+			Note:      note,
+			CreatedBy: BounceReviewer,
+		}); err != nil {
+			return 0, fmt.Errorf("suppress %s: %w", rcpt.Address, err)
+		}
+	}
+	return len(bounced), nil
+}
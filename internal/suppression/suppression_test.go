@@ -0,0 +1,66 @@
+package suppression
+
+import (
+	"testing"
+
+	"github.com/albert/mailescrow/internal/dsn"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestCheck(t *testing.T) {
+	st := store.NewMemory()
+	if err := st.AddSuppression(t.Context(), store.Suppression{Address: "bob@example.org", Reason: store.SuppressionComplained}); err != nil {
+		t.Fatalf("add suppression: %v", err)
+	}
+	l, err := New(st, "")
+	if err != nil {
+		t.Fatalf("new list: %v", err)
+	}
+
+	res, err := l.Check(t.Context(), []string{"alice@example.org", "Bob@example.org"})
+	if err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if len(res.Suppressed) != 1 || res.Refuse || res.Addresses() != "bob@example.org (complained)" {
+		t.Errorf("check with hold = %+v, want bob suppressed and held", res)
+	}
+	if err := l.SetAction(ActionRefuse); err != nil {
+		t.Fatalf("set action: %v", err)
+	}
+	if res, _ := l.Check(t.Context(), []string{"bob@example.org"}); !res.Refuse {
+		t.Errorf("check with refuse = %+v, want refused", res)
+	}
+	if res, _ := l.Check(t.Context(), []string{"alice@example.org"}); res.Refuse || len(res.Suppressed) != 0 {
+		t.Errorf("check of unlisted recipient = %+v", res)
+	}
+	if err := l.SetAction("drop"); err == nil {
+		t.Error("unknown action accepted")
+	}
+
+	var none *List
+	if res, err := none.Check(t.Context(), []string{"bob@example.org"}); err != nil || len(res.Suppressed) != 0 {
+		t.Errorf("nil list check = %+v, %v; want nothing suppressed", res, err)
+	}
+}
+
+func TestAddBounces(t *testing.T) {
+	st := store.NewMemory()
+	l, err := New(st, ActionHold)
+	if err != nil {
+		t.Fatalf("new list: %v", err)
+	}
+	report := &dsn.Report{EnvelopeID: "e1", Recipients: []dsn.Recipient{
+		{Address: "bob@example.org", Action: "failed", Status: "5.1.1", Diagnostic: "smtp; 550 no such user"},
+		{Address: "carol@example.org", Action: "failed", Status: "4.4.7"},
+		{Address: "dave@example.org", Action: "delivered", Status: "2.0.0"},
+	}}
+	n, err := l.AddBounces(t.Context(), report)
+	if err != nil || n != 1 {
+		t.Fatalf("add bounces = %d, %v; want 1", n, err)
+	}
+	list, _ := st.ListSuppressions(t.Context())
+	if len(list) != 1 || list[0].Address != "bob@example.org" || list[0].Reason != store.SuppressionBounced ||
+		list[0].Note != "5.1.1: smtp; 550 no such user" || list[0].CreatedBy != BounceReviewer {
+		t.Errorf("suppressions = %+v, want bob bounced", list)
+	}
+}
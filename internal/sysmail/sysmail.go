@@ -0,0 +1,151 @@
+// Package sysmail sends the mail mailescrow generates itself, such as bounces
+// and reviewer notifications, straight through the relay: it is never held
+// for review, tracked or journaled.
+//
+// Each message is stamped with a header carrying an expiry and a keyed
+// signature of the message below the stamp, headers and body, and of its
+// envelope recipients. Should one come back in, say because a reviewer
+// address is the monitored mailbox or the relay hands it to mailescrow's own
+// SMTP listener, intake recognises it instead of escrowing it, which would
+// otherwise notify reviewers about their own notifications. Bounces go to
+// outside senders, so the stamp is only good for the message it was made
+// for, sent to the same recipients, until it expires: copied onto anything
+// else it is ignored. The key is made at startup, so mail sent before a
+// restart that comes back after it is held like any other.
+package sysmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Header marks system mail: its kind and signature.
+const Header = "X-Mailescrow-System"
+
+// Kinds of system mail.
+const (
+	KindBounce = "bounce"
+	KindReview = "review"
+)
+
+// ReviewerPrefix starts the reviewer recorded for system mail recognised on
+// intake, followed by its kind.
+const ReviewerPrefix = "system:"
+
+// StampLifetime is how long after it is sent system mail is recognised.
+const StampLifetime = 24 * time.Hour
+
+// Mailer sends system mail and recognises it when it comes back.
+type Mailer struct {
+	next relay.Sender
+	key  []byte
+	now  func() time.Time
+}
+
+// New creates a Mailer sending through next, normally the bare relay.
+func New(next relay.Sender) *Mailer {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key) // never fails
+	return &Mailer{next: next, key: key, now: time.Now}
+}
+
+// Sender returns a relay.Sender for system mail of the given kind.
+func (m *Mailer) Sender(kind string) relay.Sender {
+	return &sender{m: m, kind: kind}
+}
+
+type sender struct {
+	m    *Mailer
+	kind string
+}
+
+// Send stamps email as system mail and relays it.
+func (s *sender) Send(ctx context.Context, email *store.Email) error {
+	stamped := *email
+	expires := s.m.now().Add(StampLifetime).Unix()
+	stamp := fmt.Sprintf("%s: %s; %d; %s\r\n", Header, s.kind, expires, s.m.sign(s.kind, expires, email.Recipients, email.RawMessage))
+	stamped.RawMessage = append([]byte(stamp), email.RawMessage...)
+	if err := s.m.next.Send(ctx, &stamped); err != nil {
+		return err
+	}
+	email.EnvelopeID = stamped.EnvelopeID
+	log.Printf("System mail (%s) to %s sent directly, bypassing escrow", s.kind, strings.Join(email.Recipients, ", "))
+	return nil
+}
+
+// Check returns the kind of system mail raw is, or "" if it is not system
+// mail this Mailer sent to rcpts, its envelope recipients, in the last
+// StampLifetime, unchanged below its stamp. m may be nil, recognising
+// nothing.
+func (m *Mailer) Check(raw []byte, rcpts []string) string {
+	if m == nil {
+		return ""
+	}
+	value, rest, ok := cutStamp(raw)
+	if !ok {
+		return ""
+	}
+	fields := strings.Split(value, ";")
+	if len(fields) != 3 {
+		return ""
+	}
+	kind, sig := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[2])
+	expires, err := strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+	if err != nil || kind == "" || m.now().Unix() > expires {
+		return ""
+	}
+	if !hmac.Equal([]byte(sig), []byte(m.sign(kind, expires, rcpts, rest))) {
+		return ""
+	}
+	return kind
+}
+
+// cutStamp finds the first stamp in raw's header and returns its value and
+// the message below it. Trace headers added above it on the way back in do
+// not matter.
+func cutStamp(raw []byte) (string, []byte, bool) {
+	prefix := strings.ToLower(Header) + ":"
+	for rest := raw; len(rest) > 0; {
+		line, next, _ := bytes.Cut(rest, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break // end of the header
+		}
+		if len(line) > len(prefix) && strings.ToLower(string(line[:len(prefix)])) == prefix {
+			return string(line[len(prefix):]), next, true
+		}
+		rest = next
+	}
+	return "", nil, false
+}
+
+// sign returns the signature of system mail of the given kind expiring at
+// expires, a Unix time, sent to rcpts: a MAC over those and a digest of
+// raw, the message below the stamp, with line endings normalized.
+func (m *Mailer) sign(kind string, expires int64, rcpts []string, raw []byte) string {
+	addrs := make([]string, len(rcpts))
+	for i, rcpt := range rcpts {
+		addrs[i] = strings.ToLower(strings.TrimSpace(rcpt))
+	}
+	slices.Sort(addrs)
+	addrs = slices.Compact(addrs)
+	digest := sha256.Sum256(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")))
+
+	mac := hmac.New(sha256.New, m.key)
+	fmt.Fprintf(mac, "%s\x00%d\x00%s\x00", kind, expires, strings.Join(addrs, "\x00"))
+	mac.Write(digest[:])
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
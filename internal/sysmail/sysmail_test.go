@@ -0,0 +1,134 @@
+package sysmail
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeSender struct {
+	sent []*store.Email
+	err  error
+}
+
+func (f *fakeSender) Send(_ context.Context, email *store.Email) error {
+	if f.err != nil {
+		return f.err
+	}
+	email.EnvelopeID = "env-1"
+	f.sent = append(f.sent, email)
+	return nil
+}
+
+const notification = "Message-Id: <n1@mailescrow>\r\nFrom: escrow@example.com\r\nSubject: [mailescrow] 1 new email waiting for review\r\n\r\nbody\r\n"
+
+func send(t *testing.T, m *Mailer, next *fakeSender, kind, raw string) []byte {
+	t.Helper()
+	email := &store.Email{Direction: store.DirectionOutbound, Recipients: []string{"reviewers@example.com"}, RawMessage: []byte(raw)}
+	if err := m.Sender(kind).Send(t.Context(), email); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if string(email.RawMessage) != raw {
+		t.Error("the original email was modified")
+	}
+	if email.EnvelopeID != "env-1" {
+		t.Errorf("envelope ID = %q, want the relay's", email.EnvelopeID)
+	}
+	return next.sent[len(next.sent)-1].RawMessage
+}
+
+var reviewers = []string{"reviewers@example.com"}
+
+func TestRecognisesOwnMail(t *testing.T) {
+	next := &fakeSender{}
+	m := New(next)
+	sent := send(t, m, next, KindReview, notification)
+	if !strings.HasPrefix(string(sent), Header+": review; ") || !strings.HasSuffix(string(sent), notification) {
+		t.Fatalf("sent:\n%s", sent)
+	}
+	if kind := m.Check(sent, reviewers); kind != KindReview {
+		t.Errorf("kind = %q, want review", kind)
+	}
+	// Trace headers added on the way back in, the case of the addresses
+	// and line endings do not matter.
+	if kind := m.Check(append([]byte("Received: from relay.example.com\r\n"), sent...), reviewers); kind != KindReview {
+		t.Errorf("kind with a Received header = %q, want review", kind)
+	}
+	if kind := m.Check([]byte(strings.ReplaceAll(string(sent), "\r\n", "\n")), []string{"Reviewers@Example.com"}); kind != KindReview {
+		t.Errorf("kind with LF line endings = %q, want review", kind)
+	}
+	if kind := m.Check([]byte(notification), reviewers); kind != "" {
+		t.Errorf("kind of unstamped mail = %q, want none", kind)
+	}
+}
+
+func TestRejectsForgedStamps(t *testing.T) {
+	next := &fakeSender{}
+	m := New(next)
+	sent := string(send(t, m, next, KindBounce, notification))
+	stamp, _, _ := strings.Cut(sent, "\r\n")
+
+	for name, raw := range map[string]string{
+		"other kind":       strings.Replace(sent, "bounce;", "review;", 1),
+		"other message id": strings.Replace(sent, "<n1@mailescrow>", "<n2@mailescrow>", 1),
+		"other subject":    strings.Replace(sent, "1 new email", "2 new emails", 1),
+		"other body":       strings.Replace(sent, "body", "click here", 1),
+		"added header":     strings.Replace(sent, "Subject:", "Reply-To: eve@example.org\r\nSubject:", 1),
+		"copied stamp":     stamp + "\r\nMessage-Id: <n1@mailescrow>\r\nFrom: eve@example.org\r\nSubject: Hi\r\n\r\nspam\r\n",
+		"no signature":     Header + ": bounce\r\n" + notification,
+	} {
+		if kind := m.Check([]byte(raw), reviewers); kind != "" {
+			t.Errorf("%s: kind = %q, want none", name, kind)
+		}
+	}
+	if kind := m.Check([]byte(sent), []string{"eve@example.org"}); kind != "" {
+		t.Errorf("kind for other recipients = %q, want none", kind)
+	}
+	if kind := m.Check([]byte(sent), append(reviewers, "eve@example.org")); kind != "" {
+		t.Errorf("kind for an added recipient = %q, want none", kind)
+	}
+	// Another instance, or this one after a restart, has another key.
+	if kind := New(next).Check([]byte(sent), reviewers); kind != "" {
+		t.Errorf("kind under another key = %q, want none", kind)
+	}
+	var none *Mailer
+	if kind := none.Check([]byte(sent), reviewers); kind != "" {
+		t.Errorf("nil Mailer recognised %q", kind)
+	}
+}
+
+func TestStampExpires(t *testing.T) {
+	next := &fakeSender{}
+	m := New(next)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	sent := send(t, m, next, KindBounce, notification)
+
+	m.now = func() time.Time { return now.Add(StampLifetime - time.Minute) }
+	if kind := m.Check(sent, reviewers); kind != KindBounce {
+		t.Errorf("kind before expiry = %q, want bounce", kind)
+	}
+	m.now = func() time.Time { return now.Add(StampLifetime + time.Minute) }
+	if kind := m.Check(sent, reviewers); kind != "" {
+		t.Errorf("kind after expiry = %q, want none", kind)
+	}
+	// Moving the expiry breaks the signature.
+	later := strconv.FormatInt(now.Add(2*StampLifetime).Unix(), 10)
+	forged := regexp.MustCompile(`; [0-9]+;`).ReplaceAll(sent, []byte("; "+later+";"))
+	if kind := m.Check(forged, reviewers); kind != "" {
+		t.Errorf("kind with a later expiry = %q, want none", kind)
+	}
+}
+
+func TestReturnsSendErrors(t *testing.T) {
+	next := &fakeSender{err: errors.New("421 try again later")}
+	if err := New(next).Sender(KindBounce).Send(t.Context(), &store.Email{RawMessage: []byte(notification)}); err == nil {
+		t.Error("expected the relay's error")
+	}
+}
@@ -0,0 +1,128 @@
+// Package textdiff compares two versions of a text line by line, to show
+// reviewers what an edit of an email changed.
+package textdiff
+
+import "strings"
+
+// Op is what happened to a line.
+type Op string
+
+// Ops of a Line.
+const (
+	Equal  Op = "equal"  // in both versions
+	Delete Op = "delete" // only in the old version
+	Insert Op = "insert" // only in the new version
+)
+
+// Line is a line of a diff, without its line ending.
+type Line struct {
+	Op   Op
+	Text string
+}
+
+// maxCells bounds the table Lines fills to find the longest common
+// subsequence of the changed lines. Beyond it the old lines are shown as
+// deleted and the new ones as inserted, which is correct if not minimal.
+const maxCells = 1 << 22
+
+// Lines returns the diff of before and after: every line of both, in order,
+// each marked as kept, deleted or inserted. Lines end in LF or CRLF. Two
+// equal texts give only Equal lines.
+func Lines(before, after string) []Line {
+	a, b := split(before), split(after)
+
+	// Common leading and trailing lines need no table.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	diff := make([]Line, 0, len(a)+len(b))
+	for _, s := range a[:prefix] {
+		diff = append(diff, Line{Equal, s})
+	}
+	diff = append(diff, middle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, s := range a[len(a)-suffix:] {
+		diff = append(diff, Line{Equal, s})
+	}
+	return diff
+}
+
+// Changed reports whether diff has any deleted or inserted line.
+func Changed(diff []Line) bool {
+	for _, l := range diff {
+		if l.Op != Equal {
+			return true
+		}
+	}
+	return false
+}
+
+// middle diffs a and b through their longest common subsequence. Deleted
+// lines come before the lines inserted in their place.
+func middle(a, b []string) []Line {
+	var diff []Line
+	if len(a) == 0 || len(b) == 0 || len(a)*len(b) > maxCells {
+		for _, s := range a {
+			diff = append(diff, Line{Delete, s})
+		}
+		for _, s := range b {
+			diff = append(diff, Line{Insert, s})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, Line{Equal, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, Line{Delete, a[i]})
+			i++
+		default:
+			diff = append(diff, Line{Insert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, Line{Delete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, Line{Insert, b[j]})
+	}
+	return diff
+}
+
+// split returns the lines of s. A final line ending does not start another
+// line, and an empty s has none.
+func split(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,46 @@
+package textdiff
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		want          []Line
+	}{
+		{"equal", "a\nb\n", "a\r\nb", []Line{{Equal, "a"}, {Equal, "b"}}},
+		{"both empty", "", "", []Line{}},
+		{"added", "", "a", []Line{{Insert, "a"}}},
+		{"removed", "a\n", "", []Line{{Delete, "a"}}},
+		{"changed line", "Hi,\nsee you Monday.\nBob", "Hi,\nsee you Tuesday.\nBob", []Line{
+			{Equal, "Hi,"}, {Delete, "see you Monday."}, {Insert, "see you Tuesday."}, {Equal, "Bob"},
+		}},
+		{"moved and inserted", "a\nb\nc\nd", "a\nc\nx\nd\nb", []Line{
+			{Equal, "a"}, {Delete, "b"}, {Equal, "c"}, {Insert, "x"}, {Equal, "d"}, {Insert, "b"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lines(tt.before, tt.after)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Lines = %v, want %v", got, tt.want)
+			}
+			if Changed(got) != (tt.name != "equal" && tt.name != "both empty") {
+				t.Errorf("Changed = %v", Changed(got))
+			}
+		})
+	}
+}
+
+func TestLinesTooLong(t *testing.T) {
+	a := strings.Repeat("a\n", 3000)
+	b := strings.Repeat("b\n", 3000)
+	got := Lines("x\n"+a+"y", "x\n"+b+"y")
+	if len(got) != 6002 || got[0] != (Line{Equal, "x"}) || got[1].Op != Delete || got[3001].Op != Insert || got[6001] != (Line{Equal, "y"}) {
+		t.Errorf("Lines gave %d lines, starting %v", len(got), got[:3])
+	}
+}
@@ -0,0 +1,153 @@
+package tlsclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// selfSigned writes a self-signed certificate for localhost and its key as
+// PEM files in dir, returning their paths and the certificate.
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mail.internal"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile, keyFile = filepath.Join(dir, "mail.crt"), filepath.Join(dir, "mail.key")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+	return certFile, keyFile, cert
+}
+
+// handshake connects to a TLS server presenting cert, requiring a client
+// certificate signed by it, and returns the client's handshake error.
+func handshake(t *testing.T, cert tls.Certificate, cfg *tls.Config) error {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake()
+		_, _ = conn.Write([]byte("ok"))
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), ForHost(cfg, "localhost"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// TLS 1.3 reports a rejected client certificate on the first read.
+	_, err = conn.Read(make([]byte, 2))
+	return err
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := selfSigned(t, dir)
+
+	cfg, err := Load("1.3", certFile, certFile, keyFile, false)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 || cfg.InsecureSkipVerify {
+		t.Errorf("config = min version %x, insecure %v", cfg.MinVersion, cfg.InsecureSkipVerify)
+	}
+	if err := handshake(t, cert, cfg); err != nil {
+		t.Errorf("handshake trusting the CA with a client certificate: %v", err)
+	}
+
+	cfg, _ = Load("", "", certFile, keyFile, false)
+	if err := handshake(t, cert, cfg); err == nil {
+		t.Error("handshake with a self-signed server certificate and system roots succeeded")
+	}
+	cfg, _ = Load("", "", certFile, keyFile, true)
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("default min version = %x, want TLS 1.2", cfg.MinVersion)
+	}
+	if err := handshake(t, cert, cfg); err != nil {
+		t.Errorf("handshake skipping verification: %v", err)
+	}
+	cfg, _ = Load("", certFile, "", "", false)
+	if err := handshake(t, cert, cfg); err == nil {
+		t.Error("handshake without the required client certificate succeeded")
+	}
+}
+
+func TestLoadRejectsInvalidOptions(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := selfSigned(t, dir)
+	notPEM := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, args := range map[string][4]string{
+		"unknown version": {"1.4", "", "", ""},
+		"missing CA":      {"", filepath.Join(dir, "missing.pem"), "", ""},
+		"CA not PEM":      {"", notPEM, "", ""},
+		"cert only":       {"", "", certFile, ""},
+		"key mismatch":    {"", "", certFile, notPEM},
+		"key only":        {"", "", "", keyFile},
+	} {
+		if _, err := Load(args[0], args[1], args[2], args[3], false); err == nil {
+			t.Errorf("%s: Load succeeded, want an error", name)
+		}
+	}
+}
+
+func TestForHost(t *testing.T) {
+	if cfg := ForHost(nil, "smtp.internal"); cfg.ServerName != "smtp.internal" || cfg.RootCAs != nil {
+		t.Errorf("ForHost(nil) = %+v", cfg)
+	}
+	base := &tls.Config{MinVersion: tls.VersionTLS13}
+	cfg := ForHost(base, "imap.internal")
+	if cfg.ServerName != "imap.internal" || cfg.MinVersion != tls.VersionTLS13 || base.ServerName != "" {
+		t.Errorf("ForHost = %q, min %x; base server name %q, want it untouched", cfg.ServerName, cfg.MinVersion, base.ServerName)
+	}
+}
@@ -0,0 +1,184 @@
+// Package tokens issues and checks scoped API tokens. Only token hashes are
+// stored; every use and every change is written to the audit log.
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Scopes a token may be granted.
+const (
+	ScopeSend     = "send"     // submit outbound email
+	ScopeRead     = "read"     // fetch approved inbound email and the pending count
+	ScopeAnnotate = "annotate" // attach scanner findings to held emails
+	ScopeWebhooks = "webhooks" // register webhooks for decisions
+	ScopeAdmin    = "admin"    // manage tokens; implies every other scope
+)
+
+// Scopes lists all scopes in display order.
+var Scopes = []string{ScopeSend, ScopeRead, ScopeAnnotate, ScopeWebhooks, ScopeAdmin}
+
+// Audit actions recorded for token management.
+const (
+	ActionCreate = "token.create"
+	ActionRevoke = "token.revoke"
+	ActionDenied = "token.denied"
+)
+
+// prefix marks mailescrow tokens so they are recognisable in logs and secret scanners.
+const prefix = "mesc_"
+
+var (
+	// ErrInvalid is returned for unknown, revoked or expired tokens.
+	ErrInvalid = errors.New("invalid API token")
+	// ErrForbidden is returned when a valid token lacks the required scope.
+	ErrForbidden = errors.New("API token lacks the required scope")
+)
+
+// Manager creates, revokes and authenticates API tokens.
+type Manager struct {
+	st  store.ReadWriter
+	now func() time.Time
+}
+
+// New creates a Manager backed by st.
+func New(st store.ReadWriter) *Manager {
+	return &Manager{st: st, now: time.Now}
+}
+
+// Hash returns the stored form of a token.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Actor is how a token is named in the audit log.
+func Actor(t *store.APIToken) string {
+	return "token:" + t.Name
+}
+
+// Create issues a token with the given scopes, valid for ttl (0 means it
+// never expires). It returns the plaintext token, which is not stored.
+func (m *Manager) Create(ctx context.Context, name string, scopes []string, ttl time.Duration, createdBy string) (string, *store.APIToken, error) {
+	return m.CreateForProject(ctx, name, "", scopes, ttl, createdBy)
+}
+
+// CreateForProject is Create for a token whose submissions belong to
+// project, a tag: held mail is tagged with it and the project's limits
+// apply. An empty project is none.
+func (m *Manager) CreateForProject(ctx context.Context, name, project string, scopes []string, ttl time.Duration, createdBy string) (string, *store.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errors.New("token name is required")
+	}
+	if project = strings.TrimSpace(project); project != "" {
+		var err error
+		if project, err = store.NormalizeTag(project); err != nil {
+			return "", nil, fmt.Errorf("project: %w", err)
+		}
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return "", nil, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if ttl < 0 {
+		return "", nil, errors.New("expiry must not be negative")
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, fmt.Errorf("generate token: %w", err)
+	}
+	plaintext := prefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+
+	now := m.now().UTC()
+	t := &store.APIToken{
+		Name:      name,
+		Hash:      Hash(plaintext),
+		Scopes:    scopes,
+		Project:   project,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl)
+	}
+	id, err := m.st.CreateAPIToken(ctx, *t)
+	if err != nil {
+		return "", nil, err
+	}
+	t.ID = id
+	detail := fmt.Sprintf("%s (%s) scopes=%s", name, id, strings.Join(scopes, ","))
+	if project != "" {
+		detail += " project=" + project
+	}
+	m.audit(ctx, createdBy, ActionCreate, detail)
+	return plaintext, t, nil
+}
+
+// Revoke revokes the token with the given ID.
+func (m *Manager) Revoke(ctx context.Context, id, revokedBy string) error {
+	if err := m.st.RevokeAPIToken(ctx, id); err != nil {
+		return err
+	}
+	m.audit(ctx, revokedBy, ActionRevoke, id)
+	return nil
+}
+
+// List returns all tokens, newest first.
+func (m *Manager) List(ctx context.Context) ([]store.APIToken, error) {
+	return m.st.ListAPITokens(ctx)
+}
+
+// Authenticate checks that token is live and grants scope, records its use
+// as action in the audit log and updates its last-used time.
+func (m *Manager) Authenticate(ctx context.Context, token, scope, action string) (*store.APIToken, error) {
+	if !strings.HasPrefix(token, prefix) {
+		return nil, ErrInvalid
+	}
+	t, err := m.st.GetAPITokenByHash(ctx, Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	if t == nil || !t.RevokedAt.IsZero() || (!t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)) {
+		return nil, ErrInvalid
+	}
+	if !Allows(t, scope) {
+		m.audit(ctx, Actor(t), ActionDenied, action)
+		return nil, ErrForbidden
+	}
+	if err := m.st.TouchAPIToken(ctx, t.ID, now); err != nil {
+		log.Printf("touch API token %s: %v", t.ID, err)
+	}
+	m.audit(ctx, Actor(t), action, "")
+	return t, nil
+}
+
+// Allows reports whether t grants scope.
+func Allows(t *store.APIToken, scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+// audit records an entry, logging rather than failing on error.
+func (m *Manager) audit(ctx context.Context, actor, action, detail string) {
+	if err := m.st.RecordAudit(ctx, store.AuditEntry{At: m.now().UTC(), Actor: actor, Action: action, Detail: detail}); err != nil {
+		log.Printf("record audit entry %s: %v", action, err)
+	}
+}
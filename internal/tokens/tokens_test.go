@@ -0,0 +1,127 @@
+package tokens
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func newTestStore(t *testing.T) *store.Store {
+	t.Helper()
+	st, err := store.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func TestCreateAndAuthenticate(t *testing.T) {
+	st := newTestStore(t)
+	m := New(st)
+
+	token, created, err := m.Create(t.Context(), "agent", []string{ScopeSend}, 0, "alice")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(token, prefix) || created.Hash != Hash(token) || created.Hash == token {
+		t.Errorf("token %q stored as %q, want only the hash stored", token, created.Hash)
+	}
+
+	got, err := m.Authenticate(t.Context(), token, ScopeSend, "POST /api/emails")
+	if err != nil || got.ID != created.ID {
+		t.Fatalf("authenticate = %+v, %v", got, err)
+	}
+	if _, err := m.Authenticate(t.Context(), token, ScopeRead, "GET /api/emails"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("read with a send token: err = %v, want ErrForbidden", err)
+	}
+	if _, err := m.Authenticate(t.Context(), prefix+"bogus", ScopeSend, "POST /api/emails"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("unknown token: err = %v, want ErrInvalid", err)
+	}
+
+	list, _ := m.List(t.Context())
+	if len(list) != 1 || list[0].LastUsedAt.IsZero() {
+		t.Errorf("tokens = %+v, want last-used time recorded", list)
+	}
+	entries, _ := st.ListAudit(t.Context(), 10)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Actor+" "+e.Action)
+	}
+	if got := strings.Join(actions, "; "); got != "token:agent token.denied; token:agent POST /api/emails; alice token.create" {
+		t.Errorf("audit log = %s", got)
+	}
+
+	if err := m.Revoke(t.Context(), created.ID, "alice"); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := m.Authenticate(t.Context(), token, ScopeSend, "POST /api/emails"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("revoked token: err = %v, want ErrInvalid", err)
+	}
+}
+
+func TestExpiryAndAdminScope(t *testing.T) {
+	m := New(newTestStore(t))
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	token, created, err := m.Create(t.Context(), "ops", []string{ScopeAdmin}, time.Hour, "alice")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !created.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("expires at %v, want in one hour", created.ExpiresAt)
+	}
+	for _, scope := range Scopes {
+		if _, err := m.Authenticate(t.Context(), token, scope, "test"); err != nil {
+			t.Errorf("admin token denied scope %s: %v", scope, err)
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := m.Authenticate(t.Context(), token, ScopeRead, "test"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expired token: err = %v, want ErrInvalid", err)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	m := New(newTestStore(t))
+	tests := []struct {
+		name   string
+		scopes []string
+		ttl    time.Duration
+	}{
+		{"", []string{ScopeSend}, 0},
+		{"agent", nil, 0},
+		{"agent", []string{"root"}, 0},
+		{"agent", []string{ScopeSend}, -time.Hour},
+	}
+	for _, tt := range tests {
+		if _, _, err := m.Create(t.Context(), tt.name, tt.scopes, tt.ttl, "alice"); err == nil {
+			t.Errorf("Create(%q, %v, %v): expected error", tt.name, tt.scopes, tt.ttl)
+		}
+	}
+}
+
+func TestCreateForProject(t *testing.T) {
+	st := newTestStore(t)
+	m := New(st)
+
+	token, created, err := m.CreateForProject(t.Context(), "ci", " Billing ", []string{ScopeSend}, 0, "alice")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if created.Project != "billing" {
+		t.Errorf("project = %q, want it normalized like a tag", created.Project)
+	}
+	if got, err := m.Authenticate(t.Context(), token, ScopeSend, "test"); err != nil || got.Project != "billing" {
+		t.Errorf("authenticate = %+v, %v; want the token's project", got, err)
+	}
+	if _, _, err := m.CreateForProject(t.Context(), "ci", "no spaces", []string{ScopeSend}, 0, "alice"); err == nil {
+		t.Error("expected error for an invalid project")
+	}
+}
@@ -0,0 +1,56 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238, appendix B, truncated to six digits.
+func TestCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := Code(secret, Step(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := ParseSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	if err != nil {
+		t.Fatalf("ParseSecret: %v", err)
+	}
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	for _, s := range []int64{step - 1, step, step + 1} {
+		if got, ok := Validate(secret, Code(secret, s), now); !ok || got != s {
+			t.Errorf("code of step %d: matched %d, %v", s-step, got, ok)
+		}
+	}
+	for _, code := range []string{Code(secret, step-2), Code(secret, step+2), "12345", "abcdef", ""} {
+		if _, ok := Validate(secret, code, now); ok {
+			t.Errorf("Validate(%q) succeeded", code)
+		}
+	}
+}
+
+func TestParseSecret(t *testing.T) {
+	for _, s := range []string{"", "JBSWY3DP", "not base32!"} {
+		if _, err := ParseSecret(s); err == nil {
+			t.Errorf("ParseSecret(%q) succeeded", s)
+		}
+	}
+	if _, err := ParseSecret("JBSWY3DPEHPK3PXP===="); err != nil {
+		t.Errorf("padded secret: %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Package tracing exports OpenTelemetry spans over OTLP and provides the
+// helpers the other packages use to start spans of their own.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is reported as service.name on every exported span.
+const ServiceName = "mailescrow"
+
+const tracerName = "github.com/albert/mailescrow"
+
+// Setup installs a global tracer provider that samples sampleRatio of new
+// traces and exports them to the OTLP/HTTP endpoint (e.g.
+// "http://localhost:4318"). Incoming W3C trace context is honoured
+// regardless of the ratio. With an empty endpoint tracing stays disabled
+// and every span is a no-op. The returned function flushes pending spans.
+func Setup(ctx context.Context, endpoint string, sampleRatio float64) (shutdown func(context.Context) error, err error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("build resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// Start starts a span named name as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it. Call it deferred with a
+// named error result so every return path is covered.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler wraps h so each request gets a server span, continuing the trace
+// from the request's traceparent header. Spans are named after the matched
+// route pattern, e.g. "POST /email/{id}/approve"; server names the listener.
+func Handler(h http.Handler, server string) http.Handler {
+	return otelhttp.NewHandler(h, server, otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+		if r.Pattern != "" {
+			return r.Pattern
+		}
+		return operation + " " + r.Method
+	}))
+}
@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// record installs a tracer provider that keeps finished spans in memory.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	prev, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	return sr
+}
+
+func TestStartEnd(t *testing.T) {
+	sr := record(t)
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("boom"))
+	End(parent, nil)
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended %d spans, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Parent().SpanID() != p.SpanContext().SpanID() {
+		t.Errorf("child parent = %s, want %s", c.Parent().SpanID(), p.SpanContext().SpanID())
+	}
+	if c.Status().Code != codes.Error || c.Status().Description != "boom" {
+		t.Errorf("child status = %+v, want error boom", c.Status())
+	}
+	if p.Status().Code != codes.Unset {
+		t.Errorf("parent status = %+v, want unset", p.Status())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	sr := record(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /email/{id}/approve", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "relay.send")
+		span.End()
+	})
+	srv := httptest.NewServer(Handler(mux, "web"))
+	defer srv.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/email/42/approve", nil)
+	req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended %d spans, want 2", len(spans))
+	}
+	send, server := spans[0], spans[1]
+	if server.Name() != "POST /email/{id}/approve" {
+		t.Errorf("server span name = %q, want the route pattern", server.Name())
+	}
+	if got := server.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("trace ID = %s, want %s from traceparent", got, traceID)
+	}
+	if send.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("span started in handler is not a child of the server span")
+	}
+}
+
+func TestSetupDisabled(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+// Package tracking rewrites the links in approved outbound HTML mail through
+// mailescrow's click redirect, so clicks are counted per email. Tracking
+// never blocks delivery: if the links cannot be recorded, the message is
+// relayed as it was submitted.
+package tracking
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// ClickPath is the path of the click redirect on the web UI, followed by the
+// token of a tracked link.
+const ClickPath = "/click/"
+
+// Store records tracked links. store.EmailStore implements it.
+type Store interface {
+	TrackLinks(ctx context.Context, links []store.TrackedLink) error
+}
+
+// Sender wraps a relay.Sender and rewrites the http and https links of
+// outbound HTML mail to point at the click redirect before relaying it.
+//
+// Messages with a DKIM signature are relayed untouched: changing the body
+// would break it. So are signed or encrypted parts and HTML attachments.
+type Sender struct {
+	next relay.Sender
+	st   Store
+	base string // URL click links start with, ending in ClickPath
+}
+
+// New wraps next, tracking links through the web UI at publicURL.
+func New(next relay.Sender, st Store, publicURL string) *Sender {
+	return &Sender{next: next, st: st, base: strings.TrimSuffix(publicURL, "/") + ClickPath}
+}
+
+// Send records the links of email and relays it with them rewritten. If
+// they cannot be recorded, email is relayed as it is.
+func (s *Sender) Send(ctx context.Context, email *store.Email) error {
+	raw, links := s.rewrite(email)
+	if len(links) > 0 {
+		if err := s.st.TrackLinks(ctx, links); err != nil {
+			log.Printf("track links of email %s (relaying it untracked): %v", email.ID, err)
+			return s.next.Send(ctx, email)
+		}
+		tracked := *email
+		tracked.RawMessage = raw
+		email = &tracked
+	}
+	return s.next.Send(ctx, email)
+}
+
+// Preview returns the raw message as the wrapped sender transmits it, with
+// its links rewritten. Nothing is recorded.
+func (s *Sender) Preview(email *store.Email) []byte {
+	if raw, links := s.rewrite(email); len(links) > 0 {
+		tracked := *email
+		tracked.RawMessage = raw
+		email = &tracked
+	}
+	if p, ok := s.next.(relay.Previewer); ok {
+		return p.Preview(email)
+	}
+	return email.RawMessage
+}
+
+// rewrite returns the raw message of email with its links rewritten, and the
+// links to record. Inbound mail being forwarded is never tracked.
+func (s *Sender) rewrite(email *store.Email) ([]byte, []store.TrackedLink) {
+	if email.Direction != store.DirectionOutbound {
+		return email.RawMessage, nil
+	}
+	var links []store.TrackedLink
+	raw := rewriteMessage(email.RawMessage, func(link string) (string, bool) {
+		if !trackable(link) || strings.HasPrefix(link, s.base) {
+			return "", false
+		}
+		id := token(email.ID, link)
+		links = append(links, store.TrackedLink{ID: id, EmailID: email.ID, Subject: email.Subject, URL: link})
+		return s.base + id, true
+	})
+	return raw, links
+}
+
+// token returns the token of a link in an email. The same link in the same
+// email always gets the same token, so a message relayed again, journaled or
+// previewed carries the same URLs and its clicks add up.
+func token(emailID, link string) string {
+	sum := sha256.Sum256([]byte(emailID + "\x00" + link))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// trackable reports whether link is an absolute http or https URL.
+func trackable(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// trackFunc returns the URL replacing link, or false to leave it as it is.
+type trackFunc func(link string) (string, bool)
+
+// rewriteMessage returns raw with the links of its HTML parts replaced as
+// track says. Messages with a DKIM signature are returned unchanged.
+func rewriteMessage(raw []byte, track trackFunc) []byte {
+	header, _, ok := splitHeader(raw)
+	if !ok {
+		return raw
+	}
+	h, err := readHeader(header)
+	if err != nil || h.Get("Dkim-Signature") != "" {
+		return raw
+	}
+	return rewriteEntity(raw, track)
+}
+
+// rewriteEntity rewrites the links in a MIME entity, the whole message or
+// one of its parts. Headers are kept byte for byte; only the bodies of
+// text/html parts change, re-encoded as they were.
+func rewriteEntity(entity []byte, track trackFunc) []byte {
+	header, body, ok := splitHeader(entity)
+	if !ok {
+		return entity
+	}
+	h, err := readHeader(header)
+	if err != nil {
+		return entity
+	}
+	if disposition, _, _ := mime.ParseMediaType(h.Get("Content-Disposition")); disposition == "attachment" {
+		return entity
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return entity
+	}
+	switch {
+	case mediaType == "multipart/signed" || mediaType == "multipart/encrypted":
+		return entity
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		return append(bytes.Clone(header), rewriteMultipart(body, params["boundary"], track)...)
+	case mediaType != "text/html":
+		return entity
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+	doc, ok := decode(body, encoding)
+	if !ok {
+		return entity
+	}
+	doc, ok = rewriteHTML(doc, track)
+	if !ok {
+		return entity
+	}
+	eol := "\n"
+	if bytes.Contains(header, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	return append(bytes.Clone(header), encode(doc, encoding, eol, bytes.HasSuffix(body, []byte("\n")))...)
+}
+
+// splitHeader splits a MIME entity after the blank line ending its header.
+func splitHeader(entity []byte) (header, body []byte, ok bool) {
+	for pos := 0; pos < len(entity); {
+		end := bytes.IndexByte(entity[pos:], '\n')
+		if end < 0 {
+			break
+		}
+		line := entity[pos : pos+end+1]
+		pos += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return entity[:pos], entity[pos:], true
+		}
+	}
+	return nil, nil, false
+}
+
+func readHeader(header []byte) (textproto.MIMEHeader, error) {
+	return textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+}
+
+// rewriteMultipart rewrites the parts of a multipart body, keeping its
+// preamble, delimiter lines and epilogue byte for byte. A body without a
+// closing delimiter is returned unchanged.
+func rewriteMultipart(body []byte, boundary string, track trackFunc) []byte {
+	delim := []byte("--" + boundary)
+	var out bytes.Buffer
+	start := -1 // offset of the current part; -1 in the preamble
+	for pos := 0; pos < len(body); {
+		next := len(body)
+		if end := bytes.IndexByte(body[pos:], '\n'); end >= 0 {
+			next = pos + end + 1
+		}
+		line := body[pos:next]
+		if closing, ok := delimiter(line, delim); ok {
+			if start < 0 {
+				out.Write(body[:pos])
+			} else {
+				// The line break before a delimiter belongs to it.
+				part := body[start:pos]
+				content := bytes.TrimSuffix(bytes.TrimSuffix(part, []byte("\n")), []byte("\r"))
+				out.Write(rewriteEntity(content, track))
+				out.Write(part[len(content):])
+			}
+			out.Write(line)
+			if closing {
+				out.Write(body[next:])
+				return out.Bytes()
+			}
+			start = next
+		}
+		pos = next
+	}
+	return body
+}
+
+// delimiter reports whether line is a delimiter line of a multipart body,
+// and whether it is the closing one.
+func delimiter(line, delim []byte) (closing, ok bool) {
+	rest, found := bytes.CutPrefix(line, delim)
+	if !found {
+		return false, false
+	}
+	rest, closing = bytes.CutPrefix(rest, []byte("--"))
+	return closing, len(bytes.TrimRight(rest, " \t\r\n")) == 0
+}
+
+// decode undoes a Content-Transfer-Encoding. It returns false for unknown
+// encodings and malformed bodies.
+func decode(body []byte, encoding string) ([]byte, bool) {
+	var r io.Reader
+	switch encoding {
+	case "", "7bit", "8bit", "binary":
+		return body, true
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(body))
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body))
+	default:
+		return nil, false
+	}
+	decoded, err := io.ReadAll(r)
+	return decoded, err == nil
+}
+
+// encode applies a Content-Transfer-Encoding decode accepted, with eol line
+// breaks. trailingEOL ends a base64 body with a line break, as the original
+// was.
+func encode(doc []byte, encoding, eol string, trailingEOL bool) []byte {
+	var out bytes.Buffer
+	switch encoding {
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&out)
+		_, _ = w.Write(doc)
+		_ = w.Close()
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(doc)
+		for len(encoded) > 76 {
+			out.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		out.WriteString(encoded)
+		if trailingEOL {
+			out.WriteString("\r\n")
+		}
+	default:
+		return doc
+	}
+	if eol != "\r\n" {
+		return bytes.ReplaceAll(out.Bytes(), []byte("\r\n"), []byte(eol))
+	}
+	return out.Bytes()
+}
+
+// rewriteHTML replaces the href of every <a> and <area> tag in doc as track
+// says, leaving the rest of the document byte for byte. It returns false if
+// no link was replaced.
+func rewriteHTML(doc []byte, track trackFunc) ([]byte, bool) {
+	z := html.NewTokenizer(bytes.NewReader(doc))
+	var out bytes.Buffer
+	changed := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return doc, false
+			}
+			out.Write(z.Raw())
+			return out.Bytes(), changed
+		}
+		raw := z.Raw()
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+		raw = bytes.Clone(raw) // Token reuses the buffer
+		tok := z.Token()
+		replaced := false
+		if tok.DataAtom == atom.A || tok.DataAtom == atom.Area {
+			for i, a := range tok.Attr {
+				if a.Namespace != "" || a.Key != "href" {
+					continue
+				}
+				if link, ok := track(strings.TrimSpace(a.Val)); ok {
+					tok.Attr[i].Val = link
+					replaced = true
+				}
+			}
+		}
+		if !replaced {
+			out.Write(raw)
+			continue
+		}
+		out.WriteString(tok.String())
+		changed = true
+	}
+}
@@ -0,0 +1,184 @@
+package tracking
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeSender struct {
+	sent []*store.Email
+}
+
+func (f *fakeSender) Send(_ context.Context, email *store.Email) error {
+	f.sent = append(f.sent, email)
+	return nil
+}
+
+func (f *fakeSender) Preview(email *store.Email) []byte {
+	return append([]byte("X-Stamped: yes\r\n"), email.RawMessage...)
+}
+
+type fakeStore struct {
+	links []store.TrackedLink
+	err   error
+}
+
+func (f *fakeStore) TrackLinks(_ context.Context, links []store.TrackedLink) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.links = append(f.links, links...)
+	return nil
+}
+
+const multipartMessage = "From: app@example.com\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: Welcome\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"This is a multi-part message.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Start here: https://example.com/start\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p>Hi=C3=A9 <a class=3D\"btn\" href=3D\"https://example.com/start?a=3D1&amp;b=3D2\">Start</a>\r\n" +
+	"<a href=3D\"mailto:help@example.com\">Help</a> <a href=3D\"https://example.com/start?a=3D1&amp;b=3D2\">again</a></p>\r\n" +
+	"--b1--\r\n"
+
+func outbound(raw string) *store.Email {
+	return &store.Email{
+		ID:         "e1",
+		Direction:  store.DirectionOutbound,
+		Subject:    "Welcome",
+		Recipients: []string{"bob@example.com"},
+		RawMessage: []byte(raw),
+	}
+}
+
+// parts returns the text and HTML parts of raw.
+func parts(t *testing.T, raw []byte) (text, html string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return mimetext.Parts(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+func TestRewritesHTMLLinks(t *testing.T) {
+	next, st := &fakeSender{}, &fakeStore{}
+	s := New(next, st, "https://escrow.example.com/")
+	email := outbound(multipartMessage)
+	if err := s.Send(t.Context(), email); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if string(email.RawMessage) != multipartMessage {
+		t.Error("the original email was modified")
+	}
+
+	tok := token("e1", "https://example.com/start?a=1&b=2")
+	if len(st.links) != 2 || st.links[0] != (store.TrackedLink{ID: tok, EmailID: "e1", Subject: "Welcome", URL: "https://example.com/start?a=1&b=2"}) {
+		t.Fatalf("tracked links = %+v", st.links)
+	}
+	sent := next.sent[0].RawMessage
+	if !bytes.HasPrefix(sent, []byte(multipartMessage[:strings.Index(multipartMessage, "--b1\r\n")])) {
+		t.Errorf("headers or preamble changed:\n%s", sent)
+	}
+	text, html := parts(t, sent)
+	if text != "Start here: https://example.com/start" {
+		t.Errorf("text part = %q, want it untouched", text)
+	}
+	want := `<p>Hié <a class="btn" href="https://escrow.example.com/click/` + tok + `">Start</a>` + "\r\n" +
+		`<a href="mailto:help@example.com">Help</a> <a href="https://escrow.example.com/click/` + tok + `">again</a></p>`
+	if strings.TrimSpace(html) != want {
+		t.Errorf("HTML part = %q, want %q", html, want)
+	}
+
+	// Relaying again rewrites to the same URLs.
+	if err := s.Send(t.Context(), email); err != nil {
+		t.Fatalf("send again: %v", err)
+	}
+	if !bytes.Equal(next.sent[1].RawMessage, sent) {
+		t.Error("relaying again produced different links")
+	}
+}
+
+func TestRewritesBase64HTML(t *testing.T) {
+	next := &fakeSender{}
+	s := New(next, &fakeStore{}, "https://escrow.example.com")
+	raw := "Subject: Welcome\nContent-Type: text/html\nContent-Transfer-Encoding: base64\n\n" +
+		"PGEgaHJlZj0iaHR0cHM6Ly9leGFtcGxlLmNvbS8iPkdvPC9hPg==\n" // <a href="https://example.com/">Go</a>
+	if err := s.Send(t.Context(), outbound(raw)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	sent := next.sent[0].RawMessage
+	if bytes.Contains(sent, []byte("\r\n")) {
+		t.Errorf("line breaks changed:\n%q", sent)
+	}
+	_, html := parts(t, sent)
+	if want := `<a href="https://escrow.example.com/click/` + token("e1", "https://example.com/") + `">Go</a>`; html != want {
+		t.Errorf("HTML = %q, want %q", html, want)
+	}
+}
+
+func TestLeavesUntrackableMailAlone(t *testing.T) {
+	signed := "DKIM-Signature: v=1; d=example.com; s=sel; bh=x; b=y\r\nContent-Type: text/html\r\n\r\n<a href=\"https://example.com/\">Go</a>\r\n"
+	attachment := "Content-Type: text/html\r\nContent-Disposition: attachment; filename=page.html\r\n\r\n<a href=\"https://example.com/\">Go</a>\r\n"
+	plain := "Subject: Hi\r\n\r\nhttps://example.com/\r\n"
+	inbound := outbound(multipartMessage)
+	inbound.Direction = store.DirectionInbound
+
+	for name, email := range map[string]*store.Email{
+		"dkim signed": outbound(signed),
+		"attachment":  outbound(attachment),
+		"plain text":  outbound(plain),
+		"inbound":     inbound,
+	} {
+		t.Run(name, func(t *testing.T) {
+			next, st := &fakeSender{}, &fakeStore{}
+			if err := New(next, st, "https://escrow.example.com").Send(t.Context(), email); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			if next.sent[0] != email || len(st.links) != 0 {
+				t.Errorf("relayed %q with links %+v, want the email untouched", next.sent[0].RawMessage, st.links)
+			}
+		})
+	}
+}
+
+func TestRelaysUntrackedWhenStoreFails(t *testing.T) {
+	next := &fakeSender{}
+	s := New(next, &fakeStore{err: errors.New("database is locked")}, "https://escrow.example.com")
+	email := outbound(multipartMessage)
+	if err := s.Send(t.Context(), email); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(next.sent) != 1 || next.sent[0] != email {
+		t.Errorf("sent = %+v, want the email untouched", next.sent)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	st := &fakeStore{}
+	s := New(&fakeSender{}, st, "https://escrow.example.com")
+	preview := s.Preview(outbound(multipartMessage))
+	if !bytes.HasPrefix(preview, []byte("X-Stamped: yes\r\n")) || !bytes.Contains(preview, []byte("https://escrow.example.com/click/")) {
+		t.Errorf("preview = %s, want the stamped message with tracked links", preview)
+	}
+	if len(st.links) != 0 {
+		t.Errorf("preview recorded %d links, want none", len(st.links))
+	}
+}
@@ -0,0 +1,89 @@
+// Package trends rolls each finished day's mail up into daily counters. The
+// counters outlive the emails and decisions they count, so the stats page
+// shows trends beyond the retention periods.
+package trends
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Delay is how long after midnight UTC the nightly roll-up runs, so that
+// decisions made just before midnight have been recorded.
+const Delay = 5 * time.Minute
+
+// MaxCatchUp is how many days back RollUp goes at most, such as on the first
+// roll-up of a database that has been in use for years.
+const MaxCatchUp = 366
+
+// Store holds the records to count and the counters. store.EmailStore
+// implements it.
+type Store interface {
+	NextStatsDay(ctx context.Context) (time.Time, error)
+	RollUpStats(ctx context.Context, day time.Time) (store.DailyStats, error)
+}
+
+// RollUp rolls up every day before now's, in UTC, that has not been rolled
+// up yet, oldest first and at most MaxCatchUp days back, and returns how
+// many it rolled up. The retention purge calls it before deleting anything,
+// so every record is counted even when it is purged before the nightly
+// roll-up.
+func RollUp(ctx context.Context, st Store, now time.Time) (int, error) {
+	day, err := st.NextStatsDay(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if day.IsZero() {
+		return 0, nil
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	if oldest := today.AddDate(0, 0, -MaxCatchUp); day.Before(oldest) {
+		day = oldest
+	}
+	n := 0
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		if _, err := st.RollUpStats(ctx, day); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Roller rolls up the days as they end.
+type Roller struct {
+	st  Store
+	now func() time.Time
+}
+
+// New creates a Roller.
+func New(st Store) *Roller {
+	return &Roller{st: st, now: time.Now}
+}
+
+// Run catches up on the days not rolled up yet, then rolls up each day
+// Delay after it ends, until ctx is cancelled.
+func (r *Roller) Run(ctx context.Context) {
+	log.Printf("Daily stats roll-up started")
+	for {
+		now := r.now()
+		n, err := RollUp(ctx, r.st, now)
+		if err != nil {
+			log.Printf("Daily stats roll-up: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Daily stats: rolled up %d days", n)
+		}
+		next := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1).Add(Delay)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
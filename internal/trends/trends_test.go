@@ -0,0 +1,58 @@
+package trends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestRollUp(t *testing.T) {
+	st := store.NewMemory()
+	ctx := t.Context()
+	now := time.Date(2026, 6, 10, 8, 0, 0, 0, time.UTC)
+
+	if n, err := RollUp(ctx, st, now); err != nil || n != 0 {
+		t.Fatalf("roll up an empty store = %d, %v, want nothing rolled up", n, err)
+	}
+	for _, d := range []store.Decision{
+		{EmailID: "a", Direction: store.DirectionOutbound, Decision: store.DecisionApproved, DecidedAt: now.AddDate(0, 0, -3)},
+		{EmailID: "b", Direction: store.DirectionOutbound, Decision: store.DecisionRejected, DecidedAt: now.AddDate(0, 0, -1)},
+		{EmailID: "c", Direction: store.DirectionOutbound, Decision: store.DecisionApproved, DecidedAt: now},
+	} {
+		if err := st.RecordDecision(ctx, d); err != nil {
+			t.Fatalf("record decision: %v", err)
+		}
+	}
+
+	// Every finished day since the oldest decision, but not today.
+	if n, err := RollUp(ctx, st, now); err != nil || n != 3 {
+		t.Fatalf("roll up = %d, %v, want 3 days", n, err)
+	}
+	stats, err := st.ListDailyStats(ctx, time.Time{})
+	if err != nil {
+		t.Fatalf("list daily stats: %v", err)
+	}
+	if len(stats) != 3 || stats[0].Rejected != 1 || stats[1] != (store.DailyStats{Day: time.Date(2026, 6, 8, 0, 0, 0, 0, time.UTC)}) || stats[2].Approved != 1 {
+		t.Errorf("daily stats = %+v", stats)
+	}
+
+	// Days rolled up are not rolled up again.
+	if n, err := RollUp(ctx, st, now.Add(time.Hour)); err != nil || n != 0 {
+		t.Errorf("second roll-up = %d, %v, want nothing rolled up", n, err)
+	}
+	if n, err := RollUp(ctx, st, now.AddDate(0, 0, 1)); err != nil || n != 1 {
+		t.Errorf("roll-up the next day = %d, %v, want 1 day", n, err)
+	}
+}
+
+func TestRollUpCatchesUpAtMostMaxCatchUp(t *testing.T) {
+	st := store.NewMemory()
+	now := time.Date(2026, 6, 10, 8, 0, 0, 0, time.UTC)
+	if err := st.RecordDecision(t.Context(), store.Decision{EmailID: "ancient", Decision: store.DecisionApproved, DecidedAt: time.Unix(0, 0)}); err != nil {
+		t.Fatalf("record decision: %v", err)
+	}
+	if n, err := RollUp(t.Context(), st, now); err != nil || n != MaxCatchUp {
+		t.Errorf("roll up = %d, %v, want %d days", n, err, MaxCatchUp)
+	}
+}
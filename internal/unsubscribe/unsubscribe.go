@@ -0,0 +1,141 @@
+// Package unsubscribe adds List-Unsubscribe headers to relayed outbound mail
+// with a given tag, such as marketing mail, pointing at mailescrow's
+// unsubscribe page with one-click unsubscription (RFC 8058). Recipients who
+// unsubscribe are left out of later mail with the tag.
+package unsubscribe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Path is the path of the unsubscribe page on the web UI, followed by the
+// token of an unsubscribe link.
+const Path = "/unsubscribe/"
+
+// ErrOptedOut is returned by Send when every recipient of an email has
+// unsubscribed, so there is no one left to send it to.
+var ErrOptedOut = errors.New("every recipient has unsubscribed")
+
+// Store records unsubscribe links and tells who used one. store.EmailStore
+// implements it.
+type Store interface {
+	AddUnsubscribeLinks(ctx context.Context, links []store.UnsubscribeLink) error
+	OptedOut(ctx context.Context, addresses []string) ([]string, error)
+}
+
+// Sender wraps a relay.Sender. Outbound mail with its tag is relayed only to
+// the recipients who have not unsubscribed, and with List-Unsubscribe and
+// List-Unsubscribe-Post headers added.
+//
+// The headers carry one recipient's link, so mail to several recipients at
+// once, or already carrying a List-Unsubscribe header, is relayed without
+// them.
+type Sender struct {
+	next relay.Sender
+	st   Store
+	base string // URL unsubscribe links start with, ending in Path
+	tag  string
+}
+
+// New wraps next, handling mail tagged tag through the web UI at publicURL.
+func New(next relay.Sender, st Store, publicURL, tag string) *Sender {
+	return &Sender{next: next, st: st, base: strings.TrimSuffix(publicURL, "/") + Path, tag: tag}
+}
+
+// Send relays email to those of its recipients who have not unsubscribed,
+// with an unsubscribe link if it has one recipient left. If the link cannot
+// be recorded, email is relayed without it. It returns ErrOptedOut, without
+// relaying, if every recipient has unsubscribed.
+func (s *Sender) Send(ctx context.Context, email *store.Email) error {
+	if !s.applies(email) {
+		return s.next.Send(ctx, email)
+	}
+	out, err := s.st.OptedOut(ctx, email.Recipients)
+	if err != nil {
+		return fmt.Errorf("check opt-outs: %w", err)
+	}
+	kept := *email
+	if len(out) > 0 {
+		kept.Recipients = slices.DeleteFunc(slices.Clone(email.Recipients), func(rcpt string) bool {
+			return slices.Contains(out, rcpt)
+		})
+		if len(kept.Recipients) == 0 {
+			return fmt.Errorf("%w: %s", ErrOptedOut, strings.Join(out, ", "))
+		}
+		log.Printf("Email %s: not relaying to %s, who unsubscribed", email.ID, strings.Join(out, ", "))
+	}
+	if raw, link, ok := s.addHeaders(&kept); ok {
+		if err := s.st.AddUnsubscribeLinks(ctx, []store.UnsubscribeLink{link}); err != nil {
+			log.Printf("record unsubscribe link of email %s (relaying it without one): %v", email.ID, err)
+		} else {
+			kept.RawMessage = raw
+		}
+	}
+	return s.next.Send(ctx, &kept)
+}
+
+// Preview returns the raw message as the wrapped sender transmits it, with
+// the unsubscribe headers added. Nothing is recorded, and opt-outs are not
+// checked.
+func (s *Sender) Preview(email *store.Email) []byte {
+	if s.applies(email) {
+		if raw, _, ok := s.addHeaders(email); ok {
+			c := *email
+			c.RawMessage = raw
+			email = &c
+		}
+	}
+	if p, ok := s.next.(relay.Previewer); ok {
+		return p.Preview(email)
+	}
+	return email.RawMessage
+}
+
+// applies reports whether email is outbound mail with the tag.
+func (s *Sender) applies(email *store.Email) bool {
+	return email.Direction == store.DirectionOutbound && slices.Contains(email.Tags, s.tag)
+}
+
+// addHeaders returns the raw message of email with the unsubscribe headers
+// of its one recipient on top, and the link to record, or false if it does
+// not get them.
+func (s *Sender) addHeaders(email *store.Email) ([]byte, store.UnsubscribeLink, bool) {
+	if len(email.Recipients) != 1 {
+		return nil, store.UnsubscribeLink{}, false
+	}
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(email.RawMessage))).ReadMIMEHeader()
+	if err != nil || h.Get("List-Unsubscribe") != "" {
+		return nil, store.UnsubscribeLink{}, false
+	}
+
+	rcpt := strings.ToLower(email.Recipients[0])
+	link := store.UnsubscribeLink{ID: token(email.ID, rcpt), Address: rcpt, EmailID: email.ID, Subject: email.Subject}
+	eol := "\n"
+	if i := bytes.IndexByte(email.RawMessage, '\n'); i > 0 && email.RawMessage[i-1] == '\r' {
+		eol = "\r\n"
+	}
+	headers := "List-Unsubscribe: <" + s.base + link.ID + ">" + eol +
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click" + eol
+	return append([]byte(headers), email.RawMessage...), link, true
+}
+
+// token returns the token of the unsubscribe link of a recipient of an
+// email. It is always the same, so a message relayed again, journaled or
+// previewed carries the same link.
+func token(emailID, rcpt string) string {
+	sum := sha256.Sum256([]byte(emailID + "\x00" + rcpt))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
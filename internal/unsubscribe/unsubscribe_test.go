@@ -0,0 +1,121 @@
+package unsubscribe
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+type fakeSender struct {
+	sent []*store.Email
+}
+
+func (f *fakeSender) Send(_ context.Context, email *store.Email) error {
+	f.sent = append(f.sent, email)
+	return nil
+}
+
+const message = "From: shop@example.com\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: Spring sale\r\n" +
+	"\r\n" +
+	"Everything must go.\r\n"
+
+func newEmail(id string, tags []string, recipients ...string) *store.Email {
+	return &store.Email{
+		ID: id, Direction: store.DirectionOutbound, Sender: "shop@example.com", Recipients: recipients,
+		Subject: "Spring sale", RawMessage: []byte(message), Tags: tags,
+	}
+}
+
+func TestSendAddsHeaders(t *testing.T) {
+	st := store.NewMemory()
+	next := &fakeSender{}
+	s := New(next, st, "https://escrow.example.com/", "marketing")
+
+	if err := s.Send(t.Context(), newEmail("e1", []string{"marketing"}, "Bob@example.org")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(next.sent[0].RawMessage)))
+	if err != nil {
+		t.Fatalf("read relayed message: %v", err)
+	}
+	want := "<https://escrow.example.com/unsubscribe/" + token("e1", "bob@example.org") + ">"
+	if got := msg.Header.Get("List-Unsubscribe"); got != want {
+		t.Errorf("List-Unsubscribe = %q, want %q", got, want)
+	}
+	if got := msg.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post = %q", got)
+	}
+	if !strings.HasSuffix(string(next.sent[0].RawMessage), message) {
+		t.Errorf("message changed below the added headers: %q", next.sent[0].RawMessage)
+	}
+	if got := string(s.Preview(newEmail("e1", []string{"marketing"}, "bob@example.org"))); got != string(next.sent[0].RawMessage) {
+		t.Errorf("preview = %q, want the relayed message", got)
+	}
+
+	l, err := st.Unsubscribe(t.Context(), token("e1", "bob@example.org"), time.Now())
+	if err != nil || l == nil || l.Address != "bob@example.org" || l.EmailID != "e1" {
+		t.Fatalf("unsubscribe through the relayed link = %+v, %v", l, err)
+	}
+}
+
+func TestSendLeavesOtherMailAlone(t *testing.T) {
+	next := &fakeSender{}
+	s := New(next, store.NewMemory(), "https://escrow.example.com", "marketing")
+
+	untagged := newEmail("e1", []string{"invoice"}, "bob@example.org")
+	several := newEmail("e2", []string{"marketing"}, "bob@example.org", "carol@example.org")
+	own := newEmail("e3", []string{"marketing"}, "bob@example.org")
+	own.RawMessage = []byte("List-Unsubscribe: <mailto:leave@example.com>\r\n" + message)
+	for _, email := range []*store.Email{untagged, several, own} {
+		if err := s.Send(t.Context(), email); err != nil {
+			t.Fatalf("send %s: %v", email.ID, err)
+		}
+	}
+	for i, email := range []*store.Email{untagged, several, own} {
+		if string(next.sent[i].RawMessage) != string(email.RawMessage) {
+			t.Errorf("%s relayed as %q, want it unchanged", email.ID, next.sent[i].RawMessage)
+		}
+	}
+}
+
+func TestSendSkipsOptedOutRecipients(t *testing.T) {
+	st := store.NewMemory()
+	next := &fakeSender{}
+	s := New(next, st, "https://escrow.example.com", "marketing")
+	if err := s.Send(t.Context(), newEmail("e1", []string{"marketing"}, "bob@example.org")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := st.Unsubscribe(t.Context(), token("e1", "bob@example.org"), time.Now()); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+
+	if err := s.Send(t.Context(), newEmail("e2", []string{"marketing"}, "BOB@example.org", "carol@example.org")); err != nil {
+		t.Fatalf("send to bob and carol: %v", err)
+	}
+	relayed := next.sent[1]
+	if !slices.Equal(relayed.Recipients, []string{"carol@example.org"}) {
+		t.Errorf("relayed to %v, want only carol", relayed.Recipients)
+	}
+	if !strings.Contains(string(relayed.RawMessage), token("e2", "carol@example.org")) {
+		t.Errorf("relayed message lacks carol's unsubscribe link: %q", relayed.RawMessage)
+	}
+
+	err := s.Send(t.Context(), newEmail("e3", []string{"marketing"}, "bob@example.org"))
+	if !errors.Is(err, ErrOptedOut) {
+		t.Errorf("send to bob only = %v, want ErrOptedOut", err)
+	}
+	if len(next.sent) != 2 {
+		t.Errorf("relayed %d emails, want 2", len(next.sent))
+	}
+	if err := s.Send(t.Context(), newEmail("e4", nil, "bob@example.org")); err != nil {
+		t.Errorf("send untagged mail to bob: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Limits on what a scanner may attach to an email.
+const (
+	maxAnnotationFindings = 100
+	maxAnnotationText     = 1000 // bytes of the summary and of each finding
+)
+
+// SetRules sets the rules applied to API submissions and evaluated again
+// when a held email is annotated; then only those whose when looks at
+// email.annotations count. engine may be nil.
+func (s *Server) SetRules(engine *rules.Engine) {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	s.rules = engine
+}
+
+type annotationRequest struct {
+	Source   string   `json:"source"`
+	Kind     string   `json:"kind"`
+	Severity string   `json:"severity"` // "info" | "warning" | "critical"; empty means "info"
+	Score    float64  `json:"score"`
+	Summary  string   `json:"summary"`
+	Findings []string `json:"findings"`
+}
+
+type annotationResponse struct {
+	ID        string    `json:"id"`
+	Source    string    `json:"source"`
+	Kind      string    `json:"kind"`
+	Severity  string    `json:"severity"`
+	Score     float64   `json:"score,omitempty"`
+	Summary   string    `json:"summary,omitempty"`
+	Findings  []string  `json:"findings,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Rule is the rule that rejected the email because of the annotation;
+	// only in the response to adding it.
+	Rule string `json:"rule,omitempty"`
+}
+
+func newAnnotationResponse(a store.Annotation) annotationResponse {
+	return annotationResponse{
+		ID: a.ID, Source: a.Source, Kind: a.Kind, Severity: a.Severity, Score: a.Score,
+		Summary: a.Summary, Findings: a.Findings, CreatedBy: a.CreatedBy, CreatedAt: a.CreatedAt,
+	}
+}
+
+// validate checks req, defaulting its severity, and returns the reason it is
+// invalid, or "".
+func (req *annotationRequest) validate() string {
+	req.Source, req.Kind = strings.TrimSpace(req.Source), strings.TrimSpace(req.Kind)
+	if req.Severity == "" {
+		req.Severity = store.SeverityInfo
+	}
+	switch {
+	case req.Source == "" || req.Kind == "":
+		return "source and kind are required"
+	case len(req.Source) > 64 || len(req.Kind) > 64:
+		return "source and kind must be at most 64 bytes"
+	case !slices.Contains(store.Severities, req.Severity):
+		return `severity must be "info", "warning" or "critical"`
+	case len(req.Findings) > maxAnnotationFindings:
+		return "too many findings"
+	case len(req.Summary) > maxAnnotationText || slices.ContainsFunc(req.Findings, func(f string) bool { return len(f) > maxAnnotationText }):
+		return "summary and findings must be at most 1000 bytes each"
+	}
+	return ""
+}
+
+// handleAddAnnotation attaches a scanner's finding to a held email, then
+// evaluates the annotation rules again if the email is pending.
+func (s *Server) handleAddAnnotation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email, err := s.st.GetSummary(ctx, r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	a := store.Annotation{
+		EmailID: email.ID, Source: req.Source, Kind: req.Kind, Severity: req.Severity, Score: req.Score,
+		Summary: req.Summary, Findings: req.Findings, CreatedBy: apiActor(r), CreatedAt: time.Now().UTC(),
+	}
+	if a.ID, err = s.st.AddAnnotation(ctx, a); err != nil {
+		http.Error(w, "failed to save annotation", http.StatusInternalServerError)
+		log.Printf("annotate email %s: %v", email.ID, err)
+		return
+	}
+
+	resp := newAnnotationResponse(a)
+	if email.Status == store.StatusPending {
+		resp.Rule = s.applyAnnotationRules(ctx, email)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
+
+// applyAnnotationRules evaluates the annotation rules against a pending
+// email and its annotations: it adds the tags of every matching rule and,
+// if the first rule with an action rejects, rejects the email. It returns
+// that rule's name, or "" if the email was not rejected. Annotations never
+// approve mail: a scanner can only make review stricter.
+func (s *Server) applyAnnotationRules(ctx context.Context, email *store.Email) string {
+	s.rulesMu.Lock()
+	engine := s.rules.ForAnnotations()
+	s.rulesMu.Unlock()
+	if engine == nil {
+		return ""
+	}
+	full, err := s.st.Get(ctx, email.ID)
+	if err != nil {
+		log.Printf("load %s for annotation rules: %v", email.ID, err)
+		return ""
+	}
+	annotations, err := s.st.ListAnnotations(ctx, email.ID)
+	if err != nil {
+		log.Printf("list annotations of %s: %v", email.ID, err)
+		return ""
+	}
+	msg := rules.Message{
+		Direction: full.Direction, Sender: full.Sender, Recipients: full.Recipients,
+		Subject: full.Subject, Body: full.Body, Size: len(full.RawMessage), Annotations: annotations,
+	}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(full.RawMessage)); err == nil {
+		msg.Header = parsed.Header
+	}
+	if engine.UsesReputation() {
+		msg.Listed = len(s.checkReputation(ctx, email)) > 0
+	}
+
+	for _, tag := range engine.Tags(msg) {
+		if err := s.st.AddTag(ctx, email.ID, tag); err != nil {
+			log.Printf("tag email %s: %v", email.ID, err)
+		}
+	}
+	rule, ok := engine.Evaluate(msg)
+	if !ok || rule.Action != rules.ActionReject {
+		return ""
+	}
+	if err := s.rejectAt(ctx, full, full.Version, "rule:"+rule.Name); err != nil {
+		log.Printf("reject email %s by rule %q: %v", email.ID, rule.Name, err)
+		return ""
+	}
+	log.Printf("Email %s rejected by rule %q after annotation", email.ID, rule.Name)
+	return rule.Name
+}
+
+func (s *Server) handleListAnnotations(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listAnnotations(w, r); ok {
+		writeJSON(w, resp)
+	}
+}
+
+func (s *Server) handleListAnnotationsV2(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listAnnotations(w, r); ok {
+		paginate(w, r, resp)
+	}
+}
+
+// listAnnotations returns the annotations of the email in r's path, oldest
+// first. On failure it writes the error response and returns false.
+func (s *Server) listAnnotations(w http.ResponseWriter, r *http.Request) ([]annotationResponse, bool) {
+	id := r.PathValue("id")
+	if _, err := s.st.GetSummary(r.Context(), id); err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return nil, false
+	}
+	list, err := s.st.ListAnnotations(r.Context(), id)
+	if err != nil {
+		http.Error(w, "failed to list annotations", http.StatusInternalServerError)
+		log.Printf("list annotations of %s: %v", id, err)
+		return nil, false
+	}
+	resp := make([]annotationResponse, 0, len(list))
+	for _, a := range list {
+		resp = append(resp, newAnnotationResponse(a))
+	}
+	return resp, true
+}
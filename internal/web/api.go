@@ -0,0 +1,251 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VersionHeader names the API version a request asks for on the unversioned
+// /api/ routes, and the version a response was served as.
+const VersionHeader = "Mailescrow-API-Version"
+
+const (
+	// defaultPageLimit is how many items a v2 list returns without ?limit=.
+	defaultPageLimit = 50
+	// maxPageLimit caps ?limit= on v2 lists.
+	maxPageLimit = 500
+)
+
+// SetAPIV2 serves the v2 API under /api/v2/ and to requests that ask for
+// version 2. Until then v2 routes answer 404, so it can ship dark.
+func (s *Server) SetAPIV2(enabled bool) {
+	s.apiV2 = enabled
+}
+
+// handleAPI registers an API route, pattern being a method and a path below
+// /api, e.g. "GET /emails". v1 serves it under /api/v1/, v2 (v1 if nil) under
+// /api/v2/ with v2 error objects, and the legacy /api/ path serves the version
+// the request's VersionHeader asks for, v1 by default. Both are wrapped in
+// apiAuth for scope.
+func (s *Server) handleAPI(mux *http.ServeMux, pattern, scope string, v1, v2 http.HandlerFunc) {
+	method, path, _ := strings.Cut(pattern, " ")
+	if v2 == nil {
+		v2 = v1
+	}
+	one := s.apiVersion(1, s.apiAuth(scope, v1))
+	two := s.apiVersion(2, v2Errors(s.apiAuth(scope, v2)))
+	mux.HandleFunc(method+" /api/v1"+path, one)
+	mux.HandleFunc(method+" /api/v2"+path, two)
+	mux.HandleFunc(method+" /api"+path, func(w http.ResponseWriter, r *http.Request) {
+		switch v := r.Header.Get(VersionHeader); v {
+		case "", "1":
+			one(w, r)
+		case "2":
+			if !s.apiV2 {
+				http.Error(w, "unsupported API version "+v, http.StatusBadRequest)
+				return
+			}
+			two(w, r)
+		default:
+			http.Error(w, "unsupported API version "+v, http.StatusBadRequest)
+		}
+	})
+}
+
+// apiVersion serves h as API version, answering 404 for v2 while it is off.
+func (s *Server) apiVersion(version int, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if version == 2 && !s.apiV2 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set(VersionHeader, strconv.Itoa(version))
+		h(w, r)
+	}
+}
+
+// apiError is the body of every v2 error response.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// errorCodes are the v2 error codes of HTTP statuses.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal",
+	http.StatusBadGateway:            "upstream_failed",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// errorCode returns the v2 error code of status.
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	return "error"
+}
+
+// v2Errors rewrites the error responses of h, plain text from http.Error or
+// the JSON of writeFieldErrors, as apiError objects, so v2 shares the v1
+// handlers.
+func v2Errors(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorWriter{ResponseWriter: w}
+		h(ew, r)
+		ew.finish()
+	}
+}
+
+// errorWriter holds back the body of an error response until finish.
+type errorWriter struct {
+	http.ResponseWriter
+	status int // set once an error status was written
+	body   bytes.Buffer
+}
+
+func (w *errorWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *errorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *errorWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+	detail := errorDetail(w.status, w.Header(), w.body.Bytes())
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	if err := json.NewEncoder(w.ResponseWriter).Encode(apiError{Error: detail}); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
+
+// errorDetail returns the error response of status with header and body,
+// plain text from http.Error or the JSON of writeFieldErrors, as an
+// apiErrorDetail.
+func errorDetail(status int, header http.Header, body []byte) apiErrorDetail {
+	detail := apiErrorDetail{Code: errorCode(status), Message: strings.TrimSpace(string(body))}
+	if strings.HasPrefix(header.Get("Content-Type"), "application/json") {
+		var fields struct {
+			Error  string       `json:"error"`
+			Fields []fieldError `json:"fields"`
+		}
+		if err := json.Unmarshal(body, &fields); err == nil {
+			detail.Message, detail.Fields = fields.Error, fields.Fields
+		}
+	}
+	return detail
+}
+
+// apiPage is the v2 envelope of a list. NextCursor, passed back as ?cursor=,
+// fetches the next page; it is empty on the last one.
+type apiPage[T any] struct {
+	Data       []T    `json:"data"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// pageLimit parses ?limit=, defaulting to defaultPageLimit and capped at
+// maxPageLimit. On a bad value it writes the error response and returns false.
+func pageLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultPageLimit, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return 0, false
+	}
+	return min(n, maxPageLimit), true
+}
+
+// paginate writes the page of items selected by ?limit= and ?cursor= in an
+// apiPage.
+func paginate[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	limit, ok := pageLimit(w, r)
+	if !ok {
+		return
+	}
+	offset, ok := pageOffset(w, r)
+	if !ok {
+		return
+	}
+	page := apiPage[T]{Data: items[min(offset, len(items)):min(offset+limit, len(items))]}
+	if page.Data == nil {
+		page.Data = []T{} // [] not null
+	}
+	if offset+limit < len(items) {
+		page.HasMore = true
+		page.NextCursor = pageCursor(offset + limit)
+	}
+	writeJSON(w, page)
+}
+
+// pageOffset parses ?cursor= into the offset of the page it starts. On a bad
+// value it writes the error response and returns false.
+func pageOffset(w http.ResponseWriter, r *http.Request) (int, bool) {
+	c := r.URL.Query().Get("cursor")
+	if c == "" {
+		return 0, true
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c)
+	offset := 0
+	if err == nil {
+		offset, err = strconv.Atoi(string(b))
+	}
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid cursor", http.StatusBadRequest)
+		return 0, false
+	}
+	return offset, true
+}
+
+// pageCursor is the ?cursor= of the page starting at offset.
+func pageCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+// writeJSON writes v as a 200 JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
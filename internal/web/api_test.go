@@ -0,0 +1,86 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestV2Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		want    apiErrorDetail
+	}{
+		{"plain text", func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "email not found", http.StatusNotFound)
+		}, http.StatusNotFound, apiErrorDetail{Code: "not_found", Message: "email not found"}},
+		{"field errors", func(w http.ResponseWriter, _ *http.Request) {
+			writeFieldErrors(w, "invalid recipients", []fieldError{{Field: "to[0]", Value: "x", Message: "missing @"}})
+		}, http.StatusBadRequest, apiErrorDetail{Code: "invalid_request", Message: "invalid recipients", Fields: []fieldError{{Field: "to[0]", Value: "x", Message: "missing @"}}}},
+		{"unknown status", func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "teapot", http.StatusTeapot)
+		}, http.StatusTeapot, apiErrorDetail{Code: "error", Message: "teapot"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			v2Errors(tt.handler)(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != tt.status || rec.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+			}
+			var got apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decode %q: %v", rec.Body, err)
+			}
+			if got.Error.Code != tt.want.Code || got.Error.Message != tt.want.Message || len(got.Error.Fields) != len(tt.want.Fields) {
+				t.Errorf("error = %+v, want %+v", got.Error, tt.want)
+			}
+		})
+	}
+
+	// Successful responses pass through untouched.
+	rec := httptest.NewRecorder()
+	v2Errors(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+	})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "ok" {
+		t.Errorf("success = %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+	get := func(query string) (apiPage[int], int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		paginate(rec, httptest.NewRequest(http.MethodGet, "/?"+query, nil), items)
+		var page apiPage[int]
+		_ = json.Unmarshal(rec.Body.Bytes(), &page)
+		return page, rec.Code
+	}
+
+	page, _ := get("limit=2")
+	if len(page.Data) != 2 || page.Data[0] != 1 || !page.HasMore || page.NextCursor == "" {
+		t.Fatalf("first page = %+v", page)
+	}
+	page, _ = get("limit=2&cursor=" + page.NextCursor)
+	if len(page.Data) != 2 || page.Data[0] != 3 || !page.HasMore {
+		t.Fatalf("second page = %+v", page)
+	}
+	page, _ = get("limit=2&cursor=" + page.NextCursor)
+	if len(page.Data) != 1 || page.Data[0] != 5 || page.HasMore || page.NextCursor != "" {
+		t.Errorf("last page = %+v", page)
+	}
+	if page, _ := get(""); len(page.Data) != 5 || page.HasMore {
+		t.Errorf("default page = %+v", page)
+	}
+	for _, q := range []string{"limit=0", "limit=x", "cursor=!!", "cursor=LTE"} {
+		if _, code := get(q); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, code)
+		}
+	}
+}
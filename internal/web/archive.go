@@ -0,0 +1,164 @@
+package web
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// MaxArchiveEmails caps the number of emails in one zip download.
+const MaxArchiveEmails = 500
+
+type archiveRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// archiveManifest is metadata.json, the zip's table of contents.
+type archiveManifest struct {
+	CreatedAt time.Time      `json:"created_at"`
+	CreatedBy string         `json:"created_by"`
+	Emails    []archiveEntry `json:"emails"`
+}
+
+type archiveEntry struct {
+	ID         string    `json:"id"`
+	File       string    `json:"file,omitempty"` // empty when the raw message was not stored
+	SHA256     string    `json:"sha256,omitempty"`
+	Direction  string    `json:"direction"`
+	Status     string    `json:"status"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Subject    string    `json:"subject"`
+	Queue      string    `json:"queue,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	ApprovedBy string    `json:"approved_by,omitempty"`
+	ApprovedAt time.Time `json:"approved_at,omitzero"`
+}
+
+// handleArchive downloads the emails selected on the pending list.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	s.writeArchive(w, r, r.PostForm["id"], reviewerName(r))
+}
+
+func (s *Server) handleAPIArchive(w http.ResponseWriter, r *http.Request) {
+	var req archiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	s.writeArchive(w, r, req.IDs, apiActor(r))
+}
+
+// writeArchive streams a zip of ids: one <id>.eml per email and a
+// metadata.json manifest with the SHA-256 of each file. Every ID must exist
+// when the download starts. Raw messages are shown as the raw view shows
+// them, so with redaction their bodies are decoded and redacted.
+func (s *Server) writeArchive(w http.ResponseWriter, r *http.Request, ids []string, by string) {
+	ctx := r.Context()
+	if len(ids) == 0 {
+		http.Error(w, "no emails selected", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > MaxArchiveEmails {
+		http.Error(w, fmt.Sprintf("at most %d emails can be downloaded at once", MaxArchiveEmails), http.StatusBadRequest)
+		return
+	}
+	// Check every ID first: once the zip is streaming, errors can no longer
+	// change the status code.
+	seen := make(map[string]bool, len(ids))
+	unique := ids[:0:0]
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, err := s.st.GetSummary(ctx, id); err != nil {
+			http.Error(w, fmt.Sprintf("email %s not found", id), http.StatusNotFound)
+			return
+		}
+		unique = append(unique, id)
+	}
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="mailescrow-%s.zip"`, now.Format("20060102-150405")))
+	zw := zip.NewWriter(w)
+	manifest := archiveManifest{CreatedAt: now, CreatedBy: by, Emails: []archiveEntry{}}
+	for _, id := range unique {
+		entry, err := s.archiveEmail(ctx, zw, id)
+		if err != nil {
+			// Ending without the central directory leaves a zip that fails to
+			// open rather than one that silently lacks emails.
+			log.Printf("archive email %s: %v", id, err)
+			return
+		}
+		manifest.Emails = append(manifest.Emails, entry)
+	}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "metadata.json", Method: zip.Deflate, Modified: now})
+	if err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("write archive: %v", err)
+		return
+	}
+	log.Printf("%s downloaded an archive of %d emails", by, len(unique))
+}
+
+// archiveEmail adds the raw message of email id to zw and returns its
+// manifest entry.
+func (s *Server) archiveEmail(ctx context.Context, zw *zip.Writer, id string) (archiveEntry, error) {
+	email, err := s.st.GetSummary(ctx, id)
+	if err != nil {
+		return archiveEntry{}, err
+	}
+	entry := archiveEntry{
+		ID:         email.ID,
+		Direction:  email.Direction,
+		Status:     email.Status,
+		From:       email.Sender,
+		To:         email.Recipients,
+		Subject:    email.Subject,
+		Queue:      email.Queue,
+		Tags:       email.Tags,
+		ReceivedAt: email.ReceivedAt,
+		ApprovedBy: email.ApprovedBy,
+		ApprovedAt: email.ApprovedAt,
+	}
+	raw, stored, err := s.openRaw(ctx, id)
+	if err != nil {
+		return archiveEntry{}, err
+	}
+	defer func() { _ = raw.Close() }()
+	if !stored {
+		return entry, nil
+	}
+	entry.File = email.ID + ".eml"
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: entry.File, Method: zip.Deflate, Modified: email.ReceivedAt})
+	if err != nil {
+		return archiveEntry{}, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), raw); err != nil {
+		return archiveEntry{}, err
+	}
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return entry, nil
+}
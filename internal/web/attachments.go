@@ -0,0 +1,148 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+)
+
+// inlineTypes are the attachment types served for display rather than
+// download: images a browser renders without running anything. SVG is left
+// out, as it can carry script.
+var inlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// htmlPolicy confines the HTML view of a message: no script, no plugins and
+// nothing fetched from elsewhere, so neither tracking pixels nor remote
+// content load. Inline images are served by handleAttachment on this origin.
+const htmlPolicy = "sandbox; default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'"
+
+// handleAttachment serves attachment n of an email, counting from 0 in the
+// order mimetext.Attachments lists them. Images of inlineTypes are served for
+// display, everything else as a download. With a redactor nothing is served,
+// as attachments cannot be redacted.
+func (s *Server) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	email, err := s.st.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	attachments := mimetext.Attachments(email.RawMessage)
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 || n >= len(attachments) {
+		http.Error(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+	if s.redactor != nil {
+		http.Error(w, "attachments are withheld while redaction is configured", http.StatusForbidden)
+		return
+	}
+	a := attachments[n]
+
+	disposition := "attachment"
+	if inlineTypes[a.ContentType] {
+		disposition = "inline"
+	}
+	filename := a.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("attachment-%d", n+1)
+	}
+	h := w.Header()
+	h.Set("Content-Type", a.ContentType)
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+	h.Set("Content-Length", strconv.Itoa(a.Size()))
+	h.Set("Content-Security-Policy", "sandbox")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if _, err := w.Write(a.Data); err != nil {
+		log.Printf("write attachment: %v", err)
+	}
+}
+
+// handleHTML serves the HTML part of an email for the detail page's HTML
+// view, with cid: references to inline images pointed at handleAttachment.
+// The response is confined by htmlPolicy or, with ?remote=1, by
+// htmlRemotePolicy. Tracking pixels are removed if SetStripTrackers says so.
+func (s *Server) handleHTML(w http.ResponseWriter, r *http.Request) {
+	email, err := s.st.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	html := messageHTML(email.RawMessage)
+	if html == "" {
+		http.Error(w, "the email has no HTML part", http.StatusNotFound)
+		return
+	}
+	if s.stripTrackers {
+		html, _, _ = remoteContent(html, true)
+	}
+	if s.redactor != nil {
+		html = s.redactor.Redact(html)
+	} else {
+		html = s.inlineImages(html, email.ID, mimetext.Attachments(email.RawMessage))
+	}
+	policy := htmlPolicy
+	if r.URL.Query().Get("remote") == "1" {
+		policy = htmlRemotePolicy
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Security-Policy", policy)
+	// Remote servers learn an image was loaded, not from where.
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if _, err := w.Write([]byte(html)); err != nil {
+		log.Printf("write message content: %v", err)
+	}
+}
+
+// messageHTML returns the decoded HTML part of raw, or "" if it has none.
+func messageHTML(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	_, html := mimetext.Parts(textproto.MIMEHeader(msg.Header), msg.Body)
+	return html
+}
+
+// inlineImages replaces the cid: URLs in html that name one of attachments
+// with the attachment's URL.
+func (s *Server) inlineImages(html, id string, attachments []mimetext.Attachment) string {
+	var pairs []string
+	for i, a := range attachments {
+		if a.ContentID != "" {
+			pairs = append(pairs, "cid:"+a.ContentID, s.url(fmt.Sprintf("/email/%s/attachments/%d", id, i)))
+		}
+	}
+	if len(pairs) == 0 {
+		return html
+	}
+	return strings.NewReplacer(pairs...).Replace(html)
+}
+
+// formatSize renders a size in bytes for display, e.g. "12.3 kB".
+func formatSize(n int) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, prefix := float64(n)/unit, 0
+	for size >= unit && prefix < 3 {
+		size /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", size, "kMGT"[prefix])
+}
@@ -0,0 +1,231 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// MaxBatchEmails caps the emails in one POST /api/emails/batch.
+const MaxBatchEmails = 100
+
+type createBatchRequest struct {
+	Emails []createEmailRequest `json:"emails"`
+}
+
+type createBatchResponse struct {
+	Results []batchResult `json:"results"` // one per email, in the order submitted
+}
+
+// batchResult is the outcome of one email of a batch: its ID and status as
+// POST /api/emails would answer, or the error it would answer with.
+type batchResult struct {
+	ID     string      `json:"id,omitempty"`
+	Status string      `json:"status,omitempty"`
+	Error  *batchError `json:"error,omitempty"`
+}
+
+type batchError struct {
+	Status int `json:"status"` // HTTP status of the error
+	apiErrorDetail
+}
+
+// handleCreateBatch submits several emails, each as POST /api/emails would.
+// An email that fails is reported in its result and does not stop the
+// others; the request only fails as a whole if it cannot be read.
+//
+// Every email is checked first. The emails to hold for review are then
+// saved in one store transaction, so either all of them are or, should that
+// fail, none is. The emails a rule, policy or trusted contact approves are
+// relayed only once that transaction is committed, since no rollback could
+// undo relaying them, and are held for review one by one if relaying fails.
+// Once the client is gone, so that it would not learn their IDs, no more
+// emails are saved or relayed.
+func (s *Server) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Header.Get("Idempotency-Key") != "" {
+		http.Error(w, "Idempotency-Key is not supported on batches", http.StatusBadRequest)
+		return
+	}
+	var req createBatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRawMessageBytes)).Decode(&req); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("request exceeds %d bytes", MaxRawMessageBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(req.Emails) == 0:
+		writeFieldErrors(w, "invalid request", []fieldError{{Field: "emails", Message: "at least one email is required"}})
+		return
+	case len(req.Emails) > MaxBatchEmails:
+		writeFieldErrors(w, "invalid request", []fieldError{{Field: "emails", Message: fmt.Sprintf("at most %d emails per batch", MaxBatchEmails)}})
+		return
+	}
+
+	results := make([]batchResult, len(req.Emails))
+	var held, unreviewed []int // indexes of the emails to hold and to send
+	checked := make([]prepared, len(req.Emails))
+	unsaved := make(map[string]store.TagUsage) // usage of the emails to hold, by project
+	for i, email := range req.Emails {
+		if ctx.Err() != nil {
+			results[i] = cancelledResult()
+			continue
+		}
+		rw := newResultWriter()
+		p, ok := s.prepareBatchEmail(ctx, rw, r, email)
+		switch {
+		case !ok:
+			results[i] = rw.result()
+		case p.approver != "":
+			checked[i] = p
+			unreviewed = append(unreviewed, i)
+		case !s.checkProject(ctx, rw, p, unsaved[p.project]):
+			results[i] = rw.result()
+		default:
+			checked[i] = p
+			held = append(held, i)
+			u := unsaved[p.project]
+			u.Pending++
+			u.Bytes += int64(len(p.sub.raw))
+			unsaved[p.project] = u
+		}
+	}
+
+	s.saveBatch(ctx, checked, held, results)
+	for _, i := range unreviewed {
+		if ctx.Err() != nil {
+			s.releaseQuota(context.WithoutCancel(ctx), checked[i].quota)
+			results[i] = cancelledResult()
+			continue
+		}
+		resp, ok := s.sendUnreviewed(ctx, checked[i])
+		if !ok {
+			rw := newResultWriter()
+			if resp, ok = s.hold(ctx, rw, checked[i]); !ok {
+				results[i] = rw.result()
+				continue
+			}
+		}
+		results[i] = batchResult{ID: resp.ID, Status: resp.Status}
+	}
+	if ctx.Err() != nil {
+		var submitted []string
+		for _, res := range results {
+			if res.Error == nil {
+				submitted = append(submitted, res.ID)
+			}
+		}
+		log.Printf("Batch of %d emails cancelled after submitting %d: %s", len(req.Emails), len(submitted), strings.Join(submitted, ", "))
+	}
+	writeJSON(w, createBatchResponse{Results: results})
+}
+
+// prepareBatchEmail checks one email of a batch as POST /api/emails would,
+// without holding or relaying it.
+func (s *Server) prepareBatchEmail(ctx context.Context, w http.ResponseWriter, r *http.Request, req createEmailRequest) (prepared, bool) {
+	extraHeaders, errs := s.validateEmail(ctx, req)
+	if len(errs) > 0 {
+		writeFieldErrors(w, "invalid request", errs)
+		return prepared{}, false
+	}
+	from, ok := s.identity(w, r, req.Identity)
+	if !ok {
+		return prepared{}, false
+	}
+	sub, ok := composeSubmission(w, req, from, extraHeaders)
+	if !ok {
+		return prepared{}, false
+	}
+	return s.prepare(ctx, w, sub)
+}
+
+// saveBatch saves the emails of checked at indexes held in one transaction
+// and sets their results.
+func (s *Server) saveBatch(ctx context.Context, checked []prepared, held []int, results []batchResult) {
+	if len(held) == 0 {
+		return
+	}
+	emails := make([]store.Email, 0, len(held))
+	for _, i := range held {
+		sub := checked[i].sub
+		emails = append(emails, store.Email{
+			Sender: sub.sender, Recipients: sub.to, Subject: sub.subject, Body: sub.body, RawMessage: sub.raw,
+			Flags: checked[i].flags, Tags: checked[i].tags,
+		})
+	}
+	ids, err := s.st.SaveOutboundBatch(ctx, emails)
+	if err != nil {
+		log.Printf("save batch of %d outbound emails: %v", len(held), err)
+	}
+	for n, i := range held {
+		switch {
+		case err == nil:
+			results[i] = batchResult{ID: ids[n], Status: store.StatusPending}
+		case ctx.Err() != nil:
+			s.releaseQuota(context.WithoutCancel(ctx), checked[i].quota)
+			results[i] = cancelledResult()
+		default:
+			s.releaseQuota(ctx, checked[i].quota)
+			results[i] = failedResult(http.StatusInternalServerError, "failed to save email")
+		}
+	}
+}
+
+// failedResult is the result of an email of a batch that failed with
+// status.
+func failedResult(status int, message string) batchResult {
+	return batchResult{Error: &batchError{
+		Status:         status,
+		apiErrorDetail: apiErrorDetail{Code: errorCode(status), Message: message},
+	}}
+}
+
+// cancelledResult is the result of an email of a batch left unsubmitted
+// because the request was cancelled.
+func cancelledResult() batchResult {
+	return failedResult(http.StatusServiceUnavailable, "not submitted: the request was cancelled")
+}
+
+// resultWriter keeps the error response written for one email of a batch.
+type resultWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResultWriter() *resultWriter {
+	return &resultWriter{header: make(http.Header)}
+}
+
+// result is the result of the email whose error response w kept.
+func (w *resultWriter) result() batchResult {
+	return batchResult{Error: &batchError{Status: w.status, apiErrorDetail: errorDetail(w.status, w.header, w.body.Bytes())}}
+}
+
+func (w *resultWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *resultWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *resultWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/rules"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestCreateBatchCancelled(t *testing.T) {
+	st := store.NewMemory()
+	s := New(st, relay.New("127.0.0.1", 1, "", "", false), nil, "sender@example.com", "", "")
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	body := `{"emails": [{"to": ["a@example.com"], "subject": "Hi", "body": "1"}, {"to": ["b@example.com"], "subject": "Hi", "body": "2"}]}`
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/api/emails/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.handleCreateBatch(w, r)
+
+	var resp createBatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Results) != 2 {
+		t.Fatalf("response = %s (%v), want two results", w.Body, err)
+	}
+	for i, res := range resp.Results {
+		if res.Error == nil || res.Error.Status != http.StatusServiceUnavailable {
+			t.Errorf("result %d = %+v, want not submitted", i, res)
+		}
+	}
+	if n, _ := st.CountPending(t.Context()); n != 0 {
+		t.Errorf("%d emails saved from a cancelled batch, want none", n)
+	}
+}
+
+// batchStore fails to save batches if failBatch is set.
+type batchStore struct {
+	*store.Memory
+	failBatch bool
+}
+
+func (s *batchStore) SaveOutboundBatch(ctx context.Context, emails []store.Email) ([]string, error) {
+	if s.failBatch {
+		return nil, errors.New("disk full")
+	}
+	return s.Memory.SaveOutboundBatch(ctx, emails)
+}
+
+// pendingAtSend relays nothing, and records how many emails were pending
+// when each was sent.
+type pendingAtSend struct {
+	st    store.Reader
+	count []int
+}
+
+func (p *pendingAtSend) Send(ctx context.Context, _ *store.Email) error {
+	n, err := p.st.CountPending(ctx)
+	p.count = append(p.count, n)
+	return err
+}
+
+func TestCreateBatchSavesHeldTogether(t *testing.T) {
+	engine, err := rules.New([]rules.Rule{{Name: "receipts", Recipient: "receipts@example.com", Action: rules.ActionApprove}})
+	if err != nil {
+		t.Fatalf("rules: %v", err)
+	}
+	body := `{"emails": [{"to": ["receipts@example.com"], "subject": "Hi", "body": "1"}, {"to": ["a@example.com"], "subject": "Hi", "body": "2"}, {"to": ["b@example.com"], "subject": "Hi", "body": "3"}]}`
+	for _, fail := range []bool{false, true} {
+		st := &batchStore{Memory: store.NewMemory(), failBatch: fail}
+		sender := &pendingAtSend{st: st}
+		s := New(st, sender, nil, "sender@example.com", "", "")
+		s.SetRules(engine)
+		w := httptest.NewRecorder()
+		s.handleCreateBatch(w, httptest.NewRequest(http.MethodPost, "/api/emails/batch", strings.NewReader(body)))
+
+		var resp createBatchResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Results) != 3 {
+			t.Fatalf("response = %s (%v), want three results", w.Body, err)
+		}
+		if res := resp.Results[0]; res.Status != "sent" {
+			t.Errorf("approved email = %+v, want sent", res)
+		}
+		n, _ := st.CountPending(t.Context())
+		if fail {
+			for i, res := range resp.Results[1:] {
+				if res.Error == nil || res.Error.Status != http.StatusInternalServerError {
+					t.Errorf("held email %d of a failed batch = %+v, want failed", i, res)
+				}
+			}
+			if n != 0 {
+				t.Errorf("%d emails saved from a failed batch, want none", n)
+			}
+			continue
+		}
+		for i, res := range resp.Results[1:] {
+			if res.Status != store.StatusPending || res.ID == "" {
+				t.Errorf("held email %d = %+v, want pending", i, res)
+			}
+		}
+		if n != 2 || len(sender.count) != 1 || sender.count[0] != 2 {
+			t.Errorf("pending = %d, pending when relaying = %v; want the approved email relayed after both held ones were saved", n, sender.count)
+		}
+	}
+}
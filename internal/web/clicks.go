@@ -0,0 +1,34 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/albert/mailescrow/internal/metrics"
+)
+
+// maxClickStats is how many emails the stats page lists link clicks for.
+const maxClickStats = 50
+
+// handleClick counts a click on a tracked link in relayed mail and redirects
+// to where the link pointed. The token in the URL is the only credential.
+// Unknown tokens get a 404, never a redirect, so the endpoint cannot be used
+// as an open redirect.
+func (s *Server) handleClick(w http.ResponseWriter, r *http.Request) {
+	link, err := s.st.ClickLink(r.Context(), r.PathValue("token"), time.Now().UTC())
+	if err != nil {
+		http.Error(w, "failed to follow link", http.StatusInternalServerError)
+		log.Printf("click tracked link: %v", err)
+		return
+	}
+	if link == nil {
+		http.Error(w, "link not found", http.StatusNotFound)
+		return
+	}
+	metrics.LinkClicks.Inc()
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, link.URL, http.StatusFound)
+}
@@ -0,0 +1,86 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxLineLength is the longest line SMTP allows, CRLF excluded (RFC 5321).
+const maxLineLength = 998
+
+// composeMessage builds the message of an API submission from its header
+// fields (each line ending in CRLF) and its bodies: a text/plain part, a
+// text/html part, or both as multipart/alternative, plain text first as RFC
+// 2046 asks. An empty html means a plain-text message, even if text is empty
+// too.
+func composeMessage(header, text, html string) []byte {
+	var b bytes.Buffer
+	b.WriteString(header)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	if html == "" {
+		writePart(&b, nil, "text/plain", text)
+		return b.Bytes()
+	}
+	if text == "" {
+		writePart(&b, nil, "text/html", html)
+		return b.Bytes()
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	writePart(&body, mw, "text/plain", text)
+	writePart(&body, mw, "text/html", html)
+	_ = mw.Close() // writes to a buffer, cannot fail
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", mw.Boundary())
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// writePart writes a UTF-8 body of mediaType: as a part of mw, or as the
+// whole message body after its header if mw is nil. Bodies that are plain
+// ASCII in short lines go as they are; anything else is quoted-printable.
+func writePart(b *bytes.Buffer, mw *multipart.Writer, mediaType, body string) {
+	body = strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	encoding := "7bit"
+	if !is7bit(body) {
+		encoding = "quoted-printable"
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mediaType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", encoding)
+
+	var w io.Writer = b
+	if mw != nil {
+		w, _ = mw.CreatePart(h) // writes to a buffer, cannot fail
+	} else {
+		fmt.Fprintf(b, "Content-Type: %s\r\nContent-Transfer-Encoding: %s\r\n\r\n", h.Get("Content-Type"), encoding)
+	}
+	if encoding == "7bit" {
+		_, _ = w.Write([]byte(body))
+		return
+	}
+	qw := quotedprintable.NewWriter(w)
+	_, _ = qw.Write([]byte(body))
+	_ = qw.Close()
+}
+
+// is7bit reports whether s can be sent without a transfer encoding: ASCII
+// without NULs or bare CRs, in lines SMTP accepts.
+func is7bit(s string) bool {
+	for line := range strings.SplitSeq(s, "\r\n") {
+		if len(line) > maxLineLength {
+			return false
+		}
+		for i := 0; i < len(line); i++ {
+			if c := line[i]; c == 0 || c == '\r' || c >= 0x80 {
+				return false
+			}
+		}
+	}
+	return true
+}
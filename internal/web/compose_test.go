@@ -0,0 +1,56 @@
+package web
+
+import (
+	"bytes"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+)
+
+func TestComposeMessage(t *testing.T) {
+	const header = "From: a@example.com\r\nSubject: Hi\r\n"
+
+	raw := composeMessage(header, "Hello\nworld", "")
+	if want := header + "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 7bit\r\n\r\nHello\r\nworld"; string(raw) != want {
+		t.Errorf("plain text message = %q, want %q", raw, want)
+	}
+
+	raw = composeMessage(header, "Grüße", "<p>Grüße</p>")
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type = %q (%v), want multipart/alternative", msg.Header.Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []string{"text/plain; charset=utf-8", "text/html; charset=utf-8"} {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		if got := part.Header.Get("Content-Type"); got != want {
+			t.Errorf("part content type = %q, want %q", got, want)
+		}
+		if got := part.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+			t.Errorf("%s encoding = %q, want quoted-printable", want, got)
+		}
+	}
+	if _, err := mr.NextRawPart(); err == nil {
+		t.Error("more than two parts")
+	}
+	text, html := mimetext.Parts(map[string][]string{"Content-Type": {msg.Header.Get("Content-Type")}}, bytes.NewReader(raw[bytes.Index(raw, []byte("\r\n\r\n"))+4:]))
+	if text != "Grüße" || html != "<p>Grüße</p>" {
+		t.Errorf("decoded parts = %q, %q", text, html)
+	}
+
+	raw = composeMessage(header, "", strings.Repeat("x", 1200))
+	if !strings.Contains(string(raw), "Content-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n") {
+		t.Errorf("HTML-only message with a long line = %q, want a quoted-printable text/html body", raw)
+	}
+}
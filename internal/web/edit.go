@@ -0,0 +1,245 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/textdiff"
+)
+
+// actionEmailEdit is the audit action recorded for edits of held mail.
+const actionEmailEdit = "email.edit"
+
+// editView is an edit of an email with the diff of each field, for display.
+type editView struct {
+	store.Edit
+	Recipients []textdiff.Line // nil if unchanged, like Subject and Body
+	Subject    []textdiff.Line
+	Body       []textdiff.Line
+}
+
+// newEditView diffs the versions e keeps.
+func newEditView(e store.Edit) editView {
+	v := editView{Edit: e}
+	if d := textdiff.Lines(strings.Join(e.Before.Recipients, "\n"), strings.Join(e.After.Recipients, "\n")); textdiff.Changed(d) {
+		v.Recipients = d
+	}
+	if d := textdiff.Lines(e.Before.Subject, e.After.Subject); textdiff.Changed(d) {
+		v.Subject = d
+	}
+	if d := textdiff.Lines(e.Before.Body, e.After.Body); textdiff.Changed(d) {
+		v.Body = d
+	}
+	return v
+}
+
+// edits returns the edits of the given emails for display, keyed by email
+// ID, logging rather than failing on error.
+func (s *Server) edits(r *http.Request, emailIDs []string) map[string][]editView {
+	edits, err := s.st.ListEdits(r.Context(), emailIDs)
+	if err != nil {
+		log.Printf("list edits: %v", err)
+		return nil
+	}
+	views := make(map[string][]editView)
+	for _, e := range edits {
+		views[e.EmailID] = append(views[e.EmailID], newEditView(e))
+	}
+	return views
+}
+
+// editPage is the form for editing a pending outbound email.
+type editPage struct {
+	emailView
+	CanEditBody bool // see plainText
+}
+
+// handleEditForm shows the form for editing pending outbound email, with its
+// full body.
+func (s *Server) handleEditForm(w http.ResponseWriter, r *http.Request) {
+	email, err := s.st.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	if email.Direction != store.DirectionOutbound || email.Status != store.StatusPending {
+		http.Error(w, "only pending outbound email can be edited", http.StatusBadRequest)
+		return
+	}
+	s.render(w, r, "edit.html", editPage{emailView: s.emailView(r.Context(), email), CanEditBody: plainText(email.RawMessage)})
+}
+
+// handleEdit changes the recipients, subject or body of pending outbound
+// email before it is approved, from the form's "to", "subject" and "body"
+// fields; a field left out is kept. Both versions are stored, so the detail
+// page and the history show what the reviewer changed; the edit is also
+// recorded in the audit log. Approvals given so far are dropped.
+func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	email, err := s.st.Get(ctx, id)
+	if err != nil {
+		s.alreadyHandled(w, r, id)
+		return
+	}
+	if email.Direction != store.DirectionOutbound {
+		http.Error(w, "only outbound email can be edited", http.StatusBadRequest)
+		return
+	}
+	if email.Status != store.StatusPending {
+		s.alreadyHandled(w, r, id)
+		return
+	}
+	if len(email.RawMessage) == 0 {
+		http.Error(w, "the raw message of this email was not stored, so it cannot be edited", http.StatusConflict)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	before := store.EditedFields{Recipients: email.Recipients, Subject: email.Subject, Body: email.Body}
+	after := before
+	if r.Form.Has("to") {
+		after.Recipients = strings.FieldsFunc(r.FormValue("to"), func(c rune) bool { return c == ',' || unicode.IsSpace(c) })
+		if len(after.Recipients) == 0 {
+			http.Error(w, "at least one recipient is required", http.StatusBadRequest)
+			return
+		}
+		for _, addr := range after.Recipients {
+			if p := s.recipients.Check(ctx, addr); p != nil {
+				http.Error(w, fmt.Sprintf("invalid recipient %s: %s", addr, p.Reason), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if r.Form.Has("subject") {
+		after.Subject = strings.TrimSpace(r.FormValue("subject"))
+		if strings.ContainsAny(after.Subject, "\r\n") {
+			http.Error(w, "the subject must be a single line", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Form.Has("body") {
+		// Browsers submit text areas with CRLF line endings.
+		after.Body = strings.ReplaceAll(r.FormValue("body"), "\r\n", "\n")
+		if after.Body == strings.ReplaceAll(before.Body, "\r\n", "\n") {
+			after.Body = before.Body
+		} else if !plainText(email.RawMessage) {
+			http.Error(w, "only the body of a plain-text message can be edited", http.StatusBadRequest)
+			return
+		}
+	}
+	changes := editSummary(before, after)
+	if changes == "" {
+		s.redirectAfterAction(w, r)
+		return
+	}
+
+	version, ok := formVersion(w, r, email)
+	if !ok {
+		return
+	}
+	reviewer := reviewerName(r)
+	edit := store.Edit{EmailID: id, Reviewer: reviewer, EditedAt: time.Now().UTC(), Before: before, After: after}
+	if err := s.st.EditEmail(ctx, edit, editMessage(email.RawMessage, before, after), version); err != nil {
+		if s.lostRace(ctx, id, err) {
+			s.alreadyHandled(w, r, id)
+			return
+		}
+		http.Error(w, "failed to edit email", http.StatusInternalServerError)
+		log.Printf("edit email %s: %v", id, err)
+		return
+	}
+	log.Printf("Email %s edited by %s: %s", id, reviewer, changes)
+	s.audit(r, reviewer, actionEmailEdit, fmt.Sprintf("email %s: %s", id, changes))
+	s.redirectAfterAction(w, r)
+}
+
+// editSummary describes in one line what changed from before to after, for
+// the audit log, or returns "" if nothing did.
+func editSummary(before, after store.EditedFields) string {
+	var changes []string
+	if before.Subject != after.Subject {
+		changes = append(changes, fmt.Sprintf("subject %q → %q", before.Subject, after.Subject))
+	}
+	if !slices.Equal(before.Recipients, after.Recipients) {
+		var to []string
+		for _, l := range textdiff.Lines(strings.Join(before.Recipients, "\n"), strings.Join(after.Recipients, "\n")) {
+			switch l.Op {
+			case textdiff.Delete:
+				to = append(to, "-"+l.Text)
+			case textdiff.Insert:
+				to = append(to, "+"+l.Text)
+			}
+		}
+		changes = append(changes, "to "+strings.Join(to, " "))
+	}
+	if before.Body != after.Body {
+		removed, added := 0, 0
+		for _, l := range textdiff.Lines(before.Body, after.Body) {
+			switch l.Op {
+			case textdiff.Delete:
+				removed++
+			case textdiff.Insert:
+				added++
+			}
+		}
+		changes = append(changes, fmt.Sprintf("body -%d +%d lines", removed, added))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// plainText reports whether raw is a single-part text/plain message, the
+// only kind whose body can be edited: the body of any other is not the
+// whole message.
+func plainText(raw []byte) bool {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return false
+	}
+	ct := msg.Header.Get("Content-Type")
+	if ct == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	return err == nil && mediaType == "text/plain"
+}
+
+// editMessage returns raw, the message of an outbound email, changed from
+// before to after: a new Subject header; a To header listing the new
+// recipients in place of the To and Cc headers; and a new body, encoded as
+// API submissions are. Headers of unchanged fields are kept as they were.
+// DKIM signatures no longer hold and are dropped.
+func editMessage(raw []byte, before, after store.EditedFields) []byte {
+	strip := []string{"Dkim-Signature"}
+	var added strings.Builder
+	if before.Subject != after.Subject {
+		strip = append(strip, "Subject")
+		fmt.Fprintf(&added, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", after.Subject))
+	}
+	if !slices.Equal(before.Recipients, after.Recipients) {
+		strip = append(strip, "To", "Cc")
+		fmt.Fprintf(&added, "To: %s\r\n", strings.Join(after.Recipients, ", "))
+	}
+	if before.Body == after.Body {
+		return append([]byte(added.String()), relay.RewriteHeaders(raw, nil, false, strip)...)
+	}
+
+	strip = append(strip, "Content-Type", "Content-Transfer-Encoding", "Mime-Version")
+	header, _ := splitMessage(relay.RewriteHeaders(raw, nil, false, strip))
+	// Drop the blank line ending the header; composeMessage adds its own.
+	header = bytes.TrimSuffix(bytes.TrimSuffix(header, []byte("\n")), []byte("\r"))
+	return composeMessage(added.String()+string(header), after.Body, "")
+}
@@ -0,0 +1,45 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestEditMessage(t *testing.T) {
+	const raw = "From: a@example.com\r\nTo: b@example.com\r\nCc: c@example.com\r\nSubject: Hi\r\nDKIM-Signature: v=1;\r\n b=abc\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\nHello\r\n"
+	before := store.EditedFields{Recipients: []string{"b@example.com", "c@example.com"}, Subject: "Hi", Body: "Hello\r\n"}
+
+	tests := []struct {
+		name  string
+		after store.EditedFields
+		want  string
+	}{
+		{"subject", store.EditedFields{Recipients: before.Recipients, Subject: "Grüße", Body: before.Body},
+			"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\nFrom: a@example.com\r\nTo: b@example.com\r\nCc: c@example.com\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\nHello\r\n"},
+		{"recipients", store.EditedFields{Recipients: []string{"b@example.com"}, Subject: "Hi", Body: before.Body},
+			"To: b@example.com\r\nFrom: a@example.com\r\nSubject: Hi\r\nContent-Type: text/plain; charset=us-ascii\r\n\r\nHello\r\n"},
+		{"body", store.EditedFields{Recipients: before.Recipients, Subject: "Hi", Body: "Hello again\n"},
+			"From: a@example.com\r\nTo: b@example.com\r\nCc: c@example.com\r\nSubject: Hi\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 7bit\r\n\r\nHello again\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(editMessage([]byte(raw), before, tt.after)); got != tt.want {
+				t.Errorf("editMessage =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"Subject: Hi\r\n\r\nHello":                                          true,
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nHello":              true,
+		"Content-Type: text/html\r\n\r\n<p>Hello</p>":                       false,
+		"Content-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\n\r\n--x--": false,
+	} {
+		if got := plainText([]byte(raw)); got != want {
+			t.Errorf("plainText(%q) = %v, want %v", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// handleForward resends inbound email to the form's "to" address through the
+// relay, e.g. to the person who should deal with it. Pending email is
+// approved first, so "approve & forward" is one action; the email stays
+// available to API consumers either way. The forward is recorded in the
+// history once it is relayed.
+func (s *Server) handleForward(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	email, err := s.st.Get(ctx, id)
+	if err != nil {
+		s.alreadyHandled(w, r, id)
+		return
+	}
+	if email.Direction != store.DirectionInbound {
+		http.Error(w, "only inbound email can be forwarded", http.StatusBadRequest)
+		return
+	}
+	if len(email.RawMessage) == 0 {
+		http.Error(w, "the raw message of this email was not stored, so it cannot be forwarded", http.StatusConflict)
+		return
+	}
+	to := strings.TrimSpace(r.FormValue("to"))
+	if p := s.recipients.Check(ctx, to); p != nil {
+		http.Error(w, "invalid forwarding address: "+p.Reason, http.StatusBadRequest)
+		return
+	}
+	reviewer := reviewerName(r)
+
+	if email.Status == store.StatusPending {
+		if !s.claimApproval(w, r, email, reviewer) {
+			return
+		}
+		s.releaseInbound(ctx, email)
+		s.recordDecision(ctx, email, store.DecisionApproved, reviewer)
+		if err := s.contacts.Learn(ctx, email); err != nil {
+			log.Printf("learn contacts from %s: %v", id, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	fwd := store.Email{
+		ID:         email.ID,
+		Direction:  store.DirectionOutbound,
+		Sender:     s.fromAddr,
+		Recipients: []string{to},
+		Subject:    email.Subject,
+		Body:       email.Body,
+		RawMessage: resent(email.RawMessage, formatFromHeader(s.fromName, s.fromAddr), to, now),
+		ApprovedBy: reviewer,
+		ApprovedAt: now,
+	}
+	// Queued, so a relay outage delays the forward rather than losing it.
+	if err := s.jobs.Add(ctx, jobs.KindRelay, email.ID, relayJob{Email: fwd, Decision: store.Decision{
+		EmailID:     email.ID,
+		Direction:   email.Direction,
+		Sender:      email.Sender,
+		Subject:     email.Subject,
+		Decision:    store.DecisionForwarded,
+		Reviewer:    reviewer,
+		Latency:     now.Sub(email.ReceivedAt),
+		ForwardedTo: to,
+	}}); err != nil {
+		http.Error(w, "failed to forward email", http.StatusInternalServerError)
+		log.Printf("queue forward of email %s to %s: %v", id, to, err)
+		return
+	}
+	s.redirectAfterAction(w, r)
+}
+
+// resent returns raw with a block of Resent-* fields (RFC 5322 section
+// 3.6.6) prepended, recording that from resent it to to at now. The original
+// header and body are untouched, so DKIM signatures still verify.
+func resent(raw []byte, from, to string, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Resent-Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Resent-From: %s\r\n", from)
+	fmt.Fprintf(&b, "Resent-To: %s\r\n", to)
+	fmt.Fprintf(&b, "Resent-Message-ID: <%s@mailescrow>\r\n", uuid.New().String())
+	b.Write(raw)
+	return b.Bytes()
+}
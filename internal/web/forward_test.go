@@ -0,0 +1,28 @@
+package web
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResent(t *testing.T) {
+	raw := []byte("DKIM-Signature: v=1; d=example.org\r\nFrom: bob@example.org\r\nSubject: Offer\r\n\r\nBuy now")
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	got := string(resent(raw, `"Escrow" <escrow@example.com>`, "sales@example.com", now))
+
+	header, original, ok := strings.Cut(got, "DKIM-Signature:")
+	if !ok || "DKIM-Signature:"+original != string(raw) {
+		t.Fatalf("original message not kept intact after the Resent-* block:\n%s", got)
+	}
+	for _, want := range []string{
+		"Resent-Date: Mon, 02 Mar 2026 10:00:00 +0000\r\n",
+		"Resent-From: \"Escrow\" <escrow@example.com>\r\n",
+		"Resent-To: sales@example.com\r\n",
+		"Resent-Message-ID: <",
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("Resent-* block lacks %q:\n%s", want, header)
+		}
+	}
+}
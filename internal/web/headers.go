@@ -0,0 +1,84 @@
+package web
+
+import (
+	"fmt"
+	"mime"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// blockedHeaders may not be set through the API: mailescrow generates them,
+// they would add recipients the reviewer does not see in the envelope, or
+// they describe a body encoding the generated message does not use.
+var blockedHeaders = map[string]bool{
+	"Bcc":                       true,
+	"Cc":                        true,
+	"Content-Transfer-Encoding": true,
+	"Content-Type":              true,
+	"Date":                      true,
+	"Dkim-Signature":            true,
+	"From":                      true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Received":                  true,
+	"Return-Path":               true,
+	"Sender":                    true,
+	"Subject":                   true,
+	"To":                        true,
+}
+
+// maxHeaderLine is the RFC 5322 limit on a line, excluding CRLF.
+const maxHeaderLine = 998
+
+// formatExtraHeaders validates headers supplied with an API submission and
+// renders them as CRLF-terminated header lines, sorted by name. Non-ASCII
+// values are encoded as RFC 2047 words.
+func formatExtraHeaders(headers map[string]string) (string, error) {
+	canonical := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !validHeaderName(name) {
+			return "", fmt.Errorf("invalid header name %q", name)
+		}
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if blockedHeaders[key] || strings.HasPrefix(key, "X-Mailescrow-") {
+			return "", fmt.Errorf("header %s cannot be set", name)
+		}
+		if _, dup := canonical[key]; dup {
+			return "", fmt.Errorf("duplicate header %s", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return "", fmt.Errorf("header %s must be a single line", name)
+		}
+		value = mime.QEncoding.Encode("utf-8", strings.TrimSpace(value))
+		if len(key)+2+len(value) > maxHeaderLine {
+			return "", fmt.Errorf("header %s is too long", name)
+		}
+		canonical[key] = value
+	}
+
+	keys := make([]string, 0, len(canonical))
+	for key := range canonical {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, canonical[key])
+	}
+	return b.String(), nil
+}
+
+// validHeaderName reports whether name is an RFC 5322 field name: printable
+// ASCII other than the colon.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c < '!' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package web
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatExtraHeaders(t *testing.T) {
+	got, err := formatExtraHeaders(map[string]string{
+		"list-unsubscribe": "<mailto:unsub@example.com>",
+		"X-Campaign-Id":    " spring-2026 ",
+		"X-Greeting":       "Grüße",
+	})
+	if err != nil {
+		t.Fatalf("format: %v", err)
+	}
+	want := "List-Unsubscribe: <mailto:unsub@example.com>\r\n" +
+		"X-Campaign-Id: spring-2026\r\n" +
+		"X-Greeting: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n"
+	if got != want {
+		t.Errorf("headers = %q, want %q", got, want)
+	}
+	if got, _ := formatExtraHeaders(nil); got != "" {
+		t.Errorf("no headers = %q, want empty", got)
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"bcc":                {"Bcc": "hidden@example.com"},
+		"from":               {"from": "ceo@example.com"},
+		"traceability":       {"X-Mailescrow-Approved-By": "me"},
+		"duplicate":          {"X-Tag": "a", "x-tag": "b"},
+		"header injection":   {"X-Tag": "a\r\nBcc: hidden@example.com"},
+		"space in name":      {"X Tag": "a"},
+		"colon in name":      {"X-Tag:": "a"},
+		"empty name":         {"": "a"},
+		"over the line size": {"X-Tag": strings.Repeat("a", maxHeaderLine)},
+	} {
+		if _, err := formatExtraHeaders(headers); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/dkim"
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/tokens"
+)
+
+// Identity is an address API submissions may send as instead of the relay
+// account, chosen by name with the "identity" field of POST /api/emails.
+type Identity struct {
+	Name        string
+	Address     string
+	DisplayName string
+	DKIM        *dkim.Signer // nil leaves the message unsigned
+	Tokens      []string     // names of the API tokens that may use it; empty allows every caller
+}
+
+// SetIdentities sets the identities API submissions may send as. Names must
+// be unique and addresses valid.
+func (s *Server) SetIdentities(ids []Identity) error {
+	byName := make(map[string]Identity, len(ids))
+	for _, id := range ids {
+		if id.Name == "" {
+			return errors.New("identity name is required")
+		}
+		if _, dup := byName[id.Name]; dup {
+			return fmt.Errorf("duplicate identity %q", id.Name)
+		}
+		if _, err := recipients.Parse(id.Address); err != nil {
+			return fmt.Errorf("identity %q: %w", id.Name, err)
+		}
+		byName[id.Name] = id
+	}
+	s.identities = byName
+	return nil
+}
+
+// identity returns the identity a submission asked for by name, the relay
+// account for "". It writes the error response and returns false if there
+// is no such identity or the caller's API token may not use it.
+func (s *Server) identity(w http.ResponseWriter, r *http.Request, name string) (Identity, bool) {
+	if name == "" {
+		return Identity{Address: s.fromAddr, DisplayName: s.fromName}, true
+	}
+	id, ok := s.identities[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown identity %q", name), http.StatusBadRequest)
+		return Identity{}, false
+	}
+	if err := mayUse(r, id); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return Identity{}, false
+	}
+	return id, true
+}
+
+// senderIdentity checks the From address of a raw submission the way SMTP
+// checks MAIL FROM: it must be the relay account or the address of an
+// identity the caller's API token may use. It writes the error response and
+// returns false otherwise.
+func (s *Server) senderIdentity(w http.ResponseWriter, r *http.Request, addr string) bool {
+	if strings.EqualFold(addr, s.fromAddr) {
+		return true
+	}
+	var denied error
+	for _, id := range s.identities {
+		if !strings.EqualFold(addr, id.Address) {
+			continue
+		}
+		if denied = mayUse(r, id); denied == nil {
+			return true
+		}
+	}
+	if denied == nil {
+		denied = fmt.Errorf("From %s is neither the relay account nor a configured identity", addr)
+	}
+	http.Error(w, denied.Error(), http.StatusForbidden)
+	return false
+}
+
+// mayUse reports why the caller's API token may not send as id, or nil if
+// it may.
+func mayUse(r *http.Request, id Identity) error {
+	if len(id.Tokens) == 0 {
+		return nil
+	}
+	t, ok := r.Context().Value(tokenKey{}).(*store.APIToken)
+	if !ok {
+		return fmt.Errorf("identity %q requires an API token", id.Name)
+	}
+	if !slices.Contains(id.Tokens, t.Name) && !tokens.Allows(t, tokens.ScopeAdmin) {
+		return fmt.Errorf("API token may not send as identity %q", id.Name)
+	}
+	return nil
+}
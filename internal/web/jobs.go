@@ -0,0 +1,201 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// SetJobs runs the server's side effects (IMAP moves, rejection notices and
+// forwards) through q, registering their handlers on it. Without it they
+// still go through a queue of the server's own, but nothing retries them.
+func (s *Server) SetJobs(q *jobs.Queue) {
+	q.Handle(jobs.KindIMAPMove, s.runIMAPMove)
+	q.Handle(jobs.KindNotify, s.runNotify)
+	q.Handle(jobs.KindRelay, s.runRelay)
+	q.Handle(jobs.KindSend, s.runSend)
+	s.jobs = q
+}
+
+// imapMoveJob is the payload of a jobs.KindIMAPMove job.
+type imapMoveJob struct {
+	MessageID string `json:"message_id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+// notifyJob is the payload of a jobs.KindNotify job. Email has neither body
+// nor raw message; the notice needs neither.
+type notifyJob struct {
+	Email  store.Email `json:"email"`
+	Reason string      `json:"reason,omitempty"`
+}
+
+// relayJob is the payload of a jobs.KindRelay job: a message to relay and,
+// once it is relayed, the decision to record.
+type relayJob struct {
+	Email    store.Email    `json:"email"`
+	Decision store.Decision `json:"decision"`
+}
+
+// moveIMAP queues moving the IMAP message of inbound email from one folder to
+// another. Email without an IMAP message is left alone.
+func (s *Server) moveIMAP(ctx context.Context, email *store.Email, from, to string) {
+	if s.imap == nil || email.IMAPMessageID == "" || from == "" {
+		return
+	}
+	if err := s.jobs.Add(ctx, jobs.KindIMAPMove, email.ID, imapMoveJob{MessageID: email.IMAPMessageID, From: from, To: to}); err != nil {
+		log.Printf("queue IMAP move of email %s to %s: %v", email.ID, to, err)
+	}
+}
+
+func (s *Server) runIMAPMove(ctx context.Context, job store.Job) error {
+	var p imapMoveJob
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("unmarshal payload: %w", err)
+	}
+	if s.imap == nil {
+		return errors.New("IMAP is not configured")
+	}
+	if err := s.imap.MoveMessage(ctx, p.MessageID, p.From, p.To); err != nil {
+		return err
+	}
+	// The email may be gone, e.g. fetched by the API after a move to read.
+	if _, err := s.st.GetSummary(ctx, job.EmailID); err == nil {
+		if err := s.st.UpdateIMAPMailbox(ctx, job.EmailID, p.To); err != nil {
+			log.Printf("update imap mailbox for %s: %v", job.EmailID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) runNotify(ctx context.Context, job store.Job) error {
+	var p notifyJob
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("unmarshal payload: %w", err)
+	}
+	if s.bounce == nil {
+		return errors.New("rejection notices are not enabled")
+	}
+	if err := s.bounce.Send(ctx, &p.Email, p.Reason); err != nil {
+		metrics.Bounces.Inc("failed")
+		return err
+	}
+	metrics.Bounces.Inc("sent")
+	log.Printf("Bounced email %s to %s", p.Email.ID, p.Email.Sender)
+	return nil
+}
+
+func (s *Server) runRelay(ctx context.Context, job store.Job) error {
+	var p relayJob
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("unmarshal payload: %w", err)
+	}
+	if err := s.relay.Send(ctx, &p.Email); err != nil {
+		return err
+	}
+	if p.Decision.Decision == "" {
+		return nil
+	}
+	p.Decision.EnvelopeID = p.Email.EnvelopeID
+	p.Decision.RawMessage = p.Email.RawMessage
+	if err := s.st.RecordDecision(ctx, p.Decision); err != nil {
+		log.Printf("record %s decision for %s: %v", p.Decision.Decision, p.Decision.EmailID, err)
+	}
+	if p.Decision.Decision == store.DecisionForwarded {
+		log.Printf("Email %s forwarded to %s by %s", p.Decision.EmailID, p.Decision.ForwardedTo, p.Decision.Reviewer)
+	}
+	return nil
+}
+
+// runSend relays a scheduled email now that its sending window is open,
+// then deletes it and records its approval. While the relay is throttled
+// the email is rescheduled instead.
+func (s *Server) runSend(ctx context.Context, job store.Job) error {
+	var p jobs.Send
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("unmarshal payload: %w", err)
+	}
+	email, err := s.st.Get(ctx, job.EmailID)
+	if err != nil {
+		return err
+	}
+	if email.Status != store.StatusScheduled {
+		log.Printf("Email %s is %s, not scheduled; not sending it", email.ID, email.Status)
+		return nil
+	}
+	if at := s.throttle.Next(time.Now()); time.Until(at) > 0 {
+		return s.reschedule(ctx, email, p, at)
+	}
+	if err := s.relayHeld(ctx, email, store.StatusScheduled); err != nil {
+		return err
+	}
+	p.Decision.EnvelopeID = email.EnvelopeID
+	p.Decision.RawMessage = email.RawMessage
+	if err := s.st.RecordDecision(ctx, p.Decision); err != nil {
+		log.Printf("record decision for %s: %v", email.ID, err)
+	}
+	log.Printf("Sent scheduled email %s", email.ID)
+	return nil
+}
+
+// reschedule holds a scheduled email the relay may not send yet until at,
+// with a new send job carrying p, so that waiting for the relay's rate limit
+// does not use up the attempts of the current one.
+func (s *Server) reschedule(ctx context.Context, email *store.Email, p jobs.Send, at time.Time) error {
+	if err := s.jobs.Schedule(ctx, jobs.KindSend, email.ID, p, at); err != nil {
+		return err
+	}
+	if err := s.st.Reschedule(ctx, email.ID, at); err != nil {
+		log.Printf("reschedule email %s: %v", email.ID, err)
+	}
+	log.Printf("Relay rate limit reached; email %s rescheduled for %s", email.ID, at.Format(time.RFC3339))
+	return nil
+}
+
+type jobsPage struct {
+	Jobs        []store.Job
+	MaxAttempts int
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	list, err := s.jobs.List(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load jobs", http.StatusInternalServerError)
+		log.Printf("list jobs: %v", err)
+		return
+	}
+	s.render(w, r, "jobs.html", jobsPage{Jobs: list, MaxAttempts: jobs.MaxAttempts})
+}
+
+// handleRetryJob runs a pending or failed job as soon as possible.
+func (s *Server) handleRetryJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.jobs.Retry(r.Context(), id); err != nil {
+		http.Error(w, "job not found or running", http.StatusNotFound)
+		log.Printf("retry job %s: %v", id, err)
+		return
+	}
+	log.Printf("Job %s retried by %s", id, reviewerName(r))
+	s.redirect(w, r, "/jobs")
+}
+
+// handleDiscardJob deletes a job without running it.
+func (s *Server) handleDiscardJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.jobs.Discard(r.Context(), id); err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		log.Printf("discard job %s: %v", id, err)
+		return
+	}
+	log.Printf("Job %s discarded by %s", id, reviewerName(r))
+	s.redirect(w, r, "/jobs")
+}
@@ -0,0 +1,217 @@
+package web
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// listFilter is the filtering, sorting and page of the email lists, as set
+// by the query string of "/".
+type listFilter struct {
+	Status      string // the list's tab; empty for pending mail, see statusTabs
+	Direction   string // "", "outbound" or "inbound"
+	Queue       string
+	Attachments bool   // only emails with attachments
+	Tag         string // only emails with this tag
+	Age         string // ageOver1h, ageOver24h or ageToday; empty for any
+	Snoozed     bool   // only snoozed emails, which are otherwise left out
+	Sort        string // store.SortAge, store.SortSender or store.SortSubject
+	Desc        bool
+	Page        int // 1-based
+}
+
+// statusTabs are the lists the index page offers, by the status of their
+// mail: "" (pending), the other statuses of held mail, then the outcomes of
+// mail that is gone from the store and only left its decision.
+var statusTabs = []string{"", store.StatusScheduled, store.StatusApproved, store.OutcomeRejected, store.OutcomeSent, store.OutcomeBounced}
+
+// Age filters of the pending list, one click away on the index page.
+const (
+	ageOver1h  = "1h"    // received more than an hour ago
+	ageOver24h = "24h"   // received more than a day ago
+	ageToday   = "today" // received since midnight in the reviewer's timezone
+)
+
+func parseListFilter(v url.Values) listFilter {
+	f := listFilter{Queue: v.Get("queue"), Attachments: v.Get("attachments") == "1", Snoozed: v.Get("snoozed") == "1", Sort: store.SortAge, Page: 1}
+	if status := v.Get("status"); slices.Contains(statusTabs, status) {
+		f.Status = status
+	}
+	if tag, err := store.NormalizeTag(v.Get("tag")); err == nil {
+		f.Tag = tag
+	}
+	switch d := v.Get("direction"); d {
+	case store.DirectionOutbound, store.DirectionInbound:
+		f.Direction = d
+	}
+	switch age := v.Get("age"); age {
+	case ageOver1h, ageOver24h, ageToday:
+		f.Age = age
+	}
+	switch sort := v.Get("sort"); sort {
+	case store.SortSender, store.SortSubject:
+		f.Sort = sort
+	}
+	f.Desc = v.Get("order") == "desc"
+	if n, err := strconv.Atoi(v.Get("page")); err == nil && n > 1 {
+		f.Page = n
+	}
+	return f
+}
+
+// decided reports whether f lists decisions, rather than mail still held.
+func (f listFilter) decided() bool {
+	switch f.Status {
+	case store.OutcomeRejected, store.OutcomeSent, store.OutcomeBounced:
+		return true
+	}
+	return false
+}
+
+// query is the store query for f. now, in the reviewer's timezone, anchors
+// the age filter and tells which emails are snoozed.
+func (f listFilter) query(now time.Time) store.PendingQuery {
+	q := store.PendingQuery{
+		Status:         f.Status,
+		Direction:      f.Direction,
+		Queue:          f.Queue,
+		HasAttachments: f.Attachments,
+		Tag:            f.Tag,
+		Sort:           f.Sort,
+		Desc:           f.Desc,
+		Offset:         (f.Page - 1) * pageSize,
+		Limit:          pageSize,
+	}
+	if f.Status == "" {
+		// Only pending mail is snoozed.
+		q.SnoozedAt, q.Snoozed = now, f.Snoozed
+	}
+	switch f.Age {
+	case ageOver1h:
+		q.ReceivedBefore = now.Add(-time.Hour)
+	case ageOver24h:
+		q.ReceivedBefore = now.Add(-24 * time.Hour)
+	case ageToday:
+		y, m, d := now.Date()
+		q.ReceivedAfter = time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	}
+	return q
+}
+
+// url links to page of the list with the same filters, omitting defaults.
+func (f listFilter) url(page int) string {
+	v := f.values()
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	if len(v) == 0 {
+		return "/"
+	}
+	return "/?" + v.Encode()
+}
+
+// ageURLs links to the first page of the list with each age filter in place
+// of f's, keyed by age ("" for any).
+func (f listFilter) ageURLs() map[string]string {
+	urls := make(map[string]string)
+	for _, age := range []string{"", ageToday, ageOver1h, ageOver24h} {
+		g := f
+		g.Age = age
+		urls[age] = g.url(1)
+	}
+	return urls
+}
+
+// statusURLs links to the first page of each tab, keyed by status. Held
+// mail keeps f's filters; decisions are not filtered.
+func (f listFilter) statusURLs() map[string]string {
+	urls := make(map[string]string)
+	for _, status := range statusTabs {
+		g := f
+		g.Status = status
+		if g.decided() {
+			g = listFilter{Status: status, Sort: store.SortAge}
+		}
+		urls[status] = g.url(1)
+	}
+	return urls
+}
+
+// triageURL links to the email at pos (1-based) of the filtered list in the
+// triage view.
+func (f listFilter) triageURL(pos int) string {
+	v := f.values()
+	if pos > 1 {
+		v.Set("pos", strconv.Itoa(pos))
+	}
+	if len(v) == 0 {
+		return "/triage"
+	}
+	return "/triage?" + v.Encode()
+}
+
+// values encodes the filters, omitting defaults and the page.
+func (f listFilter) values() url.Values {
+	v := url.Values{}
+	if f.Status != "" {
+		v.Set("status", f.Status)
+	}
+	if f.Direction != "" {
+		v.Set("direction", f.Direction)
+	}
+	if f.Queue != "" {
+		v.Set("queue", f.Queue)
+	}
+	if f.Attachments {
+		v.Set("attachments", "1")
+	}
+	if f.Tag != "" {
+		v.Set("tag", f.Tag)
+	}
+	if f.Age != "" {
+		v.Set("age", f.Age)
+	}
+	if f.Snoozed {
+		v.Set("snoozed", "1")
+	}
+	if f.Sort != store.SortAge {
+		v.Set("sort", f.Sort)
+	}
+	if f.Desc {
+		v.Set("order", "desc")
+	}
+	return v
+}
+
+type listPage struct {
+	Emails    []emailView
+	Decided   bool             // the tab lists decisions rather than held mail
+	Decisions []store.Decision // instead of Emails, when Decided
+	Filter    listFilter
+	Tags      []string // every tag in use, to filter by
+	Total     int      // emails matching the filter, across all pages
+	Pages     int
+	PrevURL   string                // empty on the first page
+	NextURL   string                // empty on the last page
+	TriageURL string                // the same emails, one at a time
+	Scheduled []store.Email         // approved outbound mail waiting for its sending window or the relay; first page of pending mail only
+	Throttle  *relay.ThrottleStatus // nil unless the relay is throttled; first page of pending or scheduled mail only
+	AgeURLs   map[string]string     // the first page with each age filter instead of Age, keyed by age ("" for any)
+	TabURLs   map[string]string     // the first page of each tab, keyed by status ("" for pending)
+}
+
+// triagePage is one email of the filtered pending list, for keyboard-driven
+// review.
+type triagePage struct {
+	Email   *emailView // nil when nothing is pending
+	Filter  listFilter
+	Pos     int // 1-based position of Email
+	Total   int
+	PrevURL string // empty at the first email
+	NextURL string // empty at the last email
+}
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestListFilter(t *testing.T) {
+	v, _ := url.ParseQuery("direction=inbound&queue=billing&attachments=1&tag=Invoice&snoozed=1&sort=subject&order=desc&page=3")
+	f := parseListFilter(v)
+	want := listFilter{Direction: "inbound", Queue: "billing", Attachments: true, Tag: "invoice", Snoozed: true, Sort: store.SortSubject, Desc: true, Page: 3}
+	if f != want {
+		t.Fatalf("filter = %+v, want %+v", f, want)
+	}
+	if q := f.query(time.Now()); q.Offset != 2*pageSize || q.Limit != pageSize || !q.HasAttachments || q.Tag != "invoice" || !q.Snoozed || q.SnoozedAt.IsZero() || !q.ReceivedBefore.IsZero() {
+		t.Errorf("query = %+v", q)
+	}
+	if got := f.url(4); got != "/?attachments=1&direction=inbound&order=desc&page=4&queue=billing&snoozed=1&sort=subject&tag=invoice" {
+		t.Errorf("url = %s", got)
+	}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 7, 1, 9, 30, 0, 0, berlin)
+	ages := map[string]store.PendingQuery{
+		"1h":    {ReceivedBefore: now.Add(-time.Hour)},
+		"24h":   {ReceivedBefore: now.Add(-24 * time.Hour)},
+		"today": {ReceivedAfter: time.Date(2026, 7, 1, 0, 0, 0, 0, berlin)},
+	}
+	for age, want := range ages {
+		v, _ := url.ParseQuery("age=" + age)
+		q := parseListFilter(v).query(now)
+		if !q.ReceivedBefore.Equal(want.ReceivedBefore) || !q.ReceivedAfter.Equal(want.ReceivedAfter) {
+			t.Errorf("age %s: received before %v, after %v; want %v, %v", age, q.ReceivedBefore, q.ReceivedAfter, want.ReceivedBefore, want.ReceivedAfter)
+		}
+	}
+	if urls := f.ageURLs(); urls["24h"] != "/?age=24h&attachments=1&direction=inbound&order=desc&queue=billing&snoozed=1&sort=subject&tag=invoice" {
+		t.Errorf("age urls = %v", urls)
+	}
+
+	v, _ = url.ParseQuery("direction=sideways&sort=size&tag=two+words&page=-2&age=1y")
+	if f := parseListFilter(v); f != (listFilter{Sort: store.SortAge, Page: 1}) {
+		t.Errorf("invalid values = %+v, want defaults", f)
+	}
+	if got := (listFilter{Sort: store.SortAge, Page: 1}).url(1); got != "/" {
+		t.Errorf("default url = %s, want /", got)
+	}
+	if got := f.triageURL(2); got != "/triage?attachments=1&direction=inbound&order=desc&pos=2&queue=billing&snoozed=1&sort=subject&tag=invoice" {
+		t.Errorf("triage url = %s", got)
+	}
+	if got := (listFilter{Sort: store.SortAge, Page: 1}).triageURL(1); got != "/triage" {
+		t.Errorf("default triage url = %s, want /triage", got)
+	}
+}
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/albert/mailescrow/internal/i18n"
+)
+
+// Cookies holding a reviewer's choices on the preferences page. They override
+// the configured language and timezone for that browser.
+const (
+	langCookie = "mailescrow_lang"
+	tzCookie   = "mailescrow_tz"
+)
+
+// prefsMaxAge is how long the preference cookies last, in seconds.
+const prefsMaxAge = 365 * 24 * 60 * 60
+
+// locale is how a page is shown to one request: in which language, and with
+// timestamps (stored in UTC) in which timezone.
+type locale struct {
+	lang string
+	loc  *time.Location
+}
+
+// SetLocale sets the language of the web UI and the timezone its timestamps
+// are shown in, for reviewers who have not chosen their own on the
+// preferences page. An empty language follows each browser's Accept-Language
+// header; an empty timezone means UTC.
+func (s *Server) SetLocale(language, timezone string) error {
+	if language != "" && !i18n.Supported(language) {
+		return fmt.Errorf("unsupported language %q (have %v)", language, i18n.Languages())
+	}
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return fmt.Errorf("load timezone %q: %w", timezone, err)
+		}
+	}
+	s.language, s.timezone = language, loc
+	return nil
+}
+
+// locale returns the language and timezone to render r's page in: the
+// reviewer's cookies first, then the configuration, then Accept-Language and
+// UTC.
+func (s *Server) locale(r *http.Request) locale {
+	l := locale{lang: s.language, loc: s.timezone}
+	if c, err := r.Cookie(langCookie); err == nil && i18n.Supported(c.Value) {
+		l.lang = c.Value
+	}
+	if l.lang == "" {
+		l.lang = i18n.Match(r.Header.Get("Accept-Language"))
+	}
+	if c, err := r.Cookie(tzCookie); err == nil {
+		if loc, err := time.LoadLocation(c.Value); err == nil {
+			l.loc = loc
+		}
+	}
+	if l.loc == nil {
+		l.loc = time.UTC
+	}
+	return l
+}
+
+// funcs are the template functions that depend on the locale: t translates a
+// message, lang names the language and datetime and date show a timestamp.
+func (l locale) funcs() template.FuncMap {
+	return template.FuncMap{
+		"t": func(msg string, args ...any) string {
+			return i18n.Translate(l.lang, msg, args...)
+		},
+		"lang": func() string { return l.lang },
+		"datetime": func(t time.Time) string {
+			return t.In(l.loc).Format("2006-01-02 15:04:05 MST")
+		},
+		"date": func(t time.Time) string {
+			return t.In(l.loc).Format("2006-01-02 15:04 MST")
+		},
+	}
+}
+
+// languageOption is a choice in the preferences page's language list.
+type languageOption struct {
+	Code, Name string
+}
+
+type preferencesPage struct {
+	Languages       []languageOption
+	Language        string // chosen in this browser; empty to follow the default
+	DefaultLanguage string // configured, or empty to follow Accept-Language
+	Timezone        string // chosen in this browser; empty to follow the default
+	DefaultTimezone string
+	BadTimezone     string // submitted but unknown
+}
+
+// handlePreferences shows the language and timezone chosen in this browser.
+func (s *Server) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	s.renderPreferences(w, r, "")
+}
+
+func (s *Server) renderPreferences(w http.ResponseWriter, r *http.Request, badTimezone string) {
+	page := preferencesPage{DefaultLanguage: s.language, BadTimezone: badTimezone}
+	for _, lang := range i18n.Languages() {
+		page.Languages = append(page.Languages, languageOption{Code: lang, Name: i18n.Name(lang)})
+	}
+	if c, err := r.Cookie(langCookie); err == nil && i18n.Supported(c.Value) {
+		page.Language = c.Value
+	}
+	if c, err := r.Cookie(tzCookie); err == nil {
+		page.Timezone = c.Value
+	}
+	page.DefaultTimezone = "UTC"
+	if s.timezone != nil {
+		page.DefaultTimezone = s.timezone.String()
+	}
+	s.render(w, r, "preferences.html", page)
+}
+
+// handleSetPreferences stores the chosen language and timezone in cookies.
+// An empty choice clears the cookie, going back to the default.
+func (s *Server) handleSetPreferences(w http.ResponseWriter, r *http.Request) {
+	lang, tz := r.FormValue("language"), r.FormValue("timezone")
+	if lang != "" && !i18n.Supported(lang) {
+		http.Error(w, "unsupported language", http.StatusBadRequest)
+		return
+	}
+	if tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			s.renderPreferences(w, r, tz)
+			return
+		}
+	}
+	s.setPreference(w, langCookie, lang)
+	s.setPreference(w, tzCookie, tz)
+	s.redirect(w, r, "/preferences")
+}
+
+func (s *Server) setPreference(w http.ResponseWriter, name, value string) {
+	maxAge := prefsMaxAge
+	if value == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.url("/"),
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
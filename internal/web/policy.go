@@ -0,0 +1,98 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/policy"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// SetPolicies sets the recipient domain policies applied to outbound mail
+// submitted through the API and to approvals of held outbound mail.
+// policies may be nil.
+func (s *Server) SetPolicies(policies *policy.Set) {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+	s.policies = policies
+}
+
+// requirement returns what the recipient domain policies require of mail to
+// recipients.
+func (s *Server) requirement(recipients []string) policy.Requirement {
+	s.rulesMu.Lock()
+	policies := s.policies
+	s.rulesMu.Unlock()
+	return policies.For(recipients)
+}
+
+// emailRequirement returns what the policies require of email. They only
+// cover outbound mail.
+func (s *Server) emailRequirement(email *store.Email) policy.Requirement {
+	if email.Direction != store.DirectionOutbound {
+		return policy.Requirement{Approvals: 1}
+	}
+	return s.requirement(email.Recipients)
+}
+
+// addApproval checks reviewer's approval of email against the policies. If
+// it is the last approval needed, it is added to email.Approvals and
+// addApproval returns true: the caller approves the email. Otherwise, when
+// a required reason is missing, reviewer has approved the email already or
+// it needs further approvals (this one is then recorded), it writes the
+// response and returns false.
+func (s *Server) addApproval(w http.ResponseWriter, r *http.Request, email *store.Email, reviewer string) bool {
+	req := s.emailRequirement(email)
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if req.RequireReason && reason == "" {
+		http.Error(w, "a reason is required to approve mail to "+req.Domain, http.StatusBadRequest)
+		return false
+	}
+	if slices.ContainsFunc(email.Approvals, func(a store.Approval) bool { return a.Reviewer == reviewer }) {
+		http.Error(w, "You have approved this email already; it needs another reviewer", http.StatusConflict)
+		return false
+	}
+	approval := store.Approval{Reviewer: reviewer, Reason: reason, At: time.Now().UTC()}
+	if len(email.Approvals)+1 >= req.Approvals {
+		email.Approvals = append(email.Approvals, approval)
+		return true
+	}
+
+	version, ok := formVersion(w, r, email)
+	if !ok {
+		return false
+	}
+	if err := s.st.AddApproval(r.Context(), email.ID, approval, version); err != nil {
+		if s.lostRace(r.Context(), email.ID, err) {
+			s.alreadyHandled(w, r, email.ID)
+			return false
+		}
+		http.Error(w, "failed to approve email", http.StatusInternalServerError)
+		log.Printf("add approval of email %s: %v", email.ID, err)
+		return false
+	}
+	log.Printf("Email %s approved by %s, %d of %d approvals required by policy %s", email.ID, reviewer, len(email.Approvals)+1, req.Approvals, req.Domain)
+	s.redirectAfterAction(w, r)
+	return false
+}
+
+// approvalReason sums up the reasons given by the reviewers approving an
+// email for its decision. With several approvals each is named after its
+// reviewer.
+func approvalReason(approvals []store.Approval) string {
+	var reasons []string
+	for _, a := range approvals {
+		switch {
+		case len(approvals) == 1:
+			reasons = append(reasons, a.Reason)
+		case a.Reason == "":
+			reasons = append(reasons, a.Reviewer)
+		default:
+			reasons = append(reasons, a.Reviewer+": "+a.Reason)
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
@@ -0,0 +1,151 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Preview views, selected with ?view=.
+const (
+	previewText = "text"
+	previewHTML = "html"
+	previewRaw  = "raw"
+)
+
+// previewPage shows an outbound email as it will be relayed.
+type previewPage struct {
+	emailView
+	View string // previewText, previewHTML or previewRaw
+
+	// Headers, body parts and source of the message as relayed.
+	FinalFrom    string
+	FinalTo      string
+	FinalSubject string
+	Text         string
+	HTML         string
+	Raw          string
+
+	Notes []string // how relaying changes the message
+}
+
+// handlePreview renders the final message an outbound email would be relayed
+// as if approved now, as plain text, HTML or raw source.
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	email, err := s.st.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	if email.Direction != store.DirectionOutbound {
+		http.Error(w, "only outbound emails can be previewed", http.StatusBadRequest)
+		return
+	}
+
+	final := email.RawMessage
+	if p, ok := s.relay.(relay.Previewer); ok {
+		stamped := *email
+		stamped.ApprovedBy = reviewerName(r)
+		stamped.ApprovedAt = time.Now().UTC()
+		final = p.Preview(&stamped)
+	}
+
+	page := previewPage{
+		emailView: s.emailView(r.Context(), email),
+		View:      r.URL.Query().Get("view"),
+		Raw:       string(s.displayRaw(final)),
+	}
+	origHeader, origBody := splitMessage(email.RawMessage)
+	finalHeader, finalBody := splitMessage(final)
+	if !bytes.Equal(finalHeader, origHeader) {
+		page.Notes = append(page.Notes, "The relay rewrites the headers of this message; they are shown as if you approved it now.")
+	}
+	if !bytes.Equal(finalBody, origBody) {
+		page.Notes = append(page.Notes, "The links of this message are rewritten for click tracking; clicks are counted on the stats page.")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(final))
+	if err != nil {
+		page.Notes = append(page.Notes, fmt.Sprintf("The message cannot be parsed: %v", err))
+	} else {
+		page.FinalFrom = mimetext.Header(msg.Header.Get("From"))
+		page.FinalTo = mimetext.Header(msg.Header.Get("To"))
+		page.FinalSubject = s.redactor.Redact(mimetext.Header(msg.Header.Get("Subject")))
+		page.Text, page.HTML = mimetext.Parts(textproto.MIMEHeader(msg.Header), msg.Body)
+		page.Text, page.HTML = s.redactor.Redact(page.Text), s.redactor.Redact(page.HTML)
+		page.Notes = append(page.Notes, dkimNotes(email.RawMessage, msg.Header)...)
+	}
+	if page.View != previewHTML && page.View != previewRaw {
+		page.View = previewText
+		if page.Text == "" && page.HTML != "" {
+			page.View = previewHTML
+		}
+	}
+	s.render(w, r, "preview.html", page)
+}
+
+// splitMessage splits a raw message into its header and body. A message
+// that cannot be parsed is all header.
+func splitMessage(raw []byte) (header, body []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return raw, nil
+	}
+	body, _ = io.ReadAll(msg.Body)
+	return raw[:len(raw)-len(body)], body
+}
+
+// dkimNotes describes the DKIM signatures on the original message and whether
+// relaying will invalidate them by changing a signed header.
+func dkimNotes(original []byte, final mail.Header) []string {
+	orig, err := mail.ReadMessage(bytes.NewReader(original))
+	if err != nil {
+		return nil
+	}
+	sigs := orig.Header["Dkim-Signature"]
+	if len(sigs) == 0 {
+		return []string{"The message has no DKIM signature; the relay may add its own."}
+	}
+	if len(final["Dkim-Signature"]) < len(sigs) {
+		return []string{"The relay strips the DKIM-Signature header; the message is relayed unsigned unless the relay signs it."}
+	}
+	var notes []string
+	for _, sig := range sigs {
+		tags := dkimTags(sig)
+		var broken []string
+		for _, name := range strings.Split(tags["h"], ":") {
+			key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			if key != "" && !slices.Equal(orig.Header[key], final[key]) && !slices.Contains(broken, key) {
+				broken = append(broken, key)
+			}
+		}
+		if len(broken) > 0 {
+			notes = append(notes, fmt.Sprintf("DKIM signature for %s will fail: the relay changes the signed header(s) %s.", tags["d"], strings.Join(broken, ", ")))
+		} else {
+			notes = append(notes, fmt.Sprintf("DKIM signature for %s is preserved: no signed header is changed.", tags["d"]))
+		}
+	}
+	return notes
+}
+
+// dkimTags parses the tag=value list of a DKIM-Signature header.
+func dkimTags(v string) map[string]string {
+	tags := make(map[string]string)
+	for _, field := range strings.Split(v, ";") {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestDKIMNotes(t *testing.T) {
+	original := []byte("DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel;\r\n\th=From:To:Subject:Received; bh=x; b=y\r\n" +
+		"Received: from app\r\nFrom: app@example.com\r\nTo: ops@example.com\r\nSubject: Hi\r\n\r\nBody\r\n")
+	header := func(raw []byte) mail.Header {
+		msg, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("read message: %v", err)
+		}
+		return msg.Header
+	}
+	email := &store.Email{ID: "e1", RawMessage: original}
+
+	tests := []struct {
+		name  string
+		final []byte
+		want  string
+	}{
+		{"unchanged", original, "is preserved"},
+		{"signed header stripped", relay.RewriteHeaders(original, email, false, []string{"Received"}), "changes the signed header(s) Received"},
+		{"unsigned header added", relay.RewriteHeaders(original, email, true, nil), "is preserved"},
+		{"signature stripped", relay.RewriteHeaders(original, email, false, []string{"DKIM-Signature"}), "strips the DKIM-Signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notes := dkimNotes(original, header(tt.final))
+			if len(notes) != 1 || !strings.Contains(notes[0], tt.want) {
+				t.Errorf("notes = %q, want one containing %q", notes, tt.want)
+			}
+		})
+	}
+
+	if notes := dkimNotes([]byte("From: a@example.com\r\n\r\nBody"), nil); len(notes) != 1 || !strings.Contains(notes[0], "no DKIM signature") {
+		t.Errorf("unsigned notes = %q", notes)
+	}
+}
@@ -0,0 +1,163 @@
+package web
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// SetBasePath serves the web UI and the API under prefix, e.g. "/mailescrow",
+// for a reverse proxy that forwards that subpath without rewriting it.
+// Requests outside the prefix get 404, and links and redirects include it.
+func (s *Server) SetBasePath(prefix string) {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	s.basePath = prefix
+}
+
+// SetPublicURL sets the URL reviewers open the web UI at, base path
+// included, e.g. "https://intranet.example.org/mailescrow/". Links shown to
+// be opened elsewhere, such as share links, are built on it; when it is
+// empty they use the scheme and host of the request.
+func (s *Server) SetPublicURL(u string) {
+	s.publicURL = strings.TrimRight(u, "/")
+}
+
+// SetTrustedProxies honors the X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host headers of requests from the given IP addresses and CIDR
+// ranges. Headers from anyone else are ignored, so clients cannot spoof them.
+func (s *Server) SetTrustedProxies(proxies []string) error {
+	var prefixes []netip.Prefix
+	for _, p := range proxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(p)
+			if addrErr != nil {
+				return fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", p)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	s.trustedProxies = prefixes
+	return nil
+}
+
+// url returns path, a path of the UI such as "/tokens", under the base
+// path. Templates call it for every link, e.g. {{url "/email/"}}{{.ID}}.
+func (s *Server) url(path string) string {
+	return s.basePath + path
+}
+
+// redirect sends the client to path, a path of the UI such as "/tokens".
+// Behind a trusted proxy that set X-Forwarded-Proto, the location is an
+// absolute URL with the scheme and host the client used.
+func (s *Server) redirect(w http.ResponseWriter, r *http.Request, path string) {
+	target := s.url(path)
+	if r.URL.Scheme != "" {
+		target = r.URL.Scheme + "://" + r.Host + target
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// absoluteURL returns the URL of path, a path of the UI, under the public
+// URL, or as the client of r reaches it, for links shown to be opened
+// elsewhere.
+func (s *Server) absoluteURL(r *http.Request, path string) string {
+	if s.publicURL != "" {
+		return s.publicURL + path
+	}
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + r.Host + s.url(path)
+}
+
+// proxied adapts requests arriving through a reverse proxy before h sees
+// them: it applies the forwarded headers of trusted proxies and strips the
+// base path.
+func (s *Server) proxied(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.trusted(r.RemoteAddr) {
+			r = s.forwarded(r)
+		}
+		if s.basePath == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == s.basePath {
+			s.redirect(w, r, "/")
+			return
+		}
+		rest, ok := strings.CutPrefix(r.URL.Path, s.basePath)
+		if !ok || !strings.HasPrefix(rest, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// forwarded returns r with the client address, scheme and host its proxy
+// reported. The client is the last X-Forwarded-For address that is not
+// itself a trusted proxy.
+func (s *Server) forwarded(r *http.Request) *http.Request {
+	r = r.Clone(r.Context())
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		r.RemoteAddr = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	switch proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto {
+	case "http", "https":
+		r.URL.Scheme = proto
+	}
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		r.Host = host
+	}
+	return r
+}
+
+// trusted reports whether addr, a RemoteAddr or X-Forwarded-For entry, is a
+// trusted proxy.
+func (s *Server) trusted(addr string) bool {
+	if len(s.trustedProxies) == 0 {
+		return false
+	}
+	ip, err := netip.ParseAddr(remoteIP(addr))
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of addr, which may carry a port.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxied(t *testing.T) {
+	s := &Server{}
+	s.SetBasePath("/mailescrow/")
+	if err := s.SetTrustedProxies([]string{"10.0.0.0/8", "127.0.0.1"}); err != nil {
+		t.Fatalf("set trusted proxies: %v", err)
+	}
+	var got *http.Request
+	h := s.proxied(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		s.redirect(w, r, "/tokens")
+	}))
+
+	tests := []struct {
+		name       string
+		remote     string
+		path       string
+		headers    map[string]string
+		wantStatus int
+		wantPath   string
+		wantRemote string
+		wantLoc    string
+	}{
+		{
+			name: "direct", remote: "192.0.2.1:5000", path: "/mailescrow/email/1",
+			wantStatus: http.StatusSeeOther, wantPath: "/email/1", wantRemote: "192.0.2.1:5000", wantLoc: "/mailescrow/tokens",
+		},
+		{
+			name: "spoofed headers ignored", remote: "192.0.2.1:5000", path: "/mailescrow/",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.9", "X-Forwarded-Proto": "https"},
+			wantStatus: http.StatusSeeOther, wantPath: "/", wantRemote: "192.0.2.1:5000", wantLoc: "/mailescrow/tokens",
+		},
+		{
+			name: "trusted proxy", remote: "10.1.2.3:41000", path: "/mailescrow/",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.5, 198.51.100.9, 127.0.0.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "mail.example.org"},
+			wantStatus: http.StatusSeeOther, wantPath: "/", wantRemote: "198.51.100.9", wantLoc: "https://mail.example.org/mailescrow/tokens",
+		},
+		{name: "outside base path", remote: "192.0.2.1:5000", path: "/email/1", wantStatus: http.StatusNotFound},
+		{name: "prefix of a longer segment", remote: "192.0.2.1:5000", path: "/mailescrowx/", wantStatus: http.StatusNotFound},
+		{name: "base path without slash", remote: "192.0.2.1:5000", path: "/mailescrow", wantStatus: http.StatusSeeOther, wantLoc: "/mailescrow/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if loc := rec.Header().Get("Location"); loc != tt.wantLoc {
+				t.Errorf("Location = %q, want %q", loc, tt.wantLoc)
+			}
+			if tt.wantPath == "" {
+				if got != nil {
+					t.Errorf("handler called with %s", got.URL.Path)
+				}
+				return
+			}
+			if got.URL.Path != tt.wantPath || got.RemoteAddr != tt.wantRemote {
+				t.Errorf("handler saw path %q from %q, want %q from %q", got.URL.Path, got.RemoteAddr, tt.wantPath, tt.wantRemote)
+			}
+		})
+	}
+
+	if err := s.SetTrustedProxies([]string{"proxy.local"}); err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+
+	"github.com/google/uuid"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+)
+
+// MaxRawMessageBytes bounds a message submitted to POST /api/emails/raw.
+const MaxRawMessageBytes = 25 << 20
+
+type createRawEmailRequest struct {
+	Message []byte `json:"message"` // the complete message, base64-encoded
+}
+
+// handleCreateRawEmail holds a complete RFC 5322 message built by the
+// caller. The body is either the message itself (Content-Type:
+// message/rfc822) or JSON carrying it base64-encoded. Sender, recipients and
+// subject are read from the headers for review; the message is relayed as
+// submitted. The From address must be one the caller may send as, since it
+// is what trusted contacts, rules and quotas are checked against.
+func (s *Server) handleCreateRawEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	body := http.MaxBytesReader(w, r.Body, MaxRawMessageBytes)
+
+	var raw []byte
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "message/rfc822":
+		b, err := io.ReadAll(body)
+		if err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				http.Error(w, fmt.Sprintf("message exceeds %d bytes", MaxRawMessageBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "failed to read message", http.StatusBadRequest)
+			return
+		}
+		raw = b
+	case "application/json", "":
+		var req createRawEmailRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON: message must be the base64-encoded message", http.StatusBadRequest)
+			return
+		}
+		raw = req.Message
+	default:
+		http.Error(w, "Content-Type must be message/rfc822 or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	sub, err := parseRawMessage(raw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.senderIdentity(w, r, sub.sender) {
+		return
+	}
+	if errs := checkRecipientCount(sub.to); errs != nil {
+		writeFieldErrors(w, "invalid request", errs)
+		return
+	}
+	if errs := s.checkRecipients(ctx, sub.to); len(errs) > 0 {
+		writeFieldErrors(w, "invalid recipients", errs)
+		return
+	}
+
+	sum := sha256.Sum256(raw)
+	s.idempotent(w, r, hex.EncodeToString(sum[:]), func() (createEmailResponse, bool) {
+		return s.submit(ctx, w, sub)
+	})
+}
+
+// parseRawMessage reads what review needs from a submitted message. The
+// sender is the From address, and the recipients are the To and Cc
+// addresses. A Bcc header is refused, since the message is relayed unchanged
+// and every recipient would see it.
+func parseRawMessage(raw []byte) (submission, error) {
+	if len(raw) == 0 {
+		return submission{}, errors.New("message is required")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return submission{}, fmt.Errorf("invalid message: %v", err)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return submission{}, errors.New("message needs a valid From header")
+	}
+	if _, ok := msg.Header["Bcc"]; ok {
+		return submission{}, errors.New("message must not have a Bcc header: it would be relayed to every recipient")
+	}
+	var to []string
+	for _, name := range []string{"To", "Cc"} {
+		addrs, err := msg.Header.AddressList(name)
+		if err != nil && !errors.Is(err, mail.ErrHeaderNotPresent) {
+			return submission{}, fmt.Errorf("invalid %s header: %v", name, err)
+		}
+		for _, a := range addrs {
+			to = append(to, a.Address)
+		}
+	}
+	if len(to) == 0 {
+		return submission{}, errors.New("message needs at least one To or Cc recipient")
+	}
+
+	subject := mimetext.Header(msg.Header.Get("Subject"))
+	if subject == "" {
+		subject = "(no subject)"
+	}
+
+	return submission{
+		id:      uuid.New().String(),
+		sender:  from[0].Address,
+		to:      to,
+		subject: subject,
+		body:    mimetext.Body(textproto.MIMEHeader(msg.Header), msg.Body),
+		raw:     raw,
+	}, nil
+}
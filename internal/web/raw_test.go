@@ -0,0 +1,51 @@
+package web
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseRawMessage(t *testing.T) {
+	raw := []byte("From: App <app@example.com>\r\n" +
+		"To: a@example.com, B <b@example.com>\r\n" +
+		"Cc: c@example.com\r\n" +
+		"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Hello\r\n")
+	sub, err := parseRawMessage(raw)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if sub.sender != "app@example.com" {
+		t.Errorf("sender = %q, want app@example.com", sub.sender)
+	}
+	if want := []string{"a@example.com", "b@example.com", "c@example.com"}; !slices.Equal(sub.to, want) {
+		t.Errorf("to = %v, want %v", sub.to, want)
+	}
+	if sub.subject != "Grüße" {
+		t.Errorf("subject = %q, want decoded Grüße", sub.subject)
+	}
+	if sub.body != "Hello" {
+		t.Errorf("body = %q, want Hello", sub.body)
+	}
+	if !slices.Equal(sub.raw, raw) {
+		t.Error("raw message was modified")
+	}
+	if sub.id == "" {
+		t.Error("expected an ID")
+	}
+
+	for name, msg := range map[string]string{
+		"empty":         "",
+		"no from":       "To: a@example.com\r\n\r\nbody",
+		"no recipients": "From: app@example.com\r\nSubject: Hi\r\n\r\nbody",
+		"bcc":           "From: app@example.com\r\nTo: a@example.com\r\nBcc: hidden@example.com\r\n\r\nbody",
+		"bad to":        "From: app@example.com\r\nTo: not an address\r\n\r\nbody",
+	} {
+		if _, err := parseRawMessage([]byte(msg)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// fieldError reports a problem with one field of an API request.
+type fieldError struct {
+	Field   string `json:"field"` // e.g. "to[1]"
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// checkRecipients validates each address in to, returning one error per
+// refused address.
+func (s *Server) checkRecipients(ctx context.Context, to []string) []fieldError {
+	var errs []fieldError
+	for i, addr := range to {
+		if p := s.recipients.Check(ctx, addr); p != nil {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("to[%d]", i), Value: addr, Message: p.Reason})
+		}
+	}
+	return errs
+}
+
+// writeFieldErrors responds 400 with a JSON body listing the invalid fields.
+func writeFieldErrors(w http.ResponseWriter, msg string, errs []fieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	resp := struct {
+		Error  string       `json:"error"`
+		Fields []fieldError `json:"fields"`
+	}{msg, errs}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
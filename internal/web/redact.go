@@ -0,0 +1,72 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/mail"
+	"net/textproto"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/redact"
+)
+
+// SetRedactor redacts what r matches from raw messages and previews shown in
+// the web UI. Stored subjects and bodies are redacted before they are saved
+// (see redact.Store), so they need nothing more.
+func (s *Server) SetRedactor(r *redact.Redactor) {
+	s.redactor = r
+}
+
+// displayRaw returns raw as the web UI shows it. With a redactor the body is
+// replaced by its decoded, redacted text, since patterns cannot be matched
+// inside base64 or quoted-printable content.
+func (s *Server) displayRaw(raw []byte) []byte {
+	if len(raw) == 0 {
+		return []byte("The raw message of this email was not stored (redaction.raw: drop).\n")
+	}
+	if s.redactor == nil {
+		return raw
+	}
+	header := raw
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		header = raw[:i+2]
+	} else if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		header = raw[:i+1]
+	}
+	var b bytes.Buffer
+	b.Write(s.redactor.RedactBytes(header))
+	b.WriteString("\r\n[Body shown decoded and redacted]\r\n\r\n")
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		b.WriteString(s.redactor.Redact(mimetext.Body(textproto.MIMEHeader(msg.Header), msg.Body)))
+	}
+	return b.Bytes()
+}
+
+// openRaw returns a reader over the raw message of email id as displayRaw
+// shows it, and whether the raw message was stored. Without a redactor the
+// message is streamed from the store; redacting it takes it whole.
+func (s *Server) openRaw(ctx context.Context, id string) (io.ReadCloser, bool, error) {
+	if s.redactor != nil {
+		email, err := s.st.Get(ctx, id)
+		if err != nil {
+			return nil, false, err
+		}
+		return io.NopCloser(bytes.NewReader(s.displayRaw(email.RawMessage))), len(email.RawMessage) > 0, nil
+	}
+	raw, err := s.st.OpenRaw(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	br := bufio.NewReader(raw)
+	if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+		_ = raw.Close()
+		return io.NopCloser(bytes.NewReader(s.displayRaw(nil))), false, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, raw}, true, nil
+}
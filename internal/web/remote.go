@@ -0,0 +1,147 @@
+package web
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlRemotePolicy is htmlPolicy for a reviewer who asked to load the
+// remote content of a message: images, styles and fonts may come from
+// anywhere, but still no script runs.
+const htmlRemotePolicy = "sandbox; default-src 'none'; img-src 'self' data: https: http:; style-src 'unsafe-inline' https: http:; font-src https: http:"
+
+// remoteAttrs are the attributes that make a browser fetch a URL, by the
+// tags they do so on. Links are left out: they load nothing until clicked.
+var remoteAttrs = map[atom.Atom][]string{
+	atom.Img:    {"src", "srcset"},
+	atom.Image:  {"href", "xlink:href"},
+	atom.Input:  {"src"},
+	atom.Source: {"src", "srcset"},
+	atom.Video:  {"src", "poster"},
+	atom.Audio:  {"src"},
+	atom.Iframe: {"src"},
+	atom.Embed:  {"src"},
+	atom.Object: {"data"},
+	atom.Link:   {"href"},
+	atom.Body:   {"background"},
+	atom.Table:  {"background"},
+	atom.Td:     {"background"},
+	atom.Th:     {"background"},
+}
+
+// cssRemote matches what makes CSS fetch a URL from another site.
+var cssRemote = regexp.MustCompile(`(?i)(url\(\s*['"]?|@import\s+['"])\s*(https?:)?//`)
+
+// remoteContent scans an HTML document for what it loads from other sites.
+// It returns doc, without its tracking pixels if strip is set, how many
+// remote resources it loads and how many of those are tracking pixels:
+// remote images hidden or at most a pixel wide or high, whose only use is
+// telling the sender the message was opened. A document that cannot be
+// tokenized is counted as far as it can be.
+func remoteContent(doc string, strip bool) (out string, remote, trackers int) {
+	z := html.NewTokenizer(strings.NewReader(doc))
+	var b strings.Builder
+	inStyle := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			b.Write(z.Raw())
+			return b.String(), remote, trackers
+		}
+		raw := z.Raw()
+		switch tt {
+		case html.TextToken:
+			if inStyle {
+				remote += len(cssRemote.FindAllIndex(raw, -1))
+			}
+		case html.EndTagToken:
+			inStyle = false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw = append([]byte(nil), raw...) // Token reuses the buffer
+			tok := z.Token()
+			inStyle = tok.DataAtom == atom.Style && tt == html.StartTagToken
+			n := remoteRefs(tok)
+			remote += n
+			if n > 0 && tok.DataAtom == atom.Img && trackingPixel(tok) {
+				trackers++
+				if strip {
+					continue
+				}
+			}
+		}
+		b.Write(raw)
+	}
+}
+
+// remoteRefs counts the remote URLs a tag loads, in its attributes and its
+// inline style.
+func remoteRefs(tok html.Token) int {
+	n := 0
+	for _, a := range tok.Attr {
+		key := a.Key
+		if a.Namespace != "" {
+			key = a.Namespace + ":" + key
+		}
+		if key == "style" {
+			n += len(cssRemote.FindAllStringIndex(a.Val, -1))
+			continue
+		}
+		for _, k := range remoteAttrs[tok.DataAtom] {
+			if key == k && remoteURL(a.Val) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// remoteURL reports whether a URL, or any of those of a srcset, is on
+// another site: absolute http or https, or scheme-relative.
+func remoteURL(v string) bool {
+	for u := range strings.SplitSeq(v, ",") {
+		u = strings.ToLower(strings.TrimSpace(u))
+		if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "//") {
+			return true
+		}
+	}
+	return false
+}
+
+// trackingPixel reports whether an <img> is hidden or at most a pixel wide
+// or high, by its attributes or its inline style.
+func trackingPixel(tok html.Token) bool {
+	for _, a := range tok.Attr {
+		switch a.Key {
+		case "width", "height":
+			if tinyLength(a.Val) {
+				return true
+			}
+		case "hidden":
+			return true
+		case "style":
+			for decl := range strings.SplitSeq(a.Val, ";") {
+				prop, val, _ := strings.Cut(decl, ":")
+				prop = strings.ToLower(strings.TrimSpace(prop))
+				val = strings.TrimSpace(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(val)), "!important"))
+				switch {
+				case prop == "display" && val == "none",
+					prop == "visibility" && val == "hidden",
+					(prop == "width" || prop == "height" || prop == "max-width" || prop == "max-height") && tinyLength(val):
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// tinyLength reports whether an HTML or CSS length is at most one pixel.
+func tinyLength(v string) bool {
+	v = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v)), "px")
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	return err == nil && n <= 1
+}
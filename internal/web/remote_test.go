@@ -0,0 +1,51 @@
+package web
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRemoteContent(t *testing.T) {
+	tests := []struct {
+		name             string
+		doc              string
+		remote, trackers int
+	}{
+		{"none", `<p>Hi</p><img src="cid:logo"><img src="data:image/png;base64,AA=="><a href="https://example.org/">link</a>`, 0, 0},
+		{"image", `<img src="https://cdn.example.org/a.png">`, 1, 0},
+		{"scheme-relative", `<img src="//cdn.example.org/a.png">`, 1, 0},
+		{"srcset", `<img src="a.png" srcset="a.png 1x, https://cdn.example.org/a@2x.png 2x">`, 1, 0},
+		{"pixel", `<img src="https://t.example.net/o.gif" width="1" height="1">`, 1, 1},
+		{"pixel in px", `<img src="https://t.example.net/o.gif" width="1px">`, 1, 1},
+		{"hidden", `<img src="https://t.example.net/o.gif" style="display: none !important">`, 1, 1},
+		{"zero size style", `<img src="https://t.example.net/o.gif" style="width:0;height:0">`, 1, 1},
+		{"local pixel", `<img src="cid:spacer" width="1" height="1">`, 0, 0},
+		{"stylesheet", `<link rel="stylesheet" href="https://cdn.example.org/s.css">`, 1, 0},
+		{"style", `<style>@import "https://cdn.example.org/s.css"; p { background: url(https://cdn.example.org/bg.png) }</style>`, 2, 0},
+		{"inline style", `<td style="background-image: url('http://cdn.example.org/bg.png')">`, 1, 0},
+		{"background", `<body background="https://cdn.example.org/bg.png">`, 1, 0},
+		{"text", `<p>Paste url(https://example.org/) here</p>`, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, remote, trackers := remoteContent(tt.doc, false)
+			if out != tt.doc || remote != tt.remote || trackers != tt.trackers {
+				t.Errorf("remoteContent = %q, %d, %d, want the document unchanged, %d, %d", out, remote, trackers, tt.remote, tt.trackers)
+			}
+		})
+	}
+}
+
+func TestRemoteContentStrip(t *testing.T) {
+	doc := `<p>Hi</p><img src="https://cdn.example.org/a.png"><IMG SRC="https://t.example.net/o.gif" WIDTH=1 HEIGHT=1 /><p>Bye</p>`
+	out, remote, trackers := remoteContent(doc, true)
+	if want := `<p>Hi</p><img src="https://cdn.example.org/a.png"><p>Bye</p>`; out != want {
+		t.Errorf("stripped = %q, want %q", out, want)
+	}
+	if remote != 2 || trackers != 1 {
+		t.Errorf("counted %d remote, %d trackers, want 2, 1", remote, trackers)
+	}
+	if out, _, _ := remoteContent("<p>unclosed <img", true); !strings.HasPrefix(out, "<p>unclosed") {
+		t.Errorf("malformed document = %q, want it kept", out)
+	}
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/reputation"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// SetReputation warns on the detail page when an outbound recipient domain
+// or an inbound sender's IP address is listed in c.
+func (s *Server) SetReputation(c *reputation.Checker) {
+	s.reputation = c
+}
+
+// checkReputation returns the listings to warn about on email's detail page.
+// email may be a summary; the raw message of inbound mail is loaded for its
+// Received headers.
+func (s *Server) checkReputation(ctx context.Context, email *store.Email) []reputation.Listing {
+	if s.reputation == nil {
+		return nil
+	}
+	var raw []byte
+	if email.Direction == store.DirectionInbound {
+		full, err := s.st.Get(ctx, email.ID)
+		if err != nil {
+			log.Printf("load %s for reputation check: %v", email.ID, err)
+			return nil
+		}
+		raw = full.RawMessage
+	}
+	return s.reputation.CheckEmail(ctx, email, raw)
+}
+
+type reputationEntry struct {
+	Subject    string    `json:"subject"`
+	Reputation string    `json:"reputation"` // "blocked" | "trusted"
+	Note       string    `json:"note,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type setReputationRequest struct {
+	Reputation string `json:"reputation"`
+	Note       string `json:"note"`
+}
+
+func newReputationEntry(e store.ReputationEntry) reputationEntry {
+	return reputationEntry{Subject: e.Subject, Reputation: e.Reputation, Note: e.Note, CreatedBy: e.CreatedBy, CreatedAt: e.CreatedAt}
+}
+
+func (s *Server) handleListReputation(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listReputation(w, r); ok {
+		writeJSON(w, resp)
+	}
+}
+
+func (s *Server) handleListReputationV2(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listReputation(w, r); ok {
+		paginate(w, r, resp)
+	}
+}
+
+// listReputation returns every reputation entry. On failure it writes the
+// error response and returns false.
+func (s *Server) listReputation(w http.ResponseWriter, r *http.Request) ([]reputationEntry, bool) {
+	list, err := s.st.ListReputation(r.Context())
+	if err != nil {
+		http.Error(w, "failed to list reputation entries", http.StatusInternalServerError)
+		log.Printf("list reputation: %v", err)
+		return nil, false
+	}
+	resp := make([]reputationEntry, 0, len(list))
+	for _, e := range list {
+		resp = append(resp, newReputationEntry(e))
+	}
+	return resp, true
+}
+
+func (s *Server) handleSetReputation(w http.ResponseWriter, r *http.Request) {
+	subject := strings.ToLower(r.PathValue("subject"))
+	if _, err := netip.ParseAddr(subject); err != nil {
+		if _, err := recipients.Parse("postmaster@" + subject); err != nil || strings.HasPrefix(subject, "[") {
+			http.Error(w, "subject must be a domain or an IP address", http.StatusBadRequest)
+			return
+		}
+	}
+	var req setReputationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Reputation != store.ReputationBlocked && req.Reputation != store.ReputationTrusted {
+		http.Error(w, `reputation must be "blocked" or "trusted"`, http.StatusBadRequest)
+		return
+	}
+	e := store.ReputationEntry{Subject: subject, Reputation: req.Reputation, Note: req.Note, CreatedBy: apiActor(r), CreatedAt: time.Now().UTC()}
+	if err := s.st.SetReputation(r.Context(), e); err != nil {
+		http.Error(w, "failed to save reputation entry", http.StatusInternalServerError)
+		log.Printf("set reputation of %s: %v", subject, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newReputationEntry(e)); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
+
+func (s *Server) handleDeleteReputation(w http.ResponseWriter, r *http.Request) {
+	if err := s.st.DeleteReputation(r.Context(), r.PathValue("subject")); err != nil {
+		http.Error(w, "reputation entry not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
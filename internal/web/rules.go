@@ -0,0 +1,195 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// handleAllow approves an email and adds an allow rule for its sender in its
+// direction, so later mail from that sender skips review. The rule is made
+// only once the approval succeeded.
+func (s *Server) handleAllow(w http.ResponseWriter, r *http.Request) {
+	if s.contacts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	id := r.PathValue("id")
+	email, err := s.st.Get(ctx, id)
+	if err != nil {
+		s.alreadyHandled(w, r, id)
+		return
+	}
+	if email.Direction != store.DirectionOutbound && email.Direction != store.DirectionInbound {
+		http.Error(w, "unknown direction", http.StatusInternalServerError)
+		return
+	}
+	reviewer := reviewerName(r)
+	if !s.approve(w, r, email, reviewer) {
+		return
+	}
+	if err := s.contacts.Allow(ctx, email.Direction, email.Sender, reviewer, email.ID); err != nil {
+		// The email is approved already; only the rule is missing.
+		log.Printf("allow %s sender %s: %v", email.Direction, email.Sender, err)
+	} else {
+		log.Printf("%s sender %s allowed by %s", email.Direction, email.Sender, reviewer)
+	}
+	s.redirectAfterAction(w, r)
+}
+
+// handleBlock rejects an email and adds a block rule for its sender, or for
+// the sender's domain if the form's scope is "domain", in its direction, so
+// later mail from them is rejected without review. The rule is made only once
+// the rejection succeeded.
+func (s *Server) handleBlock(w http.ResponseWriter, r *http.Request) {
+	if s.contacts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	id := r.PathValue("id")
+	email, err := s.st.Get(ctx, id)
+	if err != nil {
+		s.alreadyHandled(w, r, id)
+		return
+	}
+	subject := email.Sender
+	if r.FormValue("scope") == "domain" {
+		at := strings.LastIndex(subject, "@")
+		if at < 0 {
+			http.Error(w, "the sender has no domain", http.StatusBadRequest)
+			return
+		}
+		subject = subject[at+1:]
+	}
+	reviewer := reviewerName(r)
+	if !s.reject(w, r, email, reviewer) {
+		return
+	}
+	if err := s.contacts.Block(ctx, email.Direction, subject, reviewer, email.ID); err != nil {
+		// The email is rejected already; only the rule is missing.
+		log.Printf("block %s sender %s: %v", email.Direction, subject, err)
+	} else {
+		log.Printf("%s sender %s blocked by %s", email.Direction, subject, reviewer)
+	}
+	s.redirectAfterAction(w, r)
+}
+
+type rulesPage struct {
+	Allow      []store.AllowRule
+	Block      []store.BlockRule
+	OptOuts    []store.UnsubscribeLink // recipients who used an unsubscribe link
+	Suppressed []store.Suppression
+	Error      string
+}
+
+func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	s.renderRules(w, r, rulesPage{})
+}
+
+func (s *Server) renderRules(w http.ResponseWriter, r *http.Request, page rulesPage) {
+	if s.contacts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	allow, err := s.contacts.AllowRules(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load rules", http.StatusInternalServerError)
+		log.Printf("list allow rules: %v", err)
+		return
+	}
+	block, err := s.contacts.BlockRules(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load rules", http.StatusInternalServerError)
+		log.Printf("list block rules: %v", err)
+		return
+	}
+	optOuts, err := s.st.ListOptOuts(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load rules", http.StatusInternalServerError)
+		log.Printf("list opt-outs: %v", err)
+		return
+	}
+	suppressed, err := s.st.ListSuppressions(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load rules", http.StatusInternalServerError)
+		log.Printf("list suppressions: %v", err)
+		return
+	}
+	page.Allow, page.Block, page.OptOuts, page.Suppressed = allow, block, optOuts, suppressed
+	s.render(w, r, "rules.html", page)
+}
+
+// handleAddRule adds an allow rule, or a block rule if the form's kind is
+// "block", without deciding on any email.
+func (s *Server) handleAddRule(w http.ResponseWriter, r *http.Request) {
+	if s.contacts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("kind") == "suppression" {
+		s.addSuppression(w, r)
+		return
+	}
+	direction, sender := r.PostForm.Get("direction"), strings.TrimSpace(r.PostForm.Get("sender"))
+	add := s.contacts.Allow
+	if r.PostForm.Get("kind") == "block" {
+		add = s.contacts.Block
+	}
+	if err := add(r.Context(), direction, sender, reviewerName(r), ""); err != nil {
+		s.renderRules(w, r, rulesPage{Error: err.Error()})
+		return
+	}
+	s.redirect(w, r, "/rules")
+}
+
+// handleDeleteRule deletes the form's allow rule, or block rule if its kind is
+// "block".
+func (s *Server) handleDeleteRule(w http.ResponseWriter, r *http.Request) {
+	if s.contacts == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	direction, sender := r.PostForm.Get("direction"), r.PostForm.Get("sender")
+	if r.PostForm.Get("kind") == "unsubscribe" {
+		s.resubscribe(w, r, sender)
+		return
+	}
+	if r.PostForm.Get("kind") == "suppression" {
+		s.deleteSuppression(w, r)
+		return
+	}
+	remove := s.contacts.Disallow
+	if r.PostForm.Get("kind") == "block" {
+		remove = s.contacts.Unblock
+	}
+	if err := remove(r.Context(), direction, sender, reviewerName(r)); err != nil {
+		http.Error(w, "rule not found", http.StatusNotFound)
+		log.Printf("delete allow rule: %v", err)
+		return
+	}
+	s.redirect(w, r, "/rules")
+}
+
+// resubscribe removes the opt-out of address, so tagged mail to it is relayed
+// again.
+func (s *Server) resubscribe(w http.ResponseWriter, r *http.Request, address string) {
+	if err := s.st.Resubscribe(r.Context(), address); err != nil {
+		http.Error(w, "opt-out not found", http.StatusNotFound)
+		log.Printf("resubscribe %s: %v", address, err)
+		return
+	}
+	s.audit(r, reviewerName(r), actionResubscribe, address)
+	s.redirect(w, r, "/rules")
+}
@@ -0,0 +1,251 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albert/mailescrow/internal/totp"
+)
+
+// factorCookie holds a reviewer's verified second factor, signed by the
+// server, so the code is asked for once per session rather than with every
+// request.
+const factorCookie = "mailescrow_2fa"
+
+// defaultFactorSession is how long a verified code lasts in a browser unless
+// configured otherwise.
+const defaultFactorSession = 12 * time.Hour
+
+// Wrong codes in a row after which a reviewer must wait factorLockout.
+const (
+	maxFactorFailures = 5
+	factorLockout     = 5 * time.Minute
+)
+
+// Roles of web UI routes, which second factors can be enforced for
+// separately. See SetSecondFactors.
+const (
+	RoleView   = "view"   // pages showing held mail, the history and stats
+	RoleReview = "review" // deciding on held mail, and editing, tagging, snoozing and sharing it
+	RoleAdmin  = "admin"  // API tokens, rules, jobs and runtime settings
+)
+
+// Roles lists every role, in order of privilege.
+var Roles = []string{RoleView, RoleReview, RoleAdmin}
+
+// secondFactors asks reviewers for a TOTP code after the password. See
+// SetSecondFactors.
+type secondFactors struct {
+	secrets map[string][]byte // by reviewer (Basic Auth username)
+	roles   map[string]bool   // roles whose routes need a second factor
+	session time.Duration
+	key     []byte // signs session cookies; new at every start
+	now     func() time.Time
+
+	mu     sync.Mutex
+	states map[string]*factorState
+}
+
+// factorState is what a reviewer's recent codes left behind.
+type factorState struct {
+	lastStep    int64 // step of the last accepted code, which cannot be used again
+	failures    int   // wrong codes since the last accepted one
+	lockedUntil time.Time
+}
+
+// SetSecondFactors asks reviewers for a code from their authenticator app
+// after the web.password prompt on the routes of roles, or of every role if
+// roles is empty. secrets maps each reviewer, the Basic Auth username, to
+// their base32 TOTP secret; a username without one is refused on those
+// routes. A verified code lasts for session in that browser (12 hours if 0),
+// and until the server restarts. It needs a password, since the username is
+// only trusted once the password has been checked. Without secrets, no
+// second factor is asked for.
+func (s *Server) SetSecondFactors(secrets map[string]string, roles []string, session time.Duration) error {
+	if len(secrets) == 0 {
+		s.factors = nil
+		return nil
+	}
+	if s.password == "" {
+		return errors.New("second factors need web.password")
+	}
+	f := &secondFactors{
+		secrets: make(map[string][]byte, len(secrets)),
+		roles:   make(map[string]bool, len(Roles)),
+		session: session,
+		key:     make([]byte, 32),
+		now:     time.Now,
+		states:  make(map[string]*factorState),
+	}
+	if f.session <= 0 {
+		f.session = defaultFactorSession
+	}
+	if len(roles) == 0 {
+		roles = Roles
+	}
+	for _, role := range roles {
+		if !slices.Contains(Roles, role) {
+			return fmt.Errorf("unknown role %q, want one of %s", role, strings.Join(Roles, ", "))
+		}
+		f.roles[role] = true
+	}
+	for name, secret := range secrets {
+		if name == "" {
+			return errors.New("second factor for an empty reviewer name")
+		}
+		b, err := totp.ParseSecret(secret)
+		if err != nil {
+			return fmt.Errorf("second factor of %q: %w", name, err)
+		}
+		f.secrets[name] = b
+	}
+	if _, err := rand.Read(f.key); err != nil {
+		return fmt.Errorf("generate session key: %w", err)
+	}
+	s.factors = f
+	return nil
+}
+
+// checkSecondFactor lets r, a request to a route of role, through if the
+// role needs no second factor or its reviewer verified one in this browser.
+// Otherwise it sends them to the code form, or refuses them if they have no
+// secret, and returns false.
+func (s *Server) checkSecondFactor(w http.ResponseWriter, r *http.Request, role string) bool {
+	f := s.factors
+	if f == nil || !f.roles[role] {
+		return true
+	}
+	user := reviewerName(r)
+	if _, ok := f.secrets[user]; !ok {
+		log.Printf("Web UI refused %q from %s: no second factor set up", user, remoteIP(r.RemoteAddr))
+		http.Error(w, fmt.Sprintf("reviewer %q has no second factor set up; ask an administrator to add one", user), http.StatusForbidden)
+		return false
+	}
+	if c, err := r.Cookie(factorCookie); err == nil && f.verifyCookie(c.Value, user) {
+		return true
+	}
+	next := "/"
+	if r.Method == http.MethodGet {
+		next = r.URL.RequestURI()
+	}
+	s.redirect(w, r, "/second-factor?next="+url.QueryEscape(next))
+	return false
+}
+
+type secondFactorPage struct {
+	Reviewer string
+	Next     string
+	Failed   bool // the code submitted was wrong
+	Locked   bool // too many wrong codes; wait
+}
+
+// handleSecondFactorForm asks for the code of the reviewer's authenticator
+// app.
+func (s *Server) handleSecondFactorForm(w http.ResponseWriter, r *http.Request) {
+	s.render(w, r, "second_factor.html", secondFactorPage{Reviewer: reviewerName(r), Next: r.FormValue("next")})
+}
+
+// handleSecondFactor checks a code and, if it is right, marks the browser as
+// verified for the session and returns to the page the reviewer asked for.
+func (s *Server) handleSecondFactor(w http.ResponseWriter, r *http.Request) {
+	f := s.factors
+	user := reviewerName(r)
+	if f == nil || f.secrets[user] == nil {
+		s.redirectAfterAction(w, r)
+		return
+	}
+	page := secondFactorPage{Reviewer: user, Next: r.FormValue("next")}
+	switch err := f.verify(user, r.FormValue("code")); {
+	case errors.Is(err, errLocked):
+		page.Locked = true
+	case err != nil:
+		log.Printf("Web UI second factor failed for %q from %s", user, remoteIP(r.RemoteAddr))
+		page.Failed = true
+	default:
+		http.SetCookie(w, &http.Cookie{
+			Name:     factorCookie,
+			Value:    f.cookie(user),
+			Path:     s.url("/"),
+			MaxAge:   int(f.session / time.Second),
+			HttpOnly: true,
+			Secure:   r.TLS != nil || r.URL.Scheme == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		s.redirectAfterAction(w, r)
+		return
+	}
+	s.render(w, r, "second_factor.html", page)
+}
+
+var errLocked = errors.New("too many wrong codes")
+
+// verify checks user's code, refusing one already used and any while the
+// user is locked out after too many wrong ones.
+func (f *secondFactors) verify(user, code string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := f.states[user]
+	if st == nil {
+		st = &factorState{}
+		f.states[user] = st
+	}
+	now := f.now()
+	if now.Before(st.lockedUntil) {
+		return errLocked
+	}
+	step, ok := totp.Validate(f.secrets[user], code, now)
+	if !ok || step <= st.lastStep {
+		if st.failures++; st.failures >= maxFactorFailures {
+			st.failures = 0
+			st.lockedUntil = now.Add(factorLockout)
+		}
+		return errors.New("wrong code")
+	}
+	st.lastStep, st.failures = step, 0
+	return nil
+}
+
+// cookie returns the value of user's session cookie: their name, when it
+// expires and a MAC over both.
+func (f *secondFactors) cookie(user string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(f.now().Add(f.session).Unix(), 10)
+	return payload + "." + f.sign(payload)
+}
+
+// verifyCookie reports whether value is an unexpired session cookie this
+// server issued to user.
+func (f *secondFactors) verifyCookie(value, user string) bool {
+	i := strings.LastIndex(value, ".")
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(f.sign(value[:i]))) {
+		return false
+	}
+	name, expires, ok := strings.Cut(value[:i], ".")
+	if !ok {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || string(b) != user {
+		return false
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	return err == nil && f.now().Unix() < exp
+}
+
+func (f *secondFactors) sign(payload string) string {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
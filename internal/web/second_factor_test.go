@@ -0,0 +1,124 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/totp"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+func newTestFactors(t *testing.T, now *time.Time) *secondFactors {
+	t.Helper()
+	s := &Server{password: "secret"}
+	if err := s.SetSecondFactors(map[string]string{"alice": testTOTPSecret}, nil, time.Hour); err != nil {
+		t.Fatalf("SetSecondFactors: %v", err)
+	}
+	s.factors.now = func() time.Time { return *now }
+	return s.factors
+}
+
+func TestSecondFactorVerify(t *testing.T) {
+	now := time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC)
+	f := newTestFactors(t, &now)
+	secret, _ := totp.ParseSecret(testTOTPSecret)
+	code := totp.Code(secret, totp.Step(now))
+
+	if err := f.verify("alice", code); err != nil {
+		t.Fatalf("current code: %v", err)
+	}
+	if err := f.verify("alice", code); err == nil {
+		t.Error("a code was accepted twice")
+	}
+
+	now = now.Add(time.Minute)
+	for range maxFactorFailures {
+		if err := f.verify("alice", "000000"); err == nil {
+			t.Fatal("wrong code accepted")
+		}
+	}
+	if err := f.verify("alice", totp.Code(secret, totp.Step(now))); !errors.Is(err, errLocked) {
+		t.Errorf("right code while locked out: %v, want errLocked", err)
+	}
+	now = now.Add(factorLockout)
+	if err := f.verify("alice", totp.Code(secret, totp.Step(now))); err != nil {
+		t.Errorf("right code after the lockout: %v", err)
+	}
+}
+
+func TestSecondFactorCookie(t *testing.T) {
+	now := time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC)
+	f := newTestFactors(t, &now)
+	c := f.cookie("alice")
+
+	if !f.verifyCookie(c, "alice") {
+		t.Error("fresh cookie refused")
+	}
+	if f.verifyCookie(c, "bob") {
+		t.Error("alice's cookie accepted for bob")
+	}
+	if f.verifyCookie(c[:len(c)-1]+"0", "alice") || f.verifyCookie("alice", "alice") {
+		t.Error("forged cookie accepted")
+	}
+	now = now.Add(time.Hour)
+	if f.verifyCookie(c, "alice") {
+		t.Error("expired cookie accepted")
+	}
+}
+
+func TestSetSecondFactors(t *testing.T) {
+	if err := (&Server{}).SetSecondFactors(map[string]string{"alice": testTOTPSecret}, nil, 0); err == nil {
+		t.Error("second factors without a password succeeded")
+	}
+	if err := (&Server{password: "secret"}).SetSecondFactors(map[string]string{"alice": "short"}, nil, 0); err == nil {
+		t.Error("invalid secret accepted")
+	}
+	if err := (&Server{password: "secret"}).SetSecondFactors(map[string]string{"alice": testTOTPSecret}, []string{"owner"}, 0); err == nil {
+		t.Error("unknown role accepted")
+	}
+	s := &Server{password: "secret"}
+	if err := s.SetSecondFactors(nil, []string{RoleAdmin}, 0); err != nil || s.factors != nil {
+		t.Errorf("no secrets: %v, factors %v; want none", err, s.factors)
+	}
+}
+
+func TestCheckSecondFactorRoles(t *testing.T) {
+	s := &Server{password: "secret"}
+	if err := s.SetSecondFactors(map[string]string{"alice": testTOTPSecret}, []string{RoleReview, RoleAdmin}, time.Hour); err != nil {
+		t.Fatalf("SetSecondFactors: %v", err)
+	}
+	check := func(user, role string, cookies ...*http.Cookie) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/email/1/approve", nil)
+		r.SetBasicAuth(user, "secret")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		if s.checkSecondFactor(w, r, role) {
+			return http.StatusOK
+		}
+		return w.Code
+	}
+
+	if code := check("bob", RoleView); code != http.StatusOK {
+		t.Errorf("view as a reviewer without a secret: %d, want let through", code)
+	}
+	if code := check("bob", RoleReview); code != http.StatusForbidden {
+		t.Errorf("review as a reviewer without a secret: %d, want 403", code)
+	}
+	if code := check("alice", RoleAdmin); code != http.StatusSeeOther {
+		t.Errorf("admin without a code: %d, want 303 to the code form", code)
+	}
+	session := &http.Cookie{Name: factorCookie, Value: s.factors.cookie("alice")}
+	if code := check("alice", RoleReview, session); code != http.StatusOK {
+		t.Errorf("review with a verified code: %d, want let through", code)
+	}
+	if code := check("bob", RoleReview, session); code != http.StatusForbidden {
+		t.Errorf("review as bob with alice's session: %d, want 403", code)
+	}
+}
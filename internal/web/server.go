@@ -1,23 +1,62 @@
 package web
 
 import (
+	"bytes"
+	"cmp"
 	"context"
-	_ "embed"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"maps"
+	"mime"
 	"net/http"
+	"net/mail"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/albert/mailescrow/internal/bounce"
+	"github.com/albert/mailescrow/internal/config"
+	"github.com/albert/mailescrow/internal/contacts"
+	"github.com/albert/mailescrow/internal/i18n"
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/metrics"
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/policy"
+	"github.com/albert/mailescrow/internal/poller"
+	"github.com/albert/mailescrow/internal/projects"
+	"github.com/albert/mailescrow/internal/pubsub"
+	"github.com/albert/mailescrow/internal/quota"
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/redact"
 	"github.com/albert/mailescrow/internal/relay"
+	"github.com/albert/mailescrow/internal/reputation"
+	"github.com/albert/mailescrow/internal/rules"
 	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+	"github.com/albert/mailescrow/internal/tokens"
+	"github.com/albert/mailescrow/internal/tracing"
+	"github.com/albert/mailescrow/internal/webhooks"
+	"github.com/albert/mailescrow/internal/window"
 	"github.com/google/uuid"
 )
 
-//go:embed templates/index.html
-var indexHTML string
+//go:embed templates/*.html
+var templateFS embed.FS
+
+//go:embed static
+var staticFS embed.FS
+
+// historyLimit caps the number of decisions shown on the history page.
+const historyLimit = 200
 
 const (
 	folderReceived = "mailescrow/received"
@@ -33,7 +72,7 @@ type IMAPMover interface {
 
 // Server is the HTTP web server.
 type Server struct {
-	st       store.EmailStore
+	st       store.ReadWriter
 	relay    relay.Sender
 	imap     IMAPMover // may be nil if IMAP not configured
 	fromAddr string    // relay sender address used as MAIL FROM and From header
@@ -41,39 +80,273 @@ type Server struct {
 	password string    // if non-empty, web UI requires HTTP Basic Auth with this password
 	webSrv   *http.Server
 	apiSrv   *http.Server
-	t        *template.Template
+
+	webHandler, apiHandler http.Handler // the routes of each server, before proxied
+	apiMounted             bool         // the API is served on the web UI's listener; see MountAPI
+
+	templates  *templateSet
+	quota      *quota.Limiter        // may be nil; API submissions are then unlimited
+	projects   *projects.Limits      // may be nil; token projects are then unlimited
+	suppress   *suppression.List     // may be nil; nothing is then suppressed
+	contacts   *contacts.Book        // may be nil; approvals are then not learned
+	bounce     *bounce.Notifier      // may be nil; rejected senders are then never notified
+	tokens     *tokens.Manager       // may be nil; the API is then open and has no token management
+	recipients *recipients.Validator // may be nil; recipients are then checked for syntax only
+	identities map[string]Identity   // further addresses API submissions may send as, by name; see SetIdentities
+	reputation *reputation.Checker   // may be nil; the detail page then shows no reputation warnings
+	redactor   *redact.Redactor      // may be nil; raw messages and previews are then shown as they are
+	jobs       *jobs.Queue           // runs IMAP moves, rejection notices, forwards and scheduled sends; see SetJobs
+	windows    *window.Schedule      // may be nil; approved outbound mail is then relayed at once
+	throttle   *relay.Throttle       // may be nil; approved outbound mail is then never held for the relay's rate limits
+	webhooks   *webhooks.Manager     // may be nil; tokens then cannot register webhooks
+	factors    *secondFactors        // nil unless reviewers need a second factor; see SetSecondFactors
+
+	requireAPIToken bool // refuse API requests without a token
+	apiV2           bool // serve the v2 API; see SetAPIV2
+	keepFetched     bool // api.consume_mode: keep; see SetKeepFetched
+	stripTrackers   bool // web.tracking_pixels: strip; see SetStripTrackers
+
+	maxPendingAge time.Duration // SLA on held mail, marking rows aging and stale; 0 uses an hour and a day
+
+	language string         // UI language; empty to follow Accept-Language. See SetLocale
+	timezone *time.Location // timestamps are shown in this timezone; nil is UTC
+
+	basePath       string         // path prefix of every route, e.g. "/mailescrow"; empty to serve at the root
+	publicURL      string         // where reviewers open the UI, base path included; see SetPublicURL
+	trustedProxies []netip.Prefix // reverse proxies whose X-Forwarded-* headers are honored
+
+	approved *pubsub.Topic // published when inbound mail is approved; wakes long-polling API reads
+	closing  chan struct{} // closed when the API server shuts down, ending long polls
+
+	pollerStatus func() poller.Status // nil when IMAP is not configured
+	debug        http.Handler         // nil unless debug endpoints are enabled
+	reload       Reloader             // nil unless configuration reloads are wired up
+
+	settingsEditor SettingsEditor // nil unless settings can be changed at runtime; see SetSettingsEditor
+
+	rulesMu  sync.Mutex
+	rules    *rules.Engine // applied to submissions and again when a held email is annotated; see SetRules
+	policies *policy.Set   // recipient domain policies; see SetPolicies
+
+	settingsMu sync.Mutex
+	settings   []config.Setting // shown read-only on the settings page; replaced on reload
+
+	idempotencyLocks keyLocks // serializes API submissions carrying the same Idempotency-Key
 }
 
 // New creates a new web Server. imapClient may be nil if IMAP is not configured.
 // fromAddr is the relay account address used as the outbound sender.
 // fromName is an optional display name; when set emails are sent as "fromName" <fromAddr>.
 // password, if non-empty, enables HTTP Basic Auth on the web UI; the API is never gated.
-func New(st store.EmailStore, r relay.Sender, imapClient IMAPMover, fromAddr, fromName, password string) *Server {
-	funcMap := template.FuncMap{
-		"join": strings.Join,
+func New(st store.ReadWriter, r relay.Sender, imapClient IMAPMover, fromAddr, fromName, password string) *Server {
+	s := &Server{st: st, relay: r, imap: imapClient, fromAddr: fromAddr, fromName: fromName, password: password,
+		approved: pubsub.New(), closing: make(chan struct{})}
+	s.SetJobs(jobs.New(st))
+	funcs := template.FuncMap{
+		"join":     strings.Join,
+		"duration": formatDuration,
+		"url":      s.url,
+		"size":     formatSize,
 	}
-	t := template.Must(template.New("index.html").Funcs(funcMap).Parse(indexHTML))
-	s := &Server{st: st, relay: r, imap: imapClient, fromAddr: fromAddr, fromName: fromName, password: password, t: t}
+	maps.Copy(funcs, locale{lang: i18n.Default, loc: time.UTC}.funcs()) // replaced per request; see render
+	s.templates = newTemplateSet(funcs)
 
 	webMux := http.NewServeMux()
-	webMux.HandleFunc("GET /", s.basicAuth(s.handleList))
-	webMux.HandleFunc("POST /email/{id}/approve", s.basicAuth(s.handleApprove))
-	webMux.HandleFunc("POST /email/{id}/reject", s.basicAuth(s.handleReject))
-	s.webSrv = &http.Server{Handler: webMux}
+	webMux.HandleFunc("GET /{$}", s.basicAuth(s.handleList))
+	webMux.HandleFunc("GET /triage", s.basicAuth(s.handleTriage))
+	webMux.HandleFunc("GET /email/{id}", s.basicAuth(s.handleDetail))
+	webMux.HandleFunc("GET /email/{id}/body", s.basicAuth(s.handleBody))
+	webMux.HandleFunc("GET /email/{id}/raw", s.basicAuth(s.handleRaw))
+	webMux.HandleFunc("GET /email/{id}/html", s.basicAuth(s.handleHTML))
+	webMux.HandleFunc("GET /email/{id}/attachments/{n}", s.basicAuth(s.handleAttachment))
+	webMux.HandleFunc("GET /email/{id}/preview", s.basicAuth(s.handlePreview))
+	webMux.HandleFunc("POST /email/{id}/approve", s.roleAuth(RoleReview, s.handleApprove))
+	webMux.HandleFunc("POST /email/{id}/reject", s.roleAuth(RoleReview, s.handleReject))
+	webMux.HandleFunc("POST /email/{id}/forward", s.roleAuth(RoleReview, s.handleForward))
+	webMux.HandleFunc("POST /email/{id}/allow", s.roleAuth(RoleReview, s.handleAllow))
+	webMux.HandleFunc("POST /email/{id}/block", s.roleAuth(RoleReview, s.handleBlock))
+	webMux.HandleFunc("GET /email/{id}/edit", s.roleAuth(RoleReview, s.handleEditForm))
+	webMux.HandleFunc("POST /email/{id}/edit", s.roleAuth(RoleReview, s.handleEdit))
+	webMux.HandleFunc("POST /email/{id}/tag", s.roleAuth(RoleReview, s.handleTag))
+	webMux.HandleFunc("POST /email/{id}/untag", s.roleAuth(RoleReview, s.handleUntag))
+	webMux.HandleFunc("POST /email/{id}/snooze", s.roleAuth(RoleReview, s.handleSnooze))
+	webMux.HandleFunc("POST /email/{id}/unsnooze", s.roleAuth(RoleReview, s.handleUnsnooze))
+	webMux.HandleFunc("POST /email/{id}/share", s.roleAuth(RoleReview, s.handleCreateShare))
+	webMux.HandleFunc("POST /email/{id}/share/{link}/revoke", s.roleAuth(RoleReview, s.handleRevokeShare))
+	webMux.HandleFunc("GET /share/{token}", s.handleShare) // the token in the URL is the credential
+	webMux.HandleFunc("GET /click/{token}", s.handleClick) // tracked links in relayed mail
+	webMux.HandleFunc("GET /unsubscribe/{token}", s.handleUnsubscribePage)
+	webMux.HandleFunc("POST /unsubscribe/{token}", s.handleUnsubscribe) // one-click unsubscribe from mail clients
+	webMux.HandleFunc("POST /archive", s.basicAuth(s.handleArchive))
+	webMux.HandleFunc("GET /history", s.basicAuth(s.handleHistory))
+	webMux.HandleFunc("GET /stats", s.basicAuth(s.handleStats))
+	webMux.HandleFunc("GET /settings", s.roleAuth(RoleAdmin, s.handleSettings))
+	webMux.HandleFunc("POST /settings", s.roleAuth(RoleAdmin, s.handleUpdateSetting))
+	webMux.HandleFunc("GET /tokens", s.roleAuth(RoleAdmin, s.handleTokens))
+	webMux.HandleFunc("POST /tokens", s.roleAuth(RoleAdmin, s.handleCreateToken))
+	webMux.HandleFunc("POST /tokens/{id}/revoke", s.roleAuth(RoleAdmin, s.handleRevokeToken))
+	webMux.HandleFunc("GET /rules", s.roleAuth(RoleAdmin, s.handleRules))
+	webMux.HandleFunc("POST /rules", s.roleAuth(RoleAdmin, s.handleAddRule))
+	webMux.HandleFunc("POST /rules/delete", s.roleAuth(RoleAdmin, s.handleDeleteRule))
+	webMux.HandleFunc("GET /jobs", s.roleAuth(RoleAdmin, s.handleJobs))
+	webMux.HandleFunc("POST /jobs/{id}/retry", s.roleAuth(RoleAdmin, s.handleRetryJob))
+	webMux.HandleFunc("POST /jobs/{id}/discard", s.roleAuth(RoleAdmin, s.handleDiscardJob))
+	webMux.HandleFunc("GET /second-factor", s.passwordAuth(s.handleSecondFactorForm))
+	webMux.HandleFunc("POST /second-factor", s.passwordAuth(s.handleSecondFactor))
+	webMux.HandleFunc("GET /preferences", s.basicAuth(s.handlePreferences))
+	webMux.HandleFunc("POST /preferences", s.basicAuth(s.handleSetPreferences))
+	webMux.Handle("GET /static/", http.FileServerFS(staticFS))
+	s.webHandler = tracing.Handler(webMux, "web")
+	s.webSrv = &http.Server{Handler: s.proxied(s.webHandler)}
 
 	apiMux := http.NewServeMux()
-	apiMux.HandleFunc("POST /api/emails", s.handleCreateEmail)
-	apiMux.HandleFunc("GET /api/emails", s.handleGetEmails)
-	apiMux.HandleFunc("GET /api/emails/pending/count", s.handlePendingCount)
-	s.apiSrv = &http.Server{Handler: apiMux}
+	s.handleAPI(apiMux, "POST /emails", tokens.ScopeSend, s.handleCreateEmail, nil)
+	s.handleAPI(apiMux, "POST /emails/raw", tokens.ScopeSend, s.handleCreateRawEmail, nil)
+	s.handleAPI(apiMux, "POST /emails/batch", tokens.ScopeSend, s.handleCreateBatch, nil)
+	s.handleAPI(apiMux, "GET /emails", tokens.ScopeRead, s.handleGetEmails, s.handleGetEmailsV2)
+	s.handleAPI(apiMux, "POST /emails/archive", tokens.ScopeAdmin, s.handleAPIArchive, nil)
+	s.handleAPI(apiMux, "GET /emails/pending/count", tokens.ScopeRead, s.handlePendingCount, nil)
+	s.handleAPI(apiMux, "GET /emails/{id}/annotations", tokens.ScopeAnnotate, s.handleListAnnotations, s.handleListAnnotationsV2)
+	s.handleAPI(apiMux, "POST /emails/{id}/annotations", tokens.ScopeAnnotate, s.handleAddAnnotation, nil)
+	s.handleAPI(apiMux, "GET /tokens", tokens.ScopeAdmin, s.handleAPIListTokens, s.handleAPIListTokensV2)
+	s.handleAPI(apiMux, "POST /tokens", tokens.ScopeAdmin, s.handleAPICreateToken, nil)
+	s.handleAPI(apiMux, "DELETE /tokens/{id}", tokens.ScopeAdmin, s.handleAPIRevokeToken, nil)
+	s.handleAPI(apiMux, "GET /reputation", tokens.ScopeAdmin, s.handleListReputation, s.handleListReputationV2)
+	s.handleAPI(apiMux, "PUT /reputation/{subject}", tokens.ScopeAdmin, s.handleSetReputation, nil)
+	s.handleAPI(apiMux, "DELETE /reputation/{subject}", tokens.ScopeAdmin, s.handleDeleteReputation, nil)
+	s.handleAPI(apiMux, "GET /suppressions", tokens.ScopeAdmin, s.handleAPIListSuppressions, s.handleAPIListSuppressionsV2)
+	s.handleAPI(apiMux, "PUT /suppressions/{address}", tokens.ScopeAdmin, s.handleAPISetSuppression, nil)
+	s.handleAPI(apiMux, "DELETE /suppressions/{address}", tokens.ScopeAdmin, s.handleAPIDeleteSuppression, nil)
+	s.handleAPI(apiMux, "GET /webhooks", tokens.ScopeWebhooks, s.handleListWebhooks, s.handleListWebhooksV2)
+	s.handleAPI(apiMux, "POST /webhooks", tokens.ScopeWebhooks, s.handleCreateWebhook, nil)
+	s.handleAPI(apiMux, "DELETE /webhooks/{id}", tokens.ScopeWebhooks, s.handleDeleteWebhook, nil)
+	s.handleAPI(apiMux, "GET /webhooks/{id}/deliveries", tokens.ScopeWebhooks, s.handleListDeliveries, s.handleListDeliveriesV2)
+	s.handleAPI(apiMux, "POST /config/reload", tokens.ScopeAdmin, s.handleReloadConfig, nil)
+	s.handleAPI(apiMux, "GET /settings", tokens.ScopeAdmin, s.handleAPISettings, nil)
+	s.handleAPI(apiMux, "PUT /settings", tokens.ScopeAdmin, s.handleAPIUpdateSettings, nil)
+	apiMux.HandleFunc("GET /metrics", s.handleMetrics)
+	apiMux.HandleFunc("GET /healthz", s.handleHealthz)
+	apiMux.HandleFunc("/debug/", s.apiAuth(tokens.ScopeAdmin, s.handleDebug))
+	s.apiHandler = tracing.Handler(apiMux, "api")
+	s.apiSrv = &http.Server{Handler: s.proxied(s.apiHandler)}
+	s.apiSrv.RegisterOnShutdown(func() { close(s.closing) })
 
 	return s
 }
 
+// SetSettings sets the configuration values listed on the settings page.
+// Callers are responsible for redacting secrets (see config.Config.Settings).
+func (s *Server) SetSettings(settings []config.Setting) {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+	s.settings = settings
+}
+
+// SetQuota limits API submissions per API token, or per sender when the API
+// is used without tokens. Usage is shown on the stats page.
+func (s *Server) SetQuota(l *quota.Limiter) {
+	s.quota = l
+}
+
+// SetProjects refuses API submissions whose token's project is over one of
+// its limits: too large a message, or too many emails or bytes held.
+func (s *Server) SetProjects(l *projects.Limits) {
+	s.projects = l
+}
+
+// SetContacts enables the address book: approvals are learned, the UI shows how
+// often a counterparty was approved before, and API mail to trusted contacts
+// is relayed immediately.
+func (s *Server) SetContacts(b *contacts.Book) {
+	s.contacts = b
+}
+
+// SetBounce enables "reject and notify" for inbound mail: the sender is told
+// the message was not accepted, if the bounce policy allows it.
+func (s *Server) SetBounce(n *bounce.Notifier) {
+	s.bounce = n
+}
+
+// SetRecipients sets how API recipients are validated, e.g. with an MX check.
+func (s *Server) SetRecipients(v *recipients.Validator) {
+	s.recipients = v
+}
+
+// SetWindows holds approved outbound mail until its sending window opens.
+func (s *Server) SetWindows(w *window.Schedule) {
+	s.windows = w
+}
+
+// SetSLA colors held mail on the pending list by how close it is to the SLA
+// on pending age: aging past half of maxAge, stale past it. 0 means no SLA,
+// in which case mail is aging after an hour and stale after a day.
+func (s *Server) SetSLA(maxAge time.Duration) {
+	s.maxPendingAge = maxAge
+}
+
+// SetThrottle holds approved outbound mail the relay may not send yet
+// because of its rate limits, and shows how close it is to them on the
+// index page. t should be the throttle the server's sender relays through.
+func (s *Server) SetThrottle(t *relay.Throttle) {
+	s.throttle = t
+}
+
+// SetApprovals shares the topic published when inbound mail is approved, so
+// approvals made elsewhere (e.g. by the IMAP poller) wake long-polling reads.
+func (s *Server) SetApprovals(t *pubsub.Topic) {
+	s.approved = t
+}
+
+// SetPollerStatus reports the IMAP poller's health on /healthz.
+func (s *Server) SetPollerStatus(status func() poller.Status) {
+	s.pollerStatus = status
+}
+
+// SetDebug serves h, which handles pprof and expvar, under /debug/ on the API
+// to admin tokens.
+func (s *Server) SetDebug(h http.Handler) {
+	s.debug = h
+}
+
+// Reloader re-reads the configuration and applies what can change at runtime.
+// It returns the changed settings, split into those applied and those that
+// need a restart.
+type Reloader func() (reloaded, restart []string, err error)
+
+// SetReload serves POST /api/config/reload to admin tokens, calling fn.
+func (s *Server) SetReload(fn Reloader) {
+	s.reload = fn
+}
+
+// UseTemplateDir loads UI templates from dir, falling back to the embedded
+// template for any file the directory does not provide, and reloads them
+// whenever a file in dir changes.
+func (s *Server) UseTemplateDir(dir string) error {
+	return s.templates.useDir(dir)
+}
+
+// MountAPI serves the REST API on the web UI's listener as well, under
+// /api/ with /metrics, /healthz and /debug/, for deployments that don't need
+// the two on separate networks. Each keeps its own authentication. Call it
+// before Serve; ServeAPI is then not needed.
+func (s *Server) MountAPI() {
+	mux := http.NewServeMux()
+	mux.Handle("/", s.webHandler)
+	for _, pattern := range []string{"/api/", "/metrics", "/healthz", "/debug/"} {
+		mux.Handle(pattern, s.apiHandler)
+	}
+	s.webSrv.Handler = s.proxied(mux)
+	s.apiMounted = true
+}
+
 // Serve starts the web UI server on addr. Blocks until the server stops.
 func (s *Server) Serve(addr string) error {
 	s.webSrv.Addr = addr
-	log.Printf("Web UI listening on http://%s", addr)
+	if s.apiMounted {
+		log.Printf("Web UI and API listening on http://%s%s", addr, s.basePath)
+	} else {
+		log.Printf("Web UI listening on http://%s%s", addr, s.basePath)
+	}
 	if err := s.webSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return err
 	}
@@ -83,7 +356,7 @@ func (s *Server) Serve(addr string) error {
 // ServeAPI starts the REST API server on addr. Blocks until the server stops.
 func (s *Server) ServeAPI(addr string) error {
 	s.apiSrv.Addr = addr
-	log.Printf("API listening on http://%s", addr)
+	log.Printf("API listening on http://%s%s", addr, s.basePath)
 	if err := s.apiSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return err
 	}
@@ -92,25 +365,49 @@ func (s *Server) ServeAPI(addr string) error {
 
 // Shutdown gracefully stops both the web UI and API servers.
 func (s *Server) Shutdown(ctx context.Context) error {
-	err1 := s.webSrv.Shutdown(ctx)
-	err2 := s.apiSrv.Shutdown(ctx)
+	if err := s.templates.close(); err != nil {
+		log.Printf("close template watcher: %v", err)
+	}
+	// The API goes first: its shutdown ends long polls, which may be held
+	// on the web UI's listener when the API is mounted there.
+	err1 := s.apiSrv.Shutdown(ctx)
+	err2 := s.webSrv.Shutdown(ctx)
 	if err1 != nil {
 		return err1
 	}
 	return err2
 }
 
-// basicAuth wraps a handler with HTTP Basic Auth when s.password is non-empty.
-// Any username is accepted; only the password is checked.
-// If no password is configured the handler is called directly.
+// basicAuth wraps a page of the view role with HTTP Basic Auth when
+// s.password is non-empty, followed by the reviewer's second factor if they
+// need one.
 func (s *Server) basicAuth(next http.HandlerFunc) http.HandlerFunc {
+	return s.roleAuth(RoleView, next)
+}
+
+// roleAuth is basicAuth for a route of role.
+func (s *Server) roleAuth(role string, next http.HandlerFunc) http.HandlerFunc {
+	return s.passwordAuth(func(w http.ResponseWriter, r *http.Request) {
+		if s.checkSecondFactor(w, r, role) {
+			next(w, r)
+		}
+	})
+}
+
+// passwordAuth wraps a handler with HTTP Basic Auth when s.password is
+// non-empty. Any username is accepted; only the password is checked.
+// If no password is configured the handler is called directly.
+func (s *Server) passwordAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if s.password == "" {
 			next(w, r)
 			return
 		}
-		_, pass, ok := r.BasicAuth()
+		user, pass, ok := r.BasicAuth()
 		if !ok || pass != s.password {
+			if ok {
+				log.Printf("Web UI auth failed for %q from %s", user, remoteIP(r.RemoteAddr))
+			}
 			w.Header().Set("WWW-Authenticate", `Basic realm="mailescrow"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -119,17 +416,441 @@ func (s *Server) basicAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// reviewerName identifies who is acting in the web UI. It is the HTTP Basic
+// Auth username when one was supplied, or "anonymous" otherwise.
+func reviewerName(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
+// recordDecision logs a reviewer decision and observes its latency. Failures
+// are logged but never block the approve/reject action itself.
+func (s *Server) recordDecision(ctx context.Context, email *store.Email, decision, reviewer string) {
+	if err := s.st.RecordDecision(ctx, newDecision(email, decision, reviewer)); err != nil {
+		log.Printf("record decision for %s: %v", email.ID, err)
+	}
+}
+
+// newDecision returns reviewer's decision on email, observing its latency.
+func newDecision(email *store.Email, decision, reviewer string) store.Decision {
+	latency := time.Since(email.ReceivedAt)
+	metrics.ApprovalLatency.Observe(latency.Seconds(), email.Direction, decision, reviewer)
+	var reason string
+	if decision == store.DecisionApproved {
+		reason = approvalReason(email.Approvals)
+	}
+	return store.Decision{
+		EmailID:   email.ID,
+		Direction: email.Direction,
+		Sender:    email.Sender,
+		Subject:   email.Subject,
+		Decision:  decision,
+		Reviewer:  reviewer,
+		Latency:   latency,
+		Reason:    reason,
+
+		EnvelopeID: email.EnvelopeID,
+		RawMessage: email.RawMessage,
+	}
+}
+
+// pageSize is the number of emails shown per page of a list.
+const pageSize = 50
+
+// handleList shows a page of one of the index page's tabs: held mail with
+// the tab's status, or the decisions on mail that is no longer held.
 func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
-	emails, err := s.st.ListPending(r.Context())
+	f := parseListFilter(r.URL.Query())
+	page := listPage{Filter: f, Decided: f.decided(), TriageURL: f.triageURL(1), AgeURLs: f.ageURLs(), TabURLs: f.statusURLs()}
+	if page.Decided {
+		decisions, total, err := s.st.ListDecisionPage(r.Context(), store.DecisionQuery{
+			Outcome: f.Status,
+			Offset:  (f.Page - 1) * pageSize,
+			Limit:   pageSize,
+		})
+		if err != nil {
+			http.Error(w, "failed to list emails", http.StatusInternalServerError)
+			log.Printf("list %s decisions: %v", f.Status, err)
+			return
+		}
+		page.Decisions, page.Total = decisions, total
+	} else {
+		q := f.query(time.Now().In(s.locale(r).loc))
+		emails, total, err := s.st.ListPendingPage(r.Context(), q)
+		if err != nil {
+			http.Error(w, "failed to list emails", http.StatusInternalServerError)
+			log.Printf("list %s emails: %v", cmp.Or(f.Status, store.StatusPending), err)
+			return
+		}
+		if page.Tags, err = s.st.ListTags(r.Context()); err != nil {
+			log.Printf("list tags: %v", err)
+		}
+		page.Total = total
+		for i := range emails {
+			page.Emails = append(page.Emails, s.emailView(r.Context(), &emails[i]))
+		}
+	}
+	page.Pages = max((page.Total+pageSize-1)/pageSize, 1)
+	if f.Page > 1 {
+		page.PrevURL = f.url(f.Page - 1)
+	}
+	if f.Page < page.Pages {
+		page.NextURL = f.url(f.Page + 1)
+	}
+	if f.Page == 1 && f.Status == "" {
+		var err error
+		if page.Scheduled, err = s.st.ListScheduled(r.Context()); err != nil {
+			log.Printf("list scheduled emails: %v", err)
+		}
+	}
+	if f.Page == 1 && (f.Status == "" || f.Status == store.StatusScheduled) {
+		if st := s.throttle.Status(time.Now()); !st.Until.IsZero() {
+			page.Throttle = &st
+		}
+	}
+	s.render(w, r, "index.html", page)
+}
+
+// handleTriage shows the pending email at position pos of the filtered list.
+// Approving or rejecting it returns to the same position, which then holds
+// the next email.
+func (s *Server) handleTriage(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	f := parseListFilter(v)
+	f.Status = "" // only pending mail is triaged
+	pos := 1
+	if n, err := strconv.Atoi(v.Get("pos")); err == nil && n > 1 {
+		pos = n
+	}
+	q := f.query(time.Now().In(s.locale(r).loc))
+	q.Offset, q.Limit = pos-1, 1
+	emails, total, err := s.st.ListPendingPage(r.Context(), q)
 	if err != nil {
 		http.Error(w, "failed to list emails", http.StatusInternalServerError)
 		log.Printf("list pending emails: %v", err)
 		return
 	}
+	if len(emails) == 0 && total > 0 {
+		// Past the end, e.g. after deciding on the last email.
+		s.redirect(w, r, f.triageURL(total))
+		return
+	}
+	page := triagePage{Filter: f, Pos: pos, Total: total}
+	if len(emails) == 1 {
+		view := s.emailView(r.Context(), &emails[0])
+		view.Next = f.triageURL(pos)
+		page.Email = &view
+	}
+	if pos > 1 {
+		page.PrevURL = f.triageURL(pos - 1)
+	}
+	if pos < total {
+		page.NextURL = f.triageURL(pos + 1)
+	}
+	s.render(w, r, "triage.html", page)
+}
+
+// emailView is an email as shown in the UI, annotated with how many times its
+// counterparties were previously approved and the actions available for it.
+type emailView struct {
+	*store.Email
+	ApprovedCount int
+	CanBounce     bool               // offer "reject and notify"
+	SenderRules   bool               // offer to always allow or block the sender; detail page only
+	SenderDomain  string             // domain of the sender, offered for blocking
+	Aging         string             // "aging" or "stale" as pending mail nears or passes the SLA; see aging
+	Policy        policy.Requirement // what the recipient domain policies require to approve it
+	Next          string             // where to go after an action; empty for the pending list
+
+	Reputation  []reputation.Listing // block list warnings; detail page only
+	Suppressed  []store.Suppression  // recipients on the suppression list; detail page of pending outbound mail only
+	Annotations []store.Annotation   // scanner findings, oldest first; detail page only
+
+	// The message's HTML part and attachments; detail page only.
+	HasHTML             bool
+	RemoteContent       int  // resources the HTML part loads from other sites
+	Trackers            int  // of those, tracking pixels
+	LoadRemote          bool // the reviewer asked to load the remote content
+	TrackersStripped    bool // web.tracking_pixels: strip, so the trackers never load
+	Attachments         []mimetext.Attachment
+	AttachmentsWithheld bool // a redactor is set, so attachments are listed but not served
+
+	Structure *mimetext.Part // the message's MIME tree, for debugging mail that renders oddly; detail page only
+
+	RepliesTo *store.SentMessage // the relayed message an inbound email answers; detail page only
+
+	Edits []editView // reviewers' edits of outbound mail, oldest first; detail page only
+
+	// Share links for external reviewers; detail page only. NewShareURL is
+	// the URL of a link just created, shown once.
+	ShareLinks  []shareLinkView
+	NewShareURL string
+}
+
+func (s *Server) emailView(ctx context.Context, email *store.Email) emailView {
+	n, err := s.contacts.Count(ctx, email.Direction, email.Sender, email.Recipients)
+	if err != nil {
+		log.Printf("contact count for %s: %v", email.ID, err)
+	}
+	return emailView{
+		Email:         email,
+		ApprovedCount: n,
+		CanBounce:     s.bounce != nil && email.Direction == store.DirectionInbound,
+		Aging:         s.aging(email, time.Now()),
+		Policy:        s.emailRequirement(email),
+	}
+}
+
+// aging returns "stale" for pending email past the SLA (see SetSLA), "aging"
+// for pending email past half of it, and "" otherwise.
+func (s *Server) aging(email *store.Email, now time.Time) string {
+	if email.Status != store.StatusPending {
+		return ""
+	}
+	warn, stale := time.Hour, 24*time.Hour
+	if s.maxPendingAge > 0 {
+		warn, stale = s.maxPendingAge/2, s.maxPendingAge
+	}
+	switch age := now.Sub(email.ReceivedAt); {
+	case age > stale:
+		return "stale"
+	case age > warn:
+		return "aging"
+	}
+	return ""
+}
+
+// render executes the named page template in r's locale, logging (rather
+// than returning) errors since the response may already be partially written.
+func (s *Server) render(w http.ResponseWriter, r *http.Request, name string, data any) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := s.t.Execute(w, emails); err != nil {
-		log.Printf("render template: %v", err)
+	if err := s.templates.execute(w, name, data, s.locale(r).funcs()); err != nil {
+		log.Printf("render template %s: %v", name, err)
+	}
+}
+
+// handleDetail renders an email with a body preview only; the full body and
+// raw message are served by handleBody and handleRaw when asked for.
+func (s *Server) handleDetail(w http.ResponseWriter, r *http.Request) {
+	s.renderDetail(w, r, "")
+}
+
+// renderDetail renders the detail page of the email in r's path. shareURL,
+// if not empty, is the URL of a share link just created for it.
+func (s *Server) renderDetail(w http.ResponseWriter, r *http.Request, shareURL string) {
+	email, err := s.st.GetSummary(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	view := s.emailView(r.Context(), email)
+	view.Reputation = s.checkReputation(r.Context(), email)
+	view.Suppressed = s.suppressedRecipients(r.Context(), email)
+	if view.Annotations, err = s.st.ListAnnotations(r.Context(), email.ID); err != nil {
+		log.Printf("list annotations of %s: %v", email.ID, err)
+	}
+	view.SenderRules = s.contacts != nil
+	if at := strings.LastIndex(email.Sender, "@"); at >= 0 {
+		view.SenderDomain = strings.ToLower(email.Sender[at+1:])
+	}
+	// The summary has no raw message to find the HTML and attachments in.
+	if full, err := s.st.Get(r.Context(), email.ID); err == nil {
+		if html := messageHTML(full.RawMessage); html != "" {
+			view.HasHTML = true
+			_, view.RemoteContent, view.Trackers = remoteContent(html, false)
+			view.LoadRemote = r.URL.Query().Get("remote") == "1" && view.RemoteContent > 0
+			view.TrackersStripped = s.stripTrackers
+		}
+		view.Attachments = mimetext.Attachments(full.RawMessage)
+		view.AttachmentsWithheld = s.redactor != nil
+		for i := range view.Attachments {
+			view.Attachments[i].Filename = s.redactor.Redact(view.Attachments[i].Filename)
+		}
+		structure := mimetext.Structure(full.RawMessage)
+		s.redactFilenames(&structure)
+		view.Structure = &structure
+	}
+	if email.Direction == store.DirectionInbound && email.InReplyTo != "" {
+		if view.RepliesTo, err = s.st.GetSent(r.Context(), email.InReplyTo); err != nil {
+			log.Printf("get message %s answered by %s: %v", email.InReplyTo, email.ID, err)
+		}
+	}
+	if email.Direction == store.DirectionOutbound {
+		view.Edits = s.edits(r, []string{email.ID})[email.ID]
 	}
+	view.ShareLinks = s.shareLinks(r, email.ID)
+	view.NewShareURL = shareURL
+	s.render(w, r, "detail.html", view)
+}
+
+// redactFilenames redacts the filenames of p and its parts, as those of
+// attachments are.
+func (s *Server) redactFilenames(p *mimetext.Part) {
+	p.Filename = s.redactor.Redact(p.Filename)
+	for i := range p.Parts {
+		s.redactFilenames(&p.Parts[i])
+	}
+}
+
+func (s *Server) handleBody(w http.ResponseWriter, r *http.Request) {
+	email, err := s.st.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	writePlainText(w, []byte(email.Body))
+}
+
+// handleRaw streams the raw message, so a large one is sent in chunks as it
+// is read from the store.
+func (s *Server) handleRaw(w http.ResponseWriter, r *http.Request) {
+	raw, _, err := s.openRaw(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	defer func() { _ = raw.Close() }()
+	copyPlainText(w, raw)
+}
+
+// writePlainText serves untrusted message content so that browsers never
+// interpret it as markup.
+func writePlainText(w http.ResponseWriter, b []byte) {
+	copyPlainText(w, bytes.NewReader(b))
+}
+
+// copyPlainText is writePlainText for content read from r, which is sent as
+// it is read.
+func copyPlainText(w http.ResponseWriter, r io.Reader) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, r); err != nil {
+		log.Printf("write message content: %v", err)
+	}
+}
+
+// historyPage lists decisions with the edits of the emails decided on, keyed
+// by email ID.
+type historyPage struct {
+	Decisions []store.Decision
+	Edits     map[string][]editView
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	decisions, err := s.st.ListDecisions(r.Context(), historyLimit)
+	if err != nil {
+		http.Error(w, "failed to load history", http.StatusInternalServerError)
+		log.Printf("list decisions: %v", err)
+		return
+	}
+	var ids []string
+	for _, d := range decisions {
+		if d.Direction == store.DirectionOutbound {
+			ids = append(ids, d.EmailID)
+		}
+	}
+	s.render(w, r, "history.html", historyPage{Decisions: decisions, Edits: s.edits(r, ids)})
+}
+
+// trendDays is how many days of daily stats the stats page shows.
+const trendDays = 30
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	reviewers, err := s.st.ListReviewerStats(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		log.Printf("list reviewer stats: %v", err)
+		return
+	}
+	usage, err := s.quota.Usage(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		log.Printf("list quota usage: %v", err)
+		return
+	}
+	counts, err := s.st.CountByStatus(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		log.Printf("count emails by status: %v", err)
+		return
+	}
+	oldest, err := s.st.OldestPendingAge(r.Context(), time.Now())
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		log.Printf("oldest pending age: %v", err)
+		return
+	}
+	clicks, err := s.st.ListClickStats(r.Context(), maxClickStats)
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		log.Printf("list click stats: %v", err)
+		return
+	}
+	days, err := s.st.ListDailyStats(r.Context(), time.Now().AddDate(0, 0, -trendDays))
+	if err != nil {
+		http.Error(w, "failed to load stats", http.StatusInternalServerError)
+		log.Printf("list daily stats: %v", err)
+		return
+	}
+	page := statsPage{Reviewers: reviewers, QuotaEnabled: s.quota.Enabled(), Quota: usage, Counts: counts, OldestPending: oldest, Days: days, Clicks: clicks}
+	if s.contacts != nil {
+		blocked, err := s.contacts.BlockRules(r.Context())
+		if err != nil {
+			http.Error(w, "failed to load stats", http.StatusInternalServerError)
+			log.Printf("list block rules: %v", err)
+			return
+		}
+		for _, rule := range blocked {
+			page.Suppressed += rule.Suppressed
+		}
+		page.Blocked = blocked
+	}
+	s.render(w, r, "stats.html", page)
+}
+
+type statsPage struct {
+	Reviewers     []store.ReviewerStats
+	QuotaEnabled  bool
+	Quota         []quota.Usage
+	Counts        []store.StatusCount
+	OldestPending time.Duration // 0 when nothing is pending
+	Blocked       []store.BlockRule
+	Suppressed    int // emails rejected by all block rules
+	Days          []store.DailyStats
+	Clicks        []store.ClickStats
+}
+
+// handleMetrics refreshes the queue gauges from the store before serving all
+// metrics, so they are exact at scrape time.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	counts, err := s.st.CountByStatus(r.Context())
+	if err != nil {
+		log.Printf("count emails by status for metrics: %v", err)
+	} else {
+		found := make(map[[2]string]int, len(counts))
+		for _, c := range counts {
+			found[[2]string{c.Direction, c.Status}] = c.Count
+		}
+		// Set every combination so a drained queue reports 0, not its last value.
+		for _, direction := range []string{store.DirectionOutbound, store.DirectionInbound} {
+			for _, status := range []string{store.StatusPending, store.StatusApproved, store.StatusScheduled, store.StatusRelaying, store.StatusSent} {
+				metrics.Emails.Set(float64(found[[2]string{direction, status}]), direction, status)
+			}
+		}
+	}
+	if age, err := s.st.OldestPendingAge(r.Context(), time.Now()); err != nil {
+		log.Printf("oldest pending age for metrics: %v", err)
+	} else {
+		metrics.OldestPendingAge.Set(age.Seconds())
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+// formatDuration renders a duration rounded to whole seconds for display.
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
 }
 
 func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
@@ -137,41 +858,186 @@ func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	email, err := s.st.Get(ctx, id)
 	if err != nil {
-		http.Error(w, "email not found", http.StatusNotFound)
+		s.alreadyHandled(w, r, id)
+		return
+	}
+	if email.Direction != store.DirectionOutbound && email.Direction != store.DirectionInbound {
+		http.Error(w, "unknown direction", http.StatusInternalServerError)
 		return
 	}
+	if s.approve(w, r, email, reviewerName(r)) {
+		s.redirectAfterAction(w, r)
+	}
+}
+
+// approve approves email as reviewer, relaying outbound mail and releasing
+// inbound mail. If the email is not approved, because the recipient domain
+// policies need further approvals or that fails, it writes the response and
+// returns false.
+func (s *Server) approve(w http.ResponseWriter, r *http.Request, email *store.Email, reviewer string) bool {
+	ctx := r.Context()
+	id := email.ID
+
+	if !s.checkSuppressed(w, r, email) {
+		return false
+	}
+	if !s.addApproval(w, r, email, reviewer) {
+		return false
+	}
+
+	// Approving first claims the email, so a reviewer approving or rejecting
+	// it at the same time gets a conflict instead of relaying it twice.
+	if !s.claimApproval(w, r, email, reviewer) {
+		return false
+	}
 
 	switch email.Direction {
 	case store.DirectionOutbound:
-		// Relay via SMTP then delete.
-		if err := s.relay.Send(ctx, email); err != nil {
-			http.Error(w, "failed to relay email", http.StatusInternalServerError)
-			log.Printf("relay email %s: %v", id, err)
-			return
+		// Relay via SMTP then delete; the relay uses the approval for
+		// traceability headers. A failed relay returns the email to review.
+		email.ApprovedBy = reviewer
+		email.ApprovedAt = time.Now().UTC()
+		if at, window := s.windows.Next(email, email.ApprovedAt); at.After(email.ApprovedAt) {
+			return s.schedule(w, r, email, reviewer, at, "sending window "+window)
+		}
+		if at := s.throttle.Next(email.ApprovedAt); at.After(email.ApprovedAt) {
+			return s.schedule(w, r, email, reviewer, at, "the relay rate limit")
 		}
-		if err := s.st.Delete(ctx, id); err != nil {
-			log.Printf("delete email %s after relay: %v", id, err)
+		if err := s.relayHeld(ctx, email, store.StatusApproved); err != nil {
+			// The relay aborts when the reviewer goes away; the email must
+			// still go back to review.
+			if err := s.st.Unapprove(context.WithoutCancel(ctx), id); err != nil {
+				log.Printf("return email %s to review after failed relay: %v", id, err)
+			}
+			msg := "failed to relay email"
+			if errors.Is(err, relay.ErrUnsupported) { // approving again won't help
+				msg += ": " + err.Error()
+			}
+			http.Error(w, msg, http.StatusInternalServerError)
+			log.Printf("relay email %s: %v", id, err)
+			return false
 		}
 	case store.DirectionInbound:
-		// Approve in DB and move IMAP message to approved folder.
-		if err := s.st.Approve(ctx, id); err != nil {
-			http.Error(w, "failed to approve email", http.StatusInternalServerError)
-			log.Printf("approve email %s: %v", id, err)
-			return
+		s.releaseInbound(ctx, email)
+	}
+
+	s.recordDecision(ctx, email, store.DecisionApproved, reviewer)
+	if err := s.contacts.Learn(ctx, email); err != nil {
+		log.Printf("learn contacts from %s: %v", id, err)
+	}
+	return true
+}
+
+// relayHeld relays a held outbound email that is in status, approved or
+// scheduled, and deletes it. The email is marked relaying before the relay
+// is called and sent once it accepts, so an approval retried after a crash
+// never relays it twice (see ResumeRelays). If the relay refuses it, the
+// email is returned to status and the error returned.
+func (s *Server) relayHeld(ctx context.Context, email *store.Email, status string) error {
+	if err := s.st.BeginRelay(ctx, email.ID); err != nil {
+		return fmt.Errorf("begin relay: %w", err)
+	}
+	if err := s.relay.Send(ctx, email); err != nil {
+		if err := s.st.AbortRelay(context.WithoutCancel(ctx), email.ID, status); err != nil {
+			log.Printf("return email %s to %s after failed relay: %v", email.ID, status, err)
 		}
-		if s.imap != nil && email.IMAPMessageID != "" && email.IMAPMailbox != "" {
-			if err := s.imap.MoveMessage(ctx, email.IMAPMessageID, email.IMAPMailbox, folderApproved); err != nil {
-				log.Printf("IMAP move email %s to approved: %v", id, err)
-			} else if err := s.st.UpdateIMAPMailbox(ctx, id, folderApproved); err != nil {
-				log.Printf("update imap mailbox for %s: %v", id, err)
+		return err
+	}
+	// Relayed is relayed, even if the reviewer has gone away meanwhile.
+	ctx = context.WithoutCancel(ctx)
+	if err := s.st.MarkSent(ctx, email.ID); err != nil {
+		log.Printf("mark email %s sent: %v", email.ID, err)
+	}
+	if err := s.st.Delete(ctx, email.ID); err != nil {
+		log.Printf("delete email %s after relay: %v", email.ID, err)
+	}
+	return nil
+}
+
+// ResumeRelays finishes the approvals mailescrow was relaying when it last
+// stopped. Sent emails are deleted and their approval recorded. Emails still
+// relaying may or may not have reached the relay, so rather than risk
+// sending them twice they go back to review, flagged FlagRelayInterrupted.
+// Call it once at startup, before serving.
+func (s *Server) ResumeRelays(ctx context.Context) error {
+	emails, err := s.st.ListInFlight(ctx)
+	if err != nil {
+		return fmt.Errorf("list in-flight emails: %w", err)
+	}
+	for _, email := range emails {
+		switch email.Status {
+		case store.StatusSent:
+			if err := s.st.Delete(ctx, email.ID); err != nil {
+				log.Printf("delete sent email %s: %v", email.ID, err)
+				continue
+			}
+			s.recordDecision(ctx, &email, store.DecisionApproved, email.ApprovedBy)
+			log.Printf("Finished relaying email %s, sent before the last shutdown", email.ID)
+		case store.StatusRelaying:
+			if err := s.st.AbortRelay(ctx, email.ID, store.StatusApproved); err != nil {
+				log.Printf("return interrupted email %s to review: %v", email.ID, err)
+				continue
+			}
+			if err := s.st.Unapprove(ctx, email.ID); err != nil {
+				log.Printf("return interrupted email %s to review: %v", email.ID, err)
+				continue
 			}
+			if err := s.st.AddFlag(ctx, email.ID, store.FlagRelayInterrupted); err != nil {
+				log.Printf("flag email %s: %v", email.ID, err)
+			}
+			log.Printf("Email %s was being relayed when mailescrow stopped and may have been sent; returned to review", email.ID)
 		}
-	default:
-		http.Error(w, "unknown direction", http.StatusInternalServerError)
-		return
 	}
+	return nil
+}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+// schedule holds outbound email, approved by reviewer while its sending
+// window is closed or the relay is throttled, until at, when a job relays it.
+// reason says what holds it, for the log. The decision is recorded once it
+// is relayed. If scheduling fails the email returns to review; schedule
+// writes the response and returns false.
+func (s *Server) schedule(w http.ResponseWriter, r *http.Request, email *store.Email, reviewer string, at time.Time, reason string) bool {
+	ctx := r.Context()
+	if err := s.jobs.ScheduleSend(ctx, email.ID, newDecision(email, store.DecisionApproved, reviewer), at); err != nil {
+		if err := s.st.Unapprove(context.WithoutCancel(ctx), email.ID); err != nil {
+			log.Printf("return email %s to review after failed scheduling: %v", email.ID, err)
+		}
+		http.Error(w, "failed to schedule email", http.StatusInternalServerError)
+		log.Printf("schedule email %s: %v", email.ID, err)
+		return false
+	}
+	log.Printf("Email %s approved by %s, scheduled for %s by %s", email.ID, reviewer, at.Format(time.RFC3339), reason)
+	if err := s.contacts.Learn(ctx, email); err != nil {
+		log.Printf("learn contacts from %s: %v", email.ID, err)
+	}
+	return true
+}
+
+// claimApproval approves email as reviewer, at the version the form was
+// loaded with. If that fails, because someone decided first or otherwise, it
+// writes the response and returns false.
+func (s *Server) claimApproval(w http.ResponseWriter, r *http.Request, email *store.Email, reviewer string) bool {
+	version, ok := formVersion(w, r, email)
+	if !ok {
+		return false
+	}
+	if err := s.st.Approve(r.Context(), email.ID, reviewer, version); err != nil {
+		if s.lostRace(r.Context(), email.ID, err) {
+			s.alreadyHandled(w, r, email.ID)
+			return false
+		}
+		http.Error(w, "failed to approve email", http.StatusInternalServerError)
+		log.Printf("approve email %s: %v", email.ID, err)
+		return false
+	}
+	return true
+}
+
+// releaseInbound wakes consumers waiting for newly approved inbound email and
+// moves its IMAP message to the approved folder.
+func (s *Server) releaseInbound(ctx context.Context, email *store.Email) {
+	s.approved.Publish()
+	s.moveIMAP(ctx, email, email.IMAPMailbox, folderApproved)
 }
 
 func (s *Server) handleReject(w http.ResponseWriter, r *http.Request) {
@@ -179,23 +1045,155 @@ func (s *Server) handleReject(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	email, err := s.st.Get(ctx, id)
 	if err != nil {
-		http.Error(w, "email not found", http.StatusNotFound)
-		log.Printf("get email %s for reject: %v", id, err)
+		s.alreadyHandled(w, r, id)
+		return
+	}
+	if !s.reject(w, r, email, reviewerName(r)) {
 		return
 	}
+	if r.FormValue("notify") != "" {
+		s.sendBounce(ctx, email, strings.TrimSpace(r.FormValue("reason")))
+	}
+	s.redirectAfterAction(w, r)
+}
 
-	if email.Direction == store.DirectionInbound && s.imap != nil && email.IMAPMessageID != "" && email.IMAPMailbox != "" {
-		if err := s.imap.MoveMessage(ctx, email.IMAPMessageID, email.IMAPMailbox, folderRejected); err != nil {
-			log.Printf("IMAP move email %s to rejected: %v", id, err)
+// reject rejects email as reviewer, at the version the form was loaded with.
+// If that fails it writes the response and returns false.
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, email *store.Email, reviewer string) bool {
+	ctx := r.Context()
+	version, ok := formVersion(w, r, email)
+	if !ok {
+		return false
+	}
+	if err := s.rejectAt(ctx, email, version, reviewer); err != nil {
+		if s.lostRace(ctx, email.ID, err) {
+			s.alreadyHandled(w, r, email.ID)
+			return false
 		}
+		http.Error(w, "failed to reject email", http.StatusInternalServerError)
+		log.Printf("reject email %s: %v", email.ID, err)
+		return false
 	}
+	return true
+}
+
+// rejectAt rejects email as reviewer if it is still pending at version,
+// moving inbound mail to the rejected folder and recording the decision.
+func (s *Server) rejectAt(ctx context.Context, email *store.Email, version int, reviewer string) error {
+	if err := s.st.Reject(ctx, email.ID, version); err != nil {
+		return err
+	}
+	if email.Direction == store.DirectionInbound {
+		s.moveIMAP(ctx, email, email.IMAPMailbox, folderRejected)
+	}
+	s.recordDecision(ctx, email, store.DecisionRejected, reviewer)
+	return nil
+}
+
+// handleTag applies the form's tag to an email.
+func (s *Server) handleTag(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	tag, err := store.NormalizeTag(r.FormValue("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.st.AddTag(r.Context(), id, tag); err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		log.Printf("tag email %s: %v", id, err)
+		return
+	}
+	s.redirectAfterAction(w, r)
+}
 
-	if err := s.st.Delete(ctx, id); err != nil {
+// handleUntag removes the form's tag from an email.
+func (s *Server) handleUntag(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.st.RemoveTag(r.Context(), id, r.FormValue("tag")); err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		log.Printf("untag email %s: %v", id, err)
+		return
+	}
+	s.redirectAfterAction(w, r)
+}
+
+// formVersion returns the email version the reviewer's page showed, from the
+// form's "version" field, or the current version if the form has none.
+func formVersion(w http.ResponseWriter, r *http.Request, email *store.Email) (int, bool) {
+	v := r.FormValue("version")
+	if v == "" {
+		return email.Version, true
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		http.Error(w, "invalid version", http.StatusBadRequest)
+		return 0, false
+	}
+	return version, true
+}
+
+// lostRace reports whether err, from deciding on an email, means another
+// decision got there first: the email changed or is gone.
+func (s *Server) lostRace(ctx context.Context, id string, err error) bool {
+	if errors.Is(err, store.ErrConflict) {
+		return true
+	}
+	_, getErr := s.st.GetSummary(ctx, id)
+	return getErr != nil
+}
+
+// alreadyHandled responds to a decision on an email that is gone or no longer
+// pending at the version the reviewer saw: 409 Conflict saying who decided
+// on it first, or 404 if nobody did.
+func (s *Server) alreadyHandled(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	if email, err := s.st.GetSummary(ctx, id); err == nil {
+		if email.Status != store.StatusPending {
+			http.Error(w, "Email already approved by "+email.ApprovedBy, http.StatusConflict)
+		} else {
+			http.Error(w, "Email changed since the page was loaded; reload and try again", http.StatusConflict)
+		}
+		return
+	}
+	d, err := s.st.LastDecision(ctx, id)
+	if err != nil {
+		log.Printf("get last decision on %s: %v", id, err)
+	}
+	if d == nil {
 		http.Error(w, "email not found", http.StatusNotFound)
-		log.Printf("delete email %s: %v", id, err)
 		return
 	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	http.Error(w, fmt.Sprintf("Email already %s by %s", d.Decision, d.Reviewer), http.StatusConflict)
+}
+
+// redirectAfterAction returns the reviewer to the page named by the form's
+// "next" field, e.g. the triage view, or else to the pending list. Only local
+// paths are followed; they are paths of the UI, below the base path.
+func (s *Server) redirectAfterAction(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	s.redirect(w, r, next)
+}
+
+// sendBounce queues a notice to the sender of a rejected inbound email.
+// Bounces the policy does not allow are suppressed; failures are retried by
+// the job queue, as the email is already rejected.
+func (s *Server) sendBounce(ctx context.Context, email *store.Email, reason string) {
+	if s.bounce == nil || email.Direction != store.DirectionInbound {
+		return
+	}
+	if ok, why := s.bounce.Eligible(email); !ok {
+		metrics.Bounces.Inc("suppressed")
+		log.Printf("Bounce for email %s suppressed: %s", email.ID, why)
+		return
+	}
+	summary := *email
+	summary.Body, summary.RawMessage = "", nil
+	if err := s.jobs.Add(ctx, jobs.KindNotify, email.ID, notifyJob{Email: summary, Reason: reason}); err != nil {
+		log.Printf("queue bounce for email %s to %s: %v", email.ID, email.Sender, err)
+	}
 }
 
 // formatFromHeader returns an RFC 2822 From header value. If name is empty,
@@ -212,14 +1210,14 @@ func formatFromHeader(name, addr string) string {
 
 func (s *Server) handlePendingCount(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	emails, err := s.st.ListPending(ctx)
+	n, err := s.st.CountPending(ctx)
 	if err != nil {
-		http.Error(w, "failed to list pending emails", http.StatusInternalServerError)
-		log.Printf("list pending emails for count: %v", err)
+		http.Error(w, "failed to count pending emails", http.StatusInternalServerError)
+		log.Printf("count pending emails: %v", err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]int{"count": len(emails)}); err != nil {
+	if err := json.NewEncoder(w).Encode(map[string]int{"count": n}); err != nil {
 		log.Printf("encode pending count: %v", err)
 	}
 }
@@ -228,68 +1226,737 @@ type createEmailRequest struct {
 	To      []string `json:"to"`
 	Subject string   `json:"subject"`
 	Body    string   `json:"body"`
+
+	// HTMLBody is sent as a text/html part, alongside Body as
+	// multipart/alternative if both are given.
+	HTMLBody string `json:"html_body,omitempty"`
+
+	// Headers are added to the generated message, e.g. List-Unsubscribe.
+	// Headers mailescrow sets itself, Cc and Bcc are refused.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Identity names the configured identity to send as; empty sends as
+	// the relay account.
+	Identity string `json:"identity,omitempty"`
 }
 
 type createEmailResponse struct {
-	ID string `json:"id"`
+	ID     string `json:"id"`
+	Status string `json:"status"` // "pending", or "sent" if relayed to a trusted contact
 }
 
+// IdempotencyKeyTTL is how long an Idempotency-Key on POST /api/emails is
+// remembered; retries within it return the original submission.
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
 func (s *Server) handleCreateEmail(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var req createEmailRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRawMessageBytes)).Decode(&req); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("request exceeds %d bytes", MaxRawMessageBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
-	if len(req.To) == 0 || req.Subject == "" {
-		http.Error(w, "to and subject are required", http.StatusBadRequest)
+	extraHeaders, errs := s.validateEmail(ctx, req)
+	if len(errs) > 0 {
+		writeFieldErrors(w, "invalid request", errs)
+		return
+	}
+	from, ok := s.identity(w, r, req.Identity)
+	if !ok {
+		return
+	}
+
+	s.idempotent(w, r, requestHash(req), func() (createEmailResponse, bool) {
+		return s.submitEmail(ctx, w, req, from, extraHeaders)
+	})
+}
+
+// idempotent runs submit and writes its response, honouring the request's
+// Idempotency-Key: a retry with the same key and request hash, by the same
+// API token, gets the original response instead of a second submission.
+// Keys are scoped to the token, so one client cannot read another's
+// submission, or block it, by guessing its key.
+func (s *Server) idempotent(w http.ResponseWriter, r *http.Request, hash string, submit func() (createEmailResponse, bool)) {
+	ctx := r.Context()
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		if resp, ok := submit(); ok {
+			writeCreated(w, resp)
+		}
+		return
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
 		return
 	}
 
-	// Build RFC 2822 raw message.
-	rawMessage := fmt.Sprintf(
-		"Date: %s\r\nMessage-Id: <%s@mailescrow>\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
+	key = idempotencyScope(ctx) + key
+
+	// Submissions carrying the same key are serialized so concurrent retries
+	// cannot both miss the lookup and create duplicates.
+	defer s.idempotencyLocks.lock(key)()
+
+	now := time.Now()
+	prev, err := s.st.GetIdempotencyKey(ctx, key, now.Add(-IdempotencyKeyTTL))
+	if err != nil {
+		http.Error(w, "failed to check idempotency key", http.StatusInternalServerError)
+		log.Printf("get idempotency key: %v", err)
+		return
+	}
+	if prev != nil {
+		if prev.RequestHash != hash {
+			http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		writeCreated(w, createEmailResponse{ID: prev.EmailID, Status: prev.Status})
+		return
+	}
+
+	resp, ok := submit()
+	if !ok {
+		return
+	}
+	if err := s.st.PruneIdempotencyKeys(ctx, now.Add(-IdempotencyKeyTTL)); err != nil {
+		log.Printf("prune idempotency keys: %v", err)
+	}
+	if err := s.st.SaveIdempotencyKey(ctx, store.IdempotencyKey{
+		Key:         key,
+		RequestHash: hash,
+		EmailID:     resp.ID,
+		Status:      resp.Status,
+		CreatedAt:   now,
+	}); err != nil {
+		log.Printf("save idempotency key for %s: %v", resp.ID, err)
+	}
+	writeCreated(w, resp)
+}
+
+// idempotencyScope prefixes the Idempotency-Keys of the API token in ctx:
+// its ID, or nothing when the API is used without tokens.
+func idempotencyScope(ctx context.Context) string {
+	if t, ok := ctx.Value(tokenKey{}).(*store.APIToken); ok {
+		return "token:" + t.ID + ":"
+	}
+	return ""
+}
+
+// keyLocks hands out a mutex per key, so that submissions with different
+// Idempotency-Keys do not wait for each other. The zero value is ready to
+// use.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	users int // holding or waiting for it; dropped from keyLocks at 0
+}
+
+// lock locks key and returns the function that unlocks it.
+func (l *keyLocks) lock(key string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	kl := l.locks[key]
+	if kl == nil {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.users++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if kl.users--; kl.users == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// requestHash fingerprints a submission so a reused Idempotency-Key with a
+// different request can be refused.
+func requestHash(req createEmailRequest) string {
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// submitEmail builds the message for a JSON submission from identity from,
+// signing it if the identity has a DKIM key, and submits it.
+func (s *Server) submitEmail(ctx context.Context, w http.ResponseWriter, req createEmailRequest, from Identity, extraHeaders string) (createEmailResponse, bool) {
+	sub, ok := composeSubmission(w, req, from, extraHeaders)
+	if !ok {
+		return createEmailResponse{}, false
+	}
+	return s.submit(ctx, w, sub)
+}
+
+// composeSubmission builds the message for a JSON submission from identity
+// from, signing it if the identity has a DKIM key. On failure it writes the
+// error response and returns false.
+func composeSubmission(w http.ResponseWriter, req createEmailRequest, from Identity, extraHeaders string) (submission, bool) {
+	messageID := uuid.New().String()
+	header := fmt.Sprintf(
+		"Date: %s\r\nMessage-Id: <%s@mailescrow>\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n%s",
 		time.Now().UTC().Format(time.RFC1123Z),
-		uuid.New().String(),
-		formatFromHeader(s.fromName, s.fromAddr),
+		messageID,
+		formatFromHeader(from.DisplayName, from.Address),
 		strings.Join(req.To, ", "),
-		req.Subject,
-		req.Body,
+		mime.QEncoding.Encode("utf-8", req.Subject),
+		extraHeaders,
 	)
+	raw := composeMessage(header, req.Body, req.HTMLBody)
+	if from.DKIM != nil {
+		signed, err := from.DKIM.Sign(raw)
+		if err != nil {
+			http.Error(w, "failed to sign email", http.StatusInternalServerError)
+			log.Printf("DKIM-sign email as %s: %v", from.Address, err)
+			return submission{}, false
+		}
+		raw = signed
+	}
+	return submission{
+		id:      messageID,
+		sender:  from.Address,
+		to:      req.To,
+		subject: req.Subject,
+		body:    cmp.Or(req.Body, req.HTMLBody), // as mimetext.Body shows it
+		raw:     raw,
+	}, true
+}
+
+// submission is an outbound email submitted through the API.
+type submission struct {
+	id      string // used as the email ID if it is relayed without being held
+	sender  string
+	to      []string
+	subject string
+	body    string
+	raw     []byte
+}
 
-	id, err := s.st.SaveOutbound(ctx, s.fromAddr, req.To, req.Subject, req.Body, []byte(rawMessage))
+// submit holds sub for review, or relays it straight away if a rule or
+// recipient domain policy approves it or it goes to trusted contacts. On
+// failure, or if a block rule, rule or policy rejects it, it writes the
+// error response and returns false.
+func (s *Server) submit(ctx context.Context, w http.ResponseWriter, sub submission) (createEmailResponse, bool) {
+	p, ok := s.prepare(ctx, w, sub)
+	if !ok {
+		return createEmailResponse{}, false
+	}
+	if p.approver != "" {
+		if resp, ok := s.sendUnreviewed(ctx, p); ok {
+			return resp, true
+		}
+	}
+	return s.hold(ctx, w, p)
+}
+
+// prepared is a submission that passed prepare's checks, with what they
+// decided about it.
+type prepared struct {
+	sub      submission
+	project  string       // the project of the API token that submitted it
+	approver string       // who approves it without review; empty to hold it
+	quota    quota.Result // what it took of its sender's quota
+	flags    []string     // the flags it is held with
+	tags     []string     // the tags it is held or relayed with
+}
+
+// prepare runs the checks of submit that come before sub is held or relayed:
+// the project's message size limit, block rules, rules, recipient domain
+// policies, the sender's quota and the suppression list. It counts sub
+// against the quota, and records rejections. If sub is refused or rejected,
+// it writes the error response and returns false.
+func (s *Server) prepare(ctx context.Context, w http.ResponseWriter, sub submission) (prepared, bool) {
+	project := tokenProject(ctx)
+	if res := s.projects.CheckSize(ctx, project, len(sub.raw)); res.Exceeded != "" {
+		http.Error(w, res.Message(project), http.StatusRequestEntityTooLarge)
+		log.Printf("Refused email from %s: %s", sub.sender, res.Message(project))
+		return prepared{}, false
+	}
+	if blocked, err := s.contacts.Blocked(ctx, store.DirectionOutbound, sub.sender); err != nil {
+		log.Printf("check block rules: %v", err)
+	} else if blocked != "" {
+		http.Error(w, "sender is blocked", http.StatusForbidden)
+		log.Printf("Rejected email from %s to %v: %s is blocked", sub.sender, sub.to, blocked)
+		if err := s.st.RecordDecision(ctx, store.Decision{
+			Direction: store.DirectionOutbound,
+			Sender:    sub.sender,
+			Subject:   sub.subject,
+			Decision:  store.DecisionRejected,
+			Reviewer:  contacts.BlockReviewer,
+
+			RawMessage: sub.raw,
+		}); err != nil {
+			log.Printf("record decision: %v", err)
+		}
+		return prepared{}, false
+	}
+	s.rulesMu.Lock()
+	engine := s.rules
+	s.rulesMu.Unlock()
+	msg := s.ruleMessage(ctx, engine, sub)
+	rule, _ := engine.Evaluate(msg)
+	req := s.requirement(sub.to)
+	if action, decidedBy := req.Decide(rule); action == rules.ActionReject {
+		if rule.Action == rules.ActionReject {
+			http.Error(w, "message is refused by policy", http.StatusForbidden)
+		} else {
+			http.Error(w, "recipient domain is refused by policy", http.StatusForbidden)
+		}
+		log.Printf("Rejected email from %s to %v by %s", sub.sender, sub.to, decidedBy)
+		if err := s.st.RecordDecision(ctx, store.Decision{
+			Direction: store.DirectionOutbound,
+			Sender:    sub.sender,
+			Subject:   sub.subject,
+			Decision:  store.DecisionRejected,
+			Reviewer:  decidedBy,
+
+			RawMessage: sub.raw,
+		}); err != nil {
+			log.Printf("record decision: %v", err)
+		}
+		return prepared{}, false
+	}
+	q, err := s.quota.Take(ctx, quotaKey(ctx, sub.sender))
 	if err != nil {
+		http.Error(w, "failed to check quota", http.StatusInternalServerError)
+		log.Printf("check quota: %v", err)
+		return prepared{}, false
+	}
+	if q.Refuse {
+		http.Error(w, fmt.Sprintf("sender quota exceeded (%d per %s)", q.Limit, q.Period), http.StatusTooManyRequests)
+		return prepared{}, false
+	}
+	// Mail to a suppressed recipient, or whose recipients could not be
+	// checked, is held for review.
+	supp, err := s.suppress.Check(ctx, sub.to)
+	if err != nil {
+		log.Printf("submit email from %s: %v", sub.sender, err)
+	}
+	if supp.Refuse {
+		s.releaseQuota(ctx, q)
+		writeFieldErrors(w, "recipients are on the suppression list", suppressedFields(sub.to, supp))
+		return prepared{}, false
+	}
+	p := prepared{sub: sub, project: project, quota: q, tags: engine.Tags(msg)}
+	if project != "" {
+		p.tags = append(p.tags, project)
+	}
+	if q.Exceeded {
+		p.flags = append(p.flags, store.FlagQuotaExceeded)
+	}
+	if len(supp.Suppressed) > 0 {
+		p.flags = append(p.flags, store.FlagSuppressed)
+	}
+	if !q.Exceeded && err == nil && len(supp.Suppressed) == 0 {
+		p.approver = s.unreviewedApprover(ctx, sub, req, rule)
+	}
+	return p, true
+}
+
+// checkProject checks whether p's project may have it held for review along
+// with unsaved, the usage of the project's emails not stored yet. If not, it
+// gives back p's quota, writes the error response and returns false.
+func (s *Server) checkProject(ctx context.Context, w http.ResponseWriter, p prepared, unsaved store.TagUsage) bool {
+	res, err := s.projects.CheckWith(ctx, p.project, unsaved)
+	if err != nil {
+		s.releaseQuota(ctx, p.quota)
+		http.Error(w, "failed to check project limits", http.StatusInternalServerError)
+		log.Printf("submit email from %s: %v", p.sub.sender, err)
+		return false
+	}
+	if res.Exceeded != "" {
+		s.releaseQuota(ctx, p.quota)
+		http.Error(w, res.Message(p.project)+", try again later", http.StatusTooManyRequests)
+		log.Printf("Refused email from %s: %s", p.sub.sender, res.Message(p.project))
+		return false
+	}
+	return true
+}
+
+// hold saves p for review. On failure, or if its project is over a limit,
+// it writes the error response and returns false.
+func (s *Server) hold(ctx context.Context, w http.ResponseWriter, p prepared) (createEmailResponse, bool) {
+	if !s.checkProject(ctx, w, p, store.TagUsage{}) {
+		return createEmailResponse{}, false
+	}
+	sub := p.sub
+	id, err := s.st.SaveOutbound(ctx, sub.sender, sub.to, sub.subject, sub.body, sub.raw)
+	if err != nil {
+		s.releaseQuota(ctx, p.quota)
 		http.Error(w, "failed to save email", http.StatusInternalServerError)
 		log.Printf("save outbound email: %v", err)
-		return
+		return createEmailResponse{}, false
+	}
+	for _, flag := range p.flags {
+		if err := s.st.AddFlag(ctx, id, flag); err != nil {
+			log.Printf("flag email %s: %v", id, err)
+		}
+	}
+	for _, tag := range p.tags {
+		if err := s.st.AddTag(ctx, id, tag); err != nil {
+			log.Printf("tag email %s: %v", id, err)
+		}
+	}
+	return createEmailResponse{ID: id, Status: store.StatusPending}, true
+}
+
+// ruleMessage is what engine's rules see of sub. Its recipients' reputation
+// is only looked up if a rule reads it.
+func (s *Server) ruleMessage(ctx context.Context, engine *rules.Engine, sub submission) rules.Message {
+	msg := rules.Message{
+		Direction: store.DirectionOutbound, Sender: sub.sender, Recipients: sub.to,
+		Subject: sub.subject, Body: sub.body, Size: len(sub.raw),
+	}
+	if parsed, err := mail.ReadMessage(bytes.NewReader(sub.raw)); err == nil {
+		msg.Header = parsed.Header
+	}
+	if engine.UsesReputation() {
+		msg.Listed = len(s.reputation.CheckRecipients(ctx, sub.to)) > 0
+	}
+	return msg
+}
+
+// quotaKey is what an API submission counts against: the API token that made
+// it, or its sender address when the API is used without tokens.
+func quotaKey(ctx context.Context, sender string) string {
+	if t, ok := ctx.Value(tokenKey{}).(*store.APIToken); ok {
+		return quota.TokenKey(t.ID)
+	}
+	return sender
+}
+
+// tokenProject is the project of the API token that made a submission, or
+// "" without one.
+func tokenProject(ctx context.Context) string {
+	if t, ok := ctx.Value(tokenKey{}).(*store.APIToken); ok {
+		return t.Project
+	}
+	return ""
+}
+
+// releaseQuota gives back the quota of a submission refused after it was
+// counted.
+func (s *Server) releaseQuota(ctx context.Context, q quota.Result) {
+	if err := s.quota.Release(ctx, q); err != nil {
+		log.Printf("release quota: %v", err)
 	}
+}
 
+func writeCreated(w http.ResponseWriter, resp createEmailResponse) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(createEmailResponse{ID: id}); err != nil {
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("encode response: %v", err)
 	}
 }
 
+// unreviewedApprover returns who approves sub without review: rule, the
+// first matching rule, or req, the requirement of the recipient domain
+// policies, or, unless req holds it, the trusted contacts or allow rule
+// covering it. It returns "" if sub is to be held for review.
+func (s *Server) unreviewedApprover(ctx context.Context, sub submission, req policy.Requirement, rule rules.Rule) string {
+	action, approver := req.Decide(rule)
+	if action == rules.ActionApprove {
+		return approver
+	}
+	if req.Review() {
+		return ""
+	}
+	approver, err := s.contacts.Approver(ctx, store.DirectionOutbound, sub.sender, sub.to)
+	if err != nil {
+		log.Printf("check contacts: %v", err)
+		return ""
+	}
+	return approver
+}
+
+// sendUnreviewed relays p, which p.approver approved without review. While
+// its sending window is closed it is held, approved, until it opens. It
+// reports whether p was sent or held that way; otherwise the caller holds it
+// for review as usual.
+func (s *Server) sendUnreviewed(ctx context.Context, p prepared) (createEmailResponse, bool) {
+	sub, id, approver := p.sub, p.sub.id, p.approver
+	now := time.Now().UTC()
+	email := &store.Email{
+		ID:         id,
+		Direction:  store.DirectionOutbound,
+		Status:     store.StatusApproved,
+		Sender:     sub.sender,
+		Recipients: sub.to,
+		Subject:    sub.subject,
+		Body:       sub.body,
+		RawMessage: sub.raw,
+		ReceivedAt: now,
+		ApprovedBy: approver,
+		ApprovedAt: now,
+		Tags:       p.tags,
+	}
+	if at, window := s.windows.Next(email, now); at.After(now) {
+		return s.scheduleUnreviewed(ctx, email, at, window)
+	}
+	if err := s.relay.Send(ctx, email); err != nil {
+		log.Printf("relay email %s approved by %s (holding for review): %v", id, approver, err)
+		return createEmailResponse{}, false
+	}
+	log.Printf("Relayed email %s to %v (approved by %s)", id, sub.to, approver)
+	if err := s.st.RecordDecision(ctx, store.Decision{
+		EmailID:   id,
+		Direction: email.Direction,
+		Sender:    email.Sender,
+		Subject:   email.Subject,
+		Decision:  store.DecisionApproved,
+		Reviewer:  approver,
+
+		EnvelopeID: email.EnvelopeID,
+		RawMessage: email.RawMessage,
+	}); err != nil {
+		log.Printf("record decision for %s: %v", id, err)
+	}
+	return createEmailResponse{ID: id, Status: "sent"}, true
+}
+
+// scheduleUnreviewed holds email, approved without review by its
+// ApprovedBy, until at, when the sending window called window opens. Should
+// approving or scheduling it fail once it is saved, it is left pending for
+// review instead.
+func (s *Server) scheduleUnreviewed(ctx context.Context, email *store.Email, at time.Time, window string) (createEmailResponse, bool) {
+	id, err := s.st.SaveOutbound(ctx, email.Sender, email.Recipients, email.Subject, email.Body, email.RawMessage)
+	if err != nil {
+		log.Printf("save email approved by %s (holding for review): %v", email.ApprovedBy, err)
+		return createEmailResponse{}, false
+	}
+	email.ID = id
+	for _, tag := range email.Tags {
+		if err := s.st.AddTag(ctx, id, tag); err != nil {
+			log.Printf("tag email %s: %v", id, err)
+		}
+	}
+	if err := s.st.Approve(ctx, id, email.ApprovedBy, 0); err != nil {
+		log.Printf("approve email %s (holding for review): %v", id, err)
+		return createEmailResponse{ID: id, Status: store.StatusPending}, true
+	}
+	if err := s.jobs.ScheduleSend(ctx, id, newDecision(email, store.DecisionApproved, email.ApprovedBy), at); err != nil {
+		if err := s.st.Unapprove(context.WithoutCancel(ctx), id); err != nil {
+			log.Printf("return email %s to review after failed scheduling: %v", id, err)
+		}
+		log.Printf("schedule email %s (holding for review): %v", id, err)
+		return createEmailResponse{ID: id, Status: store.StatusPending}, true
+	}
+	log.Printf("Email %s approved by %s, scheduled for %s by sending window %s", id, email.ApprovedBy, at.Format(time.RFC3339), window)
+	return createEmailResponse{ID: id, Status: store.StatusScheduled}, true
+}
+
+type healthResponse struct {
+	Status string         `json:"status"` // "ok" | "degraded"
+	IMAP   *poller.Status `json:"imap,omitempty"`
+}
+
+// handleHealthz reports service health. It returns 503 while the IMAP
+// poller's circuit breaker is open.
+func (s *Server) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	resp := healthResponse{Status: "ok"}
+	code := http.StatusOK
+	if s.pollerStatus != nil {
+		status := s.pollerStatus()
+		resp.IMAP = &status
+		if status.State == poller.StateOpen {
+			resp.Status = "degraded"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
+
+func (s *Server) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if s.debug == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.debug.ServeHTTP(w, r)
+}
+
+type reloadResponse struct {
+	Reloaded        []string `json:"reloaded"`         // changed settings now in effect
+	RestartRequired []string `json:"restart_required"` // changed settings that take effect on restart
+}
+
+func (s *Server) handleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if s.reload == nil {
+		http.NotFound(w, r)
+		return
+	}
+	reloaded, restart, err := s.reload()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reload failed, previous configuration kept: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+	resp := reloadResponse{Reloaded: []string{}, RestartRequired: []string{}}
+	resp.Reloaded = append(resp.Reloaded, reloaded...)
+	resp.RestartRequired = append(resp.RestartRequired, restart...)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("encode reload response: %v", err)
+	}
+}
+
 type emailResponse struct {
 	ID         string    `json:"id"`
 	From       string    `json:"from"`
 	To         []string  `json:"to"`
 	Subject    string    `json:"subject"`
 	Body       string    `json:"body"`
+	Snippet    string    `json:"snippet"`
+	Queue      string    `json:"queue"`
 	ReceivedAt time.Time `json:"received_at"`
+
+	DeliveredTo []string `json:"delivered_to,omitempty"` // envelope recipients, when they were recorded
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// MaxWait caps the ?wait= duration of a long-polling GET /api/emails.
+const MaxWait = time.Minute
+
+// SetKeepFetched leaves approved inbound mail in place once GET /api/emails
+// returns it (api.consume_mode: keep), so several consumers can read it,
+// each from its own checkpoint with ?after_checkpoint=true.
+func (s *Server) SetKeepFetched(keep bool) {
+	s.keepFetched = keep
+}
+
+// SetStripTrackers removes tracking pixels from the HTML view of messages
+// (web.tracking_pixels: strip), so they do not load even when a reviewer
+// loads the rest of the remote content. They are still counted.
+func (s *Server) SetStripTrackers(strip bool) {
+	s.stripTrackers = strip
 }
 
+// handleGetEmails fetches approved inbound mail, or with ?status= lists the
+// emails with that status.
 func (s *Server) handleGetEmails(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("status") {
+		if results, _, ok := s.listEmailsByStatus(w, r, 0, 0); ok {
+			writeJSON(w, results)
+		}
+		return
+	}
+	if results, _, ok := s.fetchEmails(w, r, 0); ok {
+		writeJSON(w, results)
+	}
+}
+
+// handleGetEmailsV2 is handleGetEmails returning at most ?limit= emails in an
+// apiPage. Fetched email is gone, or behind the token's checkpoint, so there
+// is no cursor: while HasMore is set, fetch again for the rest. Lists by
+// ?status= are paged with ?cursor= as usual.
+func (s *Server) handleGetEmailsV2(w http.ResponseWriter, r *http.Request) {
+	limit, ok := pageLimit(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Has("status") {
+		offset, ok := pageOffset(w, r)
+		if !ok {
+			return
+		}
+		if results, total, ok := s.listEmailsByStatus(w, r, offset, limit); ok {
+			page := apiPage[statusEmailResponse]{Data: results}
+			if offset+limit < total {
+				page.HasMore = true
+				page.NextCursor = pageCursor(offset + limit)
+			}
+			writeJSON(w, page)
+		}
+		return
+	}
+	if results, more, ok := s.fetchEmails(w, r, limit); ok {
+		writeJSON(w, apiPage[emailResponse]{Data: results, HasMore: more})
+	}
+}
+
+// fetchEmails returns up to limit (0 for all) approved inbound emails and
+// whether more are left, deleting those it returns unless SetKeepFetched
+// keeps them. With ?after_checkpoint=true it returns those approved since
+// the request's token last read the queue, and moves the token's checkpoint
+// past them. On failure it writes the error response and returns false.
+func (s *Server) fetchEmails(w http.ResponseWriter, r *http.Request, limit int) ([]emailResponse, bool, bool) {
 	ctx := r.Context()
-	emails, err := s.st.ListApproved(ctx)
+	queue := r.URL.Query().Get("queue")
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "wait must be a duration such as 30s", http.StatusBadRequest)
+			return nil, false, false
+		}
+		wait = min(d, MaxWait)
+	}
+	var tag string
+	if v := r.URL.Query().Get("tag"); v != "" {
+		t, err := store.NormalizeTag(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false, false
+		}
+		tag = t
+	}
+	list := func(ctx context.Context) ([]store.Email, error) {
+		return s.st.ListApproved(ctx, queue, tag)
+	}
+	var consumer string
+	if v := r.URL.Query().Get("after_checkpoint"); v != "" {
+		after, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "after_checkpoint must be true or false", http.StatusBadRequest)
+			return nil, false, false
+		}
+		if after {
+			c, ok := s.checkpointConsumer(w, r, tag)
+			if !ok {
+				return nil, false, false
+			}
+			consumer = c
+			list = func(ctx context.Context) ([]store.Email, error) {
+				position, err := s.st.GetCheckpoint(ctx, consumer, queue)
+				if err != nil {
+					return nil, err
+				}
+				return s.st.ListApprovedAfter(ctx, queue, position)
+			}
+		}
+	}
+	emails, err := s.waitForApproved(ctx, list, wait)
 	if err != nil {
 		http.Error(w, "failed to list emails", http.StatusInternalServerError)
 		log.Printf("list approved emails: %v", err)
-		return
+		return nil, false, false
+	}
+	more := limit > 0 && len(emails) > limit
+	if more {
+		emails = emails[:limit]
 	}
 
-	var results []emailResponse
+	results := []emailResponse{} // return [] not null
 	for _, email := range emails {
 		results = append(results, emailResponse{
 			ID:         email.ID,
@@ -297,25 +1964,76 @@ func (s *Server) handleGetEmails(w http.ResponseWriter, r *http.Request) {
 			To:         email.Recipients,
 			Subject:    email.Subject,
 			Body:       email.Body,
+			Snippet:    email.Snippet,
+			Queue:      email.Queue,
 			ReceivedAt: email.ReceivedAt,
+
+			DeliveredTo: email.EnvelopeRecipients,
+			Tags:        email.Tags,
 		})
-		// Move to mailescrow/read and delete from DB.
-		if s.imap != nil && email.IMAPMessageID != "" {
-			if err := s.imap.MoveMessage(ctx, email.IMAPMessageID, folderApproved, folderRead); err != nil {
-				log.Printf("IMAP move email %s to read: %v", email.ID, err)
-			}
+		if s.keepFetched {
+			continue
 		}
+		// Move to mailescrow/read and delete from DB.
+		s.moveIMAP(ctx, &email, folderApproved, folderRead)
 		if err := s.st.Delete(ctx, email.ID); err != nil {
 			log.Printf("delete email %s after fetch: %v", email.ID, err)
 		}
 	}
+	if consumer != "" && len(emails) > 0 {
+		// Saved before the response is sent: an email the consumer fails to
+		// receive is not returned to it again.
+		if err := s.st.SaveCheckpoint(ctx, consumer, queue, emails[len(emails)-1].ApprovalSeq); err != nil {
+			http.Error(w, "failed to save checkpoint", http.StatusInternalServerError)
+			log.Printf("save checkpoint of %s: %v", consumer, err)
+			return nil, false, false
+		}
+	}
+
+	return results, more, true
+}
 
-	if results == nil {
-		results = []emailResponse{} // return [] not null
+// checkpointConsumer returns the ID of the request's token, whose checkpoint
+// ?after_checkpoint=true reads from. On failure it writes the error response
+// and returns false.
+func (s *Server) checkpointConsumer(w http.ResponseWriter, r *http.Request, tag string) (string, bool) {
+	if !s.keepFetched {
+		http.Error(w, "after_checkpoint needs api.consume_mode: keep", http.StatusBadRequest)
+		return "", false
 	}
+	if tag != "" {
+		http.Error(w, "after_checkpoint cannot be combined with tag", http.StatusBadRequest)
+		return "", false
+	}
+	t, ok := r.Context().Value(tokenKey{}).(*store.APIToken)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mailescrow"`)
+		http.Error(w, "checkpoints belong to an API token; send one", http.StatusUnauthorized)
+		return "", false
+	}
+	return t.ID, true
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(results); err != nil {
-		log.Printf("encode response: %v", err)
+// waitForApproved lists approved inbound mail with list. If there is none,
+// it waits up to wait for an approval, the client to go away or the server
+// to shut down, and lists again after each approval.
+func (s *Server) waitForApproved(ctx context.Context, list func(context.Context) ([]store.Email, error), wait time.Duration) ([]store.Email, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		approved := s.approved.Wait()
+		emails, err := list(ctx)
+		if err != nil || len(emails) > 0 || wait <= 0 {
+			return emails, err
+		}
+		select {
+		case <-approved:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		case <-s.closing:
+			return nil, nil
+		}
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestBasicAuthMiddleware(t *testing.T) {
@@ -72,3 +73,48 @@ func TestBasicAuthMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestReviewerName(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if got := reviewerName(r); got != "anonymous" {
+		t.Errorf("reviewer without credentials = %q, want anonymous", got)
+	}
+	r.SetBasicAuth("alice", "secret")
+	if got := reviewerName(r); got != "alice" {
+		t.Errorf("reviewer with credentials = %q, want alice", got)
+	}
+}
+
+func TestKeyLocks(t *testing.T) {
+	var l keyLocks
+	unlock := l.lock("a")
+
+	// Another key is not held up by a.
+	done := make(chan struct{})
+	go func() {
+		l.lock("b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock of b waited for a")
+	}
+
+	// The same key waits until a is unlocked.
+	locked := make(chan struct{})
+	go func() {
+		l.lock("a")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("a was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	if len(l.locks) != 0 {
+		t.Errorf("locks = %v, want none left once unlocked", l.locks)
+	}
+}
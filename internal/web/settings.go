@@ -0,0 +1,233 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/albert/mailescrow/internal/config"
+)
+
+const (
+	actionSettingsUpdate = "settings.update"
+	actionSettingsReset  = "settings.reset"
+)
+
+// redactedValue is how a secret setting that is set is shown, as in
+// config.Config.Settings.
+const redactedValue = "(redacted)"
+
+// TunableSetting is a setting that can be changed at runtime (see
+// config.Tunable), as it is in effect.
+type TunableSetting struct {
+	Key       string
+	Value     string // YAML, "(redacted)" for a secret that is set
+	Secret    bool
+	Changed   bool // changed at runtime; otherwise the config file applies
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+// SettingsEditor changes the tunable settings at runtime.
+type SettingsEditor interface {
+	// TunableSettings returns the tunable settings in effect.
+	TunableSettings(ctx context.Context) ([]TunableSetting, error)
+	// UpdateSettings applies changes, YAML values by key, a nil value
+	// resetting the setting to the config file's, and keeps them. If a
+	// value is invalid it returns a *config.SettingError and changes
+	// nothing.
+	UpdateSettings(ctx context.Context, changes map[string]*string, actor string) error
+}
+
+// SetSettingsEditor lets admins change the tunable settings on the settings
+// page and with GET and PUT /api/settings, which answer 404 without one.
+func (s *Server) SetSettingsEditor(e SettingsEditor) {
+	s.settingsEditor = e
+}
+
+type settingsPage struct {
+	Tunable  []TunableSetting
+	Settings []config.Setting
+
+	// A refused change: the setting, why, and the value submitted.
+	Invalid, Error, Value string
+}
+
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	s.renderSettings(w, r, settingsPage{}, http.StatusOK)
+}
+
+func (s *Server) renderSettings(w http.ResponseWriter, r *http.Request, page settingsPage, status int) {
+	if s.settingsEditor != nil {
+		tunable, err := s.settingsEditor.TunableSettings(r.Context())
+		if err != nil {
+			http.Error(w, "failed to load settings", http.StatusInternalServerError)
+			log.Printf("list tunable settings: %v", err)
+			return
+		}
+		page.Tunable = tunable
+	}
+	s.settingsMu.Lock()
+	page.Settings = s.settings
+	s.settingsMu.Unlock()
+	w.WriteHeader(status)
+	s.render(w, r, "settings.html", page)
+}
+
+// handleUpdateSetting changes or, with action=reset, resets one setting
+// from the settings page.
+func (s *Server) handleUpdateSetting(w http.ResponseWriter, r *http.Request) {
+	if s.settingsEditor == nil {
+		http.NotFound(w, r)
+		return
+	}
+	key := r.FormValue("key")
+	var value *string
+	if r.FormValue("action") != "reset" {
+		v := r.FormValue("value")
+		value = &v
+	}
+	changes := map[string]*string{key: value}
+	if errs := s.updateSettings(r.Context(), changes, reviewerName(r), r); len(errs) > 0 {
+		page := settingsPage{Invalid: key, Error: errs[0].Message}
+		if value != nil {
+			page.Value = *value
+		}
+		s.renderSettings(w, r, page, http.StatusBadRequest)
+		return
+	}
+	s.redirect(w, r, "/settings")
+}
+
+// updateSettings checks changes and has the editor apply them, auditing
+// each. It returns the invalid settings; other errors are answered with
+// 500 and returned as a fieldError without a Field.
+func (s *Server) updateSettings(ctx context.Context, changes map[string]*string, actor string, r *http.Request) []fieldError {
+	keys := slices.Sorted(maps.Keys(changes))
+	var errs []fieldError
+	for _, key := range keys {
+		value := changes[key]
+		switch {
+		case !config.IsTunable(key):
+			errs = append(errs, fieldError{Field: key, Message: "not a setting that can be changed at runtime"})
+		case value != nil && isRedacted(*value):
+			errs = append(errs, fieldError{Field: key, Message: "enter the new value; the current one is not shown"})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if err := s.settingsEditor.UpdateSettings(ctx, changes, actor); err != nil {
+		var se *config.SettingError
+		if errors.As(err, &se) {
+			return []fieldError{{Field: se.Key, Message: se.Err.Error()}}
+		}
+		log.Printf("update settings: %v", err)
+		return []fieldError{{Message: fmt.Sprintf("settings not changed: %v", err)}}
+	}
+	for _, key := range keys {
+		if changes[key] == nil {
+			s.audit(r, actor, actionSettingsReset, key)
+		} else {
+			s.audit(r, actor, actionSettingsUpdate, key)
+		}
+	}
+	return nil
+}
+
+// isRedacted reports whether value, YAML, is the redacted value a secret
+// is shown as, sent back unchanged.
+func isRedacted(value string) bool {
+	var s string
+	return yaml.Unmarshal([]byte(value), &s) == nil && s == redactedValue
+}
+
+type settingResponse struct {
+	Key       string     `json:"key"`
+	Value     any        `json:"value"`
+	Secret    bool       `json:"secret"`
+	Changed   bool       `json:"changed"` // false while the config file applies
+	UpdatedBy string     `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type settingsResponse struct {
+	Settings []settingResponse `json:"settings"`
+}
+
+func (s *Server) handleAPISettings(w http.ResponseWriter, r *http.Request) {
+	if s.settingsEditor == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.writeSettings(w, r)
+}
+
+func (s *Server) writeSettings(w http.ResponseWriter, r *http.Request) {
+	tunable, err := s.settingsEditor.TunableSettings(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load settings", http.StatusInternalServerError)
+		log.Printf("list tunable settings: %v", err)
+		return
+	}
+	resp := settingsResponse{Settings: make([]settingResponse, 0, len(tunable))}
+	for _, t := range tunable {
+		var value any
+		if err := yaml.Unmarshal([]byte(t.Value), &value); err != nil {
+			value = t.Value
+		}
+		sr := settingResponse{Key: t.Key, Value: value, Secret: t.Secret, Changed: t.Changed}
+		if t.Changed {
+			sr.UpdatedBy = t.UpdatedBy
+			sr.UpdatedAt = &t.UpdatedAt
+		}
+		resp.Settings = append(resp.Settings, sr)
+	}
+	writeJSON(w, resp)
+}
+
+// handleAPIUpdateSettings changes the settings named in the request, a JSON
+// object of new values by key; null resets a setting to the config file's.
+// It answers with the settings as GET /api/settings does.
+func (s *Server) handleAPIUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	if s.settingsEditor == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var req map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(req) == 0 {
+		http.Error(w, "no settings to change", http.StatusBadRequest)
+		return
+	}
+	changes := make(map[string]*string, len(req))
+	for key, raw := range req {
+		if string(raw) == "null" {
+			changes[key] = nil
+			continue
+		}
+		// JSON is YAML, as the settings are stored.
+		value := string(raw)
+		changes[key] = &value
+	}
+	if errs := s.updateSettings(r.Context(), changes, apiActor(r), r); len(errs) > 0 {
+		if errs[0].Field == "" {
+			http.Error(w, errs[0].Message, http.StatusInternalServerError)
+			return
+		}
+		writeFieldErrors(w, "invalid settings", errs)
+		return
+	}
+	s.writeSettings(w, r)
+}
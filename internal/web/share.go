@@ -0,0 +1,189 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/albert/mailescrow/internal/mimetext"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/tokens"
+)
+
+// Audit actions recorded for share links.
+const (
+	actionShareCreate = "share.create"
+	actionShareRevoke = "share.revoke"
+	actionShareView   = "share.view"
+)
+
+// Share links are valid for defaultShareTTL unless the reviewer picks another
+// expiry, which may not exceed maxShareTTL.
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 7 * 24 * time.Hour
+)
+
+// sharePolicy confines the shared page and the HTML part shown in it: no
+// script and nothing fetched from elsewhere, so neither remote content nor
+// tracking pixels reveal who opened the link.
+const sharePolicy = "default-src 'none'; style-src 'self' 'unsafe-inline'; img-src data:"
+
+type shareLinkView struct {
+	store.ShareLink
+	Status string
+}
+
+// sharePage is a held email as an external reviewer sees it: read-only, with
+// no actions and no attachment downloads.
+type sharePage struct {
+	*store.Email
+	HTML        string
+	Attachments []mimetext.Attachment
+	ExpiresAt   time.Time
+}
+
+// shareStatus reports whether l is active, expired or revoked.
+func shareStatus(l store.ShareLink, now time.Time) string {
+	switch {
+	case !l.RevokedAt.IsZero():
+		return tokenRevoked
+	case now.After(l.ExpiresAt):
+		return tokenExpired
+	}
+	return tokenActive
+}
+
+// shareLinks returns the share links of an email for its detail page.
+func (s *Server) shareLinks(r *http.Request, emailID string) []shareLinkView {
+	links, err := s.st.ListShareLinks(r.Context(), emailID)
+	if err != nil {
+		log.Printf("list share links of %s: %v", emailID, err)
+		return nil
+	}
+	now := time.Now()
+	views := make([]shareLinkView, 0, len(links))
+	for _, l := range links {
+		views = append(views, shareLinkView{ShareLink: l, Status: shareStatus(l, now)})
+	}
+	return views
+}
+
+// handleCreateShare creates a share link for an email and shows its URL once
+// on the detail page. Only a hash of the token in the URL is stored.
+func (s *Server) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if _, err := s.st.GetSummary(r.Context(), id); err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultShareTTL
+	if hours := r.PostForm.Get("expires_in_hours"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 || time.Duration(n)*time.Hour > maxShareTTL {
+			http.Error(w, fmt.Sprintf("expiry must be between 1 and %d hours", int(maxShareTTL.Hours())), http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(n) * time.Hour
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "failed to create share link", http.StatusInternalServerError)
+		log.Printf("generate share token: %v", err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now().UTC()
+	reviewer := reviewerName(r)
+	link := store.ShareLink{EmailID: id, Hash: tokens.Hash(token), CreatedBy: reviewer, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	linkID, err := s.st.CreateShareLink(r.Context(), link)
+	if err != nil {
+		http.Error(w, "failed to create share link", http.StatusInternalServerError)
+		log.Printf("create share link for %s: %v", id, err)
+		return
+	}
+	s.audit(r, reviewer, actionShareCreate, fmt.Sprintf("email %s, link %s, expires %s", id, linkID, link.ExpiresAt.Format(time.RFC3339)))
+	s.renderDetail(w, r, s.absoluteURL(r, "/share/"+token))
+}
+
+func (s *Server) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	id, linkID := r.PathValue("id"), r.PathValue("link")
+	links, err := s.st.ListShareLinks(r.Context(), id)
+	if err != nil {
+		http.Error(w, "failed to revoke share link", http.StatusInternalServerError)
+		log.Printf("list share links of %s: %v", id, err)
+		return
+	}
+	found := false
+	for _, l := range links {
+		found = found || l.ID == linkID
+	}
+	if !found {
+		http.Error(w, "share link not found", http.StatusNotFound)
+		return
+	}
+	if err := s.st.RevokeShareLink(r.Context(), linkID); err != nil {
+		http.Error(w, "share link not found", http.StatusNotFound)
+		log.Printf("revoke share link: %v", err)
+		return
+	}
+	reviewer := reviewerName(r)
+	s.audit(r, reviewer, actionShareRevoke, fmt.Sprintf("email %s, link %s", id, linkID))
+	s.redirect(w, r, "/email/"+id)
+}
+
+// handleShare shows the email of a live share link to whoever holds it, with
+// no other authentication. Every view is recorded in the audit log. Unknown,
+// expired and revoked links are indistinguishable to the visitor.
+func (s *Server) handleShare(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Robots-Tag", "noindex")
+
+	link, err := s.st.GetShareLinkByHash(r.Context(), tokens.Hash(r.PathValue("token")))
+	if err != nil {
+		http.Error(w, "failed to load share link", http.StatusInternalServerError)
+		log.Printf("get share link: %v", err)
+		return
+	}
+	if link == nil || shareStatus(*link, time.Now()) != tokenActive {
+		http.Error(w, "share link not found or expired", http.StatusNotFound)
+		return
+	}
+	email, err := s.st.Get(r.Context(), link.EmailID)
+	if err != nil {
+		http.Error(w, "share link not found or expired", http.StatusNotFound)
+		return
+	}
+	s.audit(r, "share:"+link.ID, actionShareView, fmt.Sprintf("email %s from %s", email.ID, remoteIP(r.RemoteAddr)))
+
+	page := sharePage{
+		Email:       email,
+		HTML:        s.redactor.Redact(messageHTML(email.RawMessage)),
+		Attachments: mimetext.Attachments(email.RawMessage),
+		ExpiresAt:   link.ExpiresAt,
+	}
+	for i := range page.Attachments {
+		page.Attachments[i].Filename = s.redactor.Redact(page.Attachments[i].Filename)
+	}
+	h.Set("Content-Security-Policy", sharePolicy)
+	s.render(w, r, "share.html", page)
+}
+
+// audit records an entry in the audit log, logging rather than failing on
+// error.
+func (s *Server) audit(r *http.Request, actor, action, detail string) {
+	if err := s.st.RecordAudit(r.Context(), store.AuditEntry{At: time.Now().UTC(), Actor: actor, Action: action, Detail: detail}); err != nil {
+		log.Printf("record audit entry %s: %v", action, err)
+	}
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Audit actions recorded for snoozes.
+const (
+	actionEmailSnooze   = "email.snooze"
+	actionEmailUnsnooze = "email.unsnooze"
+)
+
+// maxSnooze bounds how long a pending email may be snoozed at once.
+const maxSnooze = 30 * 24 * time.Hour
+
+// handleSnooze hides a pending email from the pending list for the form's
+// number of hours. When the snooze expires the email returns and the
+// reviewers are notified; see package snooze.
+func (s *Server) handleSnooze(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	n, err := strconv.Atoi(r.FormValue("hours"))
+	if err != nil || n <= 0 || time.Duration(n)*time.Hour > maxSnooze {
+		http.Error(w, fmt.Sprintf("snooze must be between 1 and %d hours", int(maxSnooze.Hours())), http.StatusBadRequest)
+		return
+	}
+	until := time.Now().UTC().Add(time.Duration(n) * time.Hour)
+	reviewer := reviewerName(r)
+	if err := s.st.Snooze(r.Context(), id, reviewer, until); err != nil {
+		if errors.Is(err, store.ErrConflict) {
+			http.Error(w, "only pending emails can be snoozed", http.StatusConflict)
+			return
+		}
+		http.Error(w, "email not found", http.StatusNotFound)
+		log.Printf("snooze email %s: %v", id, err)
+		return
+	}
+	s.audit(r, reviewer, actionEmailSnooze, fmt.Sprintf("email %s, until %s", id, until.Format(time.RFC3339)))
+	s.redirectAfterAction(w, r)
+}
+
+// handleUnsnooze returns a snoozed email to the pending list at once.
+func (s *Server) handleUnsnooze(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.st.Unsnooze(r.Context(), id); err != nil {
+		http.Error(w, "email not found", http.StatusNotFound)
+		log.Printf("unsnooze email %s: %v", id, err)
+		return
+	}
+	s.audit(r, reviewerName(r), actionEmailUnsnooze, "email "+id)
+	s.redirectAfterAction(w, r)
+}
@@ -0,0 +1,165 @@
+// mailescrow web UI enhancements. Every page works without JavaScript;
+// this only adds conveniences.
+(function () {
+  "use strict";
+
+  // Highlight the navigation link for the current page.
+  // The first link is the pending list at the root, which only matches
+  // itself.
+  var path = window.location.pathname;
+  var links = document.querySelectorAll("nav a");
+  var root = links.length ? links[0].getAttribute("href") : "/";
+  links.forEach(function (a) {
+    var href = a.getAttribute("href");
+    if (href === path || (href !== root && path.indexOf(href) === 0)) {
+      a.classList.add("active");
+    }
+  });
+
+  // Load message content on demand instead of with the page. Without
+  // JavaScript the links open the plain-text content directly.
+  function load(url, target) {
+    return fetch(url, { credentials: "same-origin" }).then(function (resp) {
+      if (!resp.ok) {
+        throw new Error(resp.statusText);
+      }
+      return resp.text();
+    }).then(function (text) {
+      target.textContent = text;
+    });
+  }
+
+  // enhance wires up the elements under root; triage calls it again for
+  // each email it swaps in.
+  function enhance(root) {
+    // Ask before destructive actions marked with data-confirm.
+    root.querySelectorAll("form[data-confirm]").forEach(function (form) {
+      form.addEventListener("submit", function (ev) {
+        if (!window.confirm(form.getAttribute("data-confirm"))) {
+          ev.preventDefault();
+        }
+      });
+    });
+
+    root.querySelectorAll("a[data-load]").forEach(function (a) {
+      a.addEventListener("click", function (ev) {
+        var target = document.getElementById(a.getAttribute("data-load"));
+        if (!target) {
+          return;
+        }
+        ev.preventDefault();
+        load(a.getAttribute("href"), target).then(function () {
+          a.parentNode.remove();
+        }, function () {
+          window.location = a.getAttribute("href");
+        });
+      });
+    });
+
+    root.querySelectorAll("details[data-src]").forEach(function (details) {
+      details.addEventListener("toggle", function () {
+        if (!details.open || details.hasAttribute("data-loaded")) {
+          return;
+        }
+        details.setAttribute("data-loaded", "");
+        load(details.getAttribute("data-src"), details.querySelector("pre"))
+          .catch(function () { details.removeAttribute("data-loaded"); });
+      });
+    });
+  }
+
+  enhance(document);
+
+  // Triage: one pending email at a time, driven by the keys in data-key
+  // (J/K move, A approves, R rejects, E opens the email). The next email is
+  // fetched in the background, and decisions are posted without leaving the
+  // page, so each step only swaps the email in place.
+  var triage = document.querySelector("[data-triage]");
+  if (!triage) {
+    return;
+  }
+  var prefetched = {};
+
+  function fetchPage(url, opts) {
+    opts = opts || {};
+    opts.credentials = "same-origin";
+    return fetch(url, opts).then(function (resp) {
+      if (!resp.ok) {
+        // Errors are plain text, e.g. "Email already approved by alice".
+        return resp.text().then(function (text) {
+          throw new Error(text.trim() || resp.statusText);
+        });
+      }
+      return resp.text().then(function (html) {
+        return { url: resp.url, html: html };
+      });
+    });
+  }
+
+  function prefetchNext() {
+    var next = triage.querySelector("a[rel=next]");
+    if (!next || prefetched[next.href]) {
+      return;
+    }
+    prefetched[next.href] = fetchPage(next.href);
+    prefetched[next.href].catch(function () { delete prefetched[next.href]; });
+  }
+
+  function show(page) {
+    var doc = new DOMParser().parseFromString(page.html, "text/html");
+    var replacement = doc.querySelector("[data-triage]");
+    if (!replacement) {
+      window.location = page.url;
+      return;
+    }
+    triage.replaceWith(replacement);
+    triage = replacement;
+    enhance(triage);
+    document.title = doc.title;
+    window.history.pushState(null, "", page.url);
+    prefetchNext();
+  }
+
+  function go(url) {
+    var page = prefetched[url] || fetchPage(url);
+    page.then(show, function () { window.location = url; });
+  }
+
+  document.addEventListener("submit", function (ev) {
+    var form = ev.target;
+    if (ev.defaultPrevented || !triage.contains(form)) {
+      return;
+    }
+    ev.preventDefault();
+    // Positions shift once an email is decided on.
+    prefetched = {};
+    fetchPage(form.action, { method: "POST", body: new URLSearchParams(new FormData(form)) })
+      .then(show, function (err) { window.alert("Action failed: " + err.message); });
+  });
+
+  document.addEventListener("keydown", function (ev) {
+    var key = ev.key.toLowerCase();
+    if (ev.ctrlKey || ev.metaKey || ev.altKey || !/^[a-z]$/.test(key) ||
+        /^(INPUT|TEXTAREA|SELECT)$/.test(ev.target.tagName)) {
+      return;
+    }
+    var el = triage.querySelector("[data-key=" + key + "]");
+    if (!el) {
+      return;
+    }
+    ev.preventDefault();
+    if (el.tagName === "FORM") {
+      el.requestSubmit();
+    } else if (el.rel === "next" || el.rel === "prev") {
+      go(el.href);
+    } else {
+      window.location = el.href;
+    }
+  });
+
+  window.addEventListener("popstate", function () {
+    window.location.reload();
+  });
+
+  prefetchNext();
+})();
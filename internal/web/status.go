@@ -0,0 +1,119 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// emailStatuses are the values of GET /api/emails?status=: the statuses of
+// held mail, then the outcomes of mail that is gone and only left its
+// decision.
+var emailStatuses = []string{store.StatusPending, store.StatusScheduled, store.StatusApproved, store.OutcomeRejected, store.OutcomeSent, store.OutcomeBounced}
+
+// statusEmailResponse is an email listed by GET /api/emails?status=. Mail
+// that is no longer held is known only by its decision, which keeps neither
+// its recipients nor its body.
+type statusEmailResponse struct {
+	ID        string   `json:"id"`
+	Status    string   `json:"status"`
+	Direction string   `json:"direction"`
+	From      string   `json:"from"`
+	To        []string `json:"to,omitempty"`
+	Subject   string   `json:"subject"`
+	Snippet   string   `json:"snippet,omitempty"`
+	Queue     string   `json:"queue,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+
+	ReceivedAt  time.Time `json:"received_at,omitzero"`  // held mail only
+	ScheduledAt time.Time `json:"scheduled_at,omitzero"` // scheduled mail only
+	Reviewer    string    `json:"reviewer,omitempty"`    // who approved or rejected it
+	DecidedAt   time.Time `json:"decided_at,omitzero"`   // mail no longer held only
+
+	DeliveryStatus string `json:"delivery_status,omitempty"` // sent and bounced mail whose relay returns DSNs
+	DeliveryDetail string `json:"delivery_detail,omitempty"`
+}
+
+// listEmailsByStatus returns up to limit (0 for all) emails with ?status=,
+// skipping the first offset, and how many there are in all. Unlike fetching
+// approved mail it only reads: nothing it returns is consumed. On failure it
+// writes the error response and returns false.
+func (s *Server) listEmailsByStatus(w http.ResponseWriter, r *http.Request, offset, limit int) ([]statusEmailResponse, int, bool) {
+	ctx := r.Context()
+	v := r.URL.Query()
+	status := v.Get("status")
+	if !slices.Contains(emailStatuses, status) {
+		http.Error(w, "status must be one of "+strings.Join(emailStatuses, ", "), http.StatusBadRequest)
+		return nil, 0, false
+	}
+	if v.Has("wait") || v.Has("after_checkpoint") {
+		http.Error(w, "status cannot be combined with wait or after_checkpoint", http.StatusBadRequest)
+		return nil, 0, false
+	}
+
+	results := []statusEmailResponse{} // return [] not null
+	switch status {
+	case store.OutcomeRejected, store.OutcomeSent, store.OutcomeBounced:
+		if v.Has("queue") || v.Has("tag") {
+			http.Error(w, "queue and tag only filter mail still held", http.StatusBadRequest)
+			return nil, 0, false
+		}
+		decisions, total, err := s.st.ListDecisionPage(ctx, store.DecisionQuery{Outcome: status, Offset: offset, Limit: limit})
+		if err != nil {
+			http.Error(w, "failed to list emails", http.StatusInternalServerError)
+			log.Printf("list %s decisions: %v", status, err)
+			return nil, 0, false
+		}
+		for _, d := range decisions {
+			results = append(results, statusEmailResponse{
+				ID:             d.EmailID,
+				Status:         status,
+				Direction:      d.Direction,
+				From:           d.Sender,
+				Subject:        d.Subject,
+				Reviewer:       d.Reviewer,
+				DecidedAt:      d.DecidedAt,
+				DeliveryStatus: d.DeliveryStatus,
+				DeliveryDetail: d.DeliveryDetail,
+			})
+		}
+		return results, total, true
+	}
+
+	q := store.PendingQuery{Status: status, Queue: v.Get("queue"), Offset: offset, Limit: limit}
+	if t := v.Get("tag"); t != "" {
+		tag, err := store.NormalizeTag(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, 0, false
+		}
+		q.Tag = tag
+	}
+	emails, total, err := s.st.ListPendingPage(ctx, q)
+	if err != nil {
+		http.Error(w, "failed to list emails", http.StatusInternalServerError)
+		log.Printf("list %s emails: %v", status, err)
+		return nil, 0, false
+	}
+	for _, e := range emails {
+		results = append(results, statusEmailResponse{
+			ID:          e.ID,
+			Status:      e.Status,
+			Direction:   e.Direction,
+			From:        e.Sender,
+			To:          e.Recipients,
+			Subject:     e.Subject,
+			Snippet:     e.Snippet,
+			Queue:       e.Queue,
+			Tags:        e.Tags,
+			ReceivedAt:  e.ReceivedAt,
+			ScheduledAt: e.ScheduledAt,
+			Reviewer:    e.ApprovedBy,
+		})
+	}
+	return results, total, true
+}
@@ -0,0 +1,197 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/recipients"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/suppression"
+)
+
+// Audit actions recorded for suppression list changes made on the rules
+// page.
+const (
+	actionSuppressionAdd    = "suppression.add"
+	actionSuppressionDelete = "suppression.delete"
+)
+
+// SetSuppression checks the recipients of outbound mail against l when it is
+// submitted and approved. Suppressed recipients are either refused or have
+// the mail to them held (never sent unreviewed) and flagged.
+func (s *Server) SetSuppression(l *suppression.List) {
+	s.suppress = l
+}
+
+// suppressedFields returns one error per recipient in to that res lists.
+func suppressedFields(to []string, res suppression.Result) []fieldError {
+	var errs []fieldError
+	for i, addr := range to {
+		for _, e := range res.Suppressed {
+			if strings.EqualFold(addr, e.Address) {
+				errs = append(errs, fieldError{Field: fmt.Sprintf("to[%d]", i), Value: addr, Message: "on the suppression list (" + e.Reason + ")"})
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// checkSuppressed refuses to approve outbound email if a recipient is on
+// the suppression list and the action is to refuse. If it refuses, or the
+// check fails, it writes the response and returns false.
+func (s *Server) checkSuppressed(w http.ResponseWriter, r *http.Request, email *store.Email) bool {
+	if email.Direction != store.DirectionOutbound {
+		return true
+	}
+	res, err := s.suppress.Check(r.Context(), email.Recipients)
+	if err != nil {
+		http.Error(w, "failed to check suppression list", http.StatusInternalServerError)
+		log.Printf("approve email %s: %v", email.ID, err)
+		return false
+	}
+	if res.Refuse {
+		http.Error(w, "recipient is on the suppression list: "+res.Addresses(), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// suppressedRecipients returns the entries of email's suppressed recipients
+// to warn about on its detail page.
+func (s *Server) suppressedRecipients(ctx context.Context, email *store.Email) []store.Suppression {
+	if email.Direction != store.DirectionOutbound || email.Status != store.StatusPending {
+		return nil
+	}
+	res, err := s.suppress.Check(ctx, email.Recipients)
+	if err != nil {
+		log.Printf("email %s: %v", email.ID, err)
+	}
+	return res.Suppressed
+}
+
+// validSuppression checks an address and reason to add to the suppression
+// list, returning why they are invalid or "".
+func validSuppression(address, reason string) string {
+	if _, err := recipients.Parse(address); err != nil {
+		return "invalid address: " + err.Error()
+	}
+	switch reason {
+	case store.SuppressionBounced, store.SuppressionComplained, store.SuppressionUnsubscribed:
+		return ""
+	}
+	return `reason must be "bounced", "complained" or "unsubscribed"`
+}
+
+// addSuppression adds the form's address to the suppression list, from the
+// rules page.
+func (s *Server) addSuppression(w http.ResponseWriter, r *http.Request) {
+	address, reason := strings.TrimSpace(r.PostForm.Get("address")), r.PostForm.Get("reason")
+	if msg := validSuppression(address, reason); msg != "" {
+		s.renderRules(w, r, rulesPage{Error: msg})
+		return
+	}
+	reviewer := reviewerName(r)
+	e := store.Suppression{Address: address, Reason: reason, Note: strings.TrimSpace(r.PostForm.Get("note")), CreatedBy: reviewer}
+	if err := s.st.AddSuppression(r.Context(), e); err != nil {
+		http.Error(w, "failed to add suppression", http.StatusInternalServerError)
+		log.Printf("add suppression of %s: %v", address, err)
+		return
+	}
+	s.audit(r, reviewer, actionSuppressionAdd, fmt.Sprintf("%s (%s)", strings.ToLower(address), reason))
+	s.redirect(w, r, "/rules")
+}
+
+// deleteSuppression removes the form's address from the suppression list,
+// from the rules page.
+func (s *Server) deleteSuppression(w http.ResponseWriter, r *http.Request) {
+	address := r.PostForm.Get("address")
+	if err := s.st.DeleteSuppression(r.Context(), address); err != nil {
+		http.Error(w, "suppression not found", http.StatusNotFound)
+		log.Printf("delete suppression: %v", err)
+		return
+	}
+	s.audit(r, reviewerName(r), actionSuppressionDelete, strings.ToLower(address))
+	s.redirect(w, r, "/rules")
+}
+
+type suppressionEntry struct {
+	Address   string    `json:"address"`
+	Reason    string    `json:"reason"` // "bounced" | "complained" | "unsubscribed"
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type setSuppressionRequest struct {
+	Reason string `json:"reason"`
+	Note   string `json:"note"`
+}
+
+func newSuppressionEntry(e store.Suppression) suppressionEntry {
+	return suppressionEntry{Address: e.Address, Reason: e.Reason, Note: e.Note, CreatedBy: e.CreatedBy, CreatedAt: e.CreatedAt}
+}
+
+func (s *Server) handleAPIListSuppressions(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listSuppressions(w, r); ok {
+		writeJSON(w, resp)
+	}
+}
+
+func (s *Server) handleAPIListSuppressionsV2(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listSuppressions(w, r); ok {
+		paginate(w, r, resp)
+	}
+}
+
+// listSuppressions returns every suppression list entry. On failure it
+// writes the error response and returns false.
+func (s *Server) listSuppressions(w http.ResponseWriter, r *http.Request) ([]suppressionEntry, bool) {
+	list, err := s.st.ListSuppressions(r.Context())
+	if err != nil {
+		http.Error(w, "failed to list suppressions", http.StatusInternalServerError)
+		log.Printf("list suppressions: %v", err)
+		return nil, false
+	}
+	resp := make([]suppressionEntry, 0, len(list))
+	for _, e := range list {
+		resp = append(resp, newSuppressionEntry(e))
+	}
+	return resp, true
+}
+
+func (s *Server) handleAPISetSuppression(w http.ResponseWriter, r *http.Request) {
+	address := strings.ToLower(r.PathValue("address"))
+	var req setSuppressionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if msg := validSuppression(address, req.Reason); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	e := store.Suppression{Address: address, Reason: req.Reason, Note: req.Note, CreatedBy: apiActor(r), CreatedAt: time.Now().UTC()}
+	if err := s.st.AddSuppression(r.Context(), e); err != nil {
+		http.Error(w, "failed to save suppression", http.StatusInternalServerError)
+		log.Printf("add suppression of %s: %v", address, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newSuppressionEntry(e)); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
+
+func (s *Server) handleAPIDeleteSuppression(w http.ResponseWriter, r *http.Request) {
+	if err := s.st.DeleteSuppression(r.Context(), r.PathValue("address")); err != nil {
+		http.Error(w, "suppression not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,190 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// sharedTemplates are parsed into every page: the layout and reusable partials.
+// Every other *.html file is a page, rendered by its file name.
+var sharedTemplates = []string{"layout.html", "partials.html"}
+
+// templateSet holds the parsed UI pages. Templates are always read from the
+// embedded defaults first; if a directory is configured, any *.html files in it
+// replace embedded templates of the same name.
+type templateSet struct {
+	funcs template.FuncMap
+	dir   string // empty means embedded templates only
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+
+	watcher *fsnotify.Watcher
+}
+
+func newTemplateSet(funcs template.FuncMap) *templateSet {
+	ts := &templateSet{funcs: funcs}
+	pages, err := ts.parse("")
+	if err != nil {
+		panic(err)
+	}
+	ts.pages = pages
+	return ts
+}
+
+// parse builds one template tree per page from the embedded templates
+// overlaid with the *.html files in dir (if non-empty).
+func (ts *templateSet) parse(dir string) (map[string]*template.Template, error) {
+	sources := make(map[string]string)
+	embedded, err := fs.Glob(templateFS, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("list embedded templates: %w", err)
+	}
+	for _, file := range embedded {
+		data, err := fs.ReadFile(templateFS, file)
+		if err != nil {
+			return nil, fmt.Errorf("read embedded template %s: %w", file, err)
+		}
+		sources[path.Base(file)] = string(data)
+	}
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+		if err != nil {
+			return nil, fmt.Errorf("list templates in %s: %w", dir, err)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("read template %s: %w", file, err)
+			}
+			sources[filepath.Base(file)] = string(data)
+		}
+	}
+
+	base := template.New("").Funcs(ts.funcs)
+	for _, name := range sharedTemplates {
+		if _, err := base.New(name).Parse(sources[name]); err != nil {
+			return nil, fmt.Errorf("parse template %s: %w", name, err)
+		}
+		delete(sources, name)
+	}
+
+	pages := make(map[string]*template.Template, len(sources))
+	for name, src := range sources {
+		page, err := base.Clone()
+		if err != nil {
+			return nil, fmt.Errorf("clone base template: %w", err)
+		}
+		if _, err := page.New(name).Parse(src); err != nil {
+			return nil, fmt.Errorf("parse template %s: %w", name, err)
+		}
+		pages[name] = page
+	}
+	return pages, nil
+}
+
+// useDir switches to loading templates from dir and watches it for changes.
+// A template that later fails to parse is logged and the previous set is kept.
+func (ts *templateSet) useDir(dir string) error {
+	pages, err := ts.parse(dir)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create template watcher: %w", err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("watch %s: %w", dir, err)
+	}
+
+	ts.mu.Lock()
+	ts.dir = dir
+	ts.pages = pages
+	ts.watcher = watcher
+	ts.mu.Unlock()
+
+	go ts.watch(watcher)
+	return nil
+}
+
+// watch reloads templates whenever a file in the directory changes. Events are
+// debounced briefly because editors often write a file in several steps.
+func (ts *templateSet) watch(watcher *fsnotify.Watcher) {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if strings.HasSuffix(ev.Name, ".html") {
+				debounce = time.After(100 * time.Millisecond)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("template watcher: %v", err)
+		case <-debounce:
+			debounce = nil
+			ts.reload()
+		}
+	}
+}
+
+func (ts *templateSet) reload() {
+	ts.mu.RLock()
+	dir := ts.dir
+	ts.mu.RUnlock()
+
+	pages, err := ts.parse(dir)
+	if err != nil {
+		log.Printf("reload templates from %s (keeping previous): %v", dir, err)
+		return
+	}
+	ts.mu.Lock()
+	ts.pages = pages
+	ts.mu.Unlock()
+	log.Printf("Reloaded templates from %s", dir)
+}
+
+// execute renders the page called name (its file name, e.g. "index.html"),
+// with funcs replacing the functions of the same name for this rendering
+// only. The parsed pages are cloned, never executed, so they stay clonable.
+func (ts *templateSet) execute(w io.Writer, name string, data any, funcs template.FuncMap) error {
+	ts.mu.RLock()
+	page, ok := ts.pages[name]
+	ts.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %s not found", name)
+	}
+	page, err := page.Clone()
+	if err != nil {
+		return fmt.Errorf("clone template %s: %w", name, err)
+	}
+	return page.Funcs(funcs).ExecuteTemplate(w, name, data)
+}
+
+func (ts *templateSet) close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.watcher == nil {
+		return nil
+	}
+	err := ts.watcher.Close()
+	ts.watcher = nil
+	return err
+}
@@ -0,0 +1,126 @@
+package web
+
+import (
+	"html/template"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/i18n"
+)
+
+func testFuncs() template.FuncMap {
+	funcs := template.FuncMap{"join": strings.Join, "duration": formatDuration, "url": func(p string) string { return p }, "size": formatSize}
+	maps.Copy(funcs, locale{lang: i18n.Default, loc: time.UTC}.funcs())
+	return funcs
+}
+
+func renderTemplate(t *testing.T, ts *templateSet, name string, data any) string {
+	t.Helper()
+	var sb strings.Builder
+	if err := ts.execute(&sb, name, data, nil); err != nil {
+		t.Fatalf("execute %s: %v", name, err)
+	}
+	return sb.String()
+}
+
+func TestTemplateDirOverridesAndFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("custom index v1"), 0o644); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	ts := newTemplateSet(testFuncs())
+	if err := ts.useDir(dir); err != nil {
+		t.Fatalf("use dir: %v", err)
+	}
+	t.Cleanup(func() { ts.close() })
+
+	if got := renderTemplate(t, ts, "index.html", nil); got != "custom index v1" {
+		t.Errorf("index.html = %q, want custom override", got)
+	}
+	// stats.html is not in dir, so the embedded template is used.
+	if got := renderTemplate(t, ts, "stats.html", nil); !strings.Contains(got, "mailescrow — stats") {
+		t.Errorf("stats.html should fall back to embedded template, got %q", got)
+	}
+
+	// Editing the file is picked up without a restart.
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("custom index v2"), 0o644); err != nil {
+		t.Fatalf("rewrite template: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for renderTemplate(t, ts, "index.html", nil) != "custom index v2" {
+		if time.Now().After(deadline) {
+			t.Fatal("template was not reloaded after change")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A broken edit keeps the last good template.
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("{{if}"), 0o644); err != nil {
+		t.Fatalf("rewrite template: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if got := renderTemplate(t, ts, "index.html", nil); got != "custom index v2" {
+		t.Errorf("index.html after broken edit = %q, want previous version", got)
+	}
+}
+
+func TestTemplateDirInvalidTemplateFails(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("{{if}"), 0o644); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	ts := newTemplateSet(testFuncs())
+	if err := ts.useDir(dir); err == nil {
+		ts.close()
+		t.Fatal("expected error for invalid template")
+	}
+}
+
+func TestTemplatesTranslated(t *testing.T) {
+	files, err := fs.Glob(templateFS, "templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages picked at run time, such as {{t .Status}}.
+	msgs := []string{"pending", "approved", "rejected", "forwarded", "valid", "untrusted", "invalid",
+		"requested", "delivered", "relayed", "delayed", "failed", "active", "expired", "revoked", "scheduled"}
+	literal := regexp.MustCompile(`\bt "((?:[^"\\]|\\.)*)"`)
+	for _, file := range files {
+		src, err := fs.ReadFile(templateFS, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range literal.FindAllStringSubmatch(string(src), -1) {
+			msgs = append(msgs, m[1])
+		}
+	}
+	for _, lang := range i18n.Languages() {
+		for _, msg := range msgs {
+			if !i18n.Has(lang, msg) {
+				t.Errorf("%s: no translation for %q", lang, msg)
+			}
+		}
+	}
+}
+
+func TestLocaleFuncs(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := locale{lang: "de", loc: berlin}.funcs()
+	at := time.Date(2026, 7, 1, 12, 30, 0, 0, time.UTC)
+	if got := funcs["datetime"].(func(time.Time) string)(at); got != "2026-07-01 14:30:00 CEST" {
+		t.Errorf("datetime = %q", got)
+	}
+	if got := funcs["t"].(func(string, ...any) string)("%d of %d pending", 1, 2); got != "1 von 2 ausstehend" {
+		t.Errorf("t = %q", got)
+	}
+}
@@ -0,0 +1,272 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/tokens"
+)
+
+// auditLimit is the number of audit entries shown on the tokens page.
+const auditLimit = 50
+
+// Token states shown in the UI and API.
+const (
+	tokenActive  = "active"
+	tokenExpired = "expired"
+	tokenRevoked = "revoked"
+)
+
+// SetTokens enables API tokens. When require is true every API request other
+// than /metrics and /healthz must carry a token with the right scope; otherwise
+// requests without a token are still accepted. The token management API
+// always requires an admin token.
+func (s *Server) SetTokens(m *tokens.Manager, require bool) {
+	s.tokens = m
+	s.requireAPIToken = require
+}
+
+// tokenKey is the request context key of the authenticated *store.APIToken.
+type tokenKey struct{}
+
+// apiAuth wraps an API handler with bearer token authentication for scope.
+func (s *Server) apiAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.tokens == nil && scope == tokens.ScopeAdmin {
+			http.Error(w, "API tokens are not enabled", http.StatusNotFound)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			if s.tokens != nil && (s.requireAPIToken || scope == tokens.ScopeAdmin) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="mailescrow"`)
+				http.Error(w, "API token required", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+			return
+		}
+		if s.tokens == nil {
+			http.Error(w, "API tokens are not enabled", http.StatusUnauthorized)
+			return
+		}
+		t, err := s.tokens.Authenticate(r.Context(), strings.TrimSpace(token), scope, r.Method+" "+r.URL.Path)
+		switch {
+		case errors.Is(err, tokens.ErrInvalid):
+			log.Printf("API auth with an invalid token from %s", remoteIP(r.RemoteAddr))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mailescrow", error="invalid_token"`)
+			http.Error(w, "invalid API token", http.StatusUnauthorized)
+		case errors.Is(err, tokens.ErrForbidden):
+			http.Error(w, "API token lacks the "+scope+" scope", http.StatusForbidden)
+		case err != nil:
+			http.Error(w, "failed to check API token", http.StatusInternalServerError)
+			log.Printf("authenticate API token: %v", err)
+		default:
+			next(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, t)))
+		}
+	}
+}
+
+// tokenStatus reports whether t is active, expired or revoked.
+func tokenStatus(t store.APIToken, now time.Time) string {
+	switch {
+	case !t.RevokedAt.IsZero():
+		return tokenRevoked
+	case !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt):
+		return tokenExpired
+	}
+	return tokenActive
+}
+
+type tokenView struct {
+	store.APIToken
+	Status string
+}
+
+type tokensPage struct {
+	Tokens   []tokenView
+	Scopes   []string
+	NewToken string // plaintext of a token just created; shown once
+	Error    string
+	Audit    []store.AuditEntry
+}
+
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	s.renderTokens(w, r, tokensPage{})
+}
+
+func (s *Server) renderTokens(w http.ResponseWriter, r *http.Request, page tokensPage) {
+	if s.tokens == nil {
+		http.NotFound(w, r)
+		return
+	}
+	list, err := s.tokens.List(r.Context())
+	if err != nil {
+		http.Error(w, "failed to load tokens", http.StatusInternalServerError)
+		log.Printf("list API tokens: %v", err)
+		return
+	}
+	audit, err := s.st.ListAudit(r.Context(), auditLimit)
+	if err != nil {
+		http.Error(w, "failed to load tokens", http.StatusInternalServerError)
+		log.Printf("list audit log: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, t := range list {
+		page.Tokens = append(page.Tokens, tokenView{APIToken: t, Status: tokenStatus(t, now)})
+	}
+	page.Scopes = tokens.Scopes
+	page.Audit = audit
+	s.render(w, r, "tokens.html", page)
+}
+
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if days := r.PostForm.Get("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			s.renderTokens(w, r, tokensPage{Error: "expiry must be a number of days"})
+			return
+		}
+		ttl = time.Duration(n) * 24 * time.Hour
+	}
+	plaintext, _, err := s.tokens.CreateForProject(r.Context(), r.PostForm.Get("name"), r.PostForm.Get("project"), r.PostForm["scope"], ttl, reviewerName(r))
+	if err != nil {
+		s.renderTokens(w, r, tokensPage{Error: err.Error()})
+		return
+	}
+	s.renderTokens(w, r, tokensPage{NewToken: plaintext})
+}
+
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if s.tokens == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.tokens.Revoke(r.Context(), r.PathValue("id"), reviewerName(r)); err != nil {
+		http.Error(w, "token not found", http.StatusNotFound)
+		log.Printf("revoke API token: %v", err)
+		return
+	}
+	s.redirect(w, r, "/tokens")
+}
+
+type apiTokenResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Project    string     `json:"project,omitempty"`
+	Status     string     `json:"status"`          // "active" | "expired" | "revoked"
+	Token      string     `json:"token,omitempty"` // plaintext, only in the response to creation
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func newAPITokenResponse(t store.APIToken, now time.Time) apiTokenResponse {
+	resp := apiTokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		Project:   t.Project,
+		Status:    tokenStatus(t, now),
+		CreatedBy: t.CreatedBy,
+		CreatedAt: t.CreatedAt,
+	}
+	if !t.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &t.ExpiresAt
+	}
+	if !t.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &t.LastUsedAt
+	}
+	return resp
+}
+
+type createTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	Project       string   `json:"project"`         // tag and project limits of the mail the token submits; optional
+	ExpiresInDays int      `json:"expires_in_days"` // 0 means the token never expires
+}
+
+// apiActor names the caller of an API request for the audit log.
+func apiActor(r *http.Request) string {
+	if t, ok := r.Context().Value(tokenKey{}).(*store.APIToken); ok {
+		return tokens.Actor(t)
+	}
+	return "api"
+}
+
+func (s *Server) handleAPIListTokens(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listAPITokens(w, r); ok {
+		writeJSON(w, resp)
+	}
+}
+
+func (s *Server) handleAPIListTokensV2(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listAPITokens(w, r); ok {
+		paginate(w, r, resp)
+	}
+}
+
+// listAPITokens returns every token. On failure it writes the error response
+// and returns false.
+func (s *Server) listAPITokens(w http.ResponseWriter, r *http.Request) ([]apiTokenResponse, bool) {
+	list, err := s.tokens.List(r.Context())
+	if err != nil {
+		http.Error(w, "failed to list tokens", http.StatusInternalServerError)
+		log.Printf("list API tokens: %v", err)
+		return nil, false
+	}
+	now := time.Now()
+	resp := make([]apiTokenResponse, 0, len(list))
+	for _, t := range list {
+		resp = append(resp, newAPITokenResponse(t, now))
+	}
+	return resp, true
+}
+
+func (s *Server) handleAPICreateToken(w http.ResponseWriter, r *http.Request) {
+	var req createTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	plaintext, t, err := s.tokens.CreateForProject(r.Context(), req.Name, req.Project, req.Scopes, time.Duration(req.ExpiresInDays)*24*time.Hour, apiActor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := newAPITokenResponse(*t, time.Now())
+	resp.Token = plaintext
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
+
+func (s *Server) handleAPIRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := s.tokens.Revoke(r.Context(), r.PathValue("id"), apiActor(r)); err != nil {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Audit actions recorded for unsubscribe links.
+const (
+	actionUnsubscribe = "recipient.unsubscribe"
+	actionResubscribe = "recipient.resubscribe"
+)
+
+// unsubscribePage is the data of the public unsubscribe page. Done is set
+// once the recipient has opted out.
+type unsubscribePage struct {
+	Token string
+	Done  bool
+}
+
+// handleUnsubscribePage asks the holder of an unsubscribe link to confirm.
+// Opting out takes a POST so that link scanners following the URL in the
+// List-Unsubscribe header cannot opt anyone out.
+func (s *Server) handleUnsubscribePage(w http.ResponseWriter, r *http.Request) {
+	unsubscribeHeaders(w)
+	s.render(w, r, "unsubscribe.html", unsubscribePage{Token: r.PathValue("token")})
+}
+
+// handleUnsubscribe records an opt-out, either from a mail client's one-click
+// unsubscribe (RFC 8058) or from the confirmation form. The token in the URL
+// is the only credential. Opting out again is harmless.
+func (s *Server) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	unsubscribeHeaders(w)
+	link, err := s.st.Unsubscribe(r.Context(), r.PathValue("token"), time.Now().UTC())
+	if err != nil {
+		http.Error(w, "failed to unsubscribe", http.StatusInternalServerError)
+		log.Printf("unsubscribe: %v", err)
+		return
+	}
+	if link == nil {
+		http.Error(w, "unsubscribe link not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Unsubscribed: %s opted out via email %s", link.Address, link.EmailID)
+	s.audit(r, "recipient:"+link.Address, actionUnsubscribe, "email "+link.EmailID)
+	s.render(w, r, "unsubscribe.html", unsubscribePage{Done: true})
+}
+
+// unsubscribeHeaders keeps the public unsubscribe pages out of caches and
+// search indexes.
+func unsubscribeHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Robots-Tag", "noindex")
+}
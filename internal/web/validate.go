@@ -0,0 +1,56 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MaxRecipients bounds the recipients of an email submitted through the API,
+// as smtp.max_recipients does by default for SMTP.
+const MaxRecipients = 100
+
+// MaxBodyBytes bounds each of body and html_body on POST /api/emails.
+const MaxBodyBytes = 10 << 20
+
+// validateEmail checks a JSON submission and formats its extra headers. It
+// returns one error per invalid field, so a client can fix them all at once:
+// a missing or multi-line subject, missing recipients or too many of them,
+// recipients refused by s.recipients, oversized bodies and headers that
+// cannot be added. Recipients are checked one by one only if there are not
+// too many, as their domains may be looked up.
+func (s *Server) validateEmail(ctx context.Context, req createEmailRequest) (string, []fieldError) {
+	var errs []fieldError
+	if len(req.To) == 0 {
+		errs = append(errs, fieldError{Field: "to", Message: "at least one recipient is required"})
+	} else if tooMany := checkRecipientCount(req.To); tooMany != nil {
+		errs = append(errs, tooMany...)
+	} else {
+		errs = append(errs, s.checkRecipients(ctx, req.To)...)
+	}
+	switch {
+	case strings.TrimSpace(req.Subject) == "":
+		errs = append(errs, fieldError{Field: "subject", Message: "subject is required"})
+	case strings.ContainsAny(req.Subject, "\r\n"):
+		errs = append(errs, fieldError{Field: "subject", Value: req.Subject, Message: "subject must be a single line"})
+	}
+	for _, f := range []struct{ name, value string }{{"body", req.Body}, {"html_body", req.HTMLBody}} {
+		if len(f.value) > MaxBodyBytes {
+			errs = append(errs, fieldError{Field: f.name, Message: fmt.Sprintf("%d bytes, at most %d are allowed", len(f.value), MaxBodyBytes)})
+		}
+	}
+	extraHeaders, err := formatExtraHeaders(req.Headers)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "headers", Message: err.Error()})
+	}
+	return extraHeaders, errs
+}
+
+// checkRecipientCount returns an error if to has more than MaxRecipients
+// addresses.
+func checkRecipientCount(to []string) []fieldError {
+	if len(to) <= MaxRecipients {
+		return nil
+	}
+	return []fieldError{{Field: "to", Message: fmt.Sprintf("%d recipients, at most %d are allowed", len(to), MaxRecipients)}}
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateEmail(t *testing.T) {
+	s := &Server{}
+	tooMany := make([]string, MaxRecipients+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		req    createEmailRequest
+		fields []string
+	}{
+		{"valid", createEmailRequest{To: []string{"bob@example.com"}, Subject: "Hi", Body: "hi"}, nil},
+		{"html only", createEmailRequest{To: []string{"bob@example.com"}, Subject: "Hi", HTMLBody: "<p>hi</p>"}, nil},
+		{"missing everything", createEmailRequest{}, []string{"to", "subject"}},
+		{"blank subject", createEmailRequest{To: []string{"bob@example.com"}, Subject: "  "}, []string{"subject"}},
+		{"multi-line subject", createEmailRequest{To: []string{"bob@example.com"}, Subject: "Hi\r\nBcc: eve@example.com"}, []string{"subject"}},
+		{"bad addresses", createEmailRequest{To: []string{"bob@example.com", "Carol <carol@example.com>", "dave@"}, Subject: "Hi"}, []string{"to[1]", "to[2]"}},
+		{"too many recipients", createEmailRequest{To: tooMany, Subject: "Hi"}, []string{"to"}},
+		{"oversized bodies", createEmailRequest{To: []string{"bob@example.com"}, Subject: "Hi", Body: strings.Repeat("a", MaxBodyBytes+1), HTMLBody: strings.Repeat("a", MaxBodyBytes+1)}, []string{"body", "html_body"}},
+		{"refused header", createEmailRequest{To: []string{"bob@example.com"}, Subject: "Hi", Headers: map[string]string{"Bcc": "eve@example.com"}}, []string{"headers"}},
+		{"all at once", createEmailRequest{To: []string{"bob"}, Body: strings.Repeat("a", MaxBodyBytes+1), Headers: map[string]string{"From": "eve@example.com"}}, []string{"to[0]", "subject", "body", "headers"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs := s.validateEmail(t.Context(), tt.req)
+			var fields []string
+			for _, e := range errs {
+				if e.Message == "" {
+					t.Errorf("%s: no message", e.Field)
+				}
+				if len(e.Value) > 1000 {
+					t.Errorf("%s: value of %d bytes echoed", e.Field, len(e.Value))
+				}
+				fields = append(fields, e.Field)
+			}
+			if !slices.Equal(fields, tt.fields) {
+				t.Errorf("fields = %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+
+	headers, errs := s.validateEmail(t.Context(), createEmailRequest{To: []string{"bob@example.com"}, Subject: "Hi", Headers: map[string]string{"X-Campaign-Id": "spring"}})
+	if len(errs) != 0 || headers != "X-Campaign-Id: spring\r\n" {
+		t.Errorf("headers = %q, errors %v", headers, errs)
+	}
+}
@@ -0,0 +1,184 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/webhooks"
+)
+
+// deliveryHistory is how many of a webhook's most recent deliveries the API
+// returns.
+const deliveryHistory = maxPageLimit
+
+// SetWebhooks lets API tokens register webhooks through m. Without it the
+// webhook API answers 404.
+func (s *Server) SetWebhooks(m *webhooks.Manager) {
+	s.webhooks = m
+}
+
+type webhookResponse struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`              // empty means every event
+	Direction string    `json:"direction,omitempty"` // empty means both
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookResponse(w store.Webhook) webhookResponse {
+	events := w.Events
+	if events == nil {
+		events = []string{}
+	}
+	return webhookResponse{ID: w.ID, URL: w.URL, Events: events, Direction: w.Direction, CreatedAt: w.CreatedAt}
+}
+
+type deliveryResponse struct {
+	ID           string    `json:"id"`
+	Event        string    `json:"event"`
+	EmailID      string    `json:"email_id,omitempty"`
+	Status       string    `json:"status"` // "pending" | "succeeded" | "failed"
+	Attempts     int       `json:"attempts"`
+	ResponseCode int       `json:"response_code,omitempty"` // absent if no response was received
+	LastError    string    `json:"last_error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type createWebhookRequest struct {
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`    // empty means every event
+	Direction string   `json:"direction"` // "inbound" | "outbound"; empty means both
+}
+
+// webhookToken returns the token of a webhook API request, which owns the
+// webhooks it manages. Without one, or without webhooks, it writes the error
+// response and returns false.
+func (s *Server) webhookToken(w http.ResponseWriter, r *http.Request) (*store.APIToken, bool) {
+	if s.webhooks == nil || s.tokens == nil {
+		http.Error(w, "webhooks are not enabled", http.StatusNotFound)
+		return nil, false
+	}
+	t, ok := r.Context().Value(tokenKey{}).(*store.APIToken)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mailescrow"`)
+		http.Error(w, "webhooks belong to an API token; send one", http.StatusUnauthorized)
+		return nil, false
+	}
+	return t, true
+}
+
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listWebhooks(w, r); ok {
+		writeJSON(w, resp)
+	}
+}
+
+func (s *Server) handleListWebhooksV2(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listWebhooks(w, r); ok {
+		paginate(w, r, resp)
+	}
+}
+
+// listWebhooks returns the webhooks of the request's token. On failure it
+// writes the error response and returns false.
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) ([]webhookResponse, bool) {
+	t, ok := s.webhookToken(w, r)
+	if !ok {
+		return nil, false
+	}
+	list, err := s.webhooks.List(r.Context(), t)
+	if err != nil {
+		http.Error(w, "failed to list webhooks", http.StatusInternalServerError)
+		log.Printf("list webhooks: %v", err)
+		return nil, false
+	}
+	resp := make([]webhookResponse, 0, len(list))
+	for _, wh := range list {
+		resp = append(resp, newWebhookResponse(wh))
+	}
+	return resp, true
+}
+
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.webhookToken(w, r)
+	if !ok {
+		return
+	}
+	var req createWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	wh, err := s.webhooks.Create(r.Context(), t, req.URL, req.Events, req.Direction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(newWebhookResponse(*wh)); err != nil {
+		log.Printf("encode response: %v", err)
+	}
+}
+
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.webhookToken(w, r)
+	if !ok {
+		return
+	}
+	err := s.webhooks.Delete(r.Context(), t, r.PathValue("id"))
+	switch {
+	case errors.Is(err, webhooks.ErrNotFound):
+		http.Error(w, "webhook not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "failed to delete webhook", http.StatusInternalServerError)
+		log.Printf("delete webhook: %v", err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listDeliveries(w, r); ok {
+		writeJSON(w, resp)
+	}
+}
+
+func (s *Server) handleListDeliveriesV2(w http.ResponseWriter, r *http.Request) {
+	if resp, ok := s.listDeliveries(w, r); ok {
+		paginate(w, r, resp)
+	}
+}
+
+// listDeliveries returns the most recent deliveries to a webhook of the
+// request's token, newest first. On failure it writes the error response and
+// returns false.
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request) ([]deliveryResponse, bool) {
+	t, ok := s.webhookToken(w, r)
+	if !ok {
+		return nil, false
+	}
+	list, err := s.webhooks.Deliveries(r.Context(), t, r.PathValue("id"), deliveryHistory)
+	if errors.Is(err, webhooks.ErrNotFound) {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "failed to list deliveries", http.StatusInternalServerError)
+		log.Printf("list webhook deliveries: %v", err)
+		return nil, false
+	}
+	resp := make([]deliveryResponse, 0, len(list))
+	for _, d := range list {
+		resp = append(resp, deliveryResponse{
+			ID: d.ID, Event: d.Event, EmailID: d.EmailID, Status: d.Status, Attempts: d.Attempts,
+			ResponseCode: d.ResponseCode, LastError: d.LastError, CreatedAt: d.CreatedAt, UpdatedAt: d.UpdatedAt,
+		})
+	}
+	return resp, true
+}
@@ -0,0 +1,348 @@
+// Package webhooks lets API tokens register their own webhooks for decisions
+// on held emails, filtered by event type and direction. Every event sent to
+// a webhook is a delivery, run as a job so failures are retried, whose
+// response code and attempts are kept for the token to inspect.
+//
+// Unless allowed with SetAllowPrivate, webhooks may not post to loopback,
+// private or link-local addresses, so a token cannot make mailescrow reach
+// services only it can: the host is checked when a webhook is registered,
+// and the address actually connected to on every delivery.
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+	"github.com/albert/mailescrow/internal/tokens"
+)
+
+// Event types a webhook may subscribe to.
+const (
+	EventApproved  = "email_approved"
+	EventRejected  = "email_rejected"
+	EventForwarded = "email_forwarded"
+)
+
+// Events lists all event types in display order.
+var Events = []string{EventApproved, EventRejected, EventForwarded}
+
+// Audit actions recorded for webhook management.
+const (
+	ActionCreate = "webhook.create"
+	ActionDelete = "webhook.delete"
+)
+
+// ErrNotFound is returned for a webhook that does not exist or belongs to
+// another token.
+var ErrNotFound = errors.New("webhook not found")
+
+// Manager registers webhooks and delivers events to them through a job
+// queue.
+type Manager struct {
+	st           store.ReadWriter
+	q            *jobs.Queue
+	allowPrivate bool // see SetAllowPrivate
+	lookup       func(ctx context.Context, host string) ([]netip.Addr, error)
+	now          func() time.Time
+}
+
+// New creates a Manager backed by st that delivers through q, registering
+// its handler for jobs.KindDelivery.
+func New(st store.ReadWriter, q *jobs.Queue) *Manager {
+	m := &Manager{st: st, q: q, lookup: lookupHost, now: time.Now}
+	q.Handle(jobs.KindDelivery, m.runDelivery)
+	return m
+}
+
+// SetAllowPrivate lets webhooks post to loopback, private and link-local
+// addresses, e.g. to a consumer on the same host or network.
+func (m *Manager) SetAllowPrivate(allow bool) {
+	m.allowPrivate = allow
+}
+
+// Create registers a webhook posting the given event types (all if empty)
+// about emails in direction (both if empty) to rawURL, owned by token t.
+func (m *Manager) Create(ctx context.Context, t *store.APIToken, rawURL string, events []string, direction string) (*store.Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q must be an absolute http or https URL", rawURL)
+	}
+	if err := m.checkHost(ctx, u.Hostname()); err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		if !slices.Contains(Events, e) {
+			return nil, fmt.Errorf("unknown event %q", e)
+		}
+	}
+	if direction != "" && direction != store.DirectionInbound && direction != store.DirectionOutbound {
+		return nil, fmt.Errorf("direction %q (want %s or %s)", direction, store.DirectionInbound, store.DirectionOutbound)
+	}
+
+	w := &store.Webhook{TokenID: t.ID, URL: rawURL, Events: events, Direction: direction, CreatedAt: m.now().UTC()}
+	id, err := m.st.CreateWebhook(ctx, *w)
+	if err != nil {
+		return nil, err
+	}
+	w.ID = id
+	m.audit(ctx, tokens.Actor(t), ActionCreate, fmt.Sprintf("%s (%s)", rawURL, id))
+	return w, nil
+}
+
+// checkHost refuses a webhook host that is, or resolves to, an internal
+// address, unless those are allowed.
+func (m *Manager) checkHost(ctx context.Context, host string) error {
+	if m.allowPrivate {
+		return nil
+	}
+	addrs, err := m.lookup(ctx, host)
+	if err != nil {
+		return fmt.Errorf("resolve url host %s: %w", host, err)
+	}
+	for _, a := range addrs {
+		if isInternal(a) {
+			return fmt.Errorf("url host %s is an internal address (%s)", host, a.Unmap())
+		}
+	}
+	return nil
+}
+
+// lookupHost returns the addresses of host, a name or an IP address.
+func lookupHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	if a, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{a}, nil
+	}
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// isInternal reports whether a is an address webhooks may not post to
+// unless allowed: loopback, private, link-local, unspecified or multicast.
+func isInternal(a netip.Addr) bool {
+	a = a.Unmap()
+	return a.IsLoopback() || a.IsPrivate() || a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast() ||
+		a.IsInterfaceLocalMulticast() || a.IsMulticast() || a.IsUnspecified()
+}
+
+// publicClient posts to webhooks when internal addresses are not allowed. It
+// connects directly, never through a proxy, and refuses internal addresses
+// however the host resolves at delivery time, redirects included.
+var publicClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				ap, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				if isInternal(ap.Addr()) {
+					return fmt.Errorf("refusing to connect to internal address %s", ap.Addr().Unmap())
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+	},
+}
+
+// List returns the webhooks of token t, oldest first.
+func (m *Manager) List(ctx context.Context, t *store.APIToken) ([]store.Webhook, error) {
+	return m.st.ListWebhooks(ctx, t.ID)
+}
+
+// Get returns webhook id if token t owns it, or ErrNotFound.
+func (m *Manager) Get(ctx context.Context, t *store.APIToken, id string) (*store.Webhook, error) {
+	w, err := m.st.GetWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if w == nil || w.TokenID != t.ID {
+		return nil, ErrNotFound
+	}
+	return w, nil
+}
+
+// Delete deletes webhook id and its deliveries if token t owns it, or
+// returns ErrNotFound. Deliveries still queued are dropped.
+func (m *Manager) Delete(ctx context.Context, t *store.APIToken, id string) error {
+	if _, err := m.Get(ctx, t, id); err != nil {
+		return err
+	}
+	if err := m.st.DeleteWebhook(ctx, id); err != nil {
+		return err
+	}
+	m.audit(ctx, tokens.Actor(t), ActionDelete, id)
+	return nil
+}
+
+// Deliveries returns the most recent deliveries to webhook id, newest
+// first, up to limit, if token t owns it, or ErrNotFound.
+func (m *Manager) Deliveries(ctx context.Context, t *store.APIToken, id string, limit int) ([]store.WebhookDelivery, error) {
+	if _, err := m.Get(ctx, t, id); err != nil {
+		return nil, err
+	}
+	return m.st.ListWebhookDeliveries(ctx, id, limit)
+}
+
+// deliveryJob is the payload of a jobs.KindDelivery job.
+type deliveryJob struct {
+	DeliveryID string       `json:"delivery_id"`
+	WebhookID  string       `json:"webhook_id"`
+	Event      notify.Event `json:"event"`
+}
+
+// Publish queues e for every webhook subscribed to it whose token is still
+// active. A webhook that cannot be queued is logged and skipped.
+func (m *Manager) Publish(ctx context.Context, e notify.Event) error {
+	webhooks, err := m.st.ListWebhooks(ctx, "")
+	if err != nil {
+		return fmt.Errorf("list webhooks: %w", err)
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+	list, err := m.st.ListAPITokens(ctx)
+	if err != nil {
+		return fmt.Errorf("list API tokens: %w", err)
+	}
+	now := m.now()
+	active := make(map[string]bool, len(list))
+	for _, t := range list {
+		active[t.ID] = t.RevokedAt.IsZero() && (t.ExpiresAt.IsZero() || now.Before(t.ExpiresAt))
+	}
+	if e.Time.IsZero() {
+		e.Time = now.UTC()
+	}
+
+	for _, w := range webhooks {
+		if !active[w.TokenID] || !subscribed(w, e) {
+			continue
+		}
+		id, err := m.st.AddWebhookDelivery(ctx, store.WebhookDelivery{
+			WebhookID: w.ID, Event: e.Type, EmailID: e.EmailID, Status: store.WebhookPending, CreatedAt: now.UTC(),
+		})
+		if err != nil {
+			log.Printf("queue %s for webhook %s: %v", e.Type, w.ID, err)
+			continue
+		}
+		// Scheduled rather than added, so a slow endpoint never holds up
+		// the decision that caused the event.
+		if err := m.q.Schedule(ctx, jobs.KindDelivery, e.EmailID, deliveryJob{DeliveryID: id, WebhookID: w.ID, Event: e}, now); err != nil {
+			log.Printf("queue %s for webhook %s: %v", e.Type, w.ID, err)
+		}
+	}
+	return nil
+}
+
+// subscribed reports whether w takes e.
+func subscribed(w store.Webhook, e notify.Event) bool {
+	if len(w.Events) > 0 && !slices.Contains(w.Events, e.Type) {
+		return false
+	}
+	return w.Direction == "" || w.Direction == e.Direction
+}
+
+// runDelivery posts a delivery's event and records the outcome on it.
+// Deliveries to webhooks deleted since they were queued are dropped.
+func (m *Manager) runDelivery(ctx context.Context, job store.Job) error {
+	var p deliveryJob
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return fmt.Errorf("unmarshal payload: %w", err)
+	}
+	w, err := m.st.GetWebhook(ctx, p.WebhookID)
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		return nil
+	}
+
+	wh := notify.NewWebhook(w.URL)
+	if !m.allowPrivate {
+		wh.SetClient(publicClient)
+	}
+	wh.SetSecret(m.q.WebhookSecret())
+	code, postErr := wh.Deliver(ctx, p.Event)
+
+	d := store.WebhookDelivery{ID: p.DeliveryID, Status: store.WebhookSucceeded, Attempts: job.Attempts, ResponseCode: code, UpdatedAt: m.now().UTC()}
+	if postErr != nil {
+		d.Status, d.LastError = store.WebhookPending, postErr.Error()
+		if job.Attempts >= jobs.MaxAttempts {
+			d.Status = store.WebhookFailed
+		}
+	}
+	if err := m.st.UpdateWebhookDelivery(context.WithoutCancel(ctx), d); err != nil {
+		log.Printf("record delivery %s to webhook %s: %v", d.ID, w.ID, err)
+	}
+	return postErr
+}
+
+// audit records an entry, logging rather than failing on error.
+func (m *Manager) audit(ctx context.Context, actor, action, detail string) {
+	if err := m.st.RecordAudit(ctx, store.AuditEntry{At: m.now().UTC(), Actor: actor, Action: action, Detail: detail}); err != nil {
+		log.Printf("record audit entry %s: %v", action, err)
+	}
+}
+
+// Store wraps a store and publishes an event for every decision recorded
+// through it.
+type Store struct {
+	store.EmailStore
+	m *Manager
+}
+
+// NewStore wraps st to publish decisions through m.
+func NewStore(st store.EmailStore, m *Manager) *Store {
+	return &Store{EmailStore: st, m: m}
+}
+
+// RecordDecision records d, then publishes it. Failing to publish is logged,
+// never returned.
+func (s *Store) RecordDecision(ctx context.Context, d store.Decision) error {
+	if err := s.EmailStore.RecordDecision(ctx, d); err != nil {
+		return err
+	}
+	if err := s.m.Publish(ctx, DecisionEvent(d)); err != nil {
+		log.Printf("publish %s of email %s: %v", d.Decision, d.EmailID, err)
+	}
+	return nil
+}
+
+// DecisionEvent returns the event published for d.
+func DecisionEvent(d store.Decision) notify.Event {
+	e := notify.Event{
+		EmailID:   d.EmailID,
+		Direction: d.Direction,
+		Sender:    d.Sender,
+		Subject:   d.Subject,
+		Reviewer:  d.Reviewer,
+		Time:      d.DecidedAt.UTC(),
+	}
+	switch d.Decision {
+	case store.DecisionApproved:
+		e.Type = EventApproved
+		e.Message = fmt.Sprintf("%s email from %s approved by %s", d.Direction, d.Sender, d.Reviewer)
+	case store.DecisionRejected:
+		e.Type = EventRejected
+		e.Message = fmt.Sprintf("%s email from %s rejected by %s", d.Direction, d.Sender, d.Reviewer)
+	default:
+		e.Type = EventForwarded
+		e.Message = fmt.Sprintf("%s email from %s forwarded to %s by %s", d.Direction, d.Sender, d.ForwardedTo, d.Reviewer)
+	}
+	return e
+}
@@ -0,0 +1,249 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/jobs"
+	"github.com/albert/mailescrow/internal/notify"
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// receiver is a webhook endpoint answering with status.
+type receiver struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	status int
+	events []notify.Event
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e notify.Event
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.events = append(r.events, e)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []notify.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]notify.Event(nil), r.events...)
+}
+
+func setup(t *testing.T) (*store.Memory, *jobs.Queue, *Manager, *store.APIToken) {
+	t.Helper()
+	st := store.NewMemory()
+	q := jobs.New(st)
+	m := New(st, q)
+	m.SetAllowPrivate(true) // the receivers listen on loopback
+	id, err := st.CreateAPIToken(t.Context(), store.APIToken{Name: "app", Hash: "h", Scopes: []string{"webhooks"}})
+	if err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+	return st, q, m, &store.APIToken{ID: id, Name: "app"}
+}
+
+func TestCreateValidates(t *testing.T) {
+	_, _, m, tok := setup(t)
+	for _, tc := range []struct {
+		url       string
+		events    []string
+		direction string
+	}{
+		{"ftp://example.com/hook", nil, ""},
+		{"/hook", nil, ""},
+		{"https://example.com/hook", []string{"email_deleted"}, ""},
+		{"https://example.com/hook", nil, "sideways"},
+	} {
+		if _, err := m.Create(t.Context(), tok, tc.url, tc.events, tc.direction); err == nil {
+			t.Errorf("Create(%q, %v, %q) succeeded, want an error", tc.url, tc.events, tc.direction)
+		}
+	}
+	w, err := m.Create(t.Context(), tok, "https://example.com/hook", []string{EventApproved}, store.DirectionInbound)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if w.ID == "" || w.TokenID != tok.ID {
+		t.Errorf("webhook = %+v", w)
+	}
+}
+
+func TestRefusesInternalHosts(t *testing.T) {
+	_, _, m, tok := setup(t)
+	m.SetAllowPrivate(false)
+	m.lookup = func(_ context.Context, host string) ([]netip.Addr, error) {
+		switch host {
+		case "hooks.example.com":
+			return []netip.Addr{netip.MustParseAddr("93.184.215.14")}, nil
+		case "rebound.example.com":
+			return []netip.Addr{netip.MustParseAddr("93.184.215.14"), netip.MustParseAddr("10.0.0.5")}, nil
+		}
+		return lookupHost(context.Background(), host)
+	}
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"http://[::ffff:192.168.1.1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"https://rebound.example.com/hook",
+	} {
+		if _, err := m.Create(t.Context(), tok, url, nil, ""); err == nil {
+			t.Errorf("Create(%q) succeeded, want an internal address refused", url)
+		}
+	}
+	if _, err := m.Create(t.Context(), tok, "https://hooks.example.com/hook", nil, ""); err != nil {
+		t.Errorf("public host refused: %v", err)
+	}
+
+	// A host resolving to an internal address after it was registered is
+	// refused on delivery.
+	rcv := newReceiver(t, http.StatusOK)
+	wh := notify.NewWebhook(rcv.URL)
+	wh.SetClient(publicClient)
+	if _, err := wh.Deliver(t.Context(), notify.Event{Type: EventApproved}); err == nil || len(rcv.received()) != 0 {
+		t.Errorf("delivery to loopback = %v, want it refused", err)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	st, _, m, tok := setup(t)
+	w, err := m.Create(t.Context(), tok, "https://example.com/hook", nil, "")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	other := &store.APIToken{ID: "other", Name: "other"}
+	if list, _ := m.List(t.Context(), other); len(list) != 0 {
+		t.Errorf("other token lists %d webhooks, want 0", len(list))
+	}
+	if _, err := m.Deliveries(t.Context(), other, w.ID, 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("other token's deliveries: %v, want ErrNotFound", err)
+	}
+	if err := m.Delete(t.Context(), other, w.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("other token's delete: %v, want ErrNotFound", err)
+	}
+	if err := m.Delete(t.Context(), tok, w.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	audit, _ := st.ListAudit(t.Context(), 10)
+	if len(audit) != 2 || audit[0].Action != ActionDelete || audit[1].Action != ActionCreate || audit[0].Actor != "token:app" {
+		t.Errorf("audit = %+v", audit)
+	}
+}
+
+func TestPublishFilters(t *testing.T) {
+	st, q, m, tok := setup(t)
+	all := newReceiver(t, http.StatusNoContent)
+	rejections := newReceiver(t, http.StatusNoContent)
+	outbound := newReceiver(t, http.StatusNoContent)
+	for _, w := range []struct {
+		url       string
+		events    []string
+		direction string
+	}{
+		{all.URL, nil, ""},
+		{rejections.URL, []string{EventRejected}, ""},
+		{outbound.URL, nil, store.DirectionOutbound},
+	} {
+		if _, err := m.Create(t.Context(), tok, w.url, w.events, w.direction); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+
+	hooked := NewStore(st, m)
+	for _, d := range []store.Decision{
+		{EmailID: "e1", Direction: store.DirectionInbound, Sender: "a@example.com", Decision: store.DecisionApproved, Reviewer: "alice", DecidedAt: time.Now()},
+		{EmailID: "e2", Direction: store.DirectionOutbound, Sender: "b@example.com", Decision: store.DecisionRejected, Reviewer: "bob", DecidedAt: time.Now()},
+	} {
+		if err := hooked.RecordDecision(t.Context(), d); err != nil {
+			t.Fatalf("record decision: %v", err)
+		}
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run jobs: %v", err)
+	}
+
+	if got := all.received(); len(got) != 2 || got[0].Type != EventApproved || got[0].Reviewer != "alice" || got[1].Type != EventRejected {
+		t.Errorf("all = %+v, want approved then rejected", got)
+	}
+	if got := rejections.received(); len(got) != 1 || got[0].EmailID != "e2" {
+		t.Errorf("rejections = %+v, want only e2", got)
+	}
+	if got := outbound.received(); len(got) != 1 || got[0].Direction != store.DirectionOutbound {
+		t.Errorf("outbound = %+v, want only e2", got)
+	}
+
+	// Webhooks of revoked tokens hear nothing more.
+	if err := st.RevokeAPIToken(t.Context(), tok.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := hooked.RecordDecision(t.Context(), store.Decision{EmailID: "e3", Decision: store.DecisionApproved}); err != nil {
+		t.Fatalf("record decision: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run jobs: %v", err)
+	}
+	if got := all.received(); len(got) != 2 {
+		t.Errorf("all got %d events after the token was revoked, want 2", len(got))
+	}
+}
+
+func TestDeliveryHistory(t *testing.T) {
+	_, q, m, tok := setup(t)
+	rcv := newReceiver(t, http.StatusServiceUnavailable)
+	w, err := m.Create(t.Context(), tok, rcv.URL, nil, "")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := m.Publish(t.Context(), notify.Event{Type: EventApproved, EmailID: "e1"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run jobs: %v", err)
+	}
+
+	deliveries, err := m.Deliveries(t.Context(), tok, w.ID, 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("deliveries = %d (%v), want 1", len(deliveries), err)
+	}
+	d := deliveries[0]
+	if d.Status != store.WebhookPending || d.Attempts != 1 || d.ResponseCode != http.StatusServiceUnavailable || d.LastError == "" {
+		t.Errorf("failed delivery = %+v, want pending after 1 attempt with 503", d)
+	}
+
+	// The retry succeeds.
+	rcv.mu.Lock()
+	rcv.status = http.StatusOK
+	rcv.mu.Unlock()
+	list, err := q.List(t.Context())
+	if err != nil || len(list) != 1 {
+		t.Fatalf("jobs = %d (%v), want 1", len(list), err)
+	}
+	if err := q.Retry(t.Context(), list[0].ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := q.RunDue(t.Context()); err != nil {
+		t.Fatalf("run jobs: %v", err)
+	}
+	deliveries, _ = m.Deliveries(t.Context(), tok, w.ID, 10)
+	if d := deliveries[0]; d.Status != store.WebhookSucceeded || d.ResponseCode != http.StatusOK {
+		t.Errorf("retried delivery = %+v, want succeeded with 200", d)
+	}
+}
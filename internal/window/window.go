@@ -0,0 +1,169 @@
+// Package window keeps approved outbound mail from being relayed outside
+// configured sending windows, such as business hours. Mail approved while
+// its window is closed waits until the window next opens.
+package window
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+// Window is a recurring period in which the outbound mail it matches may be
+// relayed. Empty Sender, Recipient and Tag match anything. Sender and
+// Recipient are case-insensitive globs over the full address (e.g.
+// "*@example.de"); Recipient must match every recipient.
+type Window struct {
+	Name      string
+	Sender    string
+	Recipient string
+	Tag       string         // the email must carry this tag
+	Days      []time.Weekday // days the window opens; empty means every day
+	Start     time.Duration  // opening time after midnight
+	End       time.Duration  // closing time after midnight; at or before Start for a window that closes the next day
+	Location  *time.Location // time zone of Start and End; nil means the server's
+}
+
+// Schedule applies the first window matching an email. A nil *Schedule lets
+// everything through at once.
+type Schedule struct {
+	windows []Window
+}
+
+// New validates windows and returns a Schedule. Tags are normalized with
+// store.NormalizeTag.
+func New(windows []Window) (*Schedule, error) {
+	windows = slices.Clone(windows)
+	for i, w := range windows {
+		if w.Name == "" {
+			return nil, fmt.Errorf("sending window %d: name is required", i)
+		}
+		if w.Start < 0 || w.Start >= 24*time.Hour || w.End < 0 || w.End > 24*time.Hour {
+			return nil, fmt.Errorf("sending window %s: start and end must be times of day", w.Name)
+		}
+		if w.Start == w.End {
+			return nil, fmt.Errorf("sending window %s: start and end are the same", w.Name)
+		}
+		for _, pattern := range []string{w.Sender, w.Recipient} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("sending window %s: invalid pattern %q: %w", w.Name, pattern, err)
+			}
+		}
+		if w.Tag != "" {
+			tag, err := store.NormalizeTag(w.Tag)
+			if err != nil {
+				return nil, fmt.Errorf("sending window %s: %w", w.Name, err)
+			}
+			windows[i].Tag = tag
+		}
+		if w.Location == nil {
+			windows[i].Location = time.Local
+		}
+	}
+	return &Schedule{windows: windows}, nil
+}
+
+// Next returns when email may be relayed and the name of the window that
+// decides it: now if that window is open, otherwise when it next opens. Mail
+// no window matches may be relayed now, with no window name.
+func (s *Schedule) Next(email *store.Email, now time.Time) (time.Time, string) {
+	if s == nil {
+		return now, ""
+	}
+	for _, w := range s.windows {
+		if w.matches(email) {
+			return w.next(now), w.Name
+		}
+	}
+	return now, ""
+}
+
+func (w Window) matches(email *store.Email) bool {
+	if email.Direction != store.DirectionOutbound {
+		return false
+	}
+	if w.Sender != "" && !matchAddr(w.Sender, email.Sender) {
+		return false
+	}
+	if w.Recipient != "" {
+		for _, rcpt := range email.Recipients {
+			if !matchAddr(w.Recipient, rcpt) {
+				return false
+			}
+		}
+	}
+	return w.Tag == "" || slices.Contains(email.Tags, w.Tag)
+}
+
+// next returns now if the window is open at now, otherwise when it next
+// opens. Openings are computed on the calendar of the window's time zone, so
+// they keep their local time across daylight saving changes.
+func (w Window) next(now time.Time) time.Time {
+	local := now.In(w.Location)
+	y, m, d := local.Date()
+	// Yesterday's opening may still be open past midnight; a week ahead
+	// covers every listed day.
+	for i := -1; i <= 7; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, w.Location)
+		if len(w.Days) > 0 && !slices.Contains(w.Days, day.Weekday()) {
+			continue
+		}
+		opens := clock(day, w.Start)
+		closes := clock(day, w.End)
+		if w.End <= w.Start {
+			closes = clock(day.AddDate(0, 0, 1), w.End)
+		}
+		if now.Before(opens) {
+			return opens
+		}
+		if now.Before(closes) {
+			return now
+		}
+	}
+	return now
+}
+
+// clock returns the time of day offset on day's date, in day's location.
+func clock(day time.Time, offset time.Duration) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, day.Location())
+}
+
+func matchAddr(pattern, addr string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(addr))
+	return ok
+}
+
+// ParseClock parses a time of day such as "09:00" or "17:30" into its offset
+// after midnight. "24:00" is accepted as the end of the day.
+func ParseClock(s string) (time.Duration, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || hours == 24 && minutes > 0 {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+var days = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseDay parses a day of the week by its English name or first three
+// letters, in any case.
+func ParseDay(s string) (time.Weekday, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) >= 3 {
+		if d, ok := days[s[:3]]; ok && strings.HasPrefix(strings.ToLower(d.String()), s) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
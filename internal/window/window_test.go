@@ -0,0 +1,100 @@
+package window
+
+import (
+	"testing"
+	"time"
+
+	"github.com/albert/mailescrow/internal/store"
+)
+
+func TestNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	s, err := New([]Window{
+		{Name: "marketing", Tag: "Marketing", Days: weekdays, Start: 9 * time.Hour, End: 17 * time.Hour, Location: berlin},
+		{Name: "night", Recipient: "*@batch.example.com", Start: 22 * time.Hour, End: 6 * time.Hour, Location: time.UTC},
+	})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	marketing := &store.Email{Direction: store.DirectionOutbound, Sender: "news@example.com", Recipients: []string{"a@example.de"}, Tags: []string{"marketing"}}
+	batch := &store.Email{Direction: store.DirectionOutbound, Sender: "app@example.com", Recipients: []string{"x@batch.example.com"}}
+	other := &store.Email{Direction: store.DirectionOutbound, Sender: "app@example.com", Recipients: []string{"x@batch.example.com", "y@example.org"}}
+
+	at := func(loc *time.Location, s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name       string
+		email      *store.Email
+		now, want  time.Time
+		wantWindow string
+	}{
+		{"open", marketing, at(berlin, "2026-06-03 10:00"), at(berlin, "2026-06-03 10:00"), "marketing"},
+		{"before opening", marketing, at(berlin, "2026-06-03 07:30"), at(berlin, "2026-06-03 09:00"), "marketing"},
+		{"after closing", marketing, at(berlin, "2026-06-03 17:00"), at(berlin, "2026-06-04 09:00"), "marketing"},
+		{"friday evening waits for monday", marketing, at(berlin, "2026-06-05 18:00"), at(berlin, "2026-06-08 09:00"), "marketing"},
+		{"in the window's time zone", marketing, at(time.UTC, "2026-06-03 07:30"), at(time.UTC, "2026-06-03 07:30"), "marketing"},
+		{"across daylight saving", marketing, at(berlin, "2026-03-27 18:00"), at(berlin, "2026-03-30 09:00"), "marketing"},
+		{"overnight, after midnight", batch, at(time.UTC, "2026-06-03 02:00"), at(time.UTC, "2026-06-03 02:00"), "night"},
+		{"overnight, daytime", batch, at(time.UTC, "2026-06-03 12:00"), at(time.UTC, "2026-06-03 22:00"), "night"},
+		{"no window matches", other, at(time.UTC, "2026-06-03 12:00"), at(time.UTC, "2026-06-03 12:00"), ""},
+	}
+	for _, tt := range tests {
+		got, window := s.Next(tt.email, tt.now)
+		if !got.Equal(tt.want) || window != tt.wantWindow {
+			t.Errorf("%s: Next = %s, %q, want %s, %q", tt.name, got, window, tt.want, tt.wantWindow)
+		}
+	}
+
+	var none *Schedule
+	now := time.Now()
+	if got, _ := none.Next(marketing, now); !got.Equal(now) {
+		t.Errorf("nil schedule: Next = %s, want now", got)
+	}
+}
+
+func TestNewRejectsInvalidWindows(t *testing.T) {
+	for _, w := range []Window{
+		{Start: 9 * time.Hour, End: 17 * time.Hour},
+		{Name: "empty", Start: 9 * time.Hour, End: 9 * time.Hour},
+		{Name: "pattern", Sender: "[", Start: 9 * time.Hour, End: 17 * time.Hour},
+		{Name: "tag", Tag: "no spaces", Start: 9 * time.Hour, End: 17 * time.Hour},
+		{Name: "start", Start: 24 * time.Hour, End: 17 * time.Hour},
+	} {
+		if _, err := New([]Window{w}); err == nil {
+			t.Errorf("New(%+v) succeeded, want an error", w)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for s, want := range map[string]time.Duration{"09:00": 9 * time.Hour, "17:30": 17*time.Hour + 30*time.Minute, "24:00": 24 * time.Hour, "0:05": 5 * time.Minute} {
+		if got, err := ParseClock(s); err != nil || got != want {
+			t.Errorf("ParseClock(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"9", "25:00", "24:30", "12:60", "noon"} {
+		if _, err := ParseClock(s); err == nil {
+			t.Errorf("ParseClock(%q) succeeded", s)
+		}
+	}
+	for s, want := range map[string]time.Weekday{"mon": time.Monday, "Friday": time.Friday, "SUN": time.Sunday} {
+		if got, err := ParseDay(s); err != nil || got != want {
+			t.Errorf("ParseDay(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"mo", "monkey", ""} {
+		if _, err := ParseDay(s); err == nil {
+			t.Errorf("ParseDay(%q) succeeded", s)
+		}
+	}
+}